@@ -0,0 +1,148 @@
+package pie
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Alias routes calls to from, which is not a registered method, to the
+// registered method to, so that a provider can rename a method, or replace it
+// with a new version, and still serve hosts that call it by its old name.
+// Both are in "Service.Method" form, and to may itself be an alias, in which
+// case calls are routed to the method it names.  Calls through an alias are
+// served exactly as calls to its method are: Server.Expose, Server.Require,
+// and Server.SetValidator apply to them by the method's name.  The provider's
+// Manifest lists each method's aliases.
+func (s Server) Alias(from, to string) error {
+	if s.d == nil {
+		return errors.New("pie: server cannot be configured")
+	}
+	if service, _, ok := splitServiceMethod(from); !ok || service == "" || strings.HasPrefix(from, controlService+".") {
+		return fmt.Errorf("pie: cannot alias %s: not a method name", from)
+	}
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	if s.d.methods[from] != nil {
+		return fmt.Errorf("pie: cannot alias %s: a method of that name is registered", from)
+	}
+	if _, ok := s.d.routes[from]; ok {
+		return fmt.Errorf("pie: cannot alias %s: it is already routed to %s", from, s.d.routes[from])
+	}
+	if target, ok := s.d.routes[to]; ok {
+		to = target
+	}
+	if s.d.methods[to] == nil {
+		return fmt.Errorf("pie: cannot alias %s to %s: no such method is registered", from, to)
+	}
+	if s.d.routes == nil {
+		s.d.routes = map[string]string{}
+	}
+	s.d.routes[from] = to
+	return nil
+}
+
+// RouteLatest routes calls to each method of the named service that has
+// versioned successors, but no method of its own, to the latest of them.  A
+// successor is a method whose name is the routed name followed by "V" and a
+// version number, so that, if the service Store has methods GetV2 and GetV3
+// but no Get, "Store.Get" is routed to "Store.GetV3".  Names that are already
+// aliases are left as they are.
+func (s Server) RouteLatest(service string) error {
+	if s.d == nil {
+		return errors.New("pie: server cannot be configured")
+	}
+	if !s.d.has(service) {
+		return fmt.Errorf("pie: cannot route %s: no such service is registered", service)
+	}
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	latest := map[string]int{}
+	for name := range s.d.methods {
+		method, ok := strings.CutPrefix(name, service+".")
+		if !ok {
+			continue
+		}
+		base, v, ok := versionSuffix(method)
+		if !ok {
+			continue
+		}
+		if cur, seen := latest[base]; !seen || v > cur {
+			latest[base] = v
+		}
+	}
+	for base, v := range latest {
+		from := service + "." + base
+		if _, ok := s.d.routes[from]; ok || s.d.methods[from] != nil {
+			continue
+		}
+		if s.d.routes == nil {
+			s.d.routes = map[string]string{}
+		}
+		s.d.routes[from] = from + "V" + strconv.Itoa(v)
+	}
+	return nil
+}
+
+// Routes returns the Server's routing table, which maps each alias set with
+// Server.Alias or Server.RouteLatest to the method calls to it are routed to.
+func (s Server) Routes() map[string]string {
+	if s.d == nil {
+		return nil
+	}
+	return s.d.routeTable()
+}
+
+// versionSuffix splits a method name of the form "NameV2" into its name and
+// version, and reports whether it has that form.
+func versionSuffix(method string) (string, int, bool) {
+	i := strings.LastIndexByte(method, 'V')
+	if i <= 0 || i == len(method)-1 {
+		return "", 0, false
+	}
+	digits := method[i+1:]
+	if digits[0] == '0' || strings.Trim(digits, "0123456789") != "" {
+		return "", 0, false
+	}
+	v, err := strconv.Atoi(digits)
+	if err != nil {
+		return "", 0, false
+	}
+	return method[:i], v, true
+}
+
+// route returns the method calls to serviceMethod are routed to, which is
+// serviceMethod itself unless it is an alias.
+func (d *dispatcher) route(serviceMethod string) string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if to, ok := d.routes[serviceMethod]; ok {
+		return to
+	}
+	return serviceMethod
+}
+
+// routeTable returns a copy of the dispatcher's routes.
+func (d *dispatcher) routeTable() map[string]string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	routes := make(map[string]string, len(d.routes))
+	for from, to := range d.routes {
+		routes[from] = to
+	}
+	return routes
+}
+
+// aliases returns the aliases of each routed method, sorted.
+func (d *dispatcher) aliases() map[string][]string {
+	aliases := map[string][]string{}
+	for from, to := range d.routeTable() {
+		aliases[to] = append(aliases[to], from)
+	}
+	for _, a := range aliases {
+		sort.Strings(a)
+	}
+	return aliases
+}
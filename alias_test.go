@@ -0,0 +1,161 @@
+package pie
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type store struct{}
+
+func (store) GetV2(key string, val *string) error {
+	*val = "v2:" + key
+	return nil
+}
+
+func (store) GetV3(key string, val *string) error {
+	*val = "v3:" + key
+	return nil
+}
+
+func (store) List(prefix string) ([]string, error) {
+	return []string{prefix + "a", prefix + "b"}, nil
+}
+
+// routedServer returns a provider serving store, with configure setting up its
+// routes.
+func routedServer(t *testing.T, configure func(Server) error) Server {
+	s := NewProvider()
+	s.RegisterName("Store", store{})
+	if err := configure(s); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestAlias(t *testing.T) {
+	p := pipePlugin(t, routedServer(t, func(s Server) error {
+		if err := s.Alias("Store.Get", "Store.GetV2"); err != nil {
+			return err
+		}
+		if err := s.Alias("Store.Fetch", "Store.Get"); err != nil {
+			return err
+		}
+		return s.Alias("Store.Keys", "Store.List")
+	}))
+	for name, want := range map[string]string{"Store.Get": "v2:k", "Store.Fetch": "v2:k", "Store.GetV3": "v3:k"} {
+		var val string
+		if err := p.Call(name, "k", &val); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if val != want {
+			t.Errorf("%s: expected %q, got %q", name, want, val)
+		}
+	}
+	var keys []string
+	if err := p.Call("Store.Keys", "x", &keys); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"xa", "xb"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Expected %v, got %v", want, keys)
+	}
+	m, err := p.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mi := range m.Methods {
+		if mi.Name == "Store.GetV2" && !reflect.DeepEqual(mi.Aliases, []string{"Store.Fetch", "Store.Get"}) {
+			t.Errorf("Expected Store.GetV2 to list its aliases, got %v", mi.Aliases)
+		}
+		if mi.Name == "Store.GetV3" && mi.Aliases != nil {
+			t.Errorf("Expected Store.GetV3 to have no aliases, got %v", mi.Aliases)
+		}
+	}
+}
+
+func TestAliasErrors(t *testing.T) {
+	s := NewProviderConn(nil)
+	s.RegisterName("Store", store{})
+	for _, tc := range []struct{ from, to, msg string }{
+		{"Get", "Store.GetV2", "not a method name"},
+		{"pie.Ping", "Store.GetV2", "not a method name"},
+		{"Store.GetV3", "Store.GetV2", "a method of that name is registered"},
+		{"Store.Get", "Store.Missing", "no such method is registered"},
+	} {
+		err := s.Alias(tc.from, tc.to)
+		if err == nil || !strings.Contains(err.Error(), tc.msg) {
+			t.Errorf("Alias(%q, %q): expected an error containing %q, got %v", tc.from, tc.to, tc.msg, err)
+		}
+	}
+	if err := s.Alias("Store.Get", "Store.GetV2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Alias("Store.Get", "Store.GetV3"); err == nil {
+		t.Error("Expected an error aliasing a name twice")
+	}
+	if err := (Server{}).Alias("Store.Get", "Store.GetV2"); err == nil {
+		t.Error("Expected an error from a zero Server")
+	}
+}
+
+func TestRouteLatest(t *testing.T) {
+	var routes map[string]string
+	p := pipePlugin(t, routedServer(t, func(s Server) error {
+		if err := s.RouteLatest("Store"); err != nil {
+			return err
+		}
+		routes = s.Routes()
+		return nil
+	}))
+	if want := map[string]string{"Store.Get": "Store.GetV3"}; !reflect.DeepEqual(routes, want) {
+		t.Errorf("Expected routes %v, got %v", want, routes)
+	}
+	var val string
+	if err := p.Call("Store.Get", "k", &val); err != nil {
+		t.Fatal(err)
+	}
+	if val != "v3:k" {
+		t.Errorf("Expected v3:k, got %q", val)
+	}
+	if err := NewProviderConn(nil).RouteLatest("Store"); err == nil {
+		t.Error("Expected an error routing an unknown service")
+	}
+}
+
+func TestAliasExposure(t *testing.T) {
+	p := pipePlugin(t, routedServer(t, func(s Server) error {
+		if err := s.Alias("Store.Get", "Store.GetV2"); err != nil {
+			return err
+		}
+		return s.Expose("Store.GetV3")
+	}))
+	var val string
+	if err := p.Call("Store.Get", "k", &val); err == nil {
+		t.Error("Expected calls through an alias of an unexposed method to fail")
+	}
+	if err := p.Call("Store.GetV3", "k", &val); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVersionSuffix(t *testing.T) {
+	for _, tc := range []struct {
+		method string
+		base   string
+		v      int
+		ok     bool
+	}{
+		{"GetV2", "Get", 2, true},
+		{"GetV10", "Get", 10, true},
+		{"Get", "", 0, false},
+		{"GetV", "", 0, false},
+		{"V2", "", 0, false},
+		{"GetV02", "", 0, false},
+		{"GetVx", "", 0, false},
+	} {
+		base, v, ok := versionSuffix(tc.method)
+		if base != tc.base || v != tc.v || ok != tc.ok {
+			t.Errorf("versionSuffix(%q) = %q, %d, %v; expected %q, %d, %v", tc.method, base, v, ok, tc.base, tc.v, tc.ok)
+		}
+	}
+}
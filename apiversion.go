@@ -0,0 +1,175 @@
+package pie
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"strings"
+)
+
+// VersionMismatchError is returned by StartPlugin, when used with
+// WithAPIVersions, if the plugin implements none of the API versions the host
+// accepts.
+type VersionMismatchError struct {
+	// Accepted are the versions the host accepts.
+	Accepted []string
+	// Offered are the versions the plugin implements.
+	Offered []string
+}
+
+// Error implements the error interface.
+func (e *VersionMismatchError) Error() string {
+	return fmt.Sprintf("plugin implements API versions %s, host accepts %s",
+		strings.Join(e.Offered, ", "), strings.Join(e.Accepted, ", "))
+}
+
+// SetAPIVersions declares the versions of its API that the provider
+// implements, such as "v1" and "v2.3".  Hosts that start the plugin with
+// WithAPIVersions use them to select the version both sides will speak, which
+// is then reported by APIVersion.  On a Server returned by StartConsumer, it
+// declares the versions of the host's API instead, which consumers negotiate
+// with NegotiateHostAPI.  It must be called before Serve.
+func (s Server) SetAPIVersions(versions ...string) error {
+	if s.ctl == nil && s.d == nil {
+		return errors.New("only providers and consuming hosts can declare API versions")
+	}
+	parsed := make([]Version, len(versions))
+	for i, v := range versions {
+		pv, err := ParseVersion(v)
+		if err != nil {
+			return err
+		}
+		parsed[i] = pv
+	}
+	if s.ctl == nil {
+		s.d.mu.Lock()
+		defer s.d.mu.Unlock()
+		s.d.apiVersions = parsed
+		return nil
+	}
+	s.ctl.mu.Lock()
+	defer s.ctl.mu.Unlock()
+	s.ctl.apiVersions = parsed
+	return nil
+}
+
+// APIVersion returns the version of the provider's API selected by the host
+// during the handshake, or of the host's API selected by the consumer, or an
+// empty string if there has been no handshake.
+func (s Server) APIVersion() string {
+	if s.ctl == nil {
+		if s.d == nil {
+			return ""
+		}
+		s.d.mu.RLock()
+		defer s.d.mu.RUnlock()
+		return s.d.apiVersion
+	}
+	s.ctl.mu.Lock()
+	defer s.ctl.mu.Unlock()
+	return s.ctl.apiVersion
+}
+
+// WithAPIVersions makes StartPlugin negotiate the version of the plugin's API
+// to use.  accept lists the versions the host can speak, such as "v1" and
+// "v2.1".  A plugin version is compatible with an accepted version if it has
+// the same major version and is not older, since a plugin implementing v2.3
+// also implements everything in v2.1; for major version zero the minor
+// versions must match too.  The newest accepted version the plugin is
+// compatible with is selected and reported by Plugin.APIVersion, and by
+// Server.APIVersion in the plugin.  If there is none, StartPlugin stops the
+// plugin and returns a *VersionMismatchError.
+//
+// Plugins that declare no API versions, including those built before version
+// negotiation existed, are started with an empty Plugin.APIVersion, so that
+// hosts can fall back to the oldest API they support.
+func WithAPIVersions(accept ...string) StartOption {
+	return func(o *startOptions) {
+		o.apiVersions = accept
+	}
+}
+
+// APIVersion returns the API version selected when the plugin was started with
+// WithAPIVersions.  It is empty if negotiation was not requested, or if the
+// plugin declares no API versions.
+func (p *Plugin) APIVersion() string {
+	return p.apiVersion
+}
+
+// handshake negotiates the API version with the plugin, recording the
+// selected version in p.
+func (p *Plugin) handshake(accept []string) error {
+	v, err := negotiateAPIVersion(p.controlClient(), accept)
+	if err != nil {
+		return err
+	}
+	p.apiVersion = v
+	return nil
+}
+
+// negotiateAPIVersion calls the Handshake method of the control API served to
+// client, returning the version selected from accept, or an empty string if
+// the server declares no versions.
+func negotiateAPIVersion(client *rpc.Client, accept []string) (string, error) {
+	for _, v := range accept {
+		if _, err := ParseVersion(v); err != nil {
+			return "", err
+		}
+	}
+	var offered []string
+	err := client.Call(controlService+".Handshake", accept, &offered)
+	if isMissingMethod(err) || (err == nil && len(offered) == 0) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	v, ok := selectAPIVersion(accept, offered)
+	if !ok {
+		return "", &VersionMismatchError{Accepted: accept, Offered: offered}
+	}
+	return v, nil
+}
+
+// isMissingMethod reports whether err is the error net/rpc returns for a call
+// to a service or method the server does not have.
+func isMissingMethod(err error) bool {
+	var serr rpc.ServerError
+	return errors.As(err, &serr) && strings.HasPrefix(string(serr), "rpc: can't find ")
+}
+
+// selectAPIVersion returns the newest version in accept that a version in
+// offered is compatible with, in canonical form.  Versions that fail to parse
+// are ignored.
+func selectAPIVersion(accept, offered []string) (string, bool) {
+	var best Version
+	found := false
+	for _, a := range accept {
+		av, err := ParseVersion(a)
+		if err != nil || (found && !best.Less(av)) {
+			continue
+		}
+		for _, o := range offered {
+			if ov, err := ParseVersion(o); err == nil && apiCompatible(ov, av) {
+				best, found = av, true
+				break
+			}
+		}
+	}
+	if !found {
+		return "", false
+	}
+	return best.String(), true
+}
+
+// apiCompatible reports whether a plugin implementing version impl can serve a
+// host that speaks version want.
+func apiCompatible(impl, want Version) bool {
+	if impl.Major != want.Major || impl.Less(want) {
+		return false
+	}
+	if impl.Major == 0 && impl.Minor != want.Minor {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package pie
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestSelectAPIVersion(t *testing.T) {
+	tests := []struct {
+		accept, offered []string
+		selected        string
+	}{
+		{[]string{"v1", "v2"}, []string{"v1", "v2"}, "2.0.0"},
+		{[]string{"v1", "v2"}, []string{"v1.3"}, "1.0.0"},
+		{[]string{"v1.1", "v1.4"}, []string{"v1.3"}, "1.1.0"},
+		{[]string{"v2", "v1"}, []string{"v2.5", "v1.0"}, "2.0.0"},
+		{[]string{"v0.2"}, []string{"v0.3"}, ""},
+		{[]string{"v0.2"}, []string{"v0.2.4"}, "0.2.0"},
+		{[]string{"v3"}, []string{"v1", "v2"}, ""},
+		{[]string{"v2"}, []string{"v2.0.0-rc.1"}, ""},
+		{[]string{"bogus", "v1"}, []string{"v1"}, "1.0.0"},
+	}
+	for _, test := range tests {
+		got, ok := selectAPIVersion(test.accept, test.offered)
+		if got != test.selected || ok != (test.selected != "") {
+			t.Errorf("selectAPIVersion(%q, %q) = %q, %v; expected %q", test.accept, test.offered, got, ok, test.selected)
+		}
+	}
+}
+
+func TestStartPluginAPIVersions(t *testing.T) {
+	p, err := StartPlugin(nil, os.Args[0], helperArgs("versioned"), WithAPIVersions("v1", "v2", "v3"))
+	if err != nil {
+		t.Fatalf("Unexpected error from StartPlugin: %#v", err)
+	}
+	defer p.Close()
+	if v := p.APIVersion(); v != "2.0.0" {
+		t.Errorf("Wrong API version selected, expected 2.0.0, got %q", v)
+	}
+	var provider string
+	if err := p.Call("helper.APIVersion", 0, &provider); err != nil {
+		t.Fatalf("Unexpected error getting provider's API version: %#v", err)
+	}
+	if provider != "2.0.0" {
+		t.Errorf("Wrong API version in provider, expected 2.0.0, got %q", provider)
+	}
+}
+
+func TestStartPluginAPIVersionMismatch(t *testing.T) {
+	_, err := StartPlugin(nil, os.Args[0], helperArgs("versioned"), WithAPIVersions("v3"))
+	var mismatch *VersionMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("Expected a *VersionMismatchError, got %#v", err)
+	}
+	if len(mismatch.Offered) != 2 || mismatch.Offered[0] != "1.2.0" || mismatch.Offered[1] != "2.1.0" {
+		t.Errorf("Wrong offered versions in error: %q", mismatch.Offered)
+	}
+}
+
+func TestStartPluginAPIVersionsUndeclared(t *testing.T) {
+	p, err := StartPlugin(nil, os.Args[0], helperArgs("provider"), WithAPIVersions("v1"))
+	if err != nil {
+		t.Fatalf("Unexpected error starting plugin without declared versions: %#v", err)
+	}
+	defer p.Close()
+	if v := p.APIVersion(); v != "" {
+		t.Errorf("Expected no API version for plugin without declared versions, got %q", v)
+	}
+}
@@ -0,0 +1,282 @@
+package pie
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Each message written to a plugin's connection is normally written with its
+// own write, which under a high call rate costs a system call and, for pipes,
+// a context switch per message.  With batching, once the rate of writes is
+// high, small writes are held back for a moment and coalesced into a single
+// write.  At low rates nothing is held back, so batching adds no latency when
+// there is nothing to gain.
+
+// batchingEnv is the environment variable through which the host asks a
+// provider to batch its writes.  Its value is the Batching's threshold, delay,
+// and size, separated by commas.
+const batchingEnv = "PIE_BATCHING"
+
+// batchWindow is how often the rate of writes is measured.
+const batchWindow = 100 * time.Millisecond
+
+// Batching configures the batching of writes to a connection.
+type Batching struct {
+	// Threshold is the rate, in writes per second, above which writes are
+	// batched.  Batching stops when the rate falls below half of it.  It
+	// defaults to 1000.
+	Threshold int
+	// MaxDelay is the longest a write is held back.  It defaults to one
+	// millisecond.
+	MaxDelay time.Duration
+	// MaxBytes is how much data is held back before it is written, even if
+	// MaxDelay has not passed.  Writes at least this big are never held back.
+	// It defaults to 64KiB.
+	MaxBytes int
+}
+
+func (b Batching) threshold() int {
+	if b.Threshold > 0 {
+		return b.Threshold
+	}
+	return 1000
+}
+
+func (b Batching) maxDelay() time.Duration {
+	if b.MaxDelay > 0 {
+		return b.MaxDelay
+	}
+	return time.Millisecond
+}
+
+func (b Batching) maxBytes() int {
+	if b.MaxBytes > 0 {
+		return b.MaxBytes
+	}
+	return 64 << 10
+}
+
+// env returns the value of batchingEnv that asks a provider for b.
+func (b Batching) env() string {
+	return fmt.Sprintf("%d,%s,%d", b.threshold(), b.maxDelay(), b.maxBytes())
+}
+
+// parseBatchingEnv parses the value of batchingEnv.  It returns nil if v is
+// empty or invalid.
+func parseBatchingEnv(v string) *Batching {
+	parts := strings.Split(v, ",")
+	if len(parts) != 3 {
+		return nil
+	}
+	threshold, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil
+	}
+	delay, err := time.ParseDuration(parts[1])
+	if err != nil {
+		return nil
+	}
+	size, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return nil
+	}
+	return &Batching{Threshold: threshold, MaxDelay: delay, MaxBytes: size}
+}
+
+// WithBatching makes the plugin handle coalesce the small messages it writes
+// to the plugin into fewer, bigger writes while the rate of writes is above
+// b's threshold, holding each message back for at most b's MaxDelay.  Plugins
+// started by StartPlugin are asked to batch their replies the same way; the
+// provider must be created with NewProvider by a version of this package that
+// supports it.  For handles created with NewPlugin, the provider can be told
+// with Server.SetBatching.
+//
+// A write that fails after it was held back fails the next write, or Close.
+func WithBatching(b Batching) StartOption {
+	return func(o *startOptions) {
+		o.batching = &b
+	}
+}
+
+// SetBatching makes the Server batch its writes, as a host does with
+// WithBatching, on connections served after it is called.  Providers created
+// with NewProvider for hosts that use WithBatching have batching set already.
+func (s Server) SetBatching(b Batching) error {
+	if s.d == nil {
+		return errors.New("pie: server cannot be configured")
+	}
+	s.d.regMu.Lock()
+	defer s.d.regMu.Unlock()
+	s.d.batching = &b
+	return nil
+}
+
+// batchConn is a connection whose writes are batched while their rate is high.
+type batchConn struct {
+	io.ReadWriteCloser
+	cfg Batching
+
+	mu sync.Mutex
+	// batching is set while writes are held back, and writes counts the
+	// writes since windowStart, to measure their rate.
+	batching    bool
+	writes      int
+	windowStart time.Time
+	// buf holds the writes held back, in a pooled buffer, and timer flushes
+	// them once the delay has passed.
+	buf   []byte
+	timer *time.Timer
+	// err is the error of a write of held back data, which is returned by
+	// later writes.
+	err    error
+	closed bool
+	// Writes to the connection are made without c.mu held, so that Close is
+	// not stuck behind a blocked one, in the order of their tickets: next is
+	// the ticket of the next write, and turn that of the write whose turn it
+	// is.  turned is signalled when turn moves on.
+	next, turn uint64
+	turned     *sync.Cond
+}
+
+// newBatchConn returns rwc with its writes batched as configured by b.
+func newBatchConn(rwc io.ReadWriteCloser, b Batching) *batchConn {
+	c := &batchConn{ReadWriteCloser: rwc, cfg: b, windowStart: time.Now()}
+	c.turned = sync.NewCond(&c.mu)
+	return c
+}
+
+// Write writes p, or holds it back to be written with later writes if the
+// rate of writes is high.
+func (c *batchConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	c.observe(time.Now())
+	if !c.batching || c.closed || len(p) >= c.cfg.maxBytes() {
+		if err := c.flush(); err != nil {
+			return 0, err
+		}
+		return c.write(p)
+	}
+	if len(c.buf)+len(p) > c.cfg.maxBytes() {
+		if err := c.flush(); err != nil {
+			return 0, err
+		}
+	}
+	if c.buf == nil {
+		c.buf = GetBuffer(c.cfg.maxBytes())[:0]
+	}
+	c.buf = append(c.buf, p...)
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.cfg.maxDelay(), c.flushHeld)
+	}
+	return len(p), nil
+}
+
+// observe counts a write made at now, and starts or stops batching when a
+// measurement of the rate of writes is due.  c.mu must be held.
+func (c *batchConn) observe(now time.Time) {
+	c.writes++
+	elapsed := now.Sub(c.windowStart)
+	if elapsed < batchWindow {
+		return
+	}
+	rate := float64(c.writes) / elapsed.Seconds()
+	threshold := float64(c.cfg.threshold())
+	switch {
+	case !c.batching && rate > threshold:
+		c.batching = true
+	case c.batching && rate < threshold/2:
+		c.batching = false
+	}
+	c.writes, c.windowStart = 0, now
+}
+
+// flushHeld writes the data held back, once its delay has passed.
+func (c *batchConn) flushHeld() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timer = nil
+	if !c.closed {
+		c.flush()
+	}
+}
+
+// flush writes the data held back, if any.  c.mu must be held.
+func (c *batchConn) flush() error {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if len(c.buf) == 0 {
+		return nil
+	}
+	held := c.buf
+	c.buf = nil
+	_, err := c.write(held)
+	PutBuffer(held)
+	if err != nil {
+		c.err = err
+	}
+	return err
+}
+
+// Close writes the data held back, and closes the connection.  If a write to
+// the connection is in progress, which might be blocked, the connection is
+// closed right away, as it would be without batching.
+func (c *batchConn) Close() error {
+	c.mu.Lock()
+	if c.busy() {
+		c.closed = true
+		c.mu.Unlock()
+		return c.ReadWriteCloser.Close()
+	}
+	var err error
+	if !c.closed {
+		c.closed = true
+		if c.err == nil {
+			err = c.flush()
+		}
+	}
+	c.mu.Unlock()
+	if cerr := c.ReadWriteCloser.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// write writes p to the connection once the writes before it are done.  c.mu
+// must be held, and is released while waiting and writing.
+func (c *batchConn) write(p []byte) (int, error) {
+	ticket := c.next
+	c.next++
+	for c.turn != ticket {
+		c.turned.Wait()
+	}
+	c.mu.Unlock()
+	n, err := c.ReadWriteCloser.Write(p)
+	c.mu.Lock()
+	c.turn++
+	c.turned.Broadcast()
+	return n, err
+}
+
+// busy reports whether a write to the connection is in progress or waiting.
+// c.mu must be held.
+func (c *batchConn) busy() bool {
+	return c.turn != c.next
+}
+
+// batchingOn reports whether writes are being held back.
+func (c *batchConn) batchingOn() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.batching
+}
@@ -0,0 +1,240 @@
+package pie
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeLog is a connection that records the writes made to it.
+type writeLog struct {
+	mu     sync.Mutex
+	writes [][]byte
+	closed bool
+}
+
+func (w *writeLog) Read(p []byte) (int, error) { return 0, nil }
+
+func (w *writeLog) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes = append(w.writes, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func (w *writeLog) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	return nil
+}
+
+// log returns the number of writes made, and all the data written.
+func (w *writeLog) log() (int, []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.writes), bytes.Join(w.writes, nil)
+}
+
+// heatUp writes to c fast enough, for long enough, to turn batching on.
+func heatUp(t *testing.T, c *batchConn, want *bytes.Buffer) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !c.batchingOn() {
+		if time.Now().After(deadline) {
+			t.Fatal("batching did not start")
+		}
+		c.Write([]byte("x"))
+		want.WriteString("x")
+	}
+}
+
+func TestBatchConnLowRate(t *testing.T) {
+	w := &writeLog{}
+	c := newBatchConn(w, Batching{Threshold: 1 << 30})
+	for i := 0; i < 10; i++ {
+		if _, err := c.Write([]byte("abc")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Nothing is held back, so every write has been made already.
+	if n, data := w.log(); n != 10 || string(data) != "abcabcabcabcabcabcabcabcabcabc" {
+		t.Errorf("Expected 10 writes of abc, got %d writes of %q", n, data)
+	}
+}
+
+func TestBatchConnCoalesces(t *testing.T) {
+	w := &writeLog{}
+	c := newBatchConn(w, Batching{Threshold: 100, MaxDelay: time.Hour, MaxBytes: 1000})
+	var want bytes.Buffer
+	heatUp(t, c, &want)
+	before, _ := w.log()
+	for i := 0; i < 100; i++ {
+		c.Write([]byte("0123456789"))
+		want.WriteString("0123456789")
+	}
+	// The 1000 bytes are coalesced into one or two writes, depending on how
+	// much was held back already, and a write at least MaxBytes big is made
+	// right away, after what was held back.
+	big := bytes.Repeat([]byte("B"), 1000)
+	c.Write(big)
+	want.Write(big)
+	n, data := w.log()
+	if n-before > 3 {
+		t.Errorf("Expected at most 3 writes, got %d", n-before)
+	}
+	if !bytes.Equal(data, want.Bytes()) {
+		t.Errorf("Data was written out of order")
+	}
+}
+
+func TestBatchConnMaxDelay(t *testing.T) {
+	w := &writeLog{}
+	c := newBatchConn(w, Batching{Threshold: 100, MaxDelay: 10 * time.Millisecond})
+	var want bytes.Buffer
+	heatUp(t, c, &want)
+	c.Write([]byte("held"))
+	want.WriteString("held")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, data := w.log(); bytes.Equal(data, want.Bytes()) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("held back data was not written after MaxDelay")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBatchConnStops(t *testing.T) {
+	w := &writeLog{}
+	c := newBatchConn(w, Batching{Threshold: 100, MaxDelay: time.Hour})
+	var want bytes.Buffer
+	heatUp(t, c, &want)
+	time.Sleep(2 * batchWindow)
+	// After a quiet spell the rate is low, so this write is made right away,
+	// after what was held back.
+	c.Write([]byte("cool"))
+	want.WriteString("cool")
+	if c.batchingOn() {
+		t.Error("batching did not stop")
+	}
+	if _, data := w.log(); !bytes.Equal(data, want.Bytes()) {
+		t.Errorf("Expected %d bytes written, got %d", want.Len(), len(data))
+	}
+}
+
+func TestBatchConnCloseFlushes(t *testing.T) {
+	w := &writeLog{}
+	c := newBatchConn(w, Batching{Threshold: 100, MaxDelay: time.Hour})
+	var want bytes.Buffer
+	heatUp(t, c, &want)
+	c.Write([]byte("last"))
+	want.WriteString("last")
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, data := w.log(); !bytes.Equal(data, want.Bytes()) || !w.closed {
+		t.Errorf("Expected held back data written before closing")
+	}
+}
+
+func TestBatchConnCloseBlockedWrite(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	c := newBatchConn(a, Batching{})
+	done := make(chan error, 1)
+	go func() {
+		// Nothing reads b, so this blocks until the connection is closed.
+		_, err := c.Write([]byte("stuck"))
+		done <- err
+	}()
+	for {
+		c.mu.Lock()
+		busy := c.busy()
+		c.mu.Unlock()
+		if busy {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked behind a blocked write")
+	}
+	if err := <-done; err == nil {
+		t.Error("Expected the blocked write to fail")
+	}
+}
+
+func TestParseBatchingEnv(t *testing.T) {
+	b := Batching{Threshold: 500, MaxDelay: 2 * time.Millisecond, MaxBytes: 4096}
+	if got := parseBatchingEnv(b.env()); got == nil || *got != b {
+		t.Errorf("Expected %+v, got %+v", b, got)
+	}
+	for _, v := range []string{"", "1,2", "x,1ms,2", "1,x,2", "1,1ms,x"} {
+		if got := parseBatchingEnv(v); got != nil {
+			t.Errorf("parseBatchingEnv(%q): expected nil, got %+v", v, got)
+		}
+	}
+}
+
+func TestWithBatching(t *testing.T) {
+	p, err := StartPlugin(os.Stderr, os.Args[0], helperArgs("provider"), WithBatching(Batching{Threshold: 10}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	callConcurrently(t, p, 200)
+}
+
+func TestSetBatching(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	s := NewProviderConn(serverConn)
+	s.RegisterName("api", api{})
+	if err := s.SetBatching(Batching{Threshold: 10}); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	p, err := NewPlugin(clientConn, WithBatching(Batching{Threshold: 10}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	callConcurrently(t, p, 200)
+	if err := (Server{}).SetBatching(Batching{}); err == nil {
+		t.Error("Expected an error configuring a consumer's server")
+	}
+}
+
+// callConcurrently makes n calls to p's api.SayHi, several at a time.
+func callConcurrently(t *testing.T, p *Plugin, n int) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < n/8; j++ {
+				var response string
+				if err := p.Call("api.SayHi", "bob", &response); err != nil {
+					t.Error(err)
+					return
+				}
+				if response != "Hi bob" {
+					t.Errorf("Expected %q, got %q", "Hi bob", response)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
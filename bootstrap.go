@@ -0,0 +1,293 @@
+package pie
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Plugins that run as Windows services or GUI subsystem applications, or are
+// otherwise started without usable standard streams, cannot serve RPC over
+// stdin and stdout.  Such plugins can instead connect back to the host over a
+// loopback TCP connection, whose address the host hands them in their
+// environment or on their command line.  The address carries a token, which the
+// plugin sends first so the host knows the connection is from its plugin and
+// not from another local process.
+
+// bootstrapEnv is the environment variable through which the host hands the
+// plugin its bootstrap address.
+const bootstrapEnv = "PIE_BOOTSTRAP"
+
+// bootstrapFlag is the argument through which the host can hand the plugin its
+// bootstrap address instead, as --pie-bootstrap=address.
+const bootstrapFlag = "--pie-bootstrap"
+
+// bootstrapHandshakeTimeout is how long the host waits for a connection to
+// send its token, and the plugin for its connection to the host.
+const bootstrapHandshakeTimeout = 10 * time.Second
+
+// WithSocketBootstrap makes StartPlugin talk to the plugin over a loopback TCP
+// connection the plugin makes back to the host, instead of over its stdin and
+// stdout, for plugins that cannot use their standard streams, such as GUI
+// subsystem applications on Windows.  The plugin's NewProvider connects
+// automatically, using the address passed in its environment.  StartPlugin
+// waits for the connection, until the plugin exits, the context is cancelled,
+// or Timeouts.Ready passes.  What the plugin writes to stdout is written to
+// the output passed to StartPlugin.
+func WithSocketBootstrap() StartOption {
+	return func(o *startOptions) {
+		o.bootstrap = true
+	}
+}
+
+// BootstrapListener accepts connections from plugins the host does not start
+// itself, such as plugins run as Windows services by the service control
+// manager, which cannot inherit pipes from the host.  Hand such a plugin Arg
+// on its command line, or Addr in the PIE_BOOTSTRAP environment variable, and
+// its NewProvider connects back to the listener instead of serving over stdin
+// and stdout.
+type BootstrapListener struct {
+	ln    net.Listener
+	token string
+	// mu serializes accepts, which abort by setting the listener's deadline.
+	mu sync.Mutex
+}
+
+// ListenBootstrap returns a BootstrapListener on a loopback TCP port chosen by
+// the system, with a random token.
+func ListenBootstrap() (*BootstrapListener, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	return &BootstrapListener{ln: ln, token: hex.EncodeToString(token)}, nil
+}
+
+// Addr returns the address plugins connect to, including the listener's token.
+// It should be kept from other users of the machine.
+func (l *BootstrapListener) Addr() string {
+	return "tcp://" + l.ln.Addr().String() + "/" + l.token
+}
+
+// Arg returns the command line argument that hands a plugin Addr.
+func (l *BootstrapListener) Arg() string {
+	return bootstrapFlag + "=" + l.Addr()
+}
+
+// Accept waits for a plugin to connect with the listener's token, and returns
+// a handle for it like one NewPluginContext returns.  Connections without the
+// token are closed.  Accept returns when ctx is cancelled, or the listener is
+// closed.
+func (l *BootstrapListener) Accept(ctx context.Context, opts ...StartOption) (*Plugin, error) {
+	conn, err := l.accept(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return NewPluginContext(ctx, conn, opts...)
+}
+
+// Close closes the listener.  Plugins already accepted are not affected.
+func (l *BootstrapListener) Close() error {
+	return l.ln.Close()
+}
+
+// accept returns the first connection that sends the listener's token, giving
+// up when ctx is cancelled or exited is closed.  Each connection is checked on
+// its own, so one that sends nothing holds up neither the others nor giving
+// up.
+func (l *BootstrapListener) accept(ctx context.Context, exited <-chan struct{}) (net.Conn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// done is closed once accept returns, after which checked connections
+	// are closed rather than handed over.
+	done := make(chan struct{})
+	checked := make(chan net.Conn)
+	failed := make(chan error, 1)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			conn, err := l.ln.Accept()
+			if err != nil {
+				failed <- err
+				return
+			}
+			go func() {
+				if !l.check(conn) {
+					conn.Close()
+					return
+				}
+				select {
+				case checked <- conn:
+				case <-done:
+					conn.Close()
+				}
+			}()
+		}
+	}()
+	var conn net.Conn
+	var err error
+	select {
+	case conn = <-checked:
+	case err = <-failed:
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-exited:
+		err = errors.New("pie: plugin exited before connecting to the host")
+	}
+	close(done)
+	// Stop the accepting goroutine, so it cannot take a later plugin's
+	// connection.
+	if tl, ok := l.ln.(*net.TCPListener); ok {
+		tl.SetDeadline(time.Unix(1, 0))
+		<-stopped
+		tl.SetDeadline(time.Time{})
+	}
+	return conn, err
+}
+
+// check reports whether conn sends the listener's token.
+func (l *BootstrapListener) check(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(bootstrapHandshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	got := make([]byte, len(l.token))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(got, []byte(l.token)) == 1
+}
+
+// bootstrapPipe returns pipe, a started plugin's pipes, with conn in place of
+// its stdin and stdout, which are closed along with conn.  What the plugin
+// writes to stdout is copied to output.
+func bootstrapPipe(pipe ioPipe, conn net.Conn, output io.Writer) ioPipe {
+	if output == nil {
+		output = io.Discard
+	}
+	go io.Copy(output, pipe.ReadCloser)
+	return ioPipe{
+		ReadCloser: conn,
+		WriteCloser: struct {
+			io.Writer
+			io.Closer
+		}{conn, newRWCloser(pipe.ReadCloser, pipe.WriteCloser)},
+		proc:        pipe.proc,
+		stopTimeout: pipe.stopTimeout,
+		once:        pipe.once,
+	}
+}
+
+// bootstrapArg returns the bootstrap address handed to the plugin on its
+// command line or in its environment, or an empty string if there is none.
+// The argument is removed from os.Args.
+func bootstrapArg() string {
+	addr := ""
+	args := append([]string(nil), os.Args[:1]...)
+	for _, arg := range os.Args[1:] {
+		if v, ok := strings.CutPrefix(arg, bootstrapFlag+"="); ok {
+			addr = v
+			continue
+		}
+		if v, ok := strings.CutPrefix(arg, bootstrapFlag[1:]+"="); ok {
+			addr = v
+			continue
+		}
+		args = append(args, arg)
+	}
+	if addr != "" {
+		os.Args = args
+		return addr
+	}
+	return providerGetenv(bootstrapEnv)
+}
+
+// dialBootstrap connects to the host at the bootstrap address addr, and sends
+// it the address's token.
+func dialBootstrap(addr string) (net.Conn, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("pie: bad bootstrap address: %w", err)
+	}
+	if u.Scheme != "tcp" || u.Host == "" {
+		return nil, fmt.Errorf("pie: bad bootstrap address %q", addr)
+	}
+	conn, err := net.DialTimeout("tcp", u.Host, bootstrapHandshakeTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("pie: connecting to the host: %w", err)
+	}
+	if _, err := io.WriteString(conn, strings.TrimPrefix(u.Path, "/")); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("pie: connecting to the host: %w", err)
+	}
+	return conn, nil
+}
+
+// providerConn returns the connection NewProvider serves over: the one to the
+// host at the bootstrap address, if the plugin was handed one, the socket a
+// supervisor such as inetd accepted for it, or else stdin and stdout.  If none
+// can be had, the connection fails every read and write with the reason.
+func providerConn() io.ReadWriteCloser {
+	if addr := bootstrapArg(); addr != "" {
+		conn, err := dialBootstrap(addr)
+		if err != nil {
+			return brokenConn{err}
+		}
+		return newRWCloser(conn, framedStdout(nopWriteCloser{conn}))
+	}
+	if conn := inheritedConn(); conn != nil {
+		return conn
+	}
+	if !usableStdio() {
+		return brokenConn{errors.New("pie: no usable stdin and stdout, and no bootstrap address")}
+	}
+	return newRWCloser(os.Stdin, framedStdout(guardedStdout()))
+}
+
+// usableStdio reports whether the plugin's stdin and stdout are open, which
+// they are not in a Windows service or GUI subsystem application.
+func usableStdio() bool {
+	for _, f := range []*os.File{os.Stdin, os.Stdout} {
+		if f == nil {
+			return false
+		}
+		if _, err := f.Stat(); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// nopWriteCloser is a writer whose Close does nothing, for the write side of a
+// connection that is closed through its read side.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+// Close does nothing.
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// brokenConn is a connection that could not be made, which fails every read
+// and write with the reason.
+type brokenConn struct {
+	err error
+}
+
+func (c brokenConn) Read([]byte) (int, error)  { return 0, c.err }
+func (c brokenConn) Write([]byte) (int, error) { return 0, c.err }
+func (c brokenConn) Close() error              { return nil }
@@ -0,0 +1,195 @@
+package pie
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSocketBootstrap(t *testing.T) {
+	var output lockedBuffer
+	p, err := StartPlugin(&output, os.Args[0], helperArgs("provider"), WithSocketBootstrap())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	var reply string
+	if err := p.Call("api.SayHi", "bootstrap", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "Hi bootstrap" {
+		t.Errorf("Expected Hi bootstrap, got %q", reply)
+	}
+	if err := p.Call("helper.Print", "to stdout", new(int)); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(output.String(), "to stdout") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(output.String(), "to stdout") {
+		t.Errorf("Expected the plugin's stdout in the output, got %q", output.String())
+	}
+	if err := p.Close(); err != nil {
+		t.Errorf("Unexpected error closing the plugin: %v", err)
+	}
+}
+
+func TestSocketBootstrapExited(t *testing.T) {
+	// The test binary exits without connecting when it runs no tests.
+	_, err := StartPlugin(nil, os.Args[0], []string{"-test.run=^$"}, WithSocketBootstrap())
+	if err == nil || !strings.Contains(err.Error(), "exited before connecting") {
+		t.Errorf("Expected an error for a plugin that exits without connecting, got %v", err)
+	}
+}
+
+func TestBootstrapListener(t *testing.T) {
+	l, err := ListenBootstrap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if !strings.HasPrefix(l.Arg(), "--pie-bootstrap=tcp://127.0.0.1:") {
+		t.Errorf("Unexpected argument %q", l.Arg())
+	}
+	// A connection without the token is turned away.
+	addr := strings.TrimPrefix(l.Addr(), "tcp://")
+	addr = addr[:strings.IndexByte(addr, '/')]
+	impostor, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer impostor.Close()
+	impostor.Write([]byte(strings.Repeat("0", 64)))
+
+	cmd := exec.Command(os.Args[0], helperArgs("provider")[0], l.Arg())
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	p, err := l.Accept(ctx)
+	if err != nil {
+		cmd.Process.Kill()
+		t.Fatal(err)
+	}
+	defer p.Close()
+	var reply string
+	if err := p.Call("api.SayHi", "service", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "Hi service" {
+		t.Errorf("Expected Hi service, got %q", reply)
+	}
+	p.Close()
+	if _, err := impostor.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected the impostor's connection to be closed")
+	}
+}
+
+func TestBootstrapListenerCancel(t *testing.T) {
+	l, err := ListenBootstrap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.Accept(ctx); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	// The listener still accepts after an abandoned accept.
+	dialed := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := dialBootstrap(l.Addr())
+		dialed <- conn
+	}()
+	conn, err := l.accept(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if conn := <-dialed; conn != nil {
+		conn.Close()
+	}
+}
+
+func TestBootstrapListenerSilentConn(t *testing.T) {
+	l, err := ListenBootstrap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr := strings.TrimPrefix(l.Addr(), "tcp://")
+	addr = addr[:strings.IndexByte(addr, '/')]
+	silent, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	// A connection that sends nothing does not hold up the plugin's.
+	dialed := make(chan net.Conn, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		conn, _ := dialBootstrap(l.Addr())
+		dialed <- conn
+	}()
+	start := time.Now()
+	conn, err := l.accept(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if conn := <-dialed; conn != nil {
+		conn.Close()
+	}
+	if d := time.Since(start); d > bootstrapHandshakeTimeout/2 {
+		t.Errorf("Expected the plugin's connection to be accepted at once, took %v", d)
+	}
+
+	// Nor giving up.
+	silent2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent2.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if _, err := l.accept(ctx, nil); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if d := time.Since(start); d > bootstrapHandshakeTimeout/2 {
+		t.Errorf("Expected accept to give up at once, took %v", d)
+	}
+}
+
+func TestBootstrapArg(t *testing.T) {
+	args := os.Args
+	defer func() { os.Args = args }()
+	os.Args = []string{"plugin", "-v", "--pie-bootstrap=tcp://127.0.0.1:1/abc", "x"}
+	if got := bootstrapArg(); got != "tcp://127.0.0.1:1/abc" {
+		t.Errorf("Expected the address from the command line, got %q", got)
+	}
+	if strings.Join(os.Args, " ") != "plugin -v x" {
+		t.Errorf("Expected the argument to be removed, got %q", os.Args)
+	}
+	t.Setenv(bootstrapEnv, "tcp://127.0.0.1:2/def")
+	if got := bootstrapArg(); got != "tcp://127.0.0.1:2/def" {
+		t.Errorf("Expected the address from the environment, got %q", got)
+	}
+}
+
+func TestDialBootstrapBadAddress(t *testing.T) {
+	for _, addr := range []string{"udp://127.0.0.1:1/abc", "tcp:///abc", "%"} {
+		if _, err := dialBootstrap(addr); err == nil {
+			t.Errorf("Expected an error dialing %q", addr)
+		}
+	}
+}
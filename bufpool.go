@@ -0,0 +1,63 @@
+package pie
+
+import "sync"
+
+// Frames are read into and written from buffers taken from a pool shared by
+// the framing layer, the mux, and codecs, so that a busy connection does not
+// allocate a buffer for every message.  The pool is split into size classes,
+// each a sync.Pool of buffers of one capacity, so that small messages do not
+// hold on to big buffers.
+
+// bufferClasses are the capacities of the pool's size classes, smallest first.
+// Buffers bigger than the largest class are allocated and never pooled.
+var bufferClasses = [...]int{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20}
+
+var bufferPools [len(bufferClasses)]sync.Pool
+
+// GetBuffer returns a buffer of length n from pie's buffer pool.  Its contents
+// are undefined.  The caller owns the buffer, and may give it back with
+// PutBuffer once it is done with it, or simply drop it.
+//
+// Codecs registered with RegisterCodec can use GetBuffer and PutBuffer for
+// their own buffers, sharing the pool with pie's framing.
+func GetBuffer(n int) []byte {
+	c := bufferClass(n)
+	if c < 0 {
+		return make([]byte, n)
+	}
+	if b, ok := bufferPools[c].Get().(*[]byte); ok {
+		return (*b)[:n]
+	}
+	return make([]byte, n, bufferClasses[c])
+}
+
+// PutBuffer gives b back to pie's buffer pool, for reuse by a later call to
+// GetBuffer.  Neither b nor any slice of it may be used afterwards.  Buffers
+// handed to callers without copying, such as those returned by
+// Stream.ReadBuffer and FrameDecoder.Decode, may be given back too; buffers
+// that did not come from the pool are accepted if they are big enough to be
+// useful, and dropped otherwise.
+func PutBuffer(b []byte) {
+	// A buffer goes to the biggest class it can serve, so that slices of
+	// pooled buffers, whose capacity has shrunk, are still reused.
+	c := len(bufferClasses) - 1
+	for c >= 0 && cap(b) < bufferClasses[c] {
+		c--
+	}
+	if c < 0 || cap(b) > 2*bufferClasses[len(bufferClasses)-1] {
+		return
+	}
+	b = b[:0:bufferClasses[c]]
+	bufferPools[c].Put(&b)
+}
+
+// bufferClass returns the smallest size class that holds n bytes, or -1 if n
+// is bigger than the largest class.
+func bufferClass(n int) int {
+	for c, size := range bufferClasses {
+		if n <= size {
+			return c
+		}
+	}
+	return -1
+}
@@ -0,0 +1,75 @@
+package pie
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGetBuffer(t *testing.T) {
+	for _, tc := range []struct {
+		n, cap int
+	}{
+		{0, 1 << 10},
+		{1, 1 << 10},
+		{1 << 10, 1 << 10},
+		{1<<10 + 1, 4 << 10},
+		{muxHeaderLen + muxMaxFrame, 64 << 10},
+		{1 << 20, 1 << 20},
+		{1<<20 + 1, 1<<20 + 1},
+	} {
+		b := GetBuffer(tc.n)
+		if len(b) != tc.n || cap(b) != tc.cap {
+			t.Errorf("GetBuffer(%d): expected len %d cap %d, got len %d cap %d", tc.n, tc.n, tc.cap, len(b), cap(b))
+		}
+		PutBuffer(b)
+	}
+}
+
+func TestPutBufferSlice(t *testing.T) {
+	// Slices of pooled buffers, and buffers that never came from the pool, go
+	// back to a class they can serve.
+	for _, b := range [][]byte{
+		GetBuffer(64 << 10)[100:],
+		make([]byte, 5000),
+		make([]byte, 10),
+		nil,
+	} {
+		PutBuffer(b)
+	}
+	for i := 0; i < 100; i++ {
+		b := GetBuffer(16 << 10)
+		if len(b) != 16<<10 || cap(b) < 16<<10 {
+			t.Fatalf("GetBuffer(%d): got len %d cap %d", 16<<10, len(b), cap(b))
+		}
+		PutBuffer(b[7:])
+	}
+}
+
+func TestFrameDecoderHandsOffPayloads(t *testing.T) {
+	var wire bytes.Buffer
+	for _, format := range []FrameFormat{PlainFrames, ChecksummedFrames} {
+		enc := NewFrameEncoder(&wire, format)
+		for _, p := range []string{"one", "", "three"} {
+			if err := enc.Encode([]byte(p)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	dec := NewFrameDecoder(&wire)
+	var got [][]byte
+	for i := 0; i < 6; i++ {
+		p, err := dec.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, p)
+	}
+	// Payloads are not overwritten by later decoding until they are given
+	// back.
+	for i, want := range []string{"one", "", "three", "one", "", "three"} {
+		if string(got[i]) != want {
+			t.Errorf("payload %d: expected %q, got %q", i, want, got[i])
+		}
+		PutBuffer(got[i])
+	}
+}
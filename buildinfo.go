@@ -0,0 +1,219 @@
+package pie
+
+import (
+	"context"
+	"encoding/json"
+	"net/rpc"
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// hostBuildEnv is the environment variable through which StartPlugin tells
+// the provider the host's build information, as JSON.
+const hostBuildEnv = "PIE_HOST_BUILD"
+
+// BuildInfo describes how a host or plugin binary was built, and the platform
+// and locale it runs in.  The host and the plugin exchange theirs, which makes
+// them available for support requests and compatibility checks.
+type BuildInfo struct {
+	// Path is the path of the main module, such as
+	// "github.com/example/resizer".
+	Path string
+	// Version is the version of the main module, which is "(devel)" for
+	// binaries not built from a tagged module version.
+	Version string
+	// Revision is the version control revision the binary was built from, if
+	// it was recorded.
+	Revision string
+	// GoVersion is the version of Go the binary was built with.
+	GoVersion string
+	// OS and Arch are the binary's GOOS and GOARCH.
+	OS, Arch string
+	// Locale is the locale the process runs in, from LC_ALL or LANG, and
+	// TimeZone its TZ.  Either is empty if the process uses the system's
+	// default.  See WithLocale.
+	Locale, TimeZone string
+}
+
+// String returns a short, human readable description of the build, such as
+// "github.com/example/resizer v1.2.3 (go1.22.1 linux/amd64)".
+func (b BuildInfo) String() string {
+	if b == (BuildInfo{}) {
+		return "unknown build"
+	}
+	s := b.Path
+	if b.Version != "" {
+		s += " " + b.Version
+	}
+	return s + " (" + b.GoVersion + " " + b.OS + "/" + b.Arch + ")"
+}
+
+var (
+	buildInfoOnce sync.Once
+	buildInfoMu   sync.Mutex
+	buildInfo     BuildInfo
+)
+
+// CurrentBuildInfo returns the build information of the running binary.
+func CurrentBuildInfo() BuildInfo {
+	buildInfoOnce.Do(func() {
+		buildInfo = BuildInfo{GoVersion: runtime.Version(), OS: runtime.GOOS, Arch: runtime.GOARCH}
+		bi, ok := debug.ReadBuildInfo()
+		if !ok {
+			return
+		}
+		buildInfo.Path = bi.Main.Path
+		buildInfo.Version = bi.Main.Version
+		for _, s := range bi.Settings {
+			if s.Key == "vcs.revision" {
+				buildInfo.Revision = s.Value
+			}
+		}
+	})
+	buildInfoMu.Lock()
+	b := buildInfo
+	buildInfoMu.Unlock()
+	b.Locale, b.TimeZone = currentLocale()
+	return b
+}
+
+// env returns the value of hostBuildEnv for b.
+func (b BuildInfo) env() string {
+	data, _ := json.Marshal(b)
+	return string(data)
+}
+
+// parseBuildInfoEnv parses the value of hostBuildEnv, returning nil if it is
+// not valid.
+func parseBuildInfoEnv(s string) *BuildInfo {
+	var b BuildInfo
+	if json.Unmarshal([]byte(s), &b) != nil {
+		return nil
+	}
+	return &b
+}
+
+// isServerError reports whether err is an error returned by the plugin's
+// server.
+func isServerError(err error) bool {
+	_, ok := err.(rpc.ServerError)
+	return ok
+}
+
+// BuildInfo returns the plugin's build information.  If the host waited for
+// the plugin to become ready, as StartPluginContext does, the host and the
+// plugin exchanged build information then; otherwise the first call exchanges
+// it, within the Timeouts.Call timeout, if one is set.  Later calls return
+// what the plugin sent.  It is the zero BuildInfo if the plugin was created by
+// a version of this package that cannot exchange it, or is not a pie provider.
+func (p *Plugin) BuildInfo() (BuildInfo, error) {
+	p.buildMu.Lock()
+	defer p.buildMu.Unlock()
+	if p.buildInfo == nil {
+		if _, err := p.exchangeLater(); err != nil {
+			return BuildInfo{}, err
+		}
+	}
+	return *p.buildInfo, nil
+}
+
+// exchangeLater exchanges build information with the plugin after it was
+// started without it, with p.buildMu held, within the Timeouts.Call timeout,
+// if one is set.
+func (p *Plugin) exchangeLater() (BuildReply, error) {
+	ctx := context.Background()
+	if p.callTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.callTimeout)
+		defer cancel()
+	}
+	reply, err := p.exchangeBuildInfo(ctx)
+	if err == context.DeadlineExceeded {
+		err = ErrCallTimeout
+	}
+	return reply, err
+}
+
+// handshakeBuildInfo exchanges build information with the plugin as it is
+// started, giving up when ctx is done, and returns why the plugin refuses the
+// host's calls, if it does.
+func (p *Plugin) handshakeBuildInfo(ctx context.Context) error {
+	p.buildMu.Lock()
+	defer p.buildMu.Unlock()
+	reply, err := p.exchangeBuildInfo(ctx)
+	if err != nil {
+		return err
+	}
+	if reply.Refused != nil {
+		return reply.Refused
+	}
+	return nil
+}
+
+// HostBuildInfo returns the build information of the host the provider is
+// serving.  Hosts that start the plugin with StartPlugin send it through the
+// plugin's environment, so that it is known from the start; hosts connected
+// with NewPlugin send it as they connect, if they wait for the plugin to
+// become ready, and otherwise when a call fails or they call Plugin.BuildInfo.
+// It is the zero BuildInfo until the host has sent it.
+func (s Server) HostBuildInfo() BuildInfo {
+	if s.d == nil {
+		return BuildInfo{}
+	}
+	s.d.regMu.Lock()
+	defer s.d.regMu.Unlock()
+	if s.d.hostBuild == nil {
+		return BuildInfo{}
+	}
+	return *s.d.hostBuild
+}
+
+// BuildReply is the plugin's reply to the host's build information.
+// Applications do not need to use it; it is exported because net/rpc requires
+// the types of the replies of the methods it serves to be.
+type BuildReply struct {
+	// Build is the plugin's build information.
+	Build BuildInfo
+	// Refused, if not nil, is why the plugin refuses the host's calls: the
+	// host does not meet the plugin's version requirement.
+	Refused *VersionRequirementError
+	// Admitted reports whether the plugin refused the host's calls because
+	// it did not know the host's version, and no longer does.
+	Admitted bool
+}
+
+// BuildInfo records the host's build information, and replies with the
+// plugin's, and with why the plugin refuses the host's calls, if it does.
+func (c *control) BuildInfo(host BuildInfo, reply *BuildReply) error {
+	before := c.d.hostError()
+	c.d.setHostBuild(host)
+	reply.Build = CurrentBuildInfo()
+	reply.Refused = c.d.hostError()
+	reply.Admitted = before != nil && reply.Refused == nil
+	return nil
+}
+
+// exchangeBuildInfo sends the host's build information to the plugin, with
+// p.buildMu held, and records the plugin's reply, giving up when ctx is done.
+// Plugins that cannot exchange build information are recorded with the zero
+// BuildInfo.
+func (p *Plugin) exchangeBuildInfo(ctx context.Context) (BuildReply, error) {
+	reply := new(BuildReply)
+	call := p.controlClient().Go(controlService+".BuildInfo", CurrentBuildInfo(), reply, make(chan *rpc.Call, 1))
+	var err error
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-ctx.Done():
+		return BuildReply{}, ctx.Err()
+	}
+	if isServerError(err) {
+		reply, err = new(BuildReply), nil
+	}
+	if err != nil {
+		return BuildReply{}, err
+	}
+	p.buildInfo = &reply.Build
+	return *reply, nil
+}
@@ -0,0 +1,148 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/rpc"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestCurrentBuildInfo(t *testing.T) {
+	b := CurrentBuildInfo()
+	if b.GoVersion != runtime.Version() || b.OS != runtime.GOOS || b.Arch != runtime.GOARCH {
+		t.Errorf("Wrong platform in build info %+v", b)
+	}
+	if s := b.String(); s == "" || s == "unknown build" {
+		t.Errorf("Unexpected description %q", s)
+	}
+	if s := (BuildInfo{}).String(); s != "unknown build" {
+		t.Errorf("Expected the zero BuildInfo to be an unknown build, got %q", s)
+	}
+}
+
+func TestBuildInfoStartPlugin(t *testing.T) {
+	p := startHelper(t, "provider", os.Stderr)
+	defer p.Close()
+	// The host's build information reaches the plugin through its
+	// environment, before any exchange.
+	var host BuildInfo
+	if err := p.Call("helper.HostBuildInfo", 0, &host); err != nil {
+		t.Fatal(err)
+	}
+	if host != CurrentBuildInfo() {
+		t.Errorf("Expected the plugin to see the host's build info %+v, got %+v", CurrentBuildInfo(), host)
+	}
+	info, err := p.BuildInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The helper is this test binary, so it was built the same way.
+	if info != CurrentBuildInfo() {
+		t.Errorf("Expected the plugin's build info %+v, got %+v", CurrentBuildInfo(), info)
+	}
+}
+
+func TestBuildInfoNewPlugin(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	s := NewProviderConn(serverConn)
+	s.RegisterName("api", api{})
+	go s.Serve()
+	p, err := NewPlugin(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if got := s.HostBuildInfo(); got != (BuildInfo{}) {
+		t.Errorf("Expected no host build info before the exchange, got %+v", got)
+	}
+	if _, err := p.BuildInfo(); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.HostBuildInfo(); got != CurrentBuildInfo() {
+		t.Errorf("Expected the provider to have the host's build info %+v, got %+v", CurrentBuildInfo(), got)
+	}
+}
+
+func TestBuildInfoHandshake(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	s := NewProviderConn(serverConn)
+	s.RegisterName("api", api{})
+	go s.Serve()
+	p, err := NewPluginContext(context.Background(), clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	// The build information was exchanged as the plugin was connected.
+	if got := s.HostBuildInfo(); got != CurrentBuildInfo() {
+		t.Errorf("Expected the provider to have the host's build info %+v, got %+v", CurrentBuildInfo(), got)
+	}
+	before := p.ConnStats()
+	if info, err := p.BuildInfo(); err != nil || info != CurrentBuildInfo() {
+		t.Errorf("Expected the plugin's build info %+v, got %+v, %v", CurrentBuildInfo(), info, err)
+	}
+	if after := p.ConnStats(); after.FramesSent != before.FramesSent {
+		t.Errorf("Expected BuildInfo to make no call, sent %d frames", after.FramesSent-before.FramesSent)
+	}
+}
+
+// stalledBuild is a control service that answers pings, but not the host's
+// build information.
+type stalledBuild struct{ stop chan struct{} }
+
+func (stalledBuild) Ping(_ int, n *int) error { return nil }
+
+func (s stalledBuild) BuildInfo(_ BuildInfo, _ *BuildReply) error {
+	<-s.stop
+	return nil
+}
+
+func TestBuildInfoHandshakeTimeout(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	s := rpc.NewServer()
+	stall := stalledBuild{stop: make(chan struct{})}
+	defer close(stall.stop)
+	s.RegisterName(controlService, stall)
+	go s.ServeConn(serverConn)
+	start := time.Now()
+	_, err := NewPlugin(clientConn, WithTimeouts(Timeouts{Ready: 100 * time.Millisecond}))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the exchange to time out, got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Expected the exchange to be bounded by the ready timeout, took %v", d)
+	}
+}
+
+func TestBuildInfoOldPlugin(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	s := rpc.NewServer()
+	s.RegisterName("api", api{})
+	go s.ServeConn(serverConn)
+	p, err := NewPlugin(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	info, err := p.BuildInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info != (BuildInfo{}) {
+		t.Errorf("Expected no build info from a plain rpc server, got %+v", info)
+	}
+}
+
+func TestParseBuildInfoEnv(t *testing.T) {
+	b := BuildInfo{Path: "example.com/host", Version: "v1.2.3", GoVersion: "go1.22", OS: "linux", Arch: "arm64"}
+	if got := parseBuildInfoEnv(b.env()); got == nil || *got != b {
+		t.Errorf("Expected %+v, got %+v", b, got)
+	}
+	if got := parseBuildInfoEnv("garbage"); got != nil {
+		t.Errorf("Expected no BuildInfo for garbage, got %+v", got)
+	}
+}
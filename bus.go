@@ -0,0 +1,408 @@
+package pie
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"path"
+	"strings"
+	"sync"
+)
+
+// busChannel is the name of the channel a Bus opens to each attached plugin.
+const busChannel = "pie.bus"
+
+// busQueueSize is the most events held for a plugin that has not fetched
+// them.  Older events are dropped to make room for new ones.
+const busQueueSize = 1024
+
+// ErrBusDenied is returned when a plugin publishes or subscribes to events its
+// BusACL does not allow.  Check for it with errors.Is.
+var ErrBusDenied = errors.New("not allowed by bus ACL")
+
+// BusEvent is an event published on a Bus.
+type BusEvent struct {
+	// Name is the name of the event, such as "orders.created".
+	Name string
+	Data []byte
+	// Source is the name of the plugin that published the event, or empty
+	// for events published by the host.
+	Source string
+}
+
+// BusACL lists the events a plugin may publish and subscribe to on a Bus, as
+// path.Match patterns of event names.  A plugin may subscribe with a pattern
+// only if one of its Subscribe patterns matches it, and it is only sent events
+// whose names match one of its Subscribe patterns.
+type BusACL struct {
+	Publish   []string
+	Subscribe []string
+}
+
+// allows reports whether one of patterns matches name.
+func allows(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Bus carries named events between the host and the plugins attached to it.
+// Plugins publish events, and the host and other plugins subscribe to them by
+// pattern, as allowed by each plugin's BusACL.  Plugins without an ACL may not
+// publish or subscribe to anything.
+//
+// A host attaches plugins with Bus.Attach, or by setting the Bus of a Manager,
+// which attaches every plugin it starts.  Providers take part with JoinBus.
+// Events are delivered in the order they were published, and are dropped for
+// a plugin that falls more than 1024 events behind.
+type Bus struct {
+	mu    sync.Mutex
+	acls  map[string]BusACL
+	subs  map[*busSub]bool
+	conns map[*busConn]bool
+}
+
+// busSub is a subscription of the host.
+type busSub struct {
+	pattern string
+	fn      func(BusEvent)
+}
+
+// NewBus returns an empty Bus.
+func NewBus() *Bus {
+	return &Bus{acls: map[string]BusACL{}, subs: map[*busSub]bool{}, conns: map[*busConn]bool{}}
+}
+
+// SetACL sets what the named plugin may publish and subscribe to.  Events
+// already queued for the plugin are still delivered.
+func (b *Bus) SetACL(plugin string, acl BusACL) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.acls[plugin] = acl
+}
+
+// acl returns the named plugin's ACL.
+func (b *Bus) acl(plugin string) BusACL {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.acls[plugin]
+}
+
+// Publish publishes an event from the host.
+func (b *Bus) Publish(name string, data []byte) {
+	b.publish(BusEvent{Name: name, Data: data})
+}
+
+// Subscribe calls fn with each event whose name matches pattern, a path.Match
+// pattern, until the returned function is called.  fn is called synchronously
+// by the publisher, and so must not block.
+func (b *Bus) Subscribe(pattern string, fn func(BusEvent)) (cancel func(), err error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	sub := &busSub{pattern: pattern, fn: fn}
+	b.mu.Lock()
+	b.subs[sub] = true
+	b.mu.Unlock()
+	return func() {
+		b.mu.Lock()
+		delete(b.subs, sub)
+		b.mu.Unlock()
+	}, nil
+}
+
+// publish delivers e to the host's subscriptions and queues it for the
+// plugins subscribed to it.
+func (b *Bus) publish(e BusEvent) {
+	b.mu.Lock()
+	var fns []func(BusEvent)
+	for sub := range b.subs {
+		if ok, _ := path.Match(sub.pattern, e.Name); ok {
+			fns = append(fns, sub.fn)
+		}
+	}
+	conns := make([]*busConn, 0, len(b.conns))
+	for c := range b.conns {
+		if allows(b.acls[c.plugin].Subscribe, e.Name) {
+			conns = append(conns, c)
+		}
+	}
+	b.mu.Unlock()
+	for _, fn := range fns {
+		fn(e)
+	}
+	for _, c := range conns {
+		c.deliver(e)
+	}
+}
+
+// Attach connects the plugin p, known to the bus by name, so that it can
+// publish and subscribe to events.  The plugin must have been started with
+// WithMux, and must serve the bus with JoinBus.  It stays attached until its
+// connection closes.
+func (b *Bus) Attach(name string, p *Plugin) error {
+	st, err := p.OpenChannel(busChannel)
+	if err != nil {
+		return err
+	}
+	c := &busConn{bus: b, plugin: name, wake: make(chan struct{}, 1), done: make(chan struct{})}
+	b.mu.Lock()
+	b.conns[c] = true
+	b.mu.Unlock()
+	server := rpc.NewServer()
+	server.RegisterName(controlService, &busService{c})
+	go func() {
+		server.ServeConn(&busStream{Stream: st, c: c})
+		b.mu.Lock()
+		delete(b.conns, c)
+		b.mu.Unlock()
+	}()
+	return nil
+}
+
+// busConn is a plugin attached to a Bus.
+type busConn struct {
+	bus    *Bus
+	plugin string
+	wake   chan struct{}
+	done   chan struct{}
+
+	mu       sync.Mutex
+	patterns map[string]bool
+	queue    []BusEvent
+	dropped  int
+	closed   bool
+}
+
+// deliver queues e for the plugin if it subscribed to it.
+func (c *busConn) deliver(e BusEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || !allows(keys(c.patterns), e.Name) {
+		return
+	}
+	if len(c.queue) >= busQueueSize {
+		c.queue = c.queue[1:]
+		c.dropped++
+	}
+	c.queue = append(c.queue, e)
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// close stops the plugin's wait for events.
+func (c *busConn) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+	}
+}
+
+func keys(m map[string]bool) []string {
+	list := make([]string, 0, len(m))
+	for k := range m {
+		list = append(list, k)
+	}
+	return list
+}
+
+// busStream is the bus channel to a plugin, which stops the plugin's wait for
+// events once the plugin stops reading.
+type busStream struct {
+	*Stream
+	c *busConn
+}
+
+func (s *busStream) Read(p []byte) (int, error) {
+	n, err := s.Stream.Read(p)
+	if err != nil {
+		s.c.close()
+	}
+	return n, err
+}
+
+// BusBatch is the events sent to a plugin by one call to the bus.
+type BusBatch struct {
+	Events []BusEvent
+	// Dropped is the number of events dropped since the last batch because
+	// the plugin fell behind.
+	Dropped int
+}
+
+// busService is the API a Bus serves to an attached plugin.
+type busService struct {
+	c *busConn
+}
+
+// BusPublish publishes an event from the plugin.
+func (s *busService) BusPublish(e BusEvent, _ *int) error {
+	if !allows(s.c.bus.acl(s.c.plugin).Publish, e.Name) {
+		return fmt.Errorf("%w: plugin %s may not publish %q", ErrBusDenied, s.c.plugin, e.Name)
+	}
+	e.Source = s.c.plugin
+	s.c.bus.publish(e)
+	return nil
+}
+
+// BusSubscribe subscribes the plugin to the events matching a pattern.
+func (s *busService) BusSubscribe(pattern string, _ *int) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return err
+	}
+	if !allows(s.c.bus.acl(s.c.plugin).Subscribe, pattern) {
+		return fmt.Errorf("%w: plugin %s may not subscribe to %q", ErrBusDenied, s.c.plugin, pattern)
+	}
+	s.c.mu.Lock()
+	defer s.c.mu.Unlock()
+	if s.c.patterns == nil {
+		s.c.patterns = map[string]bool{}
+	}
+	s.c.patterns[pattern] = true
+	return nil
+}
+
+// BusNext waits for events for the plugin and returns them.
+func (s *busService) BusNext(_ int, batch *BusBatch) error {
+	for {
+		s.c.mu.Lock()
+		if len(s.c.queue) > 0 {
+			*batch = BusBatch{Events: s.c.queue, Dropped: s.c.dropped}
+			s.c.queue = nil
+			s.c.dropped = 0
+			s.c.mu.Unlock()
+			return nil
+		}
+		s.c.mu.Unlock()
+		select {
+		case <-s.c.wake:
+		case <-s.c.done:
+			return io.EOF
+		}
+	}
+}
+
+// BusClient is the provider side of a Bus.
+type BusClient struct {
+	mu      sync.Mutex
+	client  *rpc.Client
+	subs    []*busSub
+	dropped int
+}
+
+// JoinBus makes the provider served by s take part in the bus the host attaches
+// it to with Bus.Attach.  Publishing fails until the host has attached the
+// plugin, while subscriptions made before then take effect once it has.
+func JoinBus(s Server) (*BusClient, error) {
+	c := &BusClient{}
+	if err := s.HandleChannel(busChannel, c.attach); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// attach uses st, the bus channel opened by the host, to deliver the events
+// subscribed to until the channel closes.
+func (c *BusClient) attach(st *Stream) {
+	client := rpc.NewClient(st)
+	defer client.Close()
+	c.mu.Lock()
+	c.client = client
+	subs := c.subs
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		if c.client == client {
+			c.client = nil
+		}
+		c.mu.Unlock()
+	}()
+	for _, sub := range subs {
+		if err := client.Call(controlService+".BusSubscribe", sub.pattern, new(int)); err != nil {
+			return
+		}
+	}
+	for {
+		var batch BusBatch
+		if err := client.Call(controlService+".BusNext", 0, &batch); err != nil {
+			return
+		}
+		c.mu.Lock()
+		c.dropped += batch.Dropped
+		subs := c.subs
+		c.mu.Unlock()
+		for _, e := range batch.Events {
+			for _, sub := range subs {
+				if ok, _ := path.Match(sub.pattern, e.Name); ok {
+					sub.fn(e)
+				}
+			}
+		}
+	}
+}
+
+// errNotAttached is returned by a BusClient the host has not attached.
+var errNotAttached = errors.New("pie: plugin is not attached to a bus")
+
+// call calls the bus, translating ACL errors so they match ErrBusDenied.
+func (c *BusClient) call(client *rpc.Client, method string, args interface{}) error {
+	err := client.Call(controlService+"."+method, args, new(int))
+	if err != nil && strings.HasPrefix(err.Error(), ErrBusDenied.Error()+":") {
+		return fmt.Errorf("%w%s", ErrBusDenied, strings.TrimPrefix(err.Error(), ErrBusDenied.Error()))
+	}
+	return err
+}
+
+// Publish publishes an event on the bus.  It fails with an error matching
+// ErrBusDenied if the plugin's ACL does not allow it.
+func (c *BusClient) Publish(name string, data []byte) error {
+	c.mu.Lock()
+	client := c.client
+	c.mu.Unlock()
+	if client == nil {
+		return errNotAttached
+	}
+	return c.call(client, "BusPublish", BusEvent{Name: name, Data: data})
+}
+
+// Subscribe calls fn with each event whose name matches pattern, a path.Match
+// pattern.  Events are delivered one at a time, in the order they were
+// published.  If the plugin is attached, Subscribe fails with an error
+// matching ErrBusDenied if the plugin's ACL does not allow the subscription.
+func (c *BusClient) Subscribe(pattern string, fn func(BusEvent)) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return err
+	}
+	sub := &busSub{pattern: pattern, fn: fn}
+	c.mu.Lock()
+	client := c.client
+	if client == nil {
+		// attach subscribes to everything in subs once the host attaches.
+		c.subs = append(c.subs, sub)
+		c.mu.Unlock()
+		return nil
+	}
+	c.mu.Unlock()
+	if err := c.call(client, "BusSubscribe", pattern); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.subs = append(c.subs, sub)
+	c.mu.Unlock()
+	return nil
+}
+
+// Dropped returns the number of events the host dropped because the plugin
+// fell behind.
+func (c *BusClient) Dropped() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.dropped
+}
@@ -0,0 +1,179 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// busPlugin returns a provider attached to b as the plugin "p", and the
+// provider's side of the bus.  setup is called on the provider's side of the
+// bus before the plugin is attached.
+func busPlugin(t *testing.T, b *Bus, setup func(*BusClient)) *BusClient {
+	serverConn, clientConn := net.Pipe()
+	s := NewProviderConn(serverConn)
+	s.SetMultiplexing(true)
+	c, err := JoinBus(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setup != nil {
+		setup(c)
+	}
+	go s.Serve()
+	p, err := NewPlugin(clientConn, WithMux())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	if err := b.Attach("p", p); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// waitBusEvent waits for an event on events.
+func waitBusEvent(t *testing.T, events <-chan BusEvent) BusEvent {
+	t.Helper()
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+	return BusEvent{}
+}
+
+// waitAttached waits until the provider's side of the bus can publish.
+func waitAttached(t *testing.T, c *BusClient, name string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := c.Publish(name, nil)
+		if err == nil {
+			return
+		}
+		if err != errNotAttached || time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBusHostAndPlugin(t *testing.T) {
+	b := NewBus()
+	b.SetACL("p", BusACL{Publish: []string{"orders.*"}, Subscribe: []string{"jobs.*"}})
+	fromHost := make(chan BusEvent, 10)
+	c := busPlugin(t, b, func(c *BusClient) {
+		if err := c.Subscribe("jobs.*", func(e BusEvent) { fromHost <- e }); err != nil {
+			t.Fatal(err)
+		}
+	})
+	fromPlugin := make(chan BusEvent, 10)
+	cancel, err := b.Subscribe("orders.*", func(e BusEvent) { fromPlugin <- e })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+
+	waitAttached(t, c, "orders.ready")
+	if e := waitBusEvent(t, fromPlugin); e.Name != "orders.ready" || e.Source != "p" {
+		t.Errorf("Expected orders.ready from p, got %+v", e)
+	}
+
+	b.Publish("other.thing", nil)
+	b.Publish("jobs.run", []byte("1"))
+	if e := waitBusEvent(t, fromHost); e.Name != "jobs.run" || string(e.Data) != "1" || e.Source != "" {
+		t.Errorf("Expected jobs.run from the host, got %+v", e)
+	}
+
+	if err := c.Publish("jobs.run", nil); !errors.Is(err, ErrBusDenied) {
+		t.Errorf("Expected ErrBusDenied publishing, got %v", err)
+	}
+	if err := c.Subscribe("orders.*", func(BusEvent) {}); !errors.Is(err, ErrBusDenied) {
+		t.Errorf("Expected ErrBusDenied subscribing, got %v", err)
+	}
+}
+
+func TestBusNoACL(t *testing.T) {
+	b := NewBus()
+	c := busPlugin(t, b, nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := c.Publish("x", nil)
+		if errors.Is(err, ErrBusDenied) {
+			break
+		}
+		if err != errNotAttached || time.Now().After(deadline) {
+			t.Fatalf("Expected ErrBusDenied, got %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBusDetach(t *testing.T) {
+	b := NewBus()
+	b.SetACL("p", BusACL{Publish: []string{"*"}, Subscribe: []string{"*"}})
+	serverConn, clientConn := net.Pipe()
+	s := NewProviderConn(serverConn)
+	s.SetMultiplexing(true)
+	JoinBus(s)
+	go s.Serve()
+	p, err := NewPlugin(clientConn, WithMux())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Attach("p", p); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b.mu.Lock()
+		n := len(b.conns)
+		b.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Plugin was not detached after its connection closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestManagerBus(t *testing.T) {
+	b := NewBus()
+	b.SetACL("a", BusACL{Publish: []string{"pong.*"}, Subscribe: []string{"ping.*"}})
+	m := &Manager{Bus: b, Plugins: []PluginSpec{helperSpec("a", "bus")}}
+	if err := m.StartAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	pongs := make(chan BusEvent, 100)
+	cancel, err := b.Subscribe("pong.*", func(e BusEvent) { pongs <- e })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	// The plugin subscribes once it is attached, so keep pinging until it
+	// answers.
+	deadline := time.After(5 * time.Second)
+	tick := time.NewTicker(20 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		select {
+		case e := <-pongs:
+			if e.Name != "pong.1" || string(e.Data) != "hi" || e.Source != "a" {
+				t.Errorf("Expected pong.1 from a, got %+v", e)
+			}
+			return
+		case <-tick.C:
+			b.Publish("ping.1", []byte("hi"))
+		case <-deadline:
+			t.Fatal("timed out waiting for the plugin to answer")
+		}
+	}
+}
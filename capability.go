@@ -0,0 +1,160 @@
+package pie
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// CapabilityCheck decides whether a call may go ahead, given the scopes
+// granted to the capability token the call was made with, or nil if it was
+// made without a valid token, and the call's argument.  It returns an error
+// describing what is missing to deny the call.
+type CapabilityCheck func(scopes []string, args interface{}) error
+
+// Grant returns a new capability token granting the given scopes, such as
+// "filesystem.read:/project".  The host hands the token to a plugin, for
+// example as an argument or in the reply to a call, and the plugin makes calls
+// with it using WithToken.  Scopes mean whatever the host's checks, set with
+// Require, make of them; ScopeAllows implements the usual prefix matching.
+func (s Server) Grant(scopes ...string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	if s.d.grants == nil {
+		s.d.grants = map[string][]string{}
+	}
+	s.d.grants[token] = append([]string(nil), scopes...)
+	return token, nil
+}
+
+// Revoke invalidates a token returned by Grant.  Calls made with it afterwards
+// are treated as having no token.
+func (s Server) Revoke(token string) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	delete(s.d.grants, token)
+}
+
+// Require makes the Server run check before each call to serviceMethod, and
+// fail the call if check returns an error.  This enforces least privilege on
+// the API a host serves to consumer-style plugins: for example, a check on a
+// file reading method can require a scope covering the path being read.
+// Passing a nil check removes the requirement.
+func (s Server) Require(serviceMethod string, check CapabilityCheck) error {
+	if s.d.lookup(serviceMethod) == nil {
+		return fmt.Errorf("pie: cannot require capabilities for %s: no such method", serviceMethod)
+	}
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	if check == nil {
+		delete(s.d.checks, serviceMethod)
+		return nil
+	}
+	if s.d.checks == nil {
+		s.d.checks = map[string]CapabilityCheck{}
+	}
+	s.d.checks[serviceMethod] = check
+	return nil
+}
+
+// ScopeAllows reports whether any of the granted scopes allows want.  A scope
+// allows itself, and a scope of the form "name:/path" also allows the paths
+// below it, so "filesystem.read:/project" allows
+// "filesystem.read:/project/main.go" but not "filesystem.read:/projects".
+// Paths are compared once cleaned with path.Clean, so
+// "filesystem.read:/project/../etc/passwd" is not allowed, and no scope
+// allows a path that still climbs out of where it starts, such as
+// "filesystem.read:../etc".
+func ScopeAllows(granted []string, want string) bool {
+	wantName, wantPath, wantHasPath := splitScope(want)
+	if wantHasPath && climbs(wantPath) {
+		return false
+	}
+	for _, g := range granted {
+		name, p, hasPath := splitScope(g)
+		if name != wantName || hasPath != wantHasPath {
+			continue
+		}
+		if p == wantPath {
+			return true
+		}
+		if hasPath && strings.HasPrefix(wantPath, strings.TrimSuffix(p, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// splitScope splits a scope of the form "name:path" into its name and its
+// path, cleaned, reporting whether it has one.
+func splitScope(scope string) (name, p string, hasPath bool) {
+	name, p, hasPath = strings.Cut(scope, ":")
+	if hasPath && p != "" {
+		p = path.Clean(p)
+	}
+	return name, p, hasPath
+}
+
+// climbs reports whether the cleaned path p has a ".." element.
+func climbs(p string) bool {
+	for _, elem := range strings.Split(p, "/") {
+		if elem == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// capabilityKey is the context key of the scopes granted to a call.
+type capabilityKey struct{}
+
+// Capabilities returns the scopes granted to the token the method given ctx
+// was called with, or nil if it was called without a valid token.  Only
+// methods that take a context.Context can see their call's capabilities.
+func Capabilities(ctx context.Context) []string {
+	scopes, _ := ctx.Value(capabilityKey{}).([]string)
+	return scopes
+}
+
+// check returns the capability check for serviceMethod, if any.
+func (d *dispatcher) check(serviceMethod string) CapabilityCheck {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.checks[serviceMethod]
+}
+
+// scopes returns the scopes granted to token, or nil if it is not valid.
+func (d *dispatcher) scopes(token string) []string {
+	if token == "" {
+		return nil
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.grants[token]
+}
+
+// WithToken returns a Caller that makes its calls through c with the given
+// capability token, as granted by the Server that serves them.  c may be the
+// rpc.Client returned by NewConsumer.
+func WithToken(c Caller, token string) Caller {
+	return tokenCaller{c, token}
+}
+
+// tokenCaller is the Caller returned by WithToken.
+type tokenCaller struct {
+	c     Caller
+	token string
+}
+
+// Call makes the call with the token in its metadata.
+func (t tokenCaller) Call(serviceMethod string, args interface{}, reply interface{}) error {
+	return t.c.Call(callMeta{token: t.token}.encode(serviceMethod), args, reply)
+}
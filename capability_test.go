@@ -0,0 +1,105 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// files is a host API that pretends to read files.
+type files struct{}
+
+func (files) Read(path string, contents *string) error {
+	*contents = "contents of " + path
+	return nil
+}
+
+func (files) Scopes(ctx context.Context, _ int) ([]string, error) {
+	return Capabilities(ctx), nil
+}
+
+// readCheck requires a filesystem.read scope covering the path read.
+func readCheck(scopes []string, args interface{}) error {
+	path := args.(string)
+	if !ScopeAllows(scopes, "filesystem.read:"+path) {
+		return errors.New("no read access to " + path)
+	}
+	return nil
+}
+
+func TestCapabilities(t *testing.T) {
+	s := NewProvider()
+	if err := s.RegisterName("files", files{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Require("files.Read", readCheck); err != nil {
+		t.Fatal(err)
+	}
+	token, err := s.Grant("filesystem.read:/project")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := servePipe(t, s, nil, nil)
+	granted := WithToken(client, token)
+
+	var contents string
+	if err := granted.Call("files.Read", "/project/main.go", &contents); err != nil {
+		t.Errorf("Unexpected error reading a granted path: %v", err)
+	} else if contents != "contents of /project/main.go" {
+		t.Errorf("Wrong reply %q", contents)
+	}
+	for name, c := range map[string]Caller{"without a token": client, "with a token": granted} {
+		err := c.Call("files.Read", "/etc/passwd", &contents)
+		if err == nil || !strings.Contains(err.Error(), "permission denied") {
+			t.Errorf("Expected reading /etc/passwd %s to be denied, got %v", name, err)
+		}
+	}
+	if err := client.Call("files.Read", "/project/main.go", &contents); err == nil {
+		t.Error("Expected a call without a token to be denied")
+	}
+
+	var scopes []string
+	if err := granted.Call("files.Scopes", 0, &scopes); err != nil {
+		t.Fatal(err)
+	}
+	if len(scopes) != 1 || scopes[0] != "filesystem.read:/project" {
+		t.Errorf("Wrong capabilities seen by the method: %v", scopes)
+	}
+
+	s.Revoke(token)
+	if err := granted.Call("files.Read", "/project/main.go", &contents); err == nil {
+		t.Error("Expected a call with a revoked token to be denied")
+	}
+}
+
+func TestRequireUnknownMethod(t *testing.T) {
+	s := NewProvider()
+	if err := s.Require("files.Read", readCheck); err == nil {
+		t.Error("Expected an error requiring capabilities for an unknown method")
+	}
+}
+
+func TestScopeAllows(t *testing.T) {
+	granted := []string{"filesystem.read:/project", "net.dial"}
+	for want, expected := range map[string]bool{
+		"filesystem.read:/project":         true,
+		"filesystem.read:/project/main.go": true,
+		"filesystem.read:/projects":        false,
+		"filesystem.write:/project":        false,
+		"net.dial":                         true,
+		"net.dial.udp":                     false,
+
+		"filesystem.read:/project/../etc/passwd":    false,
+		"filesystem.read:/project/src/../../etc":    false,
+		"filesystem.read:/project/./src/../main.go": true,
+		"filesystem.read:/project//main.go":         true,
+		"filesystem.read:project/../../etc":         false,
+		"filesystem.read:/project/..":               false,
+		"filesystem.read:/project/a..b":             true,
+	} {
+		if got := ScopeAllows(granted, want); got != expected {
+			t.Errorf("ScopeAllows(%q) = %v, expected %v", want, got, expected)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package pie
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// ErrNoMatchingVersion is returned by Catalog.Resolve when no version of a
+// plugin satisfies the requirement for the host's platform.
+var ErrNoMatchingVersion = errors.New("no matching plugin version")
+
+// Catalog is a client for a plugin catalog: a static JSON index, served over
+// HTTP, listing the available versions of each plugin and where to download
+// them.  The index is a CatalogIndex encoded as JSON, for example:
+//
+//	{
+//	  "plugins": {
+//	    "foo": {
+//	      "description": "Frobs widgets",
+//	      "versions": [{
+//	        "version": "1.2.0",
+//	        "artifacts": [{
+//	          "os": "linux",
+//	          "arch": "amd64",
+//	          "url": "https://example.com/foo/1.2.0/foo_linux_amd64",
+//	          "sha256": "..."
+//	        }]
+//	      }]
+//	    }
+//	  }
+//	}
+type Catalog struct {
+	// URL is the location of the catalog's index.
+	URL string
+	// Client is the HTTP client used to fetch the index.  It defaults to
+	// http.DefaultClient.
+	Client *http.Client
+}
+
+// CatalogIndex is the contents of a catalog.
+type CatalogIndex struct {
+	Plugins map[string]CatalogPlugin `json:"plugins"`
+}
+
+// CatalogPlugin describes a plugin in a catalog.
+type CatalogPlugin struct {
+	Description string           `json:"description,omitempty"`
+	Versions    []CatalogVersion `json:"versions"`
+}
+
+// CatalogVersion is a released version of a plugin.
+type CatalogVersion struct {
+	Version   string     `json:"version"`
+	Artifacts []Artifact `json:"artifacts"`
+}
+
+// Artifact is a plugin binary for a particular platform.
+type Artifact struct {
+	// Name and Version identify the plugin the artifact is for.  They are
+	// not part of the index, but are filled in by Catalog.Resolve.
+	Name    string `json:"-"`
+	Version string `json:"-"`
+	OS      string `json:"os"`
+	Arch    string `json:"arch"`
+	URL     string `json:"url"`
+	SHA256  string `json:"sha256"`
+}
+
+// Index fetches the catalog's index.
+func (c *Catalog) Index(ctx context.Context) (*CatalogIndex, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching plugin catalog from %s: %s", c.URL, resp.Status)
+	}
+	index := &CatalogIndex{}
+	if err := json.NewDecoder(resp.Body).Decode(index); err != nil {
+		return nil, fmt.Errorf("invalid plugin catalog at %s: %w", c.URL, err)
+	}
+	return index, nil
+}
+
+// Resolve finds the highest version of a plugin that satisfies requirement
+// and has an artifact for the host's platform.  A requirement is a plugin name
+// optionally followed by a version constraint, as accepted by
+// ParseConstraint, such as "foo >= 1.2, < 2.0".  If no version matches, the
+// error wraps ErrNoMatchingVersion.
+func (c *Catalog) Resolve(ctx context.Context, requirement string) (Artifact, error) {
+	name, constraint, err := ParseRequirement(requirement)
+	if err != nil {
+		return Artifact{}, err
+	}
+	index, err := c.Index(ctx)
+	if err != nil {
+		return Artifact{}, err
+	}
+	return index.Resolve(name, constraint)
+}
+
+// Install resolves requirement like Resolve does, and then downloads the
+// matching artifact with f, returning the artifact and the path to the
+// downloaded binary.
+func (c *Catalog) Install(ctx context.Context, f *Fetcher, requirement string) (Artifact, string, error) {
+	a, err := c.Resolve(ctx, requirement)
+	if err != nil {
+		return Artifact{}, "", err
+	}
+	path, err := f.Fetch(ctx, a.URL, a.SHA256)
+	if err != nil {
+		return Artifact{}, "", err
+	}
+	return a, path, nil
+}
+
+// Resolve finds the highest version of the named plugin in the index that
+// satisfies constraint and has an artifact for the host's platform.
+// Versions that fail to parse are ignored.
+func (idx *CatalogIndex) Resolve(name string, constraint Constraint) (Artifact, error) {
+	plugin, ok := idx.Plugins[name]
+	if !ok {
+		return Artifact{}, fmt.Errorf("plugin %s is not in the catalog: %w", name, ErrNoMatchingVersion)
+	}
+	versions := sortedVersions(plugin.Versions)
+	for i := len(versions) - 1; i >= 0; i-- {
+		cv := versions[i]
+		v, _ := ParseVersion(cv.Version)
+		if !constraint.Check(v) {
+			continue
+		}
+		for _, a := range cv.Artifacts {
+			if a.OS == runtime.GOOS && a.Arch == runtime.GOARCH {
+				a.Name, a.Version = name, v.String()
+				return a, nil
+			}
+		}
+	}
+	return Artifact{}, fmt.Errorf("no version of plugin %s matching %q for %s/%s: %w",
+		name, constraint, runtime.GOOS, runtime.GOARCH, ErrNoMatchingVersion)
+}
+
+// sortedVersions returns the versions with valid version numbers, in
+// ascending order of precedence.
+func sortedVersions(versions []CatalogVersion) []CatalogVersion {
+	var valid []CatalogVersion
+	for _, cv := range versions {
+		if _, err := ParseVersion(cv.Version); err == nil {
+			valid = append(valid, cv)
+		}
+	}
+	sort.Slice(valid, func(i, j int) bool {
+		a, _ := ParseVersion(valid[i].Version)
+		b, _ := ParseVersion(valid[j].Version)
+		return a.Less(b)
+	})
+	return valid
+}
+
+// ParseRequirement splits a requirement such as "foo >= 1.2, < 2.0" into the
+// plugin name and its version constraint.
+func ParseRequirement(requirement string) (string, Constraint, error) {
+	requirement = strings.TrimSpace(requirement)
+	i := strings.IndexAny(requirement, " <>=!")
+	if i < 0 {
+		i = len(requirement)
+	}
+	name := requirement[:i]
+	if name == "" {
+		return "", nil, fmt.Errorf("plugin requirement %q has no name", requirement)
+	}
+	c, err := ParseConstraint(requirement[i:])
+	if err != nil {
+		return "", nil, err
+	}
+	return name, c, nil
+}
@@ -0,0 +1,104 @@
+package pie
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"testing"
+)
+
+// newCatalogServer serves index as a catalog, and returns a Catalog for it.
+func newCatalogServer(t *testing.T, index *CatalogIndex) *Catalog {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(index)
+	}))
+	t.Cleanup(srv.Close)
+	return &Catalog{URL: srv.URL + "/index.json", Client: srv.Client()}
+}
+
+// hostArtifact returns an artifact for the host platform.
+func hostArtifact(url, sha string) Artifact {
+	return Artifact{OS: runtime.GOOS, Arch: runtime.GOARCH, URL: url, SHA256: sha}
+}
+
+func TestCatalogResolve(t *testing.T) {
+	other := Artifact{OS: "plan9", Arch: "mips", URL: "https://example.com/plan9"}
+	c := newCatalogServer(t, &CatalogIndex{Plugins: map[string]CatalogPlugin{
+		"foo": {Versions: []CatalogVersion{
+			{Version: "1.1.0", Artifacts: []Artifact{hostArtifact("https://example.com/1.1.0", "")}},
+			{Version: "2.0.0", Artifacts: []Artifact{hostArtifact("https://example.com/2.0.0", "")}},
+			{Version: "1.3.0", Artifacts: []Artifact{hostArtifact("https://example.com/1.3.0", "")}},
+			{Version: "1.4.0", Artifacts: []Artifact{other}},
+			{Version: "bogus", Artifacts: []Artifact{hostArtifact("https://example.com/bogus", "")}},
+		}},
+	}})
+
+	tests := []struct {
+		requirement string
+		version     string
+	}{
+		{"foo", "2.0.0"},
+		{"foo >= 1.2, < 2.0", "1.3.0"},
+		{"foo<1.2", "1.1.0"},
+		{"foo = 2", "2.0.0"},
+	}
+	for _, test := range tests {
+		a, err := c.Resolve(context.Background(), test.requirement)
+		if err != nil {
+			t.Errorf("Unexpected error resolving %q: %s", test.requirement, err)
+			continue
+		}
+		if a.Version != test.version || a.Name != "foo" {
+			t.Errorf("Wrong resolution of %q, expected foo %s, got %s %s", test.requirement, test.version, a.Name, a.Version)
+		}
+		if a.URL != "https://example.com/"+test.version {
+			t.Errorf("Wrong artifact for %q: %#v", test.requirement, a)
+		}
+	}
+	for _, req := range []string{"foo > 2.0", "bar", "foo = 1.4.0"} {
+		if _, err := c.Resolve(context.Background(), req); !errors.Is(err, ErrNoMatchingVersion) {
+			t.Errorf("Expected ErrNoMatchingVersion resolving %q, got %#v", req, err)
+		}
+	}
+}
+
+func TestCatalogInstall(t *testing.T) {
+	data := []byte("#!/bin/sh\n")
+	srv, _ := newPluginServer(t, data)
+	c := newCatalogServer(t, &CatalogIndex{Plugins: map[string]CatalogPlugin{
+		"foo": {Versions: []CatalogVersion{
+			{Version: "1.0.0", Artifacts: []Artifact{hostArtifact(srv.URL+"/foo", sha256Hex(data))}},
+		}},
+	}})
+	f := &Fetcher{CacheDir: t.TempDir(), Client: srv.Client()}
+	a, path, err := c.Install(context.Background(), f, "foo >= 1.0")
+	if err != nil {
+		t.Fatalf("Unexpected error from Install: %#v", err)
+	}
+	if a.Version != "1.0.0" {
+		t.Errorf("Wrong version installed, expected 1.0.0, got %s", a.Version)
+	}
+	if got, _ := os.ReadFile(path); string(got) != string(data) {
+		t.Errorf("Wrong installed contents, expected %q, got %q", data, got)
+	}
+}
+
+func TestParseRequirement(t *testing.T) {
+	name, c, err := ParseRequirement("foo >= 1.2, < 2.0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if name != "foo" {
+		t.Errorf("Wrong name, expected foo, got %q", name)
+	}
+	if c.String() != ">= 1.2.0, < 2.0.0" {
+		t.Errorf("Wrong constraint, got %q", c)
+	}
+	if _, _, err := ParseRequirement(">= 1.0"); err == nil {
+		t.Error("Expected error for requirement without a name")
+	}
+}
@@ -0,0 +1,170 @@
+// Package cborcodec provides a net/rpc codec that encodes messages with CBOR,
+// the Concise Binary Object Representation of RFC 8949.  CBOR is compact like
+// gob, but is schema-less and has implementations in most languages, which
+// makes it a good choice for plugins not written in Go, and for those that
+// receive large binary payloads, which JSON would have to encode as base64.
+//
+// Each message is a header followed by a body.  The header of a request is a
+// map with the keys "method", the service method's name, and "id", the
+// request's sequence number.  The header of a response is a map with the same
+// keys and, if the call failed, "error", the error's text.  The body is the
+// call's argument or reply, encoded as Marshal encodes it, or null if it has
+// none.
+//
+// To have pie plugins negotiate the codec, call Register in both the host and
+// the plugin, and start the plugin with pie.WithCodecs(cborcodec.Name, ...).
+// The data of the pie.StreamChunk values that move exported streams travels
+// as CBOR byte strings, unencoded.  Encoder.ByteStream and Decoder.ByteStream
+// encode and decode byte strings chunk by chunk, for data paths that produce
+// or consume data as it arrives.
+package cborcodec
+
+import (
+	"io"
+	"net/rpc"
+
+	"github.com/natefinch/pie"
+)
+
+// Name is the name Register registers the codec under.
+const Name = "cbor"
+
+// Register makes the codec available to pie's codec negotiation under Name.
+func Register() {
+	pie.RegisterCodec(Name, NewClientCodec, NewServerCodec)
+}
+
+// requestHeader is the header of a request.
+type requestHeader struct {
+	Method string `cbor:"method"`
+	Seq    uint64 `cbor:"id"`
+}
+
+// responseHeader is the header of a response.
+type responseHeader struct {
+	Method string `cbor:"method"`
+	Seq    uint64 `cbor:"id"`
+	Error  string `cbor:"error,omitempty"`
+}
+
+// codec holds what the client and server codecs share.
+type codec struct {
+	conn io.ReadWriteCloser
+	dec  *Decoder
+	enc  *Encoder
+}
+
+func newCodec(conn io.ReadWriteCloser) codec {
+	return codec{conn: conn, dec: NewDecoder(conn), enc: NewEncoder(conn)}
+}
+
+// write writes a message with the given header and body, which has already
+// been encoded, and flushes it.  If the message cannot be written in full,
+// the connection is closed, since the other end could not make sense of what
+// follows.
+func (c *codec) write(header interface{}, body []byte) error {
+	err := c.enc.Encode(header)
+	if err == nil {
+		_, err = c.enc.w.Write(body)
+	}
+	if err == nil {
+		err = c.enc.Flush()
+	}
+	if err != nil {
+		c.conn.Close()
+	}
+	return err
+}
+
+// readBody decodes the body of the message whose header was read last into
+// body, or skips it if body is nil.
+func (c *codec) readBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+// Close closes the connection.
+func (c *codec) Close() error {
+	return c.conn.Close()
+}
+
+// NewClientCodec returns a ClientCodec that speaks CBOR over conn, for use
+// with pie.WithClientCodec or rpc.NewClientWithCodec.
+func NewClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	return &clientCodec{codec: newCodec(conn)}
+}
+
+type clientCodec struct {
+	codec
+}
+
+// WriteRequest implements rpc.ClientCodec.  The body is encoded before
+// anything is written, so that a body that cannot be encoded fails the call
+// without affecting the connection.
+func (c *clientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	data, err := Marshal(body)
+	if err != nil {
+		return err
+	}
+	return c.write(requestHeader{Method: r.ServiceMethod, Seq: r.Seq}, data)
+}
+
+// ReadResponseHeader implements rpc.ClientCodec.
+func (c *clientCodec) ReadResponseHeader(r *rpc.Response) error {
+	var h responseHeader
+	if err := c.dec.Decode(&h); err != nil {
+		return err
+	}
+	r.ServiceMethod = h.Method
+	r.Seq = h.Seq
+	r.Error = h.Error
+	return nil
+}
+
+// ReadResponseBody implements rpc.ClientCodec.
+func (c *clientCodec) ReadResponseBody(body interface{}) error {
+	return c.readBody(body)
+}
+
+// NewServerCodec returns a ServerCodec that speaks CBOR over conn, for use
+// with pie.Server.ServeCodec or rpc.ServeCodec.
+func NewServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	return &serverCodec{codec: newCodec(conn)}
+}
+
+type serverCodec struct {
+	codec
+}
+
+// ReadRequestHeader implements rpc.ServerCodec.
+func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	var h requestHeader
+	if err := c.dec.Decode(&h); err != nil {
+		return err
+	}
+	r.ServiceMethod = h.Method
+	r.Seq = h.Seq
+	return nil
+}
+
+// ReadRequestBody implements rpc.ServerCodec.
+func (c *serverCodec) ReadRequestBody(body interface{}) error {
+	return c.readBody(body)
+}
+
+// nullBody is the encoding of a missing body.
+var nullBody = []byte{majorSimple<<5 | simpleNull}
+
+// WriteResponse implements rpc.ServerCodec.  A reply that cannot be encoded is
+// sent as an error, in place of the call's result.
+func (c *serverCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	h := responseHeader{Method: r.ServiceMethod, Seq: r.Seq, Error: r.Error}
+	data := nullBody
+	if h.Error == "" {
+		var err error
+		if data, err = Marshal(body); err != nil {
+			h.Error = "cborcodec: encoding reply: " + err.Error()
+			data = nullBody
+		}
+	}
+	return c.write(h, data)
+}
@@ -0,0 +1,108 @@
+package cborcodec
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/rpc"
+	"strings"
+	"testing"
+
+	"github.com/natefinch/pie"
+)
+
+type Args struct {
+	Name string
+	Data []byte
+}
+
+type Reply struct {
+	Greeting string
+	Size     int
+}
+
+type api struct{}
+
+func (api) Greet(args Args, reply *Reply) error {
+	if args.Name == "" {
+		return errors.New("no name")
+	}
+	*reply = Reply{Greeting: "Hi " + args.Name, Size: len(args.Data)}
+	return nil
+}
+
+func (api) Unencodable(args Args, reply *chan int) error {
+	*reply = make(chan int)
+	return nil
+}
+
+// newClient returns a client talking to an rpc server that serves api with
+// this package's codecs.
+func newClient(t *testing.T) *rpc.Client {
+	serverConn, clientConn := net.Pipe()
+	s := rpc.NewServer()
+	s.RegisterName("api", api{})
+	go s.ServeCodec(NewServerCodec(serverConn))
+	c := rpc.NewClientWithCodec(NewClientCodec(clientConn))
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestCodec(t *testing.T) {
+	c := newClient(t)
+	data := bytes.Repeat([]byte{7}, 100000)
+	for i := 0; i < 3; i++ {
+		var reply Reply
+		if err := c.Call("api.Greet", Args{Name: "bob", Data: data}, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Greeting != "Hi bob" || reply.Size != len(data) {
+			t.Errorf("Wrong reply, got %+v", reply)
+		}
+	}
+}
+
+func TestCodecErrors(t *testing.T) {
+	c := newClient(t)
+	var reply Reply
+	if err := c.Call("api.Greet", Args{}, &reply); err == nil || err.Error() != "no name" {
+		t.Errorf("Expected the method's error, got %v", err)
+	}
+	if err := c.Call("api.Nonesuch", Args{}, &reply); err == nil {
+		t.Error("Call of a missing method succeeded")
+	}
+	if err := c.Call("api.Greet", make(chan int), &reply); err == nil {
+		t.Error("Call with an unencodable argument succeeded")
+	}
+	var ch chan int
+	if err := c.Call("api.Unencodable", Args{Name: "x"}, &ch); err == nil || !strings.Contains(err.Error(), "encoding reply") {
+		t.Errorf("Expected an error for an unencodable reply, got %v", err)
+	}
+	// The connection is still usable after all of that.
+	if err := c.Call("api.Greet", Args{Name: "bob"}, &reply); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	Register()
+	serverConn, clientConn := net.Pipe()
+	s := pie.NewProviderConn(serverConn)
+	s.RegisterName("api", api{})
+	go s.Serve()
+	p, err := pie.NewPlugin(clientConn, pie.WithCodecs(Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	var reply Reply
+	if err := p.Call("api.Greet", Args{Name: "bob", Data: []byte{1, 2}}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Greeting != "Hi bob" || reply.Size != 2 {
+		t.Errorf("Wrong reply, got %+v", reply)
+	}
+	if err := p.Ping(); err != nil {
+		t.Errorf("Unexpected error from Ping: %v", err)
+	}
+}
@@ -0,0 +1,778 @@
+package cborcodec
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"time"
+)
+
+// maxDepth is how deeply items may be nested, which keeps hostile input from
+// exhausting the stack.
+const maxDepth = 1000
+
+// maxPrealloc is the most elements or bytes allocated up front for an item, so
+// that a bogus length in hostile input costs nothing until the data arrives.
+const maxPrealloc = 4096
+
+// ErrSyntax is returned, possibly wrapped, for input that is not well-formed
+// CBOR.
+var ErrSyntax = errors.New("cborcodec: malformed input")
+
+// UnmarshalTypeError describes an item that could not be decoded into the Go
+// value it was meant for.  The rest of the input is still decoded; the error
+// is returned once it has been.
+type UnmarshalTypeError struct {
+	// Item describes the CBOR item, such as "text string".
+	Item string
+	// Type is the type of the Go value.
+	Type reflect.Type
+}
+
+// Error implements the error interface.
+func (e *UnmarshalTypeError) Error() string {
+	return "cborcodec: cannot decode " + e.Item + " into Go value of type " + e.Type.String()
+}
+
+// Unmarshal decodes the single CBOR item in data into the value pointed to by
+// v, reversing Marshal.  Items decoded into an empty interface become bool,
+// uint64 for unsigned integers, int64 for negative ones, float64, string,
+// []byte, []interface{}, map[interface{}]interface{}, time.Time for tagged
+// times, or nil for null and undefined.  Other tags are ignored.  Map entries
+// are matched to struct fields by name, preferring an exact match to one that
+// differs in case, and entries without a field are skipped.  Items of
+// indefinite length are accepted wherever those of definite length are.
+func Unmarshal(data []byte, v interface{}) error {
+	d := NewDecoder(bytes.NewReader(data))
+	if err := d.Decode(v); err != nil {
+		return err
+	}
+	if d.r.Buffered() > 0 {
+		return fmt.Errorf("%w: extra data after item", ErrSyntax)
+	}
+	if _, err := d.r.ReadByte(); err != io.EOF {
+		return fmt.Errorf("%w: extra data after item", ErrSyntax)
+	}
+	return nil
+}
+
+// A Decoder reads CBOR items from an input stream.
+type Decoder struct {
+	r *bufio.Reader
+	// typeErr is the first type error found in the item being decoded.
+	typeErr error
+}
+
+// NewDecoder returns a Decoder that reads from r.  It may read past the items
+// it decodes.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// Decode reads the next item and decodes it into the value pointed to by v, as
+// Unmarshal does.  If v is nil, the item is skipped.  It returns io.EOF if the
+// input ends before the item starts, and io.ErrUnexpectedEOF if it ends inside
+// it.
+func (d *Decoder) Decode(v interface{}) error {
+	if v == nil {
+		return d.skip()
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("cborcodec: Decode of non-pointer %T", v)
+	}
+	d.typeErr = nil
+	h, err := d.head()
+	if err != nil {
+		return err
+	}
+	if err := d.value(h, rv.Elem(), 0); err != nil {
+		return unexpectedEOF(err)
+	}
+	return d.typeErr
+}
+
+// ByteStream reads the next item, which must be a byte string of definite or
+// indefinite length, and returns a reader of its contents, which reads each
+// chunk as it arrives.  Nothing else may be decoded until the reader returns
+// io.EOF.
+func (d *Decoder) ByteStream() (io.Reader, error) {
+	h, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	if h.major != majorBytes {
+		return nil, &UnmarshalTypeError{Item: h.String(), Type: typeOfReader}
+	}
+	r := &byteStreamReader{d: d, indefinite: h.indefinite, remaining: h.arg}
+	if h.indefinite {
+		r.remaining = 0
+	}
+	return r, nil
+}
+
+var typeOfReader = reflect.TypeOf((*io.Reader)(nil)).Elem()
+
+// byteStreamReader reads the contents of a byte string.
+type byteStreamReader struct {
+	d          *Decoder
+	indefinite bool
+	remaining  uint64
+	done       bool
+}
+
+// Read reads from the current chunk, moving on to the next once it is read.
+func (r *byteStreamReader) Read(p []byte) (int, error) {
+	for r.remaining == 0 {
+		if r.done || !r.indefinite {
+			r.done = true
+			return 0, io.EOF
+		}
+		h, err := r.d.head()
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		if h.isBreak {
+			r.done = true
+			return 0, io.EOF
+		}
+		if h.major != majorBytes || h.indefinite {
+			return 0, fmt.Errorf("%w: %s in byte string", ErrSyntax, h)
+		}
+		r.remaining = h.arg
+	}
+	if uint64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.d.r.Read(p)
+	r.remaining -= uint64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// itemHead is the head of an item.
+type itemHead struct {
+	major      byte
+	ai         byte
+	arg        uint64
+	indefinite bool
+	isBreak    bool
+}
+
+// String describes the kind of item the head starts.
+func (h itemHead) String() string {
+	switch h.major {
+	case majorUint:
+		return "unsigned integer"
+	case majorNint:
+		return "negative integer"
+	case majorBytes:
+		return "byte string"
+	case majorText:
+		return "text string"
+	case majorArray:
+		return "array"
+	case majorMap:
+		return "map"
+	case majorTag:
+		return "tag"
+	}
+	switch {
+	case h.isBreak:
+		return "break"
+	case h.ai == simpleFalse || h.ai == simpleTrue:
+		return "boolean"
+	case h.ai == simpleNull:
+		return "null"
+	case h.ai == simpleUndefined:
+		return "undefined"
+	case h.ai >= aiFloat16 && h.ai <= aiFloat64:
+		return "float"
+	}
+	return "simple value"
+}
+
+// head reads the head of the next item.
+func (d *Decoder) head() (itemHead, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return itemHead{}, err
+	}
+	h := itemHead{major: b >> 5, ai: b & 0x1f}
+	switch {
+	case h.ai < 24:
+		h.arg = uint64(h.ai)
+	case h.ai <= 27:
+		var buf [8]byte
+		n := 1 << (h.ai - 24)
+		if _, err := io.ReadFull(d.r, buf[:n]); err != nil {
+			return itemHead{}, unexpectedEOF(err)
+		}
+		for _, c := range buf[:n] {
+			h.arg = h.arg<<8 | uint64(c)
+		}
+		if h.major == majorSimple && h.ai == 24 && h.arg < 32 {
+			return itemHead{}, fmt.Errorf("%w: simple value %d in two bytes", ErrSyntax, h.arg)
+		}
+	case h.ai == aiIndefinite:
+		switch h.major {
+		case majorBytes, majorText, majorArray, majorMap:
+			h.indefinite = true
+		case majorSimple:
+			h.isBreak = true
+		default:
+			return itemHead{}, fmt.Errorf("%w: indefinite length %s", ErrSyntax, h)
+		}
+	default:
+		return itemHead{}, fmt.Errorf("%w: reserved additional information %d", ErrSyntax, h.ai)
+	}
+	return h, nil
+}
+
+// atBreak reports whether the next byte is a break, reading it if it is.
+func (d *Decoder) atBreak() (bool, error) {
+	b, err := d.r.Peek(1)
+	if err != nil {
+		return false, unexpectedEOF(err)
+	}
+	if b[0] != breakByte {
+		return false, nil
+	}
+	d.r.ReadByte()
+	return true, nil
+}
+
+// typeError records that the item with head h could not be decoded into v, and
+// skips the rest of it.
+func (d *Decoder) typeError(h itemHead, v reflect.Value) error {
+	if d.typeErr == nil {
+		d.typeErr = &UnmarshalTypeError{Item: h.String(), Type: v.Type()}
+	}
+	return d.skipItem(h, 0)
+}
+
+// value decodes the item with head h into v.
+func (d *Decoder) value(h itemHead, v reflect.Value, depth int) error {
+	if depth > maxDepth {
+		return fmt.Errorf("%w: items nested too deeply", ErrSyntax)
+	}
+	if h.isBreak {
+		return fmt.Errorf("%w: unexpected break", ErrSyntax)
+	}
+	null := h.major == majorSimple && (h.ai == simpleNull || h.ai == simpleUndefined)
+	for v.Kind() == reflect.Ptr {
+		if null {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	if v.Kind() == reflect.Interface {
+		if v.NumMethod() != 0 {
+			return d.typeError(h, v)
+		}
+		g, err := d.generic(h, depth)
+		if err != nil {
+			return err
+		}
+		if g == nil {
+			v.Set(reflect.Zero(v.Type()))
+		} else {
+			v.Set(reflect.ValueOf(g))
+		}
+		return nil
+	}
+	if null {
+		switch v.Kind() {
+		case reflect.Map, reflect.Slice:
+			v.Set(reflect.Zero(v.Type()))
+		}
+		return nil
+	}
+	if v.Type() == typeOfTime {
+		return d.time(h, v, depth)
+	}
+	switch h.major {
+	case majorTag:
+		inner, err := d.head()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		return d.value(inner, v, depth+1)
+	case majorUint, majorNint:
+		return d.integer(h, v)
+	case majorBytes, majorText:
+		return d.str(h, v)
+	case majorArray:
+		return d.array(h, v, depth)
+	case majorMap:
+		return d.mapItem(h, v, depth)
+	}
+	switch {
+	case h.ai == simpleFalse || h.ai == simpleTrue:
+		if v.Kind() != reflect.Bool {
+			return d.typeError(h, v)
+		}
+		v.SetBool(h.ai == simpleTrue)
+		return nil
+	case h.ai >= aiFloat16 && h.ai <= aiFloat64:
+		switch v.Kind() {
+		case reflect.Float32, reflect.Float64:
+			v.SetFloat(floatValue(h))
+			return nil
+		}
+	}
+	return d.typeError(h, v)
+}
+
+// floatValue returns the value of a float item.
+func floatValue(h itemHead) float64 {
+	switch h.ai {
+	case aiFloat16:
+		return fromHalf(uint16(h.arg))
+	case aiFloat32:
+		return float64(math.Float32frombits(uint32(h.arg)))
+	}
+	return math.Float64frombits(h.arg)
+}
+
+// fromHalf returns the value of a half precision float.
+func fromHalf(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 0x1f:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
+
+func (d *Decoder) integer(h itemHead, v reflect.Value) error {
+	neg := h.major == majorNint
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if h.arg > math.MaxInt64 {
+			return d.typeError(h, v)
+		}
+		n := int64(h.arg)
+		if neg {
+			n = -1 - n
+		}
+		if v.OverflowInt(n) {
+			return d.typeError(h, v)
+		}
+		v.SetInt(n)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if neg || v.OverflowUint(h.arg) {
+			return d.typeError(h, v)
+		}
+		v.SetUint(h.arg)
+		return nil
+	case reflect.Float32, reflect.Float64:
+		f := float64(h.arg)
+		if neg {
+			f = -1 - f
+		}
+		v.SetFloat(f)
+		return nil
+	}
+	return d.typeError(h, v)
+}
+
+// readString reads the contents of a byte or text string with head h.
+func (d *Decoder) readString(h itemHead) ([]byte, error) {
+	if !h.indefinite {
+		return d.readN(h.arg)
+	}
+	var buf []byte
+	for {
+		chunk, err := d.head()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if chunk.isBreak {
+			return buf, nil
+		}
+		if chunk.major != h.major || chunk.indefinite {
+			return nil, fmt.Errorf("%w: %s in %s", ErrSyntax, chunk, h)
+		}
+		b, err := d.readN(chunk.arg)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, b...)
+	}
+}
+
+// readN reads n bytes.
+func (d *Decoder) readN(n uint64) ([]byte, error) {
+	if n <= maxPrealloc {
+		b := make([]byte, n)
+		_, err := io.ReadFull(d.r, b)
+		return b, unexpectedEOF(err)
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, d.r, int64(min(n, math.MaxInt64))); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (d *Decoder) str(h itemHead, v reflect.Value) error {
+	b, err := d.readString(h)
+	if err != nil {
+		return err
+	}
+	switch {
+	case h.major == majorText && v.Kind() == reflect.String:
+		v.SetString(string(b))
+		return nil
+	case h.major == majorBytes && v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		if b == nil {
+			b = []byte{}
+		}
+		v.SetBytes(b)
+		return nil
+	case h.major == majorBytes && v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8:
+		for i := 0; i < v.Len(); i++ {
+			var c byte
+			if i < len(b) {
+				c = b[i]
+			}
+			v.Index(i).SetUint(uint64(c))
+		}
+		return nil
+	}
+	if d.typeErr == nil {
+		d.typeErr = &UnmarshalTypeError{Item: h.String(), Type: v.Type()}
+	}
+	return nil
+}
+
+// elements calls f for each element of the array or map with head h, until
+// f fails.  For maps, f reads both the key and the value.
+func (d *Decoder) elements(h itemHead, f func(int, itemHead) error) error {
+	for i := 0; h.indefinite || uint64(i) < h.arg; i++ {
+		eh, err := d.head()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		if eh.isBreak && h.indefinite {
+			return nil
+		}
+		if err := f(i, eh); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Decoder) array(h itemHead, v reflect.Value, depth int) error {
+	switch v.Kind() {
+	case reflect.Slice:
+		n := int(min(h.arg, maxPrealloc))
+		if h.indefinite {
+			n = 0
+		}
+		s := reflect.MakeSlice(v.Type(), 0, n)
+		elem := reflect.New(v.Type().Elem()).Elem()
+		err := d.elements(h, func(i int, eh itemHead) error {
+			elem.Set(reflect.Zero(elem.Type()))
+			if err := d.value(eh, elem, depth+1); err != nil {
+				return err
+			}
+			s = reflect.Append(s, elem)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		v.Set(s)
+		return nil
+	case reflect.Array:
+		err := d.elements(h, func(i int, eh itemHead) error {
+			if i >= v.Len() {
+				return d.skipItem(eh, depth+1)
+			}
+			return d.value(eh, v.Index(i), depth+1)
+		})
+		return err
+	}
+	return d.typeError(h, v)
+}
+
+func (d *Decoder) mapItem(h itemHead, v reflect.Value, depth int) error {
+	switch v.Kind() {
+	case reflect.Map:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		key := reflect.New(v.Type().Key()).Elem()
+		val := reflect.New(v.Type().Elem()).Elem()
+		return d.elements(h, func(i int, kh itemHead) error {
+			key.Set(reflect.Zero(key.Type()))
+			val.Set(reflect.Zero(val.Type()))
+			if err := d.value(kh, key, depth+1); err != nil {
+				return err
+			}
+			vh, err := d.head()
+			if err != nil {
+				return unexpectedEOF(err)
+			}
+			if err := d.value(vh, val, depth+1); err != nil {
+				return err
+			}
+			if key.Kind() == reflect.Interface && !key.IsNil() && !key.Elem().Type().Comparable() {
+				if d.typeErr == nil {
+					d.typeErr = &UnmarshalTypeError{Item: kh.String() + " map key", Type: v.Type()}
+				}
+				return nil
+			}
+			v.SetMapIndex(key, val)
+			return nil
+		})
+	case reflect.Struct:
+		fields := cachedFields(v.Type())
+		return d.elements(h, func(i int, kh itemHead) error {
+			var name string
+			if kh.major == majorText {
+				b, err := d.readString(kh)
+				if err != nil {
+					return err
+				}
+				name = string(b)
+			} else if err := d.skipItem(kh, depth+1); err != nil {
+				return err
+			}
+			vh, err := d.head()
+			if err != nil {
+				return unexpectedEOF(err)
+			}
+			f, ok := fieldByName(fields, name)
+			if !ok || kh.major != majorText {
+				return d.skipItem(vh, depth+1)
+			}
+			return d.value(vh, v.Field(f.index), depth+1)
+		})
+	}
+	return d.typeError(h, v)
+}
+
+// time decodes a time tagged with tag 0 or 1 into v.
+func (d *Decoder) time(h itemHead, v reflect.Value, depth int) error {
+	if h.major != majorTag || (h.arg != tagTimeString && h.arg != tagTimeEpoch) {
+		return d.typeError(h, v)
+	}
+	inner, err := d.head()
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	g, err := d.generic(inner, depth+1)
+	if err != nil {
+		return err
+	}
+	t, ok := timeValue(h.arg, g)
+	if !ok {
+		if d.typeErr == nil {
+			d.typeErr = &UnmarshalTypeError{Item: "tagged " + inner.String(), Type: v.Type()}
+		}
+		return nil
+	}
+	v.Set(reflect.ValueOf(t))
+	return nil
+}
+
+// timeValue returns the time represented by the content g of an item with the
+// given tag.
+func timeValue(tag uint64, g interface{}) (time.Time, bool) {
+	if tag == tagTimeString {
+		s, ok := g.(string)
+		if !ok {
+			return time.Time{}, false
+		}
+		t, err := time.Parse(time.RFC3339Nano, s)
+		return t, err == nil
+	}
+	switch n := g.(type) {
+	case uint64:
+		if n > math.MaxInt64 {
+			return time.Time{}, false
+		}
+		return time.Unix(int64(n), 0), true
+	case int64:
+		return time.Unix(n, 0), true
+	case float64:
+		if math.IsNaN(n) || math.IsInf(n, 0) {
+			return time.Time{}, false
+		}
+		sec, frac := math.Modf(n)
+		return time.Unix(int64(sec), int64(frac*1e9)), true
+	}
+	return time.Time{}, false
+}
+
+// generic decodes the item with head h into the Go value Unmarshal uses for
+// items decoded into an empty interface.
+func (d *Decoder) generic(h itemHead, depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("%w: items nested too deeply", ErrSyntax)
+	}
+	switch h.major {
+	case majorUint:
+		return h.arg, nil
+	case majorNint:
+		if h.arg > math.MaxInt64 {
+			return -1 - float64(h.arg), nil
+		}
+		return -1 - int64(h.arg), nil
+	case majorBytes:
+		b, err := d.readString(h)
+		if b == nil && err == nil {
+			b = []byte{}
+		}
+		return b, err
+	case majorText:
+		b, err := d.readString(h)
+		return string(b), err
+	case majorArray:
+		a := make([]interface{}, 0, int(min(h.arg, maxPrealloc)))
+		err := d.elements(h, func(i int, eh itemHead) error {
+			g, err := d.generic(eh, depth+1)
+			a = append(a, g)
+			return err
+		})
+		return a, err
+	case majorMap:
+		m := map[interface{}]interface{}{}
+		err := d.elements(h, func(i int, kh itemHead) error {
+			k, err := d.generic(kh, depth+1)
+			if err != nil {
+				return err
+			}
+			vh, err := d.head()
+			if err != nil {
+				return unexpectedEOF(err)
+			}
+			val, err := d.generic(vh, depth+1)
+			if err != nil {
+				return err
+			}
+			if k != nil && !reflect.TypeOf(k).Comparable() {
+				if d.typeErr == nil {
+					d.typeErr = &UnmarshalTypeError{Item: kh.String() + " map key", Type: reflect.TypeOf(m)}
+				}
+				return nil
+			}
+			m[k] = val
+			return nil
+		})
+		return m, err
+	case majorTag:
+		inner, err := d.head()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		g, err := d.generic(inner, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		if h.arg == tagTimeString || h.arg == tagTimeEpoch {
+			if t, ok := timeValue(h.arg, g); ok {
+				return t, nil
+			}
+		}
+		return g, nil
+	}
+	switch {
+	case h.isBreak:
+		return nil, fmt.Errorf("%w: unexpected break", ErrSyntax)
+	case h.ai == simpleFalse || h.ai == simpleTrue:
+		return h.ai == simpleTrue, nil
+	case h.ai == simpleNull || h.ai == simpleUndefined:
+		return nil, nil
+	case h.ai >= aiFloat16 && h.ai <= aiFloat64:
+		return floatValue(h), nil
+	}
+	return h.arg, nil
+}
+
+// skip skips the next item.
+func (d *Decoder) skip() error {
+	h, err := d.head()
+	if err != nil {
+		return err
+	}
+	return unexpectedEOF(d.skipItem(h, 0))
+}
+
+// skipItem skips the rest of the item with head h.
+func (d *Decoder) skipItem(h itemHead, depth int) error {
+	if depth > maxDepth {
+		return fmt.Errorf("%w: items nested too deeply", ErrSyntax)
+	}
+	switch h.major {
+	case majorBytes, majorText:
+		if !h.indefinite {
+			_, err := io.CopyN(io.Discard, d.r, int64(min(h.arg, math.MaxInt64)))
+			return unexpectedEOF(err)
+		}
+		_, err := d.readString(h)
+		return err
+	case majorArray:
+		return d.elements(h, func(i int, eh itemHead) error {
+			return d.skipItem(eh, depth+1)
+		})
+	case majorMap:
+		return d.elements(h, func(i int, kh itemHead) error {
+			if err := d.skipItem(kh, depth+1); err != nil {
+				return err
+			}
+			vh, err := d.head()
+			if err != nil {
+				return unexpectedEOF(err)
+			}
+			return d.skipItem(vh, depth+1)
+		})
+	case majorTag:
+		inner, err := d.head()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		return d.skipItem(inner, depth+1)
+	}
+	if h.isBreak {
+		return fmt.Errorf("%w: unexpected break", ErrSyntax)
+	}
+	return nil
+}
+
+// unexpectedEOF turns io.EOF, which means the input ended inside an item,
+// into io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
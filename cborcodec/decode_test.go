@@ -0,0 +1,350 @@
+package cborcodec
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// decodeTests are examples from RFC 8949's Appendix A, decoded into empty
+// interfaces.
+var decodeTests = []struct {
+	in   string
+	want interface{}
+}{
+	{"00", uint64(0)},
+	{"1bffffffffffffffff", uint64(math.MaxUint64)},
+	{"3903e7", int64(-1000)},
+	{"3bffffffffffffffff", -18446744073709551616.0},
+	{"f93c00", 1.0},
+	{"f90001", 5.960464477539063e-8},
+	{"f9c400", -4.0},
+	{"fa47c35000", 100000.0},
+	{"fbc010666666666666", -4.1},
+	{"f97c00", math.Inf(1)},
+	{"f4", false},
+	{"f5", true},
+	{"f6", nil},
+	{"f7", nil},
+	{"f0", uint64(16)},
+	{"f8ff", uint64(255)},
+	{"c074323031332d30332d32315432303a30343a30305a", time.Date(2013, 3, 21, 20, 4, 0, 0, time.UTC)},
+	{"c11a514b67b0", time.Unix(1363896240, 0)},
+	{"c1fb41d452d9ec200000", time.Unix(1363896240, 500000000)},
+	{"d74401020304", []byte{1, 2, 3, 4}},
+	{"d818456449455446", []byte("dIETF")},
+	{"40", []byte{}},
+	{"62c3bc", "ü"},
+	{"8301820203820405", []interface{}{uint64(1), []interface{}{uint64(2), uint64(3)}, []interface{}{uint64(4), uint64(5)}}},
+	{"a26161016162820203", map[interface{}]interface{}{"a": uint64(1), "b": []interface{}{uint64(2), uint64(3)}}},
+	{"5f42010243030405ff", []byte{1, 2, 3, 4, 5}},
+	{"7f657374726561646d696e67ff", "streaming"},
+	{"9fff", []interface{}{}},
+	{"9f018202039f0405ffff", []interface{}{uint64(1), []interface{}{uint64(2), uint64(3)}, []interface{}{uint64(4), uint64(5)}}},
+	{"83018202039f0405ff", []interface{}{uint64(1), []interface{}{uint64(2), uint64(3)}, []interface{}{uint64(4), uint64(5)}}},
+	{"bf61610161629f0203ffff", map[interface{}]interface{}{"a": uint64(1), "b": []interface{}{uint64(2), uint64(3)}}},
+	{"826161bf61626163ff", []interface{}{"a", map[interface{}]interface{}{"b": "c"}}},
+	{"bf6346756ef563416d7421ff", map[interface{}]interface{}{"Fun": true, "Amt": int64(-2)}},
+}
+
+func TestUnmarshalInterface(t *testing.T) {
+	for _, test := range decodeTests {
+		var got interface{}
+		if err := Unmarshal(mustHex(test.in), &got); err != nil {
+			t.Errorf("Unmarshal(%s): %v", test.in, err)
+			continue
+		}
+		if gt, ok := got.(time.Time); ok {
+			if !gt.Equal(test.want.(time.Time)) {
+				t.Errorf("Unmarshal(%s): expected %v, got %v", test.in, test.want, gt)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Unmarshal(%s): expected %#v, got %#v", test.in, test.want, got)
+		}
+	}
+}
+
+func TestUnmarshalNaN(t *testing.T) {
+	for _, in := range []string{"f97e00", "fa7fc00000", "fb7ff8000000000000"} {
+		var f float64
+		if err := Unmarshal(mustHex(in), &f); err != nil {
+			t.Fatal(err)
+		}
+		if !math.IsNaN(f) {
+			t.Errorf("Unmarshal(%s): expected NaN, got %v", in, f)
+		}
+	}
+}
+
+type record struct {
+	Name    string
+	Count   int8
+	Tags    []string
+	Data    []byte
+	Nested  *record
+	Scores  map[string]float64
+	When    time.Time
+	Renamed string `cbor:"other"`
+	Any     interface{}
+	Fixed   [2]int
+}
+
+func TestRoundTrip(t *testing.T) {
+	in := record{
+		Name:    "top",
+		Count:   -7,
+		Tags:    []string{"a", "b"},
+		Data:    []byte{0, 1, 2},
+		Nested:  &record{Name: "inner", Scores: map[string]float64{"x": 1.5}},
+		When:    time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC),
+		Renamed: "r",
+		Any:     []interface{}{"s", uint64(1)},
+		Fixed:   [2]int{3, 4},
+	}
+	b, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out record
+	if err := Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("Expected %+v, got %+v", in, out)
+	}
+}
+
+func TestUnmarshalFieldNames(t *testing.T) {
+	// {"name": "a", "NAME": "b", "unknown": [1, 2], "other": "c"}
+	b, err := Marshal(map[string]interface{}{"name": "a", "NAME": "b", "unknown": []int{1, 2}, "other": "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r record
+	if err := Unmarshal(b, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Renamed != "c" {
+		t.Errorf("Expected tagged field to be %q, got %q", "c", r.Renamed)
+	}
+	if r.Name != "a" && r.Name != "b" {
+		t.Errorf("Expected Name to be set from a case-insensitive match, got %q", r.Name)
+	}
+}
+
+func TestUnmarshalNull(t *testing.T) {
+	r := &record{Name: "x"}
+	s := []int{1}
+	n := 5
+	v := struct {
+		R *record
+		S []int
+		N int
+	}{r, s, n}
+	if err := Unmarshal(mustHex("a36152f66153f6614ef6"), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.R != nil || v.S != nil || v.N != 5 {
+		t.Errorf("Expected null to clear pointers and slices and leave ints alone, got %+v", v)
+	}
+}
+
+func TestUnmarshalTypeError(t *testing.T) {
+	tests := []struct {
+		in string
+		v  interface{}
+	}{
+		{"1901f4", new(int8)},
+		{"20", new(uint)},
+		{"1bffffffffffffffff", new(int64)},
+		{"6161", new(int)},
+		{"4161", new(string)},
+		{"f5", new(string)},
+		{"f93c00", new(int)},
+		{"8101", new(map[string]int)},
+		{"c11a514b67b0", new(string)},
+		{"6161", new(time.Time)},
+		{"c06161", new(time.Time)},
+		{"01", new(io.Reader)},
+	}
+	for _, test := range tests {
+		err := Unmarshal(mustHex(test.in), test.v)
+		var te *UnmarshalTypeError
+		if !errors.As(err, &te) {
+			t.Errorf("Unmarshal(%s, %T): expected an UnmarshalTypeError, got %v", test.in, test.v, err)
+		}
+	}
+}
+
+func TestUnmarshalTypeErrorKeepsGoing(t *testing.T) {
+	// [["x", [1]], 2] into a []int: the first element is skipped in full.
+	var got []int
+	err := Unmarshal(mustHex("82826178810102"), &got)
+	var te *UnmarshalTypeError
+	if !errors.As(err, &te) {
+		t.Fatalf("Expected an UnmarshalTypeError, got %v", err)
+	}
+	if len(got) != 2 || got[1] != 2 {
+		t.Errorf("Expected decoding to carry on after the type error, got %v", got)
+	}
+}
+
+func TestUnmarshalMalformed(t *testing.T) {
+	tests := []struct {
+		in   string
+		want error
+	}{
+		{"", io.EOF},
+		{"18", io.ErrUnexpectedEOF},
+		{"636162", io.ErrUnexpectedEOF},
+		{"8301", io.ErrUnexpectedEOF},
+		{"a1", io.ErrUnexpectedEOF},
+		{"5f", io.ErrUnexpectedEOF},
+		{"9f01", io.ErrUnexpectedEOF},
+		{"1c", ErrSyntax},
+		{"ff", ErrSyntax},
+		{"1f", ErrSyntax},
+		{"df", ErrSyntax},
+		{"f818", ErrSyntax},
+		{"5f6161ff", ErrSyntax},
+		{"5f5f4100ffff", ErrSyntax},
+		{"81ff", ErrSyntax},
+		{"0000", ErrSyntax},
+		{strings.Repeat("81", maxDepth+2) + "00", ErrSyntax},
+	}
+	for _, test := range tests {
+		var v interface{}
+		err := Unmarshal(mustHex(test.in), &v)
+		if !errors.Is(err, test.want) {
+			t.Errorf("Unmarshal(%s): expected %v, got %v", test.in, test.want, err)
+		}
+	}
+}
+
+func TestUnmarshalHugeLength(t *testing.T) {
+	// A byte string and an array claiming to be enormous, followed by nothing.
+	for _, in := range []string{"5b00ffffffffffffff", "9b00ffffffffffffff"} {
+		var v interface{}
+		if err := Unmarshal(mustHex(in), &v); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("Unmarshal(%s): expected %v, got %v", in, io.ErrUnexpectedEOF, err)
+		}
+	}
+}
+
+func TestDecoderStream(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	for _, v := range []interface{}{1, "skipped", []string{"a"}} {
+		if err := e.Encode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.Flush()
+	d := NewDecoder(&buf)
+	var n int
+	if err := d.Decode(&n); err != nil || n != 1 {
+		t.Fatalf("Expected 1, got %v, %v", n, err)
+	}
+	if err := d.Decode(nil); err != nil {
+		t.Fatal(err)
+	}
+	var s []string
+	if err := d.Decode(&s); err != nil || len(s) != 1 || s[0] != "a" {
+		t.Fatalf("Expected [a], got %v, %v", s, err)
+	}
+	if err := d.Decode(&n); err != io.EOF {
+		t.Errorf("Expected io.EOF at the end of the stream, got %v", err)
+	}
+	if err := d.Decode(n); err == nil {
+		t.Error("Decode into a non-pointer succeeded")
+	}
+}
+
+func TestDecoderByteStream(t *testing.T) {
+	for _, in := range []string{"4401020304", "5f4201024102410440ff", "5fff"} {
+		d := NewDecoder(bytes.NewReader(mustHex(in + "f5")))
+		r, err := d.ByteStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%s: %v", in, err)
+		}
+		want := mustHex(in)[1:]
+		switch in {
+		case "5f4201024102410440ff":
+			want = []byte{1, 2, 2, 4}
+		case "5fff":
+			want = []byte{}
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: expected %x, got %x", in, want, got)
+		}
+		var b bool
+		if err := d.Decode(&b); err != nil || !b {
+			t.Errorf("%s: expected the next item to be true, got %v, %v", in, b, err)
+		}
+	}
+	d := NewDecoder(bytes.NewReader(mustHex("6161")))
+	if _, err := d.ByteStream(); err == nil {
+		t.Error("ByteStream of a text string succeeded")
+	}
+	d = NewDecoder(bytes.NewReader(mustHex("5f420102")))
+	r, _ := d.ByteStream()
+	if _, err := io.ReadAll(r); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected %v for a truncated byte string, got %v", io.ErrUnexpectedEOF, err)
+	}
+}
+
+func TestEncoderDecoderByteStream(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	w := e.ByteStream()
+	data := bytes.Repeat([]byte("chunk"), 1000)
+	for i := 0; i < len(data); i += 700 {
+		w.Write(data[i:min(i+700, len(data))])
+	}
+	w.Close()
+	e.Flush()
+	var got []byte
+	if err := Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("Streamed byte string did not round trip")
+	}
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	for _, test := range decodeTests {
+		f.Add(mustHex(test.in))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var v interface{}
+		if err := Unmarshal(data, &v); err != nil {
+			return
+		}
+		var r record
+		Unmarshal(data, &r)
+		if _, err := Marshal(v); err != nil {
+			t.Errorf("Marshal of decoded %x: %v", data, err)
+		}
+	})
+}
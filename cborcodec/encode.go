@@ -0,0 +1,352 @@
+package cborcodec
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// CBOR major types.
+const (
+	majorUint   byte = 0
+	majorNint   byte = 1
+	majorBytes  byte = 2
+	majorText   byte = 3
+	majorArray  byte = 4
+	majorMap    byte = 5
+	majorTag    byte = 6
+	majorSimple byte = 7
+)
+
+// Simple values and other items of major type 7.
+const (
+	simpleFalse     byte = 20
+	simpleTrue      byte = 21
+	simpleNull      byte = 22
+	simpleUndefined byte = 23
+	aiFloat16       byte = 25
+	aiFloat32       byte = 26
+	aiFloat64       byte = 27
+	// aiIndefinite is the additional information of the head of an item of
+	// indefinite length, and of the break that ends it.
+	aiIndefinite byte = 31
+)
+
+// Tags understood by this package.
+const (
+	tagTimeString uint64 = 0
+	tagTimeEpoch  uint64 = 1
+)
+
+// breakByte ends an item of indefinite length.
+const breakByte = 0xff
+
+var typeOfTime = reflect.TypeOf(time.Time{})
+
+// Marshal returns the CBOR encoding of v.
+//
+// Booleans, integers, floating point numbers, strings, and byte slices and
+// arrays are encoded as the CBOR items of the same kind, with integers and
+// floats in the shortest form that holds their value exactly.  Other slices
+// and arrays are encoded as arrays, and maps as maps whose keys are sorted by
+// their encoding, as RFC 8949's deterministic encoding requires.  Structs are
+// encoded as maps from field names to values, in field order.  A field's name
+// can be changed with a `cbor:"name"` tag, the field can be left out when it
+// holds its zero value with `cbor:",omitempty"`, and it is ignored with
+// `cbor:"-"`.  Unexported fields are ignored.  Pointers and interfaces are
+// encoded as what they point to or hold, nil pointers, interfaces, slices,
+// and maps as null, and time.Time values as RFC 3339 strings with tag 0.
+func Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	e := &encodeState{w: &buf}
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// An Encoder writes CBOR items to an output stream.
+type Encoder struct {
+	w   *bufio.Writer
+	enc encodeState
+}
+
+// NewEncoder returns an Encoder that writes to w.  Items are buffered, and
+// only written to w by Flush, or when the buffer fills.
+func NewEncoder(w io.Writer) *Encoder {
+	bw := bufio.NewWriter(w)
+	return &Encoder{w: bw, enc: encodeState{w: bw}}
+}
+
+// Encode writes the CBOR encoding of v, as Marshal encodes it.
+func (e *Encoder) Encode(v interface{}) error {
+	return e.enc.encode(reflect.ValueOf(v))
+}
+
+// Flush writes any buffered data to the underlying writer.
+func (e *Encoder) Flush() error {
+	return e.w.Flush()
+}
+
+// ByteStream starts a byte string of indefinite length, and returns a writer
+// that writes each Write to it as a chunk, so that data can be encoded as a
+// single item as it is produced, without knowing its length up front.  The
+// byte string ends when the writer is closed.  Nothing else may be encoded
+// until then.
+func (e *Encoder) ByteStream() io.WriteCloser {
+	e.w.WriteByte(majorBytes<<5 | aiIndefinite)
+	return &byteStreamWriter{e: e}
+}
+
+// byteStreamWriter writes the chunks of a byte string of indefinite length.
+type byteStreamWriter struct {
+	e      *Encoder
+	closed bool
+}
+
+// Write writes p as a chunk.
+func (w *byteStreamWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	w.e.enc.head(majorBytes, uint64(len(p)))
+	return w.e.w.Write(p)
+}
+
+// Close ends the byte string.
+func (w *byteStreamWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.e.w.WriteByte(breakByte)
+}
+
+// encodeState encodes values to a writer.
+type encodeState struct {
+	w interface {
+		io.Writer
+		io.ByteWriter
+		io.StringWriter
+	}
+	// scratch holds item heads as they are built.
+	scratch [9]byte
+}
+
+// head writes the head of an item of the given major type, with n as its
+// argument, in the shortest form.
+func (e *encodeState) head(major byte, n uint64) {
+	b := e.scratch[:0]
+	m := major << 5
+	switch {
+	case n < 24:
+		b = append(b, m|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, m|24, byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, m|25, byte(n>>8), byte(n))
+	case n <= math.MaxUint32:
+		b = append(b, m|26, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	default:
+		b = append(b, m|27, byte(n>>56), byte(n>>48), byte(n>>40), byte(n>>32),
+			byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	e.w.Write(b)
+}
+
+func (e *encodeState) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		return e.w.WriteByte(majorSimple<<5 | simpleNull)
+	}
+	if v.Type() == typeOfTime {
+		t := v.Interface().(time.Time)
+		e.head(majorTag, tagTimeString)
+		s := t.Format(time.RFC3339Nano)
+		e.head(majorText, uint64(len(s)))
+		_, err := e.w.WriteString(s)
+		return err
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return e.w.WriteByte(majorSimple<<5 | simpleTrue)
+		}
+		return e.w.WriteByte(majorSimple<<5 | simpleFalse)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n := v.Int(); n < 0 {
+			e.head(majorNint, uint64(-(n + 1)))
+		} else {
+			e.head(majorUint, uint64(n))
+		}
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.head(majorUint, v.Uint())
+		return nil
+	case reflect.Float32, reflect.Float64:
+		e.float(v.Float())
+		return nil
+	case reflect.String:
+		s := v.String()
+		e.head(majorText, uint64(len(s)))
+		_, err := e.w.WriteString(s)
+		return err
+	case reflect.Slice:
+		if v.IsNil() {
+			return e.w.WriteByte(majorSimple<<5 | simpleNull)
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := v.Bytes()
+			e.head(majorBytes, uint64(len(b)))
+			_, err := e.w.Write(b)
+			return err
+		}
+		return e.array(v)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.head(majorBytes, uint64(v.Len()))
+			for i := 0; i < v.Len(); i++ {
+				e.w.WriteByte(byte(v.Index(i).Uint()))
+			}
+			return nil
+		}
+		return e.array(v)
+	case reflect.Map:
+		if v.IsNil() {
+			return e.w.WriteByte(majorSimple<<5 | simpleNull)
+		}
+		return e.mapItems(v)
+	case reflect.Struct:
+		return e.structItems(v)
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return e.w.WriteByte(majorSimple<<5 | simpleNull)
+		}
+		return e.encode(v.Elem())
+	}
+	return fmt.Errorf("cborcodec: cannot encode values of type %s", v.Type())
+}
+
+// float writes f in the shortest of the half, single, and double precision
+// forms that holds it exactly.
+func (e *encodeState) float(f float64) {
+	if h, ok := toHalf(f); ok {
+		e.w.Write([]byte{majorSimple<<5 | aiFloat16, byte(h >> 8), byte(h)})
+		return
+	}
+	if f32 := float32(f); float64(f32) == f {
+		bits := math.Float32bits(f32)
+		e.w.Write([]byte{majorSimple<<5 | aiFloat32, byte(bits >> 24), byte(bits >> 16), byte(bits >> 8), byte(bits)})
+		return
+	}
+	bits := math.Float64bits(f)
+	e.w.Write([]byte{majorSimple<<5 | aiFloat64, byte(bits >> 56), byte(bits >> 48), byte(bits >> 40), byte(bits >> 32),
+		byte(bits >> 24), byte(bits >> 16), byte(bits >> 8), byte(bits)})
+}
+
+// toHalf returns the half precision encoding of f, if it holds f exactly.  All
+// NaNs are encoded as the canonical quiet NaN.
+func toHalf(f float64) (uint16, bool) {
+	switch {
+	case math.IsNaN(f):
+		return 0x7e00, true
+	case math.IsInf(f, 1):
+		return 0x7c00, true
+	case math.IsInf(f, -1):
+		return 0xfc00, true
+	}
+	var sign uint16
+	if math.Signbit(f) {
+		sign = 0x8000
+		f = -f
+	}
+	if f == 0 {
+		return sign, true
+	}
+	frac, exp := math.Frexp(f) // f = frac * 2^exp, with 0.5 <= frac < 1
+	switch {
+	case exp >= -13 && exp <= 16:
+		// A normal half: 1.m * 2^(exp-1), with a 10 bit m.
+		m := frac*2048 - 1024
+		if m != math.Trunc(m) {
+			return 0, false
+		}
+		return sign | uint16(exp+14)<<10 | uint16(m), true
+	case exp >= -23 && exp < -13:
+		// A subnormal half: m * 2^-24.
+		m := math.Ldexp(f, 24)
+		if m != math.Trunc(m) {
+			return 0, false
+		}
+		return sign | uint16(m), true
+	}
+	return 0, false
+}
+
+func (e *encodeState) array(v reflect.Value) error {
+	e.head(majorArray, uint64(v.Len()))
+	for i := 0; i < v.Len(); i++ {
+		if err := e.encode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *encodeState) mapItems(v reflect.Value) error {
+	type entry struct {
+		key []byte
+		val reflect.Value
+	}
+	entries := make([]entry, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		var buf bytes.Buffer
+		ke := &encodeState{w: &buf}
+		if err := ke.encode(iter.Key()); err != nil {
+			return err
+		}
+		entries = append(entries, entry{buf.Bytes(), iter.Value()})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].key, entries[j].key) < 0
+	})
+	e.head(majorMap, uint64(len(entries)))
+	for _, en := range entries {
+		e.w.Write(en.key)
+		if err := e.encode(en.val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *encodeState) structItems(v reflect.Value) error {
+	fields := cachedFields(v.Type())
+	n := 0
+	for _, f := range fields {
+		if !f.omitEmpty || !v.Field(f.index).IsZero() {
+			n++
+		}
+	}
+	e.head(majorMap, uint64(n))
+	for _, f := range fields {
+		fv := v.Field(f.index)
+		if f.omitEmpty && fv.IsZero() {
+			continue
+		}
+		e.head(majorText, uint64(len(f.name)))
+		e.w.WriteString(f.name)
+		if err := e.encode(fv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
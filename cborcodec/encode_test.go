@@ -0,0 +1,161 @@
+package cborcodec
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"testing"
+	"time"
+)
+
+// encodeTests are the examples of RFC 8949's Appendix A that have a single
+// encoding in Go, along with some of this package's own.
+var encodeTests = []struct {
+	v    interface{}
+	want string
+}{
+	{0, "00"},
+	{1, "01"},
+	{10, "0a"},
+	{23, "17"},
+	{24, "1818"},
+	{25, "1819"},
+	{100, "1864"},
+	{1000, "1903e8"},
+	{1000000, "1a000f4240"},
+	{uint64(1000000000000), "1b000000e8d4a51000"},
+	{uint64(18446744073709551615), "1bffffffffffffffff"},
+	{-1, "20"},
+	{-10, "29"},
+	{-100, "3863"},
+	{-1000, "3903e7"},
+	{int64(math.MinInt64), "3b7fffffffffffffff"},
+	{0.0, "f90000"},
+	{math.Copysign(0, -1), "f98000"},
+	{1.0, "f93c00"},
+	{1.1, "fb3ff199999999999a"},
+	{1.5, "f93e00"},
+	{65504.0, "f97bff"},
+	{100000.0, "fa47c35000"},
+	{3.4028234663852886e+38, "fa7f7fffff"},
+	{1.0e+300, "fb7e37e43c8800759c"},
+	{5.960464477539063e-8, "f90001"},
+	{0.00006103515625, "f90400"},
+	{-4.0, "f9c400"},
+	{-4.1, "fbc010666666666666"},
+	{math.Inf(1), "f97c00"},
+	{math.NaN(), "f97e00"},
+	{math.Inf(-1), "f9fc00"},
+	{float32(100000), "fa47c35000"},
+	{false, "f4"},
+	{true, "f5"},
+	{nil, "f6"},
+	{[]byte{}, "40"},
+	{[]byte{1, 2, 3, 4}, "4401020304"},
+	{[4]byte{1, 2, 3, 4}, "4401020304"},
+	{"", "60"},
+	{"a", "6161"},
+	{"IETF", "6449455446"},
+	{"\"\\", "62225c"},
+	{"ü", "62c3bc"},
+	{"水", "63e6b0b4"},
+	{"\U00010151", "64f0908591"},
+	{[]int{}, "80"},
+	{[]int{1, 2, 3}, "83010203"},
+	{[]interface{}{1, []int{2, 3}, []int{4, 5}}, "8301820203820405"},
+	{
+		[]int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25},
+		"98190102030405060708090a0b0c0d0e0f101112131415161718181819",
+	},
+	{map[int]int{}, "a0"},
+	{map[int]int{1: 2, 3: 4}, "a201020304"},
+	{map[string]interface{}{"a": 1, "b": []int{2, 3}}, "a26161016162820203"},
+	{[]interface{}{"a", map[string]string{"b": "c"}}, "826161a161626163"},
+	{
+		map[string]string{"a": "A", "b": "B", "c": "C", "d": "D", "e": "E"},
+		"a56161614161626142616361436164614461656145",
+	},
+	{time.Date(2013, 3, 21, 20, 4, 0, 0, time.UTC), "c074323031332d30332d32315432303a30343a30305a"},
+	// Deterministic encoding sorts keys by their encoding, which puts
+	// shorter keys first.
+	{map[string]int{"bb": 1, "a": 2, "c": 3}, "a361610261630362626201"},
+	{map[int]bool{-1: true, 10: false, 100: true}, "a30af41864f520f5"},
+	{[]string(nil), "f6"},
+	{(*int)(nil), "f6"},
+	{new(int), "00"},
+}
+
+func TestMarshal(t *testing.T) {
+	for _, test := range encodeTests {
+		got, err := Marshal(test.v)
+		if err != nil {
+			t.Errorf("Marshal(%#v): %v", test.v, err)
+			continue
+		}
+		if hex.EncodeToString(got) != test.want {
+			t.Errorf("Marshal(%#v): expected %s, got %x", test.v, test.want, got)
+		}
+	}
+}
+
+type point struct {
+	X, Y   int
+	Label  string `cbor:"label,omitempty"`
+	hidden int
+	Skip   bool `cbor:"-"`
+}
+
+func TestMarshalStruct(t *testing.T) {
+	got, err := Marshal(point{X: 1, Y: -2, hidden: 3, Skip: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// {"X": 1, "Y": -2}
+	if want := "a2615801615921"; hex.EncodeToString(got) != want {
+		t.Errorf("Expected %s, got %x", want, got)
+	}
+	got, err = Marshal(&point{Label: "p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// {"X": 0, "Y": 0, "label": "p"}
+	if want := "a3615800615900656c6162656c6170"; hex.EncodeToString(got) != want {
+		t.Errorf("Expected %s, got %x", want, got)
+	}
+}
+
+func TestMarshalUnsupported(t *testing.T) {
+	for _, v := range []interface{}{make(chan int), func() {}, complex(1, 2)} {
+		if _, err := Marshal(v); err == nil {
+			t.Errorf("Marshal(%T) succeeded", v)
+		}
+	}
+}
+
+func TestEncoderByteStream(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	w := e.ByteStream()
+	w.Write([]byte{1, 2})
+	w.Write(nil)
+	w.Write([]byte{3, 4, 5})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte{6}); err == nil {
+		t.Error("Write after Close succeeded")
+	}
+	if err := e.Encode(true); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Encoder wrote %d bytes before Flush", buf.Len())
+	}
+	if err := e.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// (_ h'0102', h'030405'), true
+	if want := "5f42010243030405fff5"; hex.EncodeToString(buf.Bytes()) != want {
+		t.Errorf("Expected %s, got %x", want, buf.Bytes())
+	}
+}
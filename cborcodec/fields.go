@@ -0,0 +1,57 @@
+package cborcodec
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// field describes a struct field encoded as a map entry.
+type field struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+var fieldCache sync.Map // reflect.Type to []field
+
+// cachedFields returns the fields of the struct type t that are encoded, in
+// order.
+func cachedFields(t reflect.Type) []field {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.([]field)
+	}
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		name, opts, _ := strings.Cut(sf.Tag.Get("cbor"), ",")
+		if name == "-" && opts == "" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, field{name: name, index: i, omitEmpty: opts == "omitempty"})
+	}
+	f, _ := fieldCache.LoadOrStore(t, fields)
+	return f.([]field)
+}
+
+// fieldByName returns the field of fields named name, preferring an exact
+// match to one that differs in case.
+func fieldByName(fields []field, name string) (field, bool) {
+	for _, f := range fields {
+		if f.name == name {
+			return f, true
+		}
+	}
+	for _, f := range fields {
+		if strings.EqualFold(f.name, name) {
+			return f, true
+		}
+	}
+	return field{}, false
+}
@@ -0,0 +1,188 @@
+package pie
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+)
+
+// Checksummed frames are like plain frames, but start with checksumMagic, and
+// have the CRC-32C checksum of their payload after its length.  They are used
+// in both directions of a connection, so that data corrupted by a flaky pipe or
+// network transport is detected instead of being decoded into garbage.  The
+// host's first frame is how checksums are negotiated: a provider that was not
+// told whether to use them looks at the first bytes the host sends, and
+// answers with checksummed frames if they start one.
+
+// checksumMagic starts each checksummed frame.
+var checksumMagic = [4]byte{0x1b, 'P', 'I', 'C'}
+
+// checksumHeaderLen is the length of a checksummed frame's header.
+const checksumHeaderLen = frameHeaderLen + 4
+
+// maxChecksumFrame is the largest payload a checksummed frame may have.  A
+// larger length can only come from a corrupt header, and is not trusted with
+// an allocation.
+const maxChecksumFrame = 256 << 20
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checksum returns the checksum of a frame's payload.
+func checksum(p []byte) uint32 {
+	return crc32.Checksum(p, castagnoli)
+}
+
+// CorruptFrameError is the error that ends a connection using checksums when a
+// frame read from it is corrupt.  Calls in flight on the connection fail with
+// it.
+type CorruptFrameError struct {
+	// Detail describes what was wrong with the frame.
+	Detail string
+}
+
+// Error implements the error interface.
+func (e *CorruptFrameError) Error() string {
+	return "pie: corrupt frame: " + e.Detail
+}
+
+// WithChecksums makes the host and the plugin exchange checksummed frames in
+// both directions, so that data corrupted in transit ends the connection with a
+// *CorruptFrameError rather than being decoded into garbage.  If reset is
+// true, the handle is also closed when corruption is detected, which stops the
+// plugin, so that a Supervisor restarts it with a fresh connection.  Stray
+// output is handled as with WithFraming, which may be used to set a handler
+// for it.
+//
+// The provider must be created with NewProvider or NewProviderConn by a
+// version of this package that supports checksums.  It recognizes them from
+// the first frame the host sends, and uses them in turn, so it needs no
+// configuration of its own; plugins started by StartPlugin are also asked to
+// use them through their environment.
+func WithChecksums(reset bool) StartOption {
+	return func(o *startOptions) {
+		o.framing = true
+		o.checksums = true
+		o.resetOnCorruption = reset
+	}
+}
+
+// SetChecksums makes the Server exchange checksummed frames with its host, as
+// a host does with WithChecksums, on connections served after it is called.
+// Without it, the Server uses checksums with hosts whose first frame is
+// checksummed, and not with others; with it, the Server requires them.
+func (s Server) SetChecksums(on bool) error {
+	if s.d == nil {
+		return errors.New("pie: server cannot be configured")
+	}
+	s.d.regMu.Lock()
+	defer s.d.regMu.Unlock()
+	s.d.checksums = on
+	return nil
+}
+
+// checksumSniffer is a provider's connection to a host that may send
+// checksummed frames.  It waits for the host's first bytes, and then uses
+// checksummed frames in both directions if they start one, and passes data
+// through unchanged otherwise.  Writes made before then wait for them.
+type checksumSniffer struct {
+	rwc     io.ReadWriteCloser
+	once    sync.Once
+	decided chan struct{}
+	// conn is the connection used once decided is closed.
+	conn io.ReadWriteCloser
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// sniffChecksums returns rwc, using checksummed frames if the host's first
+// bytes start one.
+func sniffChecksums(rwc io.ReadWriteCloser) *checksumSniffer {
+	return &checksumSniffer{rwc: rwc, decided: make(chan struct{}), closed: make(chan struct{})}
+}
+
+// decide looks at the host's first bytes, the first time it is called, and
+// sets the connection to use.
+func (c *checksumSniffer) decide() {
+	c.once.Do(func() {
+		br := bufio.NewReader(c.rwc)
+		head, _ := br.Peek(len(checksumMagic))
+		c.conn = newRWCloser(io.NopCloser(br), c.rwc)
+		if bytes.Equal(head, checksumMagic[:]) {
+			c.conn = newFramedConn(c.conn, framing{checksums: true})
+		}
+		close(c.decided)
+	})
+}
+
+// Read reads from the connection, once the host's first bytes have shown
+// which it is.
+func (c *checksumSniffer) Read(p []byte) (int, error) {
+	c.decide()
+	return c.conn.Read(p)
+}
+
+// Write writes to the connection, once the host's first bytes have shown
+// which it is.
+func (c *checksumSniffer) Write(p []byte) (int, error) {
+	select {
+	case <-c.decided:
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	}
+	return c.conn.Write(p)
+}
+
+// Close closes the connection, failing the writes waiting for the host's
+// first bytes.
+func (c *checksumSniffer) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.rwc.Close()
+}
+
+// nextChecksummed reads the checksummed frame at the start of the reader, and
+// verifies its payload.
+func (f *frameReader) nextChecksummed() error {
+	head, err := f.r.Peek(checksumHeaderLen)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	n := binary.BigEndian.Uint32(head[len(checksumMagic):])
+	want := binary.BigEndian.Uint32(head[frameHeaderLen:])
+	if n > maxChecksumFrame {
+		return &CorruptFrameError{Detail: fmt.Sprintf("frame length %d exceeds limit", n)}
+	}
+	if _, err := f.r.Discard(checksumHeaderLen); err != nil {
+		return err
+	}
+	var payload []byte
+	if n > 0 {
+		payload = GetBuffer(int(n))
+	}
+	if _, err := io.ReadFull(f.r, payload); err != nil {
+		PutBuffer(payload)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if got := checksum(payload); got != want {
+		PutBuffer(payload)
+		return &CorruptFrameError{Detail: fmt.Sprintf("checksum mismatch over %d bytes: expected %08x, got %08x", n, want, got)}
+	}
+	if n == 0 {
+		// A keepalive has nothing to give back to the pool.
+		f.buf = []byte{}
+		return nil
+	}
+	f.buf, f.pooled = payload, payload
+	return nil
+}
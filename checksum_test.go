@@ -0,0 +1,174 @@
+package pie
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestChecksummedFrames(t *testing.T) {
+	var stream bytes.Buffer
+	w := &frameWriter{w: nopWriteCloser{&stream}, checksum: true}
+	w.Write([]byte("hello "))
+	w.Write([]byte("world"))
+	got, err := io.ReadAll(&frameReader{r: bufio.NewReader(&stream)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello world" {
+		t.Fatalf("expected %q, got %q", "hello world", got)
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	var stream bytes.Buffer
+	(&frameWriter{w: nopWriteCloser{&stream}, checksum: true}).Write([]byte("payload"))
+	data := stream.Bytes()
+	data[len(data)-1] ^= 0x20
+
+	corrupted := false
+	r := &frameReader{r: bufio.NewReader(&stream), onCorrupt: func() { corrupted = true }}
+	_, err := io.ReadAll(r)
+	var cerr *CorruptFrameError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("expected *CorruptFrameError, got %v", err)
+	}
+	if !corrupted {
+		t.Fatal("expected corruption to be reported")
+	}
+}
+
+// flippingConn flips a bit in the nth byte read through it.
+type flippingConn struct {
+	net.Conn
+	mu sync.Mutex
+	n  int
+}
+
+func (c *flippingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.n >= 0 && c.n < n {
+		p[c.n] ^= 1
+	}
+	c.n -= n
+	return n, err
+}
+
+// checksumPlugin serves api with checksums over a pipe, and returns a handle
+// for it that reads through conn.
+func checksumPlugin(t *testing.T, wrap func(net.Conn) net.Conn, reset bool) *Plugin {
+	serverConn, clientConn := net.Pipe()
+	s := NewProviderConn(serverConn)
+	s.RegisterName("api", api{})
+	if err := s.SetChecksums(true); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	p, err := NewPlugin(wrap(clientConn), WithChecksums(reset))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func TestChecksumsOverConn(t *testing.T) {
+	p := checksumPlugin(t, func(c net.Conn) net.Conn { return c }, false)
+	var reply string
+	if err := p.Call("api.SayHi", "bob", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "Hi bob" {
+		t.Fatalf("expected %q, got %q", "Hi bob", reply)
+	}
+}
+
+func TestChecksumsDetectCorruption(t *testing.T) {
+	p := checksumPlugin(t, func(c net.Conn) net.Conn { return &flippingConn{Conn: c, n: 20} }, true)
+	var reply string
+	err := p.Call("api.SayHi", "bob", &reply)
+	var cerr *CorruptFrameError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("expected *CorruptFrameError, got %v", err)
+	}
+	select {
+	case <-p.Exited():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the handle to be reset after corruption")
+	}
+}
+
+// firstBytesConn records the first bytes read through it.
+type firstBytesConn struct {
+	net.Conn
+	mu    sync.Mutex
+	first []byte
+}
+
+func (c *firstBytesConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.first == nil {
+		c.first = append([]byte{}, p[:n]...)
+	}
+	return n, err
+}
+
+func TestChecksumsNegotiated(t *testing.T) {
+	// The provider is not told to use checksums, and picks them up from the
+	// host's first frame.
+	serverConn, clientConn := net.Pipe()
+	s := NewProviderConn(serverConn)
+	s.RegisterName("api", api{})
+	go s.Serve()
+	conn := &firstBytesConn{Conn: clientConn}
+	p, err := NewPlugin(conn, WithChecksums(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	var reply string
+	if err := p.Call("api.SayHi", "bob", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "Hi bob" {
+		t.Fatalf("expected %q, got %q", "Hi bob", reply)
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if !bytes.HasPrefix(conn.first, checksumMagic[:]) {
+		t.Errorf("expected the provider to answer with checksummed frames, got %q", conn.first)
+	}
+}
+
+func TestChecksumsWithStartPlugin(t *testing.T) {
+	stray := make(chan string, 10)
+	p, err := StartPlugin(os.Stderr, os.Args[0], helperArgs("provider"),
+		WithChecksums(false), WithFraming(func(b []byte) { stray <- string(b) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if err := p.Call("helper.PrintRaw", "Hello world\n", new(int)); err != nil {
+		t.Fatal(err)
+	}
+	var reply string
+	if err := p.Call("api.SayHi", "bob", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "Hi bob" {
+		t.Fatalf("expected %q, got %q", "Hi bob", reply)
+	}
+	if got := <-stray; got != "Hello world\n" {
+		t.Fatalf("expected stray print to be reported, got %q", got)
+	}
+}
@@ -0,0 +1,312 @@
+package pie
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+)
+
+// discarder is implemented by ServerCodecs that hold state for each request
+// until its response is written.  The dispatcher calls discard instead of
+// writing a response to a notification.  Codecs that do not implement it are
+// sent responses to notifications, which clients ignore.
+type discarder interface {
+	discard(seq uint64)
+}
+
+// gobServerCodec is the gob ServerCodec that rpc.Server.ServeConn uses, which
+// net/rpc does not export.  Serve uses it so that its codec can be wrapped.
+type gobServerCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	closed bool
+}
+
+// newGobServerCodec returns a ServerCodec that uses gob encoding over conn,
+// exactly as rpc.Server.ServeConn does.
+func newGobServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	buf := bufio.NewWriter(conn)
+	return &gobServerCodec{
+		rwc:    conn,
+		dec:    gob.NewDecoder(conn),
+		enc:    gob.NewEncoder(buf),
+		encBuf: buf,
+	}
+}
+
+func (c *gobServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	return c.dec.Decode(r)
+}
+
+func (c *gobServerCodec) ReadRequestBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *gobServerCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
+	if err = c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			// Gob couldn't encode the header.  Should not happen, so if it
+			// does, shut down the connection to signal that it is broken.
+			log.Println("rpc: gob error encoding response:", err)
+			c.Close()
+		}
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			// Was a gob problem encoding the body but the header has been
+			// written.  Shut down the connection to signal that it is broken.
+			log.Println("rpc: gob error encoding body:", err)
+			c.Close()
+		}
+		return
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobServerCodec) discard(seq uint64) {}
+
+func (c *gobServerCodec) Close() error {
+	if c.closed {
+		// Only call c.rwc.Close once; otherwise the semantics are undefined.
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
+
+// gobClientCodec is the gob ClientCodec that rpc.NewClient uses, which
+// net/rpc does not export.
+type gobClientCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	// msgs is what dec reads from, which measures and limits replies, and
+	// last is what it measured of the last reply body.
+	msgs *gobMessageReader
+	last replySize
+}
+
+// newGobClientCodec returns a ClientCodec that uses gob encoding over conn,
+// exactly as rpc.NewClient does.
+func newGobClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	return newGobClientCodecReader(conn, bufio.NewReader(conn))
+}
+
+// newGobClientCodecReader returns a gob ClientCodec that writes to conn and
+// reads from r, which reads from conn.
+func newGobClientCodecReader(conn io.ReadWriteCloser, r interface {
+	io.Reader
+	io.ByteReader
+}) *gobClientCodec {
+	buf := bufio.NewWriter(conn)
+	msgs := &gobMessageReader{r: r}
+	return &gobClientCodec{
+		rwc:    conn,
+		dec:    gob.NewDecoder(msgs),
+		enc:    gob.NewEncoder(buf),
+		encBuf: buf,
+		msgs:   msgs,
+	}
+}
+
+func (c *gobClientCodec) WriteRequest(r *rpc.Request, body interface{}) (err error) {
+	if err = c.enc.Encode(r); err != nil {
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		return
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobClientCodec) ReadResponseHeader(r *rpc.Response) error {
+	return c.dec.Decode(r)
+}
+
+func (c *gobClientCodec) ReadResponseBody(body interface{}) error {
+	c.msgs.arm()
+	err := c.dec.Decode(body)
+	c.last = c.msgs.disarm()
+	return err
+}
+
+func (c *gobClientCodec) setReplyLimit(max int) {
+	if max > 0 {
+		c.msgs.limit = uint64(max)
+	}
+}
+
+func (c *gobClientCodec) lastReplySize() replySize {
+	return c.last
+}
+
+func (c *gobClientCodec) Close() error {
+	return c.rwc.Close()
+}
+
+// notifySeq is the sequence number of notifications.  Nothing ever responds to
+// it, and an rpc.Client would take centuries to reach it.
+const notifySeq = math.MaxUint64
+
+// clientCodec wraps the codec of a Plugin's rpc.Client so that the Plugin can
+// also write requests that bypass the client, such as notifications.
+type clientCodec struct {
+	rpc.ClientCodec
+	mu sync.Mutex
+	// sent and received count the requests and responses, for ConnStats.
+	sent     uint64
+	received uint64
+
+	// replies are the sizes of the watched replies, by reply pointer,
+	// deferred the functions that decode the deferred replies, and aliases
+	// map the pointers replies are decoded into to the watched or deferred
+	// pointers they stand in for.
+	repliesMu sync.Mutex
+	replies   map[interface{}]replySize
+	deferred  map[interface{}]func(interface{}) error
+	aliases   map[interface{}]interface{}
+
+	// marshalers holds the typeMarshalers negotiated with WithMarshalers.
+	marshalers atomic.Value
+
+	// budget measures the replies of codecs that cannot measure them
+	// themselves, if replies are measured.
+	budget *replyBudget
+}
+
+// WriteRequest writes a request, serializing it with those written by the
+// Plugin itself.
+func (c *clientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	body, err := c.usedMarshalers().marshal(body)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err = c.ClientCodec.WriteRequest(r, body)
+	if err == nil {
+		atomic.AddUint64(&c.sent, 1)
+	}
+	return err
+}
+
+// notify writes a notification, which the provider will not respond to.
+func (c *clientCodec) notify(serviceMethod string, args interface{}) error {
+	r := &rpc.Request{ServiceMethod: callMeta{notify: true}.encode(serviceMethod), Seq: notifySeq}
+	return c.WriteRequest(r, args)
+}
+
+// NewJSONServerCodec returns a JSON-RPC 1.0 ServerCodec for use with
+// Server.ServeCodec.  It is a drop-in replacement for net/rpc/jsonrpc's
+// NewServerCodec that also supports notifications: requests with a null id
+// are served without a response, as the JSON-RPC specification requires.
+func NewJSONServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	return &jsonServerCodec{
+		dec:     json.NewDecoder(conn),
+		enc:     json.NewEncoder(conn),
+		c:       conn,
+		pending: map[uint64]*json.RawMessage{},
+	}
+}
+
+// jsonServerCodec is net/rpc/jsonrpc's server codec, with support for
+// notifications.
+type jsonServerCodec struct {
+	dec *json.Decoder
+	enc *json.Encoder
+	c   io.Closer
+
+	// req is the request being read.  It is reset for each request.
+	req jsonServerRequest
+
+	mu      sync.Mutex
+	seq     uint64
+	pending map[uint64]*json.RawMessage
+}
+
+type jsonServerRequest struct {
+	Method string           `json:"method"`
+	Params *json.RawMessage `json:"params"`
+	Id     *json.RawMessage `json:"id"`
+}
+
+type jsonServerResponse struct {
+	Id     *json.RawMessage `json:"id"`
+	Result interface{}      `json:"result"`
+	Error  interface{}      `json:"error"`
+}
+
+var errMissingParams = errors.New("jsonrpc: request body missing params")
+
+func (c *jsonServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	c.req = jsonServerRequest{}
+	if err := c.dec.Decode(&c.req); err != nil {
+		return err
+	}
+	r.ServiceMethod = c.req.Method
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	r.Seq = c.seq
+	if c.req.Id == nil || string(*c.req.Id) == "null" {
+		name, meta := splitMeta(r.ServiceMethod)
+		meta.notify = true
+		r.ServiceMethod = meta.encode(name)
+		return nil
+	}
+	c.pending[c.seq] = c.req.Id
+	c.req.Id = nil
+	return nil
+}
+
+func (c *jsonServerCodec) ReadRequestBody(x interface{}) error {
+	if x == nil {
+		return nil
+	}
+	if c.req.Params == nil {
+		return errMissingParams
+	}
+	// JSON-RPC params are an array holding the single argument.
+	params := [1]interface{}{x}
+	return json.Unmarshal(*c.req.Params, &params)
+}
+
+func (c *jsonServerCodec) WriteResponse(r *rpc.Response, x interface{}) error {
+	c.mu.Lock()
+	b, ok := c.pending[r.Seq]
+	if !ok {
+		c.mu.Unlock()
+		return errors.New("invalid sequence number in response")
+	}
+	delete(c.pending, r.Seq)
+	c.mu.Unlock()
+
+	resp := jsonServerResponse{Id: b}
+	if r.Error == "" {
+		resp.Result = x
+	} else {
+		resp.Error = r.Error
+	}
+	return c.enc.Encode(resp)
+}
+
+func (c *jsonServerCodec) discard(seq uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, seq)
+}
+
+func (c *jsonServerCodec) Close() error {
+	return c.c.Close()
+}
@@ -0,0 +1,147 @@
+package pie
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"reflect"
+)
+
+// adapter is a translation set by Server.Adapt.
+type adapter struct {
+	constraint Constraint
+	m          *method
+}
+
+// Adapt makes the Server serve calls to serviceMethod with fn, instead of the
+// method registered under that name, if any, when the client negotiated a
+// version of the API that satisfies constraint, such as "< 2".  This keeps
+// clients written against old versions of an API working once the
+// implementation has moved on: fn takes the arguments the old version sends,
+// and returns the reply it expects, translating them to and from calls to the
+// current implementation.  serviceMethod need not be registered, so that
+// methods the current version has dropped can be served to the clients that
+// still call them.
+//
+// fn is an adapter, a func in one of the forms Register serves,
+//
+//	func(args A, reply *R) error
+//	func(ctx context.Context, args A, reply *R) error
+//	func(ctx context.Context, args A) (R, error)
+//	func(args A) (R, error)
+//
+// Adapters are tried in the order they were set, and the first whose
+// constraint the client's version satisfies serves the call.  A client that
+// negotiated no version counts as v0.0.0, the oldest of all.  It is most
+// useful on the Servers returned by StartConsumer, whose API versions are set
+// with SetAPIVersions and negotiated by consumers with NegotiateHostAPI, but
+// providers can adapt calls from hosts started with WithAPIVersions too.
+// Adapt must be called before Serve.
+func (s Server) Adapt(constraint, serviceMethod string, fn interface{}) error {
+	if s.d == nil {
+		return errors.New("pie: server cannot be configured")
+	}
+	if service, _, ok := splitServiceMethod(serviceMethod); !ok || service == "" || service == controlService {
+		return fmt.Errorf("pie: cannot adapt %s: not a method name", serviceMethod)
+	}
+	c, err := ParseConstraint(constraint)
+	if err != nil {
+		return err
+	}
+	m := funcMethod(fn)
+	if m == nil {
+		return fmt.Errorf("pie: cannot adapt %s: %T is not a func of a form Register serves", serviceMethod, fn)
+	}
+	s.d.regMu.Lock()
+	defer s.d.regMu.Unlock()
+	if s.d.serving {
+		return ErrRegisterAfterServe
+	}
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	if s.d.adapters == nil {
+		s.d.adapters = map[string][]adapter{}
+	}
+	s.d.adapters[serviceMethod] = append(s.d.adapters[serviceMethod], adapter{constraint: c, m: m})
+	return nil
+}
+
+// funcMethod returns a method for fn if it is a func in one of the forms
+// Register serves, and nil otherwise.
+func funcMethod(fn interface{}) *method {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func || v.IsNil() {
+		return nil
+	}
+	if m := adaptMethod(v); m != nil {
+		return m
+	}
+	t := v.Type()
+	if t.NumIn() != 2 || t.In(1).Kind() != reflect.Ptr || t.NumOut() != 1 || t.Out(0) != typeOfError {
+		return nil
+	}
+	m := &method{fn: v, arg: t.In(0), reply: t.In(1).Elem()}
+	if !exportedOrBuiltin(m.arg) || !exportedOrBuiltin(m.reply) {
+		return nil
+	}
+	return m
+}
+
+// setAPIVersion records the API version the client negotiated.
+func (d *dispatcher) setAPIVersion(v string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.apiVersion = v
+}
+
+// adapter returns the adapter that serves calls to serviceMethod from the
+// client, or nil if the method itself does.
+func (d *dispatcher) adapter(serviceMethod string) *method {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	adapters := d.adapters[serviceMethod]
+	if len(adapters) == 0 {
+		return nil
+	}
+	var v Version
+	if d.apiVersion != "" {
+		v, _ = ParseVersion(d.apiVersion)
+	}
+	for _, a := range adapters {
+		if a.constraint.Check(v) {
+			return a.m
+		}
+	}
+	return nil
+}
+
+// hostControl is the control API served to consumers by the Servers returned
+// by StartConsumer, which only negotiates the version of the host's API.
+type hostControl struct {
+	d *dispatcher
+}
+
+// Handshake negotiates the version of the host's API to use.  The consumer
+// sends the API versions it accepts, and the host replies with the versions
+// it implements, as the host does with a provider.
+func (c *hostControl) Handshake(accept []string, offered *[]string) error {
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	for _, v := range c.d.apiVersions {
+		*offered = append(*offered, v.String())
+	}
+	c.d.apiVersion, _ = selectAPIVersion(accept, *offered)
+	return nil
+}
+
+// NegotiateHostAPI negotiates the version of the host's API that the
+// consumer client, such as one returned by NewConsumer, will speak.  accept
+// lists the versions the consumer can speak, and the version is selected as
+// WithAPIVersions selects one, from the versions the host declared with
+// Server.SetAPIVersions, so that the host serves the consumer with the
+// adapters set by Server.Adapt for that version.  It returns an empty string
+// if the host declares no API versions, and a *VersionMismatchError if the
+// host implements none that the consumer accepts.
+func NegotiateHostAPI(client *rpc.Client, accept ...string) (string, error) {
+	return negotiateAPIVersion(client, accept)
+}
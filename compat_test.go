@@ -0,0 +1,150 @@
+package pie
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// adaptedHost serves store to consumers as versions 1 to 3 of the host's API,
+// with adapters for clients of versions before 3, and returns a function that
+// connects a consumer.
+func adaptedHost(t *testing.T) func() *rpc.Client {
+	return func() *rpc.Client {
+		serverConn, clientConn := net.Pipe()
+		s := newConsumerServer(serverConn)
+		s.RegisterName("Store", store{})
+		if err := s.SetAPIVersions("v1", "v2", "v3"); err != nil {
+			t.Fatal(err)
+		}
+		// Version 1 had Get, which version 3 replaced with GetV3.
+		err := s.Adapt("< 2", "Store.Get", func(key string) (string, error) {
+			var val string
+			err := store{}.GetV3(key, &val)
+			return "old " + val, err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Until version 3, List returned how many keys there were.
+		err = s.Adapt("< 3", "Store.List", func(prefix string, n *int) error {
+			keys, err := store{}.List(prefix)
+			*n = len(keys)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.Serve()
+		client := rpc.NewClient(clientConn)
+		t.Cleanup(func() { client.Close() })
+		return client
+	}
+}
+
+func TestAdapt(t *testing.T) {
+	connect := adaptedHost(t)
+
+	v1 := connect()
+	if v, err := NegotiateHostAPI(v1, "v1"); err != nil || v != "1.0.0" {
+		t.Fatalf("Expected version 1.0.0, got %q, %v", v, err)
+	}
+	var val string
+	if err := v1.Call("Store.Get", "k", &val); err != nil || val != "old v3:k" {
+		t.Errorf("Expected the adapter to serve Store.Get, got %q, %v", val, err)
+	}
+	var n int
+	if err := v1.Call("Store.List", "x", &n); err != nil || n != 2 {
+		t.Errorf("Expected the adapter to serve Store.List, got %d, %v", n, err)
+	}
+
+	v2 := connect()
+	if v, err := NegotiateHostAPI(v2, "v2"); err != nil || v != "2.0.0" {
+		t.Fatalf("Expected version 2.0.0, got %q, %v", v, err)
+	}
+	if err := v2.Call("Store.Get", "k", &val); err == nil || !strings.Contains(err.Error(), "can't find method") {
+		t.Errorf("Expected Store.Get to be gone in version 2, got %v", err)
+	}
+	if err := v2.Call("Store.List", "x", &n); err != nil || n != 2 {
+		t.Errorf("Expected the adapter to serve Store.List, got %d, %v", n, err)
+	}
+
+	v3 := connect()
+	if v, err := NegotiateHostAPI(v3, "v2", "v3"); err != nil || v != "3.0.0" {
+		t.Fatalf("Expected version 3.0.0, got %q, %v", v, err)
+	}
+	var keys []string
+	if err := v3.Call("Store.List", "x", &keys); err != nil || !reflect.DeepEqual(keys, []string{"xa", "xb"}) {
+		t.Errorf("Expected Store.List itself to serve version 3, got %v, %v", keys, err)
+	}
+}
+
+func TestAdaptUnversioned(t *testing.T) {
+	// Hosts that do not negotiate count as the oldest version.
+	p := pipePlugin(t, routedServer(t, func(s Server) error {
+		return s.Adapt("< 1", "Store.Get", func(key string, val *string) error {
+			return store{}.GetV2(key, val)
+		})
+	}))
+	var val string
+	if err := p.Call("Store.Get", "k", &val); err != nil || val != "v2:k" {
+		t.Errorf("Expected the adapter to serve Store.Get, got %q, %v", val, err)
+	}
+	connect := adaptedHost(t)
+	var n int
+	if err := connect().Call("Store.List", "x", &n); err != nil || n != 2 {
+		t.Errorf("Expected the adapter to serve consumers that do not negotiate, got %d, %v", n, err)
+	}
+}
+
+func TestNegotiateHostAPI(t *testing.T) {
+	connect := adaptedHost(t)
+	_, err := NegotiateHostAPI(connect(), "v4")
+	var mismatch *VersionMismatchError
+	if !errors.As(err, &mismatch) || !reflect.DeepEqual(mismatch.Offered, []string{"1.0.0", "2.0.0", "3.0.0"}) {
+		t.Errorf("Expected a version mismatch, got %v", err)
+	}
+	if _, err := NegotiateHostAPI(connect(), "one"); err == nil {
+		t.Error("Expected an error negotiating an invalid version")
+	}
+
+	serverConn, clientConn := net.Pipe()
+	s := newConsumerServer(serverConn)
+	s.RegisterName("Store", store{})
+	go s.Serve()
+	client := rpc.NewClient(clientConn)
+	defer client.Close()
+	if v, err := NegotiateHostAPI(client, "v1"); err != nil || v != "" {
+		t.Errorf("Expected no version from a host that declares none, got %q, %v", v, err)
+	}
+	if v := s.APIVersion(); v != "" {
+		t.Errorf("Expected the host to have no version, got %q", v)
+	}
+}
+
+func TestAdaptErrors(t *testing.T) {
+	s := NewProviderConn(nil)
+	s.RegisterName("Store", store{})
+	for _, tc := range []struct {
+		constraint, method string
+		fn                 interface{}
+		msg                string
+	}{
+		{"< 2", "Get", func(string) (string, error) { return "", nil }, "not a method name"},
+		{"< 2", "pie.Ping", func(string) (string, error) { return "", nil }, "not a method name"},
+		{"~> 2", "Store.Get", func(string) (string, error) { return "", nil }, "invalid"},
+		{"< 2", "Store.Get", "store", "not a func"},
+		{"< 2", "Store.Get", func(string) string { return "" }, "not a func"},
+	} {
+		err := s.Adapt(tc.constraint, tc.method, tc.fn)
+		if err == nil || !strings.Contains(err.Error(), tc.msg) {
+			t.Errorf("Adapt(%q, %q): expected an error containing %q, got %v", tc.constraint, tc.method, tc.msg, err)
+		}
+	}
+	if err := (Server{}).Adapt("< 2", "Store.Get", func(string) (string, error) { return "", nil }); err == nil {
+		t.Error("Expected an error from a zero Server")
+	}
+}
@@ -0,0 +1,332 @@
+package pie
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Config describes a fleet of plugins for a Manager to run.  It is usually
+// loaded from a JSON file with LoadConfig, such as:
+//
+//	{
+//	  "catalog": "https://plugins.example.com/index.json",
+//	  "plugins": [{
+//	    "name": "resize",
+//	    "path": "/usr/libexec/myapp/resize",
+//	    "args": ["--fast"],
+//	    "env": {"RESIZE_THREADS": "4"},
+//	    "restart": {"max_restarts": 5, "backoff": "2s"},
+//	    "limits": {"max_calls": 10000, "max_rss": 536870912, "action": "recycle"}
+//	  }, {
+//	    "name": "thumbnail",
+//	    "constraint": ">= 1.2, < 2.0"
+//	  }],
+//	  "profiles": {
+//	    "minimal": {"plugins": ["resize"]},
+//	    "ci": {"overrides": {"resize": {"env": {"RESIZE_THREADS": "1"}}}}
+//	  }
+//	}
+type Config struct {
+	// Catalog is the URL of the catalog index plugins are installed and
+	// updated from.
+	Catalog string `json:"catalog,omitempty"`
+	// CacheDir is where downloaded plugins are cached.  It defaults to the
+	// Fetcher's default.
+	CacheDir string         `json:"cache_dir,omitempty"`
+	Plugins  []PluginConfig `json:"plugins"`
+	// Profiles are the Manager's Profiles, by name.
+	Profiles map[string]ProfileConfig `json:"profiles,omitempty"`
+}
+
+// ProfileConfig describes a Profile in a Config.
+type ProfileConfig struct {
+	Plugins   []string                  `json:"plugins,omitempty"`
+	Overrides map[string]OverrideConfig `json:"overrides,omitempty"`
+}
+
+// OverrideConfig describes an Override in a Config.  Its Env is added to the
+// plugin's, and its Args, Restart, and Limits, if set, replace the plugin's.
+type OverrideConfig struct {
+	Args    []string          `json:"args,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	Restart *RestartConfig    `json:"restart,omitempty"`
+	Limits  *LimitsConfig     `json:"limits,omitempty"`
+}
+
+// PluginConfig describes one plugin in a Config.  Exactly one of Path and URL
+// may be set; if neither is, the plugin is installed from the catalog.
+type PluginConfig struct {
+	Name        string            `json:"name"`
+	Path        string            `json:"path,omitempty"`
+	URL         string            `json:"url,omitempty"`
+	SHA256      string            `json:"sha256,omitempty"`
+	Version     string            `json:"version,omitempty"`
+	Constraint  string            `json:"constraint,omitempty"`
+	Args        []string          `json:"args,omitempty"`
+	Env         map[string]string `json:"env,omitempty"`
+	Restart     RestartConfig     `json:"restart"`
+	Limits      LimitsConfig      `json:"limits"`
+	DependsOn   []string          `json:"depends_on,omitempty"`
+	StopTimeout Duration          `json:"stop_timeout,omitempty"`
+}
+
+// RestartConfig is the restart policy of a plugin in a Config.  See Policy for
+// the meaning of each field.
+type RestartConfig struct {
+	MaxRestarts int      `json:"max_restarts"`
+	Backoff     Duration `json:"backoff,omitempty"`
+}
+
+// LimitsConfig describes the limits placed on a plugin in a Config.  See
+// Policy and Threshold for the meaning of each field.  Action is what happens
+// when a resource limit is exceeded: "warn", "recycle" (the default), or
+// "kill".
+type LimitsConfig struct {
+	MaxCalls      uint64   `json:"max_calls,omitempty"`
+	MaxLifetime   Duration `json:"max_lifetime,omitempty"`
+	MaxRSS        uint64   `json:"max_rss,omitempty"`
+	MaxCPUTime    Duration `json:"max_cpu_time,omitempty"`
+	MaxOpenFDs    int      `json:"max_open_fds,omitempty"`
+	Action        string   `json:"action,omitempty"`
+	StatsInterval Duration `json:"stats_interval,omitempty"`
+}
+
+// Duration is a time.Duration that is written in a Config as a string, such
+// as "1.5s" or "10m".
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"5s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// LoadConfig reads the JSON Config in the named file.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := ParseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// ParseConfig parses and validates a JSON Config.  Unknown fields are
+// rejected, so that typos do not go unnoticed.
+func ParseConfig(data []byte) (*Config, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	cfg := &Config{}
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("invalid plugin config: %w", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate checks that the config is complete and consistent.
+func (c *Config) Validate() error {
+	seen := map[string]bool{}
+	for i, p := range c.Plugins {
+		if p.Name == "" {
+			return fmt.Errorf("plugin %d in config has no name", i)
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("plugin %s appears in config more than once", p.Name)
+		}
+		seen[p.Name] = true
+		switch {
+		case p.Path != "" && p.URL != "":
+			return fmt.Errorf("plugin %s has both a path and a url", p.Name)
+		case p.URL != "" && p.SHA256 == "":
+			return fmt.Errorf("plugin %s has a url but no sha256", p.Name)
+		case p.Path == "" && p.URL == "" && c.Catalog == "":
+			return fmt.Errorf("plugin %s has no path or url, and there is no catalog to install it from", p.Name)
+		}
+		if p.Version != "" {
+			if _, err := ParseVersion(p.Version); err != nil {
+				return fmt.Errorf("plugin %s: %w", p.Name, err)
+			}
+		}
+		if _, err := ParseConstraint(p.Constraint); err != nil {
+			return fmt.Errorf("plugin %s: %w", p.Name, err)
+		}
+		if _, err := parseThresholdAction(p.Limits.Action); err != nil {
+			return fmt.Errorf("plugin %s: %w", p.Name, err)
+		}
+	}
+	for _, p := range c.Plugins {
+		for _, dep := range p.DependsOn {
+			if !seen[dep] {
+				return fmt.Errorf("plugin %s depends on plugin %s, which is not in the config", p.Name, dep)
+			}
+		}
+	}
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		prof := c.Profiles[name]
+		overridden := make([]string, 0, len(prof.Overrides))
+		for p, o := range prof.Overrides {
+			overridden = append(overridden, p)
+			if o.Limits == nil {
+				continue
+			}
+			if _, err := parseThresholdAction(o.Limits.Action); err != nil {
+				return fmt.Errorf("profile %s: plugin %s: %w", name, p, err)
+			}
+		}
+		if err := checkProfile(seen, prof.Plugins, overridden); err != nil {
+			return fmt.Errorf("profile %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// FromConfig configures the Manager to run the plugins described by cfg: it
+// sets the Manager's Catalog, Fetcher, Plugins, and Profiles.  The plugins are
+// not started; call StartAll to start them.  The plugins' stderr is discarded
+// unless the Output of each PluginSpec in Plugins is set before they are
+// started.
+func (m *Manager) FromConfig(cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if cfg.Catalog != "" {
+		m.Catalog = &Catalog{URL: cfg.Catalog}
+	}
+	if cfg.CacheDir != "" {
+		m.Fetcher = &Fetcher{CacheDir: cfg.CacheDir}
+	}
+	m.Plugins = nil
+	byName := map[string]PluginConfig{}
+	for _, pc := range cfg.Plugins {
+		m.Plugins = append(m.Plugins, pc.spec())
+		byName[pc.Name] = pc
+	}
+	m.Profiles = nil
+	for name, prof := range cfg.Profiles {
+		if m.Profiles == nil {
+			m.Profiles = map[string]Profile{}
+		}
+		p := Profile{Plugins: prof.Plugins}
+		for plugin, oc := range prof.Overrides {
+			if p.Overrides == nil {
+				p.Overrides = map[string]Override{}
+			}
+			p.Overrides[plugin] = byName[plugin].override(oc)
+		}
+		m.Profiles[name] = p
+	}
+	return nil
+}
+
+// override returns the Override described by oc for the plugin described by
+// pc.  Both must be valid.
+func (pc PluginConfig) override(oc OverrideConfig) Override {
+	o := Override{Args: oc.Args, Env: envList(oc.Env)}
+	if oc.Restart != nil || oc.Limits != nil {
+		if oc.Restart != nil {
+			pc.Restart = *oc.Restart
+		}
+		if oc.Limits != nil {
+			pc.Limits = *oc.Limits
+		}
+		policy := pc.spec().Policy
+		o.Policy = &policy
+	}
+	return o
+}
+
+// envList returns env as a list of "key=value" strings, sorted by key.
+func envList(env map[string]string) []string {
+	if len(env) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	list := make([]string, len(keys))
+	for i, k := range keys {
+		list[i] = k + "=" + env[k]
+	}
+	return list
+}
+
+// spec returns the PluginSpec described by the config.  The config must be
+// valid.
+func (pc PluginConfig) spec() PluginSpec {
+	spec := PluginSpec{
+		Name:        pc.Name,
+		Path:        pc.Path,
+		URL:         pc.URL,
+		SHA256:      pc.SHA256,
+		Version:     pc.Version,
+		Constraint:  pc.Constraint,
+		Args:        pc.Args,
+		DependsOn:   pc.DependsOn,
+		StopTimeout: time.Duration(pc.StopTimeout),
+		Policy: Policy{
+			MaxRestarts:   pc.Restart.MaxRestarts,
+			Backoff:       time.Duration(pc.Restart.Backoff),
+			MaxCalls:      pc.Limits.MaxCalls,
+			MaxLifetime:   time.Duration(pc.Limits.MaxLifetime),
+			StatsInterval: time.Duration(pc.Limits.StatsInterval),
+		},
+	}
+	l := pc.Limits
+	if l.MaxRSS > 0 || l.MaxCPUTime > 0 || l.MaxOpenFDs > 0 {
+		action, _ := parseThresholdAction(l.Action)
+		spec.Policy.Thresholds = []Threshold{{
+			MaxRSS:     l.MaxRSS,
+			MaxCPUTime: time.Duration(l.MaxCPUTime),
+			MaxOpenFDs: l.MaxOpenFDs,
+			Action:     action,
+		}}
+	}
+	if env := envList(pc.Env); env != nil {
+		spec.Options = append(spec.Options, WithEnv(env...))
+	}
+	return spec
+}
+
+// parseThresholdAction parses the action of a LimitsConfig.
+func parseThresholdAction(s string) (ThresholdAction, error) {
+	switch strings.ToLower(s) {
+	case "", "recycle":
+		return ThresholdRecycle, nil
+	case "warn":
+		return ThresholdWarn, nil
+	case "kill":
+		return ThresholdKill, nil
+	}
+	return 0, fmt.Errorf("unknown limit action %q, expected warn, recycle, or kill", s)
+}
@@ -0,0 +1,174 @@
+package pie
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`{
+		"catalog": "https://plugins.example.com/index.json",
+		"plugins": [{
+			"name": "resize",
+			"path": "/usr/libexec/resize",
+			"args": ["--fast"],
+			"env": {"B": "2", "A": "1"},
+			"restart": {"max_restarts": 5, "backoff": "2s"},
+			"limits": {"max_calls": 100, "max_lifetime": "1h", "max_rss": 1024, "action": "kill"}
+		}, {
+			"name": "thumbnail",
+			"constraint": ">= 1.2, < 2.0"
+		}]
+	}`))
+	if err != nil {
+		t.Fatalf("Unexpected error from ParseConfig: %#v", err)
+	}
+	m := &Manager{}
+	if err := m.FromConfig(cfg); err != nil {
+		t.Fatalf("Unexpected error from FromConfig: %#v", err)
+	}
+	if m.Catalog == nil || m.Catalog.URL != "https://plugins.example.com/index.json" {
+		t.Errorf("Wrong catalog: %#v", m.Catalog)
+	}
+	if len(m.Plugins) != 2 {
+		t.Fatalf("Expected 2 plugins, got %d", len(m.Plugins))
+	}
+	resize := m.Plugins[0]
+	if resize.Name != "resize" || resize.Path != "/usr/libexec/resize" || len(resize.Args) != 1 {
+		t.Errorf("Wrong spec for resize: %#v", resize)
+	}
+	p := resize.Policy
+	if p.MaxRestarts != 5 || p.Backoff != 2*time.Second || p.MaxCalls != 100 || p.MaxLifetime != time.Hour {
+		t.Errorf("Wrong policy for resize: %#v", p)
+	}
+	if len(p.Thresholds) != 1 || p.Thresholds[0].MaxRSS != 1024 || p.Thresholds[0].Action != ThresholdKill {
+		t.Errorf("Wrong thresholds for resize: %#v", p.Thresholds)
+	}
+	if len(resize.Options) != 1 {
+		t.Errorf("Expected an option setting the environment, got %d options", len(resize.Options))
+	}
+	if thumb := m.Plugins[1]; thumb.Constraint != ">= 1.2, < 2.0" || thumb.Path != "" || thumb.Policy.Thresholds != nil {
+		t.Errorf("Wrong spec for thumbnail: %#v", thumb)
+	}
+}
+
+func TestParseConfigProfiles(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`{
+		"plugins": [{
+			"name": "resize",
+			"path": "/usr/libexec/resize",
+			"restart": {"max_restarts": 5},
+			"limits": {"max_calls": 100}
+		}, {
+			"name": "thumbnail",
+			"path": "/usr/libexec/thumbnail"
+		}],
+		"profiles": {
+			"minimal": {"plugins": ["thumbnail"]},
+			"ci": {"overrides": {"resize": {"args": ["--slow"], "env": {"A": "1"}, "limits": {"max_calls": 10}}}}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("Unexpected error from ParseConfig: %#v", err)
+	}
+	m := &Manager{}
+	if err := m.FromConfig(cfg); err != nil {
+		t.Fatalf("Unexpected error from FromConfig: %#v", err)
+	}
+	specs, err := m.Profile("minimal")
+	if err != nil || len(specs) != 1 || specs[0].Name != "thumbnail" {
+		t.Errorf("Wrong specs for the minimal profile: %+v, %v", specs, err)
+	}
+	specs, err = m.Profile("ci")
+	if err != nil || len(specs) != 2 {
+		t.Fatalf("Wrong specs for the ci profile: %+v, %v", specs, err)
+	}
+	resize := specs[0]
+	if len(resize.Args) != 1 || resize.Args[0] != "--slow" || len(resize.Options) != 1 {
+		t.Errorf("Wrong overridden spec for resize: %#v", resize)
+	}
+	// Limits replace the plugin's, and its restart policy is kept.
+	if p := resize.Policy; p.MaxCalls != 10 || p.MaxRestarts != 5 {
+		t.Errorf("Wrong overridden policy for resize: %#v", p)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		config, err string
+	}{
+		{`{"plugins": [{"path": "/bin/foo"}]}`, "no name"},
+		{`{"plugins": [{"name": "foo", "path": "/a"}, {"name": "foo", "path": "/b"}]}`, "more than once"},
+		{`{"plugins": [{"name": "foo", "path": "/a", "url": "https://b"}]}`, "both a path and a url"},
+		{`{"plugins": [{"name": "foo", "url": "https://b"}]}`, "no sha256"},
+		{`{"plugins": [{"name": "foo"}]}`, "no catalog"},
+		{`{"plugins": [{"name": "foo", "path": "/a", "limits": {"action": "explode"}}]}`, "unknown limit action"},
+		{`{"plugins": [{"name": "foo", "path": "/a", "restart": {"backoff": 5}}]}`, "duration"},
+		{`{"plugins": [{"name": "foo", "path": "/a", "argz": []}]}`, "unknown field"},
+		{`{"plugins": [{"name": "foo", "path": "/a", "depends_on": ["bar"]}]}`, "not in the config"},
+		{`{"plugins": [{"name": "foo", "path": "/a"}], "profiles": {"ci": {"plugins": ["bar"]}}}`, "unknown plugin"},
+		{`{"plugins": [{"name": "foo", "path": "/a"}], "profiles": {"ci": {"plugins": [], "overrides": {"foo": {}}}}}`, "does not run"},
+		{`{"plugins": [{"name": "foo", "path": "/a"}], "profiles": {"ci": {"overrides": {"foo": {"limits": {"action": "explode"}}}}}}`, "unknown limit action"},
+	}
+	for _, test := range tests {
+		_, err := ParseConfig([]byte(test.config))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Expected error containing %q parsing %s, got %v", test.err, test.config, err)
+		}
+	}
+}
+
+func TestDurationJSON(t *testing.T) {
+	data, err := json.Marshal(Duration(90 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `"1m30s"` {
+		t.Errorf("Wrong JSON for duration, expected \"1m30s\", got %s", data)
+	}
+	var d Duration
+	if err := json.Unmarshal(data, &d); err != nil || time.Duration(d) != 90*time.Second {
+		t.Errorf("Duration did not round trip, got %v, %v", time.Duration(d), err)
+	}
+}
+
+func TestLoadConfigStartAll(t *testing.T) {
+	cfg := Config{Plugins: []PluginConfig{{
+		Name: "env",
+		Path: os.Args[0],
+		Args: helperArgs("provider"),
+		Env:  map[string]string{"PIE_TEST_VALUE": "hello"},
+	}}}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "plugins.json")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Unexpected error from LoadConfig: %#v", err)
+	}
+	m := &Manager{}
+	if err := m.FromConfig(loaded); err != nil {
+		t.Fatalf("Unexpected error from FromConfig: %#v", err)
+	}
+	if err := m.StartAll(context.Background()); err != nil {
+		t.Fatalf("Unexpected error from StartAll: %#v", err)
+	}
+	defer m.Close()
+	var value string
+	if err := m.Call("env", "helper.Getenv", "PIE_TEST_VALUE", &value); err != nil {
+		t.Fatalf("Unexpected error calling plugin: %#v", err)
+	}
+	if value != "hello" {
+		t.Errorf("Plugin did not get environment from config, expected %q, got %q", "hello", value)
+	}
+}
@@ -0,0 +1,105 @@
+package pie
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+)
+
+// NewProviderConn returns a Server that will serve RPC over conn, for plugins
+// that talk to their host over a connection other than their Stdin and
+// Stdout, such as a vsock or network connection.  Otherwise it is just like a
+// Server returned by NewProvider.
+func NewProviderConn(conn io.ReadWriteCloser) Server {
+	return newProvider(conn)
+}
+
+// NewPlugin returns a handle for a provider-style plugin that is already
+// running and reachable over conn, such as a plugin in a virtual machine or on
+// another host.  The handle works like one returned by StartPlugin, except
+// that there is no local process: the plugin counts as exited once conn is
+// closed or fails, and closing the handle closes conn.  Options that concern
+// starting the plugin process, such as WithEnv or WithPreflight, have no
+// effect.
+func NewPlugin(conn io.ReadWriteCloser, opts ...StartOption) (*Plugin, error) {
+	return newConnPlugin(context.Background(), false, conn, opts)
+}
+
+// NewPluginContext is like NewPlugin, but ties the plugin to ctx the way
+// StartPluginContext does, and does not return until the plugin has answered
+// a ping.
+func NewPluginContext(ctx context.Context, conn io.ReadWriteCloser, opts ...StartOption) (*Plugin, error) {
+	return newConnPlugin(ctx, true, conn, opts)
+}
+
+// newConnPlugin returns a handle for the plugin at the other end of conn for
+// NewPlugin and NewPluginContext.
+func newConnPlugin(ctx context.Context, ready bool, conn io.ReadWriteCloser, opts []StartOption) (*Plugin, error) {
+	var o startOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	proc := &connProcess{done: make(chan struct{})}
+	watched := &connCloser{ReadWriteCloser: conn, proc: proc}
+	proc.conn = watched
+	return newPlugin(ctx, ready, watched, newReaper(proc), &o)
+}
+
+// connProcess stands in for the process of a plugin reached over a
+// connection.  It counts as exited once the connection is closed or fails,
+// and signalling or killing it closes the connection.
+type connProcess struct {
+	conn *connCloser
+	once sync.Once
+	done chan struct{}
+}
+
+// exit marks the process exited.
+func (p *connProcess) exit() {
+	p.once.Do(func() { close(p.done) })
+}
+
+// Wait blocks until the connection is closed or fails.
+func (p *connProcess) Wait() (*os.ProcessState, error) {
+	<-p.done
+	return nil, nil
+}
+
+// Kill closes the connection.
+func (p *connProcess) Kill() error {
+	return p.conn.Close()
+}
+
+// Signal closes the connection, whatever the signal.
+func (p *connProcess) Signal(os.Signal) error {
+	return p.conn.Close()
+}
+
+// connCloser marks its connProcess exited when the connection it wraps is
+// closed or fails.
+type connCloser struct {
+	io.ReadWriteCloser
+	proc *connProcess
+	once sync.Once
+	err  error
+}
+
+// Read reads from the connection, marking the process exited if the read
+// fails.
+func (c *connCloser) Read(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(b)
+	if err != nil {
+		c.proc.exit()
+	}
+	return n, err
+}
+
+// Close closes the connection once, and marks the process exited.
+func (c *connCloser) Close() error {
+	c.once.Do(func() {
+		c.err = c.ReadWriteCloser.Close()
+		c.proc.exit()
+	})
+	return c.err
+}
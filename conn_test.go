@@ -0,0 +1,123 @@
+package pie
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// connPlugin serves a provider over one end of a pipe, and returns a handle
+// for it made by NewPlugin from the other end.
+func connPlugin(t *testing.T) (*Plugin, <-chan struct{}) {
+	serverConn, clientConn := net.Pipe()
+	s := NewProviderConn(serverConn)
+	s.RegisterName("api", api{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Serve()
+	}()
+	p, err := NewPlugin(clientConn)
+	if err != nil {
+		t.Fatalf("Unexpected error from NewPlugin: %#v", err)
+	}
+	return p, done
+}
+
+func TestNewPlugin(t *testing.T) {
+	p, served := connPlugin(t)
+	var response string
+	if err := p.Call("api.SayHi", "bob", &response); err != nil {
+		t.Fatalf("Unexpected error from Call: %#v", err)
+	}
+	if response != "Hi bob" {
+		t.Errorf("Wrong response from api call, expected %q, got %q", "Hi bob", response)
+	}
+	if err := p.Ping(); err != nil {
+		t.Errorf("Unexpected error from Ping: %#v", err)
+	}
+	if p.Pid() != 0 {
+		t.Errorf("Expected no pid for a plugin reached over a connection, got %d", p.Pid())
+	}
+	p.Close()
+	for name, ch := range map[string]<-chan struct{}{"plugin": p.Exited(), "server": served} {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("The %s did not stop after Close", name)
+		}
+	}
+}
+
+// wrappedConn records the name of each wrapper a write passes through.
+type wrappedConn struct {
+	io.ReadWriteCloser
+	name  string
+	order *[]string
+}
+
+func (c wrappedConn) Write(p []byte) (int, error) {
+	*c.order = append(*c.order, c.name)
+	return c.ReadWriteCloser.Write(p)
+}
+
+func TestWithConnWrapper(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	s := NewProviderConn(serverConn)
+	s.RegisterName("api", api{})
+	go s.Serve()
+	var order []string
+	wrap := func(name string) StartOption {
+		return WithConnWrapper(func(conn io.ReadWriteCloser) io.ReadWriteCloser {
+			return wrappedConn{ReadWriteCloser: conn, name: name, order: &order}
+		})
+	}
+	p, err := NewPlugin(clientConn, wrap("inner"), wrap("outer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	var response string
+	if err := p.Call("api.SayHi", "bob", &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(order) < 2 || order[0] != "outer" || order[1] != "inner" {
+		t.Errorf("Expected writes to pass through the outer wrapper and then the inner, got %v", order)
+	}
+}
+
+func TestNewPluginRemoteHangup(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	p, err := NewPlugin(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	serverConn.Close()
+	select {
+	case <-p.Exited():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Plugin did not count as exited after the remote end hung up")
+	}
+}
+
+func TestNewPluginContext(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	// Nothing serves serverConn, so the plugin never answers its ping.
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, err := serverConn.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	if _, err := NewPluginContext(ctx, clientConn); err == nil {
+		t.Error("Expected an error from a plugin that never answers")
+	}
+}
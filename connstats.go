@@ -0,0 +1,74 @@
+package pie
+
+import (
+	"io"
+	"net/rpc"
+	"sync/atomic"
+)
+
+// ConnStats counts the traffic on the connection to a plugin.
+type ConnStats struct {
+	// BytesRead and BytesWritten count the bytes read from and written to
+	// the plugin.
+	BytesRead    uint64
+	BytesWritten uint64
+	// FramesSent counts the requests and notifications sent to the plugin,
+	// and FramesReceived counts the responses received from it.
+	FramesSent     uint64
+	FramesReceived uint64
+	// InFlight is the number of calls made through Call and its variants
+	// that have not yet returned.
+	InFlight int
+}
+
+// ConnStats returns the traffic counters of the connection to the plugin.
+// They are useful for spotting chatty plugins.
+func (p *Plugin) ConnStats() ConnStats {
+	var s ConnStats
+	if p.conn != nil {
+		s.BytesRead = atomic.LoadUint64(&p.conn.read)
+		s.BytesWritten = atomic.LoadUint64(&p.conn.written)
+	}
+	if p.codec != nil {
+		s.FramesSent = atomic.LoadUint64(&p.codec.sent)
+		s.FramesReceived = atomic.LoadUint64(&p.codec.received)
+	}
+	p.mu.Lock()
+	s.InFlight = len(p.inflight)
+	p.mu.Unlock()
+	return s
+}
+
+// countingConn counts the bytes read from and written to the connection it
+// wraps.
+type countingConn struct {
+	io.ReadWriteCloser
+	read    uint64
+	written uint64
+}
+
+// Read reads from the connection, counting the bytes read.
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	atomic.AddUint64(&c.read, uint64(n))
+	return n, err
+}
+
+// Write writes to the connection, counting the bytes written.
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	atomic.AddUint64(&c.written, uint64(n))
+	return n, err
+}
+
+// ReadResponseHeader reads a response header, counting the response.
+func (c *clientCodec) ReadResponseHeader(r *rpc.Response) error {
+	if c.budget != nil {
+		c.budget.arm()
+	}
+	err := c.ClientCodec.ReadResponseHeader(r)
+	if err == nil {
+		atomic.AddUint64(&c.received, 1)
+	}
+	return err
+}
@@ -0,0 +1,42 @@
+package pie
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestConnStats(t *testing.T) {
+	p := startHelper(t, "provider", os.Stderr)
+	defer p.Close()
+
+	before := p.ConnStats()
+	var response string
+	for i := 0; i < 3; i++ {
+		if err := p.Call("api.SayHi", "bob", &response); err != nil {
+			t.Fatalf("Unexpected error from Call: %#v", err)
+		}
+	}
+	after := p.ConnStats()
+	if n := after.FramesSent - before.FramesSent; n != 3 {
+		t.Errorf("Expected 3 frames sent, got %d", n)
+	}
+	if n := after.FramesReceived - before.FramesReceived; n != 3 {
+		t.Errorf("Expected 3 frames received, got %d", n)
+	}
+	if after.BytesWritten <= before.BytesWritten || after.BytesRead <= before.BytesRead {
+		t.Errorf("Expected byte counts to grow, got %+v then %+v", before, after)
+	}
+	if after.InFlight != 0 {
+		t.Errorf("Expected no calls in flight, got %d", after.InFlight)
+	}
+
+	go p.Call("helper.Block", 0, new(int))
+	deadline := time.Now().Add(5 * time.Second)
+	for p.ConnStats().InFlight != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 1 call in flight, got %d", p.ConnStats().InFlight)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,81 @@
+package pie
+
+import (
+	"net"
+	"sync"
+)
+
+// controlService is the name under which every provider created by NewProvider
+// publishes pie's built-in control API.  It is lowercase so that it can never
+// collide with a service registered via Server.Register, which requires an
+// exported type name.
+const controlService = "pie"
+
+// control is the built-in API served by providers alongside the plugin's own
+// services.  The host uses it to manage the plugin independently of whatever
+// API the plugin implements.
+type control struct {
+	// d is the provider's dispatcher, which keeps track of call groups.
+	d *dispatcher
+
+	mu          sync.Mutex
+	apiVersions []Version
+	apiVersion  string
+	methods     map[string]*MethodInfo
+	// registerErrs are the errors registering services, and selfTest
+	// whether the provider was run with --pie-selftest.
+	registerErrs []string
+	selfTest     bool
+
+	// streams are the readers and writers exported by the provider.
+	streamsMu sync.Mutex
+	streams   map[string]*exportedStream
+
+	// peers are the handlers for connections brokered by the host, and
+	// peerSocket is the socket the host passes them on, opened on first use.
+	peersMu    sync.Mutex
+	peers      map[string]func(net.Conn)
+	peerSocket struct {
+		once sync.Once
+		mu   sync.Mutex
+		conn *net.UnixConn
+		err  error
+	}
+
+	// features are the feature flags sent by the host, and onFeatures the
+	// function told when they change.  featuresNotify keeps the calls to it
+	// in order.
+	featuresMu     sync.Mutex
+	features       Features
+	onFeatures     func(Features)
+	featuresNotify sync.Mutex
+
+	// phase is the provider's startup Phase, and init is the function it
+	// runs to initialize.
+	phase    int32
+	phaseMu  sync.Mutex
+	init     func() error
+	initOnce sync.Once
+	initErr  error
+}
+
+// Ping echoes n back to the caller.  The host calls it periodically to make
+// sure the plugin is still responsive.
+func (*control) Ping(n int, reply *int) error {
+	*reply = n
+	return nil
+}
+
+// Handshake negotiates the version of the plugin's API to use.  The host sends
+// the API versions it accepts, and the plugin replies with the versions it
+// implements.  Both sides then pick the same version with selectAPIVersion.
+func (c *control) Handshake(accept []string, offered *[]string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, v := range c.apiVersions {
+		*offered = append(*offered, v.String())
+	}
+	c.apiVersion, _ = selectAPIVersion(accept, *offered)
+	c.d.setAPIVersion(c.apiVersion)
+	return nil
+}
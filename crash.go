@@ -0,0 +1,254 @@
+package pie
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultCrashTail is how much of a plugin's stderr WithCrashReports keeps by
+// default.
+const defaultCrashTail = 64 << 10
+
+// crashDrainTimeout is how long to wait, once a crashed plugin has exited, for
+// the rest of its stderr, which processes it started may hold open.
+const crashDrainTimeout = time.Second
+
+// WithCrashReports makes the handle keep the last tail bytes of what the
+// plugin writes to stderr, which is still written to the output passed to
+// StartPlugin, so that if the plugin crashes, Plugin.CrashReport can describe
+// how.  A plugin crashes if it is killed by a signal, or dies of a Go panic or
+// fatal error, unless the host was stopping it.  If tail is zero or less, the
+// last 64KiB are kept.
+func WithCrashReports(tail int) StartOption {
+	return func(o *startOptions) {
+		if tail <= 0 {
+			tail = defaultCrashTail
+		}
+		o.crashTail = tail
+	}
+}
+
+// CrashReport describes how a plugin started with WithCrashReports crashed.
+type CrashReport struct {
+	// Time is when the plugin was found to have exited.
+	Time time.Time
+	// Signal is the signal that killed the plugin, or nil if it exited.
+	Signal os.Signal
+	// ExitCode is the plugin's exit status, or -1 if it was killed by a
+	// signal.
+	ExitCode int
+	// CoreDumped reports whether the plugin dumped core, and CoreDump is
+	// the path of the core file, if the host can find it.  On Linux, it is
+	// found using the kernel's core_pattern, unless that pipes core dumps
+	// to a program such as systemd-coredump.
+	CoreDumped bool
+	CoreDump   string
+	// Stderr is the tail of what the plugin wrote to stderr.
+	Stderr []byte
+	// Panic is the report of the Go panic or fatal error the plugin died of,
+	// as the Go runtime wrote it to stderr, from its "panic:" or "fatal
+	// error:" line on, or empty if there is none in Stderr.
+	Panic string
+	// PanicReport is Panic parsed by ParsePanic, or nil if Panic is empty.
+	PanicReport *PanicReport
+	// Environment is what the plugin was started with.
+	Environment *StartEnvironment
+}
+
+// CrashReport returns the report of how the plugin crashed, or nil if it has
+// not exited, exited without crashing, or was not started with
+// WithCrashReports.  Once the plugin has exited, it may wait briefly for the
+// rest of the plugin's stderr.
+func (p *Plugin) CrashReport() *CrashReport {
+	if p.crash == nil {
+		return nil
+	}
+	select {
+	case <-p.proc.done:
+	default:
+		return nil
+	}
+	<-p.crash.ready
+	return p.crash.report
+}
+
+// crashCollector collects the artifacts of a plugin crash.
+type crashCollector struct {
+	// exe is the path of the plugin's executable, and dir its working
+	// directory.
+	exe, dir string
+	// env is what the plugin was started with.
+	env  *StartEnvironment
+	tail *tailBuffer
+	// drained is closed once all of the plugin's stderr has been read.
+	drained chan struct{}
+	// ready is closed once report is set, which is nil if the plugin did not
+	// crash.
+	ready  chan struct{}
+	report *CrashReport
+}
+
+// collectCrashes sets cmd up to write its stderr through a pipe the host reads,
+// copying it to output and keeping the last tail bytes.  The function returned
+// must be called once cmd has been started, with a channel that is closed when
+// it exits, or nil if it did not start; it closes the host's copy of the
+// pipe's write end, and starts reading the pipe.  Call watch with the
+// plugin's process to build a report when it exits.
+func collectCrashes(cmd *exec.Cmd, output io.Writer, tail int) (*crashCollector, func(exited <-chan struct{}), error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	cmd.Stderr = pw
+	dir := cmd.Dir
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+	c := &crashCollector{
+		exe:     cmd.Path,
+		dir:     dir,
+		tail:    &tailBuffer{max: tail},
+		drained: make(chan struct{}),
+		ready:   make(chan struct{}),
+	}
+	return c, func(exited <-chan struct{}) {
+		pw.Close()
+		if exited == nil {
+			pr.Close()
+			return
+		}
+		go func() {
+			defer close(c.drained)
+			defer pr.Close()
+			var w io.Writer = c.tail
+			if output != nil {
+				w = io.MultiWriter(output, c.tail)
+			}
+			io.Copy(w, pr)
+		}()
+	}, nil
+}
+
+// watch builds the crash report once r's process exits.
+func (c *crashCollector) watch(r *reaper) {
+	<-r.done
+	defer close(c.ready)
+	select {
+	case <-c.drained:
+	case <-time.After(crashDrainTimeout):
+	}
+	if r.state == nil || r.stopping.Load() {
+		return
+	}
+	report := &CrashReport{Time: time.Now(), ExitCode: r.state.ExitCode(), Stderr: c.tail.bytes(), Environment: c.env}
+	report.Signal, report.CoreDumped = exitSignal(r.state)
+	report.Panic = goPanic(report.Stderr)
+	report.PanicReport, _ = ParsePanic(report.Stderr)
+	if report.Signal == nil && report.Panic == "" && report.ExitCode != ExitPanic {
+		return
+	}
+	if report.CoreDumped {
+		report.CoreDump = corePath(r.state.Pid(), c.exe, c.dir)
+	}
+	c.report = report
+}
+
+// goPanic returns the Go runtime's report of a panic or fatal error in stderr,
+// from its first line on, or an empty string if there is none.
+func goPanic(stderr []byte) string {
+	for i := 0; i < len(stderr); {
+		line := stderr[i:]
+		if bytes.HasPrefix(line, []byte("panic: ")) || bytes.HasPrefix(line, []byte("fatal error: ")) {
+			return string(line)
+		}
+		n := bytes.IndexByte(line, '\n')
+		if n < 0 {
+			break
+		}
+		i += n + 1
+	}
+	return ""
+}
+
+// corePath returns the path of the core file dumped by the process with the
+// given pid, which ran the executable exe in dir, or an empty string if it
+// cannot be found.
+func corePath(pid int, exe, dir string) string {
+	pattern, err := os.ReadFile("/proc/sys/kernel/core_pattern")
+	if err != nil {
+		return ""
+	}
+	p := strings.TrimSpace(string(pattern))
+	if p == "" || strings.HasPrefix(p, "|") {
+		return ""
+	}
+	name := filepath.Base(exe)
+	if len(name) > 15 {
+		// The kernel names processes by their first 15 bytes.
+		name = name[:15]
+	}
+	var b strings.Builder
+	hasPid := false
+	for i := 0; i < len(p); i++ {
+		if p[i] != '%' || i == len(p)-1 {
+			b.WriteByte(p[i])
+			continue
+		}
+		i++
+		switch p[i] {
+		case '%':
+			b.WriteByte('%')
+		case 'p', 'P':
+			b.WriteString(strconv.Itoa(pid))
+			hasPid = true
+		case 'e':
+			b.WriteString(name)
+		default:
+			// Other fields, such as the time, cannot be known.
+			return ""
+		}
+	}
+	path := b.String()
+	if usesPid, _ := os.ReadFile("/proc/sys/kernel/core_uses_pid"); !hasPid && strings.TrimSpace(string(usesPid)) == "1" {
+		path += "." + strconv.Itoa(pid)
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// tailBuffer is a writer that keeps the last max bytes written to it.
+type tailBuffer struct {
+	max int
+	mu  sync.Mutex
+	buf []byte
+}
+
+// Write implements io.Writer.
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if over := len(t.buf) - t.max; over > 0 {
+		t.buf = append(t.buf[:0], t.buf[over:]...)
+	}
+	return len(p), nil
+}
+
+// bytes returns a copy of the bytes kept.
+func (t *tailBuffer) bytes() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]byte(nil), t.buf...)
+}
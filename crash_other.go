@@ -0,0 +1,11 @@
+//go:build !unix
+
+package pie
+
+import "os"
+
+// exitSignal reports no signal, since processes are not killed by signals on
+// this platform.
+func exitSignal(state *os.ProcessState) (os.Signal, bool) {
+	return nil, false
+}
@@ -0,0 +1,129 @@
+package pie
+
+import (
+	"bytes"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startCrashable starts the helper plugin with crash reports, writing its
+// stderr to output.
+func startCrashable(t *testing.T, output *lockedBuffer) *Plugin {
+	p, err := StartPlugin(output, os.Args[0], helperArgs("provider"), WithCrashReports(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func TestCrashReportPanic(t *testing.T) {
+	var output lockedBuffer
+	p := startCrashable(t, &output)
+	if p.CrashReport() != nil {
+		t.Error("Expected no crash report for a running plugin")
+	}
+	p.Call("helper.Panic", "boom", new(int))
+	<-p.Exited()
+	r := p.CrashReport()
+	if r == nil {
+		t.Fatal("Expected a crash report")
+	}
+	if !strings.HasPrefix(r.Panic, "panic: boom") || !strings.Contains(r.Panic, "goroutine ") {
+		t.Errorf("Expected the panic and its stack, got %q", r.Panic)
+	}
+	if r.Signal != nil || r.ExitCode != 2 {
+		t.Errorf("Expected exit status 2 and no signal, got %d, %v", r.ExitCode, r.Signal)
+	}
+	if !bytes.Contains(r.Stderr, []byte("panic: boom")) {
+		t.Errorf("Expected the stderr tail to hold the panic, got %q", r.Stderr)
+	}
+	if !strings.Contains(output.String(), "panic: boom") {
+		t.Error("Expected stderr to still be written to the output")
+	}
+}
+
+func TestCrashReportSignal(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("processes are not killed by signals on this platform")
+	}
+	var output lockedBuffer
+	p := startCrashable(t, &output)
+	if err := p.proc.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	<-p.Exited()
+	r := p.CrashReport()
+	if r == nil {
+		t.Fatal("Expected a crash report")
+	}
+	if r.Signal == nil || r.Signal.String() != "killed" || r.ExitCode != -1 || r.Panic != "" {
+		t.Errorf("Expected the plugin to have been killed, got %+v", r)
+	}
+}
+
+func TestCrashReportClosed(t *testing.T) {
+	var output lockedBuffer
+	p := startCrashable(t, &output)
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if r := p.CrashReport(); r != nil {
+		t.Errorf("Expected no crash report for a plugin the host stopped, got %+v", r)
+	}
+}
+
+func TestCrashReportEvent(t *testing.T) {
+	events := make(chan Event, 10)
+	s, err := Supervise(func() (*Plugin, error) {
+		return StartPlugin(nil, os.Args[0], helperArgs("provider"), WithCrashReports(1024))
+	}, Policy{OnEvent: func(e Event) { events <- e }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Call("helper.Panic", "supervised", new(int))
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.Kind != EventExited {
+				continue
+			}
+			if e.Crash == nil || !strings.HasPrefix(e.Crash.Panic, "panic: supervised") {
+				t.Errorf("Expected the exit event to carry the crash report, got %+v", e.Crash)
+			}
+			if len(e.Crash.Stderr) > 1024 {
+				t.Errorf("Expected at most 1024 bytes of stderr, got %d", len(e.Crash.Stderr))
+			}
+			return
+		case <-timeout:
+			t.Fatal("Timed out waiting for the exit event")
+		}
+	}
+}
+
+func TestGoPanic(t *testing.T) {
+	for in, want := range map[string]string{
+		"log line\npanic: oops\n\ngoroutine 1 [running]:\n": "panic: oops\n\ngoroutine 1 [running]:\n",
+		"fatal error: all goroutines are asleep\n":          "fatal error: all goroutines are asleep\n",
+		"log: no panic: here\n":                             "",
+		"panic: a [recovered]\n\tpanic: b\n":                "panic: a [recovered]\n\tpanic: b\n",
+	} {
+		if got := goPanic([]byte(in)); got != want {
+			t.Errorf("goPanic(%q) = %q, expected %q", in, got, want)
+		}
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	b := &tailBuffer{max: 4}
+	b.Write([]byte("ab"))
+	b.Write([]byte("cdef"))
+	if got := string(b.bytes()); got != "cdef" {
+		t.Errorf("Expected cdef, got %q", got)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package pie
+
+import (
+	"os"
+	"syscall"
+)
+
+// exitSignal returns the signal that killed the process, if any, and whether
+// it dumped core.
+func exitSignal(state *os.ProcessState) (os.Signal, bool) {
+	ws, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() {
+		return nil, false
+	}
+	return ws.Signal(), ws.CoreDump()
+}
@@ -0,0 +1,168 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// ErrNoDaemonListener is returned by Daemon.Run when the service manager
+// handed the daemon no socket, and it has no address of its own to listen on.
+var ErrNoDaemonListener = errors.New("pie: daemon was handed no socket and has no address to listen on")
+
+// listenFdsStart is the first file descriptor systemd passes through socket
+// activation.
+const listenFdsStart = 3
+
+// Daemon runs a provider-style plugin as a long-lived operating system
+// service, which hosts connect to when they need it, instead of starting it
+// themselves.  Each host connection is served by its own Server, as
+// NewProviderConn makes, so hosts get pie's handshake and health checks as
+// they would from a plugin they started.  Hosts connect with DialPlugin.
+//
+// Run integrates the daemon with the service manager it runs under:
+//
+//   - On macOS, the daemon serves the sockets launchd activates for it, which
+//     are those under Name in the Sockets of its launchd.plist.  This needs a
+//     build with cgo.
+//   - On Linux, it serves the sockets systemd passes it through socket
+//     activation, only those named Name by FileDescriptorName if Name is set.
+//   - On Windows, when run by the service control manager as the service
+//     Name, it reports itself running once it is listening, and stops when
+//     the service is stopped or the system shuts down.
+//
+// If the daemon is handed no sockets, it listens on Addr instead.
+type Daemon struct {
+	// Name is the daemon's name for its service manager: its launchd socket
+	// name, its systemd file descriptor name, or its Windows service name.
+	Name string
+	// Network and Addr are the network and address to listen on when the
+	// service manager hands the daemon no sockets.  Network defaults to
+	// "tcp".  If Addr is empty, the daemon must be handed sockets.
+	Network string
+	Addr    string
+	// Setup registers the plugin's services on the Server for each host
+	// connection.  If it fails, the connection is closed, and Run stops with
+	// its error.
+	Setup func(Server) error
+}
+
+// Run serves hosts that connect to the daemon, until ctx is cancelled, the
+// process gets SIGTERM, the way launchd and systemd stop services, or the
+// Windows service is stopped.  Connections being served are then closed.  Run
+// returns nil when stopped, and otherwise the error that stopped it.
+func (d Daemon) Run(ctx context.Context) error {
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGTERM)
+	defer stop()
+	if ran, err := runService(ctx, d.Name, d.serve); ran {
+		return err
+	}
+	return d.serve(ctx, nil)
+}
+
+// serve listens and serves hosts until ctx is done.  If running is not nil, it
+// is called once the daemon is listening.
+func (d Daemon) serve(ctx context.Context, running func()) error {
+	listeners, err := activatedListeners(d.Name)
+	if err != nil {
+		return err
+	}
+	if len(listeners) == 0 {
+		if d.Addr == "" {
+			return ErrNoDaemonListener
+		}
+		network := d.Network
+		if network == "" {
+			network = "tcp"
+		}
+		ln, err := net.Listen(network, d.Addr)
+		if err != nil {
+			return err
+		}
+		listeners = []net.Listener{ln}
+	}
+	if running != nil {
+		running()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		mu    sync.Mutex
+		conns = map[net.Conn]bool{}
+		wg    sync.WaitGroup
+		// failed is the error that stopped the daemon, if it was not
+		// stopped through ctx.
+		failed     error
+		failedOnce sync.Once
+	)
+	fail := func(err error) {
+		failedOnce.Do(func() { failed = err })
+		cancel()
+	}
+	serveConn := func(conn net.Conn) {
+		defer wg.Done()
+		s := NewProviderConn(conn)
+		if d.Setup != nil {
+			if err := d.Setup(s); err != nil {
+				conn.Close()
+				fail(err)
+				return
+			}
+		}
+		mu.Lock()
+		if ctx.Err() != nil {
+			mu.Unlock()
+			conn.Close()
+			return
+		}
+		conns[conn] = true
+		mu.Unlock()
+		s.Serve()
+		mu.Lock()
+		delete(conns, conn)
+		mu.Unlock()
+	}
+	for _, ln := range listeners {
+		wg.Add(1)
+		go func(ln net.Listener) {
+			defer wg.Done()
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					if ctx.Err() == nil {
+						fail(err)
+					}
+					return
+				}
+				wg.Add(1)
+				go serveConn(conn)
+			}
+		}(ln)
+	}
+	<-ctx.Done()
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	mu.Lock()
+	for conn := range conns {
+		conn.Close()
+	}
+	mu.Unlock()
+	wg.Wait()
+	return failed
+}
+
+// DialPlugin connects to a plugin served by a Daemon at address on the named
+// network, and returns a handle for it like NewPluginContext does.  Closing the
+// handle closes the connection, but leaves the daemon running.
+func DialPlugin(ctx context.Context, network, address string, opts ...StartOption) (*Plugin, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewPluginContext(ctx, conn, opts...)
+}
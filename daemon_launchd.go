@@ -0,0 +1,52 @@
+//go:build darwin && cgo
+
+package pie
+
+/*
+#include <launch.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// activatedListeners returns the sockets launchd activates for the process
+// under name in its launchd.plist, or none if name is empty or the process
+// was not started by launchd.
+func activatedListeners(name string) ([]net.Listener, error) {
+	if name == "" {
+		return nil, nil
+	}
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	var fds *C.int
+	var count C.size_t
+	if errno := C.launch_activate_socket(cname, &fds, &count); errno != 0 {
+		if syscall.Errno(errno) == syscall.ESRCH {
+			// The process is not managed by launchd.
+			return nil, nil
+		}
+		return nil, fmt.Errorf("pie: activating launchd socket %q: %w", name, syscall.Errno(errno))
+	}
+	defer C.free(unsafe.Pointer(fds))
+	var listeners []net.Listener
+	for _, fd := range unsafe.Slice(fds, int(count)) {
+		f := os.NewFile(uintptr(fd), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return nil, fmt.Errorf("pie: launchd socket %q: %w", name, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
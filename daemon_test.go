@@ -0,0 +1,155 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// freeAddr returns a loopback address nothing is listening on.
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// dialDaemon connects to the daemon at addr, retrying until it is listening.
+func dialDaemon(t *testing.T, addr string) *Plugin {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p, err := DialPlugin(context.Background(), "tcp", addr)
+		if err == nil {
+			return p
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDaemon(t *testing.T) {
+	addr := freeAddr(t)
+	d := Daemon{Addr: addr, Setup: func(s Server) error { return s.RegisterName("api", api{}) }}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- d.Run(ctx) }()
+
+	p1 := dialDaemon(t, addr)
+	defer p1.Close()
+	p2 := dialDaemon(t, addr)
+	defer p2.Close()
+	for _, p := range []*Plugin{p1, p2} {
+		var reply string
+		if err := p.Call("api.SayHi", "daemon", &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply != "Hi daemon" {
+			t.Errorf("Expected Hi daemon, got %q", reply)
+		}
+		if err := p.Ping(); err != nil {
+			t.Errorf("Expected the daemon to answer health checks, got %v", err)
+		}
+	}
+	// Closing one host's handle leaves the daemon serving the others.
+	p1.Close()
+	if err := p2.Ping(); err != nil {
+		t.Errorf("Unexpected error after another host left: %v", err)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected Run to return nil when stopped, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the daemon to stop")
+	}
+	select {
+	case <-p2.Exited():
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the daemon's connections to be closed when it stopped")
+	}
+}
+
+func TestDaemonSetupError(t *testing.T) {
+	addr := freeAddr(t)
+	errSetup := errors.New("no config")
+	d := Daemon{Addr: addr, Setup: func(Server) error { return errSetup }}
+	done := make(chan error, 1)
+	go func() { done <- d.Run(context.Background()) }()
+	var dialer net.Dialer
+	for {
+		conn, err := dialer.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case err := <-done:
+		if err != errSetup {
+			t.Errorf("Expected the setup error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the daemon to stop")
+	}
+}
+
+func TestDaemonNoListener(t *testing.T) {
+	if err := (Daemon{}).Run(context.Background()); err != ErrNoDaemonListener {
+		t.Errorf("Expected ErrNoDaemonListener, got %v", err)
+	}
+}
+
+func TestDaemonSocketActivation(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("systemd socket activation is only supported on Linux")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ln.(*net.TCPListener).File()
+	ln.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0], helperArgs("daemon")...)
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.Env = append(os.Environ(), "LISTEN_FDS=1", "LISTEN_FDNAMES=pie")
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer cmd.Process.Kill()
+
+	p := dialDaemon(t, ln.Addr().String())
+	defer p.Close()
+	var reply string
+	if err := p.Call("api.SayHi", "systemd", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "Hi systemd" {
+		t.Errorf("Expected Hi systemd, got %q", reply)
+	}
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("Expected the daemon to stop cleanly on SIGTERM, got %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// debuggerPollInterval is how often a plugin started with WithDebugStart is
+// checked for a debugger.
+const debuggerPollInterval = 100 * time.Millisecond
+
+// DebugStart controls how a plugin started with WithDebugStart waits for a
+// debugger.
+type DebugStart struct {
+	// Resume, if not nil, continues the start when it is closed or a value
+	// is sent on it.  A host can, for instance, close it when the developer
+	// presses a key, or when the host receives a signal.
+	Resume <-chan struct{}
+	// Timeout, if not zero, is how long to wait before continuing anyway.
+	Timeout time.Duration
+	// Output is where the plugin's PID is printed.  It defaults to the
+	// host's stderr.
+	Output io.Writer
+}
+
+// WithDebugStart makes StartPlugin print the PID of the plugin process as soon
+// as it has been started, and then wait before the host sends the plugin
+// anything, to give the developer time to attach a debugger such as Delve,
+// with "dlv attach <pid>".  It waits until d.Resume is signalled, d.Timeout
+// has elapsed, or, on Linux, a debugger has attached to the plugin.  The
+// plugin's Timeouts do not count the wait.  It fails if the plugin exits or
+// the start's context is done while waiting.  Since the host sends nothing,
+// plugins started with WithTransportKeepalive may give up on it if it waits
+// longer than their dead peer timeout.
+func WithDebugStart(d DebugStart) StartOption {
+	return func(o *startOptions) {
+		o.debugStart = &d
+	}
+}
+
+// wait waits, as described by d, for a debugger to attach to the plugin with
+// the given path, which runs as the process r.
+func (d *DebugStart) wait(ctx context.Context, path string, r *reaper) error {
+	pid := processID(r.osProcess)
+	output := d.Output
+	if output == nil {
+		output = os.Stderr
+	}
+	fmt.Fprintf(output, "pie: plugin %s started with PID %d, waiting for a debugger to attach\n", filepath.Base(path), pid)
+	var timeout <-chan time.Time
+	if d.Timeout > 0 {
+		t := time.NewTimer(d.Timeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	poll := time.NewTicker(debuggerPollInterval)
+	defer poll.Stop()
+	for {
+		select {
+		case <-d.Resume:
+			return nil
+		case <-timeout:
+			return nil
+		case <-poll.C:
+			if pid != 0 && debuggerAttached(pid) {
+				return nil
+			}
+		case <-r.done:
+			return errors.New("pie: plugin exited while waiting for a debugger")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package pie
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// debuggerAttached reports whether a debugger is tracing the process with the
+// given pid, as reported by the TracerPid line of /proc/<pid>/status.
+func debuggerAttached(pid int) bool {
+	f, err := os.Open("/proc/" + strconv.Itoa(pid) + "/status")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(sc.Text(), "TracerPid:"); ok {
+			return strings.TrimSpace(v) != "0"
+		}
+	}
+	return false
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package pie
+
+// debuggerAttached cannot tell whether a debugger is attached on this
+// platform.
+func debuggerAttached(pid int) bool {
+	return false
+}
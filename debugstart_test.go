@@ -0,0 +1,85 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDebugStartResume(t *testing.T) {
+	var output lockedBuffer
+	resume := make(chan struct{})
+	started := make(chan *Plugin, 1)
+	go func() {
+		p, err := StartPlugin(nil, os.Args[0], helperArgs("provider"), WithDebugStart(DebugStart{Resume: resume, Output: &output}))
+		if err != nil {
+			t.Error(err)
+		}
+		started <- p
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(output.String(), "waiting for a debugger") {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the PID to be printed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-started:
+		t.Fatal("Expected the start to wait to be resumed")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(resume)
+	p := <-started
+	if p == nil {
+		return
+	}
+	defer p.Close()
+	if want := "PID " + strconv.Itoa(p.Pid()) + ","; !strings.Contains(output.String(), want) {
+		t.Errorf("Expected %q to be printed, got %q", want, output.String())
+	}
+	var reply string
+	if err := p.Call("api.SayHi", "bob", &reply); err != nil || reply != "Hi bob" {
+		t.Errorf("Expected Hi bob, got %q, %v", reply, err)
+	}
+}
+
+func TestDebugStartTimeout(t *testing.T) {
+	var output lockedBuffer
+	p, err := StartPlugin(nil, os.Args[0], helperArgs("provider"), WithDebugStart(DebugStart{Timeout: 50 * time.Millisecond, Output: &output}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if err := p.Ping(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDebugStartExited(t *testing.T) {
+	var output lockedBuffer
+	_, err := StartPlugin(nil, os.Args[0], helperArgs("badconfig"), WithDebugStart(DebugStart{Output: &output}))
+	if !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected the plugin's exit status, got %v", err)
+	}
+}
+
+func TestDebugStartCanceled(t *testing.T) {
+	var output lockedBuffer
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := StartPluginContext(ctx, nil, os.Args[0], helperArgs("provider"), WithDebugStart(DebugStart{Output: &output}))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the start to be abandoned with the context, got %v", err)
+	}
+}
+
+func TestDebuggerAttached(t *testing.T) {
+	if debuggerAttached(-1) {
+		t.Error("Expected no debugger for a process that does not exist")
+	}
+}
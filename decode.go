@@ -0,0 +1,137 @@
+package pie
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"runtime"
+)
+
+// net/rpc reads responses in a single goroutine, which decodes each reply
+// before reading the next response, so an expensive codec caps the rate at
+// which a plugin can answer calls at what one goroutine can decode.  With
+// parallel decoding, that goroutine only reads replies off the connection, and
+// leaves decoding them to the goroutines that made the calls.
+
+// RawBodyReader is implemented by ClientCodecs whose response bodies can be
+// decoded independently of each other, such as the JSON-RPC codec.  Gob's
+// cannot, since type definitions sent with one reply are needed to decode the
+// next.
+type RawBodyReader interface {
+	// ReadRawResponseBody reads the body of the response whose header was read
+	// last, without decoding it, and returns a function that decodes it into
+	// a reply.  The function may be called from any goroutine, after later
+	// responses have been read.
+	ReadRawResponseBody() (decode func(reply interface{}) error, err error)
+}
+
+// WithParallelDecode makes the plugin handle decode the replies of calls made
+// through Plugin.Call and its variants in the goroutines that made the calls,
+// up to n at a time, instead of in the goroutine that reads responses, so
+// that a codec that is expensive to decode does not hold up the replies that
+// come after.  If n is zero or less, it defaults to GOMAXPROCS.
+//
+// Parallel decoding needs a codec that implements RawBodyReader, such as the
+// one made by NewJSONClientCodec, which WithCodecs uses for "json".  With
+// other codecs, including the default gob codec, replies are decoded as they
+// are read.
+func WithParallelDecode(n int) StartOption {
+	return func(o *startOptions) {
+		if n <= 0 {
+			n = runtime.GOMAXPROCS(0)
+		}
+		o.decoders = n
+	}
+}
+
+// NewJSONClientCodec returns a JSON-RPC 1.0 ClientCodec for use with
+// WithClientCodec.  It is net/rpc/jsonrpc's NewClientCodec, with support for
+// WithParallelDecode.
+func NewJSONClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	return jsonClientCodec{jsonrpc.NewClientCodec(conn)}
+}
+
+// jsonClientCodec is net/rpc/jsonrpc's client codec, which can read reply
+// bodies without decoding them.
+type jsonClientCodec struct {
+	rpc.ClientCodec
+}
+
+// ReadRawResponseBody implements RawBodyReader.
+func (c jsonClientCodec) ReadRawResponseBody() (func(reply interface{}) error, error) {
+	var raw json.RawMessage
+	if err := c.ClientCodec.ReadResponseBody(&raw); err != nil {
+		return nil, err
+	}
+	return func(reply interface{}) error {
+		return json.Unmarshal(raw, reply)
+	}, nil
+}
+
+// deferReply makes the codec read the body of the reply to be decoded into
+// reply, which is a call's reply pointer, without decoding it, until the
+// decoder is taken with takeDecoder.  It reports whether the codec can do so.
+func (c *clientCodec) deferReply(reply interface{}) bool {
+	if _, ok := c.ClientCodec.(RawBodyReader); !ok {
+		return false
+	}
+	c.repliesMu.Lock()
+	defer c.repliesMu.Unlock()
+	if c.deferred == nil {
+		c.deferred = map[interface{}]func(interface{}) error{}
+	}
+	c.deferred[reply] = nil
+	if c.aliases == nil {
+		c.aliases = map[interface{}]interface{}{}
+	}
+	return true
+}
+
+// readDeferred reads the body of a deferred reply, and reports whether body
+// is one.
+func (c *clientCodec) readDeferred(body interface{}) (bool, error) {
+	raw, ok := c.ClientCodec.(RawBodyReader)
+	if !ok || body == nil {
+		return false, nil
+	}
+	c.repliesMu.Lock()
+	defer c.repliesMu.Unlock()
+	key := body
+	if reply, ok := c.aliases[body]; ok {
+		key = reply
+	}
+	if _, ok := c.deferred[key]; !ok {
+		return false, nil
+	}
+	decode, err := raw.ReadRawResponseBody()
+	if tm := c.usedMarshalers(); decode != nil && tm.forBody(body) != nil {
+		raw := decode
+		decode = func(reply interface{}) error { return tm.readBody(reply, raw) }
+	}
+	c.deferred[key] = decode
+	return true, err
+}
+
+// takeDecoder returns the function that decodes the body read for reply, or
+// nil if none was read, and stops deferring it.
+func (c *clientCodec) takeDecoder(reply interface{}) func(interface{}) error {
+	c.repliesMu.Lock()
+	defer c.repliesMu.Unlock()
+	decode := c.deferred[reply]
+	delete(c.deferred, reply)
+	return decode
+}
+
+// decodeReply decodes a deferred reply with decode, waiting for one of the
+// plugin's decoding slots.
+func (p *Plugin) decodeReply(decode func(interface{}) error, reply interface{}) error {
+	p.decoders <- struct{}{}
+	defer func() { <-p.decoders }()
+	if err := decode(reply); err != nil {
+		// This is how net/rpc reports replies it fails to decode.
+		return errors.New("reading body " + err.Error())
+	}
+	return nil
+}
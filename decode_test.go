@@ -0,0 +1,143 @@
+package pie
+
+import (
+	"errors"
+	"io"
+	"net/rpc"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// decodeHookCodec is a JSON client codec that runs hook around each deferred
+// decode.
+type decodeHookCodec struct {
+	jsonClientCodec
+	hook func(decode func() error) error
+}
+
+func (c decodeHookCodec) ReadRawResponseBody() (func(interface{}) error, error) {
+	decode, err := c.jsonClientCodec.ReadRawResponseBody()
+	if err != nil {
+		return nil, err
+	}
+	return func(reply interface{}) error {
+		return c.hook(func() error { return decode(reply) })
+	}, nil
+}
+
+// hookedPlugin returns a handle for a JSON provider whose deferred replies are
+// decoded through hook.
+func hookedPlugin(t *testing.T, name string, hook func(decode func() error) error, opts ...StartOption) *Plugin {
+	RegisterCodec(name, func(rwc io.ReadWriteCloser) rpc.ClientCodec {
+		return decodeHookCodec{NewJSONClientCodec(rwc).(jsonClientCodec), hook}
+	}, NewJSONServerCodec)
+	s := NewProvider()
+	s.RegisterName("api", api{})
+	return pipePlugin(t, s, append(opts, WithCodecs(name))...)
+}
+
+func TestParallelDecode(t *testing.T) {
+	// Each decode waits for the other, so the calls only succeed if their
+	// replies are decoded at the same time.
+	var started sync.WaitGroup
+	started.Add(2)
+	both := make(chan struct{})
+	go func() {
+		started.Wait()
+		close(both)
+	}()
+	p := hookedPlugin(t, "test-parallel", func(decode func() error) error {
+		started.Done()
+		select {
+		case <-both:
+		case <-time.After(5 * time.Second):
+			return errors.New("replies were not decoded in parallel")
+		}
+		return decode()
+	}, WithParallelDecode(2))
+
+	var wg sync.WaitGroup
+	for _, name := range []string{"bob", "alice"} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			var response string
+			if err := p.Call("api.SayHi", name, &response); err != nil {
+				t.Error(err)
+				return
+			}
+			if response != "Hi "+name {
+				t.Errorf("Expected %q, got %q", "Hi "+name, response)
+			}
+		}(name)
+	}
+	wg.Wait()
+}
+
+func TestParallelDecodeLimit(t *testing.T) {
+	var active, most int32
+	p := hookedPlugin(t, "test-parallel-limit", func(decode func() error) error {
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+		for {
+			m := atomic.LoadInt32(&most)
+			if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		return decode()
+	}, WithParallelDecode(1))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var response string
+			if err := p.Call("api.SayHi", "bob", &response); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if most != 1 {
+		t.Errorf("Expected one reply decoded at a time, got up to %d", most)
+	}
+}
+
+func TestParallelDecodeWithCallTimeout(t *testing.T) {
+	s := NewProvider()
+	s.RegisterName("api", api{})
+	p := pipePlugin(t, s, WithCodecs("json"), WithParallelDecode(0), WithTimeouts(Timeouts{Call: 5 * time.Second}))
+	var response string
+	if err := p.Call("api.SayHi", "bob", &response); err != nil {
+		t.Fatal(err)
+	}
+	if response != "Hi bob" {
+		t.Errorf("Expected %q, got %q", "Hi bob", response)
+	}
+}
+
+func TestParallelDecodeError(t *testing.T) {
+	s := NewProvider()
+	s.RegisterName("api", api{})
+	p := pipePlugin(t, s, WithCodecs("json"), WithParallelDecode(2))
+	var wrong int
+	err := p.Call("api.SayHi", "bob", &wrong)
+	if err == nil || !strings.HasPrefix(err.Error(), "reading body ") {
+		t.Fatalf("Expected an error decoding the reply, got %v", err)
+	}
+	// A reply that fails to decode off the read loop does not break the
+	// connection.
+	var response string
+	if err := p.Call("api.SayHi", "bob", &response); err != nil {
+		t.Fatal(err)
+	}
+	if response != "Hi bob" {
+		t.Errorf("Expected %q, got %q", "Hi bob", response)
+	}
+}
@@ -0,0 +1,204 @@
+package pie
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// detachMarker is what each side writes once it has stopped sending RPC
+// messages, to end the RPC stream the other side reads.
+var detachMarker = []byte("\x00pie-detach\x00")
+
+// errDetachMarker is returned to a codec reading a detaching connection that
+// does not begin with detachMarker.
+var errDetachMarker = errors.New("pie: detaching connection lost the detach marker")
+
+// Detach ends RPC with the plugin, and surrenders the connection to it, over
+// which the host and the plugin can go on to speak a protocol of their own,
+// such as a bulk transfer.  The plugin must accept detaching with
+// Server.HandleDetach, which is given the other end of the connection; RPC
+// stops cleanly on both sides first, so no bytes are lost or left for either
+// side's RPC client or server to read.
+//
+// The connection is what net/rpc spoke over, beneath the codec, so it is
+// still encrypted, framed, or batched as the options the plugin was started
+// with ask.  Closing it closes the plugin as Close would, and the handle can
+// make no more calls.  Detach fails without detaching if calls through the
+// handle are in flight, and must not be made at the same time as other calls;
+// it cannot detach multiplexed connections, or handles that keep themselves
+// alive with Timeouts.Keepalive.
+//
+// To speak another protocol before RPC instead, wrap the connection with
+// WithConnWrapper, which can use it before returning, and serve it with
+// NewProviderConn in the plugin once the protocol is done.
+func (p *Plugin) Detach() (io.ReadWriteCloser, error) {
+	switch {
+	case p.mux != nil:
+		return nil, errors.New("pie: cannot detach a multiplexed connection")
+	case p.keepaliveOn:
+		return nil, errors.New("pie: cannot detach a handle that keeps itself alive")
+	case p.detach == nil:
+		return nil, errors.New("pie: connection cannot be detached")
+	}
+	p.mu.Lock()
+	inflight := len(p.inflight)
+	p.mu.Unlock()
+	if inflight > 0 {
+		return nil, errors.New("pie: cannot detach with calls in flight")
+	}
+	if err := p.client.Call(controlService+".Detach", 0, new(int)); err != nil {
+		return nil, err
+	}
+	// The plugin sends nothing more until it reads our marker, so what the
+	// RPC client reads next is the plugin's marker.
+	p.detach.detaching.Store(true)
+	if _, err := p.detach.ReadWriteCloser.Write(detachMarker); err != nil {
+		return nil, err
+	}
+	select {
+	case <-p.detach.done:
+	case <-p.proc.done:
+		return nil, errors.New("pie: plugin exited while detaching")
+	}
+	if p.detach.err != nil {
+		return nil, p.detach.err
+	}
+	p.stop(stoppedByHost)
+	return p.detach.conn(), nil
+}
+
+// HandleDetach makes the provider accept Plugin.Detach, which stops serving
+// RPC, and calls handle with the connection to the host, which from then on
+// belongs to handle.  ServeErr, and the other ways of serving, return what
+// handle returns, once it does.
+func (s Server) HandleDetach(handle func(conn io.ReadWriteCloser) error) error {
+	if s.ctl == nil {
+		return errors.New("only providers can be detached")
+	}
+	s.d.regMu.Lock()
+	defer s.d.regMu.Unlock()
+	s.d.onDetach = handle
+	return nil
+}
+
+// Detach prepares to hand the connection over to the provider's detach
+// handler.  The host sends nothing more until it gets the reply, after which
+// it sends its marker.
+func (c *control) Detach(_ int, _ *int) error {
+	c.d.regMu.Lock()
+	handle, dc := c.d.onDetach, c.d.detach
+	c.d.regMu.Unlock()
+	if handle == nil || dc == nil {
+		return errors.New("pie: provider does not accept detaching")
+	}
+	dc.detaching.Store(true)
+	return nil
+}
+
+// detachConn is the connection beneath an RPC codec, which can stop being
+// read by the codec, and be handed over, once both sides have written the
+// detach marker.
+type detachConn struct {
+	io.ReadWriteCloser
+	// provider makes the connection answer the host's marker with its own.
+	provider bool
+
+	detaching atomic.Bool
+	// done is closed once the marker has been read, after which err is the
+	// error reading it, if any, and rest what was read after it.
+	done     chan struct{}
+	doneOnce sync.Once
+	err      error
+	rest     []byte
+}
+
+// newDetachConn returns a detachConn for rwc.
+func newDetachConn(rwc io.ReadWriteCloser, provider bool) *detachConn {
+	return &detachConn{ReadWriteCloser: rwc, provider: provider, done: make(chan struct{})}
+}
+
+// Read reads from the connection, until the marker is read.
+func (c *detachConn) Read(p []byte) (int, error) {
+	if c.detached() {
+		return 0, io.EOF
+	}
+	n, err := c.ReadWriteCloser.Read(p)
+	if n == 0 || !c.detaching.Load() {
+		return n, err
+	}
+	buf := append([]byte(nil), p[:n]...)
+	for len(buf) < len(detachMarker) && err == nil {
+		more := make([]byte, len(detachMarker)-len(buf))
+		n, err = c.ReadWriteCloser.Read(more)
+		buf = append(buf, more[:n]...)
+	}
+	if !bytes.HasPrefix(buf, detachMarker) {
+		if err == nil {
+			err = errDetachMarker
+		}
+		c.finish(err, nil)
+		return 0, err
+	}
+	if c.provider {
+		if _, werr := c.ReadWriteCloser.Write(detachMarker); werr != nil {
+			c.finish(werr, nil)
+			return 0, werr
+		}
+	}
+	c.finish(nil, buf[len(detachMarker):])
+	return 0, io.EOF
+}
+
+// finish records the end of detaching.
+func (c *detachConn) finish(err error, rest []byte) {
+	c.doneOnce.Do(func() {
+		c.err, c.rest = err, rest
+		close(c.done)
+	})
+}
+
+// detached reports whether the connection has been detached from the codec.
+func (c *detachConn) detached() bool {
+	select {
+	case <-c.done:
+		return c.err == nil
+	default:
+		return false
+	}
+}
+
+// Close closes the connection, unless it has been handed over.
+func (c *detachConn) Close() error {
+	if c.detached() {
+		return nil
+	}
+	return c.ReadWriteCloser.Close()
+}
+
+// conn returns the connection handed over.
+func (c *detachConn) conn() io.ReadWriteCloser {
+	return &detachedConn{ReadWriteCloser: c.ReadWriteCloser, rest: c.rest}
+}
+
+// detachedConn is a connection handed over by Detach, which first reads what
+// was read after the marker.
+type detachedConn struct {
+	io.ReadWriteCloser
+	mu   sync.Mutex
+	rest []byte
+}
+
+func (c *detachedConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	if len(c.rest) > 0 {
+		n := copy(p, c.rest)
+		c.rest = c.rest[n:]
+		c.mu.Unlock()
+		return n, nil
+	}
+	c.mu.Unlock()
+	return c.ReadWriteCloser.Read(p)
+}
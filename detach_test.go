@@ -0,0 +1,89 @@
+package pie
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// detachedPlugin returns a handle for a provider over a pipe that serves api
+// and hands detached connections to handle, and a channel that gets what
+// serving returns.
+func detachedPlugin(t *testing.T, handle func(io.ReadWriteCloser) error, opts ...StartOption) (*Plugin, <-chan error) {
+	t.Helper()
+	hostEnd, pluginEnd := net.Pipe()
+	s := NewProviderConn(pluginEnd)
+	s.RegisterName("api", api{})
+	if handle != nil {
+		if err := s.HandleDetach(handle); err != nil {
+			t.Fatal(err)
+		}
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.ServeErr() }()
+	p, err := NewPlugin(hostEnd, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, served
+}
+
+func TestDetach(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789"), 10000)
+	p, served := detachedPlugin(t, func(conn io.ReadWriteCloser) error {
+		defer conn.Close()
+		got := make([]byte, len(big))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			return err
+		}
+		_, err := conn.Write(bytes.ToUpper(got[:5]))
+		return err
+	})
+	var reply string
+	if err := p.Call("api.SayHi", "bob", &reply); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := p.Detach()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(big); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "01234" {
+		t.Errorf("Expected the handler's reply, got %q", got)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Expected serving to return the handler's result, got %v", err)
+	}
+	if err := p.Call("api.SayHi", "bob", &reply); err == nil {
+		t.Error("Expected calls after detaching to fail")
+	}
+	conn.Close()
+}
+
+func TestDetachUnhandled(t *testing.T) {
+	p, _ := detachedPlugin(t, nil)
+	defer p.Close()
+	if _, err := p.Detach(); err == nil || !strings.Contains(err.Error(), "does not accept detaching") {
+		t.Errorf("Expected the provider to refuse detaching, got %v", err)
+	}
+	var reply string
+	if err := p.Call("api.SayHi", "bob", &reply); err != nil || reply != "Hi bob" {
+		t.Errorf("Expected RPC to go on after a refused detach, got %q, %v", reply, err)
+	}
+}
+
+func TestDetachMux(t *testing.T) {
+	p := inProcessAPI(t, WithMux())
+	defer p.Close()
+	if _, err := p.Detach(); err == nil || !strings.Contains(err.Error(), "multiplexed") {
+		t.Errorf("Expected multiplexed handles to refuse detaching, got %v", err)
+	}
+}
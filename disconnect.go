@@ -0,0 +1,181 @@
+package pie
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/rpc"
+	"os"
+	"sync"
+)
+
+// DisconnectReason classifies why a Server stopped serving.
+type DisconnectReason int
+
+const (
+	// DisconnectClosed means the connection was closed by Server.Close.
+	DisconnectClosed DisconnectReason = iota
+	// DisconnectBroken means reading from the connection failed, or the
+	// client hung up partway through a message.
+	DisconnectBroken
+	// DisconnectDecode means a message from the client could not be decoded,
+	// usually because the client uses a different encoding or is not a pie
+	// client at all.
+	DisconnectDecode
+)
+
+var disconnectReasonNames = [...]string{
+	DisconnectClosed: "connection closed",
+	DisconnectBroken: "connection broken",
+	DisconnectDecode: "undecodable message",
+}
+
+// String returns a short, human readable description of the reason.
+func (r DisconnectReason) String() string {
+	if r >= 0 && int(r) < len(disconnectReasonNames) {
+		return disconnectReasonNames[r]
+	}
+	return fmt.Sprintf("DisconnectReason(%d)", int(r))
+}
+
+// DisconnectError is returned by ServeErr and ServeCodecErr when a Server
+// stops serving for any reason other than the client hanging up cleanly.
+type DisconnectError struct {
+	Reason DisconnectReason
+	// Err is the error that ended the connection.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *DisconnectError) Error() string {
+	return fmt.Sprintf("pie: %s: %v", e.Reason, e.Err)
+}
+
+// Unwrap returns the error that ended the connection.
+func (e *DisconnectError) Unwrap() error {
+	return e.Err
+}
+
+// ServeErr is like Serve, but reports why the connection ended: it returns nil
+// if the client hung up cleanly, and a *DisconnectError otherwise.  A plugin
+// can use it to decide whether to exit with a zero or a non-zero status.
+func (s Server) ServeErr() error {
+	return s.ServeCodecErr(newGobServerCodec)
+}
+
+// ServeCodecErr is like ServeCodec, but reports why the connection ended the
+// way ServeErr does.
+func (s Server) ServeCodecErr(f func(io.ReadWriteCloser) rpc.ServerCodec) error {
+	if s.ctl != nil && s.ctl.selfTest {
+		os.Exit(s.ctl.runSelfTest(os.Stdout))
+	}
+	rwc := s.rwc
+	if s.d != nil {
+		s.d.regMu.Lock()
+		f := framing{
+			writes:    true,
+			checksums: s.d.checksums,
+			keepalive: s.d.keepalive,
+			deadPeer:  s.d.deadPeer,
+		}
+		mux := s.d.mux
+		batching := s.d.batching
+		secret := s.d.encryption
+		s.d.regMu.Unlock()
+		if secret != nil {
+			sc, err := encrypt(context.Background(), rwc, secret, false)
+			if err != nil {
+				rwc.Close()
+				if err == io.EOF {
+					return nil
+				}
+				return &DisconnectError{Reason: DisconnectBroken, Err: err}
+			}
+			rwc = sc
+		}
+		if batching != nil {
+			rwc = newBatchConn(rwc, *batching)
+		}
+		if f.checksums || f.keepalive > 0 {
+			rwc = newFramedConn(rwc, f)
+		} else {
+			rwc = sniffChecksums(rwc)
+		}
+		if mux {
+			var err error
+			if rwc, err = s.d.serveMux(NewMux(rwc, false), s.serveControl); err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return &DisconnectError{Reason: DisconnectBroken, Err: err}
+			}
+		}
+	}
+	var detach *detachConn
+	if s.ctl != nil {
+		detach = newDetachConn(rwc, true)
+		rwc = detach
+		s.d.regMu.Lock()
+		s.d.detach = detach
+		s.d.regMu.Unlock()
+	}
+	conn := &watchedConn{ReadWriteCloser: rwc}
+	codec := s.wrapCodec(f(conn), conn)
+	s.server.ServeCodec(codec)
+	if detach != nil && detach.detached() {
+		s.d.regMu.Lock()
+		handle := s.d.onDetach
+		s.d.regMu.Unlock()
+		return handle(detach.conn())
+	}
+	if s.ctl != nil {
+		s.ctl.closeStreams()
+	}
+	dc, ok := codec.(*dispatchCodec)
+	if !ok || dc.err == nil {
+		return nil
+	}
+	s.d.regMu.Lock()
+	closed := s.d.closed
+	s.d.regMu.Unlock()
+	switch readErr := conn.readErr(); {
+	case closed:
+		return &DisconnectError{Reason: DisconnectClosed, Err: dc.err}
+	case dc.err == io.EOF:
+		return nil
+	case readErr != nil && readErr != io.EOF:
+		return &DisconnectError{Reason: DisconnectBroken, Err: readErr}
+	case dc.err == io.ErrUnexpectedEOF || readErr == io.EOF:
+		return &DisconnectError{Reason: DisconnectBroken, Err: dc.err}
+	default:
+		return &DisconnectError{Reason: DisconnectDecode, Err: dc.err}
+	}
+}
+
+// watchedConn records the first error returned by reads from the connection
+// it wraps, which lets a Server tell transport failures from decoding errors.
+type watchedConn struct {
+	io.ReadWriteCloser
+	mu  sync.Mutex
+	err error
+}
+
+// Read reads from the underlying connection, recording the first error.
+func (c *watchedConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if err != nil {
+		c.mu.Lock()
+		if c.err == nil {
+			c.err = err
+		}
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+// readErr returns the first error returned by a read.
+func (c *watchedConn) readErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
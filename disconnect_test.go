@@ -0,0 +1,98 @@
+package pie
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+// serveErr serves s over conn in the background, returning a channel that
+// receives the result of ServeCodecErr.
+func serveErr(s Server, conn io.ReadWriteCloser, codec func(io.ReadWriteCloser) rpc.ServerCodec) <-chan error {
+	s.rwc = conn
+	result := make(chan error, 1)
+	go func() { result <- s.ServeCodecErr(codec) }()
+	return result
+}
+
+// waitServeErr waits for the result of serveErr.
+func waitServeErr(t *testing.T, result <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for Serve to return")
+		return nil
+	}
+}
+
+// expectDisconnect checks that err is a *DisconnectError with the given
+// reason.
+func expectDisconnect(t *testing.T, err error, reason DisconnectReason) {
+	t.Helper()
+	var de *DisconnectError
+	if !errors.As(err, &de) {
+		t.Fatalf("Expected a *DisconnectError, got %#v", err)
+	}
+	if de.Reason != reason {
+		t.Errorf("Expected reason %q, got %q (%v)", reason, de.Reason, err)
+	}
+}
+
+func TestServeErrHangup(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	result := serveErr(NewProvider(), serverConn, newGobServerCodec)
+	client := rpc.NewClient(clientConn)
+	if err := client.Call(controlService+".Ping", 1, new(int)); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if err := waitServeErr(t, result); err != nil {
+		t.Errorf("Expected no error after a clean hangup, got %v", err)
+	}
+}
+
+func TestServeErrClosed(t *testing.T) {
+	s := NewProvider()
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	s.rwc = serverConn
+	result := serveErr(s, serverConn, newGobServerCodec)
+	client := rpc.NewClient(clientConn)
+	if err := client.Call(controlService+".Ping", 1, new(int)); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	expectDisconnect(t, waitServeErr(t, result), DisconnectClosed)
+}
+
+func TestServeErrBroken(t *testing.T) {
+	broken := errors.New("pipe on fire")
+	conn := newRWCloser(io.NopCloser(&errReader{broken}), nopWriteCloser{io.Discard})
+	err := waitServeErr(t, serveErr(NewProvider(), conn, newGobServerCodec))
+	expectDisconnect(t, err, DisconnectBroken)
+	if !errors.Is(err, broken) {
+		t.Errorf("Expected the error to wrap %v, got %v", broken, err)
+	}
+}
+
+func TestServeErrDecode(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	result := serveErr(NewProvider(), serverConn, NewJSONServerCodec)
+	go clientConn.Write([]byte("{not json}\n"))
+	expectDisconnect(t, waitServeErr(t, result), DisconnectDecode)
+}
+
+// errReader is a Reader whose reads fail with err.
+type errReader struct {
+	err error
+}
+
+func (r *errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
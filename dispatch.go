@@ -0,0 +1,693 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go/token"
+	"io"
+	"net/rpc"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrRegisterAfterServe is returned by Register and RegisterName when they are
+// called after the Server has started serving.  The set of methods a Server
+// publishes is fixed once it serves, so that a client never sees a method
+// appear partway through a connection, unless the Server's DuplicatePolicy,
+// set with Server.SetDuplicatePolicy, allows services to be swapped.
+var ErrRegisterAfterServe = errors.New("pie: cannot register services after Serve has been called")
+
+// dispatcher serves the methods of registered services that net/rpc cannot,
+// such as methods that take a context.Context or return their result, and
+// calls that carry metadata, such as notifications.  It sits in front of a
+// Server's rpc.Server as a wrapper around the Server's codec: those requests
+// are decoded and invoked by the dispatcher, and all other requests are
+// passed through to net/rpc untouched.
+type dispatcher struct {
+	mu       sync.RWMutex
+	services map[string]bool
+	methods  map[string]*method
+	// exposed, if not nil, limits the services and methods served to those
+	// set by Server.Expose.
+	exposed map[string]bool
+	// checks are the capability checks set by Server.Require, and grants
+	// the scopes granted to each token by Server.Grant.
+	checks map[string]CapabilityCheck
+	grants map[string][]string
+	// validators are the argument validators set by Server.SetValidator,
+	// by service.
+	validators map[string]ArgValidator
+	// routes maps the aliases set by Server.Alias and Server.RouteLatest to
+	// the methods they name.
+	routes map[string]string
+	// onDetach is the handler set by Server.HandleDetach, and detach the
+	// connection it is handed when the host detaches.
+	onDetach func(io.ReadWriteCloser) error
+	detach   *detachConn
+	// adapters are the adapters set by Server.Adapt, by method.  apiVersions
+	// are the versions of the host's API declared to consumers with
+	// Server.SetAPIVersions, and apiVersion is the version the client
+	// negotiated.
+	adapters    map[string][]adapter
+	apiVersions []Version
+	apiVersion  string
+	// rpcNames are the services registered with the rpc.Server, which
+	// cannot forget them, so that the dispatcher serves those replaced or
+	// unregistered since itself.
+	rpcNames map[string]bool
+
+	// regMu serializes registration with the start of serving, and guards
+	// closed, which records that Server.Close has been called.
+	regMu   sync.Mutex
+	serving bool
+	closed  bool
+	// timeouts are set by Server.SetTimeouts.
+	timeouts Timeouts
+	// duplicates is set by Server.SetDuplicatePolicy.
+	duplicates DuplicatePolicy
+	// results is set by Server.SetResultStore.
+	results ResultStore
+	// checksums is set by Server.SetChecksums, and keepalive and deadPeer by
+	// Server.SetTransportKeepalive.
+	checksums bool
+	keepalive time.Duration
+	deadPeer  time.Duration
+	// batching is set by Server.SetBatching.
+	batching *Batching
+	// encryption is the secret set by Server.SetEncryption.
+	encryption []byte
+	// hostReq is the requirement set by Server.SetRequiredHostVersion, and
+	// hostReqText its text.  hostBuild is the host's build information, or
+	// nil if the host has not sent it, and hostErr the error calls from the
+	// host are refused with, if any.
+	hostReq     Constraint
+	hostReqText string
+	hostBuild   *BuildInfo
+	hostErr     atomic.Pointer[VersionRequirementError]
+	// mux is set by Server.SetMultiplexing, and channels holds the handlers
+	// set by Server.HandleChannel.
+	mux      bool
+	channels map[string]func(*Stream)
+	// strict is set by Server.SetStrict, and requestLog by
+	// Server.SetRequestLog.
+	strict     bool
+	requestLog func(format string, v ...interface{})
+
+	// groups maps the IDs of call groups to whether they are open, which
+	// they are not while their Begin hook runs, and disconnected records that
+	// abortGroups was called, after which groups are aborted as soon as their
+	// Begin hook returns.
+	groupMu      sync.Mutex
+	groups       map[string]bool
+	hooks        GroupHooks
+	disconnected bool
+
+	// running holds a channel for each idempotency key with a call running,
+	// which is closed when the call finishes.
+	idemMu  sync.Mutex
+	running map[string]chan struct{}
+}
+
+// method is a method served by a dispatcher.
+type method struct {
+	// fn is the method, bound to its receiver.
+	fn  reflect.Value
+	arg reflect.Type
+	// reply is the type of the method's result, whether it is returned or
+	// written through a pointer argument.
+	reply reflect.Type
+	// ctx reports whether the method takes a context.Context first.
+	ctx bool
+	// returns reports whether the method returns its result instead of
+	// writing it through a pointer argument.
+	returns bool
+	// std reports whether net/rpc can serve the method itself, which it
+	// does unless the call carries metadata.
+	std bool
+}
+
+// request identifies a request being handled by a dispatcher.
+type request struct {
+	serviceMethod string
+	seq           uint64
+	meta          callMeta
+}
+
+// invalidRequest is the reply sent with errors, as net/rpc does.
+var invalidRequest = struct{}{}
+
+var (
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
+// adaptedMethods returns the exported methods of rcvr that the dispatcher can
+// serve, keyed by name.
+func adaptedMethods(rcvr interface{}) map[string]*method {
+	v := reflect.ValueOf(rcvr)
+	t := v.Type()
+	methods := map[string]*method{}
+	for i := 0; i < t.NumMethod(); i++ {
+		if t.Method(i).PkgPath != "" {
+			continue
+		}
+		if m := adaptMethod(v.Method(i)); m != nil {
+			methods[t.Method(i).Name] = m
+		}
+	}
+	return methods
+}
+
+// adaptMethod returns a method for fn, a bound method value, if it has one of
+// the forms
+//
+//	func(ctx context.Context, args A, reply *R) error
+//	func(ctx context.Context, args A) (R, error)
+//	func(args A) (R, error)
+//
+// and nil otherwise.
+func adaptMethod(fn reflect.Value) *method {
+	t := fn.Type()
+	m := &method{fn: fn}
+	in := 0
+	if t.NumIn() > 0 && t.In(0) == typeOfContext {
+		m.ctx = true
+		in = 1
+	}
+	switch {
+	case m.ctx && t.NumIn() == in+2 && t.NumOut() == 1 && t.Out(0) == typeOfError && t.In(in+1).Kind() == reflect.Ptr:
+		m.reply = t.In(in + 1).Elem()
+	case t.NumIn() == in+1 && t.NumOut() == 2 && t.Out(1) == typeOfError:
+		m.reply = t.Out(0)
+		m.returns = true
+	default:
+		return nil
+	}
+	m.arg = t.In(in)
+	if !exportedOrBuiltin(m.arg) || !exportedOrBuiltin(m.reply) {
+		return nil
+	}
+	return m
+}
+
+// stdMethods returns the methods of rcvr that net/rpc can serve, keyed by
+// name, so that calls to them with metadata can be served by the dispatcher.
+func stdMethods(rcvr interface{}) map[string]*method {
+	v := reflect.ValueOf(rcvr)
+	methods := map[string]*method{}
+	for _, name := range rpcMethods(v.Type()) {
+		fn := v.MethodByName(name)
+		methods[name] = &method{
+			fn:    fn,
+			arg:   fn.Type().In(0),
+			reply: fn.Type().In(1).Elem(),
+			std:   true,
+		}
+	}
+	return methods
+}
+
+// has reports whether the dispatcher serves the named service.
+func (d *dispatcher) has(service string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.services[service]
+}
+
+// add publishes methods under the given service name, in place of any it
+// published under that name before.
+func (d *dispatcher) add(service string, methods map[string]*method) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.methods == nil {
+		d.services = map[string]bool{}
+		d.methods = map[string]*method{}
+	}
+	d.removeLocked(service)
+	d.services[service] = true
+	for name, m := range methods {
+		d.methods[service+"."+name] = m
+	}
+}
+
+// lookup returns the method for serviceMethod, or nil if the dispatcher does
+// not serve it.
+func (d *dispatcher) lookup(serviceMethod string) *method {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.methods[serviceMethod]
+}
+
+// wrap returns a ServerCodec that serves the dispatcher's methods itself, and
+// passes all other requests read from codec, which uses conn, through to its
+// caller.  Once a codec has been wrapped, no more services can be registered.
+func (d *dispatcher) wrap(codec rpc.ServerCodec, conn io.ReadWriteCloser) rpc.ServerCodec {
+	d.regMu.Lock()
+	d.serving = true
+	callTimeout := d.timeouts.Call
+	results := d.results
+	strict := d.strict
+	requestLog := d.requestLog
+	d.regMu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	return &dispatchCodec{
+		ServerCodec: codec,
+		conn:        conn,
+		d:           d,
+		ctx:         ctx,
+		cancel:      cancel,
+		callTimeout: callTimeout,
+		results:     results,
+		strict:      strict,
+		requestLog:  requestLog,
+	}
+}
+
+// dispatchCodec is the ServerCodec a dispatcher puts in front of an
+// rpc.Server.
+type dispatchCodec struct {
+	rpc.ServerCodec
+	// conn is the connection the codec uses, on which a new codec is made
+	// when the host negotiates one.
+	conn io.ReadWriteCloser
+	d    *dispatcher
+	// ctx is the parent of the contexts passed to methods.  It is cancelled
+	// when the connection is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// err is the error that ended the connection.
+	err error
+	// callTimeout is the deadline for each method call, if not zero.
+	callTimeout time.Duration
+	// results, if not nil, stores the results of calls with idempotency keys.
+	results ResultStore
+	// strict makes the dispatcher answer calls to missing methods itself.
+	strict bool
+	// requestLog, if not nil, logs the calls with request IDs that fail.
+	requestLog func(format string, v ...interface{})
+	// sending serializes the responses written by the dispatcher with those
+	// written by net/rpc.
+	sending sync.Mutex
+	// marshalers holds the typeMarshalers negotiated by the host.
+	marshalers atomic.Value
+
+	// keyed holds the calls waiting to run for each ordering key that has a
+	// call running.
+	keyMu sync.Mutex
+	keyed map[string][]func()
+	// calls counts the calls started or queued by run, which Close waits
+	// for.  Once closed is set, under keyMu, run starts no more.
+	calls  sync.WaitGroup
+	closed bool
+}
+
+// ReadRequestHeader reads requests until it finds one that net/rpc should
+// serve, and returns that one's header.  The requests it skips are invoked by
+// the dispatcher in their own goroutines.
+func (c *dispatchCodec) ReadRequestHeader(r *rpc.Request) error {
+	for {
+		if err := c.ServerCodec.ReadRequestHeader(r); err != nil {
+			c.cancel()
+			c.err = err
+			return err
+		}
+		if r.ServiceMethod == selectCodecMethod {
+			if err := c.selectCodec(r); err != nil {
+				c.cancel()
+				c.err = err
+				return err
+			}
+			continue
+		}
+		if r.ServiceMethod == selectMarshalersMethod {
+			if err := c.selectMarshalers(r); err != nil {
+				c.cancel()
+				c.err = err
+				return err
+			}
+			continue
+		}
+		name, meta := splitMeta(r.ServiceMethod)
+		adapted := c.d.adapter(name)
+		if to := c.d.route(name); adapted == nil && to != name {
+			name = to
+			if !meta.present {
+				r.ServiceMethod = name
+			}
+		}
+		m := adapted
+		if m == nil {
+			m = c.d.lookup(name)
+		}
+		if c.fastPath(name, m, meta) {
+			return nil
+		}
+		control := strings.HasPrefix(name, controlService+".")
+		if !c.d.exposes(name) {
+			m = nil
+		}
+		req := request{serviceMethod: name, seq: r.Seq, meta: meta}
+		var argv reflect.Value
+		var body interface{}
+		if m != nil {
+			argv = reflect.New(m.arg)
+			body = argv.Interface()
+		}
+		if err := c.ReadRequestBody(body); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				c.cancel()
+				c.err = err
+				return err
+			}
+			c.respond(req, invalidRequest, err.Error())
+			continue
+		}
+		if herr := c.d.hostError(); herr != nil && !control {
+			c.respond(req, invalidRequest, herr.Error())
+			continue
+		}
+		if m == nil {
+			msg := "rpc: can't find method " + name
+			if c.strict {
+				msg = c.d.notFound(name).Error()
+			}
+			c.respond(req, invalidRequest, msg)
+			continue
+		}
+		if req.meta.group != "" && !c.d.groupOpen(req.meta.group) {
+			c.respond(req, invalidRequest, "pie: call group "+req.meta.group+" is not open")
+			continue
+		}
+		arg := argv.Elem()
+		c.run(req.meta.key, func() { c.call(req, m, arg) })
+	}
+}
+
+// fastPath reports whether net/rpc can serve the call to name, which the
+// dispatcher would serve with m, by itself: the call carries no metadata, is
+// exposed, has no permission check or validator, and is answered by a method
+// net/rpc serves, or by net/rpc's own error for a method neither serves.
+func (c *dispatchCodec) fastPath(name string, m *method, meta callMeta) bool {
+	if meta.present || !c.d.exposes(name) {
+		return false
+	}
+	switch {
+	case m == nil:
+		if c.strict || c.d.retired(name) {
+			return false
+		}
+	case !m.std:
+		return false
+	}
+	if c.d.check(name) != nil || c.d.validator(name) != nil {
+		return false
+	}
+	return strings.HasPrefix(name, controlService+".") || c.d.hostError() == nil
+}
+
+// run runs f in its own goroutine, after any calls with the same ordering key
+// have finished.  Calls without a key run immediately.
+func (c *dispatchCodec) run(key string, f func()) {
+	c.keyMu.Lock()
+	defer c.keyMu.Unlock()
+	if c.closed {
+		return
+	}
+	c.calls.Add(1)
+	call := f
+	f = func() {
+		defer c.calls.Done()
+		call()
+	}
+	if key == "" {
+		go f()
+		return
+	}
+	if queue, running := c.keyed[key]; running {
+		c.keyed[key] = append(queue, f)
+		return
+	}
+	if c.keyed == nil {
+		c.keyed = map[string][]func(){}
+	}
+	c.keyed[key] = nil
+	go c.runKeyed(key, f)
+}
+
+// runKeyed runs f, and then the calls queued behind it with the same key.
+func (c *dispatchCodec) runKeyed(key string, f func()) {
+	for {
+		f()
+		c.keyMu.Lock()
+		queue := c.keyed[key]
+		if len(queue) == 0 {
+			delete(c.keyed, key)
+			c.keyMu.Unlock()
+			return
+		}
+		f, c.keyed[key] = queue[0], queue[1:]
+		c.keyMu.Unlock()
+	}
+}
+
+// call invokes m and sends its response.
+func (c *dispatchCodec) call(req request, m *method, arg reflect.Value) {
+	ctx := c.ctx
+	if c.callTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.callTimeout)
+		defer cancel()
+	}
+	if req.meta.group != "" {
+		ctx = context.WithValue(ctx, groupKey{}, req.meta.group)
+	}
+	if req.meta.rid != "" {
+		ctx = context.WithValue(ctx, requestIDKey{}, req.meta.rid)
+	}
+	scopes := c.d.scopes(req.meta.token)
+	if check := c.d.check(req.serviceMethod); check != nil {
+		if err := check(scopes, arg.Interface()); err != nil {
+			c.respond(req, invalidRequest, "pie: permission denied: "+err.Error())
+			return
+		}
+	}
+	if v := c.d.validator(req.serviceMethod); v != nil {
+		if err := validate(v, req.serviceMethod, arg.Interface()); err != nil {
+			c.respond(req, invalidRequest, err.Error())
+			return
+		}
+	}
+	if scopes != nil {
+		ctx = context.WithValue(ctx, capabilityKey{}, scopes)
+	}
+	invoke := func() (interface{}, string) {
+		reply, err := m.invoke(ctx, arg)
+		if err != nil {
+			return invalidRequest, err.Error()
+		}
+		return reply, ""
+	}
+	var reply interface{}
+	var errmsg string
+	if req.meta.idem != "" && c.results != nil {
+		reply, errmsg = c.d.idempotent(c.results, req.meta.idem, req.serviceMethod, m.reply, invoke)
+	} else {
+		reply, errmsg = invoke()
+	}
+	c.respond(req, reply, errmsg)
+}
+
+// respond writes the response to req, logging it if it is the failure of a
+// call with a request ID.  Notifications get no response, unless the codec
+// needs one to release what it holds for the request; the client discards
+// those.
+func (c *dispatchCodec) respond(req request, reply interface{}, errmsg string) {
+	if errmsg != "" && req.meta.rid != "" && c.requestLog != nil {
+		c.requestLog("pie: request %s: %s failed: %s", req.meta.rid, req.serviceMethod, errmsg)
+	}
+	if req.meta.notify {
+		if d, ok := c.ServerCodec.(discarder); ok {
+			d.discard(req.seq)
+			return
+		}
+	}
+	c.WriteResponse(&rpc.Response{ServiceMethod: req.serviceMethod, Seq: req.seq, Error: errmsg}, reply)
+}
+
+// ReadRequestBody reads a request body, decoding it with its Marshaler if the
+// host negotiated one for its type.
+func (c *dispatchCodec) ReadRequestBody(body interface{}) error {
+	return c.usedMarshalers().readBody(body, c.ServerCodec.ReadRequestBody)
+}
+
+// WriteResponse writes a response, serializing it with the dispatcher's own
+// responses.  A reply whose Marshaler fails is sent as the error.
+func (c *dispatchCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	body, err := c.usedMarshalers().marshal(body)
+	if err != nil {
+		resp := *r
+		resp.Error = err.Error()
+		r, body = &resp, invalidRequest
+	}
+	c.sending.Lock()
+	defer c.sending.Unlock()
+	return c.ServerCodec.WriteResponse(r, body)
+}
+
+// Close cancels the contexts of the methods in flight, aborts the call groups
+// left open, waits for the methods to return, and closes the underlying codec.
+// Like rpc.Server.ServeCodec, it does not close the codec while a method may
+// still write its response.
+func (c *dispatchCodec) Close() error {
+	c.cancel()
+	c.d.abortGroups()
+	c.keyMu.Lock()
+	c.closed = true
+	c.keyMu.Unlock()
+	c.calls.Wait()
+	return c.ServerCodec.Close()
+}
+
+// invoke calls the method with arg, and returns a pointer to its result.
+func (m *method) invoke(ctx context.Context, arg reflect.Value) (interface{}, error) {
+	var in []reflect.Value
+	if m.ctx {
+		in = append(in, reflect.ValueOf(ctx))
+	}
+	in = append(in, arg)
+	reply := reflect.New(m.reply)
+	var errv reflect.Value
+	if m.returns {
+		out := m.fn.Call(in)
+		reply.Elem().Set(out[0])
+		errv = out[1]
+	} else {
+		// Like net/rpc, give methods an empty map or slice to fill in.
+		switch m.reply.Kind() {
+		case reflect.Map:
+			reply.Elem().Set(reflect.MakeMap(m.reply))
+		case reflect.Slice:
+			reply.Elem().Set(reflect.MakeSlice(m.reply, 0, 0))
+		}
+		errv = m.fn.Call(append(in, reply))[0]
+	}
+	if err, _ := errv.Interface().(error); err != nil {
+		return nil, err
+	}
+	return reply.Interface(), nil
+}
+
+// register publishes rcvr's methods as the named service.  Methods net/rpc can
+// serve are registered with the Server's rpc.Server, and the rest with its
+// dispatcher.  If useName is false, rcvr is registered under its type's name,
+// as with rpc.Register.
+func (s Server) register(name string, rcvr interface{}, useName bool) error {
+	std := rpcMethods(reflect.TypeOf(rcvr))
+	var adapted map[string]*method
+	var shadowed bool
+	if s.d != nil {
+		s.d.regMu.Lock()
+		defer s.d.regMu.Unlock()
+		if s.d.serving && s.d.duplicates == DuplicateError {
+			return ErrRegisterAfterServe
+		}
+		if s.taken(name) {
+			if !useName && !token.IsExported(name) {
+				return fmt.Errorf("rpc.Register: type %s is not exported", name)
+			}
+			var err error
+			if name, err = s.duplicate(name); err != nil {
+				return err
+			}
+			useName = true
+		}
+		adapted = adaptedMethods(rcvr)
+		shadowed = s.d.rpcRegistered(name)
+	}
+	switch {
+	case shadowed && len(std) == 0 && len(adapted) == 0:
+		return fmt.Errorf("rpc.Register: type %s has no exported methods of suitable type", name)
+	case shadowed:
+		// net/rpc still serves the receiver this one replaces.
+	case len(std) > 0 || len(adapted) == 0:
+		var err error
+		if useName {
+			err = s.server.RegisterName(name, rcvr)
+		} else {
+			err = s.server.Register(rcvr)
+		}
+		if err != nil {
+			return err
+		}
+		if s.d != nil {
+			s.d.setRPCRegistered(name)
+		}
+	case name == "":
+		return fmt.Errorf("rpc.Register: no service name for type %T", rcvr)
+	case !useName && !token.IsExported(name):
+		return fmt.Errorf("rpc.Register: type %s is not exported", name)
+	}
+	if s.ctl != nil {
+		names := std
+		for m := range adapted {
+			names = append(names, m)
+		}
+		s.ctl.removeMethods(name)
+		s.ctl.addMethods(name, names)
+	}
+	if s.d != nil {
+		for m, sm := range stdMethods(rcvr) {
+			sm.std = !shadowed
+			adapted[m] = sm
+		}
+		s.d.add(name, adapted)
+	}
+	return nil
+}
+
+// wrapCodec puts the Server's dispatcher, if it has one, in front of codec,
+// which uses conn.
+func (s Server) wrapCodec(codec rpc.ServerCodec, conn io.ReadWriteCloser) rpc.ServerCodec {
+	if s.d == nil {
+		return codec
+	}
+	return s.d.wrap(codec, conn)
+}
+
+// rpcMethods returns the names of the methods of t that net/rpc will serve.
+func rpcMethods(t reflect.Type) []string {
+	var names []string
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		mt := m.Type
+		if m.PkgPath != "" || mt.NumIn() != 3 || mt.NumOut() != 1 {
+			continue
+		}
+		if !exportedOrBuiltin(mt.In(1)) || mt.In(2).Kind() != reflect.Ptr || !exportedOrBuiltin(mt.In(2)) {
+			continue
+		}
+		if mt.Out(0) != typeOfError {
+			continue
+		}
+		names = append(names, m.Name)
+	}
+	return names
+}
+
+// exportedOrBuiltin reports whether t is an exported or builtin type, as
+// net/rpc requires of method arguments.
+func exportedOrBuiltin(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return token.IsExported(t.Name()) || t.PkgPath() == ""
+}
+
+// serviceName returns the name net/rpc's Register publishes rcvr under.
+func serviceName(rcvr interface{}) string {
+	return reflect.Indirect(reflect.ValueOf(rcvr)).Type().Name()
+}
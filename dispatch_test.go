@@ -0,0 +1,274 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"strings"
+	"testing"
+	"time"
+)
+
+// servePipe serves s over an in-memory connection using the given codecs, or
+// gob if they are nil, and returns a client connected to it.
+func servePipe(
+	t *testing.T,
+	s Server,
+	servercodec func(io.ReadWriteCloser) rpc.ServerCodec,
+	clientcodec func(io.ReadWriteCloser) rpc.ClientCodec,
+) *rpc.Client {
+	serverConn, clientConn := net.Pipe()
+	s.rwc = serverConn
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if servercodec == nil {
+			s.Serve()
+		} else {
+			s.ServeCodec(servercodec)
+		}
+	}()
+	var client *rpc.Client
+	if clientcodec == nil {
+		client = rpc.NewClient(clientConn)
+	} else {
+		client = rpc.NewClientWithCodec(clientcodec(clientConn))
+	}
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	return client
+}
+
+// ctxAPI has methods that net/rpc cannot serve on its own.
+type ctxAPI struct {
+	started   chan struct{}
+	cancelled chan error
+}
+
+func (ctxAPI) Upper(_ context.Context, s string, reply *string) error {
+	*reply = strings.ToUpper(s)
+	return nil
+}
+
+func (ctxAPI) Lower(_ context.Context, s string) (string, error) {
+	return strings.ToLower(s), nil
+}
+
+func (ctxAPI) Title(s string) (string, error) {
+	return strings.ToUpper(s[:1]) + s[1:], nil
+}
+
+// Pair returns a struct by value, as most (T, error) methods do.
+func (ctxAPI) Pair(n int) (Pair, error) {
+	return Pair{n, n * 2}, nil
+}
+
+// Pair is a result type of ctxAPI.
+type Pair struct {
+	A, B int
+}
+
+func (ctxAPI) Fail(_ context.Context, s string) (string, error) {
+	return "", errors.New("failed: " + s)
+}
+
+func (ctxAPI) Words(_ context.Context, s string, reply *map[string]int) error {
+	for _, w := range strings.Fields(s) {
+		(*reply)[w]++
+	}
+	return nil
+}
+
+// Wait blocks until its context is cancelled.
+func (a ctxAPI) Wait(ctx context.Context, _ int) (int, error) {
+	close(a.started)
+	<-ctx.Done()
+	a.cancelled <- ctx.Err()
+	return 0, ctx.Err()
+}
+
+func TestRegisterContextMethods(t *testing.T) {
+	for _, codec := range []string{"gob", "jsonrpc"} {
+		t.Run(codec, func(t *testing.T) {
+			s := NewProvider()
+			if err := s.RegisterName("ctx", ctxAPI{}); err != nil {
+				t.Fatalf("Unexpected error registering context methods: %#v", err)
+			}
+			if err := s.RegisterName("api", api{}); err != nil {
+				t.Fatal(err)
+			}
+			var client *rpc.Client
+			if codec == "gob" {
+				client = servePipe(t, s, nil, nil)
+			} else {
+				client = servePipe(t, s, jsonrpc.NewServerCodec, jsonrpc.NewClientCodec)
+			}
+
+			var reply string
+			if err := client.Call("ctx.Upper", "Bob", &reply); err != nil || reply != "BOB" {
+				t.Errorf("Wrong result from reply pointer method, got %q, %#v", reply, err)
+			}
+			if err := client.Call("ctx.Lower", "Bob", &reply); err != nil || reply != "bob" {
+				t.Errorf("Wrong result from returning method, got %q, %#v", reply, err)
+			}
+			if err := client.Call("ctx.Fail", "Bob", &reply); err == nil || err.Error() != "failed: Bob" {
+				t.Errorf("Wrong error from failing method, got %#v", err)
+			}
+			if err := client.Call("ctx.Title", "bob", &reply); err != nil || reply != "Bob" {
+				t.Errorf("Wrong result from method without context, got %q, %#v", reply, err)
+			}
+			var pair Pair
+			if err := client.Call("ctx.Pair", 2, &pair); err != nil || pair != (Pair{2, 4}) {
+				t.Errorf("Wrong result from struct returning method, got %v, %#v", pair, err)
+			}
+			words := map[string]int{}
+			if err := client.Call("ctx.Words", "a b a", &words); err != nil || words["a"] != 2 || words["b"] != 1 {
+				t.Errorf("Wrong result from map method, got %v, %#v", words, err)
+			}
+			if err := client.Call("api.SayHi", "bob", &reply); err != nil || reply != "Hi bob" {
+				t.Errorf("Wrong result from standard method, got %q, %#v", reply, err)
+			}
+			if err := client.Call("ctx.Missing", "bob", &reply); err == nil {
+				t.Error("Expected an error calling a missing method")
+			}
+		})
+	}
+}
+
+func TestContextMethodCancelledOnClose(t *testing.T) {
+	s := NewProvider()
+	a := ctxAPI{started: make(chan struct{}), cancelled: make(chan error, 1)}
+	if err := s.Register(a); err == nil {
+		t.Error("Expected an error registering an unexported type")
+	}
+	if err := s.RegisterName("ctx", a); err != nil {
+		t.Fatal(err)
+	}
+	serverConn, clientConn := net.Pipe()
+	s.rwc = serverConn
+	go s.Serve()
+	client := rpc.NewClient(clientConn)
+	call := client.Go("ctx.Wait", 0, new(int), nil)
+	select {
+	case <-a.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Method was not called")
+	}
+	client.Close()
+	<-call.Done
+	if call.Error == nil {
+		t.Error("Expected the call to fail when the connection closed")
+	}
+	select {
+	case err := <-a.cancelled:
+		if err != context.Canceled {
+			t.Errorf("Expected context to be cancelled, got %#v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Method's context was not cancelled when the connection closed")
+	}
+}
+
+func TestRegisterDuplicateContextService(t *testing.T) {
+	s := NewProvider()
+	if err := s.RegisterName("ctx", ctxAPI{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterName("ctx", ctxAPI{}); err == nil {
+		t.Error("Expected an error registering a service twice")
+	}
+	if err := s.RegisterName(controlService, ctxAPI{}); err == nil {
+		t.Error("Expected an error registering a service under the control service's name")
+	}
+	if err := s.SetDuplicatePolicy(DuplicateReplace); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterName(controlService, ctxAPI{}); err == nil {
+		t.Error("Expected an error replacing the control service")
+	}
+}
+
+// lingerAPI has a method that keeps running after its context is cancelled.
+type lingerAPI struct {
+	started  chan struct{}
+	returned chan struct{}
+}
+
+func (a lingerAPI) Linger(ctx context.Context, _ int) (int, error) {
+	close(a.started)
+	<-ctx.Done()
+	time.Sleep(50 * time.Millisecond)
+	close(a.returned)
+	return 0, ctx.Err()
+}
+
+// closeCheckCodec reports whether a method was still running when it was
+// closed.
+type closeCheckCodec struct {
+	rpc.ServerCodec
+	returned chan struct{}
+	early    chan bool
+}
+
+func (c closeCheckCodec) Close() error {
+	select {
+	case <-c.returned:
+		c.early <- false
+	default:
+		c.early <- true
+	}
+	return c.ServerCodec.Close()
+}
+
+func TestCloseWaitsForContextMethods(t *testing.T) {
+	s := NewProvider()
+	a := lingerAPI{started: make(chan struct{}), returned: make(chan struct{})}
+	if err := s.RegisterName("linger", a); err != nil {
+		t.Fatal(err)
+	}
+	early := make(chan bool, 1)
+	client := servePipe(t, s, func(rwc io.ReadWriteCloser) rpc.ServerCodec {
+		return closeCheckCodec{newGobServerCodec(rwc), a.returned, early}
+	}, nil)
+	client.Go("linger.Linger", 0, new(int), nil)
+	select {
+	case <-a.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Method was not called")
+	}
+	client.Close()
+	select {
+	case e := <-early:
+		if e {
+			t.Error("The codec was closed while a method was running")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The codec was not closed")
+	}
+}
+
+func TestRegisterAfterServe(t *testing.T) {
+	s := NewProvider()
+	if err := s.RegisterName("ctx", ctxAPI{}); err != nil {
+		t.Fatal(err)
+	}
+	client := servePipe(t, s, nil, nil)
+	var got string
+	if err := client.Call("ctx.Upper", "hi", &got); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterName("late", ctxAPI{}); err != ErrRegisterAfterServe {
+		t.Errorf("Expected ErrRegisterAfterServe, got %v", err)
+	}
+	if err := s.Register(&helper{}); err != ErrRegisterAfterServe {
+		t.Errorf("Expected ErrRegisterAfterServe, got %v", err)
+	}
+	if err := client.Call("late.Upper", "hi", &got); err == nil {
+		t.Error("Expected an error calling a service registered after Serve")
+	}
+}
@@ -0,0 +1,170 @@
+package pie
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// DuplicatePolicy says what a Server does when a service is registered under
+// a name that is already registered.
+type DuplicatePolicy int
+
+const (
+	// DuplicateError makes registering a duplicate name fail, as net/rpc
+	// does.  It is the default.
+	DuplicateError DuplicatePolicy = iota
+	// DuplicateReplace makes the new service replace the old one.  Calls
+	// already running finish on the old one.
+	DuplicateReplace
+	// DuplicateVersion registers the new service under the name with the
+	// first free version suffix appended, so that registering Store twice
+	// serves the second as StoreV2, and a third time as StoreV3.
+	DuplicateVersion
+)
+
+// String returns the policy's name.
+func (p DuplicatePolicy) String() string {
+	switch p {
+	case DuplicateError:
+		return "error"
+	case DuplicateReplace:
+		return "replace"
+	case DuplicateVersion:
+		return "version"
+	}
+	return "DuplicatePolicy(" + strconv.Itoa(int(p)) + ")"
+}
+
+// SetDuplicatePolicy sets what the Server does when Register, RegisterName,
+// or a Namespace registers a service under a name that is already registered.
+// With a policy other than DuplicateError, services may also be registered,
+// replaced, and unregistered after Serve has been called, so that a program
+// can swap the implementation of a service while clients are connected.
+func (s Server) SetDuplicatePolicy(p DuplicatePolicy) error {
+	if s.d == nil {
+		return errors.New("pie: server cannot be configured")
+	}
+	switch p {
+	case DuplicateError, DuplicateReplace, DuplicateVersion:
+	default:
+		return fmt.Errorf("pie: unknown duplicate policy %v", p)
+	}
+	s.d.regMu.Lock()
+	defer s.d.regMu.Unlock()
+	s.d.duplicates = p
+	return nil
+}
+
+// Unregister removes the named service, so that calls to its methods fail as
+// if it had never been registered.  Calls already running finish.  Settings
+// made by name, such as those of Server.Expose, Server.Require,
+// Server.SetValidator, and Server.Alias, are kept, and apply to a service
+// registered under the name later.  Unregister may not be called after Serve
+// unless the Server's DuplicatePolicy is other than DuplicateError.
+func (s Server) Unregister(name string) error {
+	if s.d == nil {
+		return errors.New("pie: server cannot be configured")
+	}
+	if name == controlService {
+		return fmt.Errorf("pie: cannot unregister %s: it is reserved", name)
+	}
+	s.d.regMu.Lock()
+	defer s.d.regMu.Unlock()
+	if s.d.serving && s.d.duplicates == DuplicateError {
+		return ErrRegisterAfterServe
+	}
+	if !s.d.has(name) {
+		return fmt.Errorf("pie: cannot unregister %s: no such service", name)
+	}
+	s.d.remove(name)
+	if s.ctl != nil {
+		s.ctl.removeMethods(name)
+	}
+	return nil
+}
+
+// duplicate returns the name to register a service under, following the
+// Server's DuplicatePolicy, when the name it was registered with is taken.
+// The caller holds s.d.regMu.
+func (s Server) duplicate(name string) (string, error) {
+	switch {
+	case s.d.duplicates == DuplicateReplace && name != controlService:
+		return name, nil
+	case s.d.duplicates == DuplicateVersion:
+		for v := 2; ; v++ {
+			if versioned := name + "V" + strconv.Itoa(v); !s.taken(versioned) {
+				return versioned, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("rpc: service already defined: %s", name)
+}
+
+// taken reports whether a service is registered under name, either with the
+// dispatcher or directly with the rpc.Server behind it, as the control service
+// is.  The caller holds s.d.regMu.
+func (s Server) taken(name string) bool {
+	return s.d.has(name) || name == controlService
+}
+
+// remove stops the dispatcher serving the named service.
+func (d *dispatcher) remove(service string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.removeLocked(service)
+}
+
+// removeLocked is remove for callers that hold d.mu.
+func (d *dispatcher) removeLocked(service string) {
+	if !d.services[service] {
+		return
+	}
+	delete(d.services, service)
+	for name := range d.methods {
+		if svc, _, _ := splitServiceMethod(name); svc == service {
+			delete(d.methods, name)
+		}
+	}
+}
+
+// rpcRegistered reports whether the named service was registered with the
+// rpc.Server.
+func (d *dispatcher) rpcRegistered(service string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.rpcNames[service]
+}
+
+// setRPCRegistered records that the named service was registered with the
+// rpc.Server.
+func (d *dispatcher) setRPCRegistered(service string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.rpcNames == nil {
+		d.rpcNames = map[string]bool{}
+	}
+	d.rpcNames[service] = true
+}
+
+// retired reports whether serviceMethod belongs to a service registered with
+// the rpc.Server that has since been unregistered, so that the rpc.Server
+// must not serve it.
+func (d *dispatcher) retired(serviceMethod string) bool {
+	service, _, _ := splitServiceMethod(serviceMethod)
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.rpcNames[service] && !d.services[service]
+}
+
+// removeMethods removes the named service's methods from the provider's
+// manifest.
+func (c *control) removeMethods(service string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name := range c.methods {
+		if svc, _, _ := splitServiceMethod(name); svc == service {
+			delete(c.methods, name)
+		}
+	}
+}
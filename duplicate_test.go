@@ -0,0 +1,139 @@
+package pie
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+type greeterV1 struct{}
+
+func (greeterV1) Greet(name string, reply *string) error {
+	*reply = "hello " + name
+	return nil
+}
+
+type greeterV2 struct{}
+
+func (greeterV2) Greet(name string, reply *string) error {
+	*reply = "hi " + name
+	return nil
+}
+
+// duplicatesPlugin serves s, with the greeter service registered, to a
+// plugin handle.
+func duplicatesPlugin(t *testing.T, p DuplicatePolicy) (Server, *Plugin) {
+	s := NewProvider()
+	if err := s.SetDuplicatePolicy(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterName("greeter", greeterV1{}); err != nil {
+		t.Fatal(err)
+	}
+	return s, pipePlugin(t, s)
+}
+
+func greet(t *testing.T, p *Plugin, method string) string {
+	t.Helper()
+	var reply string
+	if err := p.Call(method, "bob", &reply); err != nil {
+		t.Fatalf("%s: %v", method, err)
+	}
+	return reply
+}
+
+func TestDuplicateError(t *testing.T) {
+	s, p := duplicatesPlugin(t, DuplicateError)
+	greet(t, p, "greeter.Greet")
+	if err := s.RegisterName("greeter", greeterV2{}); err == nil {
+		t.Error("Expected an error registering a duplicate name")
+	}
+	if err := s.Unregister("greeter"); !errors.Is(err, ErrRegisterAfterServe) {
+		t.Errorf("Expected ErrRegisterAfterServe unregistering while serving, got %v", err)
+	}
+	if got := greet(t, p, "greeter.Greet"); got != "hello bob" {
+		t.Errorf("Expected the original service, got %q", got)
+	}
+}
+
+func TestDuplicateReplace(t *testing.T) {
+	s, p := duplicatesPlugin(t, DuplicateReplace)
+	if got := greet(t, p, "greeter.Greet"); got != "hello bob" {
+		t.Errorf("Expected hello bob, got %q", got)
+	}
+	if err := s.RegisterName("greeter", greeterV2{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := greet(t, p, "greeter.Greet"); got != "hi bob" {
+		t.Errorf("Expected the replacement to serve calls, got %q", got)
+	}
+	if err := s.RegisterName("fresh", greeterV1{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := greet(t, p, "fresh.Greet"); got != "hello bob" {
+		t.Errorf("Expected a service registered while serving to serve calls, got %q", got)
+	}
+}
+
+func TestDuplicateVersion(t *testing.T) {
+	s, p := duplicatesPlugin(t, DuplicateVersion)
+	if err := s.RegisterName("greeter", greeterV2{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterName("greeter", greeterV1{}); err != nil {
+		t.Fatal(err)
+	}
+	for method, want := range map[string]string{
+		"greeter.Greet":   "hello bob",
+		"greeterV2.Greet": "hi bob",
+		"greeterV3.Greet": "hello bob",
+	} {
+		if got := greet(t, p, method); got != want {
+			t.Errorf("%s: expected %q, got %q", method, want, got)
+		}
+	}
+}
+
+func TestUnregister(t *testing.T) {
+	s, p := duplicatesPlugin(t, DuplicateReplace)
+	if err := s.Unregister("greeter"); err != nil {
+		t.Fatal(err)
+	}
+	var reply string
+	if err := p.Call("greeter.Greet", "bob", &reply); err == nil || !strings.Contains(err.Error(), "can't find method") {
+		t.Errorf("Expected calls to an unregistered service to fail, got %v", err)
+	}
+	m, err := p.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mi := range m.Methods {
+		if strings.HasPrefix(mi.Name, "greeter.") {
+			t.Errorf("Expected the manifest not to list %s", mi.Name)
+		}
+	}
+	if err := s.Unregister("greeter"); err == nil {
+		t.Error("Expected an error unregistering a missing service")
+	}
+	if err := s.Unregister(controlService); err == nil {
+		t.Error("Expected an error unregistering the control API")
+	}
+	if err := s.RegisterName("greeter", greeterV2{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := greet(t, p, "greeter.Greet"); got != "hi bob" {
+		t.Errorf("Expected the re-registered service, got %q", got)
+	}
+}
+
+func TestSetDuplicatePolicy(t *testing.T) {
+	if err := NewProvider().SetDuplicatePolicy(DuplicatePolicy(9)); err == nil {
+		t.Error("Expected an error setting an unknown policy")
+	}
+	if err := (Server{}).SetDuplicatePolicy(DuplicateReplace); err == nil {
+		t.Error("Expected an error from a zero Server")
+	}
+	if s := DuplicateVersion.String(); s != "version" {
+		t.Errorf("Expected version, got %q", s)
+	}
+}
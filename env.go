@@ -0,0 +1,77 @@
+package pie
+
+import (
+	"os"
+	"strings"
+	"sync"
+)
+
+// providerEnvs are the environment variables through which a host configures
+// the providers it starts.
+var providerEnvs = []string{
+	guardEnv, framingEnv, keepaliveEnv, muxEnv, batchingEnv,
+	hostBuildEnv, featuresEnv, bootstrapEnv, netProxyEnv, peerEnv,
+}
+
+// takenEnv holds the values of providerEnvs that newProvider has taken out of
+// the environment.
+var takenEnv struct {
+	mu   sync.Mutex
+	vals map[string]string
+}
+
+// providerGetenv returns the value of the provider environment variable name,
+// which is still found once newProvider has taken it out of the environment.
+func providerGetenv(name string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	takenEnv.mu.Lock()
+	defer takenEnv.mu.Unlock()
+	return takenEnv.vals[name]
+}
+
+// takeProviderEnv takes providerEnvs out of the environment, so that the
+// plugin's own children, such as plugins it starts itself, do not inherit
+// the configuration the host meant for the plugin.
+func takeProviderEnv() {
+	takenEnv.mu.Lock()
+	defer takenEnv.mu.Unlock()
+	for _, name := range providerEnvs {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if takenEnv.vals == nil {
+			takenEnv.vals = map[string]string{}
+		}
+		takenEnv.vals[name] = v
+		os.Unsetenv(name)
+	}
+}
+
+// hostEnviron returns the environment a plugin inherits from the host: the
+// host's, without the provider environment variables the host may itself
+// have been started with.
+func hostEnviron() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if isProviderEnv(kv) {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
+
+// isProviderEnv reports whether the "key=value" entry kv sets one of
+// providerEnvs.
+func isProviderEnv(kv string) bool {
+	key, _, _ := strings.Cut(kv, "=")
+	for _, name := range providerEnvs {
+		if key == name {
+			return true
+		}
+	}
+	return false
+}
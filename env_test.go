@@ -0,0 +1,56 @@
+package pie
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestProviderEnvNotInherited(t *testing.T) {
+	p, err := StartPlugin(os.Stderr, os.Args[0], helperArgs("provider"),
+		WithMux(), WithFraming(nil), WithTransportKeepalive(50*time.Millisecond, time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	for _, name := range []string{muxEnv, framingEnv, keepaliveEnv, guardEnv, hostBuildEnv} {
+		var own, nested string
+		if err := p.Call("helper.Getenv", name, &own); err != nil {
+			t.Fatal(err)
+		}
+		if own != "" {
+			t.Errorf("Expected the provider to take %s out of its environment, got %q", name, own)
+		}
+		if err := p.Call("helper.NestedGetenv", name, &nested); err != nil {
+			t.Fatalf("Starting a nested plugin: %v", err)
+		}
+		if name == muxEnv || name == framingEnv || name == keepaliveEnv {
+			if nested != "" {
+				t.Errorf("Expected the nested plugin not to inherit %s, got %q", name, nested)
+			}
+		}
+	}
+}
+
+func TestHostEnviron(t *testing.T) {
+	t.Setenv(muxEnv, "1")
+	t.Setenv("PIE_TEST_OTHER", "kept")
+	var mux, other bool
+	for _, kv := range hostEnviron() {
+		switch kv {
+		case muxEnv + "=1":
+			mux = true
+		case "PIE_TEST_OTHER=kept":
+			other = true
+		}
+	}
+	if mux || !other {
+		t.Errorf("Expected only %s to be left out, got %v", muxEnv, hostEnviron())
+	}
+	p := startHelper(t, "provider", os.Stderr)
+	defer p.Close()
+	var reply string
+	if err := p.Call("api.SayHi", "bob", &reply); err != nil {
+		t.Fatalf("Expected a plugin started by a host with %s set to be unmultiplexed, got %v", muxEnv, err)
+	}
+}
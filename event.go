@@ -0,0 +1,114 @@
+package pie
+
+import (
+	"strconv"
+	"time"
+)
+
+// EventKind identifies what happened in a plugin lifecycle Event.
+type EventKind int
+
+const (
+	// EventStarted is emitted when a plugin has been started for the first
+	// time.
+	EventStarted EventKind = iota
+	// EventExited is emitted when a plugin process exits without having been
+	// closed.
+	EventExited
+	// EventHung is emitted when a Watchdog declares a plugin hung, just before
+	// the plugin is killed.
+	EventHung
+	// EventRestarted is emitted when a plugin has been restarted.
+	EventRestarted
+	// EventRestartFailed is emitted when an attempt to restart a plugin failed.
+	EventRestartFailed
+	// EventRecycled is emitted when a plugin instance that reached its
+	// Policy's limits has been replaced by a fresh instance.  The event's
+	// Plugin is the new instance.
+	EventRecycled
+	// EventThreshold is emitted when a plugin exceeds one of its Policy's
+	// Thresholds.  The event's Err is a *ThresholdError.
+	EventThreshold
+	// EventGaveUp is emitted when a Supervisor stops restarting a plugin
+	// because its Policy does not allow any more restarts.
+	EventGaveUp
+	// EventReplaced is emitted when a plugin instance has been replaced by
+	// one started by Supervisor.Replace.  The event's Plugin is the new
+	// instance.
+	EventReplaced
+	// EventUpdateAvailable is emitted by a Manager when it finds a newer
+	// compatible version of a plugin in its Catalog.  The event's Update
+	// describes the new version.
+	EventUpdateAvailable
+	// EventUpdated is emitted by a Manager when a plugin has been replaced by
+	// a newer version.
+	EventUpdated
+	// EventUpdateFailed is emitted by a Manager when updating a plugin failed.
+	// The plugin keeps running its current version.
+	EventUpdateFailed
+	// EventQuotaExceeded is emitted by a Manager the first time in a minute
+	// that the host hits one of a plugin's Quota limits.  The event's Err is a
+	// *QuotaError.
+	EventQuotaExceeded
+	// EventWarmUpFailed is emitted when a plugin instance's warm-up failed.
+	// The event's Err is a *WarmUpError.
+	EventWarmUpFailed
+	// EventReloaded is emitted when a plugin instance has been replaced by
+	// one started because the files a Supervisor watches changed.  The
+	// event's Plugin is the new instance.
+	EventReloaded
+	// EventReloadFailed is emitted when rebuilding or starting a plugin to
+	// reload it failed.  The event's Err is a *BuildError if the build
+	// failed.  The plugin keeps running its current instance.
+	EventReloadFailed
+)
+
+var eventKindNames = [...]string{
+	EventStarted:         "started",
+	EventExited:          "exited",
+	EventHung:            "hung",
+	EventRestarted:       "restarted",
+	EventRestartFailed:   "restart failed",
+	EventRecycled:        "recycled",
+	EventThreshold:       "threshold exceeded",
+	EventGaveUp:          "gave up",
+	EventReplaced:        "replaced",
+	EventUpdateAvailable: "update available",
+	EventUpdated:         "updated",
+	EventUpdateFailed:    "update failed",
+	EventQuotaExceeded:   "quota exceeded",
+	EventWarmUpFailed:    "warm-up failed",
+	EventReloaded:        "reloaded",
+	EventReloadFailed:    "reload failed",
+}
+
+// String returns a short, human readable name for the kind of event.
+func (k EventKind) String() string {
+	if k >= 0 && int(k) < len(eventKindNames) {
+		return eventKindNames[k]
+	}
+	return "EventKind(" + strconv.Itoa(int(k)) + ")"
+}
+
+// Event describes something that happened during the lifecycle of a
+// supervised plugin.
+type Event struct {
+	Kind EventKind
+	Time time.Time
+	// Name is the name of the plugin for events emitted by a Manager, and
+	// empty otherwise.
+	Name string
+	// Plugin is the plugin instance the event concerns.  It is nil for events
+	// that do not concern a running instance, such as EventRestartFailed.
+	Plugin *Plugin
+	// Err is the error associated with the event, if any.
+	Err error
+	// Hang is the watchdog's report for EventHung, and nil otherwise.
+	Hang *HangReport
+	// Crash is the plugin's report for EventExited if it crashed and was
+	// started with WithCrashReports, and nil otherwise.
+	Crash *CrashReport
+	// Update is the update concerned by EventUpdateAvailable, EventUpdated,
+	// and EventUpdateFailed, and nil otherwise.
+	Update *Update
+}
@@ -0,0 +1,161 @@
+package pie
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+)
+
+// Exit codes used by providers to tell their host why they failed, so that
+// hosts and the tools that run them can react to the failure rather than to
+// an unexplained exit.  They are set by ExitCode, which RunProvider and
+// Server.ServeAndExit use, and are outside both the range of sysexits(3) and
+// the codes shells use for signals.
+const (
+	// ExitHandshakeFailed means the provider could not complete a handshake
+	// with the host, such as the encryption handshake or a version check.
+	ExitHandshakeFailed = 80
+	// ExitCodecMismatch means the provider could not decode what the host
+	// sent, usually because they use different codecs.
+	ExitCodecMismatch = 81
+	// ExitInvalidConfig means the provider's configuration is invalid.
+	ExitInvalidConfig = 82
+	// ExitPanic means the provider panicked.
+	ExitPanic = 83
+)
+
+var (
+	// ErrHandshakeFailed is reported for a plugin that exited with
+	// ExitHandshakeFailed.
+	ErrHandshakeFailed = errors.New("plugin handshake failed")
+	// ErrCodecMismatch is reported for a plugin that exited with
+	// ExitCodecMismatch.
+	ErrCodecMismatch = errors.New("plugin could not decode the host's messages")
+	// ErrInvalidConfig is reported for a plugin that exited with
+	// ExitInvalidConfig.  Providers wrap it in the errors they return from
+	// RunProvider's setup function when their configuration is invalid.
+	ErrInvalidConfig = errors.New("plugin configuration is invalid")
+	// ErrPluginPanicked is reported for a plugin that exited with ExitPanic.
+	ErrPluginPanicked = errors.New("plugin panicked")
+)
+
+// exitCodeErrors maps the exit codes to the errors they are reported with.
+var exitCodeErrors = map[int]error{
+	ExitHandshakeFailed: ErrHandshakeFailed,
+	ExitCodecMismatch:   ErrCodecMismatch,
+	ExitInvalidConfig:   ErrInvalidConfig,
+	ExitPanic:           ErrPluginPanicked,
+}
+
+// ExitCode returns the status a provider should exit with after err, as
+// returned by Server.ServeErr or by setting up the provider: 0 for nil, one of
+// the Exit constants for the failures they describe, and 1 for any other
+// error.
+func ExitCode(err error) int {
+	var de *DisconnectError
+	var vre *VersionRequirementError
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, ErrInvalidConfig):
+		return ExitInvalidConfig
+	case errors.Is(err, ErrPluginPanicked):
+		return ExitPanic
+	case errors.Is(err, ErrHandshakeFailed), errors.Is(err, ErrSecretMismatch), errors.As(err, &vre):
+		return ExitHandshakeFailed
+	case errors.Is(err, ErrCodecMismatch), errors.As(err, &de) && de.Reason == DisconnectDecode:
+		return ExitCodecMismatch
+	}
+	return 1
+}
+
+// ServeAndExit serves the Server like ServeErr, and then exits the process
+// with the status ExitCode returns for the error, so that the host can tell
+// why the plugin stopped.
+func (s Server) ServeAndExit() {
+	os.Exit(ExitCode(s.ServeErr()))
+}
+
+// RunProvider runs a provider-style plugin: it creates a Server with
+// NewProvider, calls setup to register the plugin's services and otherwise
+// prepare it, serves it like ServeErr, and exits the process with the status
+// ExitCode returns for the result.  If setup fails, its error is written to
+// stderr, and an error wrapping ErrInvalidConfig exits with
+// ExitInvalidConfig.  A panic in setup, or in the goroutine RunProvider runs
+// in, is written to stderr with its stack and exits with ExitPanic.  Panics in
+// the goroutines serving calls crash the process as usual.
+func RunProvider(setup func(Server) error) {
+	os.Exit(runProvider(NewProvider(), setup))
+}
+
+// runProvider runs the provider s for RunProvider, returning the status to
+// exit with.
+func runProvider(s Server, setup func(Server) error) (code int) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "panic: %v\n\n%s", r, debug.Stack())
+			code = ExitPanic
+		}
+	}()
+	if err := setup(s); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitCode(err)
+	}
+	return ExitCode(s.ServeErr())
+}
+
+// ExitError describes a plugin that exited with one of the Exit status codes.
+// It matches the error for its status with errors.Is, such as
+// ErrInvalidConfig for ExitInvalidConfig.
+type ExitError struct {
+	Code int
+	// State is the state of the exited process, or nil if the Runner that
+	// ran it did not report one.
+	State *os.ProcessState
+}
+
+// Error implements the error interface.
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("plugin exited with status %d: %v", e.Code, exitCodeErrors[e.Code])
+}
+
+// Is reports whether target is the error for the exit status.
+func (e *ExitError) Is(target error) bool {
+	return target != nil && exitCodeErrors[e.Code] == target
+}
+
+// exitError returns an *ExitError if state, the state of an exited plugin
+// process, shows it exited with one of the Exit status codes, or, for plugins
+// whose Runner does not report their state, err has the ExitCode of one, and
+// err, the error from waiting on it, otherwise.
+func exitError(state *os.ProcessState, err error) error {
+	var ec interface{ ExitCode() int }
+	if state == nil && errors.As(err, &ec) {
+		if _, ok := exitCodeErrors[ec.ExitCode()]; ok {
+			return &ExitError{Code: ec.ExitCode()}
+		}
+	}
+	if err != nil || state == nil {
+		return err
+	}
+	if _, ok := exitCodeErrors[state.ExitCode()]; !ok {
+		return nil
+	}
+	return &ExitError{Code: state.ExitCode(), State: state}
+}
+
+// startupError returns err, the error from starting the plugin whose process
+// is r, together with the reason the plugin gave if it has exited with one of
+// the Exit status codes.
+func startupError(r *reaper, err error) error {
+	select {
+	case <-r.done:
+	default:
+		return err
+	}
+	if xe := exitError(r.state, r.err); xe != nil {
+		return fmt.Errorf("%w: %w", xe, err)
+	}
+	return err
+}
@@ -0,0 +1,98 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{nil, 0},
+		{errors.New("anything"), 1},
+		{fmt.Errorf("loading: %w", ErrInvalidConfig), ExitInvalidConfig},
+		{&DisconnectError{Reason: DisconnectDecode, Err: errors.New("gob: bad data")}, ExitCodecMismatch},
+		{&DisconnectError{Reason: DisconnectBroken, Err: ErrSecretMismatch}, ExitHandshakeFailed},
+		{&DisconnectError{Reason: DisconnectBroken, Err: io.ErrUnexpectedEOF}, 1},
+		{&VersionRequirementError{Requirer: "plugin", Constraint: ">= 2"}, ExitHandshakeFailed},
+		{ErrPluginPanicked, ExitPanic},
+	}
+	for _, test := range tests {
+		if code := ExitCode(test.err); code != test.code {
+			t.Errorf("Expected exit code %d for %v, got %d", test.code, test.err, code)
+		}
+	}
+}
+
+func TestExitError(t *testing.T) {
+	err := &ExitError{Code: ExitCodecMismatch}
+	if !errors.Is(err, ErrCodecMismatch) || errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected %v to match only ErrCodecMismatch", err)
+	}
+	if msg := "plugin exited with status 81: plugin could not decode the host's messages"; err.Error() != msg {
+		t.Errorf("Expected %q, got %q", msg, err.Error())
+	}
+	// Errors from waiting are left alone.
+	other := errors.New("wait failed")
+	if got := exitError(nil, other); got != other {
+		t.Errorf("Expected %v to be left alone, got %v", other, got)
+	}
+}
+
+func TestExitCodeInvalidConfig(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var stderr lockedBuffer
+	_, err := StartPluginContext(ctx, &stderr, os.Args[0], helperArgs("badconfig"))
+	if !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("Expected ErrInvalidConfig starting the plugin, got %v", err)
+	}
+	var xe *ExitError
+	if !errors.As(err, &xe) || xe.Code != ExitInvalidConfig {
+		t.Errorf("Expected an ExitError with status %d, got %v", ExitInvalidConfig, err)
+	}
+	if !stderrContains(&stderr, "no listen address") {
+		t.Errorf("Expected the setup error on stderr, got %q", stderr.String())
+	}
+}
+
+func TestExitCodePanic(t *testing.T) {
+	var stderr lockedBuffer
+	p, err := StartPlugin(&stderr, os.Args[0], helperArgs("panic"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	select {
+	case <-p.Exited():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Plugin did not exit")
+	}
+	if err := p.ExitErr(); !errors.Is(err, ErrPluginPanicked) {
+		t.Errorf("Expected ErrPluginPanicked from ExitErr, got %v", err)
+	}
+	if !stderrContains(&stderr, "panic: boom") {
+		t.Errorf("Expected the panic on stderr, got %q", stderr.String())
+	}
+}
+
+// stderrContains reports whether the plugin's stderr, which is copied to b in
+// the background, comes to contain s.
+func stderrContains(b *lockedBuffer, s string) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(b.String(), s) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+package pie
+
+import "fmt"
+
+// Expose limits the API the Server serves to the named services and methods,
+// each given either as a service name, which exposes all of the service's
+// methods, as a namespace, which exposes all the services in it, or as
+// "Service.Method".  Calls to anything else fail as if the
+// method did not exist.  This lets a host register its whole API with the
+// Server of each consumer-style plugin it starts, and then expose to each
+// plugin only the part it should use, such as only the read-only methods of a
+// service to an untrusted plugin.  pie's built-in control API is always
+// served.
+//
+// Expose may be called at any time, and replaces the limits set by earlier
+// calls; calling it with no names exposes nothing.  It returns an error, and
+// changes nothing, if a name is not a registered service or method.
+func (s Server) Expose(names ...string) error {
+	exposed := map[string]bool{}
+	for _, name := range names {
+		if !s.d.has(name) && !s.d.hasNamespace(name) && s.d.lookup(name) == nil {
+			return fmt.Errorf("pie: cannot expose %s: no such service or method", name)
+		}
+		exposed[name] = true
+	}
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	s.d.exposed = exposed
+	return nil
+}
+
+// exposes reports whether the dispatcher's Server may serve serviceMethod.
+func (d *dispatcher) exposes(serviceMethod string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.exposedLocked(serviceMethod)
+}
+
+// exposedLocked is exposes for callers that hold d.mu.
+func (d *dispatcher) exposedLocked(serviceMethod string) bool {
+	if d.exposed == nil {
+		return true
+	}
+	if d.exposed[serviceMethod] {
+		return true
+	}
+	for service, _, ok := splitServiceMethod(serviceMethod); ok; service, _, ok = splitServiceMethod(service) {
+		if service == controlService || d.exposed[service] {
+			return true
+		}
+	}
+	return false
+}
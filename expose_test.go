@@ -0,0 +1,57 @@
+package pie
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpose(t *testing.T) {
+	s := NewProvider()
+	if err := s.RegisterName("api", api{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterName("ctx", ctxAPI{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Expose("api", "ctx.Upper"); err != nil {
+		t.Fatal(err)
+	}
+	client := servePipe(t, s, nil, nil)
+
+	var response string
+	if err := client.Call("api.SayHi", "bob", &response); err != nil {
+		t.Errorf("Unexpected error calling an exposed service: %v", err)
+	}
+	if err := client.Call("ctx.Upper", "bob", &response); err != nil {
+		t.Errorf("Unexpected error calling an exposed method: %v", err)
+	}
+	for _, method := range []string{"ctx.Lower", "ctx.Pair"} {
+		err := client.Call(method, "bob", &response)
+		if err == nil || !strings.Contains(err.Error(), "can't find method") {
+			t.Errorf("Expected %s to be hidden, got %v", method, err)
+		}
+	}
+	if err := client.Call(controlService+".Ping", 1, new(int)); err != nil {
+		t.Errorf("Unexpected error calling the control API: %v", err)
+	}
+
+	// Narrowing the API affects later calls on the same connection.
+	if err := s.Expose("ctx.Upper"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Call("api.SayHi", "bob", &response); err == nil {
+		t.Error("Expected api to be hidden after narrowing the exposed API")
+	}
+}
+
+func TestExposeUnknown(t *testing.T) {
+	s := NewProvider()
+	if err := s.RegisterName("api", api{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"nope", "api.Nope", "nope.SayHi"} {
+		if err := s.Expose(name); err == nil {
+			t.Errorf("Expected an error exposing %s", name)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package pie
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+)
+
+// featuresEnv is the environment variable through which the host sends a
+// provider its feature flags, as a JSON object of booleans.
+const featuresEnv = "PIE_FEATURES"
+
+// Features is a set of feature flags, from the flag's name to whether it is
+// enabled.  Flags that are not in the set are disabled.
+type Features map[string]bool
+
+// Enabled reports whether the named flag is enabled.
+func (f Features) Enabled(name string) bool {
+	return f[name]
+}
+
+// Names returns the names of the enabled flags, sorted.
+func (f Features) Names() []string {
+	var names []string
+	for name, on := range f {
+		if on {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// clone returns a copy of f, which is never nil.
+func (f Features) clone() Features {
+	c := make(Features, len(f))
+	for name, on := range f {
+		c[name] = on
+	}
+	return c
+}
+
+// env returns the value of featuresEnv that sends f.
+func (f Features) env() string {
+	b, _ := json.Marshal(f)
+	return string(b)
+}
+
+// parseFeaturesEnv parses the value of featuresEnv.  Invalid values mean no
+// flags.
+func parseFeaturesEnv(v string) Features {
+	var f Features
+	if v == "" || json.Unmarshal([]byte(v), &f) != nil {
+		return nil
+	}
+	return f
+}
+
+// WithFeatures sends the plugin the feature flags in f when it starts, so that
+// it can adapt its behavior to them without a configuration API of its own.
+// The plugin reads them with Server.Features.  Use Plugin.SetFeatures to change
+// them once the plugin is running.
+//
+// Plugins started by StartPlugin get the flags through their environment.
+// Handles created with NewPlugin send them before NewPlugin returns, and fail
+// to start if the plugin cannot take them.
+func WithFeatures(f Features) StartOption {
+	return func(o *startOptions) {
+		o.features = f.clone()
+	}
+}
+
+// SetFeatures replaces the plugin's feature flags with f.  The plugin's
+// handler set with Server.OnFeaturesChange is called before SetFeatures
+// returns.  It fails for plugins created by versions of this package without
+// feature flags.  A Supervisor that restarts or recycles the plugin sets the
+// latest flags on the new instance, in place of those it was started with.
+func (p *Plugin) SetFeatures(f Features) error {
+	f = f.clone()
+	if err := p.controlClient().Call(controlService+".SetFeatures", f, new(int)); err != nil {
+		return err
+	}
+	p.featuresMu.Lock()
+	defer p.featuresMu.Unlock()
+	p.features = f
+	return nil
+}
+
+// carryFeatures sets the flags last set on old with SetFeatures on np, the
+// instance replacing it, if there are any.  If np cannot take them, it is
+// closed.
+func carryFeatures(old, np *Plugin) error {
+	old.featuresMu.Lock()
+	f := old.features
+	old.featuresMu.Unlock()
+	if f == nil {
+		return nil
+	}
+	if err := np.SetFeatures(f); err != nil {
+		np.Close()
+		return err
+	}
+	return nil
+}
+
+// Features returns the feature flags the host has sent, as with WithFeatures
+// and Plugin.SetFeatures.
+func (s Server) Features() Features {
+	if s.ctl == nil {
+		return Features{}
+	}
+	s.ctl.featuresMu.Lock()
+	defer s.ctl.featuresMu.Unlock()
+	return s.ctl.features.clone()
+}
+
+// Feature reports whether the host has enabled the named feature flag.
+func (s Server) Feature(name string) bool {
+	if s.ctl == nil {
+		return false
+	}
+	s.ctl.featuresMu.Lock()
+	defer s.ctl.featuresMu.Unlock()
+	return s.ctl.features.Enabled(name)
+}
+
+// OnFeaturesChange sets a function to be called with the new flags whenever
+// the host changes them with Plugin.SetFeatures.  Calls to it are made one at
+// a time, in the order the changes were made, and the host's SetFeatures does
+// not return until it returns.
+func (s Server) OnFeaturesChange(f func(Features)) error {
+	if s.ctl == nil {
+		return errors.New("pie: server cannot be configured")
+	}
+	s.ctl.featuresMu.Lock()
+	defer s.ctl.featuresMu.Unlock()
+	s.ctl.onFeatures = f
+	return nil
+}
+
+// SetFeatures replaces the provider's feature flags with those sent by the
+// host, and tells the provider's handler.
+func (c *control) SetFeatures(f Features, _ *int) error {
+	c.featuresNotify.Lock()
+	defer c.featuresNotify.Unlock()
+	c.featuresMu.Lock()
+	c.features = f.clone()
+	notify := c.onFeatures
+	c.featuresMu.Unlock()
+	if notify != nil {
+		notify(f.clone())
+	}
+	return nil
+}
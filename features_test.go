@@ -0,0 +1,101 @@
+package pie
+
+import (
+	"net"
+	"net/rpc"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestFeatures(t *testing.T) {
+	f := Features{"fast": true, "beta": true, "legacy": false}
+	if !f.Enabled("fast") || f.Enabled("legacy") || f.Enabled("missing") {
+		t.Errorf("Wrong flags enabled in %v", f)
+	}
+	if got, want := f.Names(), []string{"beta", "fast"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected enabled flags %v, got %v", want, got)
+	}
+	if got := parseFeaturesEnv(f.env()); !reflect.DeepEqual(got, f) {
+		t.Errorf("Expected %v back from the environment, got %v", f, got)
+	}
+	if got := parseFeaturesEnv("garbage"); got != nil {
+		t.Errorf("Expected no flags for garbage, got %v", got)
+	}
+}
+
+func TestFeaturesStartPlugin(t *testing.T) {
+	p, err := StartPlugin(os.Stderr, os.Args[0], helperArgs("provider"), WithFeatures(Features{"fast": true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	var on bool
+	if err := p.Call("helper.Feature", "fast", &on); err != nil {
+		t.Fatal(err)
+	}
+	if !on {
+		t.Error("Expected the plugin to have the flag from its environment")
+	}
+	if err := p.SetFeatures(Features{"slow": true}); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"fast": false, "slow": true} {
+		if err := p.Call("helper.Feature", name, &on); err != nil {
+			t.Fatal(err)
+		}
+		if on != want {
+			t.Errorf("Expected flag %s to be %v after the update, got %v", name, want, on)
+		}
+	}
+}
+
+func TestFeaturesNewPlugin(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	s := NewProviderConn(serverConn)
+	changes := make(chan Features, 2)
+	if err := s.OnFeaturesChange(func(f Features) { changes <- f }); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	p, err := NewPlugin(clientConn, WithFeatures(Features{"fast": true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	// The flags have been sent by the time NewPlugin returns.
+	if !s.Feature("fast") {
+		t.Error("Expected the provider to have the flag")
+	}
+	if err := p.SetFeatures(nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Features(); len(got) != 0 {
+		t.Errorf("Expected no flags after clearing them, got %v", got)
+	}
+	for _, want := range []Features{{"fast": true}, {}} {
+		if got := <-changes; !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected change to %v, got %v", want, got)
+		}
+	}
+}
+
+func TestFeaturesOldPlugin(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	s := rpc.NewServer()
+	s.RegisterName("api", api{})
+	go s.ServeConn(serverConn)
+	if _, err := NewPlugin(clientConn, WithFeatures(Features{"fast": true})); err == nil {
+		t.Error("Expected an error from a plugin that cannot take feature flags")
+	}
+}
+
+func TestFeaturesUnconfigurable(t *testing.T) {
+	var s Server
+	if s.Feature("x") || len(s.Features()) != 0 {
+		t.Error("Expected no flags on a server without a control API")
+	}
+	if err := s.OnFeaturesChange(func(Features) {}); err == nil {
+		t.Error("Expected an error from a server that cannot be configured")
+	}
+}
@@ -0,0 +1,193 @@
+package pie
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Fetcher downloads plugin binaries from https URLs into a local cache, keyed
+// by the expected SHA-256 digest of each binary.  A plugin is only downloaded
+// if the cache does not already hold a binary with the expected digest, and a
+// binary is never used unless its digest matches.
+type Fetcher struct {
+	// CacheDir is the directory downloaded plugins are stored in.  It defaults
+	// to a "pie" directory in os.UserCacheDir.
+	CacheDir string
+	// Client is the HTTP client used to download plugins.  It defaults to
+	// http.DefaultClient.
+	Client *http.Client
+}
+
+// DigestMismatchError is returned when a downloaded plugin does not have the
+// expected digest.
+type DigestMismatchError struct {
+	URL      string
+	Expected string
+	Actual   string
+}
+
+// Error implements the error interface.
+func (e *DigestMismatchError) Error() string {
+	return fmt.Sprintf("plugin downloaded from %s has digest sha256:%s, expected sha256:%s", e.URL, e.Actual, e.Expected)
+}
+
+// Start fetches the plugin at rawurl as Fetch does, and then starts it with
+// StartPluginContext, so that ctx bounds both the download and the start, and
+// closes the plugin when it is cancelled.
+func (f *Fetcher) Start(ctx context.Context, output io.Writer, rawurl, digest string, args []string, opts ...StartOption) (*Plugin, error) {
+	path, err := f.Fetch(ctx, rawurl, digest)
+	if err != nil {
+		return nil, err
+	}
+	return StartPluginContext(ctx, output, path, args, opts...)
+}
+
+// Fetch returns the path of a cached, executable copy of the plugin at rawurl,
+// downloading it first if the cache holds no binary with the given digest.
+// The digest is the hex encoded SHA-256 of the binary, optionally prefixed by
+// "sha256:".  Only https URLs are accepted.
+func (f *Fetcher) Fetch(ctx context.Context, rawurl, digest string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "https" {
+		return "", fmt.Errorf("refusing to fetch plugin over %s from %s, only https is supported", u.Scheme, rawurl)
+	}
+	sum, err := parseDigest(digest)
+	if err != nil {
+		return "", err
+	}
+	dest, err := f.cachePath(sum, cacheName(u.Path, "plugin"))
+	if err != nil {
+		return "", err
+	}
+	if fileDigest(dest) == sum {
+		return dest, nil
+	}
+	if err := f.download(ctx, u.String(), sum, dest); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
+
+// cacheName returns the last element of the slash separated path p, to name a
+// cached binary after, or fallback if that element is empty, "." or "..", or
+// is not a plain file name on this platform.
+func cacheName(p, fallback string) string {
+	name := path.Base(p)
+	if name == "/" || name == "." || name == ".." || name != filepath.Base(name) || filepath.VolumeName(name) != "" {
+		return fallback
+	}
+	return name
+}
+
+// cachePath returns the path a binary with the given digest and file name is
+// cached at.
+func (f *Fetcher) cachePath(sum, name string) (string, error) {
+	return pluginCachePath(f.CacheDir, sum, name)
+}
+
+// pluginCachePath returns the path a binary with the given digest and file
+// name is cached at in the content addressed cache rooted at dir.  If dir is
+// empty, a "pie" directory in os.UserCacheDir is used.
+func pluginCachePath(dir, sum, name string) (string, error) {
+	if dir == "" {
+		cache, err := os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(cache, "pie")
+	}
+	return filepath.Join(dir, "sha256", sum, name), nil
+}
+
+// download fetches rawurl to dest, verifying that its digest is sum.  The
+// binary is written to a temporary file and moved into place once verified,
+// so a partial or corrupt download is never left at dest.
+func (f *Fetcher) download(ctx context.Context, rawurl, sum, dest string) error {
+	client := f.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", rawurl, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error fetching plugin from %s: %s", rawurl, resp.Status)
+	}
+	return writeVerified(resp.Body, rawurl, sum, dest)
+}
+
+// writeVerified copies r to dest, checking that the SHA-256 of what was
+// copied is sum.  The source is only used to describe r in errors.
+func writeVerified(r io.Reader, source, sum, dest string) (err error) {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".download-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), r); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != sum {
+		return &DigestMismatchError{URL: source, Expected: sum, Actual: actual}
+	}
+	if err := tmp.Chmod(0755); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
+
+// parseDigest returns the lowercase hex SHA-256 from a digest of the form
+// "sha256:<hex>" or "<hex>".
+func parseDigest(digest string) (string, error) {
+	sum := strings.ToLower(strings.TrimPrefix(digest, "sha256:"))
+	if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+		return "", errors.New("invalid plugin digest " + digest + ", expected a hex encoded SHA-256")
+	}
+	return sum, nil
+}
+
+// fileDigest returns the hex SHA-256 of the file at path, or an empty string
+// if it can't be read.
+func fileDigest(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,139 @@
+package pie
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+)
+
+// newPluginServer returns a TLS server that serves data at any path, and a
+// counter of the requests it has served.
+func newPluginServer(t *testing.T, data []byte) (*httptest.Server, *int32) {
+	var hits int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestFetcherFetch(t *testing.T) {
+	data := []byte("#!/bin/sh\necho hi\n")
+	srv, hits := newPluginServer(t, data)
+	f := &Fetcher{CacheDir: t.TempDir(), Client: srv.Client()}
+	digest := "sha256:" + sha256Hex(data)
+
+	path, err := f.Fetch(context.Background(), srv.URL+"/plugins/foo", digest)
+	if err != nil {
+		t.Fatalf("Unexpected error from Fetch: %#v", err)
+	}
+	if filepath.Base(path) != "foo" {
+		t.Errorf("Expected cached plugin to be named foo, got %q", path)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(data) {
+		t.Errorf("Wrong cached plugin contents, expected %q, got %q", data, got)
+	}
+	if info, _ := os.Stat(path); runtime.GOOS != "windows" && info.Mode().Perm()&0111 == 0 {
+		t.Errorf("Cached plugin is not executable: %s", info.Mode())
+	}
+
+	again, err := f.Fetch(context.Background(), srv.URL+"/plugins/foo", digest)
+	if err != nil {
+		t.Fatalf("Unexpected error from cached Fetch: %#v", err)
+	}
+	if again != path {
+		t.Errorf("Expected cached path %q, got %q", path, again)
+	}
+	if n := atomic.LoadInt32(hits); n != 1 {
+		t.Errorf("Expected plugin to be downloaded once, got %d downloads", n)
+	}
+
+	// A corrupted cache entry is replaced.
+	if err := os.WriteFile(path, []byte("garbage"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Fetch(context.Background(), srv.URL+"/plugins/foo", digest); err != nil {
+		t.Fatalf("Unexpected error from Fetch: %#v", err)
+	}
+	if n := atomic.LoadInt32(hits); n != 2 {
+		t.Errorf("Expected corrupt cache entry to be downloaded again, got %d downloads", n)
+	}
+}
+
+func TestFetcherStartContext(t *testing.T) {
+	data := []byte("#!/bin/sh\necho hi\n")
+	srv, _ := newPluginServer(t, data)
+	f := &Fetcher{CacheDir: t.TempDir(), Client: srv.Client()}
+	digest := "sha256:" + sha256Hex(data)
+	if _, err := f.Fetch(context.Background(), srv.URL+"/plugins/foo", digest); err != nil {
+		t.Fatal(err)
+	}
+	// The plugin is cached, so only starting it can see that ctx is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := f.Start(ctx, os.Stderr, srv.URL+"/plugins/foo", digest, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestFetcherDigestMismatch(t *testing.T) {
+	srv, _ := newPluginServer(t, []byte("evil"))
+	f := &Fetcher{CacheDir: t.TempDir(), Client: srv.Client()}
+	expected := sha256Hex([]byte("good"))
+	_, err := f.Fetch(context.Background(), srv.URL+"/foo", expected)
+	var derr *DigestMismatchError
+	if !errors.As(err, &derr) {
+		t.Fatalf("Expected *DigestMismatchError, got %#v", err)
+	}
+	if derr.Expected != expected || derr.Actual != sha256Hex([]byte("evil")) {
+		t.Errorf("Wrong digests in error: %#v", derr)
+	}
+	entries, _ := os.ReadDir(filepath.Join(f.CacheDir, "sha256", expected))
+	if len(entries) != 0 {
+		t.Errorf("Expected nothing cached after a failed download, found %d files", len(entries))
+	}
+}
+
+func TestFetcherNamesUnnamedPlugins(t *testing.T) {
+	data := []byte("plugin")
+	srv, _ := newPluginServer(t, data)
+	f := &Fetcher{CacheDir: t.TempDir(), Client: srv.Client()}
+	dir := filepath.Join(f.CacheDir, "sha256", sha256Hex(data))
+	for _, p := range []string{"", "/", "/plugins/..", "/..", "/plugins/."} {
+		path, err := f.Fetch(context.Background(), srv.URL+p, sha256Hex(data))
+		if err != nil {
+			t.Fatalf("Unexpected error fetching %q: %#v", p, err)
+		}
+		if path != filepath.Join(dir, "plugin") {
+			t.Errorf("Expected plugin at %q to be cached as %q, got %q", p, filepath.Join(dir, "plugin"), path)
+		}
+	}
+}
+
+func TestFetcherRejectsBadInput(t *testing.T) {
+	f := &Fetcher{CacheDir: t.TempDir()}
+	if _, err := f.Fetch(context.Background(), "http://example.com/foo", sha256Hex(nil)); err == nil {
+		t.Error("Expected error fetching over plain http")
+	}
+	if _, err := f.Fetch(context.Background(), "https://example.com/foo", "sha256:1234"); err == nil {
+		t.Error("Expected error for a malformed digest")
+	}
+}
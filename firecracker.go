@@ -0,0 +1,434 @@
+package pie
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultFirecrackerPort is the vsock port the guest agent listens on unless
+// Firecracker.Port says otherwise.
+const defaultFirecrackerPort = 1024
+
+// defaultFirecrackerBootArgs are the kernel arguments used unless
+// Firecracker.BootArgs says otherwise.
+const defaultFirecrackerBootArgs = "console=ttyS0 reboot=k panic=1 pci=off"
+
+// Firecracker runs plugins inside Firecracker microVMs, giving hosts
+// hardware-level isolation for untrusted plugins.  Each plugin gets its own
+// VM, booted from Kernel and RootFS, with the plugin binary attached as a
+// second, read-only drive.  The root filesystem's init must call
+// RunFirecrackerGuest, which copies the plugin out of its drive, runs it, and
+// connects its Stdin and Stdout to the host over vsock, so that plugins run
+// unchanged.
+type Firecracker struct {
+	// Binary is the path to the firecracker executable.  It defaults to
+	// "firecracker", looked up in $PATH.
+	Binary string
+	// Kernel is the path to the guest kernel image.
+	Kernel string
+	// RootFS is the path to the guest's root filesystem image, which is
+	// attached read-only.
+	RootFS string
+	// BootArgs are the guest kernel's arguments.  They default to
+	// "console=ttyS0 reboot=k panic=1 pci=off".
+	BootArgs string
+	// VCPUs and MemoryMiB size the VM.  They default to 1 and 128.
+	VCPUs     int
+	MemoryMiB int
+	// Port is the vsock port the guest agent listens on.  It defaults to
+	// 1024.
+	Port uint32
+	// WorkDir is where the sockets and drive image of each VM are created,
+	// in a directory of their own that is removed when the plugin is closed.
+	// It defaults to the system's temporary directory.
+	WorkDir string
+	// Output receives the VM's console output, which includes the plugin's
+	// stderr.
+	Output io.Writer
+}
+
+// Start boots a VM running the plugin at path with the given args, and
+// returns a handle for it once the plugin answers a ping.  Cancelling ctx
+// abandons starting the VM, or shuts it down once it is running.  Closing the
+// handle shuts down the VM.  Options that concern the plugin process, such as
+// WithEnv, have no effect.
+func (f *Firecracker) Start(ctx context.Context, path string, args []string, opts ...StartOption) (_ *Plugin, err error) {
+	dir, err := os.MkdirTemp(f.WorkDir, "pie-firecracker-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+	image := filepath.Join(dir, "plugin.img")
+	size, err := writeDriveImage(path, image)
+	if err != nil {
+		return nil, err
+	}
+	apiSock := filepath.Join(dir, "api.sock")
+	vsockPath := filepath.Join(dir, "vsock.sock")
+
+	binary := f.Binary
+	if binary == "" {
+		binary = "firecracker"
+	}
+	cmd := exec.Command(binary, "--api-sock", apiSock)
+	cmd.Stdout = f.Output
+	cmd.Stderr = f.Output
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	stop := func() error {
+		cmd.Process.Kill()
+		<-exited
+		return os.RemoveAll(dir)
+	}
+	defer func() {
+		if err != nil {
+			stop()
+		}
+	}()
+
+	api := firecrackerAPI{sock: apiSock}
+	if err := api.configure(ctx, f.config(image, vsockPath, size, args), exited); err != nil {
+		return nil, err
+	}
+	conn, err := dialFirecrackerVsock(ctx, vsockPath, f.port(), exited)
+	if err != nil {
+		return nil, err
+	}
+	return NewPluginContext(ctx, &closeHook{ReadWriteCloser: conn, hook: stop}, opts...)
+}
+
+// config returns the API requests that configure and boot a VM.
+func (f *Firecracker) config(image, vsockPath string, size int64, args []string) []firecrackerRequest {
+	vcpus, mem := f.VCPUs, f.MemoryMiB
+	if vcpus <= 0 {
+		vcpus = 1
+	}
+	if mem <= 0 {
+		mem = 128
+	}
+	bootArgs := f.BootArgs
+	if bootArgs == "" {
+		bootArgs = defaultFirecrackerBootArgs
+	}
+	bootArgs += " " + guestArgs{Port: f.port(), Size: size, Args: args}.encode()
+	return []firecrackerRequest{
+		{"/machine-config", map[string]interface{}{"vcpu_count": vcpus, "mem_size_mib": mem}},
+		{"/boot-source", map[string]interface{}{"kernel_image_path": f.Kernel, "boot_args": bootArgs}},
+		{"/drives/rootfs", map[string]interface{}{"drive_id": "rootfs", "path_on_host": f.RootFS, "is_root_device": true, "is_read_only": true}},
+		{"/drives/plugin", map[string]interface{}{"drive_id": "plugin", "path_on_host": image, "is_root_device": false, "is_read_only": true}},
+		{"/vsock", map[string]interface{}{"guest_cid": 3, "uds_path": vsockPath}},
+		{"/actions", map[string]interface{}{"action_type": "InstanceStart"}},
+	}
+}
+
+// port returns the vsock port the guest agent listens on.
+func (f *Firecracker) port() uint32 {
+	if f.Port != 0 {
+		return f.Port
+	}
+	return defaultFirecrackerPort
+}
+
+// writeDriveImage copies the plugin binary at path into a drive image at
+// image, padded to a whole number of sectors, and returns the binary's size.
+func writeDriveImage(path, image string) (int64, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	dst, err := os.Create(image)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(dst, src)
+	if err == nil && n%512 != 0 {
+		_, err = dst.Write(make([]byte, 512-n%512))
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// firecrackerRequest is a PUT request to the Firecracker API.
+type firecrackerRequest struct {
+	path string
+	body interface{}
+}
+
+// firecrackerAPI is a client for the API Firecracker serves on a Unix socket.
+type firecrackerAPI struct {
+	sock string
+}
+
+// configure sends reqs to the API, waiting for Firecracker to start serving
+// it.  The socket appears before Firecracker listens on it, so configure waits
+// until a connection succeeds.  It gives up if ctx is done or exited is
+// closed.
+func (a firecrackerAPI) configure(ctx context.Context, reqs []firecrackerRequest, exited <-chan struct{}) error {
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", a.sock)
+		},
+	}}
+	defer client.CloseIdleConnections()
+	for {
+		if conn, err := net.Dial("unix", a.sock); err == nil {
+			conn.Close()
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-exited:
+			return errors.New("firecracker exited before serving its API")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	for _, r := range reqs {
+		if err := a.put(ctx, client, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// put sends r to the API.
+func (a firecrackerAPI) put(ctx context.Context, client *http.Client, r firecrackerRequest) error {
+	body, err := json.Marshal(r.body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, "http://localhost"+r.path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	var fault struct {
+		Message string `json:"fault_message"`
+	}
+	json.NewDecoder(resp.Body).Decode(&fault)
+	return fmt.Errorf("firecracker: PUT %s: %s: %s", r.path, resp.Status, fault.Message)
+}
+
+// dialFirecrackerVsock connects to the given vsock port of the guest through
+// the Unix socket Firecracker proxies vsock connections from, retrying until
+// the guest listens on the port, ctx is done, or exited is closed.
+func dialFirecrackerVsock(ctx context.Context, sock string, port uint32, exited <-chan struct{}) (net.Conn, error) {
+	for {
+		conn, err := connectFirecrackerVsock(ctx, sock, port)
+		if err == nil {
+			return conn, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("connecting to the guest: %w (last error: %v)", ctx.Err(), err)
+		case <-exited:
+			return nil, fmt.Errorf("firecracker exited before the guest listened: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// connectFirecrackerVsock makes one attempt at connecting to the guest's port,
+// using Firecracker's "CONNECT <port>" handshake.
+func connectFirecrackerVsock(ctx context.Context, sock string, port uint32) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", sock)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if _, err := fmt.Fprintf(conn, "CONNECT %d\n", port); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected vsock handshake reply %q", strings.TrimSpace(line))
+	}
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// bufferedConn is a net.Conn whose reads go through a bufio.Reader that may
+// already hold data read from the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read reads from the buffered reader.
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// closeHook is a ReadWriteCloser that calls hook after closing the
+// ReadWriteCloser it wraps.
+type closeHook struct {
+	io.ReadWriteCloser
+	hook func() error
+}
+
+// Close closes the wrapped ReadWriteCloser and calls the hook, returning both
+// of their errors.
+func (c *closeHook) Close() error {
+	return errors.Join(c.ReadWriteCloser.Close(), c.hook())
+}
+
+// guestArgs is what the host tells RunFirecrackerGuest on the guest kernel's
+// command line.
+type guestArgs struct {
+	Port  uint32
+	Size  int64
+	Args  []string
+	Drive string
+}
+
+// encode returns the kernel arguments that carry a.
+func (a guestArgs) encode() string {
+	args, _ := json.Marshal(a.Args)
+	s := fmt.Sprintf("pie.port=%d pie.size=%d pie.args=%s", a.Port, a.Size, base64.RawURLEncoding.EncodeToString(args))
+	if a.Drive != "" {
+		s += " pie.drive=" + a.Drive
+	}
+	return s
+}
+
+// parseGuestArgs parses the pie arguments from a kernel command line.
+func parseGuestArgs(cmdline string) (guestArgs, error) {
+	a := guestArgs{Port: defaultFirecrackerPort, Drive: "/dev/vdb"}
+	haveSize := false
+	for _, field := range strings.Fields(cmdline) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || !strings.HasPrefix(key, "pie.") {
+			continue
+		}
+		switch key {
+		case "pie.port":
+			port, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return a, fmt.Errorf("bad pie.port: %v", err)
+			}
+			a.Port = uint32(port)
+		case "pie.size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return a, fmt.Errorf("bad pie.size: %v", err)
+			}
+			a.Size, haveSize = size, true
+		case "pie.args":
+			data, err := base64.RawURLEncoding.DecodeString(value)
+			if err == nil {
+				err = json.Unmarshal(data, &a.Args)
+			}
+			if err != nil {
+				return a, fmt.Errorf("bad pie.args: %v", err)
+			}
+		case "pie.drive":
+			a.Drive = value
+		}
+	}
+	if !haveSize {
+		return a, errors.New("pie.size missing from the kernel command line")
+	}
+	return a, nil
+}
+
+// RunFirecrackerGuest is the guest side of Firecracker.  It is meant to be
+// called by the init of the guest's root filesystem: it copies the plugin
+// from its drive into dir, which must be writable (for example a tmpfs), waits
+// for the host to connect over vsock, and runs the plugin with its Stdin and
+// Stdout connected to the host and its stderr sent to the console.  It
+// returns when the plugin exits; an init that then exits makes the VM shut
+// down with the default boot arguments.
+func RunFirecrackerGuest(dir string) error {
+	cmdline, err := os.ReadFile("/proc/cmdline")
+	if err != nil {
+		return err
+	}
+	a, err := parseGuestArgs(string(cmdline))
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, "plugin")
+	if err := copyPlugin(a.Drive, path, a.Size); err != nil {
+		return err
+	}
+	l, err := ListenVsock(a.Port)
+	if err != nil {
+		return err
+	}
+	conn, err := l.Accept()
+	l.Close()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	cmd := exec.Command(path, a.Args...)
+	cmd.Stdin = conn
+	cmd.Stdout = conn
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// copyPlugin copies the first size bytes of the drive to an executable file
+// at path.
+func copyPlugin(drive, path string, size int64) error {
+	src, err := os.Open(drive)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(dst, src, size)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,192 @@
+package pie
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeFirecracker acts like firecracker started with the given args: it
+// serves the API on the --api-sock socket, and once the VM is started, answers
+// vsock connections to its Unix socket by serving api, as if the guest agent
+// were running the plugin.
+func fakeFirecracker(args []string) {
+	if len(args) != 2 || args[0] != "--api-sock" {
+		fmt.Fprintln(os.Stderr, "bad arguments:", args)
+		os.Exit(2)
+	}
+	l, err := net.Listen("unix", args[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	var mu sync.Mutex
+	var vsockPath string
+	http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/vsock":
+			vsockPath, _ = body["uds_path"].(string)
+		case "/actions":
+			vl, err := net.Listen("unix", vsockPath)
+			if err != nil {
+				http.Error(w, `{"fault_message": "no vsock"}`, http.StatusBadRequest)
+				return
+			}
+			go fakeGuest(vl)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+// fakeGuest answers connections to a Firecracker vsock socket, serving api.
+func fakeGuest(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			br := bufio.NewReader(conn)
+			if _, err := br.ReadString('\n'); err != nil {
+				conn.Close()
+				return
+			}
+			fmt.Fprintf(conn, "OK 1073741824\n")
+			s := NewProviderConn(&bufferedConn{Conn: conn, r: br})
+			s.RegisterName("api", api{})
+			s.Serve()
+		}()
+	}
+}
+
+func TestFirecrackerStart(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell script to stand in for firecracker")
+	}
+	dir := t.TempDir()
+	script := filepath.Join(dir, "firecracker")
+	content := fmt.Sprintf("#!/bin/sh\nexec %q %s \"$@\"\n", os.Args[0], helperFlag+"firecracker")
+	if err := os.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f := &Firecracker{Binary: script, Kernel: "vmlinux", RootFS: "rootfs.ext4", WorkDir: dir, Output: os.Stderr}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	p, err := f.Start(ctx, os.Args[0], []string{"arg"})
+	if err != nil {
+		t.Fatalf("Unexpected error from Start: %v", err)
+	}
+	var response string
+	if err := p.Call("api.SayHi", "bob", &response); err != nil {
+		t.Fatalf("Unexpected error from Call: %#v", err)
+	}
+	if response != "Hi bob" {
+		t.Errorf("Wrong response from api call, expected %q, got %q", "Hi bob", response)
+	}
+	p.Close()
+	select {
+	case <-p.Exited():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Plugin did not exit after Close")
+	}
+	entries, _ := filepath.Glob(filepath.Join(dir, "pie-firecracker-*"))
+	if len(entries) != 0 {
+		t.Errorf("VM directory not removed after Close: %v", entries)
+	}
+}
+
+func TestFirecrackerConfig(t *testing.T) {
+	f := &Firecracker{Kernel: "vmlinux", RootFS: "rootfs.ext4", MemoryMiB: 256}
+	reqs := f.config("plugin.img", "vsock.sock", 1000, []string{"a b"})
+	var paths []string
+	for _, r := range reqs {
+		paths = append(paths, r.path)
+	}
+	expected := []string{"/machine-config", "/boot-source", "/drives/rootfs", "/drives/plugin", "/vsock", "/actions"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Wrong API requests, expected %v, got %v", expected, paths)
+	}
+	machine := reqs[0].body.(map[string]interface{})
+	if machine["vcpu_count"] != 1 || machine["mem_size_mib"] != 256 {
+		t.Errorf("Wrong machine config: %v", machine)
+	}
+	bootArgs := reqs[1].body.(map[string]interface{})["boot_args"].(string)
+	if !strings.HasPrefix(bootArgs, defaultFirecrackerBootArgs+" ") {
+		t.Errorf("Boot args %q do not start with the defaults", bootArgs)
+	}
+	a, err := parseGuestArgs(bootArgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := guestArgs{Port: defaultFirecrackerPort, Size: 1000, Args: []string{"a b"}, Drive: "/dev/vdb"}
+	if !reflect.DeepEqual(a, want) {
+		t.Errorf("Wrong guest args, expected %+v, got %+v", want, a)
+	}
+}
+
+func TestParseGuestArgsMissingSize(t *testing.T) {
+	if _, err := parseGuestArgs("console=ttyS0 pie.port=5"); err == nil {
+		t.Error("Expected an error for a command line without pie.size")
+	}
+}
+
+func TestDriveImage(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "plugin")
+	data := bytes.Repeat([]byte("x"), 1000)
+	if err := os.WriteFile(src, data, 0755); err != nil {
+		t.Fatal(err)
+	}
+	image := filepath.Join(dir, "plugin.img")
+	size, err := writeDriveImage(src, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 1000 {
+		t.Errorf("Expected size 1000, got %d", size)
+	}
+	if info, err := os.Stat(image); err != nil || info.Size() != 1024 {
+		t.Errorf("Expected a 1024 byte image, got %v, %v", info.Size(), err)
+	}
+	dst := filepath.Join(dir, "copy")
+	if err := copyPlugin(image, dst, size); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(dst); !bytes.Equal(got, data) {
+		t.Error("Plugin copied out of the drive image differs from the original")
+	}
+}
+
+func TestFirecrackerAPIFault(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "api.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skipf("Cannot listen on a Unix socket: %v", err)
+	}
+	defer l.Close()
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"fault_message": "bad kernel"}`))
+	}))
+	api := firecrackerAPI{sock: sock}
+	err = api.configure(context.Background(), []firecrackerRequest{{"/boot-source", map[string]string{}}}, nil)
+	if err == nil || !strings.Contains(err.Error(), "bad kernel") {
+		t.Errorf("Expected the fault message in the error, got %v", err)
+	}
+}
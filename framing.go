@@ -0,0 +1,321 @@
+package pie
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A plugin shares its stdout with the RPC stream, so a single stray print in
+// plugin code corrupts the stream, and the host sees a baffling decoding error
+// such as "gob: unknown type id".  With framing, a provider writes each chunk
+// of the stream in a frame that starts with frameMagic and the chunk's length,
+// so that the host can tell the stream apart from anything else written to
+// stdout.
+
+// framingEnv is the environment variable through which the host asks a
+// provider to frame its output.  Its value is "1" for plain frames, and
+// "crc32" for checksummed frames in both directions.
+const framingEnv = "PIE_FRAMING"
+
+// frameMagic starts each frame.  It begins with ESC, which text output rarely
+// contains.
+var frameMagic = [4]byte{0x1b, 'P', 'I', 'E'}
+
+// frameHeaderLen is the length of a frame's header: the magic, then the
+// payload's length as a big endian uint32.
+const frameHeaderLen = len(frameMagic) + 4
+
+// maxStrayChunk is the most non-protocol data reported at a time.
+const maxStrayChunk = 4096
+
+// StrayOutputError is the error that ends the connection to a plugin started
+// with WithFraming(nil) when the plugin writes something other than the RPC
+// stream to its stdout.
+type StrayOutputError struct {
+	// Data is the start of what the plugin wrote.
+	Data []byte
+}
+
+// Error implements the error interface.
+func (e *StrayOutputError) Error() string {
+	return fmt.Sprintf("plugin wrote non-protocol data to stdout: %q", e.Data)
+}
+
+// WithFraming makes the plugin frame the RPC stream it writes to stdout, so
+// that anything else the plugin prints there, such as debugging output, is
+// detected instead of corrupting the stream.  If onStray is nil, stray output
+// ends the connection with a *StrayOutputError, which the calls in flight
+// fail with.  Otherwise stray output is skipped, and passed to onStray, which
+// might log it.  onStray is called from the goroutine reading replies, and
+// must not block or call the plugin.
+//
+// Framing requires a provider created with NewProvider by a version of this
+// package that supports it.
+func WithFraming(onStray func(data []byte)) StartOption {
+	return func(o *startOptions) {
+		o.framing = true
+		o.onStray = onStray
+	}
+}
+
+// framingValue returns the value of framingEnv that asks a provider for the
+// framing configured by o.
+func (o *startOptions) framingValue() string {
+	if o.checksums {
+		return "crc32"
+	}
+	return "1"
+}
+
+// framedStdout returns the writer a provider writes its RPC stream to: stdout,
+// framed if the host asked for plain framing.  Checksummed framing is applied
+// to both directions of the connection when the provider serves.
+func framedStdout(stdout io.WriteCloser) io.WriteCloser {
+	if providerGetenv(framingEnv) != "1" || providerGetenv(keepaliveEnv) != "" {
+		return stdout
+	}
+	return &frameWriter{w: stdout}
+}
+
+// frameWriter writes each Write as one frame.
+type frameWriter struct {
+	w io.WriteCloser
+	// checksum makes the writer write checksummed frames.
+	checksum bool
+	mu       sync.Mutex
+	// lastWrite is when the last frame was written, in Unix nanoseconds.
+	lastWrite int64
+}
+
+// Write writes p as a frame.
+func (f *frameWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := f.writeFrame(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeFrame writes a frame holding p, with a single write to the underlying
+// writer so that the frame is not split by other writes to it.  An empty frame
+// is a keepalive.
+func (f *frameWriter) writeFrame(p []byte) error {
+	magic, headerLen := frameMagic, frameHeaderLen
+	if f.checksum {
+		magic, headerLen = checksumMagic, checksumHeaderLen
+	}
+	buf := GetBuffer(headerLen + len(p))
+	defer PutBuffer(buf)
+	copy(buf, magic[:])
+	binary.BigEndian.PutUint32(buf[len(magic):], uint32(len(p)))
+	if f.checksum {
+		binary.BigEndian.PutUint32(buf[frameHeaderLen:], checksum(p))
+	}
+	copy(buf[headerLen:], p)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	atomic.StoreInt64(&f.lastWrite, time.Now().UnixNano())
+	_, err := f.w.Write(buf)
+	return err
+}
+
+// Close closes the underlying writer.
+func (f *frameWriter) Close() error {
+	return f.w.Close()
+}
+
+// frameReader reads the payloads of the frames written by a frameWriter,
+// skipping or failing on the data between frames.
+type frameReader struct {
+	r *bufio.Reader
+	// onStray is called with data found between frames.  If it is nil, such
+	// data is an error.
+	onStray func([]byte)
+	// onCorrupt, if not nil, is called when a corrupt frame is read.
+	onCorrupt func()
+	// remaining is the number of bytes left to read in the current frame.
+	remaining int
+	// buf holds the unread, verified payload of a checksummed frame, and
+	// pooled is the pooled buffer it was read into, which is given back once
+	// buf has been read.
+	buf    []byte
+	pooled []byte
+	err    error
+	// lastRead is when data was last read, in Unix nanoseconds, and dead is
+	// set when the peer has been declared dead.
+	lastRead int64
+	dead     int32
+}
+
+// framing configures a framedConn.
+type framing struct {
+	// onStray is passed stray data read between frames.
+	onStray func([]byte)
+	// writes makes the connection frame its writes, and checksums makes both
+	// directions use checksummed frames.
+	writes    bool
+	checksums bool
+	// keepalive is how often to send a keepalive frame when nothing else has
+	// been sent, and deadPeer how long to wait for data before declaring the
+	// peer dead.
+	keepalive time.Duration
+	deadPeer  time.Duration
+}
+
+// framedConn is a connection whose reads are unframed by a frameReader, and
+// whose writes, if it has a frameWriter, are framed.
+type framedConn struct {
+	io.ReadWriteCloser
+	fr *frameReader
+	fw *frameWriter
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// newFramedConn returns rwc with its reads unframed, and its writes framed as
+// configured by f.
+func newFramedConn(rwc io.ReadWriteCloser, f framing) *framedConn {
+	c := &framedConn{
+		ReadWriteCloser: rwc,
+		fr:              &frameReader{r: bufio.NewReader(rwc), onStray: f.onStray, lastRead: time.Now().UnixNano()},
+		stop:            make(chan struct{}),
+	}
+	if f.writes || f.checksums {
+		c.fw = &frameWriter{w: rwc, checksum: f.checksums, lastWrite: time.Now().UnixNano()}
+		if f.keepalive > 0 {
+			go c.sendKeepalives(f.keepalive)
+		}
+	}
+	if f.deadPeer > 0 {
+		go c.watchPeer(f.deadPeer)
+	}
+	return c
+}
+
+// Read reads the payloads of the frames read from the connection.
+func (c *framedConn) Read(p []byte) (int, error) {
+	return c.fr.Read(p)
+}
+
+// Write writes p to the connection, framed if the connection frames writes.
+func (c *framedConn) Write(p []byte) (int, error) {
+	if c.fw == nil {
+		return c.ReadWriteCloser.Write(p)
+	}
+	return c.fw.Write(p)
+}
+
+// Close stops the connection's keepalives and closes it.
+func (c *framedConn) Close() error {
+	c.stopOnce.Do(func() { close(c.stop) })
+	return c.ReadWriteCloser.Close()
+}
+
+// Read reads from the current frame, finding the next one if the current one
+// has been read.
+func (f *frameReader) Read(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	for f.remaining == 0 && len(f.buf) == 0 {
+		if err := f.next(); err != nil {
+			if atomic.LoadInt32(&f.dead) != 0 {
+				err = ErrDeadPeer
+			}
+			f.err = err
+			if _, ok := err.(*CorruptFrameError); ok && f.onCorrupt != nil {
+				f.onCorrupt()
+			}
+			return 0, err
+		}
+	}
+	if len(f.buf) > 0 {
+		n := copy(p, f.buf)
+		f.buf = f.buf[n:]
+		if len(f.buf) == 0 && f.pooled != nil {
+			PutBuffer(f.pooled)
+			f.pooled = nil
+		}
+		return n, nil
+	}
+	if len(p) > f.remaining {
+		p = p[:f.remaining]
+	}
+	n, err := f.r.Read(p)
+	f.remaining -= n
+	if n > 0 {
+		atomic.StoreInt64(&f.lastRead, time.Now().UnixNano())
+	}
+	if err == io.EOF && f.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		if atomic.LoadInt32(&f.dead) != 0 {
+			err = ErrDeadPeer
+		}
+		f.err = err
+	}
+	return n, err
+}
+
+// next reads the next frame's header, dealing with any stray data before it.
+func (f *frameReader) next() error {
+	head, err := f.r.Peek(frameHeaderLen)
+	if len(head) == 0 {
+		return err
+	}
+	atomic.StoreInt64(&f.lastRead, time.Now().UnixNano())
+	if bytes.HasPrefix(head, checksumMagic[:]) {
+		return f.nextChecksummed()
+	}
+	if !bytes.HasPrefix(head, frameMagic[:]) {
+		stray := f.stray()
+		if f.onStray == nil {
+			return &StrayOutputError{Data: stray}
+		}
+		f.onStray(stray)
+		return nil
+	}
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	f.remaining = int(binary.BigEndian.Uint32(head[len(frameMagic):]))
+	_, err = f.r.Discard(frameHeaderLen)
+	return err
+}
+
+// stray reads the data up to what might be the start of the next frame,
+// without waiting for more data than has arrived.
+func (f *frameReader) stray() []byte {
+	var stray []byte
+	for len(stray) < maxStrayChunk {
+		b, err := f.r.ReadByte()
+		if err != nil {
+			break
+		}
+		stray = append(stray, b)
+		n := f.r.Buffered()
+		if n == 0 {
+			break
+		}
+		if n > len(frameMagic) {
+			n = len(frameMagic)
+		}
+		if next, _ := f.r.Peek(n); bytes.HasPrefix(frameMagic[:], next) || bytes.HasPrefix(checksumMagic[:], next) {
+			break
+		}
+	}
+	return stray
+}
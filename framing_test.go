@@ -0,0 +1,96 @@
+package pie
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestFrameReaderSkipsStrayData(t *testing.T) {
+	var stream bytes.Buffer
+	w := &frameWriter{w: nopWriteCloser{&stream}}
+	w.Write([]byte("hello "))
+	stream.WriteString("debug output\n")
+	w.Write([]byte("world"))
+	stream.WriteString("\x1bnot a frame")
+
+	var stray [][]byte
+	r := &frameReader{r: bufio.NewReader(&stream), onStray: func(b []byte) { stray = append(stray, b) }}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello world" {
+		t.Fatalf("expected payloads %q, got %q", "hello world", got)
+	}
+	if len(stray) != 2 || string(stray[0]) != "debug output\n" || string(stray[1]) != "\x1bnot a frame" {
+		t.Fatalf("unexpected stray data %q", stray)
+	}
+}
+
+func TestFrameReaderStrayError(t *testing.T) {
+	var stream bytes.Buffer
+	stream.WriteString("Hello world\n")
+	(&frameWriter{w: nopWriteCloser{&stream}}).Write([]byte("payload"))
+
+	r := &frameReader{r: bufio.NewReader(&stream)}
+	_, err := io.ReadAll(r)
+	var serr *StrayOutputError
+	if !errors.As(err, &serr) {
+		t.Fatalf("expected *StrayOutputError, got %v", err)
+	}
+	want := `plugin wrote non-protocol data to stdout: "Hello world\n"`
+	if err.Error() != want {
+		t.Fatalf("expected %q, got %q", want, err.Error())
+	}
+}
+
+func TestFrameReaderTruncatedFrame(t *testing.T) {
+	var stream bytes.Buffer
+	(&frameWriter{w: nopWriteCloser{&stream}}).Write([]byte("payload"))
+	stream.Truncate(stream.Len() - 2)
+	_, err := io.ReadAll(&frameReader{r: bufio.NewReader(&stream)})
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestFramingSkipsStrayPrints(t *testing.T) {
+	stray := make(chan string, 10)
+	p, err := StartPlugin(os.Stderr, os.Args[0], helperArgs("provider"), WithFraming(func(b []byte) {
+		stray <- string(b)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if err := p.Call("helper.PrintRaw", "Hello world\n", new(int)); err != nil {
+		t.Fatal(err)
+	}
+	var reply string
+	if err := p.Call("api.SayHi", "bob", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "Hi bob" {
+		t.Fatalf("expected %q, got %q", "Hi bob", reply)
+	}
+	if got := <-stray; got != "Hello world\n" {
+		t.Fatalf("expected stray print to be reported, got %q", got)
+	}
+}
+
+func TestFramingReportsStrayPrints(t *testing.T) {
+	p, err := StartPlugin(os.Stderr, os.Args[0], helperArgs("provider"), WithFraming(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	err = p.Call("helper.PrintRaw", "Hello world\n", new(int))
+	var serr *StrayOutputError
+	if !errors.As(err, &serr) || string(serr.Data) != "Hello world\n" {
+		t.Fatalf("expected stray output error, got %v", err)
+	}
+}
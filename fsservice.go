@@ -0,0 +1,424 @@
+package pie
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FSOptions controls what an FSService lets plugins do.
+type FSOptions struct {
+	// Allow lists the path.Match patterns of the names plugins may access.  A
+	// name is allowed if it or one of the directories containing it matches a
+	// pattern, so "data" allows everything under the data directory.  If
+	// Allow is empty, every name is allowed.
+	Allow []string
+	// Writable lets plugins create, write, and remove files.  It only has an
+	// effect if the service's file system is a WritableFS, such as one
+	// returned by DirFS.
+	Writable bool
+}
+
+// WritableFS is a file system that FSService can write to when its options make
+// it writable.
+type WritableFS interface {
+	fs.FS
+	// WriteFile writes data to the named file, creating it with permissions
+	// perm if necessary.
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+	// Mkdir creates the named directory with permissions perm.
+	Mkdir(name string, perm fs.FileMode) error
+	// Remove removes the named file or empty directory.
+	Remove(name string) error
+}
+
+// DirFS returns a WritableFS for the tree of files rooted at dir.  Like
+// os.DirFS, it only accepts names that are valid according to fs.ValidPath, so
+// that names cannot refer to files outside dir, but it does not prevent
+// symbolic links inside dir from pointing elsewhere.
+func DirFS(dir string) WritableFS {
+	return dirFS(dir)
+}
+
+type dirFS string
+
+// Open opens the named file for reading.
+func (d dirFS) Open(name string) (fs.File, error) {
+	return os.DirFS(string(d)).Open(name)
+}
+
+// WriteFile writes data to the named file.
+func (d dirFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	p, err := d.join("write", name)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p, data, perm)
+}
+
+// Mkdir creates the named directory.
+func (d dirFS) Mkdir(name string, perm fs.FileMode) error {
+	p, err := d.join("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(p, perm)
+}
+
+// Remove removes the named file or empty directory.
+func (d dirFS) Remove(name string) error {
+	p, err := d.join("remove", name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+// join returns the OS path of name under d.
+func (d dirFS) join(op, name string) (string, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return filepath.Join(string(d), filepath.FromSlash(name)), nil
+}
+
+// FSService serves a file system to plugins.  A host shares files with a
+// consumer-style plugin by registering an FSService with the plugin's Server,
+// and the plugin reads them through the fs.FS returned by NewFSClient:
+//
+//	s.RegisterName("FS", pie.NewFSService(pie.DirFS(dir), pie.FSOptions{Allow: []string{"assets"}}))
+//
+// Names are slash-separated paths relative to the root of the file system, as
+// used by package io/fs.  Names that are not allowed by the service's options
+// fail with fs.ErrPermission.
+type FSService struct {
+	fsys fs.FS
+	opts FSOptions
+}
+
+// NewFSService returns a service that gives plugins the access to fsys allowed
+// by opts.
+func NewFSService(fsys fs.FS, opts FSOptions) *FSService {
+	return &FSService{fsys: fsys, opts: opts}
+}
+
+// FSFileInfo describes a file served by an FSService.
+type FSFileInfo struct {
+	Name    string
+	Size    int64
+	Mode    fs.FileMode
+	ModTime time.Time
+}
+
+// FSWrite is the argument of the FSService's methods that change the file
+// system.
+type FSWrite struct {
+	Name string
+	Data []byte
+	Perm fs.FileMode
+}
+
+// check returns an error if the name may not be accessed by op.
+func (s *FSService) check(op, name string, write bool) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if write && !s.opts.Writable {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+	}
+	if len(s.opts.Allow) == 0 {
+		return nil
+	}
+	for p := name; ; p = path.Dir(p) {
+		for _, pattern := range s.opts.Allow {
+			if ok, _ := path.Match(pattern, p); ok {
+				return nil
+			}
+		}
+		if p == "." {
+			return &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+		}
+	}
+}
+
+// writable returns the service's file system if it can be written to.
+func (s *FSService) writable(op, name string) (WritableFS, error) {
+	if err := s.check(op, name, true); err != nil {
+		return nil, err
+	}
+	w, ok := s.fsys.(WritableFS)
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+	}
+	return w, nil
+}
+
+// ReadFile returns the contents of the named file.
+func (s *FSService) ReadFile(name string, data *[]byte) error {
+	if err := s.check("open", name, false); err != nil {
+		return err
+	}
+	b, err := fs.ReadFile(s.fsys, name)
+	if err != nil {
+		return fsError("open", name, err)
+	}
+	*data = b
+	return nil
+}
+
+// Stat describes the named file.
+func (s *FSService) Stat(name string, info *FSFileInfo) error {
+	if err := s.check("stat", name, false); err != nil {
+		return err
+	}
+	fi, err := fs.Stat(s.fsys, name)
+	if err != nil {
+		return fsError("stat", name, err)
+	}
+	*info = fileInfo(fi)
+	return nil
+}
+
+// ReadDir describes the entries of the named directory, sorted by name.
+func (s *FSService) ReadDir(name string, infos *[]FSFileInfo) error {
+	if err := s.check("readdir", name, false); err != nil {
+		return err
+	}
+	entries, err := fs.ReadDir(s.fsys, name)
+	if err != nil {
+		return fsError("readdir", name, err)
+	}
+	list := make([]FSFileInfo, 0, len(entries))
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			return fsError("readdir", name, err)
+		}
+		list = append(list, fileInfo(fi))
+	}
+	*infos = list
+	return nil
+}
+
+// WriteFile writes args.Data to the file named args.Name, creating it with
+// permissions args.Perm if necessary.
+func (s *FSService) WriteFile(args FSWrite, _ *int) error {
+	w, err := s.writable("write", args.Name)
+	if err != nil {
+		return err
+	}
+	return fsError("write", args.Name, w.WriteFile(args.Name, args.Data, args.Perm))
+}
+
+// Mkdir creates the directory named args.Name with permissions args.Perm.
+func (s *FSService) Mkdir(args FSWrite, _ *int) error {
+	w, err := s.writable("mkdir", args.Name)
+	if err != nil {
+		return err
+	}
+	return fsError("mkdir", args.Name, w.Mkdir(args.Name, args.Perm))
+}
+
+// Remove removes the named file or empty directory.
+func (s *FSService) Remove(name string, _ *int) error {
+	w, err := s.writable("remove", name)
+	if err != nil {
+		return err
+	}
+	return fsError("remove", name, w.Remove(name))
+}
+
+func fileInfo(fi fs.FileInfo) FSFileInfo {
+	return FSFileInfo{Name: fi.Name(), Size: fi.Size(), Mode: fi.Mode(), ModTime: fi.ModTime()}
+}
+
+// fsErrors are the errors reported to plugins in a form they can recognize.
+var fsErrors = []error{fs.ErrNotExist, fs.ErrExist, fs.ErrPermission, fs.ErrInvalid}
+
+// fsError returns err in a form that names the file by its name in the service,
+// rather than by a host path, and that the client can turn back into an error
+// matching the fs package's errors.
+func fsError(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, target := range fsErrors {
+		if errors.Is(err, target) {
+			return &fs.PathError{Op: op, Path: name, Err: target}
+		}
+	}
+	return &fs.PathError{Op: op, Path: name, Err: errors.New("operation failed")}
+}
+
+// FSClient is the plugin side of an FSService.  It implements fs.FS,
+// fs.ReadFileFS, fs.ReadDirFS, and fs.StatFS, and can write to services that
+// allow it.  Open reads whole files from the host, so it is not suited to
+// very large files.
+type FSClient struct {
+	c       Caller
+	service string
+}
+
+// NewFSClient returns a client for the FSService registered under the name
+// service, which it calls through c, usually the client returned by
+// NewConsumer.
+func NewFSClient(c Caller, service string) *FSClient {
+	return &FSClient{c: c, service: service}
+}
+
+// call calls a method of the service, turning errors the service reports for
+// files back into errors matching the fs package's errors.
+func (f *FSClient) call(method, op, name string, args, reply interface{}) error {
+	err := f.c.Call(f.service+"."+method, args, reply)
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	for _, target := range fsErrors {
+		if strings.HasSuffix(msg, ": "+target.Error()) {
+			return &fs.PathError{Op: op, Path: name, Err: target}
+		}
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// Open opens the named file, reading the whole file from the host.
+func (f *FSClient) Open(name string) (fs.File, error) {
+	info, err := f.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+	file := &fsClientFile{info: info}
+	if info.IsDir() {
+		file.entries, err = f.ReadDir(name)
+	} else {
+		var data []byte
+		data, err = f.ReadFile(name)
+		file.r = bytes.NewReader(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// ReadFile returns the contents of the named file.
+func (f *FSClient) ReadFile(name string) ([]byte, error) {
+	var data []byte
+	err := f.call("ReadFile", "open", name, name, &data)
+	return data, err
+}
+
+// Stat describes the named file.
+func (f *FSClient) Stat(name string) (fs.FileInfo, error) {
+	return f.stat("stat", name)
+}
+
+func (f *FSClient) stat(op, name string) (fsClientInfo, error) {
+	var info FSFileInfo
+	err := f.call("Stat", op, name, name, &info)
+	return fsClientInfo{info}, err
+}
+
+// ReadDir returns the entries of the named directory, sorted by name.
+func (f *FSClient) ReadDir(name string) ([]fs.DirEntry, error) {
+	var infos []FSFileInfo
+	if err := f.call("ReadDir", "readdir", name, name, &infos); err != nil {
+		return nil, err
+	}
+	entries := make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = fsClientInfo{info}
+	}
+	return entries, nil
+}
+
+// WriteFile writes data to the named file, creating it with permissions perm
+// if necessary.
+func (f *FSClient) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return f.call("WriteFile", "write", name, FSWrite{Name: name, Data: data, Perm: perm}, new(int))
+}
+
+// Mkdir creates the named directory with permissions perm.
+func (f *FSClient) Mkdir(name string, perm fs.FileMode) error {
+	return f.call("Mkdir", "mkdir", name, FSWrite{Name: name, Perm: perm}, new(int))
+}
+
+// Remove removes the named file or empty directory.
+func (f *FSClient) Remove(name string) error {
+	return f.call("Remove", "remove", name, name, new(int))
+}
+
+// fsClientInfo describes a file read through an FSClient.
+type fsClientInfo struct {
+	i FSFileInfo
+}
+
+func (fi fsClientInfo) Name() string               { return fi.i.Name }
+func (fi fsClientInfo) Size() int64                { return fi.i.Size }
+func (fi fsClientInfo) Mode() fs.FileMode          { return fi.i.Mode }
+func (fi fsClientInfo) ModTime() time.Time         { return fi.i.ModTime }
+func (fi fsClientInfo) IsDir() bool                { return fi.i.Mode.IsDir() }
+func (fi fsClientInfo) Sys() interface{}           { return nil }
+func (fi fsClientInfo) Type() fs.FileMode          { return fi.i.Mode.Type() }
+func (fi fsClientInfo) Info() (fs.FileInfo, error) { return fi, nil }
+
+// fsClientFile is a file opened by an FSClient.
+type fsClientFile struct {
+	info    fsClientInfo
+	r       *bytes.Reader
+	entries []fs.DirEntry
+	closed  bool
+}
+
+func (f *fsClientFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *fsClientFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.info.Name(), Err: fs.ErrClosed}
+	}
+	if f.r == nil {
+		return 0, &fs.PathError{Op: "read", Path: f.info.Name(), Err: errors.New("is a directory")}
+	}
+	return f.r.Read(p)
+}
+
+// ReadDir returns the next n entries of a directory, as fs.ReadDirFile does.
+func (f *fsClientFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if f.closed {
+		return nil, &fs.PathError{Op: "readdir", Path: f.info.Name(), Err: fs.ErrClosed}
+	}
+	if f.r != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: f.info.Name(), Err: errors.New("not a directory")}
+	}
+	if n <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(f.entries) {
+		n = len(f.entries)
+	}
+	entries := f.entries[:n]
+	f.entries = f.entries[n:]
+	return entries, nil
+}
+
+func (f *fsClientFile) Close() error {
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.info.Name(), Err: fs.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
@@ -0,0 +1,98 @@
+package pie
+
+import (
+	"errors"
+	"io/fs"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+// fsClient returns a client for an FSService serving fsys with opts.
+func fsClient(t *testing.T, fsys fs.FS, opts FSOptions) *FSClient {
+	s := Server{server: rpc.NewServer(), d: &dispatcher{}}
+	if err := s.RegisterName("FS", NewFSService(fsys, opts)); err != nil {
+		t.Fatal(err)
+	}
+	return NewFSClient(servePipe(t, s, nil, nil), "FS")
+}
+
+func testFiles() fstest.MapFS {
+	return fstest.MapFS{
+		"a.txt":          {Data: []byte("hello")},
+		"data/b.txt":     {Data: []byte("world")},
+		"data/sub/c.txt": {Data: []byte("!")},
+		"secret/key":     {Data: []byte("hunter2")},
+	}
+}
+
+func TestFSClient(t *testing.T) {
+	c := fsClient(t, testFiles(), FSOptions{})
+	if err := fstest.TestFS(c, "a.txt", "data/b.txt", "data/sub/c.txt", "secret/key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ReadFile("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected fs.ErrNotExist, got %v", err)
+	}
+	if _, err := c.Open("../a.txt"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("Expected fs.ErrInvalid, got %v", err)
+	}
+}
+
+func TestFSClientAllow(t *testing.T) {
+	c := fsClient(t, testFiles(), FSOptions{Allow: []string{"data", "*.txt"}})
+	for _, name := range []string{"a.txt", "data/b.txt", "data/sub/c.txt"} {
+		if _, err := c.ReadFile(name); err != nil {
+			t.Errorf("Reading %s: %v", name, err)
+		}
+	}
+	for _, name := range []string{"secret/key", "secret", "."} {
+		if _, err := c.Stat(name); !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("Expected fs.ErrPermission for %s, got %v", name, err)
+		}
+	}
+}
+
+func TestFSClientReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	c := fsClient(t, DirFS(dir), FSOptions{})
+	if err := c.WriteFile("x", []byte("x"), 0o644); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("Expected fs.ErrPermission, got %v", err)
+	}
+	c = fsClient(t, testFiles(), FSOptions{Writable: true})
+	if err := c.WriteFile("x", []byte("x"), 0o644); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("Expected fs.ErrPermission writing to an fs.FS, got %v", err)
+	}
+}
+
+func TestFSClientWrite(t *testing.T) {
+	dir := t.TempDir()
+	c := fsClient(t, DirFS(dir), FSOptions{Writable: true, Allow: []string{"out"}})
+	if err := c.Mkdir("out", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteFile("out/result", []byte("done"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "out", "result"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "done" {
+		t.Errorf("Expected %q written, got %q", "done", b)
+	}
+	if err := c.Mkdir("out", 0o755); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Expected fs.ErrExist, got %v", err)
+	}
+	if err := c.WriteFile("elsewhere", []byte("x"), 0o644); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("Expected fs.ErrPermission, got %v", err)
+	}
+	if err := c.Remove("out/result"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Stat("out/result"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected fs.ErrNotExist after removing, got %v", err)
+	}
+}
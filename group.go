@@ -0,0 +1,222 @@
+package pie
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrGroupFinished is returned by the methods of a CallGroup that has already
+// been committed or aborted.
+var ErrGroupFinished = errors.New("call group already committed or aborted")
+
+// GroupHooks are called by a provider as call groups begin and finish, with the
+// group's ID, so that the provider can make the calls in a group atomic: for
+// example, by starting a transaction in Begin, using it in the calls that
+// GroupID reports are part of the group, and committing or rolling it back in
+// Commit or Abort.  Any of the hooks may be nil.
+type GroupHooks struct {
+	// Begin is called when the host opens a group.  If it returns an error,
+	// the group is not opened and the error is returned to the host.
+	Begin func(id string) error
+	// Commit is called when the host commits a group.  Its error is returned
+	// to the host; the group is finished either way.
+	Commit func(id string) error
+	// Abort is called when the host aborts a group, and for each group left
+	// open when the host disconnects.
+	Abort func(id string) error
+}
+
+// SetGroupHooks sets the hooks the provider calls as call groups begin and
+// finish.  It must be called before Serve.  Providers without hooks still
+// accept call groups, which lets their methods use GroupID.
+func (s Server) SetGroupHooks(h GroupHooks) error {
+	if s.ctl == nil {
+		return errors.New("only providers can serve call groups")
+	}
+	s.d.groupMu.Lock()
+	defer s.d.groupMu.Unlock()
+	s.d.hooks = h
+	return nil
+}
+
+// groupKey is the context key of the ID of the call group a method is called
+// in.
+type groupKey struct{}
+
+// GroupID returns the ID of the call group that the method given ctx was
+// called as part of, or an empty string if it was not called in a group.  Only
+// methods that take a context.Context can tell which group they are in.
+func GroupID(ctx context.Context) string {
+	id, _ := ctx.Value(groupKey{}).(string)
+	return id
+}
+
+// groupOpen reports whether the call group with the given ID is open.
+func (d *dispatcher) groupOpen(id string) bool {
+	d.groupMu.Lock()
+	defer d.groupMu.Unlock()
+	return d.groups[id]
+}
+
+// beginGroup opens a call group.  The Begin hook is called without holding
+// d.groupMu, which dispatching takes, so that a slow hook, or one that calls
+// back into the provider, does not hold up other calls; the group is kept in
+// d.groups, but not open, until the hook returns.  If the host disconnected
+// while the hook ran, the group is aborted instead of opened.
+func (d *dispatcher) beginGroup(id string) error {
+	d.groupMu.Lock()
+	if _, taken := d.groups[id]; id == "" || taken {
+		d.groupMu.Unlock()
+		return fmt.Errorf("pie: invalid call group ID %q", id)
+	}
+	if d.groups == nil {
+		d.groups = map[string]bool{}
+	}
+	d.groups[id] = false
+	hook := d.hooks.Begin
+	d.groupMu.Unlock()
+	var err error
+	if hook != nil {
+		err = hook(id)
+	}
+	d.groupMu.Lock()
+	if err != nil {
+		delete(d.groups, id)
+		d.groupMu.Unlock()
+		return err
+	}
+	d.groups[id] = true
+	disconnected := d.disconnected
+	d.groupMu.Unlock()
+	if disconnected {
+		d.finishGroup(id, false)
+		return errors.New("pie: host disconnected while the call group began")
+	}
+	return nil
+}
+
+// finishGroup closes a call group, calling the Commit hook if commit is true
+// and the Abort hook otherwise.
+func (d *dispatcher) finishGroup(id string, commit bool) error {
+	d.groupMu.Lock()
+	if !d.groups[id] {
+		d.groupMu.Unlock()
+		return fmt.Errorf("pie: call group %s is not open", id)
+	}
+	delete(d.groups, id)
+	hook := d.hooks.Abort
+	if commit {
+		hook = d.hooks.Commit
+	}
+	d.groupMu.Unlock()
+	if hook == nil {
+		return nil
+	}
+	return hook(id)
+}
+
+// abortGroups aborts every open call group, and makes those whose Begin hook
+// is still running abort when it returns.
+func (d *dispatcher) abortGroups() {
+	d.groupMu.Lock()
+	d.disconnected = true
+	var open []string
+	for id, isOpen := range d.groups {
+		if isOpen {
+			open = append(open, id)
+		}
+	}
+	d.groupMu.Unlock()
+	for _, id := range open {
+		d.finishGroup(id, false)
+	}
+}
+
+// BeginGroup opens the call group with the given ID.
+func (c *control) BeginGroup(id string, _ *int) error {
+	return c.d.beginGroup(id)
+}
+
+// CommitGroup commits the call group with the given ID.
+func (c *control) CommitGroup(id string, _ *int) error {
+	return c.d.finishGroup(id, true)
+}
+
+// AbortGroup aborts the call group with the given ID.
+func (c *control) AbortGroup(id string, _ *int) error {
+	return c.d.finishGroup(id, false)
+}
+
+// CallGroup is a set of calls to a plugin that the host commits or aborts as a
+// whole.  The plugin's GroupHooks are told when the group begins and
+// finishes, and its methods can find out which group a call is part of with
+// GroupID, so the plugin can make the calls atomic or undo them cleanly.  If
+// the host disconnects before finishing a group, the plugin aborts it.
+type CallGroup struct {
+	p  *Plugin
+	id string
+
+	mu   sync.Mutex
+	done bool
+}
+
+// BeginGroup opens a new call group on the plugin.  Call groups require a
+// provider created with NewProvider.
+func (p *Plugin) BeginGroup() (*CallGroup, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	g := &CallGroup{p: p, id: hex.EncodeToString(b)}
+	if err := p.controlClient().Call(controlService+".BeginGroup", g.id, new(int)); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// ID returns the group's ID, which is what GroupID returns in the plugin.
+func (g *CallGroup) ID() string {
+	return g.id
+}
+
+// Call invokes the named function on the plugin as part of the group.
+func (g *CallGroup) Call(serviceMethod string, args interface{}, reply interface{}) error {
+	if g.finished() {
+		return ErrGroupFinished
+	}
+	return g.p.call(serviceMethod, callMeta{group: g.id}, args, reply)
+}
+
+// Commit finishes the group, asking the plugin to commit the calls made in it.
+// Calls in the group must have returned before Commit is called.
+func (g *CallGroup) Commit() error {
+	return g.finish(controlService + ".CommitGroup")
+}
+
+// Abort finishes the group, asking the plugin to undo the calls made in it.
+func (g *CallGroup) Abort() error {
+	return g.finish(controlService + ".AbortGroup")
+}
+
+// finish marks the group finished and calls the given control method.
+func (g *CallGroup) finish(serviceMethod string) error {
+	g.mu.Lock()
+	if g.done {
+		g.mu.Unlock()
+		return ErrGroupFinished
+	}
+	g.done = true
+	g.mu.Unlock()
+	return g.p.controlClient().Call(serviceMethod, g.id, new(int))
+}
+
+// finished reports whether the group has been committed or aborted.
+func (g *CallGroup) finished() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.done
+}
@@ -0,0 +1,213 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// groupAPI records the group each of its calls was made in.
+type groupAPI struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (g *groupAPI) Put(ctx context.Context, s string, _ *int) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.calls = append(g.calls, GroupID(ctx)+":"+s)
+	return nil
+}
+
+// hookLog records the group hooks that were called.
+type hookLog chan string
+
+func (h hookLog) hooks() GroupHooks {
+	return GroupHooks{
+		Begin:  func(id string) error { h <- "begin " + id; return nil },
+		Commit: func(id string) error { h <- "commit " + id; return nil },
+		Abort:  func(id string) error { h <- "abort " + id; return nil },
+	}
+}
+
+// groupProvider returns a handle to a provider serving groupAPI with hooks
+// that log to the returned hookLog.
+func groupProvider(t *testing.T) (*Plugin, *groupAPI, hookLog) {
+	s := NewProvider()
+	api := &groupAPI{}
+	if err := s.RegisterName("api", api); err != nil {
+		t.Fatal(err)
+	}
+	log := make(hookLog, 10)
+	if err := s.SetGroupHooks(log.hooks()); err != nil {
+		t.Fatal(err)
+	}
+	return pipePlugin(t, s), api, log
+}
+
+// waitHook waits for the hook log to record s.
+func waitHook(t *testing.T, log hookLog, s string) {
+	t.Helper()
+	select {
+	case got := <-log:
+		if got != s {
+			t.Errorf("Wrong hook, expected %q, got %q", s, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for hook %q", s)
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	p, api, log := groupProvider(t)
+	g, err := p.BeginGroup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitHook(t, log, "begin "+g.ID())
+	for _, s := range []string{"a", "b"} {
+		if err := g.Call("api.Put", s, new(int)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Call("api.Put", "c", new(int)); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	waitHook(t, log, "commit "+g.ID())
+
+	expected := g.ID() + ":a " + g.ID() + ":b :c"
+	if got := strings.Join(api.calls, " "); got != expected {
+		t.Errorf("Wrong calls, expected %q, got %q", expected, got)
+	}
+	if err := g.Call("api.Put", "d", new(int)); err != ErrGroupFinished {
+		t.Errorf("Expected ErrGroupFinished from Call after Commit, got %v", err)
+	}
+	if err := g.Abort(); err != ErrGroupFinished {
+		t.Errorf("Expected ErrGroupFinished from Abort after Commit, got %v", err)
+	}
+}
+
+func TestGroupAbort(t *testing.T) {
+	p, _, log := groupProvider(t)
+	g, err := p.BeginGroup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitHook(t, log, "begin "+g.ID())
+	if err := g.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	waitHook(t, log, "abort "+g.ID())
+}
+
+func TestGroupAbortOnDisconnect(t *testing.T) {
+	p, _, log := groupProvider(t)
+	g, err := p.BeginGroup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitHook(t, log, "begin "+g.ID())
+	p.Close()
+	waitHook(t, log, "abort "+g.ID())
+}
+
+func TestGroupAbortOnDisconnectDuringBegin(t *testing.T) {
+	s := NewProvider()
+	began, release := make(chan string, 1), make(chan struct{})
+	log := make(hookLog, 10)
+	hooks := log.hooks()
+	hooks.Begin = func(id string) error {
+		began <- id
+		<-release
+		return nil
+	}
+	s.SetGroupHooks(hooks)
+	s.SetMultiplexing(true)
+	// With multiplexing, control calls such as BeginGroup have a connection of
+	// their own, so the provider does not wait for the hook before it sees the
+	// RPC connection close.
+	p := pipePlugin(t, s, WithMux())
+	go p.BeginGroup()
+	id := <-began
+	p.Close()
+	// Let the Begin hook return once the provider has seen the disconnection.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.d.groupMu.Lock()
+		disconnected := s.d.disconnected
+		s.d.groupMu.Unlock()
+		if disconnected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the provider to see the disconnection")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	waitHook(t, log, "abort "+id)
+}
+
+func TestGroupBeginError(t *testing.T) {
+	s := NewProvider()
+	if err := s.RegisterName("api", &groupAPI{}); err != nil {
+		t.Fatal(err)
+	}
+	refused := errors.New("no groups today")
+	s.SetGroupHooks(GroupHooks{Begin: func(string) error { return refused }})
+	p := pipePlugin(t, s)
+	if _, err := p.BeginGroup(); err == nil || err.Error() != refused.Error() {
+		t.Errorf("Expected error %q from BeginGroup, got %v", refused, err)
+	}
+}
+
+func TestGroupSlowBeginHook(t *testing.T) {
+	s := NewProvider()
+	api := &groupAPI{}
+	if err := s.RegisterName("api", api); err != nil {
+		t.Fatal(err)
+	}
+	began, release := make(chan struct{}, 1), make(chan struct{})
+	var first sync.Once
+	s.SetGroupHooks(GroupHooks{Begin: func(string) error {
+		slow := true
+		first.Do(func() { slow = false })
+		if slow {
+			began <- struct{}{}
+			<-release
+		}
+		return nil
+	}})
+	p := pipePlugin(t, s)
+	g, err := p.BeginGroup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.BeginGroup()
+	<-began
+	done := make(chan error, 1)
+	go func() { done <- g.Call("api.Put", "a", new(int)) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("A slow Begin hook held up calls in another group")
+	}
+	close(release)
+}
+
+func TestGroupNotOpen(t *testing.T) {
+	p, _, _ := groupProvider(t)
+	err := p.call("api.Put", callMeta{group: "nope"}, "a", new(int))
+	if err == nil || !strings.Contains(err.Error(), "not open") {
+		t.Errorf("Expected error about a group that is not open, got %v", err)
+	}
+}
@@ -0,0 +1,296 @@
+package pie
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// helperFlag is passed to the test binary to make it act as a plugin instead
+// of running the tests.  The rest of the argument selects the helper's
+// behavior; see runHelper.
+const helperFlag = "-pie.helper="
+
+func TestMain(m *testing.M) {
+	RunPluginMain()
+	if len(os.Args) >= 2 && strings.HasPrefix(os.Args[1], helperFlag) {
+		runHelper(strings.TrimPrefix(os.Args[1], helperFlag))
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runHelper runs the test binary as a plugin, which also echoes the data sent
+// on channels and peer connections named "echo".  The modes are:
+//
+//   - provider: serve api and helper like a normal provider
+//   - versioned: like provider, but declaring API versions 1.2 and 2.1, and
+//     deprecating api.SayHi in favor of helper.APIVersion
+//   - deaf: run forever without ever reading from stdin
+//   - exit: exit immediately with a non-zero exit code
+//   - badconfig: fail setting up with ErrInvalidConfig, as RunProvider does
+//   - panic: panic setting up, as RunProvider does
+//   - firecracker: pretend to be firecracker, serving api in the "VM"; see
+//     fakeFirecracker
+//   - bus: like provider, but joining the bus and answering each "ping.*"
+//     event with a "pong.*" event carrying the same data
+//   - systemd: like provider, but set up to take the socket systemd passes
+//     with Accept=yes, as file descriptor 3
+//   - daemon: serve api as a Daemon named "pie" on the sockets passed by
+//     systemd-style socket activation, until SIGTERM
+func runHelper(mode string) {
+	if mode == "systemd" {
+		// systemd sets LISTEN_PID after forking, which the test cannot.
+		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		mode = "provider"
+	}
+	p := NewProvider()
+	p.RegisterName("api", api{})
+	p.RegisterName("helper", helper{p})
+	p.HandleChannel("echo", func(s *Stream) {
+		io.Copy(s, s)
+		s.Close()
+	})
+	p.HandlePeer("echo", func(c net.Conn) {
+		io.Copy(c, c)
+		c.Close()
+	})
+	switch mode {
+	case "provider":
+		p.Serve()
+	case "versioned":
+		p.SetAPIVersions("v1.2", "v2.1")
+		p.Deprecate("api.SayHi", "helper.APIVersion")
+		p.Serve()
+	case "deaf":
+		time.Sleep(time.Hour)
+	case "exit":
+		os.Exit(3)
+	case "badconfig":
+		os.Exit(runProvider(p, func(Server) error {
+			return fmt.Errorf("%w: no listen address", ErrInvalidConfig)
+		}))
+	case "panic":
+		os.Exit(runProvider(p, func(Server) error { panic("boom") }))
+	case "firecracker":
+		fakeFirecracker(os.Args[2:])
+	case "bus":
+		bus, _ := JoinBus(p)
+		bus.Subscribe("ping.*", func(e BusEvent) {
+			bus.Publish("pong."+strings.TrimPrefix(e.Name, "ping."), e.Data)
+		})
+		p.Serve()
+	case "daemon":
+		// systemd sets LISTEN_PID after forking, which the test cannot.
+		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		d := Daemon{Name: "pie", Setup: func(s Server) error { return s.RegisterName("api", api{}) }}
+		if err := d.Run(context.Background()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// startHelper starts the test binary as a plugin in the given mode.
+func startHelper(t *testing.T, mode string, output io.Writer) *Plugin {
+	p, err := StartPlugin(output, os.Args[0], helperArgs(mode))
+	if err != nil {
+		t.Fatalf("Unexpected error starting helper plugin: %#v", err)
+	}
+	return p
+}
+
+// pipePlugin serves s over an in-memory pipe to a Plugin handle started with
+// opts.  When the test ends, the handle is closed and s is waited for.
+func pipePlugin(t *testing.T, s Server, opts ...StartOption) *Plugin {
+	serverConn, clientConn := net.Pipe()
+	s.rwc = serverConn
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Serve()
+	}()
+	p, err := NewPlugin(clientConn, opts...)
+	if err != nil {
+		clientConn.Close()
+		<-done
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		p.Close()
+		<-done
+	})
+	return p
+}
+
+// helperArgs returns the arguments that start the test binary as a plugin in
+// the given mode.
+func helperArgs(mode string) []string {
+	return []string{helperFlag + mode}
+}
+
+// helper is an API served by helper plugins to let tests make them misbehave.
+type helper struct {
+	srv Server
+}
+
+// Block never returns.
+func (helper) Block(_ int, _ *int) error {
+	time.Sleep(time.Hour)
+	return nil
+}
+
+// Phase returns the provider's startup phase.
+func (h helper) Phase(_ int, phase *string) error {
+	*phase = h.srv.Phase().String()
+	return nil
+}
+
+// APIVersion returns the API version the host selected.
+func (h helper) APIVersion(_ int, version *string) error {
+	*version = h.srv.APIVersion()
+	return nil
+}
+
+// HostBuildInfo returns the build information the host sent.
+func (h helper) HostBuildInfo(_ int, info *BuildInfo) error {
+	*info = h.srv.HostBuildInfo()
+	return nil
+}
+
+// Feature reports whether the host enabled the named feature flag.
+func (h helper) Feature(name string, on *bool) error {
+	*on = h.srv.Feature(name)
+	return nil
+}
+
+// Getenv returns the value of the environment variable key.
+func (helper) Getenv(key string, value *string) error {
+	*value = os.Getenv(key)
+	return nil
+}
+
+// ReadFile returns the contents of the named file.
+func (helper) ReadFile(name string, data *string) error {
+	b, err := os.ReadFile(name)
+	*data = string(b)
+	return err
+}
+
+// Print writes s to stdout, as stray prints in plugin code do.
+func (helper) Print(s string, _ *int) error {
+	_, err := os.Stdout.WriteString(s)
+	return err
+}
+
+// PrintRaw writes s to the stdout the RPC stream is written to, as stray prints
+// in plugins without the stdout guard do.
+func (helper) PrintRaw(s string, _ *int) error {
+	_, err := guardedStdout().WriteString(s)
+	return err
+}
+
+// DialArgs are the arguments of helper.Dial.
+type DialArgs struct {
+	Address string
+	// Direct makes the helper dial itself, instead of through the host.
+	Direct bool
+}
+
+// Dial connects to args.Address over TCP, and returns the first line read from
+// it.
+func (helper) Dial(args DialArgs, line *string) error {
+	var conn net.Conn
+	var err error
+	if args.Direct {
+		conn, err = net.DialTimeout("tcp", args.Address, time.Second)
+	} else {
+		conn, err = DialHost("tcp", args.Address)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	*line, err = bufio.NewReader(conn).ReadString('\n')
+	return err
+}
+
+// NestedGetenv starts the test binary as a provider from within the plugin,
+// as plugins that use plugins of their own do, and returns the value of the
+// environment variable key in it.
+func (helper) NestedGetenv(key string, value *string) error {
+	p, err := StartPlugin(os.Stderr, os.Args[0], helperArgs("provider"))
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	return p.Call("helper.Getenv", key, value)
+}
+
+// Panic panics with msg, which crashes the plugin, since net/rpc does not
+// recover panics in methods.
+func (helper) Panic(msg string, _ *int) error {
+	panic(msg)
+}
+
+// Exit exits the plugin with the given exit code.
+func (helper) Exit(code int, _ *int) error {
+	os.Exit(code)
+	return nil
+}
+
+// lockedBuffer is a bytes.Buffer that is safe for concurrent use, since plugin
+// stderr is copied from another goroutine.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// eventRecorder collects events from a Supervisor for inspection by tests.
+type eventRecorder chan Event
+
+func newEventRecorder() eventRecorder {
+	return make(eventRecorder, 100)
+}
+
+func (r eventRecorder) record(e Event) {
+	r <- e
+}
+
+// waitFor waits for an event of the given kind, failing the test if it
+// doesn't arrive within a few seconds.
+func (r eventRecorder) waitFor(t *testing.T, kind EventKind) Event {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-r:
+			if e.Kind == kind {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for %s event", kind)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package pie
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// ErrHTTPNotAllowed is returned by an HTTPService for requests its options do
+// not allow.  Check for it with errors.Is.
+var ErrHTTPNotAllowed = errors.New("http request not allowed")
+
+// ErrHTTPLimit is returned by an HTTPService when a request or response body
+// exceeds the service's limits.  Check for it with errors.Is.
+var ErrHTTPLimit = errors.New("http size limit exceeded")
+
+// HTTPOptions controls what an HTTPService lets plugins fetch.
+type HTTPOptions struct {
+	// Allow lists the path.Match patterns of the host names plugins may send
+	// requests to, so that "*.example.com" allows any host in example.com.
+	// Redirects are only followed to allowed hosts.  If Allow is empty, no
+	// requests are allowed.
+	Allow []string
+	// AllowHTTP lets plugins send requests over plain HTTP, and not only
+	// HTTPS.
+	AllowHTTP bool
+	// MaxRequestBytes is the size of the largest request body plugins may
+	// send.  It defaults to 1MiB.
+	MaxRequestBytes int
+	// MaxResponseBytes is the size of the largest response body plugins may
+	// receive.  It defaults to 10MiB.
+	MaxResponseBytes int
+	// Timeout limits how long each request may take, including reading the
+	// response body.  It defaults to 30 seconds.
+	Timeout time.Duration
+	// Client, if not nil, sends the requests, instead of
+	// http.DefaultClient.  Its CheckRedirect function, if any, is called
+	// after the service has checked that the redirect is allowed.
+	Client *http.Client
+}
+
+func (o HTTPOptions) maxRequestBytes() int {
+	if o.MaxRequestBytes > 0 {
+		return o.MaxRequestBytes
+	}
+	return 1 << 20
+}
+
+func (o HTTPOptions) maxResponseBytes() int {
+	if o.MaxResponseBytes > 0 {
+		return o.MaxResponseBytes
+	}
+	return 10 << 20
+}
+
+func (o HTTPOptions) timeout() time.Duration {
+	if o.Timeout > 0 {
+		return o.Timeout
+	}
+	return 30 * time.Second
+}
+
+// HTTPService is an HTTP client kept by the host on behalf of plugins, so that
+// plugins run without network access, as with WithNetworkPolicy, can still
+// fetch what they need from the hosts the service allows, within its limits.
+// A host offers it to a consumer-style plugin by registering it with the
+// plugin's Server, and the plugin sends requests through an HTTPTransport:
+//
+//	s.RegisterName("HTTP", pie.NewHTTPService(pie.HTTPOptions{Allow: []string{"api.example.com"}}))
+//
+// It is safe for concurrent use.
+type HTTPService struct {
+	opts   HTTPOptions
+	client *http.Client
+}
+
+// NewHTTPService returns a service that sends the requests allowed by opts for
+// plugins.
+func NewHTTPService(opts HTTPOptions) *HTTPService {
+	base := opts.Client
+	if base == nil {
+		base = http.DefaultClient
+	}
+	client := *base
+	s := &HTTPService{opts: opts, client: &client}
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if err := s.check(req.URL); err != nil {
+			return err
+		}
+		if base.CheckRedirect != nil {
+			return base.CheckRedirect(req, via)
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+	return s
+}
+
+// HTTPRequest is the argument of HTTPService.Do.
+type HTTPRequest struct {
+	Method string
+	URL    string
+	Header http.Header
+	Body   []byte
+	// Timeout, if not zero, is how long the plugin will wait for the
+	// response, which the service waits for no longer than its own limit.
+	Timeout time.Duration
+}
+
+// HTTPResponse is the reply of HTTPService.Do.
+type HTTPResponse struct {
+	StatusCode int
+	Status     string
+	Header     http.Header
+	Body       []byte
+}
+
+// check returns an error if the service's options do not allow requests to u.
+func (s *HTTPService) check(u *url.URL) error {
+	switch {
+	case u.Scheme == "https":
+	case u.Scheme == "http" && s.opts.AllowHTTP:
+	default:
+		return fmt.Errorf("%w: scheme %q", ErrHTTPNotAllowed, u.Scheme)
+	}
+	host := u.Hostname()
+	for _, pattern := range s.opts.Allow {
+		if ok, _ := path.Match(pattern, host); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: host %q", ErrHTTPNotAllowed, host)
+}
+
+// Do sends the request and returns the response, if the service's options
+// allow it.  Responses with any status are returned, and only failures to
+// get a response are errors.
+func (s *HTTPService) Do(ctx context.Context, args HTTPRequest, resp *HTTPResponse) error {
+	u, err := url.Parse(args.URL)
+	if err != nil {
+		return err
+	}
+	if err := s.check(u); err != nil {
+		return err
+	}
+	if len(args.Body) > s.opts.maxRequestBytes() {
+		return fmt.Errorf("%w: request body of %d bytes is larger than %d", ErrHTTPLimit, len(args.Body), s.opts.maxRequestBytes())
+	}
+	timeout := s.opts.timeout()
+	if args.Timeout > 0 && args.Timeout < timeout {
+		timeout = args.Timeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	method := args.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(args.Body))
+	if err != nil {
+		return err
+	}
+	for k, v := range args.Header {
+		req.Header[k] = v
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	max := s.opts.maxResponseBytes()
+	body, err := io.ReadAll(io.LimitReader(res.Body, int64(max)+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > max {
+		return fmt.Errorf("%w: response body is larger than %d bytes", ErrHTTPLimit, max)
+	}
+	*resp = HTTPResponse{
+		StatusCode: res.StatusCode,
+		Status:     res.Status,
+		Header:     res.Header,
+		Body:       body,
+	}
+	return nil
+}
+
+// HTTPTransport is the plugin side of an HTTPService.  It is an
+// http.RoundTripper, so plugins can use it as the Transport of an
+// http.Client:
+//
+//	client := &http.Client{Transport: pie.NewHTTPTransport(pie.NewConsumer(), "HTTP")}
+//
+// Request and response bodies are sent whole, so that streaming requests are
+// read fully before being sent.  Requests the service does not allow fail with
+// an error that matches ErrHTTPNotAllowed, and bodies that are too large with
+// one that matches ErrHTTPLimit.
+type HTTPTransport struct {
+	c       Caller
+	service string
+}
+
+// NewHTTPTransport returns a transport that sends requests through the
+// HTTPService registered under the name service, which it calls through c,
+// usually the client returned by NewConsumer.
+func NewHTTPTransport(c Caller, service string) *HTTPTransport {
+	return &HTTPTransport{c: c, service: service}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *HTTPTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	args := HTTPRequest{Method: req.Method, URL: req.URL.String(), Header: req.Header}
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		args.Body = body
+	}
+	ctx := req.Context()
+	if deadline, ok := ctx.Deadline(); ok {
+		args.Timeout = time.Until(deadline)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var resp HTTPResponse
+	if err := t.c.Call(t.service+".Do", args, &resp); err != nil {
+		return nil, httpError(err)
+	}
+	return &http.Response{
+		Status:        resp.Status,
+		StatusCode:    resp.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        resp.Header,
+		Body:          io.NopCloser(bytes.NewReader(resp.Body)),
+		ContentLength: int64(len(resp.Body)),
+		Request:       req,
+	}, nil
+}
+
+// httpError returns err, the error of a call to an HTTPService, matching the
+// sentinel error it was made from.
+func httpError(err error) error {
+	msg := err.Error()
+	for _, sentinel := range []error{ErrHTTPNotAllowed, ErrHTTPLimit} {
+		if i := strings.Index(msg, sentinel.Error()+":"); i >= 0 {
+			return fmt.Errorf("%s%w%s", msg[:i], sentinel, msg[i+len(sentinel.Error()):])
+		}
+	}
+	return err
+}
@@ -0,0 +1,121 @@
+package pie
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"strings"
+	"testing"
+	"time"
+)
+
+// httpClient returns an http.Client for plugins that sends its requests
+// through an HTTPService with the given options.
+func httpClient(t *testing.T, opts HTTPOptions) *http.Client {
+	s := Server{server: rpc.NewServer(), d: &dispatcher{}}
+	if err := s.RegisterName("HTTP", NewHTTPService(opts)); err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{Transport: NewHTTPTransport(servePipe(t, s, nil, nil), "HTTP")}
+}
+
+func testHTTPServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Method", r.Method)
+		w.Header().Set("X-Token", r.Header.Get("X-Token"))
+		io.Copy(w, r.Body)
+	})
+	mux.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 2048))
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(5 * time.Second):
+		case <-r.Context().Done():
+		}
+	})
+	mux.HandleFunc("/missing", http.NotFound)
+	mux.HandleFunc("/away", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://elsewhere.invalid/", http.StatusFound)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestHTTPService(t *testing.T) {
+	srv := testHTTPServer(t)
+	client := httpClient(t, HTTPOptions{Allow: []string{"127.0.0.1"}, AllowHTTP: true})
+
+	req, err := http.NewRequest("POST", srv.URL+"/echo", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Token", "secret")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "payload" {
+		t.Errorf("Expected the body to be echoed, got %q", body)
+	}
+	if m, tok := resp.Header.Get("X-Method"), resp.Header.Get("X-Token"); m != "POST" || tok != "secret" {
+		t.Errorf("Expected the method and headers to be sent, got %q, %q", m, tok)
+	}
+
+	resp, err = client.Get(srv.URL + "/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestHTTPServiceNotAllowed(t *testing.T) {
+	srv := testHTTPServer(t)
+	for name, tc := range map[string]struct {
+		opts HTTPOptions
+		url  string
+	}{
+		"host":     {HTTPOptions{Allow: []string{"*.example.com"}, AllowHTTP: true}, srv.URL + "/echo"},
+		"nothing":  {HTTPOptions{AllowHTTP: true}, srv.URL + "/echo"},
+		"scheme":   {HTTPOptions{Allow: []string{"127.0.0.1"}}, srv.URL + "/echo"},
+		"redirect": {HTTPOptions{Allow: []string{"127.0.0.1"}, AllowHTTP: true}, srv.URL + "/away"},
+	} {
+		_, err := httpClient(t, tc.opts).Get(tc.url)
+		if !errors.Is(err, ErrHTTPNotAllowed) {
+			t.Errorf("%s: expected ErrHTTPNotAllowed, got %v", name, err)
+		}
+	}
+}
+
+func TestHTTPServiceLimits(t *testing.T) {
+	srv := testHTTPServer(t)
+	client := httpClient(t, HTTPOptions{
+		Allow:            []string{"127.0.0.1"},
+		AllowHTTP:        true,
+		MaxRequestBytes:  16,
+		MaxResponseBytes: 1024,
+		Timeout:          100 * time.Millisecond,
+	})
+	if _, err := client.Post(srv.URL+"/echo", "text/plain", strings.NewReader(strings.Repeat("x", 17))); !errors.Is(err, ErrHTTPLimit) {
+		t.Errorf("Expected ErrHTTPLimit for a large request, got %v", err)
+	}
+	if _, err := client.Get(srv.URL + "/big"); !errors.Is(err, ErrHTTPLimit) {
+		t.Errorf("Expected ErrHTTPLimit for a large response, got %v", err)
+	}
+	start := time.Now()
+	if _, err := client.Get(srv.URL + "/slow"); err == nil {
+		t.Error("Expected a slow request to time out")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Expected the request to time out after 100ms, took %v", d)
+	}
+}
@@ -0,0 +1,209 @@
+package pie
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// ResultStore stores the results of calls made with idempotency keys, so that
+// a provider can answer a retried call with the result of the first attempt
+// instead of running it again.  Results are opaque, encoded by the provider.
+// A ResultStore that persists results lets a provider deduplicate calls
+// retried after it has itself been restarted.
+//
+// A ResultStore must be safe for concurrent use.
+type ResultStore interface {
+	// Get returns the result stored under key, and whether there is one.
+	Get(key string) (result []byte, ok bool, err error)
+	// Put stores result under key.
+	Put(key string, result []byte) error
+}
+
+// CallIdempotent is like Call, but sends key with the call as its idempotency
+// key.  A provider with a ResultStore set by Server.SetResultStore runs a call
+// with a given key at most once, answering later calls with the same key with
+// the stored result of the first, so that a call can be retried safely after a
+// crash or restart without repeating its side effects.  Keys should be unique
+// to an operation, such as a random ID chosen when the operation begins.
+// Idempotency keys require a provider created with NewProvider.
+func (p *Plugin) CallIdempotent(key, serviceMethod string, args interface{}, reply interface{}) error {
+	return p.call(serviceMethod, callMeta{idem: key}, args, reply)
+}
+
+// SetResultStore makes the Server remember the results of calls made with
+// idempotency keys in store.  Calls whose key has a stored result are not run
+// again; they get the stored reply or error.  Calls that arrive while a call
+// with the same key is running wait for its result.  Without a ResultStore,
+// idempotency keys are ignored.  SetResultStore applies to connections served
+// after it is called.
+func (s Server) SetResultStore(store ResultStore) error {
+	if s.d == nil {
+		return errors.New("pie: server cannot be configured")
+	}
+	s.d.regMu.Lock()
+	defer s.d.regMu.Unlock()
+	s.d.results = store
+	return nil
+}
+
+// storedResult is the encoding of a result in a ResultStore.
+type storedResult struct {
+	Method string
+	Error  string
+	Reply  []byte
+}
+
+// idempotent runs invoke for the call with the given idempotency key, unless
+// the call's result is in store, and returns the call's reply and error
+// message.  Concurrent calls with the same key wait for the first to finish.
+func (d *dispatcher) idempotent(store ResultStore, key, serviceMethod string, replyType reflect.Type, invoke func() (interface{}, string)) (interface{}, string) {
+	for {
+		d.idemMu.Lock()
+		running, ok := d.running[key]
+		if !ok {
+			break
+		}
+		d.idemMu.Unlock()
+		<-running
+	}
+	if d.running == nil {
+		d.running = map[string]chan struct{}{}
+	}
+	done := make(chan struct{})
+	d.running[key] = done
+	d.idemMu.Unlock()
+	defer func() {
+		d.idemMu.Lock()
+		delete(d.running, key)
+		d.idemMu.Unlock()
+		close(done)
+	}()
+
+	data, ok, err := store.Get(key)
+	if err != nil {
+		return invalidRequest, "pie: cannot look up idempotency key " + key + ": " + err.Error()
+	}
+	if ok {
+		return decodeResult(data, key, serviceMethod, replyType)
+	}
+	reply, errmsg := invoke()
+	if data, err := encodeResult(serviceMethod, reply, errmsg); err == nil {
+		// The call has run, so its result is sent even if it cannot be
+		// stored.
+		store.Put(key, data)
+	}
+	return reply, errmsg
+}
+
+// encodeResult encodes the result of a call for a ResultStore.
+func encodeResult(serviceMethod string, reply interface{}, errmsg string) ([]byte, error) {
+	r := storedResult{Method: serviceMethod, Error: errmsg}
+	if errmsg == "" {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(reply); err != nil {
+			return nil, err
+		}
+		r.Reply = buf.Bytes()
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeResult decodes a result stored by encodeResult into a reply and error
+// message for the call.
+func decodeResult(data []byte, key, serviceMethod string, replyType reflect.Type) (interface{}, string) {
+	var r storedResult
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&r); err != nil {
+		return invalidRequest, "pie: cannot decode result for idempotency key " + key + ": " + err.Error()
+	}
+	if r.Method != serviceMethod {
+		return invalidRequest, fmt.Sprintf("pie: idempotency key %s was used for a call to %s", key, r.Method)
+	}
+	if r.Error != "" {
+		return invalidRequest, r.Error
+	}
+	reply := reflect.New(replyType)
+	if err := gob.NewDecoder(bytes.NewReader(r.Reply)).DecodeValue(reply); err != nil {
+		return invalidRequest, "pie: cannot decode result for idempotency key " + key + ": " + err.Error()
+	}
+	return reply.Interface(), ""
+}
+
+// ResultCache is a ResultStore that keeps results in memory.  It holds at most
+// a fixed number of results, evicting the least recently stored first, and
+// forgets results once they are older than its TTL.
+type ResultCache struct {
+	max int
+	ttl time.Duration
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// cachedResult is an entry in a ResultCache.
+type cachedResult struct {
+	key     string
+	result  []byte
+	expires time.Time
+}
+
+// NewResultCache returns a ResultCache that holds at most max results, for at
+// most ttl each.  A max or ttl of zero means no limit.
+func NewResultCache(max int, ttl time.Duration) *ResultCache {
+	return &ResultCache{max: max, ttl: ttl, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+// Get implements ResultStore.
+func (c *ResultCache) Get(key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	r := e.Value.(*cachedResult)
+	if !r.expires.IsZero() && time.Now().After(r.expires) {
+		c.order.Remove(e)
+		delete(c.entries, key)
+		return nil, false, nil
+	}
+	return r.result, true, nil
+}
+
+// Put implements ResultStore.
+func (c *ResultCache) Put(key string, result []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.order.Remove(e)
+	}
+	r := &cachedResult{key: key, result: result}
+	if c.ttl > 0 {
+		r.expires = time.Now().Add(c.ttl)
+	}
+	c.entries[key] = c.order.PushBack(r)
+	for c.max > 0 && c.order.Len() > c.max {
+		oldest := c.order.Front()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedResult).key)
+	}
+	return nil
+}
+
+// Len returns the number of results in the cache, including any that have
+// expired but not yet been evicted.
+func (c *ResultCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
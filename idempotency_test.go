@@ -0,0 +1,165 @@
+package pie
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ledger is an API whose methods have side effects that must not be repeated.
+type ledger struct {
+	total int64
+	runs  int64
+}
+
+func (l *ledger) Deposit(n int64, balance *int64) error {
+	atomic.AddInt64(&l.runs, 1)
+	*balance = atomic.AddInt64(&l.total, n)
+	return nil
+}
+
+func (l *ledger) Withdraw(n int64) (int64, error) {
+	atomic.AddInt64(&l.runs, 1)
+	return 0, errors.New("insufficient funds")
+}
+
+func ledgerPlugin(t *testing.T, store ResultStore) (*Plugin, *ledger) {
+	s := NewProvider()
+	l := &ledger{}
+	if err := s.RegisterName("Ledger", l); err != nil {
+		t.Fatal(err)
+	}
+	if store != nil {
+		if err := s.SetResultStore(store); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return pipePlugin(t, s), l
+}
+
+func TestCallIdempotentRunsOnce(t *testing.T) {
+	p, l := ledgerPlugin(t, NewResultCache(0, 0))
+	for i := 0; i < 3; i++ {
+		var balance int64
+		if err := p.CallIdempotent("deposit-1", "Ledger.Deposit", int64(10), &balance); err != nil {
+			t.Fatal(err)
+		}
+		if balance != 10 {
+			t.Fatalf("attempt %d: expected balance 10, got %d", i, balance)
+		}
+	}
+	var balance int64
+	if err := p.CallIdempotent("deposit-2", "Ledger.Deposit", int64(5), &balance); err != nil {
+		t.Fatal(err)
+	}
+	if balance != 15 {
+		t.Fatalf("expected balance 15, got %d", balance)
+	}
+	if runs := atomic.LoadInt64(&l.runs); runs != 2 {
+		t.Fatalf("expected 2 deposits to run, got %d", runs)
+	}
+}
+
+func TestCallIdempotentStoresErrors(t *testing.T) {
+	p, l := ledgerPlugin(t, NewResultCache(0, 0))
+	for i := 0; i < 2; i++ {
+		var balance int64
+		err := p.CallIdempotent("withdraw-1", "Ledger.Withdraw", int64(10), &balance)
+		if err == nil || err.Error() != "insufficient funds" {
+			t.Fatalf("attempt %d: expected stored error, got %v", i, err)
+		}
+	}
+	if runs := atomic.LoadInt64(&l.runs); runs != 1 {
+		t.Fatalf("expected the withdrawal to run once, got %d", runs)
+	}
+}
+
+func TestCallIdempotentConcurrent(t *testing.T) {
+	p, l := ledgerPlugin(t, NewResultCache(0, 0))
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var balance int64
+			if err := p.CallIdempotent("deposit", "Ledger.Deposit", int64(1), &balance); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if runs := atomic.LoadInt64(&l.runs); runs != 1 {
+		t.Fatalf("expected concurrent retries to run once, got %d", runs)
+	}
+}
+
+func TestCallIdempotentKeyReused(t *testing.T) {
+	p, _ := ledgerPlugin(t, NewResultCache(0, 0))
+	var balance int64
+	if err := p.CallIdempotent("op", "Ledger.Deposit", int64(1), &balance); err != nil {
+		t.Fatal(err)
+	}
+	err := p.CallIdempotent("op", "Ledger.Withdraw", int64(1), &balance)
+	if err == nil || !strings.Contains(err.Error(), "was used for a call to Ledger.Deposit") {
+		t.Fatalf("expected key reuse error, got %v", err)
+	}
+}
+
+func TestCallIdempotentWithoutStore(t *testing.T) {
+	p, l := ledgerPlugin(t, nil)
+	for i := 0; i < 2; i++ {
+		var balance int64
+		if err := p.CallIdempotent("deposit", "Ledger.Deposit", int64(1), &balance); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if runs := atomic.LoadInt64(&l.runs); runs != 2 {
+		t.Fatalf("expected keys to be ignored without a store, got %d runs", runs)
+	}
+}
+
+func TestResultCacheLimits(t *testing.T) {
+	c := NewResultCache(2, 0)
+	c.Put("a", []byte("1"))
+	c.Put("b", []byte("2"))
+	c.Put("c", []byte("3"))
+	if _, ok, _ := c.Get("a"); ok {
+		t.Fatal("expected oldest result to be evicted")
+	}
+	if r, ok, _ := c.Get("c"); !ok || string(r) != "3" {
+		t.Fatalf("expected newest result, got %q, %v", r, ok)
+	}
+
+	c = NewResultCache(0, time.Millisecond)
+	c.Put("a", []byte("1"))
+	time.Sleep(5 * time.Millisecond)
+	if _, ok, _ := c.Get("a"); ok {
+		t.Fatal("expected expired result to be forgotten")
+	}
+	if c.Len() != 0 {
+		t.Fatalf("expected expired result to be evicted, got %d", c.Len())
+	}
+}
+
+func TestJournalRecordsIdempotencyKey(t *testing.T) {
+	j, err := OpenJournal(filepath.Join(t.TempDir(), "calls.journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	p, _ := ledgerPlugin(t, NewResultCache(0, 0))
+	p.journal = j
+	p.Close()
+	var balance int64
+	if err := p.CallIdempotent("deposit-1", "Ledger.Deposit", int64(10), &balance); err == nil {
+		t.Fatal("expected error calling closed plugin")
+	}
+	pending := j.Pending()
+	if len(pending) != 1 || pending[0].Key != "deposit-1" {
+		t.Fatalf("expected pending call with its key, got %v", pending)
+	}
+}
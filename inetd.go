@@ -0,0 +1,80 @@
+package pie
+
+import (
+	"net"
+	"net/rpc"
+	"os"
+	"strconv"
+)
+
+// A supervisor such as inetd, or systemd with Accept=yes, can accept
+// connections for a plugin itself, and start the plugin for each one, with
+// the accepted socket as its stdin and stdout, or, for systemd without
+// StandardInput=socket, as file descriptor 3.  NewProvider serves such a
+// socket directly, and hosts reach the plugin with DialPlugin or DialProvider,
+// which leave the plugin's process to the supervisor.
+
+// inheritedConn returns the connection accepted for the plugin by a supervisor
+// such as inetd or systemd, or nil if the plugin was not started with one.
+// If the connection is the plugin's stdin and stdout, stdout is replaced with
+// stderr, so that stray prints cannot corrupt the stream.
+func inheritedConn() net.Conn {
+	if providerGetenv(guardEnv) != "" {
+		// The plugin was started by StartPlugin, over pipes.
+		return nil
+	}
+	if conn := socketConn(os.Stdin); conn != nil {
+		if saved, err := redirectFd(int(os.Stderr.Fd()), int(os.Stdout.Fd())); err == nil {
+			os.NewFile(uintptr(saved), "").Close()
+		} else {
+			os.Stdout = os.Stderr
+		}
+		return conn
+	}
+	if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid != os.Getpid() || os.Getenv("LISTEN_FDS") != "1" {
+		return nil
+	}
+	conn := systemdConn()
+	if conn != nil {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}
+	return conn
+}
+
+// socketConn returns a connection for f, if f is a connected socket, and nil
+// otherwise.  The connection uses a copy of f's descriptor.
+func socketConn(f *os.File) net.Conn {
+	if f == nil {
+		return nil
+	}
+	if fi, err := f.Stat(); err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	conn, err := net.FileConn(f)
+	if err != nil {
+		return nil
+	}
+	// A listening socket has no peer.
+	if conn.RemoteAddr() == nil {
+		conn.Close()
+		return nil
+	}
+	return conn
+}
+
+// DialProvider connects to a provider-style plugin served at address on the
+// named network, such as one a supervisor like inetd starts for each
+// connection, or a Daemon, and returns an RPC client that communicates with
+// it using gob encoding, like StartProvider does for a plugin it starts.
+// Closing the client closes the connection, but leaves the plugin's process
+// to whatever started it.  Use DialPlugin for a handle with health checks and
+// the other features of StartPlugin.
+func DialProvider(network, address string) (*rpc.Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
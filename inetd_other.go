@@ -0,0 +1,10 @@
+//go:build !unix
+
+package pie
+
+import "net"
+
+// systemdConn returns nil, since systemd only runs on Linux.
+func systemdConn() net.Conn {
+	return nil
+}
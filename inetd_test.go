@@ -0,0 +1,93 @@
+package pie
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+)
+
+// inetd accepts connections on ln, starting the helper plugin in the given
+// mode for each, with the connection as its stdin and stdout, or as file
+// descriptor 3 if fd3 is true, the way inetd and systemd do.
+func inetd(t *testing.T, ln net.Listener, mode string, fd3 bool) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		f, err := conn.(*net.TCPConn).File()
+		conn.Close()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		cmd := exec.Command(os.Args[0], helperArgs(mode)...)
+		cmd.Stderr = os.Stderr
+		if fd3 {
+			cmd.ExtraFiles = []*os.File{f}
+			cmd.Env = append(os.Environ(), "LISTEN_FDS=1")
+		} else {
+			cmd.Stdin, cmd.Stdout = f, f
+		}
+		if err := cmd.Start(); err != nil {
+			t.Error(err)
+		}
+		f.Close()
+		go cmd.Wait()
+	}
+}
+
+func testInetd(t *testing.T, mode string, fd3 bool) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sockets cannot be passed as files on Windows")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go inetd(t, ln, mode, fd3)
+
+	client, err := DialProvider("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	var reply string
+	if err := client.Call("api.SayHi", "inetd", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "Hi inetd" {
+		t.Errorf("Expected Hi inetd, got %q", reply)
+	}
+
+	// Each connection gets a plugin of its own, whose stray prints do not
+	// reach the connection.
+	p := dialDaemon(t, ln.Addr().String())
+	defer p.Close()
+	if err := p.Call("helper.Print", "stray output\n", new(int)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Call("api.SayHi", "again", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "Hi again" {
+		t.Errorf("Expected Hi again, got %q", reply)
+	}
+	if err := p.Ping(); err != nil {
+		t.Errorf("Expected the plugin to answer health checks, got %v", err)
+	}
+}
+
+func TestInetd(t *testing.T) {
+	testInetd(t, "provider", false)
+}
+
+func TestInetdSystemd(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("systemd only runs on Linux")
+	}
+	testInetd(t, "systemd", true)
+}
@@ -0,0 +1,26 @@
+//go:build unix
+
+package pie
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// systemdConn returns the connection systemd passed the plugin as its first
+// file descriptor, or nil if that is not a connected socket, in which case it
+// is left open.
+func systemdConn() net.Conn {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(listenFdsStart, &st); err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFSOCK {
+		return nil
+	}
+	if _, err := syscall.Getpeername(listenFdsStart); err != nil {
+		return nil
+	}
+	f := os.NewFile(listenFdsStart, "systemd socket")
+	defer f.Close()
+	syscall.CloseOnExec(listenFdsStart)
+	return socketConn(f)
+}
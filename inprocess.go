@@ -0,0 +1,65 @@
+package pie
+
+import (
+	"io"
+	"net"
+)
+
+// InProcess returns a handle for a "plugin" that is just rcvr, a value in the
+// host process, registered as Register would register it in a real plugin.
+// It is meant for developing and testing plugins without building and
+// starting their binaries.  The handle works like one returned by
+// StartPlugin: calls are still encoded with the handle's codec and sent over
+// a connection, a synchronous in-memory one, and decoded by a Server that
+// serves the built-in control API, so methods that would not survive being
+// called in a real plugin, such as ones with arguments or replies that cannot
+// be encoded, fail the same way.  Options that concern the transport, such as
+// WithFraming, WithMux, and WithEncryption, are honored on both ends, while
+// those that concern the plugin process, such as WithEnv, have no effect.
+func InProcess(rcvr interface{}, opts ...StartOption) (*Plugin, error) {
+	return InProcessProvider(func(s Server) error { return s.Register(rcvr) }, opts...)
+}
+
+// InProcessProvider is like InProcess, but calls setup to register the
+// "plugin's" services on its Server, so that the setup function a plugin
+// passes to RunProvider can be used as is.  If setup fails, its error is
+// returned.  The Server is configured by opts alone, never by the host's
+// environment or arguments, and has the flags set with WithFeatures before
+// setup is called.
+func InProcessProvider(setup func(Server) error, opts ...StartOption) (*Plugin, error) {
+	var o startOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	hostEnd, pluginEnd := net.Pipe()
+	// The server is configured by the options alone, not by the host's own
+	// environment and arguments, as a provider's would be.
+	s := newServer(inProcessConn(pluginEnd, &o))
+	s.ctl.features = o.features.clone()
+	s.d.checksums = o.framing && o.checksums
+	s.d.keepalive, s.d.deadPeer = o.transportKeepalive, o.deadPeer
+	s.d.mux = o.mux
+	s.d.batching = o.batching
+	s.d.encryption = o.encryption
+	host := CurrentBuildInfo()
+	s.d.hostBuild = &host
+	if err := setup(s); err != nil {
+		hostEnd.Close()
+		pluginEnd.Close()
+		return nil, err
+	}
+	go s.Serve()
+	// The server already has the flags, so the handle need not send them.
+	opts = append(opts[:len(opts):len(opts)], func(o *startOptions) { o.features = nil })
+	return NewPlugin(hostEnd, opts...)
+}
+
+// inProcessConn returns the connection an in-process plugin's Server serves
+// over, framing what it writes the way NewProvider frames stdout if o asks
+// for plain framing.
+func inProcessConn(conn net.Conn, o *startOptions) io.ReadWriteCloser {
+	if !o.framing || o.checksums || o.transportKeepalive > 0 {
+		return conn
+	}
+	return newRWCloser(conn, &frameWriter{w: nopWriteCloser{conn}})
+}
@@ -0,0 +1,156 @@
+package pie
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// AnyArgs holds a value of any type, which gob can only encode if its type is
+// registered.
+type AnyArgs struct {
+	V interface{}
+}
+
+// unregistered is a type never registered with gob.
+type unregistered struct {
+	N int
+}
+
+// Taker is an API whose arguments cannot always be encoded, exported so that
+// InProcess can register it.
+type Taker struct{}
+
+// Take accepts args.
+func (Taker) Take(args AnyArgs, ok *bool) error {
+	*ok = true
+	return nil
+}
+
+// inProcessAPI returns an in-process plugin serving api.
+func inProcessAPI(t *testing.T, opts ...StartOption) *Plugin {
+	t.Helper()
+	p, err := InProcessProvider(func(s Server) error { return s.RegisterName("api", api{}) }, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestInProcess(t *testing.T) {
+	p := inProcessAPI(t)
+	defer p.Close()
+	var reply string
+	if err := p.Call("api.SayHi", "bob", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "Hi bob" {
+		t.Errorf("Expected Hi bob, got %q", reply)
+	}
+	if err := p.Ping(); err != nil {
+		t.Errorf("Expected the control API to be served, got %v", err)
+	}
+}
+
+func TestInProcessEncodes(t *testing.T) {
+	p, err := InProcess(Taker{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	var ok bool
+	if err := p.Call("Taker.Take", AnyArgs{V: 1}, &ok); err != nil || !ok {
+		t.Errorf("Expected a registered type to be encoded, got %v, %v", ok, err)
+	}
+	ok = false
+	err = p.Call("Taker.Take", AnyArgs{V: unregistered{1}}, &ok)
+	if err == nil || !strings.Contains(err.Error(), "not registered") {
+		t.Errorf("Expected the arguments to fail to encode, got %v", err)
+	}
+	if ok {
+		t.Error("Expected the method not to be called")
+	}
+}
+
+func TestInProcessOptions(t *testing.T) {
+	for name, opts := range map[string][]StartOption{
+		"framing":    {WithFraming(nil)},
+		"checksums":  {WithFraming(nil), WithChecksums(false)},
+		"keepalive":  {WithTransportKeepalive(10*time.Millisecond, time.Second)},
+		"mux":        {WithMux()},
+		"batching":   {WithBatching(Batching{})},
+		"encryption": {WithEncryption([]byte("secret"))},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := inProcessAPI(t, opts...)
+			defer p.Close()
+			var reply string
+			if err := p.Call("api.SayHi", "bob", &reply); err != nil || reply != "Hi bob" {
+				t.Errorf("Expected Hi bob, got %q, %v", reply, err)
+			}
+		})
+	}
+}
+
+func TestInProcessFeatures(t *testing.T) {
+	var atSetup bool
+	p, err := InProcessProvider(func(s Server) error {
+		atSetup = s.Feature("fast")
+		return s.RegisterName("helper", helper{s})
+	}, WithFeatures(Features{"fast": true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if !atSetup {
+		t.Error("Expected the feature to be on during setup")
+	}
+	var on bool
+	if err := p.Call("helper.Feature", "fast", &on); err != nil || !on {
+		t.Errorf("Expected the feature to be on, got %v, %v", on, err)
+	}
+	var info BuildInfo
+	if err := p.Call("helper.HostBuildInfo", 0, &info); err != nil || info.GoVersion == "" {
+		t.Errorf("Expected the host's build information, got %+v, %v", info, err)
+	}
+}
+
+func TestInProcessIgnoresHostConfig(t *testing.T) {
+	args := os.Args
+	defer func() { os.Args = args }()
+	os.Args = append([]string{args[0]}, selfTestFlag, "-v")
+	t.Setenv(keepaliveEnv, "1ms,2ms")
+	t.Setenv(muxEnv, "1")
+	p := inProcessAPI(t)
+	defer p.Close()
+	if len(os.Args) != 3 {
+		t.Errorf("Expected the host's arguments to be left alone, got %q", os.Args)
+	}
+	time.Sleep(20 * time.Millisecond)
+	var reply string
+	if err := p.Call("api.SayHi", "bob", &reply); err != nil || reply != "Hi bob" {
+		t.Errorf("Expected the in-process plugin to serve as configured by its options, got %q, %v", reply, err)
+	}
+}
+
+func TestInProcessClose(t *testing.T) {
+	p := inProcessAPI(t)
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-p.Exited():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the plugin to count as exited once closed")
+	}
+}
+
+func TestInProcessSetupError(t *testing.T) {
+	boom := errors.New("boom")
+	_, err := InProcessProvider(func(Server) error { return boom })
+	if err != boom {
+		t.Errorf("Expected the setup error, got %v", err)
+	}
+}
@@ -0,0 +1,172 @@
+package pie
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Manifest describes the API served by a provider, as reported by
+// Plugin.Manifest.
+type Manifest struct {
+	// APIVersions are the API versions the provider declared with
+	// Server.SetAPIVersions.
+	APIVersions []string
+	// Methods are the provider's methods, sorted by name.  pie's built-in
+	// control API is not included.
+	Methods []MethodInfo
+}
+
+// MethodInfo describes one method served by a provider.
+type MethodInfo struct {
+	// Name is the method's name in "Service.Method" form.
+	Name string
+	// Deprecated reports whether the provider has marked the method
+	// deprecated with Server.Deprecate.
+	Deprecated bool
+	// Replacement, if not empty, is the method callers should use instead of
+	// a deprecated method.
+	Replacement string
+	// Aliases are the other names the method can be called by, set with
+	// Server.Alias or Server.RouteLatest, sorted.
+	Aliases []string
+}
+
+// Deprecated reports whether the manifest marks the named method deprecated,
+// and returns its replacement, if any.
+func (m *Manifest) Deprecated(serviceMethod string) (bool, string) {
+	for _, mi := range m.Methods {
+		if mi.Name == serviceMethod {
+			return mi.Deprecated, mi.Replacement
+		}
+	}
+	return false, ""
+}
+
+// Deprecate marks a method the provider has registered as deprecated in the
+// provider's Manifest, optionally naming the method that replaces it.  Both
+// are in "Service.Method" form.  Hosts started with WithDeprecationWarnings
+// log a warning when they call a deprecated method.  The method still works
+// as before.
+func (s Server) Deprecate(serviceMethod, replacement string) error {
+	if s.ctl == nil {
+		return fmt.Errorf("only providers can deprecate methods")
+	}
+	s.ctl.mu.Lock()
+	defer s.ctl.mu.Unlock()
+	mi, ok := s.ctl.methods[serviceMethod]
+	if !ok {
+		return fmt.Errorf("cannot deprecate %s: no such method is registered", serviceMethod)
+	}
+	mi.Deprecated = true
+	mi.Replacement = replacement
+	return nil
+}
+
+// addMethods records the named methods in the provider's manifest, under the
+// given service name.
+func (c *control) addMethods(name string, methods []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.methods == nil {
+		c.methods = map[string]*MethodInfo{}
+	}
+	for _, m := range methods {
+		full := name + "." + m
+		c.methods[full] = &MethodInfo{Name: full}
+	}
+}
+
+// Describe returns the provider's manifest.
+func (c *control) Describe(_ int, m *Manifest) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, v := range c.apiVersions {
+		m.APIVersions = append(m.APIVersions, v.String())
+	}
+	aliases := c.d.aliases()
+	for _, mi := range c.methods {
+		info := *mi
+		info.Aliases = aliases[mi.Name]
+		m.Methods = append(m.Methods, info)
+	}
+	sort.Slice(m.Methods, func(i, j int) bool { return m.Methods[i].Name < m.Methods[j].Name })
+	return nil
+}
+
+// Manifest asks the plugin to describe the API it serves.  Plugins that do
+// not serve pie's built-in control API return an error.
+func (p *Plugin) Manifest() (*Manifest, error) {
+	m := &Manifest{}
+	if err := p.controlClient().Call(controlService+".Describe", 0, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// WithDeprecationWarnings makes StartPlugin fetch the plugin's Manifest, and
+// makes calls through Plugin.Call to methods the plugin has deprecated log a
+// warning with logf, which may be log.Printf.  Warnings are logged at most
+// once every interval for each method; an interval of zero logs each only
+// once.  Plugins that cannot describe their API are started without
+// warnings.
+func WithDeprecationWarnings(logf func(format string, v ...interface{}), every time.Duration) StartOption {
+	return func(o *startOptions) {
+		o.warnf = logf
+		o.warnEvery = every
+	}
+}
+
+// deprecationWarner logs rate limited warnings about calls to deprecated
+// methods.
+type deprecationWarner struct {
+	logf       func(format string, v ...interface{})
+	every      time.Duration
+	deprecated map[string]string
+
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+// newDeprecationWarner returns a deprecationWarner for the deprecated methods
+// in m.
+func newDeprecationWarner(m *Manifest, logf func(format string, v ...interface{}), every time.Duration) *deprecationWarner {
+	w := &deprecationWarner{
+		logf:       logf,
+		every:      every,
+		deprecated: map[string]string{},
+		last:       map[string]time.Time{},
+	}
+	for _, mi := range m.Methods {
+		if mi.Deprecated {
+			w.deprecated[mi.Name] = mi.Replacement
+		}
+	}
+	return w
+}
+
+// called logs a warning if serviceMethod is deprecated and has not been warned
+// about recently.
+func (w *deprecationWarner) called(serviceMethod string) {
+	replacement, ok := w.deprecated[serviceMethod]
+	if !ok {
+		return
+	}
+	w.mu.Lock()
+	last, warned := w.last[serviceMethod]
+	now := time.Now()
+	if warned && (w.every <= 0 || now.Sub(last) < w.every) {
+		w.mu.Unlock()
+		return
+	}
+	w.last[serviceMethod] = now
+	w.mu.Unlock()
+
+	msg := []string{"pie: plugin method " + serviceMethod + " is deprecated"}
+	if replacement != "" {
+		msg = append(msg, "use "+replacement+" instead")
+	}
+	w.logf("%s", strings.Join(msg, "; "))
+}
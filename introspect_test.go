@@ -0,0 +1,83 @@
+package pie
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPluginManifest(t *testing.T) {
+	p := startHelper(t, "versioned", nil)
+	defer p.Close()
+	m, err := p.Manifest()
+	if err != nil {
+		t.Fatalf("Unexpected error from Manifest: %#v", err)
+	}
+	if len(m.APIVersions) != 2 || m.APIVersions[0] != "1.2.0" || m.APIVersions[1] != "2.1.0" {
+		t.Errorf("Wrong API versions in manifest: %q", m.APIVersions)
+	}
+	var names []string
+	for _, mi := range m.Methods {
+		names = append(names, mi.Name)
+	}
+	expected := "api.SayHi helper.APIVersion helper.Block helper.Dial helper.Exit helper.Feature helper.Getenv helper.HostBuildInfo helper.NestedGetenv helper.Panic helper.Phase helper.Print helper.PrintRaw helper.ReadFile"
+	if got := strings.Join(names, " "); got != expected {
+		t.Errorf("Wrong methods in manifest, expected %q, got %q", expected, got)
+	}
+	if dep, repl := m.Deprecated("api.SayHi"); !dep || repl != "helper.APIVersion" {
+		t.Errorf("Expected api.SayHi to be deprecated in favor of helper.APIVersion, got %v, %q", dep, repl)
+	}
+	if dep, _ := m.Deprecated("helper.Exit"); dep {
+		t.Error("Expected helper.Exit not to be deprecated")
+	}
+}
+
+func TestServerDeprecateUnknown(t *testing.T) {
+	s := NewProvider()
+	if err := s.Deprecate("api.SayHi", ""); err == nil {
+		t.Error("Expected an error deprecating a method that is not registered")
+	}
+	if err := s.RegisterName("api", api{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deprecate("api.SayHi", ""); err != nil {
+		t.Errorf("Unexpected error deprecating registered method: %#v", err)
+	}
+}
+
+func TestDeprecationWarnings(t *testing.T) {
+	var mu sync.Mutex
+	var warnings []string
+	logf := func(format string, v ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		warnings = append(warnings, fmt.Sprintf(format, v...))
+	}
+	p, err := StartPlugin(nil, os.Args[0], helperArgs("versioned"), WithDeprecationWarnings(logf, time.Hour))
+	if err != nil {
+		t.Fatalf("Unexpected error from StartPlugin: %#v", err)
+	}
+	defer p.Close()
+
+	var response string
+	for i := 0; i < 3; i++ {
+		if err := p.Call("api.SayHi", "bob", &response); err != nil {
+			t.Fatalf("Unexpected error calling deprecated method: %#v", err)
+		}
+	}
+	if err := p.Call("helper.APIVersion", 0, &response); err != nil {
+		t.Fatalf("Unexpected error calling method: %#v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(warnings) != 1 {
+		t.Fatalf("Expected one rate limited warning, got %q", warnings)
+	}
+	if !strings.Contains(warnings[0], "api.SayHi") || !strings.Contains(warnings[0], "helper.APIVersion") {
+		t.Errorf("Warning does not name the method and its replacement: %q", warnings[0])
+	}
+}
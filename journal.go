@@ -0,0 +1,255 @@
+package pie
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Journal is an append-only, write-ahead log of the calls made to a plugin.
+// Each call is recorded, and synced to disk, before it is sent, and marked
+// done once the plugin has answered it.  If the plugin or the host crashes,
+// the calls that were in flight stay in the journal, and the host can replay
+// them with Replay once the plugin is running again, so that workflows which
+// must not lose work survive crashes.  Replayed calls may already have been
+// run by the plugin before it crashed, so they should either be idempotent or
+// be made with Plugin.CallIdempotent, whose key the journal records so that the
+// replayed call can be made with the same key.
+//
+// A Journal is used by starting plugins with WithJournal.  It is safe for
+// concurrent use, and may be shared by all instances of a supervised plugin.
+type Journal struct {
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	next    uint64
+	pending map[uint64]JournalEntry
+}
+
+// JournalEntry is a call recorded in a Journal that has not been marked done.
+type JournalEntry struct {
+	// ID identifies the entry within its journal.
+	ID uint64 `json:"id"`
+	// Method is the service method that was called.
+	Method string `json:"method"`
+	// Key is the idempotency key the call was made with, if any.
+	Key string `json:"key,omitempty"`
+	// Args is the JSON encoding of the call's argument.
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+// DecodeArgs decodes the entry's argument into v, which should be a pointer
+// to a value of the type the call was made with.
+func (e JournalEntry) DecodeArgs(v interface{}) error {
+	return json.Unmarshal(e.Args, v)
+}
+
+// journalRecord is a line in a journal file.
+type journalRecord struct {
+	Op string `json:"op"`
+	JournalEntry
+}
+
+// OpenJournal opens the journal at path, creating it if it does not exist.
+// The calls recorded in it that were never marked done are kept, for Pending
+// and Replay; the rest of its history is discarded.
+func OpenJournal(path string) (*Journal, error) {
+	j := &Journal{pending: map[uint64]JournalEntry{}}
+	if err := j.load(path); err != nil {
+		return nil, err
+	}
+	if err := j.compact(path); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	j.f = f
+	j.w = bufio.NewWriter(f)
+	return j, nil
+}
+
+// load reads the records in the journal file at path, if it exists.  A
+// truncated last record, left by a crash while it was written, is ignored, but
+// a corrupt record followed by others is an error, since dropping it could
+// lose the calls recorded after it.
+func (j *Journal) load(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20)
+	line, bad := 0, 0
+	for scanner.Scan() {
+		line++
+		if bad != 0 {
+			return fmt.Errorf("pie: journal %s: corrupt record on line %d", path, bad)
+		}
+		var r journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			bad = line
+			continue
+		}
+		switch r.Op {
+		case "call":
+			j.pending[r.ID] = r.JournalEntry
+		case "done":
+			delete(j.pending, r.ID)
+		}
+		if r.ID > j.next {
+			j.next = r.ID
+		}
+	}
+	return scanner.Err()
+}
+
+// compact atomically rewrites the journal file to hold only the pending calls.
+func (j *Journal) compact(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, e := range j.Pending() {
+		if err := enc.Encode(journalRecord{Op: "call", JournalEntry: e}); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Pending returns the calls that have been recorded but not marked done, in
+// the order they were made.
+func (j *Journal) Pending() []JournalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entries := make([]JournalEntry, 0, len(j.pending))
+	for _, e := range j.pending {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].ID < entries[b].ID })
+	return entries
+}
+
+// Replay calls replay with each pending call, in the order the calls were
+// made, marking each done when replay returns nil.  It stops at the first
+// error, which it returns.  replay typically decodes the entry's argument with
+// DecodeArgs and makes the call again.
+func (j *Journal) Replay(replay func(JournalEntry) error) error {
+	for _, e := range j.Pending() {
+		if err := replay(e); err != nil {
+			return fmt.Errorf("pie: replaying call %d to %s: %w", e.ID, e.Method, err)
+		}
+		if err := j.done(e.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the journal file.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil {
+		return errors.New("pie: journal already closed")
+	}
+	err := j.w.Flush()
+	if cerr := j.f.Close(); err == nil {
+		err = cerr
+	}
+	j.f = nil
+	return err
+}
+
+// begin records a call about to be made with the given idempotency key, and
+// returns its entry's ID.
+func (j *Journal) begin(method, key string, args interface{}) (uint64, error) {
+	data, err := json.Marshal(args)
+	if err != nil {
+		return 0, fmt.Errorf("pie: journal: cannot record call to %s: %w", method, err)
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.next++
+	e := JournalEntry{ID: j.next, Method: method, Key: key, Args: data}
+	if err := j.append(journalRecord{Op: "call", JournalEntry: e}, true); err != nil {
+		return 0, err
+	}
+	j.pending[e.ID] = e
+	return e.ID, nil
+}
+
+// done marks the call with the given ID done.
+func (j *Journal) done(id uint64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := j.pending[id]; !ok {
+		return nil
+	}
+	delete(j.pending, id)
+	return j.append(journalRecord{Op: "done", JournalEntry: JournalEntry{ID: id}}, false)
+}
+
+// append writes r to the journal file, syncing it to disk if sync is true.
+// Records that mark calls done are not synced, since losing one only makes a
+// call be replayed needlessly.
+func (j *Journal) append(r journalRecord, sync bool) error {
+	if j.f == nil {
+		return errors.New("pie: journal closed")
+	}
+	if err := json.NewEncoder(j.w).Encode(r); err != nil {
+		return err
+	}
+	if err := j.w.Flush(); err != nil {
+		return err
+	}
+	if sync {
+		return j.f.Sync()
+	}
+	return nil
+}
+
+// journalFinished reports whether a call that returned err was answered by the
+// plugin, as opposed to failing because the connection did, in which case it
+// may not have run and must stay in the journal.
+func journalFinished(err error) bool {
+	if err == nil {
+		return true
+	}
+	var serr rpc.ServerError
+	return errors.As(err, &serr)
+}
+
+// WithJournal records the calls made through the plugin's handle in j.
+func WithJournal(j *Journal) StartOption {
+	return func(o *startOptions) {
+		o.journal = j
+	}
+}
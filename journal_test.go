@@ -0,0 +1,165 @@
+package pie
+
+import (
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJournalRecordsCalls(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calls.journal")
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	s := NewProvider()
+	if err := s.RegisterName("Greeter", api{}); err != nil {
+		t.Fatal(err)
+	}
+	p := pipePlugin(t, s)
+	p.journal = j
+
+	var reply string
+	if err := p.Call("Greeter.SayHi", "bob", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Call("Greeter.Missing", "bob", &reply); err == nil {
+		t.Fatal("expected error calling missing method")
+	}
+	if pending := j.Pending(); len(pending) != 0 {
+		t.Fatalf("expected answered calls to be marked done, got %v", pending)
+	}
+
+	p.Close()
+	if err := p.Call("Greeter.SayHi", "alice", &reply); err == nil {
+		t.Fatal("expected error calling closed plugin")
+	}
+	pending := j.Pending()
+	if len(pending) != 1 || pending[0].Method != "Greeter.SayHi" {
+		t.Fatalf("expected the failed call to be pending, got %v", pending)
+	}
+}
+
+func TestJournalReplayAfterReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calls.journal")
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := j.begin("Greeter.SayHi", "", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := j.begin("Greeter.SayHi", "", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.done(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err = OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	s := NewProvider()
+	if err := s.RegisterName("Greeter", api{}); err != nil {
+		t.Fatal(err)
+	}
+	p := pipePlugin(t, s)
+	var replies []string
+	err = j.Replay(func(e JournalEntry) error {
+		var name string
+		if err := e.DecodeArgs(&name); err != nil {
+			return err
+		}
+		var reply string
+		if err := p.Call(e.Method, name, &reply); err != nil {
+			return err
+		}
+		replies = append(replies, reply)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 1 || replies[0] != "Hi alice" {
+		t.Fatalf("expected only the unfinished call to be replayed, got %v", replies)
+	}
+	if pending := j.Pending(); len(pending) != 0 {
+		t.Fatalf("expected no pending calls after replay, got %v", pending)
+	}
+
+	// New entries must not reuse the IDs of entries from before the reopen.
+	id, err := j.begin("Greeter.SayHi", "", "eve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id <= first+1 {
+		t.Fatalf("expected a fresh entry ID, got %d", id)
+	}
+}
+
+func TestJournalKeepsCallsThatFailToReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calls.journal")
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if _, err := j.begin("Greeter.SayHi", "", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	err = j.Replay(func(JournalEntry) error { return rpc.ErrShutdown })
+	if err == nil {
+		t.Fatal("expected replay error")
+	}
+	if len(j.Pending()) != 1 {
+		t.Fatal("expected call that failed to replay to stay pending")
+	}
+}
+
+func TestJournalTornLastRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calls.journal")
+	records := `{"op":"call","id":1,"method":"Greeter.SayHi","args":"bob"}` + "\n" +
+		`{"op":"call","id":2,"method":"Gree`
+	if err := os.WriteFile(path, []byte(records), 0600); err != nil {
+		t.Fatal(err)
+	}
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatalf("Expected a torn last record to be ignored, got %v", err)
+	}
+	defer j.Close()
+	if pending := j.Pending(); len(pending) != 1 || pending[0].ID != 1 {
+		t.Errorf("Expected the call before the torn record to be pending, got %v", pending)
+	}
+}
+
+func TestJournalCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calls.journal")
+	records := `{"op":"call","id":1,"method":"Greeter.SayHi","args":"bob"}` + "\n" +
+		`{"op":"call",garbage` + "\n" +
+		`{"op":"call","id":3,"method":"Greeter.SayHi","args":"alice"}` + "\n"
+	if err := os.WriteFile(path, []byte(records), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenJournal(path); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("Expected an error for the corrupt record on line 2, got %v", err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != records {
+		t.Error("Expected the journal to be left as it was")
+	}
+}
@@ -0,0 +1,117 @@
+package pie
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// keepaliveEnv is the environment variable through which the host asks a
+// provider for transport keepalives, as "interval,timeout".
+const keepaliveEnv = "PIE_KEEPALIVE"
+
+// ErrDeadPeer is the error that ends a connection using transport keepalives
+// when nothing, not even a keepalive, has been received from the other end
+// within the dead-peer timeout.  Calls in flight on the connection fail with
+// it.
+var ErrDeadPeer = errors.New("pie: peer stopped responding within the dead-peer timeout")
+
+// WithTransportKeepalive makes the host and the plugin send each other an
+// empty keepalive frame whenever they have sent nothing else for interval, and
+// close the connection with ErrDeadPeer when nothing has been received for
+// timeout.  Unlike Timeouts.Keepalive, which calls the plugin, transport
+// keepalives are sent by the connection itself, so a plugin busy with long
+// calls keeps its connection alive, while a plugin that has silently vanished,
+// such as a remote plugin cut off by a network partition, is detected within
+// timeout instead of leaving calls hanging forever.  Closing the connection of
+// a plugin started by StartPlugin also stops the plugin.  timeout should be
+// several times interval.
+//
+// For plugins started by StartPlugin, the provider is asked to send keepalives
+// through its environment; it must be created with NewProvider by a version of
+// this package that supports them.  For handles created with NewPlugin, the
+// provider must be told with Server.SetTransportKeepalive.
+func WithTransportKeepalive(interval, timeout time.Duration) StartOption {
+	return func(o *startOptions) {
+		o.framing = true
+		o.transportKeepalive = interval
+		o.deadPeer = timeout
+	}
+}
+
+// SetTransportKeepalive makes the Server send and watch for transport
+// keepalives, as a host does with WithTransportKeepalive, on connections
+// served after it is called.  When the host is declared dead, Serve returns.
+// Providers created with NewProvider for hosts that use WithTransportKeepalive
+// have keepalives set already.
+func (s Server) SetTransportKeepalive(interval, timeout time.Duration) error {
+	if s.d == nil {
+		return errors.New("pie: server cannot be configured")
+	}
+	s.d.regMu.Lock()
+	defer s.d.regMu.Unlock()
+	s.d.keepalive = interval
+	s.d.deadPeer = timeout
+	return nil
+}
+
+// parseKeepaliveEnv parses the value of keepaliveEnv.  Invalid values mean no
+// keepalives.
+func parseKeepaliveEnv(v string) (interval, timeout time.Duration) {
+	i := strings.IndexByte(v, ',')
+	if i < 0 {
+		return 0, 0
+	}
+	interval, err := time.ParseDuration(v[:i])
+	if err != nil {
+		return 0, 0
+	}
+	timeout, err = time.ParseDuration(v[i+1:])
+	if err != nil {
+		return 0, 0
+	}
+	return interval, timeout
+}
+
+// sendKeepalives writes a keepalive frame whenever nothing has been written for
+// interval, until the connection is closed.
+func (c *framedConn) sendKeepalives(interval time.Duration) {
+	t := time.NewTicker(interval / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-t.C:
+		}
+		last := time.Unix(0, atomic.LoadInt64(&c.fw.lastWrite))
+		if time.Since(last) < interval {
+			continue
+		}
+		if c.fw.writeFrame(nil) != nil {
+			return
+		}
+	}
+}
+
+// watchPeer closes the connection, declaring the peer dead, if nothing is read
+// from it for timeout.
+func (c *framedConn) watchPeer(timeout time.Duration) {
+	t := time.NewTicker(timeout / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-t.C:
+		}
+		last := time.Unix(0, atomic.LoadInt64(&c.fr.lastRead))
+		if time.Since(last) < timeout {
+			continue
+		}
+		atomic.StoreInt32(&c.fr.dead, 1)
+		c.Close()
+		return
+	}
+}
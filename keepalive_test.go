@@ -0,0 +1,132 @@
+package pie
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// freezableConn is a connection whose writes block once it is frozen, as if
+// the network had been partitioned.
+type freezableConn struct {
+	net.Conn
+	mu     sync.Mutex
+	frozen chan struct{}
+}
+
+func (c *freezableConn) freeze() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.frozen = make(chan struct{})
+}
+
+func (c *freezableConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	frozen := c.frozen
+	c.mu.Unlock()
+	if frozen != nil {
+		<-frozen
+	}
+	return c.Conn.Write(p)
+}
+
+// keepalivePlugin serves api with transport keepalives over a pipe, and
+// returns a handle for it and the provider's end of the pipe.
+func keepalivePlugin(t *testing.T) (*Plugin, *freezableConn) {
+	serverConn, clientConn := net.Pipe()
+	fc := &freezableConn{Conn: serverConn}
+	s := NewProviderConn(fc)
+	s.RegisterName("api", api{})
+	if err := s.SetTransportKeepalive(10*time.Millisecond, 300*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	p, err := NewPlugin(clientConn, WithTransportKeepalive(10*time.Millisecond, 300*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p, fc
+}
+
+func TestTransportKeepaliveKeepsIdleConnection(t *testing.T) {
+	p, _ := keepalivePlugin(t)
+	time.Sleep(600 * time.Millisecond)
+	var reply string
+	if err := p.Call("api.SayHi", "bob", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "Hi bob" {
+		t.Fatalf("expected %q, got %q", "Hi bob", reply)
+	}
+}
+
+func TestTransportKeepaliveDetectsDeadPeer(t *testing.T) {
+	p, fc := keepalivePlugin(t)
+	fc.freeze()
+	done := make(chan error, 1)
+	go func() {
+		var reply string
+		done <- p.Call("api.SayHi", "bob", &reply)
+	}()
+	select {
+	case err := <-done:
+		if err != ErrDeadPeer {
+			t.Fatalf("expected ErrDeadPeer, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("call to a vanished plugin did not fail")
+	}
+}
+
+func TestTransportKeepaliveProviderDetectsDeadHost(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go io.Copy(ioutil.Discard, clientConn)
+	s := NewProviderConn(serverConn)
+	if err := s.SetTransportKeepalive(10*time.Millisecond, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.ServeErr() }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrDeadPeer) {
+			t.Fatalf("expected ErrDeadPeer, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after the host vanished")
+	}
+}
+
+func TestTransportKeepaliveWithStartPlugin(t *testing.T) {
+	p, err := StartPlugin(os.Stderr, os.Args[0], helperArgs("provider"),
+		WithTransportKeepalive(10*time.Millisecond, 500*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	time.Sleep(600 * time.Millisecond)
+	var reply string
+	if err := p.Call("api.SayHi", "bob", &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	deaf, err := StartPlugin(ioutil.Discard, os.Args[0], helperArgs("deaf"),
+		WithTransportKeepalive(10*time.Millisecond, 100*time.Millisecond),
+		WithTimeouts(Timeouts{Stop: 10 * time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-deaf.Exited():
+	case <-time.After(5 * time.Second):
+		deaf.Close()
+		t.Fatal("a plugin that sent no keepalives was not stopped")
+	}
+}
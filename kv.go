@@ -0,0 +1,223 @@
+package pie
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrKVLimit is returned by a KVService when storing a value would exceed the
+// service's limits.  Check for it with errors.Is.
+var ErrKVLimit = errors.New("kv store limit exceeded")
+
+// KVLimits limits how much a plugin may store in a KVService.
+type KVLimits struct {
+	// MaxKeys is the most keys the store may hold.  It defaults to 1024.
+	MaxKeys int
+	// MaxValueBytes is the size of the largest value that may be stored.  It
+	// defaults to 64KiB.
+	MaxValueBytes int
+}
+
+func (l KVLimits) maxKeys() int {
+	if l.MaxKeys > 0 {
+		return l.MaxKeys
+	}
+	return 1024
+}
+
+func (l KVLimits) maxValueBytes() int {
+	if l.MaxValueBytes > 0 {
+		return l.MaxValueBytes
+	}
+	return 64 << 10
+}
+
+// KVService is a key-value store kept by the host on behalf of a plugin, so
+// that the plugin can persist small amounts of state across restarts and
+// upgrades without managing files of its own.  A host offers it to a
+// consumer-style plugin by registering it with the plugin's Server, and the
+// plugin uses it through a KVClient:
+//
+//	kv, err := pie.OpenKVService(filepath.Join(stateDir, "myplugin.json"), pie.KVLimits{})
+//	...
+//	s.RegisterName("KV", kv)
+//
+// Each change is written to the store's file before it is acknowledged, so a
+// store should hold one plugin's state and be open in only one host at a time.
+// It is safe for concurrent use.
+type KVService struct {
+	path   string
+	limits KVLimits
+
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+// OpenKVService opens the store kept in the file at path, creating the file
+// when a value is first stored.  If path is empty, the store is kept only in
+// memory.
+func OpenKVService(path string, limits KVLimits) (*KVService, error) {
+	kv := &KVService{path: path, limits: limits, data: map[string][]byte{}}
+	if path == "" {
+		return kv, nil
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return kv, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &kv.data); err != nil {
+		return nil, fmt.Errorf("kv store %s: %w", path, err)
+	}
+	return kv, nil
+}
+
+// KVEntry is a key and its value in a KVService.
+type KVEntry struct {
+	Key   string
+	Value []byte
+	// Found reports whether Get found the key.
+	Found bool
+}
+
+// Get returns the value stored under key.
+func (kv *KVService) Get(key string, entry *KVEntry) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	v, ok := kv.data[key]
+	*entry = KVEntry{Key: key, Value: v, Found: ok}
+	return nil
+}
+
+// Set stores entry.Value under entry.Key.
+func (kv *KVService) Set(entry KVEntry, _ *int) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if len(entry.Value) > kv.limits.maxValueBytes() {
+		return fmt.Errorf("%w: value for %q is %d bytes, the limit is %d", ErrKVLimit, entry.Key, len(entry.Value), kv.limits.maxValueBytes())
+	}
+	old, ok := kv.data[entry.Key]
+	if !ok && len(kv.data) >= kv.limits.maxKeys() {
+		return fmt.Errorf("%w: the store already holds %d keys", ErrKVLimit, len(kv.data))
+	}
+	kv.data[entry.Key] = entry.Value
+	if err := kv.save(); err != nil {
+		if ok {
+			kv.data[entry.Key] = old
+		} else {
+			delete(kv.data, entry.Key)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes key from the store.  Deleting a key that is not stored is not
+// an error.
+func (kv *KVService) Delete(key string, _ *int) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	old, ok := kv.data[key]
+	if !ok {
+		return nil
+	}
+	delete(kv.data, key)
+	if err := kv.save(); err != nil {
+		kv.data[key] = old
+		return err
+	}
+	return nil
+}
+
+// Keys returns the stored keys that start with prefix, sorted.
+func (kv *KVService) Keys(prefix string, keys *[]string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	list := []string{}
+	for k := range kv.data {
+		if strings.HasPrefix(k, prefix) {
+			list = append(list, k)
+		}
+	}
+	sort.Strings(list)
+	*keys = list
+	return nil
+}
+
+// save atomically rewrites the store's file.
+func (kv *KVService) save() error {
+	if kv.path == "" {
+		return nil
+	}
+	b, err := json.Marshal(kv.data)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(kv.path), filepath.Base(kv.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), kv.path)
+}
+
+// KVClient is the plugin side of a KVService.
+type KVClient struct {
+	c       Caller
+	service string
+}
+
+// NewKVClient returns a client for the KVService registered under the name
+// service, which it calls through c, usually the client returned by
+// NewConsumer.
+func NewKVClient(c Caller, service string) *KVClient {
+	return &KVClient{c: c, service: service}
+}
+
+// Get returns the value stored under key, and whether there is one.
+func (c *KVClient) Get(key string) ([]byte, bool, error) {
+	var entry KVEntry
+	err := c.c.Call(c.service+".Get", key, &entry)
+	return entry.Value, entry.Found, err
+}
+
+// Set stores value under key.  If the store's limits do not allow it, the
+// error matches ErrKVLimit.
+func (c *KVClient) Set(key string, value []byte) error {
+	err := c.c.Call(c.service+".Set", KVEntry{Key: key, Value: value}, new(int))
+	if err != nil && strings.HasPrefix(err.Error(), ErrKVLimit.Error()+":") {
+		return fmt.Errorf("%w%s", ErrKVLimit, strings.TrimPrefix(err.Error(), ErrKVLimit.Error()))
+	}
+	return err
+}
+
+// Delete removes key from the store.
+func (c *KVClient) Delete(key string) error {
+	return c.c.Call(c.service+".Delete", key, new(int))
+}
+
+// Keys returns the stored keys that start with prefix, sorted.
+func (c *KVClient) Keys(prefix string) ([]string, error) {
+	var keys []string
+	err := c.c.Call(c.service+".Keys", prefix, &keys)
+	return keys, err
+}
@@ -0,0 +1,102 @@
+package pie
+
+import (
+	"bytes"
+	"errors"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// kvClient returns a client for kv.
+func kvClient(t *testing.T, kv *KVService) *KVClient {
+	s := Server{server: rpc.NewServer(), d: &dispatcher{}}
+	if err := s.RegisterName("KV", kv); err != nil {
+		t.Fatal(err)
+	}
+	return NewKVClient(servePipe(t, s, nil, nil), "KV")
+}
+
+func TestKV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	kv, err := OpenKVService(path, KVLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := kvClient(t, kv)
+	if _, found, err := c.Get("missing"); err != nil || found {
+		t.Errorf("Expected a missing key not to be found, got found %v, error %v", found, err)
+	}
+	for _, k := range []string{"b/1", "a/2", "a/1"} {
+		if err := c.Set(k, []byte("value "+k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Delete("b/1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete("b/1"); err != nil {
+		t.Errorf("Expected deleting a missing key to succeed, got %v", err)
+	}
+
+	// The state survives the host reopening the store.
+	kv, err = OpenKVService(path, KVLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = kvClient(t, kv)
+	v, found, err := c.Get("a/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || !bytes.Equal(v, []byte("value a/2")) {
+		t.Errorf("Expected %q, got %q (found %v)", "value a/2", v, found)
+	}
+	keys, err := c.Keys("a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a/1", "a/2"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Expected keys %v, got %v", want, keys)
+	}
+	if keys, _ := c.Keys("b/"); len(keys) != 0 {
+		t.Errorf("Expected no keys, got %v", keys)
+	}
+}
+
+func TestKVLimits(t *testing.T) {
+	kv, err := OpenKVService("", KVLimits{MaxKeys: 2, MaxValueBytes: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := kvClient(t, kv)
+	if err := c.Set("big", []byte("12345")); !errors.Is(err, ErrKVLimit) {
+		t.Errorf("Expected ErrKVLimit for a large value, got %v", err)
+	}
+	for _, k := range []string{"a", "b"} {
+		if err := c.Set(k, []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Set("c", []byte("1")); !errors.Is(err, ErrKVLimit) {
+		t.Errorf("Expected ErrKVLimit for too many keys, got %v", err)
+	} else if !strings.Contains(err.Error(), "2 keys") {
+		t.Errorf("Expected the error to give the limit, got %v", err)
+	}
+	if err := c.Set("a", []byte("2")); err != nil {
+		t.Errorf("Expected replacing a key to succeed when full, got %v", err)
+	}
+}
+
+func TestOpenKVServiceCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenKVService(path, KVLimits{}); err == nil {
+		t.Error("Expected an error opening a corrupt store")
+	}
+}
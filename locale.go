@@ -0,0 +1,66 @@
+package pie
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Locale is the locale and time zone a plugin started with WithLocale runs
+// in.
+type Locale struct {
+	// Lang is the locale, such as "en_US.UTF-8", which also sets the
+	// encoding of text.  It is "C" if empty.
+	Lang string
+	// TimeZone is the time zone, such as "Europe/Paris".  It is "UTC" if
+	// empty.
+	TimeZone string
+}
+
+// WithLocale makes StartPlugin run the plugin in locale l, so that it formats
+// and sorts text, decodes bytes, and tells the time alike on every machine,
+// whatever the host's locale and time zone, which is set up differently on
+// developer machines and servers.  WithLocale(Locale{}) runs plugins in the C
+// locale and UTC.  The plugin's LANG and LC_ALL are set to l.Lang and its TZ
+// to l.TimeZone, and the LANGUAGE and LC_ variables it would inherit from the
+// host are removed.  Plugin.BuildInfo reports the locale and time zone the
+// plugin runs in.
+func WithLocale(l Locale) StartOption {
+	if l.Lang == "" {
+		l.Lang = "C"
+	}
+	if l.TimeZone == "" {
+		l.TimeZone = "UTC"
+	}
+	return func(o *startOptions) {
+		o.cmdHooks = append(o.cmdHooks, func(cmd *exec.Cmd) {
+			if cmd.Env == nil {
+				cmd.Env = hostEnviron()
+			}
+			env := cmd.Env[:0:0]
+			for _, kv := range cmd.Env {
+				if !isLocaleVar(kv) {
+					env = append(env, kv)
+				}
+			}
+			cmd.Env = append(env, "LANG="+l.Lang, "LC_ALL="+l.Lang, "TZ="+l.TimeZone)
+		})
+	}
+}
+
+// isLocaleVar reports whether the environment variable kv, of the form
+// "key=value", sets the locale or time zone.
+func isLocaleVar(kv string) bool {
+	key, _, _ := strings.Cut(kv, "=")
+	return key == "LANG" || key == "LANGUAGE" || key == "TZ" || strings.HasPrefix(key, "LC_")
+}
+
+// currentLocale returns the locale and time zone the process runs in, as
+// BuildInfo reports them.
+func currentLocale() (locale, timeZone string) {
+	locale = os.Getenv("LC_ALL")
+	if locale == "" {
+		locale = os.Getenv("LANG")
+	}
+	return locale, os.Getenv("TZ")
+}
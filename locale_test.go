@@ -0,0 +1,51 @@
+package pie
+
+import (
+	"os"
+	"testing"
+)
+
+func TestWithLocale(t *testing.T) {
+	t.Setenv("LC_CTYPE", "fr_FR.UTF-8")
+	t.Setenv("LANGUAGE", "fr")
+	t.Setenv("TZ", "Europe/Paris")
+	for _, tc := range []struct {
+		locale         Locale
+		lang, timeZone string
+	}{
+		{Locale{}, "C", "UTC"},
+		{Locale{Lang: "en_US.UTF-8", TimeZone: "America/New_York"}, "en_US.UTF-8", "America/New_York"},
+	} {
+		p, err := StartPlugin(os.Stderr, os.Args[0], helperArgs("provider"), WithLocale(tc.locale))
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := p.BuildInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Locale != tc.lang || info.TimeZone != tc.timeZone {
+			t.Errorf("Expected the plugin to run in %s and %s, got %s and %s", tc.lang, tc.timeZone, info.Locale, info.TimeZone)
+		}
+		for _, key := range []string{"LC_CTYPE", "LANGUAGE"} {
+			var value string
+			if err := p.Call("helper.Getenv", key, &value); err != nil || value != "" {
+				t.Errorf("Expected %s to be removed, got %q, %v", key, value, err)
+			}
+		}
+		p.Close()
+	}
+}
+
+func TestCurrentLocale(t *testing.T) {
+	t.Setenv("LANG", "de_DE.UTF-8")
+	t.Setenv("LC_ALL", "")
+	t.Setenv("TZ", "")
+	if b := CurrentBuildInfo(); b.Locale != "de_DE.UTF-8" || b.TimeZone != "" {
+		t.Errorf("Expected the locale from LANG and the default time zone, got %q and %q", b.Locale, b.TimeZone)
+	}
+	t.Setenv("LC_ALL", "C")
+	if b := CurrentBuildInfo(); b.Locale != "C" {
+		t.Errorf("Expected LC_ALL to override LANG, got %q", b.Locale)
+	}
+}
@@ -0,0 +1,680 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrUnknownPlugin is returned by a Manager asked about a plugin it is not
+// managing.
+var ErrUnknownPlugin = errors.New("unknown plugin")
+
+// ErrManagerShutDown is returned by Manager.Schedule once the Manager has been
+// shut down.
+var ErrManagerShutDown = errors.New("plugin manager is shut down")
+
+// PluginSpec describes a plugin for a Manager to run.
+type PluginSpec struct {
+	// Name identifies the plugin to the Manager, and is its name in the
+	// Manager's Catalog.
+	Name string
+	// Path is the plugin binary to run.  If it is empty, the plugin is
+	// downloaded from URL, or if that is empty too, the Manager installs the
+	// highest version in its Catalog that satisfies Constraint.
+	Path string
+	// URL is where to download the plugin from with the Manager's Fetcher
+	// when Path is empty.
+	URL string
+	// SHA256 is the digest of the plugin at URL.
+	SHA256 string
+	// Version is the version of the plugin at Path.  Plugins without a
+	// version are never updated.
+	Version string
+	// Constraint limits which versions from the catalog the plugin may be
+	// installed or updated to, such as ">= 1.2, < 2.0".  An empty constraint
+	// allows any version.
+	Constraint string
+	// Args are the arguments passed to the plugin.
+	Args []string
+	// Output receives the plugin's stderr.
+	Output io.Writer
+	// Options are passed to StartPlugin each time the plugin is started.
+	Options []StartOption
+	// Policy controls how the plugin is supervised.  Its OnEvent, if set, is
+	// called before the Manager's.
+	Policy Policy
+	// Quota limits the host's use of the plugin.  If it has no limits, the
+	// Manager's Quota applies.
+	Quota Quota
+	// DependsOn names the plugins this one depends on.  When the Manager
+	// shuts down, the plugin is stopped before them.
+	DependsOn []string
+	// StopTimeout, if positive, is how long the Manager waits for the plugin
+	// to stop when it shuts down, before reporting it with
+	// ErrShutdownTimeout and moving on.
+	StopTimeout time.Duration
+}
+
+// Update describes a newer version of a plugin available from a catalog.
+type Update struct {
+	Name string
+	// Current is the version running when the update was found.
+	Current string
+	// Artifact is the catalog's binary for the new version.
+	Artifact Artifact
+}
+
+// Manager runs a set of named plugins, each under its own Supervisor, and
+// keeps the ones installed from a Catalog up to date.
+type Manager struct {
+	// Plugins are the plugins started by StartAll.
+	Plugins []PluginSpec
+	// Catalog is where plugins are installed and updated from.  It may be nil
+	// if every plugin is started from a Path and updates are not wanted.
+	Catalog *Catalog
+	// Fetcher downloads and verifies plugins from the Catalog.  It defaults
+	// to a Fetcher with the default cache directory and HTTP client.
+	Fetcher *Fetcher
+	// OnEvent, if not nil, is called with the lifecycle events of every
+	// managed plugin, and with the Manager's own update events.  Each event's
+	// Name is set to the name of the plugin it concerns.  Like a Policy's
+	// OnEvent, it must not block.
+	OnEvent func(Event)
+	// Quota limits the host's use of each plugin whose spec has no Quota of
+	// its own.
+	Quota Quota
+	// StopParallelism is how many plugins Shutdown and Close stop at once.
+	// If it is zero or less, there is no limit.
+	StopParallelism int
+	// Bus, if not nil, is the event bus every plugin is attached to under its
+	// name each time it is started.  Plugins are started with WithMux so that
+	// they can be attached.
+	Bus *Bus
+	// Phases, if true, starts plugins with WithPhases, and makes StartAll
+	// initialize them all with Barrier before any of them takes calls.
+	// Plugins started after the barrier, and new instances of restarted,
+	// recycled, or updated plugins, are initialized on their own before
+	// they replace the old ones.
+	Phases bool
+	// Profiles are the named subsets of Plugins that StartProfile starts,
+	// such as "minimal" or "ci".
+	Profiles map[string]Profile
+
+	mu        sync.Mutex
+	plugins   map[string]*managed
+	schedules map[*schedule]bool
+	// shutDown records that Shutdown has been called, after which no jobs
+	// may be scheduled.
+	shutDown bool
+	// barrierPassed records that Barrier has let calls through to the
+	// plugins.
+	barrierPassed bool
+}
+
+// managed is a plugin run by a Manager.
+type managed struct {
+	sup *Supervisor
+	// quota, if not nil, tracks the plugin's usage of its Quota.
+	quota *quotaState
+
+	// updating is held while the plugin is being updated, so that concurrent
+	// updates of the same plugin happen one after the other.
+	updating sync.Mutex
+
+	mu   sync.Mutex
+	spec PluginSpec
+}
+
+// Start starts the plugin described by spec under a Supervisor.  If the spec
+// has no Path, the plugin is installed from the Manager's Catalog first.  If
+// ctx is done before the plugin has started, starting it is abandoned; once it
+// has started, ctx no longer matters.
+func (m *Manager) Start(ctx context.Context, spec PluginSpec) error {
+	if spec.Name == "" {
+		return errors.New("plugin spec has no name")
+	}
+	m.mu.Lock()
+	_, exists := m.plugins[spec.Name]
+	m.mu.Unlock()
+	if exists {
+		return fmt.Errorf("plugin %s is already running", spec.Name)
+	}
+	spec, err := m.locate(ctx, spec)
+	if err != nil {
+		return err
+	}
+	quota := spec.Quota
+	if quota == (Quota{}) {
+		quota = m.Quota
+	}
+	mp := &managed{spec: spec, quota: newQuotaState(spec.Name, quota)}
+	policy := spec.Policy
+	policy.OnEvent = func(e Event) {
+		if spec.Policy.OnEvent != nil {
+			spec.Policy.OnEvent(e)
+		}
+		e.Name = spec.Name
+		m.emit(e)
+	}
+	sup, err := Supervise(startFirstWithin(ctx, m.starter(spec)), policy)
+	if err != nil {
+		return err
+	}
+	mp.sup = sup
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.plugins[spec.Name]; exists {
+		sup.Close()
+		return fmt.Errorf("plugin %s is already running", spec.Name)
+	}
+	if m.plugins == nil {
+		m.plugins = map[string]*managed{}
+	}
+	m.plugins[spec.Name] = mp
+	return nil
+}
+
+// StartAll starts all of the Manager's Plugins concurrently, and waits until
+// each is ready, meaning it answers calls to pie's built-in control API.  If
+// any plugin fails to start or become ready before ctx is done, the others are
+// abandoned, the plugins already started are stopped, and the errors are
+// returned together.  If Phases is set, the plugins are then initialized with
+// Barrier, and a failure to initialize stops them the same way.
+func (m *Manager) StartAll(parent context.Context) error {
+	return m.startAll(parent, m.Plugins)
+}
+
+// startAll starts the plugins described by specs, as StartAll does.
+func (m *Manager) startAll(parent context.Context, specs []PluginSpec) error {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	errs := make([]error, len(specs))
+	started := make([]bool, len(specs))
+	var wg sync.WaitGroup
+	for i, spec := range specs {
+		wg.Add(1)
+		go func(i int, spec PluginSpec) {
+			defer wg.Done()
+			err := m.Start(ctx, spec)
+			if err == nil {
+				started[i] = true
+				err = m.waitReady(ctx, spec.Name)
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("plugin %s: %w", spec.Name, err)
+				cancel()
+			}
+		}(i, spec)
+	}
+	wg.Wait()
+
+	if m.Phases && ctx.Err() == nil {
+		if err := m.Barrier(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	var failed []error
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		// Plugins abandoned because another one failed only add noise.
+		if errors.Is(err, context.Canceled) && parent.Err() == nil {
+			continue
+		}
+		failed = append(failed, err)
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	for i, spec := range specs {
+		if started[i] {
+			m.Stop(spec.Name)
+		}
+	}
+	return errors.Join(failed...)
+}
+
+// waitReady waits until the named plugin answers a ping, or until ctx is done.
+// Plugins that do not serve pie's control API are ready as soon as they have
+// started.
+func (m *Manager) waitReady(ctx context.Context, name string) error {
+	sup, err := m.Supervisor(name)
+	if err != nil {
+		return err
+	}
+	p, err := sup.Plugin()
+	if err != nil {
+		return err
+	}
+	return p.ping(ctx)
+}
+
+// Barrier initializes every managed plugin with the function Barrier, so
+// that none of them takes calls until all of them have initialized.  Once it
+// has succeeded, plugins started later initialize and start serving on their
+// own.  It is called by StartAll when Phases is set.
+func (m *Manager) Barrier(ctx context.Context) error {
+	m.mu.Lock()
+	names := make([]string, 0, len(m.plugins))
+	for name := range m.plugins {
+		names = append(names, name)
+	}
+	m.mu.Unlock()
+	plugins := make([]*Plugin, 0, len(names))
+	for _, name := range names {
+		p, err := m.current(name)
+		if err != nil {
+			return fmt.Errorf("plugin %s: %w", name, err)
+		}
+		plugins = append(plugins, p)
+	}
+	err := Barrier(ctx, plugins...)
+	for i, p := range plugins {
+		if werr := p.WarmUpErr(); werr != nil {
+			m.emit(Event{Kind: EventWarmUpFailed, Name: names[i], Plugin: p, Err: werr})
+		}
+	}
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.barrierPassed = true
+	m.mu.Unlock()
+	return nil
+}
+
+// current returns the current instance of the named plugin.
+func (m *Manager) current(name string) (*Plugin, error) {
+	mp, err := m.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return mp.sup.Plugin()
+}
+
+// Stop stops the named plugin and forgets it.
+func (m *Manager) Stop(name string) error {
+	m.mu.Lock()
+	mp, ok := m.plugins[name]
+	delete(m.plugins, name)
+	m.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("plugin %s: %w", name, ErrUnknownPlugin)
+	}
+	return mp.sup.Close()
+}
+
+// Supervisor returns the Supervisor of the named plugin.
+func (m *Manager) Supervisor(name string) (*Supervisor, error) {
+	mp, err := m.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return mp.sup, nil
+}
+
+// Call invokes the named function on the named plugin.  If the call would
+// exceed the plugin's Quota, it is not made, and a *QuotaError is returned.
+func (m *Manager) Call(name, serviceMethod string, args interface{}, reply interface{}) error {
+	mp, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	if mp.quota == nil {
+		return mp.sup.Call(serviceMethod, args, reply)
+	}
+	p, err := mp.sup.Plugin()
+	if err != nil {
+		return err
+	}
+	if qerr, report := mp.quota.admitCall(p); qerr != nil {
+		m.reportQuota(qerr, report)
+		return qerr
+	}
+	err = mp.sup.Call(serviceMethod, args, reply)
+	mp.quota.done(p)
+	return err
+}
+
+// OpenChannel opens a stream with the given name to the named plugin, which
+// must have been started with WithMux.  If the stream would exceed the
+// plugin's Quota, it is not opened, and a *QuotaError is returned.
+func (m *Manager) OpenChannel(name, channel string) (*Stream, error) {
+	mp, err := m.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	p, err := mp.sup.Plugin()
+	if err != nil {
+		return nil, err
+	}
+	if mp.quota == nil {
+		return p.OpenChannel(channel)
+	}
+	if qerr, report := mp.quota.admitStream(); qerr != nil {
+		m.reportQuota(qerr, report)
+		return nil, qerr
+	}
+	s, err := p.OpenChannel(channel)
+	if err != nil {
+		mp.quota.closeStream()
+		return nil, err
+	}
+	s.onClose = mp.quota.closeStream
+	return s, nil
+}
+
+// BrokerStream connects the named plugins with a connection of their own, as
+// the function BrokerStream does for the plugins' current instances.
+func (m *Manager) BrokerStream(from, to, name string) error {
+	var ps [2]*Plugin
+	for i, n := range []string{from, to} {
+		mp, err := m.lookup(n)
+		if err != nil {
+			return err
+		}
+		if ps[i], err = mp.sup.Plugin(); err != nil {
+			return err
+		}
+	}
+	return BrokerStream(ps[0], ps[1], name)
+}
+
+// reportQuota emits an event for a quota error, if report is true.
+func (m *Manager) reportQuota(qerr *QuotaError, report bool) {
+	if report {
+		m.emit(Event{Kind: EventQuotaExceeded, Name: qerr.Name, Err: qerr})
+	}
+}
+
+// Version returns the version of the named plugin that is running, which is
+// empty for plugins that were started without one.
+func (m *Manager) Version(name string) (string, error) {
+	mp, err := m.lookup(name)
+	if err != nil {
+		return "", err
+	}
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return mp.spec.Version, nil
+}
+
+// Close stops the scheduled jobs and all the managed plugins, as Shutdown
+// does, and returns the errors encountered, joined with errors.Join.
+func (m *Manager) Close() error {
+	_, err := m.Shutdown(context.Background())
+	return err
+}
+
+// CheckUpdates looks in the Manager's Catalog for a newer version of each
+// versioned plugin that satisfies the plugin's Constraint.  It emits an
+// EventUpdateAvailable for each one found, and returns them sorted by name.
+// Nothing is downloaded or changed; use Update to apply an update.
+func (m *Manager) CheckUpdates(ctx context.Context) ([]Update, error) {
+	if m.Catalog == nil {
+		return nil, errors.New("plugin manager has no catalog")
+	}
+	index, err := m.Catalog.Index(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	var names []string
+	for name := range m.plugins {
+		names = append(names, name)
+	}
+	m.mu.Unlock()
+	sort.Strings(names)
+
+	var updates []Update
+	for _, name := range names {
+		mp, err := m.lookup(name)
+		if err != nil {
+			continue
+		}
+		u, err := mp.available(index)
+		if err != nil {
+			return updates, err
+		}
+		if u == nil {
+			continue
+		}
+		updates = append(updates, *u)
+		m.emit(Event{Kind: EventUpdateAvailable, Name: name, Update: u})
+	}
+	return updates, nil
+}
+
+// Update installs the newest version of the named plugin that satisfies its
+// Constraint, if it is newer than the version running, and hot-swaps it in
+// with Supervisor.Replace.  The new binary's digest is verified against the
+// catalog, and it must pass Preflight before the running version is replaced.
+// Update reports whether the plugin was updated; on failure, it emits an
+// EventUpdateFailed and the plugin keeps running its current version.
+func (m *Manager) Update(ctx context.Context, name string) (bool, error) {
+	if m.Catalog == nil {
+		return false, errors.New("plugin manager has no catalog")
+	}
+	mp, err := m.lookup(name)
+	if err != nil {
+		return false, err
+	}
+	mp.updating.Lock()
+	defer mp.updating.Unlock()
+
+	index, err := m.Catalog.Index(ctx)
+	if err != nil {
+		return false, err
+	}
+	u, err := mp.available(index)
+	if err != nil || u == nil {
+		return false, err
+	}
+	if err := m.apply(ctx, mp, u); err != nil {
+		m.emit(Event{Kind: EventUpdateFailed, Name: name, Err: err, Update: u})
+		return false, err
+	}
+	m.emit(Event{Kind: EventUpdated, Name: name, Update: u})
+	return true, nil
+}
+
+// apply downloads the update u and swaps it in for mp's running version.
+func (m *Manager) apply(ctx context.Context, mp *managed, u *Update) error {
+	path, err := m.fetcher().Fetch(ctx, u.Artifact.URL, u.Artifact.SHA256)
+	if err != nil {
+		return err
+	}
+	if err := Preflight(path); err != nil {
+		return err
+	}
+	mp.mu.Lock()
+	spec := mp.spec
+	mp.mu.Unlock()
+	spec.Path = path
+	spec.Version = u.Artifact.Version
+	if err := mp.sup.Replace(startFirstWithin(ctx, m.starter(spec))); err != nil {
+		return err
+	}
+	mp.mu.Lock()
+	mp.spec = spec
+	mp.mu.Unlock()
+	return nil
+}
+
+// currentSpec returns the spec of the plugin that is running.
+func (mp *managed) currentSpec() PluginSpec {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return mp.spec
+}
+
+// available returns the update to mp in index, or nil if mp is unversioned or
+// already running the newest compatible version.
+func (mp *managed) available(index *CatalogIndex) (*Update, error) {
+	mp.mu.Lock()
+	spec := mp.spec
+	mp.mu.Unlock()
+	if spec.Version == "" {
+		return nil, nil
+	}
+	current, err := ParseVersion(spec.Version)
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s has invalid version: %w", spec.Name, err)
+	}
+	constraint, err := ParseConstraint(spec.Constraint)
+	if err != nil {
+		return nil, err
+	}
+	a, err := index.Resolve(spec.Name, constraint)
+	if errors.Is(err, ErrNoMatchingVersion) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if v, _ := ParseVersion(a.Version); !current.Less(v) {
+		return nil, nil
+	}
+	return &Update{Name: spec.Name, Current: spec.Version, Artifact: a}, nil
+}
+
+// resolve finds the artifact in the Manager's Catalog to install spec from.
+func (m *Manager) resolve(ctx context.Context, spec PluginSpec) (Artifact, error) {
+	if m.Catalog == nil {
+		return Artifact{}, fmt.Errorf("plugin %s has no path and the manager has no catalog", spec.Name)
+	}
+	constraint, err := ParseConstraint(spec.Constraint)
+	if err != nil {
+		return Artifact{}, err
+	}
+	index, err := m.Catalog.Index(ctx)
+	if err != nil {
+		return Artifact{}, err
+	}
+	return index.Resolve(spec.Name, constraint)
+}
+
+// locate returns spec with its Path set to the plugin's binary, downloading it
+// from its URL or installing it from the Catalog if it has no Path.
+func (m *Manager) locate(ctx context.Context, spec PluginSpec) (PluginSpec, error) {
+	if spec.Path == "" && spec.URL != "" {
+		path, err := m.fetcher().Fetch(ctx, spec.URL, spec.SHA256)
+		if err != nil {
+			return spec, err
+		}
+		spec.Path = path
+	}
+	if spec.Path == "" {
+		a, err := m.resolve(ctx, spec)
+		if err != nil {
+			return spec, err
+		}
+		if spec.Path, err = m.fetcher().Fetch(ctx, a.URL, a.SHA256); err != nil {
+			return spec, err
+		}
+		spec.Version = a.Version
+	}
+	return spec, nil
+}
+
+// lookup returns the named managed plugin.
+func (m *Manager) lookup(name string) (*managed, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mp, ok := m.plugins[name]
+	if !ok {
+		return nil, fmt.Errorf("plugin %s: %w", name, ErrUnknownPlugin)
+	}
+	return mp, nil
+}
+
+// fetcher returns the Fetcher used to download plugins.
+func (m *Manager) fetcher() *Fetcher {
+	if m.Fetcher != nil {
+		return m.Fetcher
+	}
+	return &Fetcher{}
+}
+
+// emit sends e to the Manager's event handler, if there is one.
+func (m *Manager) emit(e Event) {
+	if m.OnEvent == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	m.OnEvent(e)
+}
+
+// starter returns a function that starts the plugin described by spec and
+// attaches it to the Manager's Bus.
+func (m *Manager) starter(spec PluginSpec) func(ctx context.Context) (*Plugin, error) {
+	if m.Bus == nil && !m.Phases {
+		return spec.starter()
+	}
+	spec.Options = spec.Options[:len(spec.Options):len(spec.Options)]
+	if m.Bus != nil {
+		spec.Options = append(spec.Options, WithMux())
+	}
+	if m.Phases {
+		spec.Options = append(spec.Options, WithPhases())
+	}
+	start := spec.starter()
+	return func(ctx context.Context) (*Plugin, error) {
+		p, err := start(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if m.Bus != nil {
+			if err := m.Bus.Attach(spec.Name, p); err != nil {
+				p.Close()
+				return nil, fmt.Errorf("attaching plugin %s to the bus: %w", spec.Name, err)
+			}
+		}
+		m.mu.Lock()
+		passed := m.barrierPassed
+		m.mu.Unlock()
+		if m.Phases && passed {
+			if err := p.Init(context.Background()); err != nil {
+				p.Close()
+				return nil, err
+			}
+			if err := p.StartServing(); err != nil {
+				p.Close()
+				return nil, err
+			}
+		}
+		return p, nil
+	}
+}
+
+// starter returns a function that starts the plugin described by spec,
+// abandoning the start if ctx is done first.
+func (spec PluginSpec) starter() func(ctx context.Context) (*Plugin, error) {
+	return func(ctx context.Context) (*Plugin, error) {
+		return startPluginWithin(ctx, spec.Output, spec.Path, spec.Args, spec.Options)
+	}
+}
+
+// startFirstWithin returns a start function for Supervise and Replace, which
+// start the first instance before they return: the first instance is started
+// with start bounded by ctx, and the restarts that follow without a bound.
+func startFirstWithin(ctx context.Context, start func(context.Context) (*Plugin, error)) func() (*Plugin, error) {
+	var started int32
+	return func() (*Plugin, error) {
+		if atomic.CompareAndSwapInt32(&started, 0, 1) {
+			return start(ctx)
+		}
+		return start(context.Background())
+	}
+}
@@ -0,0 +1,218 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newUpdateCatalog serves the test binary as versions 1.1.0 and 2.0.0 of the
+// plugin foo, and returns a Manager using the catalog and a Fetcher for it.
+// If digest is not empty, it is published as the digest of version 1.1.0.
+func newUpdateCatalog(t *testing.T, digest string) *Manager {
+	data, err := os.ReadFile(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, _ := newPluginServer(t, data)
+	if digest == "" {
+		digest = sha256Hex(data)
+	}
+	c := newCatalogServer(t, &CatalogIndex{Plugins: map[string]CatalogPlugin{
+		"foo": {Versions: []CatalogVersion{
+			{Version: "1.0.0", Artifacts: []Artifact{hostArtifact(srv.URL+"/foo", sha256Hex(data))}},
+			{Version: "1.1.0", Artifacts: []Artifact{hostArtifact(srv.URL+"/foo", digest)}},
+			{Version: "2.0.0", Artifacts: []Artifact{hostArtifact(srv.URL+"/foo", sha256Hex(data))}},
+		}},
+	}})
+	return &Manager{
+		Catalog: c,
+		Fetcher: &Fetcher{CacheDir: t.TempDir(), Client: srv.Client()},
+	}
+}
+
+// fooSpec is version 1.0.0 of the plugin foo, run from the test binary and
+// limited to 1.x versions.
+func fooSpec() PluginSpec {
+	return PluginSpec{
+		Name:       "foo",
+		Path:       os.Args[0],
+		Version:    "1.0.0",
+		Constraint: "< 2.0",
+		Args:       helperArgs("provider"),
+	}
+}
+
+func TestManagerUpdate(t *testing.T) {
+	events := newEventRecorder()
+	m := newUpdateCatalog(t, "")
+	m.OnEvent = events.record
+	ctx := context.Background()
+	if err := m.Start(ctx, fooSpec()); err != nil {
+		t.Fatalf("Unexpected error from Start: %#v", err)
+	}
+	defer m.Close()
+	if e := events.waitFor(t, EventStarted); e.Name != "foo" {
+		t.Errorf("Wrong plugin name in started event, expected foo, got %q", e.Name)
+	}
+
+	updates, err := m.CheckUpdates(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error from CheckUpdates: %#v", err)
+	}
+	if len(updates) != 1 || updates[0].Name != "foo" || updates[0].Current != "1.0.0" || updates[0].Artifact.Version != "1.1.0" {
+		t.Fatalf("Wrong updates, expected foo 1.0.0 -> 1.1.0, got %#v", updates)
+	}
+	events.waitFor(t, EventUpdateAvailable)
+
+	sup, _ := m.Supervisor("foo")
+	old, _ := sup.Plugin()
+	updated, err := m.Update(ctx, "foo")
+	if err != nil || !updated {
+		t.Fatalf("Expected Update to update foo, got %v, %#v", updated, err)
+	}
+	if e := events.waitFor(t, EventUpdated); e.Update.Artifact.Version != "1.1.0" {
+		t.Errorf("Wrong version in updated event: %#v", e.Update)
+	}
+	if v, _ := m.Version("foo"); v != "1.1.0" {
+		t.Errorf("Wrong version after Update, expected 1.1.0, got %q", v)
+	}
+	select {
+	case <-old.Exited():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Old version of plugin did not exit")
+	}
+	var response string
+	if err := m.Call("foo", "api.SayHi", "bob", &response); err != nil {
+		t.Fatalf("Unexpected error calling updated plugin: %#v", err)
+	}
+	if response != "Hi bob" {
+		t.Errorf("Wrong response from updated plugin, got %q", response)
+	}
+
+	if updated, err := m.Update(ctx, "foo"); err != nil || updated {
+		t.Errorf("Expected no update for up to date plugin, got %v, %#v", updated, err)
+	}
+}
+
+func TestManagerUpdateBadDigest(t *testing.T) {
+	events := newEventRecorder()
+	m := newUpdateCatalog(t, sha256Hex([]byte("something else")))
+	m.OnEvent = events.record
+	ctx := context.Background()
+	if err := m.Start(ctx, fooSpec()); err != nil {
+		t.Fatalf("Unexpected error from Start: %#v", err)
+	}
+	defer m.Close()
+
+	_, err := m.Update(ctx, "foo")
+	var mismatch *DigestMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("Expected a *DigestMismatchError from Update, got %#v", err)
+	}
+	events.waitFor(t, EventUpdateFailed)
+	if v, _ := m.Version("foo"); v != "1.0.0" {
+		t.Errorf("Failed update changed version to %q", v)
+	}
+	var response string
+	if err := m.Call("foo", "api.SayHi", "bob", &response); err != nil {
+		t.Errorf("Unexpected error calling plugin after failed update: %#v", err)
+	}
+}
+
+func TestManagerStartFromCatalog(t *testing.T) {
+	m := newUpdateCatalog(t, "")
+	spec := fooSpec()
+	spec.Path, spec.Version = "", ""
+	if err := m.Start(context.Background(), spec); err != nil {
+		t.Fatalf("Unexpected error from Start: %#v", err)
+	}
+	defer m.Close()
+	if v, _ := m.Version("foo"); v != "1.1.0" {
+		t.Errorf("Wrong version installed, expected 1.1.0, got %q", v)
+	}
+	if err := m.Start(context.Background(), spec); err == nil {
+		t.Error("Expected an error starting a plugin twice")
+	}
+	if err := m.Call("bar", "api.SayHi", "bob", new(string)); !errors.Is(err, ErrUnknownPlugin) {
+		t.Errorf("Expected ErrUnknownPlugin calling unknown plugin, got %#v", err)
+	}
+}
+
+// helperSpec is a plugin spec that runs the test binary in the given mode.
+func helperSpec(name, mode string) PluginSpec {
+	return PluginSpec{Name: name, Path: os.Args[0], Args: helperArgs(mode)}
+}
+
+func TestManagerStartAll(t *testing.T) {
+	m := &Manager{Plugins: []PluginSpec{
+		helperSpec("a", "provider"),
+		helperSpec("b", "provider"),
+	}}
+	if err := m.StartAll(context.Background()); err != nil {
+		t.Fatalf("Unexpected error from StartAll: %#v", err)
+	}
+	defer m.Close()
+	for _, name := range []string{"a", "b"} {
+		var response string
+		if err := m.Call(name, "api.SayHi", "bob", &response); err != nil {
+			t.Errorf("Unexpected error calling plugin %s: %#v", name, err)
+		}
+	}
+}
+
+func TestManagerStartAllRollback(t *testing.T) {
+	m := &Manager{Plugins: []PluginSpec{
+		helperSpec("good", "provider"),
+		helperSpec("deaf", "deaf"),
+		helperSpec("bad", "exit"),
+	}}
+	err := m.StartAll(context.Background())
+	if err == nil {
+		m.Close()
+		t.Fatal("Expected an error from StartAll with a failing plugin")
+	}
+	if !strings.Contains(err.Error(), "plugin bad") {
+		t.Errorf("Expected error to name the failed plugin, got %q", err)
+	}
+	if errors.Is(err, context.Canceled) {
+		t.Errorf("Expected abandoned plugins to be left out of the error, got %q", err)
+	}
+	for _, name := range []string{"good", "deaf", "bad"} {
+		if _, err := m.Supervisor(name); !errors.Is(err, ErrUnknownPlugin) {
+			t.Errorf("Expected plugin %s to be stopped after rollback, got %#v", name, err)
+		}
+	}
+}
+
+func TestManagerStartAllSlowStart(t *testing.T) {
+	// A plugin that never answers holds up codec negotiation, which is part of
+	// starting it.
+	spec := helperSpec("deaf", "deaf")
+	spec.Options = []StartOption{WithCodecs("gob"), WithTimeouts(Timeouts{Stop: 10 * time.Millisecond})}
+	m := &Manager{Plugins: []PluginSpec{spec}}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- m.StartAll(ctx) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected a deadline exceeded error from StartAll, got %#v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("StartAll did not return once ctx was done")
+	}
+}
+
+func TestManagerStartAllTimeout(t *testing.T) {
+	m := &Manager{Plugins: []PluginSpec{helperSpec("deaf", "deaf")}}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := m.StartAll(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected a deadline exceeded error from StartAll, got %#v", err)
+	}
+}
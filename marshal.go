@@ -0,0 +1,231 @@
+package pie
+
+import (
+	"fmt"
+	"net/rpc"
+	"reflect"
+	"sync"
+)
+
+// A codec has to handle any type, which makes it slower for any one type than
+// code written for it.  When one or two types dominate a plugin's traffic,
+// such as a big matrix, a Marshaler written for each can encode them instead.
+// The codec then only carries the bytes the Marshaler produced, wrapped in a
+// marshaledBody.  Which Marshalers are used is negotiated by name when the
+// plugin starts, since both sides must encode a type the same way.
+
+// selectMarshalersMethod is the control method a host calls to negotiate
+// Marshalers.  The provider's dispatcher answers it itself, since the bodies
+// it reads change when it does.
+const selectMarshalersMethod = controlService + ".SelectMarshalers"
+
+// Marshaler encodes and decodes the values of a Go type registered with
+// RegisterMarshaler.
+type Marshaler interface {
+	// Marshal encodes v, which is a value of the registered type or a
+	// pointer to one.
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal decodes data into v, which is a pointer to a value of the
+	// registered type.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// marshaledBody carries a request or response body encoded by a Marshaler.
+type marshaledBody struct {
+	Data []byte
+}
+
+// registeredMarshaler is a Marshaler registered with RegisterMarshaler.
+type registeredMarshaler struct {
+	name string
+	typ  reflect.Type
+	m    Marshaler
+}
+
+var (
+	marshalersMu sync.RWMutex
+	marshalers   = map[string]registeredMarshaler{}
+)
+
+// RegisterMarshaler registers m under name, such as "matrix/v1", to encode and
+// decode the arguments and replies of the type of sample, or of pointers to
+// it, in place of the codec.  The host and the plugin must both register a
+// Marshaler under the same name for it to be used with a plugin; a host asks
+// for it with WithMarshalers.  Registering a name again replaces the Marshaler
+// registered under it.
+func RegisterMarshaler(name string, sample interface{}, m Marshaler) {
+	t := reflect.TypeOf(sample)
+	if t == nil {
+		panic("pie: RegisterMarshaler of nil sample")
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	marshalersMu.Lock()
+	defer marshalersMu.Unlock()
+	marshalers[name] = registeredMarshaler{name: name, typ: t, m: m}
+}
+
+// lookupMarshaler returns the Marshaler registered under name.
+func lookupMarshaler(name string) (registeredMarshaler, bool) {
+	marshalersMu.RLock()
+	defer marshalersMu.RUnlock()
+	m, ok := marshalers[name]
+	return m, ok
+}
+
+// WithMarshalers makes the handle negotiate the use of the named Marshalers,
+// registered with RegisterMarshaler, once the plugin has started.  Those the
+// plugin has also registered encode the values of their types in both
+// directions.  Marshalers require a provider created with NewProvider or
+// NewProviderConn; with providers made by a version of this package that
+// cannot negotiate them, none are used.
+func WithMarshalers(names ...string) StartOption {
+	return func(o *startOptions) {
+		o.marshalers = names
+	}
+}
+
+// typeMarshalers are the Marshalers in use on a connection, by type.
+type typeMarshalers map[reflect.Type]Marshaler
+
+// newTypeMarshalers returns the Marshalers registered under names, and the
+// names for which one is registered.
+func newTypeMarshalers(names []string) (typeMarshalers, []string) {
+	tm := typeMarshalers{}
+	var found []string
+	for _, name := range names {
+		if m, ok := lookupMarshaler(name); ok {
+			tm[m.typ] = m.m
+			found = append(found, name)
+		}
+	}
+	return tm, found
+}
+
+// forBody returns the Marshaler for body, whose type is a registered type or
+// a pointer to one, possibly through further pointers, or nil.
+func (tm typeMarshalers) forBody(body interface{}) Marshaler {
+	if len(tm) == 0 || body == nil {
+		return nil
+	}
+	t := reflect.TypeOf(body)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return tm[t]
+}
+
+// single returns v with any pointers to pointers followed, so that it is a
+// value or a single pointer.  If alloc is set, nil pointers on the way are
+// set to new values, as decoding does.
+func single(v interface{}, alloc bool) interface{} {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr && !rv.IsNil() && rv.Elem().Kind() == reflect.Ptr {
+		if rv.Elem().IsNil() {
+			if !alloc {
+				break
+			}
+			rv.Elem().Set(reflect.New(rv.Elem().Type().Elem()))
+		}
+		rv = rv.Elem()
+	}
+	return rv.Interface()
+}
+
+// marshal returns what to give the codec to encode body with: body itself, or
+// body encoded by its Marshaler.
+func (tm typeMarshalers) marshal(body interface{}) (interface{}, error) {
+	m := tm.forBody(body)
+	if m == nil {
+		return body, nil
+	}
+	data, err := m.Marshal(single(body, false))
+	if err != nil {
+		return nil, fmt.Errorf("pie: marshaling %T: %w", body, err)
+	}
+	return &marshaledBody{Data: data}, nil
+}
+
+// readBody reads a body into body with read, decoding it with the Marshaler
+// for body if there is one.
+func (tm typeMarshalers) readBody(body interface{}, read func(interface{}) error) error {
+	m := tm.forBody(body)
+	if m == nil {
+		return read(body)
+	}
+	var mb marshaledBody
+	if err := read(&mb); err != nil {
+		return err
+	}
+	if err := m.Unmarshal(mb.Data, single(body, true)); err != nil {
+		return fmt.Errorf("pie: unmarshaling %T: %w", body, err)
+	}
+	return nil
+}
+
+// setMarshalers makes the codec encode the arguments and decode the replies
+// with the types of tm with their Marshalers.
+func (c *clientCodec) setMarshalers(tm typeMarshalers) {
+	c.marshalers.Store(tm)
+}
+
+// usedMarshalers returns the Marshalers the codec uses.
+func (c *clientCodec) usedMarshalers() typeMarshalers {
+	tm, _ := c.marshalers.Load().(typeMarshalers)
+	return tm
+}
+
+// negotiateMarshalers asks the plugin which of the Marshalers named, that the
+// host has registered, it can use too, and starts using those.
+func (p *Plugin) negotiateMarshalers(names []string) error {
+	tm, offered := newTypeMarshalers(names)
+	if len(offered) == 0 {
+		return nil
+	}
+	var accepted []string
+	if err := p.client.Call(selectMarshalersMethod, offered, &accepted); err != nil {
+		if isMissingMethod(err) {
+			return nil
+		}
+		return fmt.Errorf("pie: negotiating marshalers: %w", err)
+	}
+	use := typeMarshalers{}
+	for _, name := range accepted {
+		m, ok := lookupMarshaler(name)
+		if !ok || tm[m.typ] == nil {
+			return fmt.Errorf("pie: plugin chose marshaler %q, which was not offered", name)
+		}
+		use[m.typ] = m.m
+	}
+	p.codec.setMarshalers(use)
+	return nil
+}
+
+// selectMarshalers answers a host's SelectMarshalers call, whose header has
+// been read, and starts using the Marshalers both sides have.
+func (c *dispatchCodec) selectMarshalers(r *rpc.Request) error {
+	var offered []string
+	if err := c.ServerCodec.ReadRequestBody(&offered); err != nil {
+		return err
+	}
+	tm, accepted := newTypeMarshalers(offered)
+	c.sending.Lock()
+	defer c.sending.Unlock()
+	if accepted == nil {
+		accepted = []string{}
+	}
+	if err := c.ServerCodec.WriteResponse(&rpc.Response{ServiceMethod: r.ServiceMethod, Seq: r.Seq}, &accepted); err != nil {
+		return err
+	}
+	// The host makes no calls that the Marshalers apply to until it has the
+	// reply.
+	c.marshalers.Store(tm)
+	return nil
+}
+
+// usedMarshalers returns the Marshalers the codec uses.
+func (c *dispatchCodec) usedMarshalers() typeMarshalers {
+	tm, _ := c.marshalers.Load().(typeMarshalers)
+	return tm
+}
@@ -0,0 +1,172 @@
+package pie
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// Matrix is a type with a Marshaler of its own.
+type Matrix struct {
+	Rows, Cols int
+	Data       []float64
+}
+
+// matrixMarshaler encodes Matrix values as their dimensions and data in
+// binary, counting its calls.
+type matrixMarshaler struct {
+	marshals, unmarshals int32
+}
+
+func (mm *matrixMarshaler) Marshal(v interface{}) ([]byte, error) {
+	atomic.AddInt32(&mm.marshals, 1)
+	var m Matrix
+	switch v := v.(type) {
+	case Matrix:
+		m = v
+	case *Matrix:
+		m = *v
+	default:
+		return nil, errors.New("not a matrix")
+	}
+	if m.Rows < 0 {
+		return nil, errors.New("negative rows")
+	}
+	b := binary.BigEndian.AppendUint32(nil, uint32(m.Rows))
+	b = binary.BigEndian.AppendUint32(b, uint32(m.Cols))
+	for _, f := range m.Data {
+		b = binary.BigEndian.AppendUint64(b, math.Float64bits(f))
+	}
+	return b, nil
+}
+
+func (mm *matrixMarshaler) Unmarshal(data []byte, v interface{}) error {
+	atomic.AddInt32(&mm.unmarshals, 1)
+	m := v.(*Matrix)
+	if len(data) < 8 || (len(data)-8)%8 != 0 {
+		return errors.New("bad matrix")
+	}
+	m.Rows = int(binary.BigEndian.Uint32(data))
+	m.Cols = int(binary.BigEndian.Uint32(data[4:]))
+	m.Data = make([]float64, (len(data)-8)/8)
+	for i := range m.Data {
+		m.Data[i] = math.Float64frombits(binary.BigEndian.Uint64(data[8+8*i:]))
+	}
+	return nil
+}
+
+type matrixAPI struct{}
+
+func (matrixAPI) Transpose(m Matrix, reply *Matrix) error {
+	reply.Rows, reply.Cols = m.Cols, m.Rows
+	reply.Data = make([]float64, len(m.Data))
+	for r := 0; r < m.Rows; r++ {
+		for c := 0; c < m.Cols; c++ {
+			reply.Data[c*m.Rows+r] = m.Data[r*m.Cols+c]
+		}
+	}
+	return nil
+}
+
+func (a matrixAPI) TransposeCtx(ctx context.Context, m *Matrix) (Matrix, error) {
+	var reply Matrix
+	err := a.Transpose(*m, &reply)
+	return reply, err
+}
+
+func (matrixAPI) Broken(n int, reply *Matrix) error {
+	reply.Rows = -1
+	return nil
+}
+
+// matrixServer returns a provider serving matrixAPI.
+func matrixServer() Server {
+	s := NewProvider()
+	s.RegisterName("matrix", matrixAPI{})
+	return s
+}
+
+func checkTranspose(t *testing.T, p *Plugin, method string) {
+	t.Helper()
+	m := Matrix{Rows: 2, Cols: 3, Data: []float64{1, 2, 3, 4, 5, 6}}
+	var got Matrix
+	if err := p.Call(method, m, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []float64{1, 4, 2, 5, 3, 6}
+	if got.Rows != 3 || got.Cols != 2 || len(got.Data) != len(want) {
+		t.Fatalf("Unexpected transpose %+v", got)
+	}
+	for i := range want {
+		if got.Data[i] != want[i] {
+			t.Fatalf("Unexpected transpose %+v", got)
+		}
+	}
+}
+
+func TestMarshalers(t *testing.T) {
+	mm := &matrixMarshaler{}
+	RegisterMarshaler("test-matrix", Matrix{}, mm)
+	p := pipePlugin(t, matrixServer(), WithMarshalers("test-matrix", "test-unregistered"))
+	checkTranspose(t, p, "matrix.Transpose")
+	checkTranspose(t, p, "matrix.TransposeCtx")
+	// Each call's argument and reply are marshaled on one side and
+	// unmarshaled on the other.
+	if mm.marshals != 4 || mm.unmarshals != 4 {
+		t.Errorf("Expected 4 marshals and 4 unmarshals, got %d and %d", mm.marshals, mm.unmarshals)
+	}
+}
+
+func TestMarshalersNotRequested(t *testing.T) {
+	mm := &matrixMarshaler{}
+	RegisterMarshaler("test-matrix-unused", Matrix{}, mm)
+	p := pipePlugin(t, matrixServer())
+	checkTranspose(t, p, "matrix.Transpose")
+	if mm.marshals != 0 || mm.unmarshals != 0 {
+		t.Errorf("Marshaler used without being negotiated")
+	}
+}
+
+func TestMarshalersWithParallelDecode(t *testing.T) {
+	mm := &matrixMarshaler{}
+	RegisterMarshaler("test-matrix-json", Matrix{}, mm)
+	p := pipePlugin(t, matrixServer(), WithCodecs("json"), WithParallelDecode(2), WithMarshalers("test-matrix-json"))
+	checkTranspose(t, p, "matrix.Transpose")
+	if mm.marshals != 2 || mm.unmarshals != 2 {
+		t.Errorf("Expected 2 marshals and 2 unmarshals, got %d and %d", mm.marshals, mm.unmarshals)
+	}
+}
+
+func TestMarshalerError(t *testing.T) {
+	RegisterMarshaler("test-matrix-error", Matrix{}, &matrixMarshaler{})
+	p := pipePlugin(t, matrixServer(), WithMarshalers("test-matrix-error"))
+	var got Matrix
+	err := p.Call("matrix.Broken", 1, &got)
+	if err == nil || !strings.Contains(err.Error(), "negative rows") {
+		t.Fatalf("Expected the marshaler's error, got %v", err)
+	}
+	if err := p.Call("matrix.Transpose", Matrix{Rows: -1}, &got); err == nil {
+		t.Fatal("Expected an error marshaling the argument")
+	}
+	checkTranspose(t, p, "matrix.Transpose")
+}
+
+func TestMarshalersOldProvider(t *testing.T) {
+	RegisterMarshaler("test-matrix-old", Matrix{}, &matrixMarshaler{})
+	serverConn, clientConn := net.Pipe()
+	s := rpc.NewServer()
+	s.RegisterName("matrix", matrixAPI{})
+	go s.ServeConn(serverConn)
+	p, err := NewPlugin(clientConn, WithMarshalers("test-matrix-old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	checkTranspose(t, p, "matrix.Transpose")
+}
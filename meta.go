@@ -0,0 +1,76 @@
+package pie
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Calls can carry metadata for a provider's dispatcher in their service
+// method, after the method's name and a '?', in URL query form, such as
+// "Service.Method?notify=1".  Method names never contain '?', so providers
+// that do not understand metadata reject such calls as calls to an unknown
+// method rather than misinterpreting them.
+
+// callMeta is the metadata of a call.
+type callMeta struct {
+	// present reports whether the call carried any metadata.
+	present bool
+	// notify marks a notification, which gets no response.
+	notify bool
+	// key, if not empty, is the ordering key of the call.  Calls with the
+	// same key are run one at a time, in the order they arrive.
+	key string
+	// group, if not empty, is the ID of the call group the call is part of.
+	group string
+	// token, if not empty, is the capability token the call is made with.
+	token string
+	// idem, if not empty, is the idempotency key of the call.
+	idem string
+	// rid, if not empty, is the request ID of the call.
+	rid string
+}
+
+// splitMeta splits serviceMethod into the method's name and its metadata.
+func splitMeta(serviceMethod string) (string, callMeta) {
+	i := strings.IndexByte(serviceMethod, '?')
+	if i < 0 {
+		return serviceMethod, callMeta{}
+	}
+	q, _ := url.ParseQuery(serviceMethod[i+1:])
+	return serviceMethod[:i], callMeta{
+		present: true,
+		notify:  q.Get("notify") != "",
+		key:     q.Get("key"),
+		group:   q.Get("group"),
+		token:   q.Get("cap"),
+		idem:    q.Get("idem"),
+		rid:     q.Get("rid"),
+	}
+}
+
+// encode returns serviceMethod with the metadata appended.
+func (m callMeta) encode(serviceMethod string) string {
+	q := url.Values{}
+	if m.notify {
+		q.Set("notify", "1")
+	}
+	if m.key != "" {
+		q.Set("key", m.key)
+	}
+	if m.group != "" {
+		q.Set("group", m.group)
+	}
+	if m.token != "" {
+		q.Set("cap", m.token)
+	}
+	if m.idem != "" {
+		q.Set("idem", m.idem)
+	}
+	if m.rid != "" {
+		q.Set("rid", m.rid)
+	}
+	if len(q) == 0 {
+		return serviceMethod
+	}
+	return serviceMethod + "?" + q.Encode()
+}
@@ -0,0 +1,307 @@
+package pie
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TLSIdentity is the certificate a side of a mutually authenticated TLS
+// connection presents, and the certificate authorities it trusts to have
+// signed the other side's certificate.
+type TLSIdentity struct {
+	Certificate tls.Certificate
+	Roots       *x509.CertPool
+	// Bundles, if not nil, maps SPIFFE trust domain names to the authorities
+	// trusted for them.  The configurations made by SPIFFEClientConfig and
+	// SPIFFEServerConfig verify peers against the bundle for their trust
+	// domain, and only fall back on Roots if Bundles is nil.
+	Bundles map[string]*x509.CertPool
+}
+
+// IdentityProvider supplies the TLSIdentity used for each TLS handshake.
+// CertReloader is one; an adapter for a SPIFFE Workload API client, which
+// keeps the workload's X.509 SVID and trust bundles up to date, is another.
+// Identity is called for every handshake, so it should return a cached
+// identity rather than fetch one.
+type IdentityProvider interface {
+	Identity() (*TLSIdentity, error)
+}
+
+// CertReloader holds a TLSIdentity that can be replaced while connections are
+// being made with it, so that plugins reached over the network with mutual
+// TLS keep working when their certificates are rotated.  The tls.Configs it
+// makes look up the current identity for each handshake; connections already
+// established are not affected by a reload.  They can be used with tls.Dial
+// and tls.Listen to make the connections passed to NewPlugin and
+// NewProviderConn, or as the TLSConfig of a WebSocketDialer.
+type CertReloader struct {
+	load    func() (*TLSIdentity, error)
+	onError func(error)
+	stop    chan struct{}
+	once    sync.Once
+	// needRoots is set once ClientConfig or ServerConfig has been called,
+	// since their configurations verify peers against Roots, not Bundles.
+	needRoots atomic.Bool
+
+	mu  sync.RWMutex
+	cur *TLSIdentity
+}
+
+// NewCertReloader returns a CertReloader with the identity returned by load.
+// The identity is replaced with a fresh one from load each time Reload is
+// called, typically when the application learns that its certificates have
+// been renewed.
+func NewCertReloader(load func() (*TLSIdentity, error)) (*CertReloader, error) {
+	r := &CertReloader{load: load, stop: make(chan struct{})}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload replaces the identity with a fresh one from the CertReloader's load
+// function.  If that fails, the current identity is kept and the error is
+// returned.  An identity must have Roots once ClientConfig or ServerConfig
+// has been called, and otherwise either Roots or Bundles.
+func (r *CertReloader) Reload() error {
+	id, err := r.load()
+	if err == nil && (id == nil || len(id.Certificate.Certificate) == 0) {
+		err = errors.New("pie: TLS identity needs a certificate")
+	}
+	if err == nil && id.Roots == nil && (r.needRoots.Load() || len(id.Bundles) == 0) {
+		err = errors.New("pie: TLS identity needs roots to verify peers with")
+	}
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.cur = id
+	r.mu.Unlock()
+	return nil
+}
+
+// identity returns the current identity.
+func (r *CertReloader) identity() *TLSIdentity {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cur
+}
+
+// Identity implements IdentityProvider, returning the current identity.
+func (r *CertReloader) Identity() (*TLSIdentity, error) {
+	return r.identity(), nil
+}
+
+// Close stops watching files for a CertReloader returned by WatchCertFiles.
+// The identity last loaded stays in use.
+func (r *CertReloader) Close() error {
+	r.once.Do(func() { close(r.stop) })
+	return nil
+}
+
+// ClientConfig returns a TLS configuration for the host's side of connections
+// to plugins, which presents the current certificate and only accepts servers
+// whose certificates were signed by the current roots for serverName.  If
+// serverName is empty, the name the connection was dialed with is used; if
+// there is none, as with connections made with tls.Client and no name,
+// connecting fails rather than accept any name.
+func (r *CertReloader) ClientConfig(serverName string) *tls.Config {
+	r.needRoots.Store(true)
+	cfg := clientTLSConfig(r, func(cs tls.ConnectionState, id *TLSIdentity) error {
+		name := serverName
+		if name == "" {
+			name = cs.ServerName
+		}
+		if name == "" {
+			return errors.New("pie: no server name to verify the plugin's certificate for")
+		}
+		_, err := verifyPeer(cs, id.Roots, name, x509.ExtKeyUsageServerAuth)
+		return err
+	})
+	cfg.ServerName = serverName
+	return cfg
+}
+
+// clientTLSConfig returns a TLS configuration for the host's side of
+// connections, which presents the certificate of p's current identity and
+// accepts the servers that verify accepts.
+func clientTLSConfig(p IdentityProvider, verify func(tls.ConnectionState, *TLSIdentity) error) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			id, err := p.Identity()
+			if err != nil {
+				return nil, err
+			}
+			return &id.Certificate, nil
+		},
+		// The server is checked by VerifyConnection, since the roots may
+		// change after the configuration is made.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			id, err := p.Identity()
+			if err != nil {
+				return err
+			}
+			return verify(cs, id)
+		},
+	}
+}
+
+// ServerConfig returns a TLS configuration for the plugin's side of
+// connections from hosts, which presents the current certificate and requires
+// hosts to present certificates signed by the current roots.
+func (r *CertReloader) ServerConfig() *tls.Config {
+	r.needRoots.Store(true)
+	return serverTLSConfig(r, func(cs tls.ConnectionState, id *TLSIdentity) error {
+		_, err := verifyPeer(cs, id.Roots, "", x509.ExtKeyUsageClientAuth)
+		return err
+	})
+}
+
+// serverTLSConfig returns a TLS configuration for the plugin's side of
+// connections, which presents the certificate of p's current identity and
+// requires hosts to present certificates that verify accepts.
+func serverTLSConfig(p IdentityProvider, verify func(tls.ConnectionState, *TLSIdentity) error) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			id, err := p.Identity()
+			if err != nil {
+				return nil, err
+			}
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{id.Certificate},
+				ClientAuth:   tls.RequireAnyClientCert,
+				VerifyConnection: func(cs tls.ConnectionState) error {
+					return verify(cs, id)
+				},
+			}, nil
+		},
+	}
+}
+
+// verifyPeer verifies the certificate chain the peer presented on a
+// connection against roots, for the given use and, if it is not empty, DNS
+// name.  It returns the verified chains.  Nil roots are an error, rather than
+// the system roots they would be to crypto/x509, since any publicly trusted
+// certificate would then authenticate the peer.
+func verifyPeer(cs tls.ConnectionState, roots *x509.CertPool, name string, usage x509.ExtKeyUsage) ([][]*x509.Certificate, error) {
+	if len(cs.PeerCertificates) == 0 {
+		return nil, errors.New("pie: peer presented no certificate")
+	}
+	if roots == nil {
+		return nil, errors.New("pie: no roots to verify the peer's certificate with")
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	return cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		DNSName:       name,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+}
+
+// CertFiles names the PEM files a TLSIdentity is loaded from.
+type CertFiles struct {
+	// CertFile and KeyFile hold the certificate, followed by any
+	// intermediates, and its private key.
+	CertFile, KeyFile string
+	// CAFile holds the certificates of the authorities trusted to sign the
+	// other side's certificate.
+	CAFile string
+	// Interval is how often WatchCertFiles checks the files for changes.  It
+	// defaults to ten seconds.
+	Interval time.Duration
+	// OnError, if not nil, is called by WatchCertFiles when changed files
+	// could not be loaded, for example because a rotation is half done.  The
+	// previous identity stays in use, and the files are loaded again the next
+	// time they are checked.
+	OnError func(error)
+}
+
+// Load loads a TLSIdentity from the files.
+func (f CertFiles) Load() (*TLSIdentity, error) {
+	cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	pem, err := os.ReadFile(f.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("pie: no certificates found in %s", f.CAFile)
+	}
+	return &TLSIdentity{Certificate: cert, Roots: roots}, nil
+}
+
+// WatchCertFiles returns a CertReloader with the identity loaded from files,
+// which reloads it whenever one of the files changes, until the CertReloader
+// is closed.
+func WatchCertFiles(files CertFiles) (*CertReloader, error) {
+	seen := files.stat()
+	r, err := NewCertReloader(files.Load)
+	if err != nil {
+		return nil, err
+	}
+	r.onError = files.OnError
+	interval := files.Interval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	go r.watch(files, seen, interval)
+	return r, nil
+}
+
+// watch reloads the identity when files change.
+func (r *CertReloader) watch(files CertFiles, seen [3]fileStamp, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-t.C:
+		}
+		now := files.stat()
+		if now == seen {
+			continue
+		}
+		if err := r.Reload(); err != nil {
+			if r.onError != nil {
+				r.onError(err)
+			}
+			continue
+		}
+		seen = now
+	}
+}
+
+// fileStamp identifies a version of a file.
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// stat returns the stamps of the files.
+func (f CertFiles) stat() [3]fileStamp {
+	var stamps [3]fileStamp
+	for i, name := range []string{f.CertFile, f.KeyFile, f.CAFile} {
+		if info, err := os.Stat(name); err == nil {
+			stamps[i] = fileStamp{info.Size(), info.ModTime()}
+		}
+	}
+	return stamps
+}
@@ -0,0 +1,358 @@
+package pie
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+var serial int64
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(atomic.AddInt64(&serial, 1)),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, der: der}
+}
+
+// issue returns a certificate for name signed by the CA, with the given URI
+// SANs.
+func (ca *testCA) issue(t *testing.T, name string, uris ...string) (tls.Certificate, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(atomic.AddInt64(&serial, 1)),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if name != "" {
+		tmpl.DNSNames = []string{name}
+	}
+	for _, u := range uris {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl.URIs = append(tmpl.URIs, parsed)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, certPEM, keyPEM
+}
+
+func (ca *testCA) pem() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.der})
+}
+
+func (ca *testCA) identity(t *testing.T, name string, uris ...string) *TLSIdentity {
+	cert, _, _ := ca.issue(t, name, uris...)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	return &TLSIdentity{Certificate: cert, Roots: roots}
+}
+
+// staticReloader returns a CertReloader whose identity is whatever *id holds
+// when it reloads.
+func staticReloader(t *testing.T, id *atomic.Pointer[TLSIdentity]) *CertReloader {
+	r, err := NewCertReloader(func() (*TLSIdentity, error) { return id.Load(), nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// tlsPlugin connects a host and a provider over a pipe with the given TLS
+// configurations, and returns the host's handle, or the error from making it.
+func tlsPlugin(t *testing.T, client, server *tls.Config) (*Plugin, error) {
+	hostConn, providerConn := net.Pipe()
+	sc := tls.Server(providerConn, server)
+	go func() {
+		if sc.Handshake() != nil {
+			sc.Close()
+			return
+		}
+		s := NewProviderConn(sc)
+		s.RegisterName("api", api{})
+		s.Serve()
+	}()
+	cc := tls.Client(hostConn, client)
+	if err := cc.Handshake(); err != nil {
+		cc.Close()
+		return nil, err
+	}
+	p, err := NewPlugin(cc)
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { p.Close() })
+	return p, nil
+}
+
+func callSayHi(t *testing.T, p *Plugin) {
+	t.Helper()
+	var response string
+	if err := p.Call("api.SayHi", "bob", &response); err != nil {
+		t.Fatal(err)
+	}
+	if response != "Hi bob" {
+		t.Errorf("Wrong response from api call, expected %q, got %q", "Hi bob", response)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	var hostID, pluginID atomic.Pointer[TLSIdentity]
+	hostID.Store(ca.identity(t, "host"))
+	pluginID.Store(ca.identity(t, "plugin"))
+	host, plugin := staticReloader(t, &hostID), staticReloader(t, &pluginID)
+
+	p, err := tlsPlugin(t, host.ClientConfig("plugin"), plugin.ServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	callSayHi(t, p)
+
+	if _, err := tlsPlugin(t, host.ClientConfig("other"), plugin.ServerConfig()); err == nil {
+		t.Error("Connected to a plugin with the wrong name")
+	}
+	if _, err := tlsPlugin(t, host.ClientConfig(""), plugin.ServerConfig()); err == nil {
+		t.Error("Connected to a plugin without a server name to check")
+	}
+	other := newTestCA(t)
+	var strangerID atomic.Pointer[TLSIdentity]
+	strangerID.Store(other.identity(t, "host"))
+	if _, err := tlsPlugin(t, staticReloader(t, &strangerID).ClientConfig("plugin"), plugin.ServerConfig()); err == nil {
+		t.Error("Connected with a certificate from an untrusted authority")
+	}
+	noCert := &tls.Config{RootCAs: hostID.Load().Roots, ServerName: "plugin"}
+	if p, err := tlsPlugin(t, noCert, plugin.ServerConfig()); err == nil {
+		// TLS 1.3 clients learn that their missing certificate was
+		// rejected on their first read.
+		var response string
+		if err := p.Call("api.SayHi", "bob", &response); err == nil {
+			t.Error("Connected without a client certificate")
+		}
+	}
+}
+
+func TestMutualTLSRotation(t *testing.T) {
+	oldCA, newCA := newTestCA(t), newTestCA(t)
+	var hostID, pluginID atomic.Pointer[TLSIdentity]
+	hostID.Store(oldCA.identity(t, "host"))
+	pluginID.Store(oldCA.identity(t, "plugin"))
+	host, plugin := staticReloader(t, &hostID), staticReloader(t, &pluginID)
+	clientCfg, serverCfg := host.ClientConfig("plugin"), plugin.ServerConfig()
+
+	before, err := tlsPlugin(t, clientCfg, serverCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotate both sides to certificates from a new authority, using the same
+	// configurations.
+	hostID.Store(newCA.identity(t, "host"))
+	pluginID.Store(newCA.identity(t, "plugin"))
+	if err := host.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := plugin.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	after, err := tlsPlugin(t, clientCfg, serverCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callSayHi(t, after)
+	callSayHi(t, before)
+
+	// A host still on the old authority is no longer trusted.
+	stale := &atomic.Pointer[TLSIdentity]{}
+	stale.Store(oldCA.identity(t, "host"))
+	if _, err := tlsPlugin(t, staticReloader(t, stale).ClientConfig("plugin"), serverCfg); err == nil {
+		t.Error("Connected with a certificate from the rotated-out authority")
+	}
+}
+
+func TestCertReloaderKeepsIdentityOnError(t *testing.T) {
+	ca := newTestCA(t)
+	id := ca.identity(t, "host")
+	var fail bool
+	r, err := NewCertReloader(func() (*TLSIdentity, error) {
+		if fail {
+			return nil, os.ErrNotExist
+		}
+		return id, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fail = true
+	if err := r.Reload(); err == nil {
+		t.Error("Reload succeeded")
+	}
+	if r.identity() != id {
+		t.Error("Failed reload replaced the identity")
+	}
+	if _, err := NewCertReloader(func() (*TLSIdentity, error) { return &TLSIdentity{}, nil }); err == nil {
+		t.Error("NewCertReloader accepted an empty identity")
+	}
+}
+
+func TestCertReloaderNeedsRoots(t *testing.T) {
+	ca := newTestCA(t)
+	id := ca.identity(t, "host")
+	bundled := &TLSIdentity{Certificate: id.Certificate, Bundles: map[string]*x509.CertPool{"example.org": id.Roots}}
+	var cur atomic.Pointer[TLSIdentity]
+	cur.Store(bundled)
+	r := staticReloader(t, &cur)
+	r.ServerConfig()
+	if err := r.Reload(); err == nil {
+		t.Error("Reload accepted an identity without roots for ServerConfig")
+	}
+	if r.identity() != bundled {
+		t.Error("Failed reload replaced the identity")
+	}
+}
+
+// TestNilRootsRejectSystemTrust checks that an identity without roots does not
+// fall back on the system roots, by making the test CA the only system root.
+func TestNilRootsRejectSystemTrust(t *testing.T) {
+	ca := newTestCA(t)
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(file, ca.pem(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SSL_CERT_FILE", file)
+	t.Setenv("SSL_CERT_DIR", t.TempDir())
+	system, err := x509.SystemCertPool()
+	if err != nil {
+		t.Skip(err)
+	}
+	plugin := svidSource(t, ca, "spiffe://example.org/plugin", map[string]*testCA{"example.org": ca})
+	if _, err := plugin.id.Certificate.Leaf.Verify(x509.VerifyOptions{Roots: system}); err != nil {
+		t.Skipf("The system roots were loaded before the test could set them: %v", err)
+	}
+	host := workloadSource{id: &TLSIdentity{Certificate: plugin.id.Certificate}}
+	if _, err := tlsPlugin(t,
+		SPIFFEClientConfig(host, AuthorizeTrustDomain("example.org")),
+		SPIFFEServerConfig(plugin, AuthorizeTrustDomain("example.org"))); err == nil {
+		t.Error("Accepted a system-trusted peer with no roots to verify it against")
+	}
+}
+
+func TestWatchCertFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := CertFiles{
+		CertFile: filepath.Join(dir, "cert.pem"),
+		KeyFile:  filepath.Join(dir, "key.pem"),
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		Interval: 10 * time.Millisecond,
+	}
+	write := func(ca *testCA, certPEM, keyPEM []byte) {
+		for name, data := range map[string][]byte{files.CertFile: certPEM, files.KeyFile: keyPEM, files.CAFile: ca.pem()} {
+			if err := os.WriteFile(name, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	ca := newTestCA(t)
+	_, certPEM, keyPEM := ca.issue(t, "plugin")
+	write(ca, certPEM, keyPEM)
+	errs := make(chan error, 100)
+	files.OnError = func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+	r, err := WatchCertFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	first := r.identity()
+
+	// A half-done rotation, with a key that does not match the certificate,
+	// is reported and the old identity kept.
+	_, _, otherKey := ca.issue(t, "plugin")
+	if err := os.WriteFile(files.KeyFile, otherKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Mismatched key was not reported")
+	}
+	if r.identity() != first {
+		t.Error("Identity replaced by a bad rotation")
+	}
+
+	newCA := newTestCA(t)
+	_, certPEM, keyPEM = newCA.issue(t, "plugin")
+	write(newCA, certPEM, keyPEM)
+	deadline := time.Now().Add(5 * time.Second)
+	for r.identity() == first {
+		if time.Now().After(deadline) {
+			t.Fatal("Rotated files were not reloaded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	leaf, err := x509.ParseCertificate(r.identity().Certificate.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.CheckSignatureFrom(newCA.cert); err != nil {
+		t.Errorf("Reloaded certificate was not the rotated one: %v", err)
+	}
+}
@@ -0,0 +1,572 @@
+package pie
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"sync"
+)
+
+// A Mux carries several independent streams over one connection, such as the
+// pipe to a plugin process, so that a large transfer on one stream does not
+// hold up small calls on another.  Each stream has a name chosen by the side
+// that opens it, which the other side uses to decide what to do with it.
+//
+// The connection carries frames with a header of the stream's ID as a big
+// endian uint32, the frame's type, and the payload's length as a big endian
+// uint32.  Streams opened by the client side have odd IDs, and those opened by
+// the server side even IDs.  Each side may only send a stream as much data as
+// the other side has granted it room for in its receive window, and grants
+// more room as the data is read, so that a stream whose reader is slow never
+// stops the mux from reading the others.
+
+// Mux frame types.
+const (
+	muxOpen   byte = iota // opens a stream; the payload is its name
+	muxData               // carries data for a stream
+	muxClose              // closes the sender's side of a stream
+	muxWindow             // grants the payload's uint32 bytes more room
+)
+
+const (
+	muxHeaderLen = 9
+	// muxWindowSize is the receive window of each stream.
+	muxWindowSize = 256 << 10
+	// muxMaxFrame is the most data sent in one frame, which bounds how long a
+	// large write holds up the others.
+	muxMaxFrame = 32 << 10
+)
+
+// Names of the streams reserved for pie on a plugin's multiplexed connection.
+const (
+	// RPCChannel carries the plugin's RPC connection.
+	RPCChannel = "rpc"
+	// ControlChannel carries calls to the plugin's built-in control API, such
+	// as health checks, handshakes, and call group commits, so that they stay
+	// responsive while the RPC channel is busy.  It always uses gob encoding.
+	ControlChannel = "control"
+)
+
+// ErrMuxClosed is returned by operations on a Mux or its streams after the Mux
+// has been closed.
+var ErrMuxClosed = errors.New("pie: mux closed")
+
+// Mux multiplexes streams over a connection.
+type Mux struct {
+	conn io.ReadWriteCloser
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	streams map[uint32]*Stream
+	nextID  uint32
+	pending []*Stream
+	err     error
+}
+
+// NewMux returns a Mux over conn.  One end of the connection must be the
+// client, and the other not.
+func NewMux(conn io.ReadWriteCloser, client bool) *Mux {
+	m := &Mux{conn: conn, streams: map[uint32]*Stream{}, nextID: 2}
+	if client {
+		m.nextID = 1
+	}
+	m.cond = sync.NewCond(&m.mu)
+	go m.readLoop()
+	return m
+}
+
+// Open opens a stream with the given name.  The stream can be written to right
+// away; the other side sees it when it accepts it.
+func (m *Mux) Open(name string) (*Stream, error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+	s := m.newStream(m.nextID, name)
+	m.nextID += 2
+	m.mu.Unlock()
+	if err := m.writeFrame(s.id, muxOpen, []byte(name)); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Accept waits for and returns the next stream opened by the other side.
+func (m *Mux) Accept() (*Stream, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for len(m.pending) == 0 && m.err == nil {
+		m.cond.Wait()
+	}
+	if len(m.pending) == 0 {
+		return nil, m.err
+	}
+	s := m.pending[0]
+	m.pending = m.pending[1:]
+	return s, nil
+}
+
+// Close closes the Mux, its streams, and its connection.
+func (m *Mux) Close() error {
+	if !m.fail(ErrMuxClosed) {
+		return nil
+	}
+	return m.conn.Close()
+}
+
+// Err returns the error that ended the Mux, or nil if it is still running.
+func (m *Mux) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// fail ends the Mux with err, waking everything waiting on it.  It reports
+// whether the Mux was still running.
+func (m *Mux) fail(err error) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return false
+	}
+	m.err = err
+	m.cond.Broadcast()
+	return true
+}
+
+// newStream adds a stream.  m.mu must be held.
+func (m *Mux) newStream(id uint32, name string) *Stream {
+	s := &Stream{m: m, id: id, name: name, sendWindow: muxWindowSize}
+	m.streams[id] = s
+	return s
+}
+
+// writeFrame writes a frame to the connection.
+func (m *Mux) writeFrame(id uint32, typ byte, payload []byte) error {
+	buf := GetBuffer(muxHeaderLen + len(payload))
+	defer PutBuffer(buf)
+	binary.BigEndian.PutUint32(buf, id)
+	buf[4] = typ
+	binary.BigEndian.PutUint32(buf[5:], uint32(len(payload)))
+	copy(buf[muxHeaderLen:], payload)
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	if err := m.Err(); err != nil {
+		return err
+	}
+	if _, err := m.conn.Write(buf); err != nil {
+		if m.fail(err) {
+			m.conn.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+// readLoop reads frames until the connection fails.
+func (m *Mux) readLoop() {
+	head := make([]byte, muxHeaderLen)
+	for {
+		if _, err := io.ReadFull(m.conn, head); err != nil {
+			m.fail(err)
+			return
+		}
+		id := binary.BigEndian.Uint32(head)
+		typ := head[4]
+		n := binary.BigEndian.Uint32(head[5:])
+		if n > muxWindowSize {
+			m.protocolError(fmt.Sprintf("frame of %d bytes", n))
+			return
+		}
+		payload := GetBuffer(int(n))
+		if _, err := io.ReadFull(m.conn, payload); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			m.fail(err)
+			return
+		}
+		kept, err := m.handle(id, typ, payload)
+		if !kept {
+			PutBuffer(payload)
+		}
+		if err != nil {
+			m.protocolError(err.Error())
+			return
+		}
+	}
+}
+
+// protocolError ends the Mux because the other side broke the protocol.
+func (m *Mux) protocolError(detail string) {
+	if m.fail(errors.New("pie: mux protocol error: " + detail)) {
+		m.conn.Close()
+	}
+}
+
+// handle handles a frame read from the connection.  It reports whether it
+// kept payload, which is otherwise given back to the buffer pool.
+func (m *Mux) handle(id uint32, typ byte, payload []byte) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.streams[id]
+	if typ == muxOpen {
+		if s != nil || id%2 == m.nextID%2 {
+			return false, fmt.Errorf("bad open of stream %d", id)
+		}
+		s = m.newStream(id, string(payload))
+		m.pending = append(m.pending, s)
+		m.cond.Broadcast()
+		return false, nil
+	}
+	if s == nil {
+		// Frames can still arrive for a stream both sides have closed.
+		return false, nil
+	}
+	kept := false
+	switch typ {
+	case muxData:
+		if s.recvLen+len(payload) > muxWindowSize {
+			return false, fmt.Errorf("stream %d overran its window", id)
+		}
+		if len(payload) > 0 {
+			s.recv = append(s.recv, payload)
+			s.recvLen += len(payload)
+			kept = true
+		}
+	case muxClose:
+		s.remoteClosed = true
+		m.forget(s)
+	case muxWindow:
+		if len(payload) != 4 {
+			return false, fmt.Errorf("bad window update for stream %d", id)
+		}
+		s.sendWindow += int(binary.BigEndian.Uint32(payload))
+	default:
+		return false, fmt.Errorf("unknown frame type %d", typ)
+	}
+	m.cond.Broadcast()
+	return kept, nil
+}
+
+// forget removes s once both sides have closed it.  m.mu must be held.
+func (m *Mux) forget(s *Stream) {
+	if s.localClosed && s.remoteClosed {
+		delete(m.streams, s.id)
+	}
+}
+
+// Stream is a stream carried by a Mux.
+type Stream struct {
+	m    *Mux
+	id   uint32
+	name string
+
+	// The fields below are guarded by the Mux's mutex.
+
+	// recv holds the payloads of the data frames received and not yet read,
+	// in pooled buffers, of which the first has had recvOff bytes read.
+	// recvLen is the number of bytes left to read.
+	recv         [][]byte
+	recvOff      int
+	recvLen      int
+	consumed     int
+	sendWindow   int
+	localClosed  bool
+	remoteClosed bool
+	// onClose, if not nil, is called when the stream is closed locally.
+	onClose func()
+}
+
+// Name returns the name the stream was opened with.
+func (s *Stream) Name() string {
+	return s.name
+}
+
+// Read reads data sent by the other side.  It returns io.EOF once the other
+// side has closed the stream and all its data has been read.
+func (s *Stream) Read(p []byte) (int, error) {
+	if err := s.waitData(); err != nil {
+		return 0, err
+	}
+	n := 0
+	for n < len(p) && len(s.recv) > 0 {
+		head := s.recv[0]
+		c := copy(p[n:], head[s.recvOff:])
+		n += c
+		s.recvOff += c
+		if s.recvOff == len(head) {
+			PutBuffer(head)
+			s.dropHead()
+		}
+	}
+	s.recvLen -= n
+	s.consume(n)
+	return n, nil
+}
+
+// ReadBuffer returns the next chunk of data sent by the other side, as it was
+// received, without copying it.  The buffer belongs to the caller, who may
+// give it back with PutBuffer once done with it.  ReadBuffer returns io.EOF
+// once the other side has closed the stream and all its data has been read.
+// It can be mixed with calls to Read.
+func (s *Stream) ReadBuffer() ([]byte, error) {
+	if err := s.waitData(); err != nil {
+		return nil, err
+	}
+	b := s.recv[0][s.recvOff:]
+	s.dropHead()
+	s.recvLen -= len(b)
+	s.consume(len(b))
+	return b, nil
+}
+
+// waitData waits for data to read, and returns with the Mux's mutex held if
+// there is some.  Otherwise it returns the error that ends the stream's data.
+func (s *Stream) waitData() error {
+	m := s.m
+	m.mu.Lock()
+	for s.recvLen == 0 && !s.remoteClosed && !s.localClosed && m.err == nil {
+		m.cond.Wait()
+	}
+	if s.recvLen > 0 {
+		return nil
+	}
+	defer m.mu.Unlock()
+	switch {
+	case s.remoteClosed:
+		return io.EOF
+	case s.localClosed:
+		return ErrMuxClosed
+	}
+	return m.err
+}
+
+// dropHead removes the first received buffer.  The Mux's mutex must be held.
+func (s *Stream) dropHead() {
+	s.recv[0] = nil
+	s.recv = s.recv[1:]
+	s.recvOff = 0
+}
+
+// consume records that n bytes have been read, and grants the other side
+// more room in its window if enough has been read.  The Mux's mutex must be
+// held, and is released.
+func (s *Stream) consume(n int) {
+	m := s.m
+	s.consumed += n
+	var grant int
+	if s.consumed >= muxWindowSize/2 && !s.remoteClosed {
+		grant, s.consumed = s.consumed, 0
+	}
+	m.mu.Unlock()
+	if grant > 0 {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(grant))
+		m.writeFrame(s.id, muxWindow, b[:])
+	}
+}
+
+// Write writes data to the other side, waiting for room in its receive window.
+func (s *Stream) Write(p []byte) (int, error) {
+	m := s.m
+	written := 0
+	for len(p) > 0 {
+		m.mu.Lock()
+		for s.sendWindow == 0 && !s.localClosed && !s.remoteClosed && m.err == nil {
+			m.cond.Wait()
+		}
+		switch {
+		case m.err != nil:
+			m.mu.Unlock()
+			return written, m.err
+		case s.localClosed, s.remoteClosed:
+			m.mu.Unlock()
+			return written, ErrMuxClosed
+		}
+		n := len(p)
+		if n > s.sendWindow {
+			n = s.sendWindow
+		}
+		if n > muxMaxFrame {
+			n = muxMaxFrame
+		}
+		s.sendWindow -= n
+		m.mu.Unlock()
+		if err := m.writeFrame(s.id, muxData, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close closes the stream.  The other side reads io.EOF once it has read the
+// data written before Close.
+func (s *Stream) Close() error {
+	m := s.m
+	m.mu.Lock()
+	if s.localClosed {
+		m.mu.Unlock()
+		return nil
+	}
+	s.localClosed = true
+	m.forget(s)
+	m.cond.Broadcast()
+	onClose := s.onClose
+	m.mu.Unlock()
+	if onClose != nil {
+		onClose()
+	}
+	if err := m.writeFrame(s.id, muxClose, nil); err != nil && err != ErrMuxClosed {
+		return err
+	}
+	return nil
+}
+
+// muxEnv is the environment variable through which the host asks a provider to
+// multiplex its connection.
+const muxEnv = "PIE_MUX"
+
+// ErrNotMultiplexed is returned by Plugin.OpenChannel for plugins whose
+// connection is not multiplexed.
+var ErrNotMultiplexed = errors.New("pie: plugin connection is not multiplexed")
+
+// WithMux multiplexes the connection to the plugin with a Mux, carrying the
+// RPC connection on one stream and calls to the built-in control API on
+// another, and letting the host open more streams with Plugin.OpenChannel,
+// which the provider handles with Server.HandleChannel.  Data sent on other
+// streams, such as big transfers, never holds up calls, and application calls
+// never hold up the health checks and other management calls the host makes.
+//
+// For plugins started by StartPlugin, the provider is asked to multiplex
+// through its environment; it must be created with NewProvider by a version
+// of this package that supports it.  For handles created with NewPlugin, the
+// provider must be told with Server.SetMultiplexing.
+func WithMux() StartOption {
+	return func(o *startOptions) {
+		o.mux = true
+	}
+}
+
+// OpenChannel opens a stream with the given name to the plugin, alongside its
+// RPC connection.  The plugin must have been started with WithMux, and handles
+// the stream with the handler it set for name with Server.HandleChannel.
+func (p *Plugin) OpenChannel(name string) (*Stream, error) {
+	if p.mux == nil {
+		return nil, ErrNotMultiplexed
+	}
+	if reservedChannel(name) {
+		return nil, fmt.Errorf("pie: channel name %q is reserved", name)
+	}
+	return p.mux.Open(name)
+}
+
+// SetMultiplexing makes the Server multiplex its connections, as a host does
+// with WithMux, for connections served after it is called.  Providers created
+// with NewProvider for hosts that use WithMux have multiplexing set already.
+func (s Server) SetMultiplexing(on bool) error {
+	if s.d == nil {
+		return errors.New("pie: server cannot be configured")
+	}
+	s.d.regMu.Lock()
+	defer s.d.regMu.Unlock()
+	s.d.mux = on
+	return nil
+}
+
+// HandleChannel sets the function that handles the streams with the given name
+// that the host opens with Plugin.OpenChannel.  Each stream is handled in its
+// own goroutine, which should close the stream when done.  Streams with names
+// that have no handler are closed.
+func (s Server) HandleChannel(name string, h func(*Stream)) error {
+	if s.d == nil {
+		return errors.New("pie: server cannot be configured")
+	}
+	if reservedChannel(name) {
+		return fmt.Errorf("pie: channel name %q is reserved", name)
+	}
+	s.d.regMu.Lock()
+	defer s.d.regMu.Unlock()
+	if s.d.channels == nil {
+		s.d.channels = map[string]func(*Stream){}
+	}
+	s.d.channels[name] = h
+	return nil
+}
+
+// reservedChannel reports whether name is reserved for pie's own use.
+func reservedChannel(name string) bool {
+	return name == RPCChannel || name == ControlChannel
+}
+
+// muxConn is the RPC stream of a Mux, which closes the whole Mux when closed.
+type muxConn struct {
+	*Stream
+}
+
+func (c muxConn) Close() error {
+	return c.m.Close()
+}
+
+// serveMux accepts the streams the host opens on m, handing control channels to
+// control and other streams to their handlers, and returns the RPC stream once
+// the host has opened it.  Only the first RPC stream is served; later ones are
+// closed.
+func (d *dispatcher) serveMux(m *Mux, control func(*Stream)) (io.ReadWriteCloser, error) {
+	rpcStream := make(chan *Stream, 1)
+	go func() {
+		defer close(rpcStream)
+		served := false
+		for {
+			s, err := m.Accept()
+			if err != nil {
+				return
+			}
+			switch s.Name() {
+			case RPCChannel:
+				if served {
+					s.Close()
+				} else {
+					served = true
+					rpcStream <- s
+				}
+				continue
+			case ControlChannel:
+				go control(s)
+				continue
+			}
+			d.regMu.Lock()
+			h := d.channels[s.Name()]
+			d.regMu.Unlock()
+			if h == nil {
+				s.Close()
+				continue
+			}
+			go h(s)
+		}
+	}()
+	s, ok := <-rpcStream
+	if !ok {
+		return nil, m.Err()
+	}
+	return muxConn{s}, nil
+}
+
+// serveControl serves the built-in control API, and nothing else, on a control
+// channel.
+func (s Server) serveControl(st *Stream) {
+	if s.ctl == nil {
+		st.Close()
+		return
+	}
+	server := rpc.NewServer()
+	server.RegisterName(controlService, s.ctl)
+	server.ServeConn(st)
+}
@@ -0,0 +1,361 @@
+package pie
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func muxPair(t *testing.T) (client, server *Mux) {
+	a, b := net.Pipe()
+	client, server = NewMux(a, true), NewMux(b, false)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestMuxStreams(t *testing.T) {
+	client, server := muxPair(t)
+	for _, name := range []string{"one", "two"} {
+		s, err := client.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Write([]byte("hello " + name)); err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+	}
+	for _, name := range []string{"one", "two"} {
+		s, err := server.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Name() != name {
+			t.Fatalf("expected stream %q, got %q", name, s.Name())
+		}
+		data, err := io.ReadAll(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "hello "+name {
+			t.Fatalf("expected %q, got %q", "hello "+name, data)
+		}
+	}
+}
+
+func TestMuxNoHeadOfLineBlocking(t *testing.T) {
+	client, server := muxPair(t)
+	bulk, err := client.Open("bulk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing reads the bulk stream, so this write stalls once the stream's
+	// window is full.
+	go bulk.Write(make([]byte, 4*muxWindowSize))
+	small, err := client.Open("small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := small.Write([]byte("ping"))
+		done <- err
+	}()
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(accepted, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("expected ping, got %q", buf)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("small stream was blocked behind the bulk stream")
+	}
+}
+
+func TestMuxLargeTransfer(t *testing.T) {
+	client, server := muxPair(t)
+	data := bytes.Repeat([]byte("0123456789"), muxWindowSize/2)
+	s, err := client.Open("bulk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		s.Write(data)
+		s.Close()
+	}()
+	accepted, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(accepted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("expected %d bytes, got %d", len(data), len(got))
+	}
+}
+
+func TestMuxClose(t *testing.T) {
+	client, server := muxPair(t)
+	s, err := client.Open("one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if _, err := s.Write([]byte("x")); err == nil {
+		t.Fatal("expected error writing to a closed mux")
+	}
+	if _, err := server.Accept(); err == nil {
+		// The open may have arrived before the close.
+		if _, err := server.Accept(); err == nil {
+			t.Fatal("expected Accept to fail once the connection closed")
+		}
+	}
+}
+
+func echo(t *testing.T, p *Plugin) {
+	t.Helper()
+	s, err := p.OpenChannel("echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("expected echo of %q, got %q", "hello", buf)
+	}
+}
+
+func TestWithMux(t *testing.T) {
+	p, err := StartPlugin(os.Stderr, os.Args[0], helperArgs("provider"), WithMux())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	var reply string
+	if err := p.Call("api.SayHi", "bob", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "Hi bob" {
+		t.Fatalf("expected %q, got %q", "Hi bob", reply)
+	}
+	echo(t, p)
+}
+
+func TestWithMuxOverConn(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	s := NewProviderConn(serverConn)
+	s.RegisterName("api", api{})
+	s.SetMultiplexing(true)
+	s.HandleChannel("echo", func(st *Stream) {
+		io.Copy(st, st)
+		st.Close()
+	})
+	go s.Serve()
+	p, err := NewPlugin(clientConn, WithMux())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	var reply string
+	if err := p.Call("api.SayHi", "bob", &reply); err != nil {
+		t.Fatal(err)
+	}
+	echo(t, p)
+}
+
+func TestOpenChannelNotMultiplexed(t *testing.T) {
+	p, _ := connPlugin(t)
+	defer p.Close()
+	if _, err := p.OpenChannel("echo"); err != ErrNotMultiplexed {
+		t.Fatalf("expected ErrNotMultiplexed, got %v", err)
+	}
+}
+
+func TestControlChannel(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	m := NewMux(serverConn, false)
+	defer m.Close()
+	// Serve the control channel, but leave the RPC channel stuck, as if a
+	// large payload were filling it.
+	go func() {
+		for {
+			s, err := m.Accept()
+			if err != nil {
+				return
+			}
+			if s.Name() == ControlChannel {
+				go NewProvider().serveControl(s)
+			}
+		}
+	}()
+	p, err := NewPlugin(clientConn, WithMux())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	go p.Call("api.SayHi", "bob", new(string))
+	done := make(chan error, 1)
+	go func() { done <- p.Ping() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ping was blocked behind the RPC channel")
+	}
+}
+
+func TestServeMuxExtraRPCStreams(t *testing.T) {
+	client, server := muxPair(t)
+	d := &dispatcher{channels: map[string]func(*Stream){
+		"echo": func(s *Stream) {
+			io.Copy(s, s)
+			s.Close()
+		},
+	}}
+	var extra []*Stream
+	for i := 0; i < 3; i++ {
+		s, err := client.Open(RPCChannel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 {
+			extra = append(extra, s)
+		}
+	}
+	if _, err := d.serveMux(server, func(s *Stream) { s.Close() }); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range extra {
+		if _, err := io.ReadAll(s); err != nil {
+			t.Errorf("Expected extra RPC streams to be closed, got %v", err)
+		}
+	}
+	echo, err := client.Open("echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan string, 1)
+	go func() {
+		echo.Write([]byte("hi"))
+		buf := make([]byte, 2)
+		io.ReadFull(echo, buf)
+		done <- string(buf)
+	}()
+	select {
+	case got := <-done:
+		if got != "hi" {
+			t.Errorf("Expected the echo, got %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Channels were not accepted after extra RPC streams")
+	}
+}
+
+func TestControlChannelWithStartPlugin(t *testing.T) {
+	p, err := StartPlugin(os.Stderr, os.Args[0], helperArgs("provider"), WithMux())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if p.control == nil {
+		t.Fatal("expected a control channel")
+	}
+	if err := p.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	m, err := p.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Methods) == 0 {
+		t.Fatal("expected methods in the manifest")
+	}
+	g, err := p.BeginGroup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamReadBuffer(t *testing.T) {
+	client, server := muxPair(t)
+	s, err := client.Open("bulk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 3*muxWindowSize+123)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	go func() {
+		s.Write(data)
+		s.Close()
+	}()
+	r, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	small := make([]byte, 100)
+	for i := 0; ; i++ {
+		// Mix copying reads with zero-copy ones.
+		var b []byte
+		if i%3 == 0 {
+			n, err := r.Read(small)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, small[:n]...)
+			continue
+		}
+		b, err = r.ReadBuffer()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) == 0 || len(b) > muxMaxFrame {
+			t.Fatalf("ReadBuffer returned %d bytes", len(b))
+		}
+		got = append(got, b...)
+		PutBuffer(b)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes that differ from the %d written", len(got), len(data))
+	}
+}
@@ -0,0 +1,99 @@
+package pie
+
+import (
+	"fmt"
+	"go/token"
+	"strings"
+)
+
+// Namespace registers services with a Server under a dotted prefix, so that
+// services of the same name from different parts of a program can be served
+// side by side: a Blob service registered in the namespace "storage" is
+// called as "storage.Blob.Put", and one registered in "cache" as
+// "cache.Blob.Put".  Namespaces nest, so that the namespace "v1" within
+// "storage" registers services as "storage.v1.Blob".  Server.Expose accepts
+// namespaces as well as services, and exposes all the services in them.
+type Namespace struct {
+	s      Server
+	prefix string
+}
+
+// Namespace returns the namespace with the given prefix, which is one or more
+// names separated by dots.  The prefix "pie" is reserved for pie's built-in
+// control API.
+func (s Server) Namespace(prefix string) Namespace {
+	return Namespace{s: s, prefix: prefix}
+}
+
+// RegisterNamespace is like Register, but registers rcvr in the namespace
+// with the given prefix, as Server.Namespace(prefix).Register(rcvr) does.
+func (s Server) RegisterNamespace(prefix string, rcvr interface{}) error {
+	return s.Namespace(prefix).Register(rcvr)
+}
+
+// Namespace returns the namespace with the given prefix within n.
+func (n Namespace) Namespace(prefix string) Namespace {
+	return Namespace{s: n.s, prefix: n.prefix + "." + prefix}
+}
+
+// Prefix returns the namespace's prefix, which is the service name of its
+// services without the final name.
+func (n Namespace) Prefix() string {
+	return n.prefix
+}
+
+// Register is like Server.Register, but publishes the methods of rcvr as the
+// service "Prefix.Type", where Type is the receiver's concrete type.
+func (n Namespace) Register(rcvr interface{}) error {
+	name := serviceName(rcvr)
+	if !token.IsExported(name) {
+		return n.s.noteRegister(fmt.Errorf("rpc.Register: type %s is not exported", name))
+	}
+	return n.RegisterName(name, rcvr)
+}
+
+// RegisterName is like Register but uses the provided name for the type
+// instead of the receiver's concrete type.
+func (n Namespace) RegisterName(name string, rcvr interface{}) error {
+	if err := checkNamespace(n.prefix); err != nil {
+		return n.s.noteRegister(err)
+	}
+	return n.s.noteRegister(n.s.register(n.prefix+"."+name, rcvr, true))
+}
+
+// checkNamespace returns an error if prefix is not a valid namespace.
+func checkNamespace(prefix string) error {
+	for _, part := range strings.Split(prefix, ".") {
+		if part == "" || strings.ContainsAny(part, " \t\r\n") {
+			return fmt.Errorf("pie: invalid namespace %q", prefix)
+		}
+	}
+	if prefix == controlService || strings.HasPrefix(prefix, controlService+".") {
+		return fmt.Errorf("pie: namespace %q is reserved", prefix)
+	}
+	return nil
+}
+
+// splitServiceMethod splits serviceMethod into its service and method at its
+// last dot, as net/rpc does, so that names of services in namespaces split
+// correctly.  It reports whether serviceMethod has a dot.
+func splitServiceMethod(serviceMethod string) (service, method string, ok bool) {
+	i := strings.LastIndexByte(serviceMethod, '.')
+	if i < 0 {
+		return serviceMethod, "", false
+	}
+	return serviceMethod[:i], serviceMethod[i+1:], true
+}
+
+// hasNamespace reports whether the dispatcher serves any service in the
+// namespace with the given prefix.
+func (d *dispatcher) hasNamespace(prefix string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for service := range d.services {
+		if strings.HasPrefix(service, prefix+".") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package pie
+
+import (
+	"strings"
+	"testing"
+)
+
+// Bucket is registered in more than one namespace.
+type Bucket struct {
+	kind string
+}
+
+func (b Bucket) Put(key string, reply *string) error {
+	*reply = b.kind + ":" + key
+	return nil
+}
+
+func (b Bucket) Size(key string) (int, error) {
+	return len(b.kind + key), nil
+}
+
+type bucket struct{}
+
+func (bucket) Put(key string, reply *string) error { return nil }
+
+func TestRegisterNamespace(t *testing.T) {
+	s := NewProvider()
+	if err := s.RegisterNamespace("storage", Bucket{"storage"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterNamespace("cache", Bucket{"cache"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Namespace("storage").Namespace("v1").RegisterName("Objects", Bucket{"v1"}); err != nil {
+		t.Fatal(err)
+	}
+	client := servePipe(t, s, nil, nil)
+
+	for method, want := range map[string]string{
+		"storage.Bucket.Put":     "storage:k",
+		"cache.Bucket.Put":       "cache:k",
+		"storage.v1.Objects.Put": "v1:k",
+	} {
+		var reply string
+		if err := client.Call(method, "k", &reply); err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		if reply != want {
+			t.Errorf("%s: expected %q, got %q", method, want, reply)
+		}
+	}
+	var size int
+	if err := client.Call("cache.Bucket.Size", "k", &size); err != nil {
+		t.Fatal(err)
+	}
+	if size != len("cachek") {
+		t.Errorf("Expected size %d, got %d", len("cachek"), size)
+	}
+}
+
+func TestRegisterNamespaceErrors(t *testing.T) {
+	s := NewProvider()
+	for _, prefix := range []string{"", "storage.", ".storage", "a b", "pie", "pie.x"} {
+		if err := s.RegisterNamespace(prefix, Bucket{}); err == nil {
+			t.Errorf("Expected an error registering in namespace %q", prefix)
+		}
+	}
+	if err := s.RegisterNamespace("storage", bucket{}); err == nil || !strings.Contains(err.Error(), "not exported") {
+		t.Errorf("Expected an error registering an unexported type, got %v", err)
+	}
+	if err := s.RegisterNamespace("storage", Bucket{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterNamespace("storage", Bucket{}); err == nil {
+		t.Error("Expected an error registering a service twice in a namespace")
+	}
+	if p := s.Namespace("storage").Namespace("v1").Prefix(); p != "storage.v1" {
+		t.Errorf("Expected prefix storage.v1, got %q", p)
+	}
+}
+
+func TestExposeNamespace(t *testing.T) {
+	s := NewProvider()
+	s.RegisterNamespace("storage", Bucket{"storage"})
+	s.Namespace("storage.v1").Register(Bucket{"v1"})
+	s.RegisterNamespace("cache", Bucket{"cache"})
+	if err := s.Expose("storage"); err != nil {
+		t.Fatal(err)
+	}
+	client := servePipe(t, s, nil, nil)
+
+	var reply string
+	for _, method := range []string{"storage.Bucket.Put", "storage.v1.Bucket.Put"} {
+		if err := client.Call(method, "k", &reply); err != nil {
+			t.Errorf("Unexpected error calling %s in an exposed namespace: %v", method, err)
+		}
+	}
+	if err := client.Call("cache.Bucket.Put", "k", &reply); err == nil || !strings.Contains(err.Error(), "can't find method") {
+		t.Errorf("Expected cache.Bucket.Put to be hidden, got %v", err)
+	}
+	if err := s.Expose("stor"); err == nil {
+		t.Error("Expected an error exposing a partial namespace")
+	}
+}
+
+func TestSplitServiceMethod(t *testing.T) {
+	for _, tc := range []struct{ in, service, method string }{
+		{"api.SayHi", "api", "SayHi"},
+		{"storage.v1.Bucket.Put", "storage.v1.Bucket", "Put"},
+		{"api", "api", ""},
+	} {
+		service, method, _ := splitServiceMethod(tc.in)
+		if service != tc.service || method != tc.method {
+			t.Errorf("splitServiceMethod(%q) = %q, %q; expected %q, %q", tc.in, service, method, tc.service, tc.method)
+		}
+	}
+}
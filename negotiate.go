@@ -0,0 +1,176 @@
+package pie
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/rpc"
+	"strings"
+	"sync"
+)
+
+// Codec negotiation happens on a fresh connection, before anything else is
+// sent.  The host calls pie.SelectCodec with gob encoding, passing the names
+// of the codecs it accepts in order of preference, and the provider replies
+// with the first one it also has.  Both sides then start over on the same
+// connection with new codecs of that kind.  A provider without codec
+// negotiation answers that the method does not exist, and the host carries on
+// with the gob codec it made the call with.
+
+// selectCodecMethod is the control method a host calls to negotiate a codec.
+// The provider's dispatcher answers it itself, since the codec changes when
+// it does.
+const selectCodecMethod = controlService + ".SelectCodec"
+
+// codecPair holds the two halves of a codec registered with RegisterCodec.
+type codecPair struct {
+	client func(io.ReadWriteCloser) rpc.ClientCodec
+	server func(io.ReadWriteCloser) rpc.ServerCodec
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]codecPair{
+		"gob":  {client: newGobClientCodec, server: newGobServerCodec},
+		"json": {client: NewJSONClientCodec, server: NewJSONServerCodec},
+	}
+)
+
+// RegisterCodec makes a codec available for negotiation under the given name,
+// such as "msgpack", with client making the host's half of the codec and
+// server the provider's.  Both the host and the plugin must register a codec
+// for it to be chosen.  The "gob" and "json" codecs are always available.
+// Registering a name again replaces the codec registered under it.
+func RegisterCodec(name string, client func(io.ReadWriteCloser) rpc.ClientCodec, server func(io.ReadWriteCloser) rpc.ServerCodec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[name] = codecPair{client: client, server: server}
+}
+
+// lookupCodec returns the codec registered under name.
+func lookupCodec(name string) (codecPair, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// WithCodecs makes the handle negotiate the codec it talks to the plugin with,
+// offering the named codecs, registered with RegisterCodec, in order of
+// preference, such as "msgpack", "json", "gob".  The plugin picks the first
+// it supports.  Plugins that cannot negotiate are spoken to with gob encoding,
+// as long as "gob" is among the names.  WithCodecs overrides WithClientCodec,
+// and requires a provider that serves with Serve or ServeErr, which start out
+// with gob encoding; they negotiate if the provider was created by a version
+// of this package that supports it.
+func WithCodecs(names ...string) StartOption {
+	return func(o *startOptions) {
+		o.codecs = names
+	}
+}
+
+// negotiateCodec negotiates a codec with the provider at the other end of
+// conn, offering the codecs in accept.  If the provider cannot negotiate, it
+// returns the gob codec negotiation was attempted with, which must carry on
+// being used, and otherwise a new codec of the chosen kind.  If ctx is done
+// first, conn is closed.
+func negotiateCodec(ctx context.Context, conn io.ReadWriteCloser, accept []string) (rpc.ClientCodec, error) {
+	for _, name := range accept {
+		if _, ok := lookupCodec(name); !ok {
+			return nil, fmt.Errorf("pie: unknown codec %q", name)
+		}
+	}
+	// Reading a byte at a time for the gob decoder's counts keeps it from
+	// buffering anything sent after the reply, which is meant for the new
+	// codec.
+	gc := newGobClientCodecReader(conn, byteReader{conn})
+	type result struct {
+		name string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		name, err := selectCodec(gc, accept)
+		done <- result{name, err}
+	}()
+	var res result
+	select {
+	case res = <-done:
+	case <-ctx.Done():
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	switch {
+	case isMissingMethod(res.err):
+		for _, name := range accept {
+			if name == "gob" {
+				return gc, nil
+			}
+		}
+		return nil, fmt.Errorf("pie: plugin cannot negotiate codecs, and gob was not offered")
+	case res.err != nil:
+		return nil, res.err
+	}
+	c, ok := lookupCodec(res.name)
+	if !ok {
+		return nil, fmt.Errorf("pie: plugin chose codec %q, which was not offered", res.name)
+	}
+	return c.client(conn), nil
+}
+
+// selectCodec calls the provider's SelectCodec method through c.
+func selectCodec(c *gobClientCodec, accept []string) (string, error) {
+	if err := c.WriteRequest(&rpc.Request{ServiceMethod: selectCodecMethod}, accept); err != nil {
+		return "", err
+	}
+	var resp rpc.Response
+	if err := c.ReadResponseHeader(&resp); err != nil {
+		return "", err
+	}
+	if resp.Error != "" {
+		c.ReadResponseBody(nil)
+		return "", rpc.ServerError(resp.Error)
+	}
+	var name string
+	err := c.ReadResponseBody(&name)
+	return name, err
+}
+
+// byteReader adds a ReadByte method to a reader that does not buffer.
+type byteReader struct {
+	io.Reader
+}
+
+// ReadByte reads a single byte.
+func (r byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r.Reader, b[:])
+	return b[0], err
+}
+
+// selectCodec answers a host's SelectCodec call, whose header has been read,
+// and switches to the codec chosen, if any.
+func (c *dispatchCodec) selectCodec(r *rpc.Request) error {
+	var accept []string
+	if err := c.ServerCodec.ReadRequestBody(&accept); err != nil {
+		return err
+	}
+	req := request{serviceMethod: r.ServiceMethod, seq: r.Seq}
+	for _, name := range accept {
+		codec, ok := lookupCodec(name)
+		if !ok {
+			continue
+		}
+		c.sending.Lock()
+		defer c.sending.Unlock()
+		if err := c.ServerCodec.WriteResponse(&rpc.Response{ServiceMethod: r.ServiceMethod, Seq: r.Seq}, &name); err != nil {
+			return err
+		}
+		// The host sends nothing more until it has the reply, so the old
+		// codec has not read anything meant for the new one.
+		c.ServerCodec = codec.server(c.conn)
+		return nil
+	}
+	c.respond(req, invalidRequest, "pie: none of the codecs "+strings.Join(accept, ", ")+" is supported")
+	return nil
+}
@@ -0,0 +1,128 @@
+package pie
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// codecName returns the type of the codec p talks to its plugin with.
+func codecName(p *Plugin) string {
+	return fmt.Sprintf("%T", p.codec.ClientCodec)
+}
+
+func TestWithCodecs(t *testing.T) {
+	s := NewProvider()
+	s.RegisterName("api", api{})
+	p := pipePlugin(t, s, WithCodecs("json", "gob"))
+	if name := codecName(p); !strings.Contains(name, "json") {
+		t.Errorf("Expected the json codec to be chosen, got %s", name)
+	}
+	for i := 0; i < 2; i++ {
+		var response string
+		if err := p.Call("api.SayHi", "bob", &response); err != nil {
+			t.Fatal(err)
+		}
+		if response != "Hi bob" {
+			t.Errorf("Wrong response from api call, expected %q, got %q", "Hi bob", response)
+		}
+	}
+	if err := p.Ping(); err != nil {
+		t.Errorf("Unexpected error from Ping: %v", err)
+	}
+}
+
+func TestWithCodecsRegistered(t *testing.T) {
+	var clients, servers int32
+	RegisterCodec("counted", func(rwc io.ReadWriteCloser) rpc.ClientCodec {
+		atomic.AddInt32(&clients, 1)
+		return newGobClientCodec(rwc)
+	}, func(rwc io.ReadWriteCloser) rpc.ServerCodec {
+		atomic.AddInt32(&servers, 1)
+		return newGobServerCodec(rwc)
+	})
+	s := NewProvider()
+	s.RegisterName("api", api{})
+	p := pipePlugin(t, s, WithCodecs("counted", "gob"))
+	var response string
+	if err := p.Call("api.SayHi", "bob", &response); err != nil {
+		t.Fatal(err)
+	}
+	if c, s := atomic.LoadInt32(&clients), atomic.LoadInt32(&servers); c != 1 || s != 1 {
+		t.Errorf("Expected the registered codec to be used on both sides, got %d client and %d server codecs", c, s)
+	}
+}
+
+func TestWithCodecsUnknown(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	if _, err := NewPlugin(clientConn, WithCodecs("nonesuch")); err == nil {
+		t.Fatal("Expected an error for an unregistered codec")
+	}
+}
+
+func TestWithCodecsFallback(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	server := rpc.NewServer()
+	server.RegisterName("api", api{})
+	go server.ServeConn(serverConn)
+	p, err := NewPlugin(clientConn, WithCodecs("json", "gob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	var response string
+	if err := p.Call("api.SayHi", "bob", &response); err != nil {
+		t.Fatalf("Expected a plugin that cannot negotiate to be spoken to with gob, got %v", err)
+	}
+	if response != "Hi bob" {
+		t.Errorf("Wrong response from api call, expected %q, got %q", "Hi bob", response)
+	}
+}
+
+func TestWithCodecsNoFallback(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	server := rpc.NewServer()
+	server.RegisterName("api", api{})
+	go server.ServeConn(serverConn)
+	if _, err := NewPlugin(clientConn, WithCodecs("json")); err == nil {
+		t.Fatal("Expected an error when the plugin cannot negotiate and gob is not offered")
+	}
+}
+
+func TestWithCodecsContext(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	// Nothing serves serverConn, so negotiation never gets an answer.
+	go io.Copy(io.Discard, serverConn)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := NewPluginContext(ctx, clientConn, WithCodecs("json")); err != context.DeadlineExceeded {
+		t.Fatalf("Expected the deadline to end negotiation, got %v", err)
+	}
+}
+
+func TestWithCodecsStartPlugin(t *testing.T) {
+	p, err := StartPlugin(os.Stderr, os.Args[0], helperArgs("provider"), WithCodecs("json", "gob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if name := codecName(p); !strings.Contains(name, "json") {
+		t.Errorf("Expected the json codec to be chosen, got %s", name)
+	}
+	var response string
+	if err := p.Call("api.SayHi", "bob", &response); err != nil {
+		t.Fatal(err)
+	}
+	if response != "Hi bob" {
+		t.Errorf("Wrong response from api call, expected %q, got %q", "Hi bob", response)
+	}
+}
@@ -0,0 +1,102 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path"
+)
+
+// netProxyEnv tells a plugin started with WithNetworkPolicy the number of the
+// file descriptor it reaches the host's network proxy on.
+const netProxyEnv = "PIE_NET_PROXY"
+
+// ErrNetworkIsolationUnsupported is returned by StartPlugin on platforms that
+// cannot run plugins without network access, as WithNetworkPolicy asks.
+var ErrNetworkIsolationUnsupported = errors.New("pie: network isolation is not supported on this platform")
+
+// ErrNoNetworkProxy is returned by DialHost in plugins the host gave no
+// network proxy.
+var ErrNoNetworkProxy = errors.New("pie: the host provides no network proxy")
+
+// NetworkPolicy is what a plugin started with WithNetworkPolicy may reach on
+// the network.  The plugin runs without network access of its own, in a new
+// network namespace with only a loopback interface, which is down, and can
+// only connect to the addresses the policy allows, by calling DialHost, which
+// has the host make the connection and hand it to the plugin.  The zero
+// NetworkPolicy allows nothing.
+//
+// Only TCP and UDP connections can be made through the host.  A network
+// namespace does not isolate Unix sockets bound to paths in the file system,
+// though, so the plugin can still connect to those it can reach in the file
+// system, unless it is also confined with WithPrivateRoot or the like.
+type NetworkPolicy struct {
+	// Allow lists the addresses, each of the form "host:port", the plugin
+	// may connect to.  An entry may be a pattern, as matched by path.Match,
+	// so that "*.example.com:443" allows port 443 of any host in
+	// example.com.  Addresses are matched as the plugin gives them, before
+	// they are resolved.
+	Allow []string
+	// Dial, if not nil, makes the connections the policy allows, instead of
+	// a net.Dialer.  It lets the host send them through a proxy of its own,
+	// or refuse them by returning an error.
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// allows reports whether the policy allows connecting to address.
+func (p *NetworkPolicy) allows(address string) bool {
+	for _, pattern := range p.Allow {
+		if pattern == address {
+			return true
+		}
+		if ok, _ := path.Match(pattern, address); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// dial makes a connection the policy allows.  Only IP networks are dialed,
+// since the plugin would otherwise reach the host's Unix sockets through it.
+func (p *NetworkPolicy) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+	default:
+		return nil, errors.New("pie: network policy does not allow the network " + network)
+	}
+	if !p.allows(address) {
+		return nil, errors.New("pie: network policy does not allow connecting to " + address)
+	}
+	if p.Dial != nil {
+		return p.Dial(ctx, network, address)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+// WithNetworkPolicy makes StartPlugin run the plugin without network access,
+// except for connections to the addresses policy allows, which the plugin
+// makes with DialHost.  This is for plugins that are not trusted with the
+// network, and should only reach it through services the host mediates.  It
+// is only supported on Linux, where the plugin runs in a new network
+// namespace, and in a new user namespace too if the host is not running as
+// root.  Elsewhere, StartPlugin fails with ErrNetworkIsolationUnsupported.
+func WithNetworkPolicy(policy NetworkPolicy) StartOption {
+	return func(o *startOptions) {
+		o.network = &policy
+	}
+}
+
+// DialHost connects to address on the named network, which must be "tcp",
+// "udp", or one of their variants such as "tcp4", through the host that
+// started the plugin with WithNetworkPolicy, which makes the connection if its
+// policy allows it.  It returns ErrNoNetworkProxy in
+// plugins started without a network policy.
+func DialHost(network, address string) (net.Conn, error) {
+	return DialHostContext(context.Background(), network, address)
+}
+
+// DialHostContext is like DialHost, but gives up when ctx is done.
+func DialHostContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return dialHost(ctx, network, address)
+}
@@ -0,0 +1,222 @@
+//go:build linux
+
+package pie
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// The network proxy of a plugin started with WithNetworkPolicy is a
+// SOCK_SEQPACKET socket pair, whose plugin end the plugin inherits.  To dial,
+// the plugin sends the network and address, separated by a NUL, with one end
+// of a new socket pair attached, on which the host answers with a message
+// holding either a zero byte and the connection's file descriptor, or a
+// non-zero byte and the error.  Connections can be handed over this way
+// because a socket stays in the network namespace it was made in.
+
+// Bytes that start the host's answers.
+const (
+	netProxyOK  byte = 0
+	netProxyErr byte = 1
+)
+
+// isolateNetwork sets cmd up to run in a new network namespace, with the
+// plugin's end of a network proxy for policy.  The function returned must be
+// called once cmd has been started, with a channel that is closed when it
+// exits, or nil if it did not start; it closes the host's copy of the
+// plugin's end, and serves the proxy if the plugin is running.
+func isolateNetwork(cmd *exec.Cmd, policy *NetworkPolicy) (func(exited <-chan struct{}), error) {
+	host, plugin, err := seqpacketPair()
+	if err != nil {
+		return nil, err
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+	if uid, gid := os.Geteuid(), os.Getegid(); uid != 0 {
+		// Only root may make network namespaces outside a user namespace.
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
+		cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: uid, HostID: uid, Size: 1}}
+		cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: gid, HostID: gid, Size: 1}}
+	}
+	fd := 3 + len(cmd.ExtraFiles)
+	cmd.ExtraFiles = append(cmd.ExtraFiles, plugin)
+	if cmd.Env == nil {
+		cmd.Env = hostEnviron()
+	}
+	cmd.Env = append(cmd.Env, netProxyEnv+"="+strconv.Itoa(fd))
+	return func(exited <-chan struct{}) {
+		plugin.Close()
+		if exited == nil {
+			host.Close()
+			return
+		}
+		go serveNetProxy(host, policy)
+	}, nil
+}
+
+// seqpacketPair returns the two ends of a new SOCK_SEQPACKET socket pair.
+func seqpacketPair() (*os.File, *os.File, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, os.NewSyscallError("socketpair", err)
+	}
+	return os.NewFile(uintptr(fds[0]), "pie-net-proxy"), os.NewFile(uintptr(fds[1]), "pie-net-proxy"), nil
+}
+
+// serveNetProxy answers the dial requests the plugin sends on f until the
+// plugin closes its end.
+func serveNetProxy(f *os.File, policy *NetworkPolicy) {
+	c, err := unixConn(f)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for {
+		msg, fd, err := readFDMsg(c)
+		if err != nil {
+			return
+		}
+		if fd < 0 {
+			continue
+		}
+		reply, err := unixConn(os.NewFile(uintptr(fd), "pie-net-proxy"))
+		if err != nil {
+			continue
+		}
+		network, address, _ := strings.Cut(string(msg), "\x00")
+		go answerDial(ctx, reply, policy, network, address)
+	}
+}
+
+// answerDial makes the connection the plugin asked for, if policy allows it,
+// and sends it, or the error, on reply.
+func answerDial(ctx context.Context, reply *net.UnixConn, policy *NetworkPolicy, network, address string) {
+	defer reply.Close()
+	conn, err := policy.dial(ctx, network, address)
+	if err != nil {
+		reply.Write(append([]byte{netProxyErr}, err.Error()...))
+		return
+	}
+	f, err := connFile(conn)
+	if err != nil {
+		conn.Close()
+		reply.Write(append([]byte{netProxyErr}, err.Error()...))
+		return
+	}
+	defer f.Close()
+	reply.WriteMsgUnix([]byte{netProxyOK}, syscall.UnixRights(int(f.Fd())), nil)
+}
+
+// connFile returns a file for conn that can be handed to the plugin, and
+// takes over closing conn.  Conns that have no file of their own, such as
+// those made by a NetworkPolicy's Dial, are bridged to one end of a new socket
+// pair, whose other end is returned.
+func connFile(conn net.Conn) (*os.File, error) {
+	if fc, ok := conn.(interface{ File() (*os.File, error) }); ok {
+		f, err := fc.File()
+		if err == nil {
+			conn.Close()
+		}
+		return f, err
+	}
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socketpair", err)
+	}
+	ours, err := unixConn(os.NewFile(uintptr(fds[0]), "pie-net-bridge"))
+	if err != nil {
+		syscall.Close(fds[1])
+		return nil, err
+	}
+	bridged := make(chan struct{})
+	go func() {
+		io.Copy(ours, conn)
+		ours.CloseWrite()
+		<-bridged
+		ours.Close()
+	}()
+	go func() {
+		io.Copy(conn, ours)
+		conn.Close()
+		close(bridged)
+	}()
+	return os.NewFile(uintptr(fds[1]), "pie-net-bridge"), nil
+}
+
+// netProxy is the plugin's end of the host's network proxy.
+var netProxy struct {
+	once sync.Once
+	conn *net.UnixConn
+	err  error
+}
+
+// dialHost implements DialHostContext.
+func dialHost(ctx context.Context, network, address string) (net.Conn, error) {
+	netProxy.once.Do(func() {
+		fd, err := strconv.Atoi(providerGetenv(netProxyEnv))
+		if err != nil {
+			netProxy.err = ErrNoNetworkProxy
+			return
+		}
+		netProxy.conn, netProxy.err = unixConn(os.NewFile(uintptr(fd), "pie-net-proxy"))
+	})
+	if netProxy.err != nil {
+		return nil, netProxy.err
+	}
+	mine, theirs, err := seqpacketPair()
+	if err != nil {
+		return nil, err
+	}
+	_, _, err = netProxy.conn.WriteMsgUnix([]byte(network+"\x00"+address), syscall.UnixRights(int(theirs.Fd())), nil)
+	theirs.Close()
+	if err != nil {
+		mine.Close()
+		return nil, err
+	}
+	reply, err := unixConn(mine)
+	if err != nil {
+		return nil, err
+	}
+	defer reply.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			reply.Close()
+		case <-done:
+		}
+	}()
+	msg, fd, err := readFDMsg(reply)
+	if ctx.Err() != nil {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if msg[0] != netProxyOK || fd < 0 {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+		return nil, errors.New(string(msg[1:]))
+	}
+	f := os.NewFile(uintptr(fd), address)
+	defer f.Close()
+	return net.FileConn(f)
+}
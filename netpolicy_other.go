@@ -0,0 +1,20 @@
+//go:build !linux
+
+package pie
+
+import (
+	"context"
+	"net"
+	"os/exec"
+)
+
+// isolateNetwork is not supported on this platform.
+func isolateNetwork(cmd *exec.Cmd, policy *NetworkPolicy) (func(exited <-chan struct{}), error) {
+	return nil, ErrNetworkIsolationUnsupported
+}
+
+// dialHost is not supported on this platform, where no plugin has a network
+// proxy.
+func dialHost(ctx context.Context, network, address string) (net.Conn, error) {
+	return nil, ErrNoNetworkProxy
+}
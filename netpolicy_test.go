@@ -0,0 +1,144 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// lineServer listens on the loopback interface, and writes line to each
+// connection it accepts.
+func lineServer(t *testing.T, line string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(line))
+			conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// startIsolated starts the helper plugin with policy, skipping the test where
+// plugins cannot be isolated.
+func startIsolated(t *testing.T, policy NetworkPolicy) *Plugin {
+	p, err := StartPlugin(os.Stderr, os.Args[0], helperArgs("provider"), WithNetworkPolicy(policy))
+	if errors.Is(err, ErrNetworkIsolationUnsupported) {
+		t.Skip("network isolation is not supported on this platform")
+	}
+	if err != nil {
+		t.Skipf("Cannot start an isolated plugin: %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func TestNetworkPolicy(t *testing.T) {
+	addr := lineServer(t, "hello\n")
+	p := startIsolated(t, NetworkPolicy{Allow: []string{addr}})
+
+	var line string
+	if err := p.Call("helper.Dial", DialArgs{Address: addr, Direct: true}, &line); err == nil {
+		t.Error("Expected an isolated plugin not to reach the network itself")
+	}
+	if err := p.Call("helper.Dial", DialArgs{Address: addr}, &line); err != nil {
+		t.Fatalf("Unexpected error dialing through the host: %v", err)
+	}
+	if line != "hello\n" {
+		t.Errorf("Expected hello, got %q", line)
+	}
+	err := p.Call("helper.Dial", DialArgs{Address: "127.0.0.1:1"}, &line)
+	if err == nil || !strings.Contains(err.Error(), "does not allow") {
+		t.Errorf("Expected the policy to refuse another address, got %v", err)
+	}
+}
+
+func TestNetworkPolicyDial(t *testing.T) {
+	dialed := make(chan string, 1)
+	p := startIsolated(t, NetworkPolicy{
+		Allow: []string{"*.internal:80"},
+		Dial: func(_ context.Context, network, address string) (net.Conn, error) {
+			dialed <- network + " " + address
+			host, plugin := net.Pipe()
+			go func() {
+				host.Write([]byte("bridged\n"))
+				host.Close()
+			}()
+			return plugin, nil
+		},
+	})
+	var line string
+	if err := p.Call("helper.Dial", DialArgs{Address: "db.internal:80"}, &line); err != nil {
+		t.Fatal(err)
+	}
+	if line != "bridged\n" {
+		t.Errorf("Expected bridged, got %q", line)
+	}
+	if got := <-dialed; got != "tcp db.internal:80" {
+		t.Errorf("Expected the policy's Dial to be used, got %q", got)
+	}
+}
+
+func TestDialHostWithoutPolicy(t *testing.T) {
+	p := startHelper(t, "provider", os.Stderr)
+	defer p.Close()
+	var line string
+	err := p.Call("helper.Dial", DialArgs{Address: "127.0.0.1:1"}, &line)
+	if err == nil || err.Error() != ErrNoNetworkProxy.Error() {
+		t.Errorf("Expected %v, got %v", ErrNoNetworkProxy, err)
+	}
+}
+
+func TestNetworkPolicyAllows(t *testing.T) {
+	p := NetworkPolicy{Allow: []string{"api.example.com:443", "*.internal:*"}}
+	for addr, want := range map[string]bool{
+		"api.example.com:443": true,
+		"api.example.com:80":  false,
+		"db.internal:5432":    true,
+		"example.org:443":     false,
+	} {
+		if got := p.allows(addr); got != want {
+			t.Errorf("allows(%q) = %v, expected %v", addr, got, want)
+		}
+	}
+	if (&NetworkPolicy{}).allows("example.org:443") {
+		t.Error("Expected the zero policy to allow nothing")
+	}
+}
+
+func TestNetworkPolicyNetworks(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "host.sock")
+	p := NetworkPolicy{
+		Allow: []string{"*"},
+		Dial: func(_ context.Context, network, address string) (net.Conn, error) {
+			host, plugin := net.Pipe()
+			host.Close()
+			return plugin, nil
+		},
+	}
+	for _, network := range []string{"unix", "unixgram", "unixpacket", "ip4:icmp", ""} {
+		if _, err := p.dial(context.Background(), network, sock); err == nil || !strings.Contains(err.Error(), "does not allow the network") {
+			t.Errorf("Expected the policy to refuse the network %q, got %v", network, err)
+		}
+	}
+	for _, network := range []string{"tcp", "tcp6", "udp4"} {
+		conn, err := p.dial(context.Background(), network, "example.org:443")
+		if err != nil {
+			t.Errorf("Expected the policy to allow the network %q, got %v", network, err)
+			continue
+		}
+		conn.Close()
+	}
+}
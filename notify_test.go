@@ -0,0 +1,140 @@
+package pie
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+// recorder is an API that records the notifications it receives.
+type recorder chan string
+
+func (r recorder) Record(s string, _ *int) error {
+	r <- s
+	return nil
+}
+
+func (r recorder) Fail(s string) (int, error) {
+	r <- s
+	return 0, io.ErrUnexpectedEOF
+}
+
+// waitRecorded waits for the recorder to receive s.
+func waitRecorded(t *testing.T, r recorder, s string) {
+	t.Helper()
+	select {
+	case got := <-r:
+		if got != s {
+			t.Errorf("Wrong notification, expected %q, got %q", s, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for notification %q", s)
+	}
+}
+
+func TestNotifyGob(t *testing.T) {
+	s := NewProvider()
+	r := make(recorder, 10)
+	s.RegisterName("rec", r)
+	s.RegisterName("api", api{})
+	serverConn, clientConn := net.Pipe()
+	s.rwc = serverConn
+	go s.Serve()
+	codec := &clientCodec{ClientCodec: newGobClientCodec(clientConn)}
+	defer codec.Close()
+
+	if err := codec.notify("rec.Record", "one"); err != nil {
+		t.Fatalf("Unexpected error from notify: %#v", err)
+	}
+	waitRecorded(t, r, "one")
+	if err := codec.notify("rec.Fail", "two"); err != nil {
+		t.Fatalf("Unexpected error from notify: %#v", err)
+	}
+	waitRecorded(t, r, "two")
+	if err := codec.notify("rec.Missing", "three"); err != nil {
+		t.Fatalf("Unexpected error from notify: %#v", err)
+	}
+
+	// The first response read must be the one to the call, since
+	// notifications get none.
+	if err := codec.WriteRequest(&rpc.Request{ServiceMethod: "api.SayHi", Seq: 7}, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	var resp rpc.Response
+	if err := codec.ReadResponseHeader(&resp); err != nil {
+		t.Fatal(err)
+	}
+	var reply string
+	if err := codec.ReadResponseBody(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Seq != 7 || reply != "Hi bob" {
+		t.Errorf("Expected only the response to the call, got %#v, %q", resp, reply)
+	}
+}
+
+func TestNotifyJSON(t *testing.T) {
+	s := NewProvider()
+	r := make(recorder, 10)
+	s.RegisterName("rec", r)
+	s.RegisterName("api", api{})
+	serverConn, clientConn := net.Pipe()
+	s.rwc = serverConn
+	go s.ServeCodec(NewJSONServerCodec)
+	defer clientConn.Close()
+
+	go func() {
+		io.WriteString(clientConn, `{"method": "rec.Record", "params": ["one"], "id": null}`+"\n")
+		io.WriteString(clientConn, `{"method": "rec.Record", "params": ["two"]}`+"\n")
+		io.WriteString(clientConn, `{"method": "api.SayHi", "params": ["bob"], "id": 7}`+"\n")
+	}()
+	// Notifications run concurrently, like calls, so they may be recorded in
+	// either order.
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case s := <-r:
+			got[s] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for notifications")
+		}
+	}
+	if !got["one"] || !got["two"] {
+		t.Errorf("Expected notifications one and two, got %v", got)
+	}
+
+	var resp struct {
+		ID     int
+		Result string
+		Error  interface{}
+	}
+	if err := json.NewDecoder(bufio.NewReader(clientConn)).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != 7 || resp.Result != "Hi bob" || resp.Error != nil {
+		t.Errorf("Expected only the response to the call, got %#v", resp)
+	}
+}
+
+func TestPluginNotify(t *testing.T) {
+	p := startHelper(t, "provider", nil)
+	defer p.Close()
+	if err := p.Notify("helper.Exit", 7); err != nil {
+		t.Fatalf("Unexpected error from Notify: %#v", err)
+	}
+	select {
+	case <-p.Exited():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Plugin did not act on notification")
+	}
+	if st, _ := p.proc.Wait(); st == nil || st.ExitCode() != 7 {
+		t.Errorf("Expected plugin to exit with code 7, got %v", st)
+	}
+	if p.Calls() != 0 {
+		t.Errorf("Expected notifications not to count as calls, got %d", p.Calls())
+	}
+}
@@ -0,0 +1,371 @@
+package pie
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Media types of the OCI documents understood by OCIPuller.
+const (
+	ociManifestType = "application/vnd.oci.image.manifest.v1+json"
+	ociIndexType    = "application/vnd.oci.image.index.v1+json"
+)
+
+// ociTitleAnnotation is the standard annotation holding a layer's file name.
+const ociTitleAnnotation = "org.opencontainers.image.title"
+
+// OCIPuller pulls plugin binaries packaged as OCI artifacts from a container
+// registry, storing them in the same content addressed cache used by Fetcher.
+//
+// An artifact's manifest must have the plugin binary as its first layer.  If
+// the layer has an "org.opencontainers.image.title" annotation, it is used as
+// the cached binary's file name.  A reference may also point at an image index,
+// in which case the manifest for the host's platform is used.  Artifacts pushed
+// with tools such as oras follow these conventions.
+type OCIPuller struct {
+	// CacheDir is the directory pulled plugins are stored in.  It defaults to
+	// a "pie" directory in os.UserCacheDir.
+	CacheDir string
+	// Client is the HTTP client used to talk to registries.  It defaults to
+	// http.DefaultClient.
+	Client *http.Client
+	// PlainHTTP makes the puller talk to registries over http rather than
+	// https, which is useful for local registries.
+	PlainHTTP bool
+	// Username and Password, if set, are used to authenticate with the
+	// registry.  Otherwise anonymous access is used.
+	Username string
+	Password string
+
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+// OCIReference identifies an artifact in a registry, in the form
+// registry/repository[:tag][@digest].
+type OCIReference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	// Digest, if set, pins the artifact's manifest to a specific digest, in
+	// the form "sha256:<hex>".
+	Digest string
+}
+
+// String returns the reference in its canonical registry/repo:tag@digest form.
+func (r OCIReference) String() string {
+	s := r.Registry + "/" + r.Repository
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// ParseOCIReference parses a reference of the form
+// registry/repository[:tag][@digest].  If neither a tag nor a digest is given,
+// the tag defaults to "latest".
+func ParseOCIReference(ref string) (OCIReference, error) {
+	var r OCIReference
+	rest := ref
+	if i := strings.Index(rest, "@"); i >= 0 {
+		r.Digest = rest[i+1:]
+		rest = rest[:i]
+		if _, err := parseDigest(r.Digest); err != nil || !strings.HasPrefix(r.Digest, "sha256:") {
+			return OCIReference{}, fmt.Errorf("invalid digest in OCI reference %q", ref)
+		}
+	}
+	i := strings.Index(rest, "/")
+	if i <= 0 {
+		return OCIReference{}, fmt.Errorf("OCI reference %q has no registry", ref)
+	}
+	r.Registry, rest = rest[:i], rest[i+1:]
+	if j := strings.LastIndex(rest, ":"); j > strings.LastIndex(rest, "/") {
+		r.Tag, rest = rest[j+1:], rest[:j]
+	}
+	if rest == "" {
+		return OCIReference{}, fmt.Errorf("OCI reference %q has no repository", ref)
+	}
+	r.Repository = rest
+	if r.Tag == "" && r.Digest == "" {
+		r.Tag = "latest"
+	}
+	return r, nil
+}
+
+// ociDescriptor describes content in a registry.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+	} `json:"platform,omitempty"`
+}
+
+// ociManifest is an OCI image manifest or image index.
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Layers    []ociDescriptor `json:"layers"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+// Start pulls the plugin referenced by ref as Pull does, and then starts it
+// with StartPluginContext, so that ctx bounds both the pull and the start, and
+// closes the plugin when it is cancelled.
+func (p *OCIPuller) Start(ctx context.Context, output io.Writer, ref string, args []string, opts ...StartOption) (*Plugin, error) {
+	path, err := p.Pull(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return StartPluginContext(ctx, output, path, args, opts...)
+}
+
+// Pull returns the path of a cached, executable copy of the plugin binary in
+// the artifact referenced by ref, pulling it from the registry if it is not
+// already cached.  If ref includes a digest, the artifact's manifest must
+// match it.
+func (p *OCIPuller) Pull(ctx context.Context, ref string) (string, error) {
+	r, err := ParseOCIReference(ref)
+	if err != nil {
+		return "", err
+	}
+	reference, pinned := r.Tag, r.Digest
+	if pinned != "" {
+		reference = pinned
+	}
+	m, err := p.manifest(ctx, r, reference, pinned)
+	if err != nil {
+		return "", err
+	}
+	if len(m.Manifests) > 0 {
+		d, err := platformManifest(m.Manifests)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", r, err)
+		}
+		if m, err = p.manifest(ctx, r, d.Digest, d.Digest); err != nil {
+			return "", err
+		}
+	}
+	if len(m.Layers) == 0 {
+		return "", fmt.Errorf("OCI artifact %s has no layers", r)
+	}
+	layer := m.Layers[0]
+	sum, err := parseDigest(layer.Digest)
+	if err != nil || !strings.HasPrefix(layer.Digest, "sha256:") {
+		return "", fmt.Errorf("OCI artifact %s has unsupported layer digest %q", r, layer.Digest)
+	}
+	name := cacheName(layer.Annotations[ociTitleAnnotation], cacheName(r.Repository, "plugin"))
+	dest, err := pluginCachePath(p.CacheDir, sum, name)
+	if err != nil {
+		return "", err
+	}
+	if fileDigest(dest) == sum {
+		return dest, nil
+	}
+	resp, err := p.get(ctx, r, "blobs/"+layer.Digest, "")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := writeVerified(resp.Body, r.String(), sum, dest); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
+
+// manifest fetches the manifest or index with the given tag or digest.  If
+// pinned is not empty, the manifest's digest must match it.
+func (p *OCIPuller) manifest(ctx context.Context, r OCIReference, reference, pinned string) (*ociManifest, error) {
+	resp, err := p.get(ctx, r, "manifests/"+reference, ociManifestType+", "+ociIndexType)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return nil, err
+	}
+	if pinned != "" {
+		sum := sha256.Sum256(data)
+		if actual := "sha256:" + hex.EncodeToString(sum[:]); actual != pinned {
+			return nil, &DigestMismatchError{URL: r.String(), Expected: pinned, Actual: actual}
+		}
+	}
+	m := &ociManifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("invalid OCI manifest for %s: %w", r, err)
+	}
+	return m, nil
+}
+
+// platformManifest returns the descriptor in an image index for the host's
+// platform.
+func platformManifest(manifests []ociDescriptor) (ociDescriptor, error) {
+	for _, d := range manifests {
+		if d.Platform != nil && d.Platform.OS == runtime.GOOS && d.Platform.Architecture == runtime.GOARCH {
+			return d, nil
+		}
+	}
+	return ociDescriptor{}, fmt.Errorf("no manifest for %s/%s in image index", runtime.GOOS, runtime.GOARCH)
+}
+
+// get fetches a path under the repository's API endpoint, authenticating with
+// a bearer token if the registry asks for one.
+func (p *OCIPuller) get(ctx context.Context, r OCIReference, rel, accept string) (*http.Response, error) {
+	scheme := "https"
+	if p.PlainHTTP {
+		scheme = "http"
+	}
+	u := scheme + "://" + r.Registry + "/v2/" + r.Repository + "/" + rel
+	resp, err := p.do(ctx, u, accept, r.Repository)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if err := p.authenticate(ctx, r.Repository, challenge); err != nil {
+			return nil, err
+		}
+		if resp, err = p.do(ctx, u, accept, r.Repository); err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("error fetching %s from %s: %s", rel, r, resp.Status)
+	}
+	return resp, nil
+}
+
+// do performs a GET request, using the token for repo if there is one.
+func (p *OCIPuller) do(ctx context.Context, u, accept, repo string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	p.mu.Lock()
+	token := p.tokens[repo]
+	p.mu.Unlock()
+	switch {
+	case token != "":
+		req.Header.Set("Authorization", "Bearer "+token)
+	case p.Username != "":
+		req.SetBasicAuth(p.Username, p.Password)
+	}
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// authenticate obtains a pull token for repo from the token service described
+// by a Bearer WWW-Authenticate challenge.
+func (p *OCIPuller) authenticate(ctx context.Context, repo, challenge string) error {
+	params, ok := parseBearerChallenge(challenge)
+	if !ok || params["realm"] == "" {
+		return errors.New("registry requires authentication with an unsupported scheme: " + challenge)
+	}
+	q := url.Values{}
+	if s := params["service"]; s != "" {
+		q.Set("service", s)
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + repo + ":pull"
+	}
+	q.Set("scope", scope)
+	req, err := http.NewRequestWithContext(ctx, "GET", params["realm"]+"?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if p.Username != "" {
+		req.SetBasicAuth(p.Username, p.Password)
+	}
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error getting registry token for %s: %s", repo, resp.Status)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return err
+	}
+	token := body.Token
+	if token == "" {
+		token = body.AccessToken
+	}
+	if token == "" {
+		return errors.New("registry token service returned no token for " + repo)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tokens == nil {
+		p.tokens = map[string]string{}
+	}
+	p.tokens[repo] = token
+	return nil
+}
+
+// parseBearerChallenge parses the parameters of a WWW-Authenticate header of
+// the form: Bearer realm="...",service="...",scope="...".
+func parseBearerChallenge(challenge string) (map[string]string, bool) {
+	const prefix = "bearer "
+	if len(challenge) < len(prefix) || !strings.EqualFold(challenge[:len(prefix)], prefix) {
+		return nil, false
+	}
+	params := map[string]string{}
+	rest := challenge[len(prefix):]
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+		var val string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				return nil, false
+			}
+			val, rest = rest[1:end+1], rest[end+2:]
+		} else if comma := strings.Index(rest, ","); comma >= 0 {
+			val, rest = rest[:comma], rest[comma:]
+		} else {
+			val, rest = rest, ""
+		}
+		params[key] = val
+	}
+	return params, true
+}
@@ -0,0 +1,204 @@
+package pie
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseOCIReference(t *testing.T) {
+	digest := "sha256:" + sha256Hex(nil)
+	tests := []struct {
+		ref      string
+		expected OCIReference
+	}{
+		{"ghcr.io/acme/foo", OCIReference{"ghcr.io", "acme/foo", "latest", ""}},
+		{"ghcr.io/acme/foo:v1.2", OCIReference{"ghcr.io", "acme/foo", "v1.2", ""}},
+		{"localhost:5000/foo:v1", OCIReference{"localhost:5000", "foo", "v1", ""}},
+		{"ghcr.io/acme/foo@" + digest, OCIReference{"ghcr.io", "acme/foo", "", digest}},
+		{"ghcr.io/acme/foo:v1@" + digest, OCIReference{"ghcr.io", "acme/foo", "v1", digest}},
+	}
+	for _, test := range tests {
+		r, err := ParseOCIReference(test.ref)
+		if err != nil {
+			t.Errorf("Unexpected error parsing %q: %s", test.ref, err)
+			continue
+		}
+		if r != test.expected {
+			t.Errorf("Wrong parse of %q, expected %#v, got %#v", test.ref, test.expected, r)
+		}
+		if r.String() != test.ref && !strings.HasSuffix(test.ref, "/foo") {
+			t.Errorf("Reference %q did not round trip, got %q", test.ref, r.String())
+		}
+	}
+	for _, bad := range []string{"foo", "ghcr.io/", "ghcr.io/foo@sha256:1234"} {
+		if _, err := ParseOCIReference(bad); err == nil {
+			t.Errorf("Expected error parsing %q", bad)
+		}
+	}
+}
+
+// fakeRegistry serves a single plugin artifact, behind an index for the host
+// platform, and requires a bearer token obtained from its token endpoint.
+type fakeRegistry struct {
+	srv       *httptest.Server
+	binary    []byte
+	index     []byte
+	manifests map[string][]byte
+	blobPulls int32
+}
+
+func newFakeRegistry(t *testing.T, binary []byte) *fakeRegistry {
+	r := &fakeRegistry{binary: binary, manifests: map[string][]byte{}}
+	layerDigest := "sha256:" + sha256Hex(binary)
+	manifest, _ := json.Marshal(ociManifest{
+		MediaType: ociManifestType,
+		Layers: []ociDescriptor{{
+			MediaType:   "application/octet-stream",
+			Digest:      layerDigest,
+			Size:        int64(len(binary)),
+			Annotations: map[string]string{ociTitleAnnotation: "foo-plugin"},
+		}},
+	})
+	manifestDigest := "sha256:" + sha256Hex(manifest)
+	r.manifests[manifestDigest] = manifest
+	index := ociManifest{MediaType: ociIndexType, Manifests: []ociDescriptor{{
+		MediaType: ociManifestType,
+		Digest:    manifestDigest,
+		Size:      int64(len(manifest)),
+	}}}
+	index.Manifests[0].Platform = &struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+	}{runtime.GOOS, runtime.GOARCH}
+	r.index, _ = json.Marshal(index)
+	r.manifests["sha256:"+sha256Hex(r.index)] = r.index
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("scope") != "repository:acme/foo:pull" {
+			http.Error(w, "bad scope", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"token":"secret"}`))
+	})
+	mux.HandleFunc("/v2/acme/foo/", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+r.srv.URL+`/token",service="fake"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		rel := strings.TrimPrefix(req.URL.Path, "/v2/acme/foo/")
+		switch {
+		case rel == "manifests/v1":
+			w.Write(r.index)
+		case strings.HasPrefix(rel, "manifests/"):
+			m, ok := r.manifests[strings.TrimPrefix(rel, "manifests/")]
+			if !ok {
+				http.NotFound(w, req)
+				return
+			}
+			w.Write(m)
+		case rel == "blobs/"+layerDigest:
+			atomic.AddInt32(&r.blobPulls, 1)
+			w.Write(r.binary)
+		default:
+			http.NotFound(w, req)
+		}
+	})
+	r.srv = httptest.NewTLSServer(mux)
+	t.Cleanup(r.srv.Close)
+	return r
+}
+
+// ref returns a reference to the fake registry's artifact with the given tag
+// or digest suffix, such as ":v1".
+func (r *fakeRegistry) ref(suffix string) string {
+	return strings.TrimPrefix(r.srv.URL, "https://") + "/acme/foo" + suffix
+}
+
+func TestOCIPullerPull(t *testing.T) {
+	binary := []byte("#!/bin/sh\necho hi\n")
+	reg := newFakeRegistry(t, binary)
+	p := &OCIPuller{CacheDir: t.TempDir(), Client: reg.srv.Client()}
+
+	path, err := p.Pull(context.Background(), reg.ref(":v1"))
+	if err != nil {
+		t.Fatalf("Unexpected error from Pull: %#v", err)
+	}
+	if filepath.Base(path) != "foo-plugin" {
+		t.Errorf("Expected binary to be named from its title annotation, got %q", path)
+	}
+	if got, _ := os.ReadFile(path); string(got) != string(binary) {
+		t.Errorf("Wrong binary contents, expected %q, got %q", binary, got)
+	}
+	if _, err := p.Pull(context.Background(), reg.ref(":v1")); err != nil {
+		t.Fatalf("Unexpected error from second Pull: %#v", err)
+	}
+	if n := atomic.LoadInt32(&reg.blobPulls); n != 1 {
+		t.Errorf("Expected the blob to be pulled once, got %d pulls", n)
+	}
+
+	pinned := reg.ref(":v1@sha256:" + sha256Hex(reg.index))
+	if _, err := p.Pull(context.Background(), pinned); err != nil {
+		t.Errorf("Unexpected error pulling with a pinned digest: %#v", err)
+	}
+	wrong := reg.ref("@sha256:" + sha256Hex([]byte("other")))
+	if _, err := p.Pull(context.Background(), wrong); err == nil {
+		t.Error("Expected error pulling a digest the registry doesn't have")
+	}
+}
+
+func TestOCIPullerStartContext(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("#!/bin/sh\necho hi\n"))
+	p := &OCIPuller{CacheDir: t.TempDir(), Client: reg.srv.Client()}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.Start(ctx, os.Stderr, reg.ref(":v1"), nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if n := atomic.LoadInt32(&reg.blobPulls); n != 0 {
+		t.Errorf("Expected no blob pulls, got %d", n)
+	}
+}
+
+func TestOCIPullerPinnedDigestMismatch(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("plugin"))
+	p := &OCIPuller{CacheDir: t.TempDir(), Client: reg.srv.Client()}
+	// Serve a different index under the pinned digest's name.
+	digest := "sha256:" + sha256Hex([]byte("other"))
+	reg.manifests[digest] = reg.index
+	_, err := p.Pull(context.Background(), reg.ref("@"+digest))
+	var derr *DigestMismatchError
+	if !errors.As(err, &derr) {
+		t.Fatalf("Expected *DigestMismatchError, got %#v", err)
+	}
+}
+
+func TestParseBearerChallenge(t *testing.T) {
+	params, ok := parseBearerChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:foo:pull"`)
+	if !ok {
+		t.Fatal("Failed to parse bearer challenge")
+	}
+	expected := map[string]string{
+		"realm":   "https://auth.example.com/token",
+		"service": "registry.example.com",
+		"scope":   "repository:foo:pull",
+	}
+	for k, v := range expected {
+		if params[k] != v {
+			t.Errorf("Wrong %s, expected %q, got %q", k, v, params[k])
+		}
+	}
+	if _, ok := parseBearerChallenge(`Basic realm="foo"`); ok {
+		t.Error("Unexpectedly parsed a basic challenge as bearer")
+	}
+}
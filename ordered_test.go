@@ -0,0 +1,140 @@
+package pie
+
+import (
+	"fmt"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+)
+
+// orderAPI records the order in which calls for each key run, and checks that
+// calls for the same key never overlap.
+type orderAPI struct {
+	mu      sync.Mutex
+	order   map[string][]int
+	running map[string]bool
+	overlap bool
+	// both is closed once calls for two different keys are running at once.
+	both chan struct{}
+}
+
+// OrderArgs are the arguments to orderAPI.Do.
+type OrderArgs struct {
+	Key string
+	N   int
+}
+
+func (a *orderAPI) Do(args OrderArgs, _ *int) error {
+	a.mu.Lock()
+	if a.running[args.Key] {
+		a.overlap = true
+	}
+	a.running[args.Key] = true
+	if len(a.running) > 1 && a.both != nil {
+		close(a.both)
+		a.both = nil
+	}
+	a.mu.Unlock()
+
+	// Give later calls a chance to overtake this one if they could.
+	time.Sleep(time.Millisecond)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.running, args.Key)
+	a.order[args.Key] = append(a.order[args.Key], args.N)
+	return nil
+}
+
+// Wait blocks until calls for two keys have been running at the same time.
+func (a *orderAPI) Wait(key string, _ *int) error {
+	a.mu.Lock()
+	a.running[key] = true
+	both := a.both
+	if len(a.running) > 1 && both != nil {
+		close(both)
+		a.both = nil
+	}
+	a.mu.Unlock()
+	if both != nil {
+		select {
+		case <-both:
+		case <-time.After(5 * time.Second):
+			return fmt.Errorf("calls for other keys did not run concurrently with %s", key)
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.running, key)
+	return nil
+}
+
+func newOrderAPI() *orderAPI {
+	return &orderAPI{order: map[string][]int{}, running: map[string]bool{}, both: make(chan struct{})}
+}
+
+func TestOrderedCalls(t *testing.T) {
+	s := NewProvider()
+	a := newOrderAPI()
+	a.both = nil
+	s.RegisterName("order", a)
+	client := servePipe(t, s, nil, nil)
+
+	const n = 50
+	var calls []*rpc.Call
+	for i := 0; i < n; i++ {
+		for _, key := range []string{"a", "b"} {
+			method := callMeta{key: key}.encode("order.Do")
+			calls = append(calls, client.Go(method, OrderArgs{key, i}, new(int), nil))
+		}
+	}
+	for _, call := range calls {
+		<-call.Done
+		if call.Error != nil {
+			t.Fatalf("Unexpected error from ordered call: %#v", call.Error)
+		}
+	}
+	if a.overlap {
+		t.Error("Calls with the same key ran concurrently")
+	}
+	for _, key := range []string{"a", "b"} {
+		order := a.order[key]
+		if len(order) != n {
+			t.Fatalf("Expected %d calls for key %s, got %d", n, key, len(order))
+		}
+		for i, got := range order {
+			if got != i {
+				t.Fatalf("Calls for key %s ran out of order: %v", key, order)
+			}
+		}
+	}
+}
+
+func TestOrderedCallsDifferentKeysConcurrent(t *testing.T) {
+	s := NewProvider()
+	a := newOrderAPI()
+	s.RegisterName("order", a)
+	client := servePipe(t, s, nil, nil)
+
+	ca := client.Go(callMeta{key: "a"}.encode("order.Wait"), "a", new(int), nil)
+	cb := client.Go(callMeta{key: "b"}.encode("order.Wait"), "b", new(int), nil)
+	for _, call := range []*rpc.Call{ca, cb} {
+		<-call.Done
+		if call.Error != nil {
+			t.Errorf("Unexpected error: %s", call.Error)
+		}
+	}
+}
+
+func TestPluginCallOrdered(t *testing.T) {
+	p := startHelper(t, "provider", nil)
+	defer p.Close()
+	var response string
+	if err := p.CallOrdered("doc-1", "api.SayHi", "bob", &response); err != nil {
+		t.Fatalf("Unexpected error from CallOrdered: %#v", err)
+	}
+	if response != "Hi bob" {
+		t.Errorf("Wrong response from ordered call, expected %q, got %q", "Hi bob", response)
+	}
+}
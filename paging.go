@@ -0,0 +1,135 @@
+package pie
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Paging lets a provider return a large list a page at a time, so that no
+// single reply has to hold all of it.  A paged method takes a PageRequest and
+// replies with a Page:
+//
+//	func (s *Store) List(req pie.PageRequest[Query], page *pie.Page[Item]) error
+//
+// The host asks for the first page with an empty cursor, and for each later
+// page with the Next cursor of the page before, until a page has no Next
+// cursor.  Iterate does this for the host.
+
+// PageRequest is the argument of a paged method.
+type PageRequest[A any] struct {
+	// Args are the method's own arguments, which are the same for every page.
+	Args A
+	// Cursor is empty for the first page, and the Next cursor of the previous
+	// page otherwise.
+	Cursor string
+	// Limit is the most items the host wants in the page.  If it is zero,
+	// the provider chooses.
+	Limit int
+}
+
+// Page is the reply of a paged method.
+type Page[T any] struct {
+	Items []T
+	// Next is the cursor to request the next page with, or empty if this is
+	// the last page.  Its meaning is up to the provider.
+	Next string
+}
+
+// PageOf returns the page of items that starts at cursor and holds at most
+// limit items, or all those left if limit is not positive.  It lets a provider
+// that has the whole list in memory answer a PageRequest, using offsets into
+// items as cursors.
+func PageOf[T any](items []T, cursor string, limit int) (Page[T], error) {
+	start := 0
+	if cursor != "" {
+		n, err := strconv.Atoi(cursor)
+		if err != nil || n < 0 || n > len(items) {
+			return Page[T]{}, fmt.Errorf("pie: invalid page cursor %q", cursor)
+		}
+		start = n
+	}
+	end := len(items)
+	if limit > 0 && end-start > limit {
+		end = start + limit
+	}
+	page := Page[T]{Items: items[start:end]}
+	if end < len(items) {
+		page.Next = strconv.Itoa(end)
+	}
+	return page, nil
+}
+
+// Iterator iterates over the items of a paged method's result, fetching pages
+// as they are needed.  Use it like a bufio.Scanner:
+//
+//	it := pie.Iterate[Item](p, "Store.List", query, 100)
+//	for it.Next() {
+//		item := it.Value()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type Iterator[T, A any] struct {
+	c      Caller
+	method string
+	req    PageRequest[A]
+
+	items []T
+	value T
+	// last is set once the last page has been fetched.
+	last bool
+	err  error
+}
+
+// Iterate returns an iterator over the items returned by the paged method
+// serviceMethod when called through c with args, asking for pages of at most
+// limit items, or of the provider's choosing if limit is zero.  No call is made
+// until the iterator's Next method is called.
+func Iterate[T, A any](c Caller, serviceMethod string, args A, limit int) *Iterator[T, A] {
+	return &Iterator[T, A]{c: c, method: serviceMethod, req: PageRequest[A]{Args: args, Limit: limit}}
+}
+
+// Next advances to the next item, fetching the next page if the current one
+// has been used up, and reports whether there is one.  It returns false at
+// the end of the items and when a call fails, which Err reports.
+func (it *Iterator[T, A]) Next() bool {
+	for len(it.items) == 0 {
+		if it.last || it.err != nil {
+			return false
+		}
+		var page Page[T]
+		if err := it.c.Call(it.method, it.req, &page); err != nil {
+			it.err = err
+			return false
+		}
+		if page.Next != "" && page.Next == it.req.Cursor {
+			it.err = fmt.Errorf("pie: %s returned cursor %q for the page it was asked for", it.method, page.Next)
+			return false
+		}
+		it.items = page.Items
+		it.req.Cursor = page.Next
+		it.last = page.Next == ""
+	}
+	it.value, it.items = it.items[0], it.items[1:]
+	return true
+}
+
+// Value returns the current item.
+func (it *Iterator[T, A]) Value() T {
+	return it.value
+}
+
+// Err returns the error that ended the iteration, if any.
+func (it *Iterator[T, A]) Err() error {
+	return it.err
+}
+
+// All fetches the remaining items and returns them.
+func (it *Iterator[T, A]) All() ([]T, error) {
+	var all []T
+	for it.Next() {
+		all = append(all, it.Value())
+	}
+	return all, it.Err()
+}
@@ -0,0 +1,118 @@
+package pie
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Query is the argument of pagedAPI's methods.
+type Query struct {
+	Prefix string
+}
+
+// pagedAPI serves paged lists of words.
+type pagedAPI struct {
+	words []string
+	calls int
+}
+
+func (a *pagedAPI) Words(req PageRequest[Query], page *Page[string]) error {
+	a.calls++
+	var matched []string
+	for _, w := range a.words {
+		if strings.HasPrefix(w, req.Args.Prefix) {
+			matched = append(matched, w)
+		}
+	}
+	p, err := PageOf(matched, req.Cursor, req.Limit)
+	*page = p
+	return err
+}
+
+func (a *pagedAPI) Stuck(req PageRequest[Query], page *Page[string]) error {
+	*page = Page[string]{Items: []string{"again"}, Next: "same"}
+	return nil
+}
+
+func pagedPlugin(t *testing.T) (*Plugin, *pagedAPI) {
+	s := NewProvider()
+	api := &pagedAPI{words: []string{"apple", "avocado", "banana", "apricot", "almond", "blueberry", "acai"}}
+	if err := s.RegisterName("words", api); err != nil {
+		t.Fatal(err)
+	}
+	return pipePlugin(t, s), api
+}
+
+func TestIterate(t *testing.T) {
+	p, api := pagedPlugin(t)
+	got, err := Iterate[string](p, "words.Words", Query{Prefix: "a"}, 2).All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"apple", "avocado", "apricot", "almond", "acai"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	if api.calls != 3 {
+		t.Errorf("Expected 3 pages to be fetched, got %d", api.calls)
+	}
+}
+
+func TestIterateLazy(t *testing.T) {
+	p, api := pagedPlugin(t)
+	it := Iterate[string](p, "words.Words", Query{}, 3)
+	if api.calls != 0 {
+		t.Fatal("Expected no call before Next")
+	}
+	for i := 0; i < 3 && it.Next(); i++ {
+	}
+	if api.calls != 1 {
+		t.Errorf("Expected only the first page to be fetched, got %d calls", api.calls)
+	}
+}
+
+func TestIterateEmpty(t *testing.T) {
+	p, _ := pagedPlugin(t)
+	it := Iterate[string](p, "words.Words", Query{Prefix: "z"}, 0)
+	if it.Next() {
+		t.Errorf("Expected no items, got %q", it.Value())
+	}
+	if it.Err() != nil {
+		t.Errorf("Unexpected error: %v", it.Err())
+	}
+}
+
+func TestIterateErrors(t *testing.T) {
+	p, _ := pagedPlugin(t)
+	it := Iterate[string](p, "words.Stuck", Query{}, 0)
+	it.Next()
+	if it.Next() || it.Err() == nil {
+		t.Error("Expected an error from a method that does not advance its cursor")
+	}
+	_, err := Iterate[string](p, "words.Missing", Query{}, 0).All()
+	if !isMissingMethod(err) {
+		t.Errorf("Expected the call's error, got %v", err)
+	}
+}
+
+func TestPageOf(t *testing.T) {
+	items := []int{1, 2, 3, 4, 5}
+	page, err := PageOf(items, "", 2)
+	if err != nil || !reflect.DeepEqual(page, Page[int]{Items: []int{1, 2}, Next: "2"}) {
+		t.Errorf("Unexpected first page %+v, %v", page, err)
+	}
+	page, err = PageOf(items, "4", 2)
+	if err != nil || !reflect.DeepEqual(page, Page[int]{Items: []int{5}}) {
+		t.Errorf("Unexpected last page %+v, %v", page, err)
+	}
+	page, err = PageOf(items, "", 0)
+	if err != nil || len(page.Items) != 5 || page.Next != "" {
+		t.Errorf("Expected all items without a limit, got %+v, %v", page, err)
+	}
+	for _, cursor := range []string{"x", "-1", "6"} {
+		if _, err := PageOf(items, cursor, 2); err == nil {
+			t.Errorf("Expected an error for cursor %q", cursor)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package pie
+
+import (
+	"debug/elf"
+	"debug/gosym"
+	"debug/macho"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
+)
+
+// ErrNoPanic is returned by ParsePanic when the output holds no Go panic or
+// fatal error.
+var ErrNoPanic = errors.New("no Go panic in output")
+
+// PanicReport is the Go runtime's report of a panic or fatal error, parsed
+// from what it wrote to stderr.
+type PanicReport struct {
+	// Message is the value of the first panic printed, or the fatal error's
+	// message, as the runtime printed it, including any "[recovered]" tag.
+	Message string
+	// Fatal reports whether the report is of a fatal error, such as a
+	// deadlock or concurrent map writes, rather than a panic.
+	Fatal bool
+	// Nested holds the values of the panics printed after the first, which
+	// happened while it was being handled, oldest first.
+	Nested []string
+	// Signal describes the signal the runtime turned into the panic, such as
+	// the SIGSEGV of a nil pointer dereference, or is nil if there was none.
+	Signal *PanicSignal
+	// Goroutines holds the stacks the runtime printed, the one that panicked
+	// first.  How many there are depends on the plugin's GOTRACEBACK.
+	Goroutines []Goroutine
+}
+
+// PanicSignal describes a signal reported by the Go runtime.
+type PanicSignal struct {
+	// Name is the signal's name, such as "SIGSEGV", and Description what the
+	// runtime printed after it, such as "segmentation violation".
+	Name        string
+	Description string
+	// Code is the signal's code, Addr the faulting address, and PC the
+	// address of the faulting instruction.
+	Code, Addr, PC uint64
+	// Func, File and Line locate PC in the source, once the report has been
+	// symbolized.
+	Func string
+	File string
+	Line int
+}
+
+// Goroutine is the stack of a goroutine in a PanicReport.
+type Goroutine struct {
+	// ID is the goroutine's number, and State what it was doing, such as
+	// "running" or "chan receive, 2 minutes".
+	ID    int
+	State string
+	// Frames holds the goroutine's stack, innermost call first.
+	Frames []PanicFrame
+	// Elided reports whether the runtime left frames out of the stack.
+	Elided bool
+	// CreatedBy is the go statement that started the goroutine, and ParentID
+	// the goroutine that ran it, or nil and zero for the main goroutine.
+	CreatedBy *PanicFrame
+	ParentID  int
+}
+
+// PanicFrame is a frame of a goroutine's stack in a PanicReport.
+type PanicFrame struct {
+	// Func is the function's full name, such as "main.(*T).f", and Args the
+	// arguments the runtime printed for it, or "..." if the call was
+	// inlined.
+	Func string
+	Args string
+	// File and Line locate the call in the source.
+	File string
+	Line int
+	// Offset is the offset of PC from the start of the function.
+	Offset uint64
+	// PC is the frame's program counter.  The runtime only prints it when
+	// GOTRACEBACK is "system" or more, but Symbolize fills it in.
+	PC uint64
+}
+
+// ParsePanic finds the Go runtime's report of a panic or fatal error in
+// output, which is typically a plugin's stderr, and parses it.  Lines output
+// holds before the report are skipped, as are lines mixed into it that are not
+// the runtime's, such as those other goroutines logged while it was printed.
+// It returns ErrNoPanic if output holds no report.
+func ParsePanic(output []byte) (*PanicReport, error) {
+	text := goPanic(output)
+	if text == "" {
+		return nil, ErrNoPanic
+	}
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	r := &PanicReport{}
+	if msg, ok := strings.CutPrefix(lines[0], "fatal error: "); ok {
+		r.Fatal = true
+		r.Message = msg
+	} else {
+		r.Message = strings.TrimPrefix(lines[0], "panic: ")
+	}
+	i := 1
+	// The panic's value may span lines, until the signal, a blank line, or
+	// the first goroutine.
+	msg := &r.Message
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		if line == "" || strings.HasPrefix(line, "[signal ") || strings.HasPrefix(line, "goroutine ") {
+			break
+		}
+		if nested, ok := strings.CutPrefix(line, "\tpanic: "); ok {
+			r.Nested = append(r.Nested, nested)
+			msg = &r.Nested[len(r.Nested)-1]
+			continue
+		}
+		if nested, ok := strings.CutPrefix(line, "\tfatal error: "); ok {
+			r.Nested = append(r.Nested, nested)
+			msg = &r.Nested[len(r.Nested)-1]
+			continue
+		}
+		*msg += "\n" + line
+	}
+	var g *Goroutine
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case strings.HasPrefix(line, "[signal "):
+			if r.Signal == nil {
+				r.Signal = parsePanicSignal(line)
+			}
+		case strings.HasPrefix(line, "goroutine "):
+			if gr, ok := parseGoroutineHeader(line); ok {
+				r.Goroutines = append(r.Goroutines, gr)
+				g = &r.Goroutines[len(r.Goroutines)-1]
+			}
+		case g == nil || line == "":
+		case strings.HasPrefix(line, "...") && strings.HasSuffix(line, "..."):
+			g.Elided = true
+		case strings.HasPrefix(line, "created by "):
+			f := parseCreatedBy(line, g)
+			if i+1 < len(lines) && parseFrameLocation(lines[i+1], &f) {
+				i++
+			}
+			g.CreatedBy = &f
+		default:
+			f, ok := parseFrameCall(line)
+			if !ok {
+				continue
+			}
+			if i+1 < len(lines) && parseFrameLocation(lines[i+1], &f) {
+				i++
+			}
+			g.Frames = append(g.Frames, f)
+		}
+	}
+	return r, nil
+}
+
+// parsePanicSignal parses a line like
+//
+//	[signal SIGSEGV: segmentation violation code=0x1 addr=0x0 pc=0x45d2c4]
+func parsePanicSignal(line string) *PanicSignal {
+	line = strings.TrimSuffix(strings.TrimPrefix(line, "[signal "), "]")
+	s := &PanicSignal{}
+	name, rest, _ := strings.Cut(line, ": ")
+	s.Name = name
+	var desc []string
+	for _, field := range strings.Fields(rest) {
+		key, value, ok := strings.Cut(field, "=")
+		n, err := strconv.ParseUint(value, 0, 64)
+		if !ok || err != nil {
+			desc = append(desc, field)
+			continue
+		}
+		switch key {
+		case "code":
+			s.Code = n
+		case "addr":
+			s.Addr = n
+		case "pc":
+			s.PC = n
+		default:
+			desc = append(desc, field)
+		}
+	}
+	s.Description = strings.Join(desc, " ")
+	return s
+}
+
+// parseGoroutineHeader parses a line like
+//
+//	goroutine 1 gp=0xc000002380 m=0 mp=0x5323c0 [running]:
+func parseGoroutineHeader(line string) (Goroutine, bool) {
+	rest := strings.TrimPrefix(line, "goroutine ")
+	open := strings.IndexByte(rest, '[')
+	end := strings.LastIndex(rest, "]:")
+	if open < 0 || end < open {
+		return Goroutine{}, false
+	}
+	fields := strings.Fields(rest[:open])
+	if len(fields) == 0 {
+		return Goroutine{}, false
+	}
+	id, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return Goroutine{}, false
+	}
+	return Goroutine{ID: id, State: rest[open+1 : end]}, true
+}
+
+// parseFrameCall parses the call line of a frame, like
+//
+//	main.(*T).f(0x0, {0x4c5d2a, 0x1})
+func parseFrameCall(line string) (PanicFrame, bool) {
+	if !strings.HasSuffix(line, ")") || strings.HasPrefix(line, "\t") {
+		return PanicFrame{}, false
+	}
+	open := strings.LastIndexByte(line, '(')
+	if open <= 0 {
+		return PanicFrame{}, false
+	}
+	return PanicFrame{Func: line[:open], Args: line[open+1 : len(line)-1]}, true
+}
+
+// parseCreatedBy parses a line like
+//
+//	created by main.main in goroutine 1
+//
+// setting g's ParentID.
+func parseCreatedBy(line string, g *Goroutine) PanicFrame {
+	fn := strings.TrimPrefix(line, "created by ")
+	if i := strings.LastIndex(fn, " in goroutine "); i >= 0 {
+		g.ParentID, _ = strconv.Atoi(fn[i+len(" in goroutine "):])
+		fn = fn[:i]
+	}
+	return PanicFrame{Func: fn}
+}
+
+// parseFrameLocation parses the location line of a frame into f, reporting
+// whether line is one.  It looks like
+//
+//	/src/main.go:13 +0x27 fp=0xc00006ef68 sp=0xc00006ef50 pc=0x45d2c4
+//
+// indented with a tab, where what follows the line number may be missing.
+func parseFrameLocation(line string, f *PanicFrame) bool {
+	if !strings.HasPrefix(line, "\t") {
+		return false
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false
+	}
+	colon := strings.LastIndexByte(fields[0], ':')
+	if colon < 0 {
+		return false
+	}
+	n, err := strconv.Atoi(fields[0][colon+1:])
+	if err != nil {
+		return false
+	}
+	f.File, f.Line = fields[0][:colon], n
+	for _, field := range fields[1:] {
+		if off, ok := strings.CutPrefix(field, "+"); ok {
+			f.Offset, _ = strconv.ParseUint(off, 0, 64)
+		} else if pc, ok := strings.CutPrefix(field, "pc="); ok {
+			f.PC, _ = strconv.ParseUint(pc, 0, 64)
+		}
+	}
+	return true
+}
+
+// Symbolize locates the report's addresses in the Go executable at binary,
+// which should be the one the plugin ran.  It fills in the signal's Func, File
+// and Line, and the PC of frames that lack one, and the Func, File and Line of
+// frames that lack those.  Executables that are position independent are
+// supported if the report holds a frame with a PC to relocate them with, so
+// run the plugin with GOTRACEBACK=system for those.  Only ELF and Mach-O
+// executables are supported.
+func (r *PanicReport) Symbolize(binary string) error {
+	table, err := loadSymbols(binary)
+	if err != nil {
+		return fmt.Errorf("pie: symbolizing panic: %w", err)
+	}
+	// slide is how far the executable was loaded from its linked address,
+	// which is found by comparing a frame's PC with its function's entry.
+	var slide uint64
+found:
+	for _, g := range r.Goroutines {
+		for _, f := range g.Frames {
+			if fn := table.LookupFunc(f.Func); fn != nil && f.PC != 0 {
+				slide = f.PC - f.Offset - fn.Entry
+				break found
+			}
+		}
+	}
+	if s := r.Signal; s != nil && s.PC != 0 {
+		if file, line, fn := table.PCToLine(s.PC - slide); fn != nil {
+			s.Func, s.File, s.Line = fn.Name, file, line
+		}
+	}
+	for i := range r.Goroutines {
+		g := &r.Goroutines[i]
+		for j := range g.Frames {
+			symbolizeFrame(table, &g.Frames[j], slide)
+		}
+		if g.CreatedBy != nil {
+			symbolizeFrame(table, g.CreatedBy, slide)
+		}
+	}
+	return nil
+}
+
+// symbolizeFrame fills in what f lacks from table, for an executable loaded
+// slide bytes from where it was linked.
+func symbolizeFrame(table *gosym.Table, f *PanicFrame, slide uint64) {
+	if f.PC == 0 && f.Offset != 0 {
+		if fn := table.LookupFunc(f.Func); fn != nil {
+			f.PC = fn.Entry + f.Offset + slide
+		}
+	}
+	if f.PC == 0 || f.Func != "" && f.File != "" && f.Line != 0 {
+		return
+	}
+	// PC is a return address, so the call is the instruction before it.
+	if file, line, fn := table.PCToLine(f.PC - slide - 1); fn != nil {
+		if f.Func == "" || f.Func == "?" {
+			f.Func = fn.Name
+		}
+		if f.File == "" || f.Line == 0 {
+			f.File, f.Line = file, line
+		}
+	}
+}
+
+// loadSymbols reads the Go symbol table of the executable at path.
+func loadSymbols(path string) (*gosym.Table, error) {
+	var pclntab []byte
+	var text uint64
+	if f, err := elf.Open(path); err == nil {
+		defer f.Close()
+		if s := f.Section(".gopclntab"); s != nil {
+			if pclntab, err = s.Data(); err != nil {
+				return nil, err
+			}
+		}
+		if s := f.Section(".text"); s != nil {
+			text = s.Addr
+		}
+	} else if f, merr := macho.Open(path); merr == nil {
+		defer f.Close()
+		if s := f.Section("__gopclntab"); s != nil {
+			if pclntab, err = s.Data(); err != nil {
+				return nil, err
+			}
+		}
+		if s := f.Section("__text"); s != nil {
+			text = s.Addr
+		}
+	} else if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+		return nil, err
+	} else {
+		return nil, errors.New("not an ELF or Mach-O executable")
+	}
+	if pclntab == nil {
+		return nil, errors.New("no Go symbol table in executable")
+	}
+	return gosym.NewTable(nil, gosym.NewLineTable(pclntab, text))
+}
@@ -0,0 +1,165 @@
+package pie
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+const samplePanic = `starting up
+panic: runtime error: invalid memory address or nil pointer dereference
+[signal SIGSEGV: segmentation violation code=0x1 addr=0x0 pc=0x47f7c7]
+
+goroutine 1 gp=0xc000002380 m=0 mp=0x5323c0 [running]:
+main.(*T).f(...)
+	/src/main.go:7
+main.main()
+	/src/main.go:13 +0x27 fp=0xc00006ef68 sp=0xc00006ef50 pc=0x47f7c7
+some log line from another goroutine
+
+goroutine 5 [sleep, 2 minutes]:
+time.Sleep(0x34630b8a000)
+	/usr/local/go/src/runtime/time.go:368 +0x165
+...additional frames elided...
+created by main.main in goroutine 1
+	/src/main.go:10 +0x1a
+exit status 2
+`
+
+func TestParsePanic(t *testing.T) {
+	r, err := ParsePanic([]byte(samplePanic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &PanicReport{
+		Message: "runtime error: invalid memory address or nil pointer dereference",
+		Signal: &PanicSignal{
+			Name:        "SIGSEGV",
+			Description: "segmentation violation",
+			Code:        1,
+			PC:          0x47f7c7,
+		},
+		Goroutines: []Goroutine{{
+			ID:    1,
+			State: "running",
+			Frames: []PanicFrame{
+				{Func: "main.(*T).f", Args: "...", File: "/src/main.go", Line: 7},
+				{Func: "main.main", File: "/src/main.go", Line: 13, Offset: 0x27, PC: 0x47f7c7},
+			},
+		}, {
+			ID:        5,
+			State:     "sleep, 2 minutes",
+			Frames:    []PanicFrame{{Func: "time.Sleep", Args: "0x34630b8a000", File: "/usr/local/go/src/runtime/time.go", Line: 368, Offset: 0x165}},
+			Elided:    true,
+			CreatedBy: &PanicFrame{Func: "main.main", File: "/src/main.go", Line: 10, Offset: 0x1a},
+			ParentID:  1,
+		}},
+	}
+	if !reflect.DeepEqual(r, want) {
+		t.Errorf("Expected\n%#v\ngot\n%#v", want, r)
+	}
+}
+
+func TestParsePanicNested(t *testing.T) {
+	r, err := ParsePanic([]byte("panic: first\nline [recovered]\n\tpanic: second\n\ngoroutine 1 [running]:\nmain.main()\n\t/src/main.go:3 +0x1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Message != "first\nline [recovered]" || !reflect.DeepEqual(r.Nested, []string{"second"}) || r.Fatal {
+		t.Errorf("Expected a nested panic, got %q, %q", r.Message, r.Nested)
+	}
+	if len(r.Goroutines) != 1 || len(r.Goroutines[0].Frames) != 1 {
+		t.Errorf("Expected one goroutine with one frame, got %+v", r.Goroutines)
+	}
+}
+
+func TestParsePanicFatal(t *testing.T) {
+	r, err := ParsePanic([]byte("fatal error: all goroutines are asleep - deadlock!\n\ngoroutine 1 [chan receive]:\nmain.main()\n\t/src/main.go:5 +0x2d\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Fatal || r.Message != "all goroutines are asleep - deadlock!" || r.Signal != nil {
+		t.Errorf("Expected a fatal error, got %+v", r)
+	}
+	if len(r.Goroutines) != 1 || r.Goroutines[0].State != "chan receive" {
+		t.Errorf("Expected one goroutine in chan receive, got %+v", r.Goroutines)
+	}
+}
+
+func TestParsePanicNone(t *testing.T) {
+	if _, err := ParsePanic([]byte("just logs\n")); !errors.Is(err, ErrNoPanic) {
+		t.Errorf("Expected ErrNoPanic, got %v", err)
+	}
+}
+
+func TestCrashReportPanicReport(t *testing.T) {
+	var output lockedBuffer
+	p := startCrashable(t, &output)
+	p.Call("helper.Panic", "parsed", new(int))
+	<-p.Exited()
+	r := p.CrashReport()
+	if r == nil || r.PanicReport == nil {
+		t.Fatalf("Expected a crash report with a parsed panic, got %+v", r)
+	}
+	if r.PanicReport.Message != "parsed" {
+		t.Errorf("Expected the panic's message, got %q", r.PanicReport.Message)
+	}
+	var found *PanicFrame
+	for _, g := range r.PanicReport.Goroutines {
+		for i, f := range g.Frames {
+			if strings.HasSuffix(f.Func, ".helper.Panic") {
+				found = &g.Frames[i]
+			}
+		}
+	}
+	if found == nil {
+		t.Fatalf("Expected a frame for helper.Panic, got %+v", r.PanicReport.Goroutines)
+	}
+	if !strings.HasSuffix(found.File, "helper_test.go") || found.Line == 0 {
+		t.Errorf("Expected helper.Panic's location, got %+v", found)
+	}
+	if runtime.GOOS == "windows" {
+		return
+	}
+	if err := r.PanicReport.Symbolize(os.Args[0]); err != nil {
+		t.Fatal(err)
+	}
+	if found.PC == 0 {
+		t.Errorf("Expected symbolizing to fill in the frame's PC, got %+v", found)
+	}
+}
+
+func TestSymbolize(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolizing PE executables is not supported")
+	}
+	fn := runtime.FuncForPC(reflect.ValueOf(goPanic).Pointer())
+	pc := uint64(fn.Entry()) + 0x10
+	r := &PanicReport{
+		Signal:     &PanicSignal{Name: "SIGSEGV", PC: pc},
+		Goroutines: []Goroutine{{ID: 1, Frames: []PanicFrame{{Func: fn.Name(), Offset: 0x10, PC: pc}, {PC: pc + 1}}}},
+	}
+	if err := r.Symbolize(os.Args[0]); err != nil {
+		t.Fatal(err)
+	}
+	file, line := fn.FileLine(uintptr(pc))
+	if s := r.Signal; s.Func != fn.Name() || s.File != file || s.Line != line {
+		t.Errorf("Expected the signal at %s %s:%d, got %s %s:%d", fn.Name(), file, line, s.Func, s.File, s.Line)
+	}
+	if f := r.Goroutines[0].Frames[1]; f.Func != fn.Name() || !strings.HasSuffix(f.File, "crash.go") {
+		t.Errorf("Expected the frame to be symbolized, got %+v", f)
+	}
+}
+
+func TestSymbolizeNotExecutable(t *testing.T) {
+	r := &PanicReport{}
+	if err := r.Symbolize("panicreport_test.go"); err == nil {
+		t.Error("Expected an error symbolizing a file that is not an executable")
+	}
+	if err := r.Symbolize("does-not-exist"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected a not-exist error, got %v", err)
+	}
+}
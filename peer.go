@@ -0,0 +1,119 @@
+package pie
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// peerEnv tells a plugin the number of the file descriptor on which the host
+// hands it the connections it brokers with BrokerStream.
+const peerEnv = "PIE_PEER_SOCKET"
+
+// ErrNoPeerSocket is returned by BrokerStream for plugins that have no socket
+// for the host to hand them connections on, such as plugins that were not
+// started as processes on this machine, or on platforms without Unix domain
+// sockets.
+var ErrNoPeerSocket = errors.New("pie: plugin has no peer socket")
+
+// HandlePeer sets the function that handles the connections with the given name
+// that the host brokers between this plugin and another one with
+// BrokerStream.  Each connection is handled in its own goroutine, which should
+// close the connection when done.  Only providers can handle peer connections.
+func (s Server) HandlePeer(name string, h func(net.Conn)) error {
+	if s.ctl == nil {
+		return errors.New("only providers can handle peer connections")
+	}
+	s.ctl.peersMu.Lock()
+	defer s.ctl.peersMu.Unlock()
+	if s.ctl.peers == nil {
+		s.ctl.peers = map[string]func(net.Conn){}
+	}
+	s.ctl.peers[name] = h
+	return nil
+}
+
+// BrokerStream connects the plugins from and to with a connection of their own,
+// so that they can move bulk data between them without it being relayed
+// through the host.  The host makes a socket pair and passes one end to each
+// plugin's process, over a socket it gave the plugin when it started it, and
+// the plugins are handed their ends by the handlers they set for name with
+// Server.HandlePeer.  Nothing but the two plugins can reach the connection.
+// It returns ErrNoPeerSocket if either plugin cannot be passed a connection.
+func BrokerStream(from, to *Plugin, name string) error {
+	a, b, err := peerPair()
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	defer b.Close()
+	if err := to.handPeer(name, b); err != nil {
+		return fmt.Errorf("pie: handing plugin its end of peer %q: %w", name, err)
+	}
+	if err := from.handPeer(name, a); err != nil {
+		return fmt.Errorf("pie: handing plugin its end of peer %q: %w", name, err)
+	}
+	return nil
+}
+
+// handPeer passes f to the plugin over its peer socket, and has it hand f to
+// the handler for name.  The plugin reads one file from the socket for each
+// PeerAccept call, so passing a file and making the call are done one plugin
+// at a time.
+func (p *Plugin) handPeer(name string, f *os.File) error {
+	p.peersMu.Lock()
+	defer p.peersMu.Unlock()
+	if p.peers == nil {
+		return ErrNoPeerSocket
+	}
+	if err := sendPeerFile(p.peers, f); err != nil {
+		return err
+	}
+	return p.controlClient().Call(controlService+".PeerAccept", name, new(int))
+}
+
+// unixConn returns a *net.UnixConn for f, which it closes.
+func unixConn(f *os.File) (*net.UnixConn, error) {
+	defer f.Close()
+	c, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.UnixConn), nil
+}
+
+// peer returns the handler for peer connections with the given name.
+func (c *control) peer(name string) (func(net.Conn), error) {
+	c.peersMu.Lock()
+	defer c.peersMu.Unlock()
+	h := c.peers[name]
+	if h == nil {
+		return nil, fmt.Errorf("pie: no handler for peer %q", name)
+	}
+	return h, nil
+}
+
+// PeerAccept takes the connection the host passed over the peer socket, and
+// hands it to the handler for name.
+func (c *control) PeerAccept(name string, _ *int) error {
+	c.peerSocket.once.Do(func() {
+		c.peerSocket.conn, c.peerSocket.err = openPeerSocket()
+	})
+	if c.peerSocket.err != nil {
+		return c.peerSocket.err
+	}
+	c.peerSocket.mu.Lock()
+	conn, err := receivePeer(c.peerSocket.conn)
+	c.peerSocket.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	h, err := c.peer(name)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	go h(conn)
+	return nil
+}
@@ -0,0 +1,35 @@
+//go:build !unix
+
+package pie
+
+import (
+	"net"
+	"os"
+	"os/exec"
+)
+
+// peerPair is not supported on this platform, where plugins have no peer
+// socket.
+func peerPair() (*os.File, *os.File, error) {
+	return nil, nil, ErrNoPeerSocket
+}
+
+// givePeerSocket is not supported on this platform.
+func givePeerSocket(cmd *exec.Cmd) (*net.UnixConn, func(exited <-chan struct{}), error) {
+	return nil, nil, ErrNoPeerSocket
+}
+
+// sendPeerFile is not supported on this platform.
+func sendPeerFile(c *net.UnixConn, f *os.File) error {
+	return ErrNoPeerSocket
+}
+
+// openPeerSocket is not supported on this platform.
+func openPeerSocket() (*net.UnixConn, error) {
+	return nil, ErrNoPeerSocket
+}
+
+// receivePeer is not supported on this platform.
+func receivePeer(c *net.UnixConn) (net.Conn, error) {
+	return nil, ErrNoPeerSocket
+}
@@ -0,0 +1,121 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// peerPlugin returns a handle for a provider that hands the peer connections
+// named "data" to conns, with a peer socket between the two.
+func peerPlugin(t *testing.T, conns chan<- net.Conn) *Plugin {
+	s := NewProvider()
+	if err := s.HandlePeer("data", func(c net.Conn) { conns <- c }); err != nil {
+		t.Fatal(err)
+	}
+	host, plugin, err := peerPair()
+	if errors.Is(err, ErrNoPeerSocket) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostConn, err := unixConn(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ctl.peerSocket.once.Do(func() {
+		s.ctl.peerSocket.conn, s.ctl.peerSocket.err = unixConn(plugin)
+	})
+	t.Cleanup(func() {
+		hostConn.Close()
+		if s.ctl.peerSocket.conn != nil {
+			s.ctl.peerSocket.conn.Close()
+		}
+	})
+	p := pipePlugin(t, s)
+	p.peers = hostConn
+	return p
+}
+
+func waitPeer(t *testing.T, conns <-chan net.Conn) net.Conn {
+	t.Helper()
+	select {
+	case c := <-conns:
+		t.Cleanup(func() { c.Close() })
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a peer connection")
+	}
+	return nil
+}
+
+func TestBrokerStream(t *testing.T) {
+	fromConns, toConns := make(chan net.Conn, 1), make(chan net.Conn, 1)
+	from, to := peerPlugin(t, fromConns), peerPlugin(t, toConns)
+	if err := BrokerStream(from, to, "data"); err != nil {
+		t.Fatal(err)
+	}
+	fc, tc := waitPeer(t, fromConns), waitPeer(t, toConns)
+	go func() {
+		io.WriteString(fc, "bulk data")
+		fc.Close()
+	}()
+	b, err := io.ReadAll(tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "bulk data" {
+		t.Errorf("Expected %q, got %q", "bulk data", b)
+	}
+}
+
+func TestBrokerStreamNoHandler(t *testing.T) {
+	conns := make(chan net.Conn, 1)
+	from, to := peerPlugin(t, conns), peerPlugin(t, conns)
+	err := BrokerStream(from, to, "other")
+	if err == nil || !strings.Contains(err.Error(), `no handler for peer "other"`) {
+		t.Errorf("Expected an error for a peer without a handler, got %v", err)
+	}
+}
+
+func TestBrokerStreamNoPeerSocket(t *testing.T) {
+	conns := make(chan net.Conn, 1)
+	s := NewProvider()
+	s.HandlePeer("data", func(c net.Conn) { conns <- c })
+	from, to := peerPlugin(t, conns), pipePlugin(t, s)
+	if err := BrokerStream(from, to, "data"); !errors.Is(err, ErrNoPeerSocket) {
+		t.Errorf("Expected ErrNoPeerSocket, got %v", err)
+	}
+}
+
+func TestHandlePeerNotProvider(t *testing.T) {
+	if err := (Server{}).HandlePeer("data", func(net.Conn) {}); err == nil {
+		t.Error("Expected an error handling peers in a consumer")
+	}
+}
+
+func TestManagerBrokerStream(t *testing.T) {
+	m := &Manager{Plugins: []PluginSpec{
+		helperSpec("a", "provider"),
+		helperSpec("b", "provider"),
+	}}
+	if err := m.StartAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	err := m.BrokerStream("a", "b", "echo")
+	if errors.Is(err, ErrNoPeerSocket) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.BrokerStream("a", "c", "echo"); !errors.Is(err, ErrUnknownPlugin) {
+		t.Errorf("Expected ErrUnknownPlugin, got %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+//go:build unix
+
+package pie
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// The peer socket of a plugin is a stream socket pair, whose plugin end the
+// plugin inherits.  To broker a connection, the host sends a single byte with
+// one end of a new socket pair attached, and then calls PeerAccept, which
+// reads it.
+
+// peerPair returns the two ends of a new stream socket pair.
+func peerPair() (*os.File, *os.File, error) {
+	// Not every platform can make sockets close-on-exec as it makes them, so
+	// fork is held off until they are.
+	syscall.ForkLock.RLock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, nil, os.NewSyscallError("socketpair", err)
+	}
+	return os.NewFile(uintptr(fds[0]), "pie-peer"), os.NewFile(uintptr(fds[1]), "pie-peer"), nil
+}
+
+// givePeerSocket sets cmd up to inherit the plugin's end of a peer socket, and
+// returns the host's end.  The function returned must be called once cmd has
+// been started, with a channel that is closed when it exits, or nil if it did
+// not start; it closes the host's copy of the plugin's end, and the host's end
+// once the plugin exits.
+func givePeerSocket(cmd *exec.Cmd) (*net.UnixConn, func(exited <-chan struct{}), error) {
+	host, plugin, err := peerPair()
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := unixConn(host)
+	if err != nil {
+		plugin.Close()
+		return nil, nil, err
+	}
+	fd := 3 + len(cmd.ExtraFiles)
+	cmd.ExtraFiles = append(cmd.ExtraFiles, plugin)
+	if cmd.Env == nil {
+		cmd.Env = hostEnviron()
+	}
+	cmd.Env = append(cmd.Env, peerEnv+"="+strconv.Itoa(fd))
+	return conn, func(exited <-chan struct{}) {
+		plugin.Close()
+		if exited == nil {
+			conn.Close()
+			return
+		}
+		go func() {
+			<-exited
+			conn.Close()
+		}()
+	}, nil
+}
+
+// sendPeerFile passes f over the peer socket c.
+func sendPeerFile(c *net.UnixConn, f *os.File) error {
+	_, _, err := c.WriteMsgUnix([]byte{0}, syscall.UnixRights(int(f.Fd())), nil)
+	return err
+}
+
+// openPeerSocket returns the plugin's end of the peer socket the host started
+// it with.
+func openPeerSocket() (*net.UnixConn, error) {
+	fd, err := strconv.Atoi(providerGetenv(peerEnv))
+	if err != nil {
+		return nil, ErrNoPeerSocket
+	}
+	return unixConn(os.NewFile(uintptr(fd), "pie-peer"))
+}
+
+// receivePeer reads the connection passed over the peer socket c.
+func receivePeer(c *net.UnixConn) (net.Conn, error) {
+	_, fd, err := readFDMsg(c)
+	if err != nil {
+		return nil, err
+	}
+	if fd < 0 {
+		return nil, errors.New("pie: the host passed no connection")
+	}
+	return unixConn(os.NewFile(uintptr(fd), "pie-peer"))
+}
+
+// readFDMsg reads a message and the file descriptor attached to it, if any,
+// which is -1 otherwise.  It returns io.EOF once the other end is
+// closed.
+func readFDMsg(c *net.UnixConn) ([]byte, int, error) {
+	buf := make([]byte, 1024)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := c.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, -1, err
+	}
+	if n == 0 && oobn == 0 {
+		return nil, -1, io.EOF
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, -1, err
+	}
+	fd := -1
+	for _, msg := range msgs {
+		fds, err := syscall.ParseUnixRights(&msg)
+		if err != nil {
+			continue
+		}
+		for _, f := range fds {
+			if fd < 0 {
+				fd = f
+			} else {
+				syscall.Close(f)
+			}
+		}
+	}
+	return buf[:n], fd, nil
+}
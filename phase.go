@@ -0,0 +1,189 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/rpc"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrNotServing is returned by calls to a plugin started with WithPhases that
+// has not yet passed its startup barrier.
+var ErrNotServing = errors.New("plugin is not serving yet")
+
+// Phase is a stage in the startup of a plugin started with WithPhases.
+type Phase int32
+
+const (
+	// PhaseInit is the phase of a plugin that has started but not finished
+	// initializing.
+	PhaseInit Phase = iota
+	// PhaseReady is the phase of a plugin that has finished initializing,
+	// and is waiting for the host to let application calls through.
+	PhaseReady
+	// PhaseServing is the phase of a plugin that takes application calls.
+	PhaseServing
+)
+
+var phaseNames = [...]string{
+	PhaseInit:    "init",
+	PhaseReady:   "ready",
+	PhaseServing: "serving",
+}
+
+// String returns the name of the phase.
+func (p Phase) String() string {
+	if p >= 0 && int(p) < len(phaseNames) {
+		return phaseNames[p]
+	}
+	return "Phase(" + strconv.Itoa(int(p)) + ")"
+}
+
+// WithPhases makes the plugin start in PhaseInit, and refuse application
+// calls with ErrNotServing until the host has initialized it with Plugin.Init
+// and let calls through with Plugin.StartServing, usually by passing it to
+// Barrier along with the other plugins it starts.  Providers do their
+// initialization in the function they set with Server.SetInit.
+func WithPhases() StartOption {
+	return func(o *startOptions) {
+		o.phases = true
+	}
+}
+
+// Phase returns the startup phase of the plugin.  Plugins not started with
+// WithPhases are always in PhaseServing.
+func (p *Plugin) Phase() Phase {
+	if !p.phases {
+		return PhaseServing
+	}
+	return Phase(atomic.LoadInt32(&p.phase))
+}
+
+// checkServing returns ErrNotServing if the plugin may not take application
+// calls yet.  Handles that may take no more calls are refused by
+// checkRunning.
+func (p *Plugin) checkServing() error {
+	switch p.State() {
+	case StateStarting, StateReady:
+		return ErrNotServing
+	}
+	return nil
+}
+
+// Init asks the plugin to initialize, waiting until it has or ctx is done,
+// makes the plugin's warm-up calls, and moves it to PhaseReady.  Providers that
+// have not set an init function, and plugins that do not serve pie's control
+// API, count as initialized.  Calling
+// Init on a plugin that has already initialized returns the result of its
+// initialization again.
+func (p *Plugin) Init(ctx context.Context) error {
+	if err := p.checkRunning(); err != nil {
+		return err
+	}
+	call := p.controlClient().Go(controlService+".Init", 0, new(int), make(chan *rpc.Call, 1))
+	var err error
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if err != nil && !isMissingMethod(err) {
+		return fmt.Errorf("plugin failed to initialize: %w", err)
+	}
+	p.warm()
+	atomic.CompareAndSwapInt32(&p.phase, int32(PhaseInit), int32(PhaseReady))
+	return nil
+}
+
+// StartServing moves the plugin to PhaseServing, letting application calls
+// through, and tells the provider, whose Server.Phase then reports it.  It
+// returns an error if the plugin has not been initialized.
+func (p *Plugin) StartServing() error {
+	if err := p.checkRunning(); err != nil {
+		return err
+	}
+	if p.Phase() == PhaseInit {
+		return errors.New("pie: plugin has not been initialized")
+	}
+	err := p.controlClient().Call(controlService+".StartServing", 0, new(int))
+	if err != nil && !isMissingMethod(err) {
+		return err
+	}
+	atomic.StoreInt32(&p.phase, int32(PhaseServing))
+	return nil
+}
+
+// Barrier initializes all of the plugins concurrently, and only once every one
+// of them has initialized does it let application calls through to any of
+// them, so that no plugin takes traffic while the others are still loading
+// models or warming caches.  If any plugin fails to initialize before ctx is
+// done, none of them start serving, and the errors are returned together.
+func Barrier(ctx context.Context, plugins ...*Plugin) error {
+	errs := make([]error, len(plugins))
+	var wg sync.WaitGroup
+	for i, p := range plugins {
+		wg.Add(1)
+		go func(i int, p *Plugin) {
+			defer wg.Done()
+			errs[i] = p.Init(ctx)
+		}(i, p)
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	for i, p := range plugins {
+		errs[i] = p.StartServing()
+	}
+	return errors.Join(errs...)
+}
+
+// SetInit sets the function the provider runs to initialize when the host asks
+// it to, for hosts that start it with WithPhases.  The host sends no
+// application calls until init has returned successfully.  Only providers can
+// set an init function.
+func (s Server) SetInit(init func() error) error {
+	if s.ctl == nil {
+		return errors.New("only providers can set an init function")
+	}
+	s.ctl.phaseMu.Lock()
+	defer s.ctl.phaseMu.Unlock()
+	s.ctl.init = init
+	return nil
+}
+
+// Phase returns the provider's startup phase, as told by the host.  Providers
+// whose host does not use phases report PhaseInit until they are initialized,
+// and PhaseReady after.
+func (s Server) Phase() Phase {
+	if s.ctl == nil {
+		return PhaseServing
+	}
+	return Phase(atomic.LoadInt32(&s.ctl.phase))
+}
+
+// Init runs the provider's init function, once.
+func (c *control) Init(_ int, _ *int) error {
+	c.phaseMu.Lock()
+	init := c.init
+	c.phaseMu.Unlock()
+	c.initOnce.Do(func() {
+		if init != nil {
+			c.initErr = init()
+		}
+		if c.initErr == nil {
+			atomic.CompareAndSwapInt32(&c.phase, int32(PhaseInit), int32(PhaseReady))
+		}
+	})
+	return c.initErr
+}
+
+// StartServing records that the host has started sending application calls.
+func (c *control) StartServing(_ int, _ *int) error {
+	atomic.StoreInt32(&c.phase, int32(PhaseServing))
+	return nil
+}
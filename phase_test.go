@@ -0,0 +1,144 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// phasedServer returns a provider that runs init, if not nil, to initialize.
+func phasedServer(t *testing.T, init func() error) Server {
+	s := NewProvider()
+	s.RegisterName("api", api{})
+	s.RegisterName("helper", helper{s})
+	if init != nil {
+		if err := s.SetInit(init); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func TestPhases(t *testing.T) {
+	var inits int32
+	p := pipePlugin(t, phasedServer(t, func() error {
+		atomic.AddInt32(&inits, 1)
+		return nil
+	}), WithPhases())
+	if p.Phase() != PhaseInit {
+		t.Errorf("Expected phase %v, got %v", PhaseInit, p.Phase())
+	}
+	if err := p.Call("api.SayHi", "bob", new(string)); err != ErrNotServing {
+		t.Errorf("Expected ErrNotServing before init, got %v", err)
+	}
+	if err := p.StartServing(); err == nil {
+		t.Error("Expected an error serving before init")
+	}
+	for i := 0; i < 2; i++ {
+		if err := p.Init(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&inits); n != 1 {
+		t.Errorf("Expected init to run once, ran %d times", n)
+	}
+	if p.Phase() != PhaseReady {
+		t.Errorf("Expected phase %v, got %v", PhaseReady, p.Phase())
+	}
+	if err := p.Notify("api.SayHi", "bob"); err != ErrNotServing {
+		t.Errorf("Expected ErrNotServing before serving, got %v", err)
+	}
+	if err := p.StartServing(); err != nil {
+		t.Fatal(err)
+	}
+	var phase string
+	if err := p.Call("helper.Phase", 0, &phase); err != nil {
+		t.Fatal(err)
+	}
+	if phase != "serving" {
+		t.Errorf("Expected the provider to be serving, got %q", phase)
+	}
+}
+
+func TestBarrier(t *testing.T) {
+	release := make(chan struct{})
+	slow := pipePlugin(t, phasedServer(t, func() error {
+		<-release
+		return nil
+	}), WithPhases())
+	fast := pipePlugin(t, phasedServer(t, nil), WithPhases())
+	done := make(chan error, 1)
+	go func() { done <- Barrier(context.Background(), slow, fast) }()
+	// The fast plugin must not serve while the slow one is initializing.
+	time.Sleep(50 * time.Millisecond)
+	if fast.Phase() == PhaseServing {
+		t.Fatal("Plugin started serving before the others had initialized")
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []*Plugin{slow, fast} {
+		if err := p.Call("api.SayHi", "bob", new(string)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestBarrierInitFails(t *testing.T) {
+	bad := pipePlugin(t, phasedServer(t, func() error { return errors.New("no model") }), WithPhases())
+	good := pipePlugin(t, phasedServer(t, nil), WithPhases())
+	err := Barrier(context.Background(), bad, good)
+	if err == nil || !strings.Contains(err.Error(), "no model") {
+		t.Fatalf("Expected the init error, got %v", err)
+	}
+	if good.Phase() == PhaseServing {
+		t.Error("Expected no plugin to serve after a failed barrier")
+	}
+}
+
+func TestBarrierContext(t *testing.T) {
+	release := make(chan struct{})
+	p := pipePlugin(t, phasedServer(t, func() error {
+		<-release
+		return nil
+	}), WithPhases())
+	// The provider's Serve waits for init, so let it return when the test
+	// ends.
+	t.Cleanup(func() { close(release) })
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := Barrier(ctx, p); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestManagerPhases(t *testing.T) {
+	m := &Manager{Phases: true, Plugins: []PluginSpec{
+		helperSpec("a", "provider"),
+		helperSpec("b", "provider"),
+	}}
+	if err := m.StartAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	for _, name := range []string{"a", "b"} {
+		var phase string
+		if err := m.Call(name, "helper.Phase", 0, &phase); err != nil {
+			t.Fatal(err)
+		}
+		if phase != "serving" {
+			t.Errorf("Expected plugin %s to be serving, got %q", name, phase)
+		}
+	}
+	// Plugins started after the barrier serve on their own.
+	if err := m.Start(context.Background(), helperSpec("c", "provider")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Call("c", "api.SayHi", "bob", new(string)); err != nil {
+		t.Error(err)
+	}
+}
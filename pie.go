@@ -1,24 +1,92 @@
 package pie
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net/rpc"
 	"os"
 	"os/exec"
+	"sync"
 	"time"
 )
 
-var errProcStopTimeout = errors.New("process killed after timeout waiting for process to stop")
+// ErrStopTimeout is included in the error returned when closing a plugin if the
+// plugin did not stop in time after being interrupted and had to be killed.
+// Check for it with errors.Is.
+var ErrStopTimeout = errors.New("process killed after timeout waiting for process to stop")
+
+// ErrAlreadyClosed is returned when closing a plugin's or provider's
+// connection that has already been closed.  Check for it with errors.Is.
+var ErrAlreadyClosed = errors.New("already closed")
 
 // NewProvider returns a Server that will serve RPC over this
 // application's Stdin and Stdout.  This method is intended to be run by the
-// plugin application.
+// plugin application.  The Server also serves pie's built-in control API,
+// which hosts using StartPlugin rely on for health checks.  If the host started
+// the plugin with WithFraming, the Server frames what it writes to stdout, and
+// if the host used WithChecksums, the Server checksums its frames.  Likewise,
+// it sends and watches for the keepalives asked for by WithTransportKeepalive,
+// multiplexes its connection if the host used WithMux, and batches its writes
+// if the host used WithBatching.
+//
+// When the plugin was started by StartPlugin, NewProvider takes the real stdout
+// for the RPC stream and replaces stdout with a pipe to stderr, so that stray
+// prints in plugin code cannot corrupt the stream.  Use SetStrayOutput to send
+// them elsewhere.
+//
+// NewProvider takes the environment variables through which the host
+// configured it, such as PIE_FRAMING and PIE_MUX, out of the process's
+// environment, so that plugins and other children the plugin starts do not
+// inherit them.
+//
+// If the plugin is run with the argument --pie-selftest, NewProvider removes it
+// from os.Args, and the Server tests the plugin instead of serving it: when
+// Serve or one of its variants is called, it prints a SelfTestReport of the
+// services registered so far to stdout as JSON, and exits with status 0 if
+// there were any and none failed to register, or 1 otherwise.  This lets
+// packaging pipelines check plugin binaries without a host.
+//
+// If the host handed the plugin a bootstrap address, as it does when started
+// with WithSocketBootstrap, or as a BootstrapListener's Arg, the Server serves
+// over a connection to the host at that address instead of stdin and stdout.
+// If the plugin was started by a supervisor such as inetd, or systemd with
+// Accept=yes, with an accepted socket as its stdin and stdout or as its
+// systemd file descriptor, the Server serves that socket, and stdout is sent
+// to stderr.
 func NewProvider() Server {
+	return newProvider(providerConn())
+}
+
+// newProvider returns a provider Server that serves over rwc, configured by
+// the environment and arguments the host started the process with.
+func newProvider(rwc io.ReadWriteCloser) Server {
+	s := newServer(rwc)
+	s.ctl.features = parseFeaturesEnv(providerGetenv(featuresEnv))
+	s.ctl.selfTest = selfTestArg()
+	s.d.checksums = providerGetenv(framingEnv) == "crc32"
+	s.d.keepalive, s.d.deadPeer = parseKeepaliveEnv(providerGetenv(keepaliveEnv))
+	s.d.mux = providerGetenv(muxEnv) != ""
+	s.d.batching = parseBatchingEnv(providerGetenv(batchingEnv))
+	s.d.hostBuild = parseBuildInfoEnv(providerGetenv(hostBuildEnv))
+	takeProviderEnv()
+	return s
+}
+
+// newServer returns a provider Server that serves over rwc, with nothing
+// configured.
+func newServer(rwc io.ReadWriteCloser) Server {
+	server := rpc.NewServer()
+	d := &dispatcher{}
+	ctl := &control{d: d}
+	server.RegisterName(controlService, ctl)
+	d.add(controlService, stdMethods(ctl))
 	return Server{
-		server: rpc.NewServer(),
-		rwc:    rwCloser{os.Stdin, os.Stdout},
+		server: server,
+		rwc:    rwc,
+		d:      d,
+		ctl:    ctl,
 	}
 }
 
@@ -28,50 +96,81 @@ type Server struct {
 	server *rpc.Server
 	rwc    io.ReadWriteCloser
 	codec  rpc.ServerCodec
+	// d serves the methods net/rpc cannot.
+	d *dispatcher
+	// ctl is the built-in control API, which only providers serve.
+	ctl *control
 }
 
 // Close closes the connection with the client.  If the client is a plugin
 // process, the process will be stopped.  Further communication using this
 // Server will fail.
 func (s Server) Close() error {
+	if s.d != nil {
+		s.d.regMu.Lock()
+		s.d.closed = true
+		s.d.regMu.Unlock()
+	}
 	if s.codec != nil {
 		return s.codec.Close()
 	}
+	if iop, ok := s.rwc.(ioPipe); ok && s.d != nil {
+		s.d.regMu.Lock()
+		iop.stopTimeout = s.d.timeouts.Stop
+		s.d.regMu.Unlock()
+		return iop.Close()
+	}
 	return s.rwc.Close()
 }
 
 // Serve starts the Server's RPC server, serving via gob encoding.  This call
-// will block until the client hangs up.
+// will block until the client hangs up.  Use ServeErr to find out why the
+// connection ended.
 func (s Server) Serve() {
-	s.server.ServeConn(s.rwc)
+	s.ServeErr()
 }
 
 // ServeCodec starts the Server's RPC server, serving via the encoding returned
-// by f. This call will block until the client hangs up.
+// by f. This call will block until the client hangs up.  Use ServeCodecErr to
+// find out why the connection ended.
 func (s Server) ServeCodec(f func(io.ReadWriteCloser) rpc.ServerCodec) {
-	s.server.ServeCodec(f(s.rwc))
+	s.ServeCodecErr(f)
 }
 
 // Register publishes in the provider the set of methods of the receiver value
 // that satisfy the following conditions:
 //
-//	- exported method
-//	- two arguments, both of exported type
-//	- the second argument is a pointer
-//	- one return value, of type error
+//   - exported method
+//   - two arguments, both of exported type
+//   - the second argument is a pointer
+//   - one return value, of type error
+//
+// Methods in the following forms are published too, so that implementations
+// written for other callers can be served without wrappers:
+//
+//	func(ctx context.Context, args A, reply *R) error
+//	func(ctx context.Context, args A) (R, error)
+//	func(args A) (R, error)
+//
+// Clients call them like any other method, with a pointer to an R as the
+// reply.  The context is cancelled when the connection to the client is
+// closed.
 //
-// It returns an error if the receiver is not an exported type or has no
-// suitable methods. It also logs the error using package log. The client
-// accesses each method using a string of the form "Type.Method", where Type is
-// the receiver's concrete type.
+// Register must be called before Serve; afterwards it returns
+// ErrRegisterAfterServe, unless the Server's DuplicatePolicy allows services
+// to be swapped.  It returns an error if the receiver is not an exported type
+// or has no suitable methods, or if a service of the same name is registered
+// and the DuplicatePolicy does not allow it.  It also logs the error using
+// package log.  The client accesses each method using a string of the form
+// "Type.Method", where Type is the receiver's concrete type.
 func (s Server) Register(rcvr interface{}) error {
-	return s.server.Register(rcvr)
+	return s.noteRegister(s.register(serviceName(rcvr), rcvr, false))
 }
 
 // RegisterName is like Register but uses the provided name for the type
 // instead of the receiver's concrete type.
 func (s Server) RegisterName(name string, rcvr interface{}) error {
-	return s.server.RegisterName(name, rcvr)
+	return s.noteRegister(s.register(name, rcvr, true))
 }
 
 // StartProvider start a provider-style plugin application at the given path and
@@ -87,6 +186,18 @@ func StartProvider(output io.Writer, path string, args ...string) (*rpc.Client,
 	return rpc.NewClient(pipe), nil
 }
 
+// StartProviderContext is like StartProvider, but ties the plugin to ctx the
+// way StartPluginContext does: cancelling ctx abandons starting the plugin, or
+// shuts it down once it is running.  It does not return until the plugin has
+// answered a ping.
+func StartProviderContext(ctx context.Context, output io.Writer, path string, args ...string) (*rpc.Client, error) {
+	p, err := StartPluginContext(ctx, output, path, args)
+	if err != nil {
+		return nil, err
+	}
+	return p.Client(), nil
+}
+
 // StartProviderCodec starts a provider-style plugin application at the given
 // path and args, and returns an RPC client that communicates with the plugin
 // using the ClientCodec returned by f over the plugin's Stdin and Stdout. The
@@ -110,28 +221,40 @@ func StartProviderCodec(
 // and args, writing its stderr to output.  The plugin consumes an API this
 // application provides.  The function returns the Server for this host
 // application, which should be used to register APIs for the plugin to consume.
+// Use Server.Expose to limit which of them the plugin may call.
 func StartConsumer(output io.Writer, path string, args ...string) (Server, error) {
 	pipe, err := start(makeCommand(output, path, args))
 	if err != nil {
 		return Server{}, err
 	}
+	return newConsumerServer(pipe), nil
+}
+
+// newConsumerServer returns a Server that serves a consumer over rwc.
+func newConsumerServer(rwc io.ReadWriteCloser) Server {
+	server := rpc.NewServer()
+	d := &dispatcher{}
+	hc := &hostControl{d: d}
+	server.RegisterName(controlService, hc)
+	d.add(controlService, stdMethods(hc))
 	return Server{
-		server: rpc.NewServer(),
-		rwc:    pipe,
-	}, nil
+		server: server,
+		rwc:    rwc,
+		d:      d,
+	}
 }
 
 // NewConsumer returns an rpc.Client that will consume an API from the host
 // process over this application's Stdin and Stdout using gob encoding.
 func NewConsumer() *rpc.Client {
-	return rpc.NewClient(rwCloser{os.Stdin, os.Stdout})
+	return rpc.NewClient(newRWCloser(os.Stdin, os.Stdout))
 }
 
 // NewConsumerCodec returns an rpc.Client that will consume an API from the host
 // process over this application's Stdin and Stdout using the ClientCodec
 // returned by f.
 func NewConsumerCodec(f func(io.ReadWriteCloser) rpc.ClientCodec) *rpc.Client {
-	return rpc.NewClientWithCodec(f(rwCloser{os.Stdin, os.Stdout}))
+	return rpc.NewClientWithCodec(f(newRWCloser(os.Stdin, os.Stdout)))
 }
 
 // start runs the plugin and returns an ioPipe that can be used to control the
@@ -160,7 +283,7 @@ func start(cmd commander) (_ ioPipe, err error) {
 	if err != nil {
 		return ioPipe{}, err
 	}
-	return ioPipe{out, in, proc}, nil
+	return ioPipe{ReadCloser: out, WriteCloser: in, proc: proc, once: new(closeOnce)}, nil
 }
 
 // makeCommand is a function that just creates an exec.Cmd and the process in
@@ -206,55 +329,87 @@ type ioPipe struct {
 	io.ReadCloser
 	io.WriteCloser
 	proc osProcess
+	// stopTimeout is how long to wait for the process to stop after it is
+	// interrupted.  If zero, the default is used.
+	stopTimeout time.Duration
+	// once is shared by the copies of the pipe, so that only the first Close
+	// of any of them closes it.
+	once *closeOnce
 }
 
-// Close closes the pipe's WriteCloser, ReadClosers, and process.
+// Close closes the pipe's WriteCloser, ReadClosers, and process, returning all
+// the errors that occurred, joined with errors.Join.  Closing the pipe again
+// returns ErrAlreadyClosed, once the first Close has returned.
 func (iop ioPipe) Close() error {
-	err := iop.ReadCloser.Close()
-	if writeErr := iop.WriteCloser.Close(); writeErr != nil {
-		err = writeErr
-	}
-	if procErr := iop.closeProc(); procErr != nil {
-		err = procErr
-	}
-	return err
+	return iop.once.close(func() error {
+		return errors.Join(iop.ReadCloser.Close(), iop.WriteCloser.Close(), iop.closeProc())
+	})
 }
 
-// procTimeout is the timeout to wait for a process to stop after being
-// signalled.  It is adjustable to keep tests fast.
-var procTimeout = time.Second
-
 // closeProc sends an interrupt signal to the pipe's process, and if it doesn't
-// respond in one second, kills the process.
+// respond within the pipe's stop timeout, or cannot be signalled, kills the
+// process.  The error returned joins the errors from signalling, killing, and
+// waiting for the process, and includes ErrStopTimeout if the process had to be
+// killed after the timeout.
 func (iop ioPipe) closeProc() error {
+	if r, ok := iop.proc.(*reaper); ok {
+		r.stopping.Store(true)
+	}
 	result := make(chan error, 1)
 	go func() { _, err := iop.proc.Wait(); result <- err }()
-	if err := iop.proc.Signal(os.Interrupt); err != nil {
-		return err
-	}
-	select {
-	case err := <-result:
-		return err
-	case <-time.After(procTimeout):
-		if err := iop.proc.Kill(); err != nil {
-			return fmt.Errorf("error killing process after timeout: %s", err)
+	var stopErr error
+	if err := iop.proc.Signal(os.Interrupt); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		stopErr = err
+	} else {
+		select {
+		case err := <-result:
+			return err
+		case <-time.After(Timeouts{Stop: iop.stopTimeout}.stop()):
+			stopErr = ErrStopTimeout
 		}
-		return errProcStopTimeout
 	}
+	if err := iop.proc.Kill(); err != nil {
+		return errors.Join(stopErr, fmt.Errorf("error killing process: %w", err))
+	}
+	return errors.Join(stopErr, <-result)
 }
 
 // rwCloser just merges a ReadCloser and a WriteCloser into a ReadWriteCloser.
 type rwCloser struct {
 	io.ReadCloser
 	io.WriteCloser
+	// once is shared by the copies of the rwCloser, as ioPipe's is.
+	once *closeOnce
+}
+
+// newRWCloser returns an rwCloser of r and w.
+func newRWCloser(r io.ReadCloser, w io.WriteCloser) rwCloser {
+	return rwCloser{r, w, new(closeOnce)}
 }
 
-// Close closes both the ReadCloser and the WriteCloser, returning the last
-// error from either.
+// Close closes both the ReadCloser and the WriteCloser, returning the errors
+// from both, joined with errors.Join.  Closing it again returns
+// ErrAlreadyClosed, once the first Close has returned.
 func (rw rwCloser) Close() error {
-	err := rw.ReadCloser.Close()
-	if err := rw.WriteCloser.Close(); err != nil {
-		return err
+	return rw.once.close(func() error {
+		return errors.Join(rw.ReadCloser.Close(), rw.WriteCloser.Close())
+	})
+}
+
+// closeOnce makes closing something happen once, however many goroutines
+// close it.
+type closeOnce struct {
+	once sync.Once
+}
+
+// close calls f the first time it is called, and returns its error, or
+// ErrAlreadyClosed after f has returned, to later callers.  A nil closeOnce
+// calls f every time.
+func (c *closeOnce) close(f func() error) error {
+	if c == nil {
+		return f()
 	}
+	err := ErrAlreadyClosed
+	c.once.Do(func() { err = f() })
 	return err
 }
@@ -21,7 +21,7 @@ var _ io.ReadWriteCloser = ioPipe{}
 func TestRWCloser(t *testing.T) {
 	rc := &closeRW{}
 	wc := &closeRW{}
-	rwc := rwCloser{rc, wc}
+	rwc := newRWCloser(rc, wc)
 	if err := rwc.Close(); err != nil {
 		t.Errorf("unexpected error from rwCloser.Close: %#v", err)
 	}
@@ -37,7 +37,7 @@ func TestRWCloserReadCloserError(t *testing.T) {
 	readCloserErr := errors.New("read")
 	rc := &closeRW{err: readCloserErr}
 	wc := &closeRW{}
-	rwc := rwCloser{rc, wc}
+	rwc := newRWCloser(rc, wc)
 	err := rwc.Close()
 	if !rc.closed {
 		t.Error("Close not called on ReadCloser.")
@@ -48,7 +48,7 @@ func TestRWCloserReadCloserError(t *testing.T) {
 	if err == nil {
 		t.Error("ReadCloser error not passed through from rwCloser.Close")
 	}
-	if err != readCloserErr {
+	if !errors.Is(err, readCloserErr) {
 		t.Errorf("Different error returned from rwCloser than expected: %#v", err)
 	}
 }
@@ -57,7 +57,7 @@ func TestRWCloserWriteCloserError(t *testing.T) {
 	writeCloserErr := errors.New("write")
 	rc := &closeRW{}
 	wc := &closeRW{err: writeCloserErr}
-	rwc := rwCloser{rc, wc}
+	rwc := newRWCloser(rc, wc)
 	err := rwc.Close()
 	if !rc.closed {
 		t.Error("Close not called on ReadCloser.")
@@ -68,7 +68,7 @@ func TestRWCloserWriteCloserError(t *testing.T) {
 	if err == nil {
 		t.Error("ReadCloser error not passed through from rwCloser.Close")
 	}
-	if err != writeCloserErr {
+	if !errors.Is(err, writeCloserErr) {
 		t.Errorf("Different error returned from rwCloser than expected: %#v", err)
 	}
 }
@@ -78,7 +78,7 @@ func TestRWCloserBothCloserError(t *testing.T) {
 	readCloserErr := errors.New("read")
 	rc := &closeRW{err: readCloserErr}
 	wc := &closeRW{err: writeCloserErr}
-	rwc := rwCloser{rc, wc}
+	rwc := newRWCloser(rc, wc)
 	err := rwc.Close()
 	if !rc.closed {
 		t.Error("Close not called on ReadCloser.")
@@ -89,11 +89,8 @@ func TestRWCloserBothCloserError(t *testing.T) {
 	if err == nil {
 		t.Error("Error not passed through from rwCloser.Close")
 	}
-
-	// I don't think we actually care which of these errors gets returned, as
-	// long as one of them does.
-	if err != writeCloserErr && err != readCloserErr {
-		t.Errorf("Different error returned from rwCloser than expected: %#v", err)
+	if !errors.Is(err, writeCloserErr) || !errors.Is(err, readCloserErr) {
+		t.Errorf("Expected both errors from rwCloser.Close, got %#v", err)
 	}
 }
 
@@ -101,7 +98,7 @@ func TestIOPipeClose(t *testing.T) {
 	rc := &closeRW{}
 	wc := &closeRW{}
 	p := &proc{}
-	iop := ioPipe{rc, wc, p}
+	iop := ioPipe{rc, wc, p, 0, new(closeOnce)}
 	if err := iop.Close(); err != nil {
 		t.Errorf("Unexpected error from ioPipe.Close: %#v", err)
 	}
@@ -123,16 +120,12 @@ func TestIOPipeClose(t *testing.T) {
 }
 
 func TestIOPipeSlowProc(t *testing.T) {
-	defer func(d time.Duration) {
-		procTimeout = d
-	}(procTimeout)
-	procTimeout = 5 * time.Millisecond
 	rc := &closeRW{}
 	wc := &closeRW{}
-	p := &proc{delay: procTimeout * 2}
-	iop := ioPipe{rc, wc, p}
-	if err := iop.Close(); err != errProcStopTimeout {
-		t.Errorf("Unexpected error from ioPipe.Close, expected %#v, got: %#v", errProcStopTimeout, err)
+	p := &proc{delay: 10 * time.Millisecond}
+	iop := ioPipe{rc, wc, p, 5 * time.Millisecond, new(closeOnce)}
+	if err := iop.Close(); !errors.Is(err, ErrStopTimeout) {
+		t.Errorf("Unexpected error from ioPipe.Close, expected %#v, got: %#v", ErrStopTimeout, err)
 	}
 	if !rc.closed {
 		t.Error("Close not called on ReadCloser.")
@@ -151,6 +144,85 @@ func TestIOPipeSlowProc(t *testing.T) {
 	}
 }
 
+func TestIOPipeCloseJoinsErrors(t *testing.T) {
+	readErr := errors.New("read")
+	writeErr := errors.New("write")
+	waitErr := errors.New("wait")
+	p := &proc{delay: 10 * time.Millisecond, waitErr: waitErr}
+	iop := ioPipe{&closeRW{err: readErr}, &closeRW{err: writeErr}, p, 5 * time.Millisecond, new(closeOnce)}
+	err := iop.Close()
+	for _, expected := range []error{readErr, writeErr, waitErr, ErrStopTimeout} {
+		if !errors.Is(err, expected) {
+			t.Errorf("Expected error from ioPipe.Close to include %q, got: %v", expected, err)
+		}
+	}
+}
+
+func TestIOPipeSignalError(t *testing.T) {
+	signalErr := errors.New("signal")
+	p := &proc{signalErr: signalErr}
+	iop := ioPipe{&closeRW{}, &closeRW{}, p, 0, new(closeOnce)}
+	err := iop.Close()
+	if !errors.Is(err, signalErr) {
+		t.Errorf("Expected error from ioPipe.Close to include %q, got: %v", signalErr, err)
+	}
+	if errors.Is(err, ErrStopTimeout) {
+		t.Errorf("Unexpected ErrStopTimeout from ioPipe.Close: %v", err)
+	}
+	if !p.killed {
+		t.Errorf("Kill() unexpectedly not called on a process that could not be signalled.")
+	}
+}
+
+func TestRWCloserDoubleClose(t *testing.T) {
+	rc := &closeRW{err: errors.New("read")}
+	wc := &closeRW{}
+	rwc := newRWCloser(rc, wc)
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = rwc.Close()
+		}(i)
+	}
+	wg.Wait()
+	first := 0
+	for _, err := range errs {
+		if !errors.Is(err, ErrAlreadyClosed) {
+			first++
+			if !errors.Is(err, rc.err) {
+				t.Errorf("Expected the first Close to return the read error, got %v", err)
+			}
+		}
+	}
+	if first != 1 {
+		t.Errorf("Expected one Close to close, and the rest to return ErrAlreadyClosed, got %v", errs)
+	}
+	if rc.closes != 1 || wc.closes != 1 {
+		t.Errorf("Expected each closer to be closed once, got %d and %d", rc.closes, wc.closes)
+	}
+}
+
+func TestIOPipeDoubleClose(t *testing.T) {
+	rc := &closeRW{}
+	wc := &closeRW{}
+	p := &proc{}
+	iop := ioPipe{rc, wc, p, 0, new(closeOnce)}
+	if err := iop.Close(); err != nil {
+		t.Fatalf("Unexpected error from ioPipe.Close: %v", err)
+	}
+	copied := iop
+	copied.stopTimeout = time.Second
+	if err := copied.Close(); !errors.Is(err, ErrAlreadyClosed) {
+		t.Errorf("Expected closing a copy of a closed pipe to return ErrAlreadyClosed, got %v", err)
+	}
+	if rc.closes != 1 || wc.closes != 1 {
+		t.Errorf("Expected each closer to be closed once, got %d and %d", rc.closes, wc.closes)
+	}
+}
+
 func TestNewProvider(t *testing.T) {
 	p := NewProvider()
 	if p.server == nil {
@@ -371,9 +443,9 @@ func testConsumer(
 
 	var client *rpc.Client
 	if clientcodec == nil {
-		client = rpc.NewClient(rwCloser{stdinR, stdoutW})
+		client = rpc.NewClient(newRWCloser(stdinR, stdoutW))
 	} else {
-		client = rpc.NewClientWithCodec(clientcodec(rwCloser{stdinR, stdoutW}))
+		client = rpc.NewClientWithCodec(clientcodec(newRWCloser(stdinR, stdoutW)))
 	}
 	defer client.Close()
 
@@ -573,6 +645,7 @@ func (p *proc) Signal(sig os.Signal) error {
 // testing purposes.
 type closeRW struct {
 	closed bool
+	closes int
 	err    error
 }
 
@@ -580,6 +653,7 @@ type closeRW struct {
 // value's error, if any.
 func (c *closeRW) Close() error {
 	c.closed = true
+	c.closes++
 	return c.err
 }
 
@@ -0,0 +1,177 @@
+package pietest
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/natefinch/pie"
+)
+
+// ErrInjected is returned by writes that fail because a Chaos injected a
+// fault.
+var ErrInjected = errors.New("pietest: injected fault")
+
+// Chaos injects faults into the connections of the plugins started with its
+// Option, so that tests can check that a host's supervisors, retries, and
+// timeouts cope with slow, lossy, and crashing plugins.  Faults are injected
+// into the messages the host sends to the plugin.
+//
+// Rates are probabilities between 0 and 1, and zero rates inject no faults.
+// A Chaos may be shared by several plugins and used from several goroutines
+// at once.
+type Chaos struct {
+	// Latency is the longest delay added to a message.  Each delayed message
+	// waits for a random time up to Latency before it is sent.
+	Latency time.Duration
+	// LatencyRate is the probability that a message is delayed.
+	LatencyRate float64
+	// DropRate is the probability that a message is thrown away instead of
+	// being sent.  Depending on the codec, a dropped message loses the call it
+	// carried, which then never gets a reply, or corrupts the rest of the
+	// connection.
+	DropRate float64
+	// KillRate is the probability that the plugin is killed just before a
+	// message is sent to it: its connection is closed and its process stopped,
+	// as if it had crashed.
+	KillRate float64
+	// HandshakeFailRate is the probability that a plugin is killed when the
+	// host sends its first message.  For a plugin started with a Ready
+	// timeout or with pie.WithAPIVersions, this makes starting it fail.
+	HandshakeFailRate float64
+	// Seed seeds the choice of faults, so that a failing test can be
+	// repeated.  If it is zero, the time is used as the seed.
+	Seed int64
+	// Logf, if not nil, is called to log each fault injected, and may be set
+	// to a test's Logf.
+	Logf func(format string, args ...interface{})
+
+	mu    sync.Mutex
+	rand  *rand.Rand
+	stats ChaosStats
+}
+
+// ChaosStats counts the faults a Chaos has injected.
+type ChaosStats struct {
+	Delays            int
+	Drops             int
+	Kills             int
+	HandshakeFailures int
+}
+
+// Option returns the start option that makes a plugin's connection subject to
+// c's faults.  It may be passed to pie.StartPlugin, to the Start functions of
+// this package, or in a pie.PluginSpec's Options.
+func (c *Chaos) Option() pie.StartOption {
+	return pie.WithConnWrapper(func(conn io.ReadWriteCloser) io.ReadWriteCloser {
+		return &chaosConn{ReadWriteCloser: conn, chaos: c, first: true}
+	})
+}
+
+// Stats returns the number of faults c has injected so far.
+func (c *Chaos) Stats() ChaosStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// roll reports whether an event with the given probability happens, and if it
+// does, counts it with count.
+func (c *Chaos) roll(rate float64, count func(*ChaosStats)) bool {
+	if rate <= 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rand == nil {
+		seed := c.Seed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		c.rand = rand.New(rand.NewSource(seed))
+	}
+	if c.rand.Float64() >= rate {
+		return false
+	}
+	count(&c.stats)
+	return true
+}
+
+// delay returns a random delay up to c.Latency.
+func (c *Chaos) delay() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Duration(c.rand.Int63n(int64(c.Latency) + 1))
+}
+
+// logf logs a fault, if c has a Logf.
+func (c *Chaos) logf(format string, args ...interface{}) {
+	if c.Logf != nil {
+		c.Logf("pietest: chaos: "+format, args...)
+	}
+}
+
+// chaosConn is a connection to a plugin with faults injected by chaos.
+type chaosConn struct {
+	io.ReadWriteCloser
+	chaos *Chaos
+
+	mu sync.Mutex
+	// first is true until the first message has been sent.
+	first bool
+	// killed is true once the plugin has been killed.
+	killed bool
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Write sends p to the plugin, unless a fault is injected instead.
+func (c *chaosConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.killed {
+		return 0, ErrInjected
+	}
+	if c.first {
+		c.first = false
+		if c.chaos.roll(c.chaos.HandshakeFailRate, func(s *ChaosStats) { s.HandshakeFailures++ }) {
+			c.chaos.logf("failing handshake")
+			return 0, c.kill()
+		}
+	}
+	if c.chaos.roll(c.chaos.KillRate, func(s *ChaosStats) { s.Kills++ }) {
+		c.chaos.logf("killing plugin")
+		return 0, c.kill()
+	}
+	if c.chaos.roll(c.chaos.DropRate, func(s *ChaosStats) { s.Drops++ }) {
+		c.chaos.logf("dropping %d bytes", len(p))
+		return len(p), nil
+	}
+	if c.chaos.Latency > 0 && c.chaos.roll(c.chaos.LatencyRate, func(s *ChaosStats) { s.Delays++ }) {
+		d := c.chaos.delay()
+		c.chaos.logf("delaying %d bytes by %v", len(p), d)
+		time.Sleep(d)
+	}
+	return c.ReadWriteCloser.Write(p)
+}
+
+// kill closes the connection in the background, which stops the plugin
+// process, and returns the error for the write that was failed.  c.mu must be
+// held.
+func (c *chaosConn) kill() error {
+	c.killed = true
+	go c.Close()
+	return ErrInjected
+}
+
+// Close closes the connection once, returning the error from the first close
+// to every caller.
+func (c *chaosConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.ReadWriteCloser.Close()
+	})
+	return c.closeErr
+}
@@ -0,0 +1,119 @@
+package pietest
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/natefinch/pie"
+)
+
+func TestChaosLatency(t *testing.T) {
+	chaos := &Chaos{Latency: 10 * time.Millisecond, LatencyRate: 1, Seed: 1, Logf: t.Logf}
+	p := StartPlugin(t, os.Args[0], []string{helperFlag}, chaos.Option())
+	var reply string
+	if err := p.Call("api.Echo", "hi", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "hi" {
+		t.Errorf("Wrong reply, expected %q, got %q", "hi", reply)
+	}
+	if chaos.Stats().Delays == 0 {
+		t.Error("Expected a message to be delayed")
+	}
+}
+
+func TestChaosDrop(t *testing.T) {
+	chaos := &Chaos{DropRate: 1, Seed: 1}
+	p := StartPlugin(t, os.Args[0], []string{helperFlag}, chaos.Option(),
+		pie.WithTimeouts(pie.Timeouts{Call: 100 * time.Millisecond}))
+	var reply string
+	if err := p.Call("api.Echo", "hi", &reply); err == nil {
+		t.Fatal("Expected the call to time out")
+	}
+	if chaos.Stats().Drops == 0 {
+		t.Error("Expected a message to be dropped")
+	}
+}
+
+func TestChaosKill(t *testing.T) {
+	chaos := &Chaos{KillRate: 1, Seed: 1}
+	p := StartPlugin(t, os.Args[0], []string{helperFlag}, chaos.Option())
+	var reply string
+	if err := p.Call("api.Echo", "hi", &reply); err == nil {
+		t.Fatal("Expected the call to fail")
+	}
+	select {
+	case <-p.Exited():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Plugin still running after being killed")
+	}
+	if got := chaos.Stats().Kills; got != 1 {
+		t.Errorf("Expected 1 kill, got %d", got)
+	}
+}
+
+func TestChaosKillRestartedBySupervisor(t *testing.T) {
+	chaos := &Chaos{KillRate: 1, Seed: 1}
+	starts := 0
+	sup, err := pie.Supervise(func() (*pie.Plugin, error) {
+		starts++
+		opts := []pie.StartOption{}
+		if starts == 1 {
+			opts = append(opts, chaos.Option())
+		}
+		return pie.StartPlugin(os.Stderr, os.Args[0], []string{helperFlag}, opts...)
+	}, pie.Policy{MaxRestarts: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sup.Close()
+	var reply string
+	if err := sup.Call("api.Echo", "hi", &reply); err == nil {
+		t.Fatal("Expected the call to the killed plugin to fail")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for sup.Restarts() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Supervisor did not restart the killed plugin")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for {
+		err := sup.Call("api.Echo", "hi", &reply)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Calling the restarted plugin: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestChaosHandshakeFailure(t *testing.T) {
+	chaos := &Chaos{HandshakeFailRate: 1, Seed: 1}
+	p, err := pie.StartPlugin(os.Stderr, os.Args[0], []string{helperFlag}, chaos.Option(),
+		pie.WithTimeouts(pie.Timeouts{Ready: 5 * time.Second}))
+	if err == nil {
+		p.Close()
+		t.Fatal("Expected starting the plugin to fail")
+	}
+	if got := chaos.Stats().HandshakeFailures; got != 1 {
+		t.Errorf("Expected 1 handshake failure, got %d", got)
+	}
+}
+
+func TestChaosNoFaults(t *testing.T) {
+	chaos := &Chaos{}
+	p := StartPlugin(t, os.Args[0], []string{helperFlag}, chaos.Option())
+	var reply string
+	for i := 0; i < 3; i++ {
+		if err := p.Call("api.Echo", "hi", &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := chaos.Stats(); stats != (ChaosStats{}) {
+		t.Errorf("Expected no faults, got %+v", stats)
+	}
+}
@@ -0,0 +1,219 @@
+package pietest
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/natefinch/pie"
+)
+
+// leakTimeout is how long CheckLeaks waits for goroutines, file descriptors,
+// and processes to go away before reporting them.  It is a variable so that
+// this package's tests can shorten it.
+var leakTimeout = 5 * time.Second
+
+// piePackage is the import path of package pie, whose goroutines CheckLeaks
+// watches.
+var piePackage = reflect.TypeOf(pie.Plugin{}).PkgPath()
+
+// CheckLeaks makes the test fail if, when it ends, it has left behind
+// resources that closing its plugins should have released:
+//
+//   - goroutines running code in package pie, or started by it
+//   - child processes of the test, including exited ones not yet waited for
+//   - pipe and socket file descriptors
+//
+// Call it at the start of the test, before starting any plugins, so that the
+// check runs after the cleanups that close them, including those registered
+// by StartPlugin.  What exists when CheckLeaks is called is not reported.
+// Since goroutines and processes take a moment to finish, the check waits a
+// few seconds for them before failing.  Child processes and file descriptors
+// are only checked on Linux.
+func CheckLeaks(t testing.TB) {
+	t.Helper()
+	before := takeSnapshot()
+	t.Cleanup(func() {
+		deadline := time.Now().Add(leakTimeout)
+		for {
+			leaks := takeSnapshot().leaksSince(before)
+			if len(leaks) == 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Errorf("pietest: test leaked:\n%s", strings.Join(leaks, "\n"))
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+// snapshot is what CheckLeaks watches at a point in time.
+type snapshot struct {
+	// goroutines maps the IDs of pie's goroutines to their stacks.
+	goroutines map[int]string
+	// fds maps the pipe and socket file descriptors to what they refer to.
+	fds map[int]string
+	// children maps the IDs of child processes to their descriptions.
+	children map[int]string
+}
+
+// takeSnapshot returns a snapshot of the process.
+func takeSnapshot() snapshot {
+	return snapshot{
+		goroutines: pieGoroutines(),
+		fds:        pipeFds(),
+		children:   childProcesses(),
+	}
+}
+
+// leaksSince describes what the snapshot holds that before does not.
+func (s snapshot) leaksSince(before snapshot) []string {
+	var leaks []string
+	for _, id := range newKeys(s.goroutines, before.goroutines) {
+		leaks = append(leaks, "goroutine "+s.goroutines[id])
+	}
+	var fds []int
+	for fd, target := range s.fds {
+		// A descriptor closed and reused for another pipe is new too.
+		if old, ok := before.fds[fd]; !ok || old != target {
+			fds = append(fds, fd)
+		}
+	}
+	sort.Ints(fds)
+	for _, fd := range fds {
+		leaks = append(leaks, fmt.Sprintf("file descriptor %d: %s", fd, s.fds[fd]))
+	}
+	for _, pid := range newKeys(s.children, before.children) {
+		leaks = append(leaks, fmt.Sprintf("child process %d: %s", pid, s.children[pid]))
+	}
+	return leaks
+}
+
+// newKeys returns the keys of m that are not in old, in order.
+func newKeys(m, old map[int]string) []int {
+	var keys []int
+	for k := range m {
+		if _, ok := old[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// pieGoroutines returns the stacks of the goroutines running code in package
+// pie, or started by it, by goroutine ID.
+func pieGoroutines() map[int]string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	goroutines := map[int]string{}
+	for _, stack := range bytes.Split(buf, []byte("\n\n")) {
+		header, _, _ := bytes.Cut(stack, []byte("\n"))
+		fields := strings.Fields(string(header))
+		if len(fields) < 2 || fields[0] != "goroutine" {
+			continue
+		}
+		id, err := strconv.Atoi(fields[1])
+		if err != nil || !inPie(string(stack)) {
+			continue
+		}
+		goroutines[id] = string(stack)
+	}
+	return goroutines
+}
+
+// inPie reports whether a goroutine's stack has a frame in package pie, or
+// shows it was started by pie.
+func inPie(stack string) bool {
+	for _, line := range strings.Split(stack, "\n") {
+		line = strings.TrimPrefix(line, "created by ")
+		if strings.HasPrefix(line, piePackage+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// pipeFds returns the process's pipe and socket file descriptors, with what
+// they refer to.  It returns none where that cannot be found out.
+func pipeFds() map[int]string {
+	fds := map[int]string{}
+	if runtime.GOOS != "linux" {
+		return fds
+	}
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return fds
+	}
+	for _, e := range entries {
+		fd, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		target, err := os.Readlink("/proc/self/fd/" + e.Name())
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(target, "pipe:") || strings.HasPrefix(target, "socket:") {
+			fds[fd] = target
+		}
+	}
+	return fds
+}
+
+// childProcesses returns the process's children, including exited ones not
+// yet waited for, described by their name and state.  It returns none where
+// they cannot be found.
+func childProcesses() map[int]string {
+	children := map[int]string{}
+	if runtime.GOOS != "linux" {
+		return children
+	}
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return children
+	}
+	self := os.Getpid()
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := os.ReadFile("/proc/" + e.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		// The name is in parentheses, and may hold spaces and parentheses of
+		// its own, so the fields after it are found from the last ')'.
+		open := bytes.IndexByte(stat, '(')
+		end := bytes.LastIndexByte(stat, ')')
+		if open < 0 || end < open {
+			continue
+		}
+		fields := strings.Fields(string(stat[end+1:]))
+		if len(fields) < 2 {
+			continue
+		}
+		if ppid, err := strconv.Atoi(fields[1]); err != nil || ppid != self {
+			continue
+		}
+		children[pid] = fmt.Sprintf("%s, state %s", stat[open+1:end], fields[0])
+	}
+	return children
+}
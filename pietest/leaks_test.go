@@ -0,0 +1,78 @@
+package pietest
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/natefinch/pie"
+)
+
+func TestCheckLeaks(t *testing.T) {
+	CheckLeaks(t)
+	p := StartPlugin(t, os.Args[0], []string{helperFlag})
+	var reply string
+	if err := p.Call("api.Echo", "hi", &reply); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// leakTB records the failures of a test, and runs its cleanups when asked.
+type leakTB struct {
+	testing.TB
+	errors   []string
+	cleanups []func()
+}
+
+func (t *leakTB) Helper() {}
+
+func (t *leakTB) Cleanup(f func()) {
+	t.cleanups = append(t.cleanups, f)
+}
+
+func (t *leakTB) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+// end runs the cleanups, last registered first.
+func (t *leakTB) end() {
+	for i := len(t.cleanups) - 1; i >= 0; i-- {
+		t.cleanups[i]()
+	}
+}
+
+func TestCheckLeaksReportsLeaks(t *testing.T) {
+	defer func(d time.Duration) { leakTimeout = d }(leakTimeout)
+	leakTimeout = 100 * time.Millisecond
+	tb := &leakTB{TB: t}
+	CheckLeaks(tb)
+	p, err := pie.StartPlugin(nil, os.Args[0], []string{helperFlag})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb.end()
+	p.Close()
+	<-p.Exited()
+	if len(tb.errors) != 1 {
+		t.Fatalf("Expected one failure for a plugin left running, got %q", tb.errors)
+	}
+	want := []string{"goroutine "}
+	if _, err := os.Stat("/proc/self/fd"); err == nil {
+		want = append(want, "file descriptor ", "child process ")
+	}
+	for _, w := range want {
+		if !strings.Contains(tb.errors[0], "\n"+w) {
+			t.Errorf("Expected the failure to report a leaked %s, got %s", strings.TrimSpace(w), tb.errors[0])
+		}
+	}
+
+	// Once the plugin is closed, nothing is reported.
+	tb = &leakTB{TB: t}
+	CheckLeaks(tb)
+	tb.end()
+	if len(tb.errors) != 0 {
+		t.Errorf("Expected no failures, got %q", tb.errors)
+	}
+}
@@ -0,0 +1,91 @@
+// Package pietest provides helpers for testing applications that use pie
+// plugins.
+//
+// The Start functions in this package start plugins the way their
+// counterparts in package pie do, but fail the test if the plugin cannot be
+// started, send the plugin's stderr to the test log, and shut the plugin down
+// when the test ends, so that plugins are not left running on the machine
+// after a test fails or forgets to close them.  CheckLeaks checks that closing
+// them released everything pie started for them.
+package pietest
+
+import (
+	"bytes"
+	"net/rpc"
+	"sync"
+	"testing"
+
+	"github.com/natefinch/pie"
+)
+
+// StartPlugin starts a provider-style plugin like pie.StartPlugin and returns
+// its handle.  The plugin is closed when the test ends, and as a safety net
+// against handles that escape the test, the handle is started with
+// pie.WithFinalizer.
+func StartPlugin(t testing.TB, path string, args []string, opts ...pie.StartOption) *pie.Plugin {
+	t.Helper()
+	output := newLogWriter(t)
+	opts = append([]pie.StartOption{pie.WithFinalizer()}, opts...)
+	p, err := pie.StartPlugin(output, path, args, opts...)
+	if err != nil {
+		output.stop()
+		t.Fatalf("starting plugin %s: %v", path, err)
+	}
+	t.Cleanup(func() {
+		p.Close()
+		<-p.Exited()
+		output.stop()
+	})
+	return p
+}
+
+// StartProvider starts a provider-style plugin like pie.StartProvider and
+// returns an RPC client for it.  The plugin is shut down when the test ends.
+func StartProvider(t testing.TB, path string, args ...string) *rpc.Client {
+	t.Helper()
+	return StartPlugin(t, path, args).Client()
+}
+
+// logWriter writes each line written to it to the test log until it is
+// stopped.  Output written after the test ends, which the testing package
+// does not allow to be logged, is dropped.
+type logWriter struct {
+	t       testing.TB
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	stopped bool
+}
+
+// newLogWriter returns a logWriter that logs to t.
+func newLogWriter(t testing.TB) *logWriter {
+	return &logWriter{t: t}
+}
+
+// Write logs the complete lines in p, buffering any incomplete last line.
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped {
+		return len(p), nil
+	}
+	w.buf.Write(p)
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i < 0 {
+			break
+		}
+		w.t.Log("plugin: " + string(w.buf.Next(i + 1)[:i]))
+	}
+	return len(p), nil
+}
+
+// stop logs any incomplete last line, and drops all later output.
+func (w *logWriter) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.buf.Len() > 0 {
+		w.t.Log("plugin: " + w.buf.String())
+		w.buf.Reset()
+	}
+	w.stopped = true
+}
@@ -0,0 +1,61 @@
+package pietest
+
+import (
+	"os"
+	"testing"
+
+	"github.com/natefinch/pie"
+)
+
+// helperFlag is passed to the test binary to make it act as a plugin instead
+// of running the tests.
+const helperFlag = "-pietest.helper"
+
+func TestMain(m *testing.M) {
+	if len(os.Args) == 2 && os.Args[1] == helperFlag {
+		p := pie.NewProvider()
+		p.RegisterName("api", api{})
+		p.Serve()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+type api struct{}
+
+func (api) Echo(s string, reply *string) error {
+	os.Stderr.WriteString("echo " + s + "\n")
+	*reply = s
+	return nil
+}
+
+func TestStartPlugin(t *testing.T) {
+	var exited <-chan struct{}
+	t.Run("plugin", func(t *testing.T) {
+		p := StartPlugin(t, os.Args[0], []string{helperFlag})
+		exited = p.Exited()
+		var reply string
+		if err := p.Call("api.Echo", "hi", &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply != "hi" {
+			t.Errorf("Wrong reply, expected %q, got %q", "hi", reply)
+		}
+	})
+	select {
+	case <-exited:
+	default:
+		t.Error("Plugin still running after its test ended")
+	}
+}
+
+func TestStartProvider(t *testing.T) {
+	client := StartProvider(t, os.Args[0], helperFlag)
+	var reply string
+	if err := client.Call("api.Echo", "hi", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "hi" {
+		t.Errorf("Wrong reply, expected %q, got %q", "hi", reply)
+	}
+}
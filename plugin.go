@@ -0,0 +1,920 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Plugin is a handle to a provider-style plugin application started with
+// StartPlugin.  In addition to the RPC client that StartProvider would return,
+// it keeps track of the plugin process and of the calls made through the
+// handle, which lets a Supervisor notice when the plugin has exited or stopped
+// responding.
+type Plugin struct {
+	client *rpc.Client
+	codec  *clientCodec
+	conn   *countingConn
+	// detach is the connection beneath the codec, which Detach hands over,
+	// and keepaliveOn reports whether the handle pings itself, which stops it
+	// detaching.
+	detach      *detachConn
+	keepaliveOn bool
+	proc        *reaper
+	started     time.Time
+	// apiVersion is the API version negotiated by WithAPIVersions.
+	apiVersion string
+	// buildInfo is the build information sent by the plugin, once it has
+	// been exchanged.
+	buildMu   sync.Mutex
+	buildInfo *BuildInfo
+	// features are the flags last set with SetFeatures, which a Supervisor
+	// sets on the instances that replace the plugin, or nil if they have not
+	// been changed.
+	featuresMu sync.Mutex
+	features   Features
+	// deprecations, if not nil, warns about calls to deprecated methods.
+	deprecations *deprecationWarner
+	// callTimeout, if not zero, is the timeout for calls made through Call.
+	callTimeout time.Duration
+	// journal, if not nil, records the calls made through Call.
+	journal *Journal
+	// requestIDs makes calls carry request IDs, and requestLog, if not nil,
+	// logs the calls with IDs that fail.
+	requestIDs bool
+	requestLog func(format string, v ...interface{})
+	// mux, if not nil, multiplexes the connection to the plugin, and control
+	// is the client for the control API on its control channel.
+	mux     *Mux
+	control *rpc.Client
+	// phases makes the plugin refuse application calls until its phase,
+	// accessed atomically, is PhaseServing.
+	phases bool
+	phase  int32
+	// maxReply is the limit set by WithMaxReplySize, and callMetrics the
+	// function set by WithCallMetrics.
+	maxReply    int
+	callMetrics func(CallMetrics)
+	// resultHooks are set by WithResultHook.
+	resultHooks []resultHook
+	// binds are the paths granted to a plugin started with WithPrivateRoot.
+	binds []RootBind
+	// crash collects crash reports for WithCrashReports.
+	crash *crashCollector
+	// startEnv is what the plugin's process was started with.
+	startEnv *StartEnvironment
+	// peers is the host's end of the plugin's peer socket, if it has one, and
+	// peersMu keeps BrokerStream to one connection at a time per plugin.
+	peersMu sync.Mutex
+	peers   *net.UnixConn
+	// decoders, if not nil, holds a token for each deferred reply being
+	// decoded, limiting how many are at a time.
+	decoders chan struct{}
+	// warmUp are the calls made once the plugin is ready.
+	warmUp   []WarmUpCall
+	warmOnce sync.Once
+
+	// stopped records whether, and why, the handle has been stopped; see
+	// State.
+	stopped atomic.Int32
+
+	mu       sync.Mutex
+	nextID   uint64
+	inflight map[uint64]pendingCall
+	idle     chan struct{}
+	// warmUpErr is the error of the failed warm-up call, if any.
+	warmUpErr error
+}
+
+// pendingCall records a call made through Plugin.Call that has not yet
+// returned.
+type pendingCall struct {
+	method  string
+	started time.Time
+}
+
+// StartOption configures how StartPlugin starts a plugin.
+type StartOption func(*startOptions)
+
+// startOptions holds the configuration built up from StartOptions.
+type startOptions struct {
+	codec       func(io.ReadWriteCloser) rpc.ClientCodec
+	resolver    *Resolver
+	preflight   bool
+	apiVersions []string
+	warnf       func(format string, v ...interface{})
+	warnEvery   time.Duration
+	// cmdHooks adjust the plugin's exec.Cmd before it is started.
+	cmdHooks []func(*exec.Cmd)
+	timeouts Timeouts
+	// finalizer makes the handle kill the plugin when it is garbage collected.
+	finalizer bool
+	journal   *Journal
+	// framing makes the handle unframe what it reads from the plugin, passing
+	// stray output to onStray.  checksums makes frames in both directions
+	// checksummed, and resetOnCorruption closes the handle when a corrupt
+	// frame is read.
+	framing           bool
+	onStray           func([]byte)
+	checksums         bool
+	resetOnCorruption bool
+	// transportKeepalive and deadPeer are set by WithTransportKeepalive.
+	transportKeepalive time.Duration
+	deadPeer           time.Duration
+	mux                bool
+	requestIDs         bool
+	requestLog         func(format string, v ...interface{})
+	// codecs are the names of the codecs to negotiate, set by WithCodecs.
+	codecs []string
+	// wrappers wrap the connection to the plugin, in order.
+	wrappers []func(io.ReadWriteCloser) io.ReadWriteCloser
+	phases   bool
+	warmUp   []WarmUpCall
+	// maxReply and callMetrics are set by WithMaxReplySize and
+	// WithCallMetrics.
+	maxReply    int
+	callMetrics func(CallMetrics)
+	// decoders is the number of replies decoded at a time, set by
+	// WithParallelDecode.
+	decoders int
+	// batching is set by WithBatching.
+	batching *Batching
+	// marshalers are the names of the Marshalers to negotiate, set by
+	// WithMarshalers.
+	marshalers []string
+	// encryption is the secret set by WithEncryption, which is nil if the
+	// connection is not encrypted.
+	encryption []byte
+	// pluginVersion is the constraint set by WithRequiredPluginVersion.
+	pluginVersion string
+	// features are the flags set by WithFeatures.
+	features Features
+	// resultHooks are set by WithResultHook.
+	resultHooks []resultHook
+	// debugStart is set by WithDebugStart.
+	debugStart *DebugStart
+	// network is the policy set by WithNetworkPolicy.
+	network *NetworkPolicy
+	// root holds the binds set by WithPrivateRoot, and is nil if the plugin
+	// shares the host's root.
+	root []RootBind
+	// runner makes the Runner set by WithRunner.
+	runner func(*exec.Cmd) (Runner, error)
+	// capabilities are the names set by WithCapabilities.
+	capabilities []string
+	// crashTail is the amount of stderr kept by WithCrashReports, or zero.
+	crashTail int
+	// bootstrap is set by WithSocketBootstrap.
+	bootstrap bool
+}
+
+// WithClientCodec makes StartPlugin communicate with the plugin using the
+// ClientCodec returned by f instead of gob encoding.
+func WithClientCodec(f func(io.ReadWriteCloser) rpc.ClientCodec) StartOption {
+	return func(o *startOptions) {
+		o.codec = f
+	}
+}
+
+// WithConnWrapper makes the handle talk to the plugin through the connection
+// returned by wrap, which is given the connection to the plugin before any
+// framing or multiplexing is layered on it.  It is meant for instrumenting
+// and testing the transport, for example to inject faults.  Wrappers from
+// several WithConnWrapper options are applied in order.
+func WithConnWrapper(wrap func(io.ReadWriteCloser) io.ReadWriteCloser) StartOption {
+	return func(o *startOptions) {
+		o.wrappers = append(o.wrappers, wrap)
+	}
+}
+
+// WithEnv adds environment variables, each of the form "key=value", to the
+// environment the plugin inherits from the host.  The variables through
+// which pie configures providers, such as PIE_MUX, are not inherited, so that
+// a plugin that starts plugins of its own does not pass on its host's
+// configuration.
+func WithEnv(env ...string) StartOption {
+	return func(o *startOptions) {
+		o.cmdHooks = append(o.cmdHooks, func(cmd *exec.Cmd) {
+			if cmd.Env == nil {
+				cmd.Env = hostEnviron()
+			}
+			cmd.Env = append(cmd.Env, env...)
+		})
+	}
+}
+
+// WithFinalizer sets a finalizer on the handle returned by StartPlugin that
+// kills the plugin process if the handle is garbage collected without having
+// been closed.  It is a safety net against leaked plugins, for example in
+// tests, and not a substitute for calling Close: finalizers run at the garbage
+// collector's convenience, if at all, and a handle is kept reachable while it
+// is tied to a context or kept alive by Timeouts.Keepalive.
+func WithFinalizer() StartOption {
+	return func(o *startOptions) {
+		o.finalizer = true
+	}
+}
+
+// StartPlugin starts a provider-style plugin application at the given path and
+// args, and returns a handle for communicating with it.  The writer passed to
+// output will receive output from the plugin's stderr.  Closing the handle
+// will shut down the plugin application.
+func StartPlugin(output io.Writer, path string, args []string, opts ...StartOption) (*Plugin, error) {
+	return startPlugin(context.Background(), false, output, path, args, opts)
+}
+
+// StartPluginContext is like StartPlugin, but ties the plugin to ctx: if ctx
+// is cancelled while the plugin is being started, starting is abandoned, and
+// once the plugin is running it is closed when ctx is cancelled.  It does not
+// return until the plugin has answered a ping, so that a plugin which never
+// becomes ready fails when ctx expires rather than on the first call.
+func StartPluginContext(ctx context.Context, output io.Writer, path string, args []string, opts ...StartOption) (*Plugin, error) {
+	return startPlugin(ctx, true, output, path, args, opts)
+}
+
+// startPluginWithin is like StartPlugin, but abandons starting the plugin if
+// ctx is done first.  Unlike StartPluginContext, it does not wait for the
+// plugin to answer a ping, and leaves the plugin running once it has started.
+func startPluginWithin(ctx context.Context, output io.Writer, path string, args []string, opts []StartOption) (*Plugin, error) {
+	if ctx.Done() == nil {
+		return startPlugin(ctx, false, output, path, args, opts)
+	}
+	startCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, cancel)
+	p, err := startPlugin(startCtx, false, output, path, args, opts)
+	if !stop() {
+		// Cancelling startCtx closes a plugin that did start.
+		if p != nil {
+			p.Close()
+		}
+		return nil, ctx.Err()
+	}
+	return p, err
+}
+
+// startPlugin starts a plugin for StartPlugin and StartPluginContext, waiting
+// for it to answer a ping if ready is true.
+func startPlugin(ctx context.Context, ready bool, output io.Writer, path string, args []string, opts []StartOption) (*Plugin, error) {
+	var o startOptions
+	WithEnv(guardEnv + "=1")(&o)
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.framing {
+		WithEnv(framingEnv + "=" + o.framingValue())(&o)
+	}
+	if o.transportKeepalive > 0 {
+		WithEnv(keepaliveEnv + "=" + o.transportKeepalive.String() + "," + o.deadPeer.String())(&o)
+	}
+	if o.mux {
+		WithEnv(muxEnv + "=1")(&o)
+	}
+	if o.batching != nil {
+		WithEnv(batchingEnv + "=" + o.batching.env())(&o)
+	}
+	WithEnv(hostBuildEnv + "=" + CurrentBuildInfo().env())(&o)
+	if o.features != nil {
+		WithEnv(featuresEnv + "=" + o.features.env())(&o)
+		// The plugin gets its flags through its environment instead.
+		o.features = nil
+	}
+	// The pipes to a local plugin need no encryption.
+	o.encryption = nil
+	if o.resolver != nil {
+		resolved, err := o.resolver.Resolve(path)
+		if err != nil {
+			return nil, err
+		}
+		path = resolved
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if o.preflight {
+		if err := Preflight(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var boot *BootstrapListener
+	if o.bootstrap {
+		if o.network != nil {
+			return nil, errors.New("pie: WithSocketBootstrap cannot be used with WithNetworkPolicy")
+		}
+		l, err := ListenBootstrap()
+		if err != nil {
+			return nil, err
+		}
+		defer l.Close()
+		WithEnv(bootstrapEnv + "=" + l.Addr())(&o)
+		boot = l
+	}
+	cmd := makeCommand(output, path, args)
+	// releases undo what sandboxing the plugin set up, given a channel that
+	// is closed when the plugin exits, or nil if it did not start.
+	var releases []func(exited <-chan struct{})
+	var binds []RootBind
+	var crash *crashCollector
+	var startEnv *StartEnvironment
+	var peers *net.UnixConn
+	if ec, ok := cmd.(execCmd); ok {
+		for _, hook := range o.cmdHooks {
+			hook(ec.Cmd)
+		}
+		// Runners start the plugin elsewhere, where it cannot inherit a peer
+		// socket.  Plugins without one only lose BrokerStream, so failing to
+		// make one does not fail the start.
+		if o.runner == nil {
+			if conn, release, err := givePeerSocket(ec.Cmd); err == nil {
+				releases = append(releases, release)
+				peers = conn
+			}
+		}
+		if o.network != nil {
+			release, err := isolateNetwork(ec.Cmd, o.network)
+			if err != nil {
+				return nil, err
+			}
+			releases = append(releases, release)
+		}
+		if o.root != nil {
+			release, granted, err := privateRoot(ec.Cmd, o.root)
+			if err != nil {
+				for _, release := range releases {
+					release(nil)
+				}
+				return nil, err
+			}
+			releases = append(releases, release)
+			binds = granted
+		}
+		if o.capabilities != nil {
+			if err := grantCapabilities(ec.Cmd, o.capabilities); err != nil {
+				for _, release := range releases {
+					release(nil)
+				}
+				return nil, err
+			}
+		}
+		if o.crashTail > 0 {
+			c, release, err := collectCrashes(ec.Cmd, output, o.crashTail)
+			if err != nil {
+				for _, release := range releases {
+					release(nil)
+				}
+				return nil, err
+			}
+			releases = append(releases, release)
+			crash = c
+		}
+		startEnv = captureStartEnvironment(ec.Cmd)
+		if crash != nil {
+			crash.env = startEnv
+		}
+		if o.runner != nil {
+			runner, err := o.runner(ec.Cmd)
+			if err != nil {
+				for _, release := range releases {
+					release(nil)
+				}
+				return nil, err
+			}
+			cmd = newRunnerCmd(runner)
+		}
+	}
+	pipe, err := start(cmd)
+	if err != nil {
+		for _, release := range releases {
+			release(nil)
+		}
+		return nil, err
+	}
+	r := newReaper(pipe.proc)
+	for _, release := range releases {
+		release(r.done)
+	}
+	if crash != nil {
+		go crash.watch(r)
+	}
+	pipe.proc = r
+	pipe.stopTimeout = o.timeouts.Stop
+	if o.debugStart != nil {
+		if err := o.debugStart.wait(ctx, path, r); err != nil {
+			err = startupError(r, err)
+			pipe.Close()
+			return nil, err
+		}
+	}
+	if boot != nil {
+		acceptCtx := ctx
+		if o.timeouts.Ready > 0 {
+			var cancel context.CancelFunc
+			acceptCtx, cancel = context.WithTimeout(ctx, o.timeouts.Ready)
+			defer cancel()
+		}
+		conn, err := boot.accept(acceptCtx, r.done)
+		if err != nil {
+			err = startupError(r, err)
+			pipe.Close()
+			return nil, err
+		}
+		pipe = bootstrapPipe(pipe, conn, output)
+	}
+	p, err := newPlugin(ctx, ready, pipe, r, &o)
+	if err != nil {
+		return nil, startupError(r, err)
+	}
+	p.binds = binds
+	p.crash = crash
+	p.startEnv = startEnv
+	p.peers = peers
+	return p, nil
+}
+
+// newPlugin returns a handle for the plugin at the other end of rwc, whose
+// process is r, and brings it up as configured by o.  If ready is true, it
+// waits for the plugin to answer a ping.  If anything fails, rwc is closed.
+func newPlugin(ctx context.Context, ready bool, rwc io.ReadWriteCloser, r *reaper, o *startOptions) (*Plugin, error) {
+	newCodec := o.codec
+	if newCodec == nil {
+		newCodec = newGobClientCodec
+	}
+	for _, wrap := range o.wrappers {
+		rwc = wrap(rwc)
+	}
+	if o.encryption != nil {
+		encryptCtx := ctx
+		if o.timeouts.Ready > 0 {
+			var cancel context.CancelFunc
+			encryptCtx, cancel = context.WithTimeout(ctx, o.timeouts.Ready)
+			defer cancel()
+		}
+		sc, err := encrypt(encryptCtx, rwc, o.encryption, true)
+		if err != nil {
+			rwc.Close()
+			return nil, err
+		}
+		rwc = sc
+	}
+	if o.batching != nil {
+		rwc = newBatchConn(rwc, *o.batching)
+	}
+	var corrupted chan struct{}
+	if o.framing {
+		fc := newFramedConn(rwc, framing{
+			onStray:   o.onStray,
+			writes:    o.transportKeepalive > 0,
+			checksums: o.checksums,
+			keepalive: o.transportKeepalive,
+			deadPeer:  o.deadPeer,
+		})
+		if o.resetOnCorruption {
+			corrupted = make(chan struct{})
+			var once sync.Once
+			fc.fr.onCorrupt = func() { once.Do(func() { close(corrupted) }) }
+		}
+		rwc = fc
+	}
+	var mux *Mux
+	var control *rpc.Client
+	if o.mux {
+		mux = NewMux(rwc, true)
+		s, err := mux.Open(RPCChannel)
+		if err != nil {
+			mux.Close()
+			return nil, err
+		}
+		cs, err := mux.Open(ControlChannel)
+		if err != nil {
+			mux.Close()
+			return nil, err
+		}
+		rwc = muxConn{s}
+		control = rpc.NewClient(cs)
+	}
+	detach := newDetachConn(rwc, false)
+	conn := &countingConn{ReadWriteCloser: detach}
+	// Codecs other than gob read through a replyBudget, which measures their
+	// replies for them.
+	var codecConn io.ReadWriteCloser = conn
+	var budget *replyBudget
+	if o.maxReply > 0 || o.callMetrics != nil {
+		budget = &replyBudget{ReadWriteCloser: conn}
+		codecConn = budget
+	}
+	var cc rpc.ClientCodec
+	if len(o.codecs) > 0 {
+		negotiateCtx := ctx
+		if o.timeouts.Ready > 0 {
+			var cancel context.CancelFunc
+			negotiateCtx, cancel = context.WithTimeout(ctx, o.timeouts.Ready)
+			defer cancel()
+		}
+		var err error
+		if cc, err = negotiateCodec(negotiateCtx, codecConn, o.codecs); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	} else {
+		cc = newCodec(codecConn)
+	}
+	if sizer, ok := cc.(replySizer); ok {
+		sizer.setReplyLimit(o.maxReply)
+		budget = nil
+	} else if budget != nil {
+		budget.setReplyLimit(o.maxReply)
+	}
+	codec := &clientCodec{ClientCodec: cc, budget: budget}
+	p := &Plugin{
+		client:   rpc.NewClientWithCodec(codec),
+		codec:    codec,
+		conn:     conn,
+		detach:   detach,
+		proc:     r,
+		started:  time.Now(),
+		inflight: map[uint64]pendingCall{},
+
+		callTimeout: o.timeouts.Call,
+		journal:     o.journal,
+		requestIDs:  o.requestIDs,
+		requestLog:  o.requestLog,
+		mux:         mux,
+		control:     control,
+		phases:      o.phases,
+		warmUp:      o.warmUp,
+		maxReply:    o.maxReply,
+		callMetrics: o.callMetrics,
+		resultHooks: o.resultHooks,
+	}
+	if o.decoders > 0 {
+		p.decoders = make(chan struct{}, o.decoders)
+	}
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				p.Close()
+			case <-r.done:
+			}
+		}()
+	}
+	if corrupted != nil {
+		go func() {
+			select {
+			case <-corrupted:
+				p.Close()
+			case <-r.done:
+			}
+		}()
+	}
+	if o.timeouts.Ready > 0 || ready {
+		readyCtx := ctx
+		if o.timeouts.Ready > 0 {
+			var cancel context.CancelFunc
+			readyCtx, cancel = context.WithTimeout(ctx, o.timeouts.Ready)
+			defer cancel()
+		}
+		if err := p.ping(readyCtx); err != nil {
+			p.Close()
+			return nil, fmt.Errorf("plugin did not become ready: %w", err)
+		}
+		if err := p.handshakeBuildInfo(readyCtx); err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+	if len(o.marshalers) > 0 {
+		if err := p.negotiateMarshalers(o.marshalers); err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+	if o.features != nil {
+		if err := p.SetFeatures(o.features); err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+	if o.pluginVersion != "" {
+		if err := p.checkPluginVersion(o.pluginVersion); err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+	if o.apiVersions != nil {
+		if err := p.handshake(o.apiVersions); err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+	if o.warnf != nil {
+		if m, err := p.Manifest(); err == nil {
+			p.deprecations = newDeprecationWarner(m, o.warnf, o.warnEvery)
+		}
+	}
+	if o.timeouts.Keepalive > 0 {
+		p.keepaliveOn = true
+		go p.keepalive(o.timeouts.Keepalive)
+	}
+	if !p.phases {
+		p.warm()
+	}
+	if o.finalizer {
+		runtime.SetFinalizer(p, func(p *Plugin) { p.proc.Kill() })
+	}
+	return p, nil
+}
+
+// controlClient returns the client to use for calls to the plugin's control
+// API: the client on the control channel if the connection is multiplexed, so
+// that management calls are never stuck behind large application payloads,
+// and the RPC client otherwise.
+func (p *Plugin) controlClient() *rpc.Client {
+	if p.control != nil {
+		return p.control
+	}
+	return p.client
+}
+
+// Client returns the RPC client used to communicate with the plugin.  Calls
+// made directly on the client are not tracked by the handle, and so are not
+// seen by a Watchdog looking for stuck calls.
+func (p *Plugin) Client() *rpc.Client {
+	return p.client
+}
+
+// Call invokes the named function on the plugin, waits for it to complete, and
+// returns its error status.
+func (p *Plugin) Call(serviceMethod string, args interface{}, reply interface{}) error {
+	return p.call(serviceMethod, callMeta{}, args, reply)
+}
+
+// CallOrdered is like Call, but the plugin runs calls that share the same key
+// one at a time, in the order they were made, while calls with other keys
+// and calls made with Call still run concurrently.  This lets a host make
+// calls for the same document, say, from many goroutines without the plugin
+// having to lock.  Ordering requires a provider created with NewProvider.
+func (p *Plugin) CallOrdered(key, serviceMethod string, args interface{}, reply interface{}) error {
+	return p.call(serviceMethod, callMeta{key: key}, args, reply)
+}
+
+// call makes a call with the given metadata, tracking it for the watchdog and
+// recording it in the journal, if there is one.
+func (p *Plugin) call(serviceMethod string, meta callMeta, args interface{}, reply interface{}) error {
+	if err := p.checkServing(); err != nil {
+		return err
+	}
+	return p.invoke(serviceMethod, meta, args, reply)
+}
+
+// invoke makes a call, whatever the plugin's phase.
+func (p *Plugin) invoke(serviceMethod string, meta callMeta, args interface{}, reply interface{}) (err error) {
+	if p.deprecations != nil {
+		p.deprecations.called(serviceMethod)
+	}
+	if p.requestIDs {
+		meta.rid = newRequestID()
+	}
+	if p.journal != nil {
+		entry, jerr := p.journal.begin(serviceMethod, meta.idem, args)
+		if jerr != nil {
+			return jerr
+		}
+		defer func() {
+			if journalFinished(err) {
+				p.journal.done(entry)
+			}
+		}()
+	}
+	if err := p.checkRunning(); err != nil {
+		return err
+	}
+	id := p.track(serviceMethod)
+	defer p.untrack(id)
+	start := time.Now()
+	isPtr := reflect.ValueOf(reply).Kind() == reflect.Ptr
+	watched := (p.maxReply > 0 || p.callMetrics != nil) && p.codec != nil &&
+		isPtr && p.codec.watchReply(reply)
+	deferred := p.decoders != nil && p.codec != nil && isPtr && p.codec.deferReply(reply)
+	err = p.send(meta.encode(serviceMethod), args, reply)
+	if deferred {
+		if decode := p.codec.takeDecoder(reply); decode != nil && err == nil {
+			err = p.decodeReply(decode, reply)
+		}
+	}
+	var size replySize
+	if watched {
+		size = p.codec.takeReplySize(reply)
+	}
+	if size.tooLarge {
+		err = &ReplyTooLargeError{Method: serviceMethod, Size: size.bytes, Limit: p.maxReply}
+	}
+	if p.callMetrics != nil {
+		defer func() {
+			p.callMetrics(CallMetrics{Method: serviceMethod, Duration: time.Since(start), ReplyBytes: size.bytes, Err: err})
+		}()
+	}
+	err = invalidArgument(methodNotFound(err))
+	if err == nil && p.resultHooks != nil {
+		err = p.applyResultHooks(serviceMethod, reply)
+	}
+	if err != nil && meta.rid != "" {
+		if p.requestLog != nil {
+			p.requestLog("pie: request %s: %s failed: %v", meta.rid, serviceMethod, err)
+		}
+		err = &CallError{Method: serviceMethod, RequestID: meta.rid, Err: err}
+	}
+	return err
+}
+
+// Notify sends a one-way notification to the named function on the plugin.
+// Unlike Call, it does not wait for the function to run, and the plugin sends
+// no response, so errors returned by the function are lost.  The error
+// returned by Notify only reports whether the notification could be sent.
+// Notifications require a provider created with NewProvider.
+func (p *Plugin) Notify(serviceMethod string, args interface{}) error {
+	if err := p.checkServing(); err != nil {
+		return err
+	}
+	if err := p.checkRunning(); err != nil {
+		return err
+	}
+	if p.deprecations != nil {
+		p.deprecations.called(serviceMethod)
+	}
+	return p.codec.notify(serviceMethod, args)
+}
+
+// Calls returns the number of calls that have been made through Call.
+func (p *Plugin) Calls() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.nextID
+}
+
+// Ping calls the plugin's built-in control API to check that it is responsive.
+func (p *Plugin) Ping() error {
+	var n int
+	return p.controlClient().Call(controlService+".Ping", 1, &n)
+}
+
+// ping calls the plugin's control API, waiting for an answer until ctx is done.
+// Plugins that do not serve the control API count as answering.
+func (p *Plugin) ping(ctx context.Context) error {
+	call := p.controlClient().Go(controlService+".Ping", 1, new(int), make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if isMissingMethod(call.Error) {
+			return nil
+		}
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Exited returns a channel that is closed when the plugin process exits.
+func (p *Plugin) Exited() <-chan struct{} {
+	return p.proc.done
+}
+
+// ExitErr returns the error, if any, from waiting on the plugin process.  It
+// is only meaningful once the channel returned by Exited has been closed.  If
+// the plugin exited with one of the Exit status codes, the error is an
+// *ExitError.
+func (p *Plugin) ExitErr() error {
+	select {
+	case <-p.proc.done:
+		return exitError(p.proc.state, p.proc.err)
+	default:
+		return nil
+	}
+}
+
+// Close shuts down the plugin application, killing it if it does not stop in a
+// timely manner.  The error returned joins every error that occurred while
+// closing the pipes to the plugin and stopping and waiting for its process;
+// errors.Is(err, ErrStopTimeout) reports whether the plugin had to be killed.
+//
+// Closing moves the handle to StateDraining, and once the plugin has exited,
+// to StateStopped; see State.
+func (p *Plugin) Close() error {
+	p.stop(stoppedByHost)
+	runtime.SetFinalizer(p, nil)
+	return p.client.Close()
+}
+
+// track records the start of a call through the handle, returning an ID to
+// pass to untrack when the call completes.
+func (p *Plugin) track(method string) uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nextID++
+	p.inflight[p.nextID] = pendingCall{method: method, started: time.Now()}
+	return p.nextID
+}
+
+// untrack removes the record of a completed call.
+func (p *Plugin) untrack(id uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.inflight, id)
+	if len(p.inflight) == 0 && p.idle != nil {
+		close(p.idle)
+		p.idle = nil
+	}
+}
+
+// drain waits until no calls made through Call are in flight, until timeout
+// has elapsed, or until cancel is closed, whichever happens first.
+func (p *Plugin) drain(timeout time.Duration, cancel <-chan struct{}) {
+	p.mu.Lock()
+	if len(p.inflight) == 0 {
+		p.mu.Unlock()
+		return
+	}
+	if p.idle == nil {
+		p.idle = make(chan struct{})
+	}
+	idle := p.idle
+	p.mu.Unlock()
+	select {
+	case <-idle:
+	case <-time.After(timeout):
+	case <-cancel:
+	}
+}
+
+// stuckCalls returns the calls that have been in flight for longer than d.
+func (p *Plugin) stuckCalls(d time.Duration) []StuckCall {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var stuck []StuckCall
+	for _, c := range p.inflight {
+		if elapsed := time.Since(c.started); elapsed > d {
+			stuck = append(stuck, StuckCall{Method: c.method, Elapsed: elapsed})
+		}
+	}
+	return stuck
+}
+
+// reaper waits on a process exactly once, so that its exit can be observed by
+// any number of goroutines.  It satisfies osProcess, so it can stand in for the
+// process it wraps in an ioPipe.
+type reaper struct {
+	osProcess
+	done  chan struct{}
+	state *os.ProcessState
+	err   error
+	// stopping records that the host has begun stopping the process.
+	stopping atomic.Bool
+}
+
+// newReaper returns a reaper that starts waiting on proc immediately.
+func newReaper(proc osProcess) *reaper {
+	r := &reaper{osProcess: proc, done: make(chan struct{})}
+	go func() {
+		r.state, r.err = proc.Wait()
+		close(r.done)
+	}()
+	return r
+}
+
+// Wait blocks until the process has exited, and returns the result of waiting
+// on it.
+func (r *reaper) Wait() (*os.ProcessState, error) {
+	<-r.done
+	return r.state, r.err
+}
+
+// Signal sends sig to the process, unless it has already exited.
+func (r *reaper) Signal(sig os.Signal) error {
+	select {
+	case <-r.done:
+		return nil
+	default:
+		return r.osProcess.Signal(sig)
+	}
+}
+
+// Kill kills the process, unless it has already exited.
+func (r *reaper) Kill() error {
+	select {
+	case <-r.done:
+		return nil
+	default:
+		return r.osProcess.Kill()
+	}
+}
@@ -0,0 +1,189 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+var _ osProcess = &reaper{}
+
+func TestStartPlugin(t *testing.T) {
+	p := startHelper(t, "provider", os.Stderr)
+	defer p.Close()
+
+	var response string
+	if err := p.Call("api.SayHi", "bob", &response); err != nil {
+		t.Fatalf("Unexpected error from Call: %#v", err)
+	}
+	if response != "Hi bob" {
+		t.Errorf("Wrong response from api call, expected %q, got %q", "Hi bob", response)
+	}
+	if err := p.Ping(); err != nil {
+		t.Errorf("Unexpected error from Ping: %#v", err)
+	}
+	if err := p.Close(); err != nil {
+		t.Errorf("Unexpected error from Close: %#v", err)
+	}
+	select {
+	case <-p.Exited():
+	case <-time.After(time.Second):
+		t.Fatal("Plugin process did not exit after Close")
+	}
+}
+
+func TestStartPluginContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, err := StartPluginContext(ctx, os.Stderr, os.Args[0], helperArgs("provider"))
+	if err != nil {
+		t.Fatalf("Unexpected error from StartPluginContext: %#v", err)
+	}
+	var response string
+	if err := p.Call("api.SayHi", "bob", &response); err != nil {
+		t.Fatalf("Unexpected error from Call: %#v", err)
+	}
+	cancel()
+	select {
+	case <-p.Exited():
+	case <-time.After(5 * time.Second):
+		p.Close()
+		t.Fatal("Plugin process did not exit after its context was cancelled")
+	}
+}
+
+func TestStartPluginContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := StartPluginContext(ctx, os.Stderr, os.Args[0], helperArgs("provider")); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %#v", err)
+	}
+}
+
+func TestStartPluginContextNotReady(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := StartPluginContext(ctx, os.Stderr, os.Args[0], helperArgs("deaf"),
+		WithTimeouts(Timeouts{Stop: 10 * time.Millisecond}))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded from a plugin that never answers, got %#v", err)
+	}
+}
+
+func TestStartProviderContext(t *testing.T) {
+	client, err := StartProviderContext(context.Background(), os.Stderr, os.Args[0], helperArgs("provider")...)
+	if err != nil {
+		t.Fatalf("Unexpected error from StartProviderContext: %#v", err)
+	}
+	defer client.Close()
+	var response string
+	if err := client.Call("api.SayHi", "bob", &response); err != nil {
+		t.Fatalf("Unexpected error from Call: %#v", err)
+	}
+	if response != "Hi bob" {
+		t.Errorf("Wrong response from api call, expected %q, got %q", "Hi bob", response)
+	}
+}
+
+func TestStartPluginCodec(t *testing.T) {
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+	s := Server{server: rpc.NewServer(), rwc: newRWCloser(stdinR, stdoutW)}
+	s.RegisterName("api", api{})
+	go s.ServeCodec(jsonrpc.NewServerCodec)
+
+	f := &fakeCmdData{stdout: stdoutR, stdin: stdinW, p: &proc{}}
+	old := makeCommand
+	makeCommand = f.makeCommand
+	defer func() { makeCommand = old }()
+
+	p, err := StartPlugin(nil, "foo", []string{"bar"}, WithClientCodec(jsonrpc.NewClientCodec))
+	if err != nil {
+		t.Fatalf("Unexpected error from StartPlugin: %#v", err)
+	}
+	var response string
+	if err := p.Call("api.SayHi", "bob", &response); err != nil {
+		t.Fatalf("Unexpected error from Call: %#v", err)
+	}
+	if response != "Hi bob" {
+		t.Errorf("Wrong response from api call, expected %q, got %q", "Hi bob", response)
+	}
+	if err := p.Close(); err != nil {
+		t.Errorf("Unexpected error from Close: %#v", err)
+	}
+}
+
+func TestPluginExited(t *testing.T) {
+	p := startHelper(t, "exit", nil)
+	defer p.Close()
+	select {
+	case <-p.Exited():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for plugin to exit")
+	}
+	if p.ExitErr() != nil {
+		t.Errorf("Unexpected error waiting on exited plugin: %#v", p.ExitErr())
+	}
+}
+
+func TestPluginStuckCalls(t *testing.T) {
+	p := startHelper(t, "provider", nil)
+	defer p.Close()
+	go p.Call("helper.Block", 0, new(int))
+	time.Sleep(50 * time.Millisecond)
+	stuck := p.stuckCalls(10 * time.Millisecond)
+	if len(stuck) != 1 {
+		t.Fatalf("Expected 1 stuck call, got %#v", stuck)
+	}
+	if stuck[0].Method != "helper.Block" {
+		t.Errorf("Wrong method for stuck call, expected %q, got %q", "helper.Block", stuck[0].Method)
+	}
+	if stuck := p.stuckCalls(time.Hour); len(stuck) != 0 {
+		t.Errorf("Expected no calls stuck for an hour, got %#v", stuck)
+	}
+}
+
+func TestReaperAfterExit(t *testing.T) {
+	p := &proc{}
+	r := newReaper(p)
+	<-r.done
+	if err := r.Signal(os.Interrupt); err != nil {
+		t.Errorf("Unexpected error signalling exited process: %#v", err)
+	}
+	if p.sig != nil {
+		t.Errorf("Exited process was unexpectedly signalled with %#v", p.sig)
+	}
+	if err := r.Kill(); err != nil {
+		t.Errorf("Unexpected error killing exited process: %#v", err)
+	}
+	if p.killed {
+		t.Error("Exited process was unexpectedly killed")
+	}
+}
+
+func TestPluginFinalizer(t *testing.T) {
+	exited := func() <-chan struct{} {
+		p, err := StartPlugin(os.Stderr, os.Args[0], helperArgs("provider"), WithFinalizer())
+		if err != nil {
+			t.Fatalf("Unexpected error starting helper plugin: %#v", err)
+		}
+		return p.Exited()
+	}()
+	deadline := time.After(5 * time.Second)
+	for {
+		runtime.GC()
+		select {
+		case <-exited:
+			return
+		case <-deadline:
+			t.Fatal("Leaked plugin was not killed by its finalizer")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package pie
+
+import (
+	"context"
+	"net/rpc"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// PoolOptions configures a Pool.
+type PoolOptions struct {
+	// MaxOpen is the most connections the pool has open at once.  Calls made
+	// while that many are busy wait for one to be free.  It defaults to
+	// GOMAXPROCS.
+	MaxOpen int
+	// MaxIdle is the most idle connections the pool keeps for later calls.
+	// It defaults to 2, and is at most MaxOpen.
+	MaxIdle int
+	// MaxLifetime is how long a connection may be reused after it was made.
+	// Older connections are closed once their call returns.  If it is zero,
+	// connections are reused for as long as they work.
+	MaxLifetime time.Duration
+	// HealthCheckAfter is how long a connection may sit idle before it is
+	// pinged before being reused, so that a call is not lost to a connection
+	// that broke while no one was using it.  It defaults to 10 seconds, and
+	// health checks are disabled if it is negative.
+	HealthCheckAfter time.Duration
+}
+
+func (o PoolOptions) maxOpen() int {
+	if o.MaxOpen > 0 {
+		return o.MaxOpen
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+func (o PoolOptions) maxIdle() int {
+	n := 2
+	if o.MaxIdle > 0 {
+		n = o.MaxIdle
+	}
+	if max := o.maxOpen(); n > max {
+		n = max
+	}
+	return n
+}
+
+func (o PoolOptions) healthCheckAfter() time.Duration {
+	if o.HealthCheckAfter != 0 {
+		return o.HealthCheckAfter
+	}
+	return 10 * time.Second
+}
+
+// PoolStats describes the connections of a Pool.
+type PoolStats struct {
+	// Open is the number of connections open, of which Idle are not in use.
+	Open int
+	Idle int
+	// Dials is the number of connections made, and Discards the number
+	// closed because they broke, failed a health check, or outlived
+	// MaxLifetime.
+	Dials    uint64
+	Discards uint64
+}
+
+// Pool makes calls to a plugin served at a network address, such as by a
+// Daemon, over a pool of connections, so that calls made at once are spread
+// over several connections instead of queueing behind one.  Each connection
+// is a handle made by DialPlugin, used by one call at a time.  Connections
+// that break are replaced: a call that fails because its connection was
+// already shut down is retried once on a new one, since the plugin never saw
+// it, but calls that fail after being sent are not retried.  It is safe for
+// concurrent use.
+type Pool struct {
+	network, address string
+	opts             PoolOptions
+	startOpts        []StartOption
+	// slots holds a token for each connection in use or being made.
+	slots chan struct{}
+
+	mu       sync.Mutex
+	idle     []*pooledConn
+	open     int
+	dials    uint64
+	discards uint64
+	closed   bool
+}
+
+// pooledConn is a connection of a Pool.
+type pooledConn struct {
+	p        *Plugin
+	created  time.Time
+	lastUsed time.Time
+}
+
+// NewPool returns a Pool of connections to the plugin at address on the named
+// network, made with DialPlugin and the given start options.  No connections
+// are made until the first call.
+func NewPool(network, address string, opts PoolOptions, startOpts ...StartOption) *Pool {
+	return &Pool{
+		network:   network,
+		address:   address,
+		opts:      opts,
+		startOpts: startOpts,
+		slots:     make(chan struct{}, opts.maxOpen()),
+	}
+}
+
+// Call invokes the named function on the plugin over one of the pool's
+// connections, waiting for one to be free if MaxOpen are in use.  It returns
+// rpc.ErrShutdown once the pool is closed.
+func (pl *Pool) Call(serviceMethod string, args interface{}, reply interface{}) error {
+	for retried := false; ; retried = true {
+		c, err := pl.get()
+		if err != nil {
+			return err
+		}
+		err = c.p.Call(serviceMethod, args, reply)
+		if !pl.broken(c) {
+			pl.put(c)
+			return err
+		}
+		pl.discard(c)
+		if err != rpc.ErrShutdown || retried {
+			return err
+		}
+	}
+}
+
+// get returns a connection for a call, reusing an idle one if it is still
+// good, and dialing a new one otherwise.
+func (pl *Pool) get() (*pooledConn, error) {
+	pl.slots <- struct{}{}
+	pl.mu.Lock()
+	for !pl.closed && len(pl.idle) > 0 {
+		c := pl.idle[len(pl.idle)-1]
+		pl.idle = pl.idle[:len(pl.idle)-1]
+		pl.mu.Unlock()
+		if pl.healthy(c) {
+			return c, nil
+		}
+		pl.drop(c)
+		pl.mu.Lock()
+	}
+	if pl.closed {
+		pl.mu.Unlock()
+		<-pl.slots
+		return nil, rpc.ErrShutdown
+	}
+	pl.open++
+	pl.dials++
+	pl.mu.Unlock()
+	p, err := DialPlugin(context.Background(), pl.network, pl.address, pl.startOpts...)
+	if err != nil {
+		pl.mu.Lock()
+		pl.open--
+		pl.mu.Unlock()
+		<-pl.slots
+		return nil, err
+	}
+	now := time.Now()
+	return &pooledConn{p: p, created: now, lastUsed: now}, nil
+}
+
+// healthy reports whether the idle connection c can be reused, pinging it if
+// it has been idle for long.
+func (pl *Pool) healthy(c *pooledConn) bool {
+	if pl.broken(c) {
+		return false
+	}
+	if after := pl.opts.healthCheckAfter(); after > 0 && time.Since(c.lastUsed) > after {
+		return c.p.Ping() == nil
+	}
+	return true
+}
+
+// broken reports whether c has failed, or outlived the pool's MaxLifetime.
+func (pl *Pool) broken(c *pooledConn) bool {
+	select {
+	case <-c.p.Exited():
+		return true
+	default:
+	}
+	return pl.opts.MaxLifetime > 0 && time.Since(c.created) > pl.opts.MaxLifetime
+}
+
+// put returns c to the pool after a call, keeping it for later calls if
+// there is room.
+func (pl *Pool) put(c *pooledConn) {
+	c.lastUsed = time.Now()
+	pl.mu.Lock()
+	if pl.closed || len(pl.idle) >= pl.opts.maxIdle() {
+		pl.open--
+		pl.mu.Unlock()
+		c.p.Close()
+	} else {
+		pl.idle = append(pl.idle, c)
+		pl.mu.Unlock()
+	}
+	<-pl.slots
+}
+
+// discard closes c, which is in use, and frees its slot.
+func (pl *Pool) discard(c *pooledConn) {
+	pl.drop(c)
+	<-pl.slots
+}
+
+// drop closes c, counting it as discarded.
+func (pl *Pool) drop(c *pooledConn) {
+	c.p.Close()
+	pl.mu.Lock()
+	pl.open--
+	pl.discards++
+	pl.mu.Unlock()
+}
+
+// Stats returns the pool's statistics.
+func (pl *Pool) Stats() PoolStats {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	return PoolStats{
+		Open:     pl.open,
+		Idle:     len(pl.idle),
+		Dials:    pl.dials,
+		Discards: pl.discards,
+	}
+}
+
+// Close closes the pool's idle connections, and the ones in use once their
+// calls return.  Later calls return rpc.ErrShutdown.
+func (pl *Pool) Close() error {
+	pl.mu.Lock()
+	pl.closed = true
+	idle := pl.idle
+	pl.idle = nil
+	pl.open -= len(idle)
+	pl.mu.Unlock()
+	for _, c := range idle {
+		c.p.Close()
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package pie
+
+import (
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+)
+
+// poolAPI is served to pools in tests.
+type poolAPI struct {
+	// started is sent a value by each call to Wait, which returns once
+	// release is closed.
+	started chan struct{}
+	release chan struct{}
+}
+
+func (a poolAPI) Wait(_ int, _ *int) error {
+	a.started <- struct{}{}
+	<-a.release
+	return nil
+}
+
+// poolServer serves api and poolAPI on a loopback address, returning the
+// address and a function that breaks all the connections made so far.
+func poolServer(t *testing.T, pa poolAPI) (string, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			s := NewProviderConn(conn)
+			s.RegisterName("api", api{})
+			s.RegisterName("pool", pa)
+			go s.Serve()
+		}
+	}()
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+	return ln.Addr().String(), func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+		conns = nil
+	}
+}
+
+func TestPoolConcurrentCalls(t *testing.T) {
+	pa := poolAPI{started: make(chan struct{}), release: make(chan struct{})}
+	addr, _ := poolServer(t, pa)
+	pl := NewPool("tcp", addr, PoolOptions{MaxOpen: 3, MaxIdle: 2})
+	defer pl.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := pl.Call("pool.Wait", 0, new(int)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		<-pa.started
+	}
+	if st := pl.Stats(); st.Open != 3 || st.Idle != 0 {
+		t.Errorf("Expected 3 busy connections, got %+v", st)
+	}
+	select {
+	case <-pa.started:
+		t.Error("Expected the fourth call to wait for a free connection")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(pa.release)
+	<-pa.started
+	wg.Wait()
+	if st := pl.Stats(); st.Open != 2 || st.Idle != 2 || st.Dials != 3 {
+		t.Errorf("Expected 2 idle connections of 3 made, got %+v", st)
+	}
+}
+
+func TestPoolReplacesBrokenConnections(t *testing.T) {
+	addr, breakAll := poolServer(t, poolAPI{})
+	pl := NewPool("tcp", addr, PoolOptions{})
+	defer pl.Close()
+	var reply string
+	if err := pl.Call("api.SayHi", "pool", &reply); err != nil {
+		t.Fatal(err)
+	}
+	exited := pl.idle[0].p.Exited()
+	breakAll()
+	<-exited
+	if err := pl.Call("api.SayHi", "again", &reply); err != nil {
+		t.Fatalf("Expected the broken connection to be replaced, got %v", err)
+	}
+	if reply != "Hi again" {
+		t.Errorf("Expected Hi again, got %q", reply)
+	}
+	if st := pl.Stats(); st.Dials != 2 || st.Discards != 1 || st.Open != 1 {
+		t.Errorf("Expected one connection replaced, got %+v", st)
+	}
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	addr, _ := poolServer(t, poolAPI{})
+	pl := NewPool("tcp", addr, PoolOptions{HealthCheckAfter: time.Nanosecond})
+	defer pl.Close()
+	if err := pl.Call("api.SayHi", "pool", new(string)); err != nil {
+		t.Fatal(err)
+	}
+	// Pinging a working connection keeps it.
+	time.Sleep(time.Millisecond)
+	if err := pl.Call("api.SayHi", "pool", new(string)); err != nil {
+		t.Fatal(err)
+	}
+	if st := pl.Stats(); st.Dials != 1 {
+		t.Errorf("Expected the healthy connection to be reused, got %+v", st)
+	}
+}
+
+func TestPoolMaxLifetime(t *testing.T) {
+	addr, _ := poolServer(t, poolAPI{})
+	pl := NewPool("tcp", addr, PoolOptions{MaxLifetime: 50 * time.Millisecond})
+	defer pl.Close()
+	for i := 0; i < 2; i++ {
+		if err := pl.Call("api.SayHi", "pool", new(string)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if st := pl.Stats(); st.Dials != 2 || st.Discards != 1 {
+		t.Errorf("Expected the expired connection to be replaced, got %+v", st)
+	}
+}
+
+func TestPoolClose(t *testing.T) {
+	addr, _ := poolServer(t, poolAPI{})
+	pl := NewPool("tcp", addr, PoolOptions{})
+	if err := pl.Call("api.SayHi", "pool", new(string)); err != nil {
+		t.Fatal(err)
+	}
+	p := pl.idle[0].p
+	pl.Close()
+	select {
+	case <-p.Exited():
+	case <-time.After(5 * time.Second):
+		t.Error("Expected closing the pool to close its idle connections")
+	}
+	if err := pl.Call("api.SayHi", "pool", new(string)); err != rpc.ErrShutdown {
+		t.Errorf("Expected rpc.ErrShutdown, got %v", err)
+	}
+	if st := pl.Stats(); st.Open != 0 {
+		t.Errorf("Expected no open connections, got %+v", st)
+	}
+}
+
+func TestPoolDialError(t *testing.T) {
+	pl := NewPool("tcp", freeAddr(t), PoolOptions{MaxOpen: 1})
+	defer pl.Close()
+	for i := 0; i < 2; i++ {
+		if err := pl.Call("api.SayHi", "pool", new(string)); err == nil {
+			t.Fatal("Expected an error dialing nothing")
+		}
+	}
+}
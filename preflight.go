@@ -0,0 +1,264 @@
+package pie
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+)
+
+// PreflightReason identifies why a plugin binary failed preflight validation.
+type PreflightReason int
+
+const (
+	// PreflightNotFound means there is no file at the plugin's path, or the
+	// plugin's name could not be found in $PATH.
+	PreflightNotFound PreflightReason = iota
+	// PreflightNotRegular means the plugin's path is a directory or other
+	// non-regular file.
+	PreflightNotRegular
+	// PreflightNotExecutable means the plugin's file does not have any execute
+	// permission bits set.
+	PreflightNotExecutable
+	// PreflightWrongPlatform means the plugin is a binary built for a
+	// different operating system or architecture than the host.
+	PreflightWrongPlatform
+	// PreflightNoShebang means the plugin is neither a recognized binary
+	// format nor a script starting with #!.
+	PreflightNoShebang
+)
+
+var preflightReasonNames = [...]string{
+	PreflightNotFound:      "not found",
+	PreflightNotRegular:    "not a regular file",
+	PreflightNotExecutable: "not executable",
+	PreflightWrongPlatform: "built for another platform",
+	PreflightNoShebang:     "not a binary or a script with a #! line",
+}
+
+// String returns a short, human readable description of the reason.
+func (r PreflightReason) String() string {
+	if r >= 0 && int(r) < len(preflightReasonNames) {
+		return preflightReasonNames[r]
+	}
+	return fmt.Sprintf("PreflightReason(%d)", int(r))
+}
+
+// PreflightError is returned by Preflight, and by StartPlugin when used with
+// WithPreflight, when a plugin binary could not possibly be run.
+type PreflightError struct {
+	Path   string
+	Reason PreflightReason
+	// Detail, if not empty, gives more information about the failure, such as
+	// the platform a binary was built for.
+	Detail string
+	// Err is the underlying error, if any.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *PreflightError) Error() string {
+	msg := fmt.Sprintf("plugin %s: %s", e.Path, e.Reason)
+	if e.Detail != "" {
+		msg += " (" + e.Detail + ")"
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the underlying error, if any.
+func (e *PreflightError) Unwrap() error {
+	return e.Err
+}
+
+// WithPreflight makes StartPlugin validate the plugin binary with Preflight
+// before running it, so that problems which would otherwise surface as vague
+// exec failures or hangs are reported as a *PreflightError.
+func WithPreflight() StartOption {
+	return func(o *startOptions) {
+		o.preflight = true
+	}
+}
+
+// Preflight checks that the plugin at path can be run on this machine: that it
+// exists, is an executable regular file, and is either a binary for the host's
+// operating system and architecture or a script with a #! line.  If path
+// contains no path separators, it is looked up in $PATH as exec.Command would.
+// Failures are returned as a *PreflightError.
+func Preflight(path string) error {
+	resolved := path
+	if filepath.Base(path) == path {
+		lp, err := exec.LookPath(path)
+		if err != nil {
+			return &PreflightError{Path: path, Reason: PreflightNotFound, Err: err}
+		}
+		resolved = lp
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return &PreflightError{Path: path, Reason: PreflightNotFound, Err: err}
+	}
+	if !info.Mode().IsRegular() {
+		return &PreflightError{Path: path, Reason: PreflightNotRegular, Detail: info.Mode().String()}
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0111 == 0 {
+		return &PreflightError{Path: path, Reason: PreflightNotExecutable, Detail: info.Mode().String()}
+	}
+	f, err := os.Open(resolved)
+	if err != nil {
+		return &PreflightError{Path: path, Reason: PreflightNotExecutable, Err: err}
+	}
+	defer f.Close()
+	goos, goarch, err := binaryPlatform(f)
+	if err != nil {
+		return &PreflightError{Path: path, Reason: PreflightWrongPlatform, Err: err}
+	}
+	switch {
+	case goos == "script":
+		return nil
+	case goos == "":
+		return &PreflightError{Path: path, Reason: PreflightNoShebang}
+	case !platformMatches(goos, goarch):
+		return &PreflightError{
+			Path:   path,
+			Reason: PreflightWrongPlatform,
+			Detail: fmt.Sprintf("%s/%s binary, host is %s/%s", goos, goarch, runtime.GOOS, runtime.GOARCH),
+		}
+	}
+	return nil
+}
+
+// platformMatches reports whether a binary with the given os and arch, as
+// returned by binaryPlatform, can run on this machine.
+func platformMatches(goos, goarch string) bool {
+	if goarch != "" && goarch != runtime.GOARCH {
+		return false
+	}
+	switch goos {
+	case "darwin":
+		return runtime.GOOS == "darwin" || runtime.GOOS == "ios"
+	case "windows":
+		return runtime.GOOS == "windows"
+	default:
+		// ELF doesn't reliably record which OS a binary is for, so accept it
+		// on any OS that uses ELF.
+		return runtime.GOOS != "darwin" && runtime.GOOS != "ios" &&
+			runtime.GOOS != "windows" && runtime.GOOS != "plan9"
+	}
+}
+
+// binaryPlatform identifies the format of the executable in f.  For binaries it
+// returns the operating system family ("elf", "darwin", or "windows") and the
+// architecture as a GOARCH value, or an empty architecture for multi-arch
+// binaries that include the host's architecture.  For scripts it returns
+// "script".  If the format is not recognized, it returns an empty os.
+func binaryPlatform(f io.ReaderAt) (goos, goarch string, err error) {
+	magic := make([]byte, 4)
+	if _, err := f.ReadAt(magic, 0); err != nil && err != io.EOF {
+		return "", "", err
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte("#!")):
+		return "script", "", nil
+	case bytes.Equal(magic, []byte(elf.ELFMAG)):
+		ef, err := elf.NewFile(f)
+		if err != nil {
+			return "", "", err
+		}
+		return "elf", elfArch(ef), nil
+	case bytes.HasPrefix(magic, []byte("MZ")):
+		pf, err := pe.NewFile(f)
+		if err != nil {
+			return "", "", err
+		}
+		return "windows", peArch(pf.Machine), nil
+	}
+	if ff, err := macho.NewFatFile(f); err == nil {
+		for _, a := range ff.Arches {
+			if machoArch(a.Cpu) == runtime.GOARCH {
+				return "darwin", "", nil
+			}
+		}
+		return "darwin", machoArch(ff.Arches[0].Cpu), nil
+	}
+	if mf, err := macho.NewFile(f); err == nil {
+		return "darwin", machoArch(mf.Cpu), nil
+	}
+	return "", "", nil
+}
+
+// elfArch returns the GOARCH value for an ELF binary's machine type.
+func elfArch(f *elf.File) string {
+	le := f.ByteOrder == binary.LittleEndian
+	switch f.Machine {
+	case elf.EM_X86_64:
+		return "amd64"
+	case elf.EM_386:
+		return "386"
+	case elf.EM_AARCH64:
+		return "arm64"
+	case elf.EM_ARM:
+		return "arm"
+	case elf.EM_RISCV:
+		return "riscv64"
+	case elf.EM_PPC64:
+		if le {
+			return "ppc64le"
+		}
+		return "ppc64"
+	case elf.EM_S390:
+		return "s390x"
+	case elf.EM_LOONGARCH:
+		return "loong64"
+	case elf.EM_MIPS:
+		switch {
+		case f.Class == elf.ELFCLASS64 && le:
+			return "mips64le"
+		case f.Class == elf.ELFCLASS64:
+			return "mips64"
+		case le:
+			return "mipsle"
+		}
+		return "mips"
+	}
+	return f.Machine.String()
+}
+
+// peArch returns the GOARCH value for a PE binary's machine type.
+func peArch(machine uint16) string {
+	switch machine {
+	case pe.IMAGE_FILE_MACHINE_AMD64:
+		return "amd64"
+	case pe.IMAGE_FILE_MACHINE_I386:
+		return "386"
+	case pe.IMAGE_FILE_MACHINE_ARM64:
+		return "arm64"
+	case pe.IMAGE_FILE_MACHINE_ARMNT:
+		return "arm"
+	}
+	return fmt.Sprintf("machine %#x", machine)
+}
+
+// machoArch returns the GOARCH value for a Mach-O binary's CPU type.
+func machoArch(cpu macho.Cpu) string {
+	switch cpu {
+	case macho.CpuAmd64:
+		return "amd64"
+	case macho.CpuArm64:
+		return "arm64"
+	case macho.Cpu386:
+		return "386"
+	case macho.CpuArm:
+		return "arm"
+	}
+	return cpu.String()
+}
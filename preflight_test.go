@@ -0,0 +1,98 @@
+package pie
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestPreflight(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte, perm os.FileMode) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, perm); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	otherArch := elf.EM_X86_64
+	if runtime.GOARCH == "amd64" {
+		otherArch = elf.EM_AARCH64
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		ok     bool
+		reason PreflightReason
+		unix   bool
+	}{
+		{name: "test binary", path: os.Args[0], ok: true},
+		{name: "missing", path: filepath.Join(dir, "missing"), reason: PreflightNotFound},
+		{name: "not in PATH", path: "pie-no-such-plugin", reason: PreflightNotFound},
+		{name: "directory", path: dir, reason: PreflightNotRegular},
+		{name: "script", path: write("script", []byte("#!/bin/sh\necho hi\n"), 0755), ok: true, unix: true},
+		{name: "not executable", path: write("noexec", []byte("#!/bin/sh\n"), 0644), reason: PreflightNotExecutable, unix: true},
+		{name: "no shebang", path: write("noshebang", []byte("echo hi\n"), 0755), reason: PreflightNoShebang, unix: true},
+		{name: "empty", path: write("empty", nil, 0755), reason: PreflightNoShebang, unix: true},
+		{name: "wrong arch", path: write("wrongarch", fakeELF(otherArch), 0755), reason: PreflightWrongPlatform, unix: true},
+	}
+	for _, test := range tests {
+		if test.unix && runtime.GOOS == "windows" {
+			continue
+		}
+		err := Preflight(test.path)
+		if test.ok {
+			if err != nil {
+				t.Errorf("%s: unexpected error from Preflight: %s", test.name, err)
+			}
+			continue
+		}
+		var perr *PreflightError
+		if !errors.As(err, &perr) {
+			t.Errorf("%s: expected *PreflightError, got %#v", test.name, err)
+			continue
+		}
+		if perr.Reason != test.reason {
+			t.Errorf("%s: wrong reason, expected %q, got %q", test.name, test.reason, perr.Reason)
+		}
+		if perr.Path != test.path {
+			t.Errorf("%s: wrong path in error, expected %q, got %q", test.name, test.path, perr.Path)
+		}
+	}
+}
+
+func TestStartPluginWithPreflight(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing")
+	_, err := StartPlugin(nil, path, nil, WithPreflight())
+	var perr *PreflightError
+	if !errors.As(err, &perr) {
+		t.Fatalf("Expected *PreflightError from StartPlugin, got %#v", err)
+	}
+	if perr.Reason != PreflightNotFound {
+		t.Errorf("Wrong reason, expected %q, got %q", PreflightNotFound, perr.Reason)
+	}
+}
+
+// fakeELF returns the header of a little endian 64 bit ELF executable for the
+// given machine.
+func fakeELF(machine elf.Machine) []byte {
+	h := elf.Header64{
+		Type:    uint16(elf.ET_EXEC),
+		Machine: uint16(machine),
+		Version: uint32(elf.EV_CURRENT),
+		Ehsize:  64,
+	}
+	copy(h.Ident[:], elf.ELFMAG)
+	h.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	h.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	h.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, h)
+	return buf.Bytes()
+}
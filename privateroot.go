@@ -0,0 +1,83 @@
+package pie
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+// ErrPrivateRootUnsupported is returned by StartPlugin on platforms that
+// cannot run plugins in a private root, as WithPrivateRoot asks.
+var ErrPrivateRootUnsupported = errors.New("pie: private roots are not supported on this platform")
+
+// RootBind grants a plugin started with WithPrivateRoot access to a file or
+// directory of the host.
+type RootBind struct {
+	// Source is the path of the file or directory in the host.
+	Source string
+	// Target is the absolute path it appears at in the plugin's root.  If
+	// empty, it is the same as Source.
+	Target string
+	// Writable lets the plugin change what it binds.  Binds are read-only
+	// otherwise.
+	Writable bool
+}
+
+// WithPrivateRoot makes StartPlugin run the plugin in a root file system of
+// its own, which holds only the plugin's executable and the files and
+// directories given by binds, so that the plugin can reach no other part of
+// the host's file system.  The plugin runs with / as its working directory
+// unless the exec.Cmd's Dir is set, which is then a path in the private root.
+// The plugin's executable is bound at its own path, read-only, but nothing
+// else is: dynamically linked plugins need binds of the libraries they load,
+// and plugins that read /etc or /proc need those bound too.  Plugin.RootBinds
+// reports what was granted.
+//
+// It is only supported on Linux, where the host must be root: the binds are
+// made in a new mount namespace, in a temporary directory that the plugin is
+// chrooted into, and that is removed once the plugin exits.  Elsewhere,
+// StartPlugin fails with ErrPrivateRootUnsupported.
+func WithPrivateRoot(binds ...RootBind) StartOption {
+	return func(o *startOptions) {
+		o.root = append(append([]RootBind{}, o.root...), binds...)
+	}
+}
+
+// RootBinds returns the paths of the host granted to a plugin started with
+// WithPrivateRoot, its executable included, or nil if the plugin shares the
+// host's root.
+func (p *Plugin) RootBinds() []RootBind {
+	if p.binds == nil {
+		return nil
+	}
+	return append([]RootBind{}, p.binds...)
+}
+
+// rootBinds returns binds with their targets filled in, and a bind for the
+// plugin's executable at path added, or an error if one is not valid.
+func rootBinds(path string, binds []RootBind) ([]RootBind, error) {
+	all := []RootBind{{Source: path}}
+	all = append(all, binds...)
+	for i := range all {
+		b := &all[i]
+		if b.Source == "" {
+			return nil, errors.New("pie: private root bind has no source")
+		}
+		source, err := filepath.Abs(b.Source)
+		if err != nil {
+			return nil, err
+		}
+		b.Source = source
+		if b.Target == "" {
+			b.Target = source
+		}
+		if !filepath.IsAbs(b.Target) {
+			return nil, fmt.Errorf("pie: private root bind target %q is not absolute", b.Target)
+		}
+		b.Target = filepath.Clean(b.Target)
+		if b.Target == "/" {
+			return nil, errors.New("pie: private root bind cannot replace the root")
+		}
+	}
+	return all, nil
+}
@@ -0,0 +1,150 @@
+//go:build linux
+
+package pie
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// privateRoot sets cmd up to run chrooted into a new temporary directory,
+// holding binds of its executable and of binds, in a new mount namespace.
+// The binds are made in the host's mount namespace, and are private, so that
+// the plugin's copies outlive them.  The function returned must be called
+// once cmd has been started, with a channel that is closed when it exits, or
+// nil if it did not start; it unmounts the binds in the host, and removes the
+// directory once the plugin is done with it.  The binds granted are returned
+// too.
+func privateRoot(cmd *exec.Cmd, binds []RootBind) (func(exited <-chan struct{}), []RootBind, error) {
+	binds, err := rootBinds(cmd.Path, binds)
+	if err != nil {
+		return nil, nil, err
+	}
+	root, err := os.MkdirTemp("", "pie-root-")
+	if err != nil {
+		return nil, nil, err
+	}
+	r := &rootDir{root: root}
+	for _, b := range binds {
+		if err := r.bind(b); err != nil {
+			r.unmount()
+			r.remove()
+			return nil, nil, fmt.Errorf("pie: cannot bind %s into the private root: %w", b.Source, err)
+		}
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNS
+	cmd.SysProcAttr.Chroot = root
+	if cmd.Dir == "" {
+		cmd.Dir = "/"
+	}
+	return func(exited <-chan struct{}) {
+		// The plugin's mount namespace keeps its copies of the binds.
+		if !r.unmount() {
+			return
+		}
+		if exited == nil {
+			r.remove()
+			return
+		}
+		// Removing the mount points would unmount the plugin's copies.
+		go func() {
+			<-exited
+			r.remove()
+		}()
+	}, binds, nil
+}
+
+// rootDir is a private root being set up in the host.
+type rootDir struct {
+	root string
+	// created are the files and directories made in root, in the order
+	// they were made, and mounted the binds mounted on them.
+	created []string
+	mounted []string
+}
+
+// bind binds b into the root.
+func (r *rootDir) bind(b RootBind) error {
+	fi, err := os.Stat(b.Source)
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(r.root, b.Target)
+	if err := r.mkdirAll(filepath.Dir(target)); err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		err = r.mkdirAll(target)
+	} else if _, err = os.Lstat(target); os.IsNotExist(err) {
+		var f *os.File
+		if f, err = os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600); err == nil {
+			f.Close()
+			r.created = append(r.created, target)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := syscall.Mount(b.Source, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return os.NewSyscallError("mount", err)
+	}
+	r.mounted = append(r.mounted, target)
+	if err := syscall.Mount("", target, "", syscall.MS_PRIVATE|syscall.MS_REC, ""); err != nil {
+		return os.NewSyscallError("mount", err)
+	}
+	if !b.Writable {
+		if err := syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+			return os.NewSyscallError("mount", err)
+		}
+	}
+	return nil
+}
+
+// mkdirAll makes dir and the directories above it, up to the root, recording
+// those it makes.
+func (r *rootDir) mkdirAll(dir string) error {
+	rel, err := filepath.Rel(r.root, dir)
+	if err != nil || rel == "." {
+		return err
+	}
+	p := r.root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		p = filepath.Join(p, part)
+		if err := os.Mkdir(p, 0o755); err == nil {
+			r.created = append(r.created, p)
+		} else if !os.IsExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// unmount detaches the binds from the host's mount namespace, and reports
+// whether all of them were.
+func (r *rootDir) unmount() bool {
+	ok := true
+	for i := len(r.mounted) - 1; i >= 0; i-- {
+		if err := syscall.Unmount(r.mounted[i], syscall.MNT_DETACH); err != nil {
+			ok = false
+		}
+	}
+	r.mounted = nil
+	return ok
+}
+
+// remove removes what was made in the root, and the root.  It only removes
+// empty directories, so that nothing of the host is lost should a bind still
+// be mounted.
+func (r *rootDir) remove() {
+	for i := len(r.created) - 1; i >= 0; i-- {
+		os.Remove(r.created[i])
+	}
+	os.Remove(r.root)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package pie
+
+import "os/exec"
+
+// privateRoot is not supported on this platform.
+func privateRoot(cmd *exec.Cmd, binds []RootBind) (func(exited <-chan struct{}), []RootBind, error) {
+	return nil, nil, ErrPrivateRootUnsupported
+}
@@ -0,0 +1,102 @@
+package pie
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPrivateRoot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("private roots need root")
+	}
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	data := t.TempDir()
+	if err := os.WriteFile(filepath.Join(data, "greeting"), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("hidden"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// The helper is the test binary, which may be dynamically linked.
+	var binds []RootBind
+	for _, dir := range []string{"/lib", "/lib64", "/usr/lib", "/usr/lib64"} {
+		if _, err := os.Stat(dir); err == nil {
+			binds = append(binds, RootBind{Source: dir})
+		}
+	}
+	binds = append(binds, RootBind{Source: data, Target: "/data"})
+	p, err := StartPlugin(os.Stderr, os.Args[0], helperArgs("provider"), WithPrivateRoot(binds...))
+	if errors.Is(err, ErrPrivateRootUnsupported) {
+		t.Skip("private roots are not supported on this platform")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got string
+	if err := p.Call("helper.ReadFile", "/data/greeting", &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != "hello" {
+		t.Errorf("Expected hello, got %q", got)
+	}
+	if err := p.Call("helper.ReadFile", secret, &got); err == nil {
+		t.Errorf("Expected the plugin not to read a file outside its root, got %q", got)
+	}
+	granted := p.RootBinds()
+	if len(granted) != len(binds)+1 || granted[len(granted)-1] != (RootBind{Source: data, Target: "/data"}) {
+		t.Errorf("Expected the binds granted to be reported, got %+v", granted)
+	}
+	if exe, _ := filepath.Abs(os.Args[0]); granted[0].Source != exe {
+		t.Errorf("Expected the plugin's executable to be bound first, got %+v", granted[0])
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The root is removed once the plugin exits.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		entries, _ := os.ReadDir(tmp)
+		if len(entries) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the private root to be removed, found %v", entries)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if b, err := os.ReadFile(filepath.Join(data, "greeting")); err != nil || string(b) != "hello" {
+		t.Errorf("Expected the bound directory to be left alone, got %q, %v", b, err)
+	}
+}
+
+func TestRootBinds(t *testing.T) {
+	binds, err := rootBinds("/bin/plugin", []RootBind{{Source: "/srv/data", Target: "/data/"}, {Source: "/etc/ssl", Writable: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RootBind{
+		{Source: "/bin/plugin", Target: "/bin/plugin"},
+		{Source: "/srv/data", Target: "/data"},
+		{Source: "/etc/ssl", Target: "/etc/ssl", Writable: true},
+	}
+	if len(binds) != len(want) {
+		t.Fatalf("Expected %+v, got %+v", want, binds)
+	}
+	for i := range want {
+		if binds[i] != want[i] {
+			t.Errorf("Expected %+v, got %+v", want[i], binds[i])
+		}
+	}
+	for _, bad := range []RootBind{{}, {Source: "/srv", Target: "srv"}, {Source: "/srv", Target: "/"}} {
+		if _, err := rootBinds("/bin/plugin", []RootBind{bad}); err == nil {
+			t.Errorf("Expected an error for %+v", bad)
+		}
+	}
+}
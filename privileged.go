@@ -0,0 +1,127 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrCapabilitiesUnsupported is returned by StartPlugin on platforms that
+// cannot grant plugins capabilities, as WithCapabilities asks.
+var ErrCapabilitiesUnsupported = errors.New("pie: capabilities are not supported on this platform")
+
+// WithCapabilities makes StartPlugin grant the plugin the named Linux
+// capabilities, such as "CAP_NET_BIND_SERVICE" or "net_admin", as ambient
+// capabilities, which the plugin keeps though it runs as the host's user.
+// The host must hold the capabilities in its permitted set itself, as root
+// does, or as a binary given them with setcap does, each time it starts a
+// plugin; otherwise the plugin fails to start.  A host that holds
+// capabilities for the sake of one task can pass them to the plugin that does
+// it, and clear them from its own effective set, but cannot drop them
+// altogether while it still starts such plugins.
+//
+// It is only supported on Linux.  Elsewhere, StartPlugin fails with
+// ErrCapabilitiesUnsupported.
+func WithCapabilities(names ...string) StartOption {
+	return func(o *startOptions) {
+		o.capabilities = append(append([]string{}, o.capabilities...), names...)
+	}
+}
+
+// capabilityNames are the names of the Linux capabilities, indexed by number.
+var capabilityNames = []string{
+	"chown", "dac_override", "dac_read_search", "fowner", "fsetid", "kill",
+	"setgid", "setuid", "setpcap", "linux_immutable", "net_bind_service",
+	"net_broadcast", "net_admin", "net_raw", "ipc_lock", "ipc_owner",
+	"sys_module", "sys_rawio", "sys_chroot", "sys_ptrace", "sys_pacct",
+	"sys_admin", "sys_boot", "sys_nice", "sys_resource", "sys_time",
+	"sys_tty_config", "mknod", "lease", "audit_write", "audit_control",
+	"setfcap", "mac_override", "mac_admin", "syslog", "wake_alarm",
+	"block_suspend", "audit_read", "perfmon", "bpf", "checkpoint_restore",
+}
+
+// capabilityNumbers returns the numbers of the named capabilities, or an error
+// if one is not known.
+func capabilityNumbers(names []string) ([]uintptr, error) {
+	caps := make([]uintptr, 0, len(names))
+	for _, name := range names {
+		n := strings.TrimPrefix(strings.ToLower(name), "cap_")
+		i := 0
+		for i < len(capabilityNames) && capabilityNames[i] != n {
+			i++
+		}
+		if i == len(capabilityNames) {
+			return nil, fmt.Errorf("pie: unknown capability %q", name)
+		}
+		caps = append(caps, uintptr(i))
+	}
+	return caps, nil
+}
+
+// Privileged is an operation that a program runs in a helper process of its
+// own, so that the privileges the operation needs, such as those granted by
+// WithCapabilities, are used by a process that does nothing else.  The helper
+// is the host's own executable, started as StartSelf starts it, and each Run
+// starts a helper, makes a single call, and stops it again.
+//
+// Since each Run starts a new helper, the host must still be able to grant it
+// the privileges then: with WithCapabilities, the host must keep holding the
+// capabilities in its permitted set, and a host that drops them fails every
+// later Run.  Privileged does not raise privileges the host does not have; it
+// does not start the helper as root for a host that is not.
+//
+// Privileged operations are created by NewPrivileged, when the program is
+// initialized, and need RunPluginMain to be called at the start of main.
+type Privileged[A, R any] struct {
+	name string
+	opts []StartOption
+}
+
+// privilegedService serves a privileged operation in its helper.
+type privilegedService[A, R any] struct {
+	op func(context.Context, A) (R, error)
+}
+
+// Run runs the operation.
+func (s privilegedService[A, R]) Run(ctx context.Context, args A) (R, error) {
+	return s.op(ctx, args)
+}
+
+// NewPrivileged returns a privileged operation named name, which runs op,
+// started with opts.  It registers a plugin main of that name, which must
+// be unique, and so is called from package level var declarations or init
+// functions, so that the helper process registers it too.  The args and
+// results of op are sent between processes, and so must be types the codec
+// can encode, as with any other plugin method.
+func NewPrivileged[A, R any](name string, op func(context.Context, A) (R, error), opts ...StartOption) *Privileged[A, R] {
+	RegisterPluginMain(name, func(s Server) error {
+		return s.RegisterName("privileged", privilegedService[A, R]{op: op})
+	})
+	return &Privileged[A, R]{name: name, opts: opts}
+}
+
+// Run starts a helper process, runs the operation in it with args, and stops
+// the helper, returning the operation's result.  The helper's stderr is the
+// host's.  If ctx is done first, the helper is killed, and Run returns
+// ctx.Err().
+func (p *Privileged[A, R]) Run(ctx context.Context, args A) (R, error) {
+	var reply R
+	path, pluginArgs, err := SelfCommand(p.name)
+	if err != nil {
+		return reply, err
+	}
+	plugin, err := StartPluginContext(ctx, os.Stderr, path, pluginArgs, p.opts...)
+	if err != nil {
+		return reply, fmt.Errorf("pie: starting privileged helper %s: %w", p.name, err)
+	}
+	err = plugin.Call("privileged.Run", args, &reply)
+	if cerr := plugin.Close(); err == nil && ctx.Err() == nil {
+		err = cerr
+	}
+	if ctx.Err() != nil {
+		return reply, ctx.Err()
+	}
+	return reply, err
+}
@@ -0,0 +1,21 @@
+package pie
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// grantCapabilities makes cmd start with the named capabilities as ambient
+// capabilities.  The Go runtime raises them in the child's inheritable set
+// before raising them as ambient, which fails unless the host holds them.
+func grantCapabilities(cmd *exec.Cmd, names []string) error {
+	caps, err := capabilityNumbers(names)
+	if err != nil {
+		return err
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.AmbientCaps = append(cmd.SysProcAttr.AmbientCaps, caps...)
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package pie
+
+import "os/exec"
+
+// grantCapabilities is not supported on this platform.
+func grantCapabilities(cmd *exec.Cmd, names []string) error {
+	return ErrCapabilitiesUnsupported
+}
@@ -0,0 +1,83 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	privilegedDouble = NewPrivileged("double", func(_ context.Context, n int) (int, error) {
+		if n < 0 {
+			return 0, errors.New("negative")
+		}
+		return 2 * n, nil
+	})
+	privilegedBlock = NewPrivileged("block", func(_ context.Context, _ int) (int, error) {
+		time.Sleep(time.Hour)
+		return 0, nil
+	})
+	privilegedCaps = NewPrivileged("caps", func(_ context.Context, _ int) (string, error) {
+		status, err := os.ReadFile("/proc/self/status")
+		if err != nil {
+			return "", err
+		}
+		for _, line := range strings.Split(string(status), "\n") {
+			if amb, ok := strings.CutPrefix(line, "CapAmb:"); ok {
+				return strings.TrimSpace(amb), nil
+			}
+		}
+		return "", errors.New("no CapAmb in /proc/self/status")
+	}, WithCapabilities("CAP_NET_BIND_SERVICE"))
+)
+
+func TestPrivileged(t *testing.T) {
+	n, err := privilegedDouble.Run(context.Background(), 21)
+	if err != nil || n != 42 {
+		t.Errorf("Expected 42, got %d, %v", n, err)
+	}
+	if _, err := privilegedDouble.Run(context.Background(), -1); err == nil || err.Error() != "negative" {
+		t.Errorf("Expected the operation's error, got %v", err)
+	}
+}
+
+func TestPrivilegedContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := privilegedBlock.Run(ctx, 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline to be exceeded, got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Expected Run to return once ctx was done, took %v", d)
+	}
+}
+
+func TestPrivilegedCapabilities(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("granting capabilities needs root")
+	}
+	amb, err := privilegedCaps.Run(context.Background(), 0)
+	if errors.Is(err, ErrCapabilitiesUnsupported) {
+		t.Skip("capabilities are not supported on this platform")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if amb != "0000000000000400" {
+		t.Errorf("Expected only CAP_NET_BIND_SERVICE to be ambient, got %s", amb)
+	}
+}
+
+func TestCapabilityNumbers(t *testing.T) {
+	caps, err := capabilityNumbers([]string{"CAP_NET_BIND_SERVICE", "net_admin", "CAP_CHOWN"})
+	if err != nil || len(caps) != 3 || caps[0] != 10 || caps[1] != 12 || caps[2] != 0 {
+		t.Errorf("Expected [10 12 0], got %v, %v", caps, err)
+	}
+	if _, err := capabilityNumbers([]string{"CAP_FLY"}); err == nil {
+		t.Error("Expected an error for an unknown capability")
+	}
+}
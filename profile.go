@@ -0,0 +1,129 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrUnknownProfile is returned by a Manager asked for a profile it does not
+// have.
+var ErrUnknownProfile = errors.New("unknown profile")
+
+// Profile selects which of a Manager's Plugins to run, and how, so that the
+// same host can serve different deployments, such as a minimal one, a full
+// one, and one for CI.
+type Profile struct {
+	// Plugins are the names of the plugins the profile runs, in the order
+	// of the Manager's Plugins.  If it is nil, the profile runs all of them.
+	Plugins []string
+	// Overrides change the specs of the plugins the profile runs, by name.
+	Overrides map[string]Override
+}
+
+// Override changes a PluginSpec for a Profile.
+type Override struct {
+	// Args, if not nil, replace the plugin's arguments.
+	Args []string
+	// Env is added to the plugin's environment, replacing the values of
+	// variables it already sets.
+	Env []string
+	// Options are passed to StartPlugin after the spec's own.
+	Options []StartOption
+	// Policy, if not nil, replaces the plugin's Policy, except for its
+	// OnEvent, which is kept.
+	Policy *Policy
+	// Quota, if not nil, replaces the plugin's Quota.
+	Quota *Quota
+}
+
+// apply returns spec with the override applied.
+func (o Override) apply(spec PluginSpec) PluginSpec {
+	if o.Args != nil {
+		spec.Args = o.Args
+	}
+	// Copy the options, so that the spec's are not appended to in place.
+	opts := append([]StartOption(nil), spec.Options...)
+	if len(o.Env) > 0 {
+		opts = append(opts, WithEnv(o.Env...))
+	}
+	spec.Options = append(opts, o.Options...)
+	if o.Policy != nil {
+		onEvent := spec.Policy.OnEvent
+		spec.Policy = *o.Policy
+		spec.Policy.OnEvent = onEvent
+	}
+	if o.Quota != nil {
+		spec.Quota = *o.Quota
+	}
+	return spec
+}
+
+// Profile returns the specs of the plugins the named profile runs, with its
+// overrides applied.
+func (m *Manager) Profile(name string) ([]PluginSpec, error) {
+	prof, ok := m.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("profile %s: %w", name, ErrUnknownProfile)
+	}
+	known := map[string]bool{}
+	for _, spec := range m.Plugins {
+		known[spec.Name] = true
+	}
+	overridden := make([]string, 0, len(prof.Overrides))
+	for p := range prof.Overrides {
+		overridden = append(overridden, p)
+	}
+	if err := checkProfile(known, prof.Plugins, overridden); err != nil {
+		return nil, fmt.Errorf("profile %s: %w", name, err)
+	}
+	selected := map[string]bool{}
+	for _, p := range prof.Plugins {
+		selected[p] = true
+	}
+	var specs []PluginSpec
+	for _, spec := range m.Plugins {
+		if prof.Plugins != nil && !selected[spec.Name] {
+			continue
+		}
+		if o, ok := prof.Overrides[spec.Name]; ok {
+			spec = o.apply(spec)
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// checkProfile checks that a profile that runs plugins, or all the known
+// plugins if it is nil, only runs known plugins, and only overrides plugins
+// it runs.
+func checkProfile(known map[string]bool, plugins, overridden []string) error {
+	runs := known
+	if plugins != nil {
+		runs = map[string]bool{}
+		for _, p := range plugins {
+			if !known[p] {
+				return fmt.Errorf("plugin %s: %w", p, ErrUnknownPlugin)
+			}
+			runs[p] = true
+		}
+	}
+	sort.Strings(overridden)
+	for _, p := range overridden {
+		if !runs[p] {
+			return fmt.Errorf("override for plugin %s, which the profile does not run", p)
+		}
+	}
+	return nil
+}
+
+// StartProfile starts the plugins the named profile runs, with its overrides
+// applied, the way StartAll starts all of the Manager's Plugins.
+func (m *Manager) StartProfile(ctx context.Context, name string) error {
+	specs, err := m.Profile(name)
+	if err != nil {
+		return err
+	}
+	return m.startAll(ctx, specs)
+}
@@ -0,0 +1,105 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestManagerProfile(t *testing.T) {
+	onEvent := func(Event) {}
+	m := &Manager{
+		Plugins: []PluginSpec{
+			{Name: "a", Path: "/a", Args: []string{"--x"}},
+			{Name: "b", Path: "/b", Policy: Policy{MaxRestarts: 3, OnEvent: onEvent}},
+			{Name: "c", Path: "/c"},
+		},
+		Profiles: map[string]Profile{
+			"minimal": {Plugins: []string{"c", "a"}},
+			"ci": {Overrides: map[string]Override{
+				"a": {Args: []string{"--y"}, Env: []string{"A=1"}},
+				"b": {Policy: &Policy{MaxCalls: 10}, Quota: &Quota{CallsPerMinute: 5}},
+			}},
+		},
+	}
+	specs, err := m.Profile("minimal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 2 || specs[0].Name != "a" || specs[1].Name != "c" {
+		t.Errorf("Expected plugins a and c in order, got %+v", specs)
+	}
+	specs, err = m.Profile("ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 3 {
+		t.Fatalf("Expected all 3 plugins, got %d", len(specs))
+	}
+	if a := specs[0]; len(a.Args) != 1 || a.Args[0] != "--y" || len(a.Options) != 1 {
+		t.Errorf("Wrong overridden spec for a: %+v", a)
+	}
+	b := specs[1]
+	if b.Policy.MaxCalls != 10 || b.Policy.MaxRestarts != 0 || b.Policy.OnEvent == nil || b.Quota.CallsPerMinute != 5 {
+		t.Errorf("Wrong overridden spec for b: %+v", b)
+	}
+	// The Manager's own specs are left alone.
+	if a := m.Plugins[0]; a.Args[0] != "--x" || len(a.Options) != 0 {
+		t.Errorf("Expected the Manager's spec for a to be unchanged, got %+v", a)
+	}
+}
+
+func TestManagerProfileErrors(t *testing.T) {
+	m := &Manager{
+		Plugins: []PluginSpec{{Name: "a", Path: "/a"}, {Name: "b", Path: "/b"}},
+		Profiles: map[string]Profile{
+			"typo":    {Plugins: []string{"z"}},
+			"outside": {Plugins: []string{"a"}, Overrides: map[string]Override{"b": {}}},
+		},
+	}
+	if _, err := m.Profile("missing"); !errors.Is(err, ErrUnknownProfile) {
+		t.Errorf("Expected ErrUnknownProfile, got %v", err)
+	}
+	if _, err := m.Profile("typo"); !errors.Is(err, ErrUnknownPlugin) {
+		t.Errorf("Expected ErrUnknownPlugin for a profile naming an unknown plugin, got %v", err)
+	}
+	if _, err := m.Profile("outside"); err == nil || !strings.Contains(err.Error(), "does not run") {
+		t.Errorf("Expected an error overriding a plugin the profile does not run, got %v", err)
+	}
+	if err := m.StartProfile(context.Background(), "missing"); !errors.Is(err, ErrUnknownProfile) {
+		t.Errorf("Expected ErrUnknownProfile from StartProfile, got %v", err)
+	}
+}
+
+func TestManagerStartProfile(t *testing.T) {
+	m := &Manager{
+		Plugins: []PluginSpec{
+			helperSpec("a", "provider"),
+			helperSpec("b", "provider"),
+		},
+		Profiles: map[string]Profile{
+			"only-a": {
+				Plugins:   []string{"a"},
+				Overrides: map[string]Override{"a": {Env: []string{"PIE_PROFILE_TEST=ci"}}},
+			},
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := m.StartProfile(ctx, "only-a"); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	var value string
+	if err := m.Call("a", "helper.Getenv", "PIE_PROFILE_TEST", &value); err != nil {
+		t.Fatal(err)
+	}
+	if value != "ci" {
+		t.Errorf("Expected the override's environment, got %q", value)
+	}
+	if _, err := m.Supervisor("b"); !errors.Is(err, ErrUnknownPlugin) {
+		t.Errorf("Expected b not to be started, got %v", err)
+	}
+}
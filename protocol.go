@@ -0,0 +1,469 @@
+package pie
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/rpc"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ProtocolVersion is the version of the wire protocol described by Protocol.
+// It changes only when a change to the protocol would break existing
+// implementations.
+const ProtocolVersion = 1
+
+// ProtocolDescriptor is a machine-readable description of the wire protocol
+// between a host and a provider, as returned by Protocol.  It is meant for
+// implementing providers in languages other than Go, and marshals to JSON.
+// Together with ValidateTranscript, it lets such implementations be checked
+// against this package instead of against its source.
+type ProtocolDescriptor struct {
+	// Version is ProtocolVersion.
+	Version int `json:"version"`
+	// Transport describes how the host and the provider are connected.
+	Transport string `json:"transport"`
+	// Codec describes how calls and their replies are encoded.
+	Codec string `json:"codec"`
+	// Environment describes the environment variables through which the
+	// host configures the provider.
+	Environment []EnvDescriptor `json:"environment"`
+	// Frames describes the frames the RPC stream may be carried in.
+	Frames []FrameDescriptor `json:"frames"`
+	// ControlService is the name of the built-in service every provider
+	// serves, and ControlMethods describes its methods, sorted by name.
+	ControlService string                    `json:"controlService"`
+	ControlMethods []ControlMethodDescriptor `json:"controlMethods"`
+}
+
+// EnvDescriptor describes an environment variable set by the host.
+type EnvDescriptor struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Values are the values the variable may have, if there are only a few.
+	Values []string `json:"values,omitempty"`
+}
+
+// FrameDescriptor describes a format of the frames the RPC stream is carried
+// in.  A frame is a header followed by its payload, and the payloads of the
+// frames read from a direction of the connection, in order, make up the RPC
+// stream.  A frame with an empty payload is a keepalive.
+type FrameDescriptor struct {
+	// Name is the name of the format, such as "plain".
+	Name string `json:"name"`
+	// Framing is the value of PIE_FRAMING that selects the format.
+	Framing string `json:"framing"`
+	// Magic is the hex encoding of the bytes every frame starts with.
+	Magic string `json:"magic"`
+	// Header describes the fields of the frame's header, in order.
+	Header []FrameField `json:"header"`
+	// MaxPayload, if not zero, is the longest payload a frame may have.
+	MaxPayload int `json:"maxPayload,omitempty"`
+	// Usage describes when the format is used.
+	Usage string `json:"usage"`
+}
+
+// FrameField describes a field of a frame's header.
+type FrameField struct {
+	Name   string `json:"name"`
+	Offset int    `json:"offset"`
+	Size   int    `json:"size"`
+	// Encoding is "bytes" for raw bytes, or "uint32be" for a big endian
+	// unsigned integer.
+	Encoding string `json:"encoding"`
+	// Description says what the field holds.
+	Description string `json:"description"`
+}
+
+// ControlMethodDescriptor describes a method of the control service.  Args
+// and Reply describe the types of the method's arguments and reply as gob
+// encodes them, such as "int", "[]string", or
+// "struct { Name string; Tags []string }".
+type ControlMethodDescriptor struct {
+	Name  string `json:"name"`
+	Args  string `json:"args"`
+	Reply string `json:"reply"`
+}
+
+// Protocol returns the description of the wire protocol this package speaks.
+func Protocol() *ProtocolDescriptor {
+	d := &ProtocolDescriptor{
+		Version: ProtocolVersion,
+		Transport: "The host writes to the provider's stdin and reads from its stdout; the provider's stderr is its own.  " +
+			"If " + bootstrapEnv + " is set, or the provider is passed " + bootstrapFlag + "=address, the provider instead " +
+			"connects to the address, tcp://host:port/token, writes the token, and speaks the protocol on that connection, " +
+			"with its stdout left alone.",
+		Codec: "Go's net/rpc over a single gob stream in each direction: the host writes a gob-encoded net/rpc Request " +
+			"{ServiceMethod string; Seq uint} followed by the gob-encoded arguments, and the provider answers with a " +
+			"gob-encoded Response {ServiceMethod string; Seq uint; Error string} with the request's ServiceMethod and Seq, " +
+			"followed by the gob-encoded reply, or an empty struct if Error is not empty.  Replies may be sent in any order.  " +
+			"A successful " + selectCodecMethod + " call switches both directions to the chosen codec right after its reply.",
+		Environment: []EnvDescriptor{
+			{Name: guardEnv, Description: "Set when the provider was started by a host, so that it may redirect what the rest of the process writes to stdout.", Values: []string{"1"}},
+			{Name: framingEnv, Description: "Asks the provider to frame what it writes: \"1\" for plain frames from the provider, \"crc32\" for checksummed frames in both directions.", Values: []string{"1", "crc32"}},
+			{Name: keepaliveEnv, Description: "Asks for transport keepalives, as \"interval,timeout\" in Go duration syntax: both directions are framed, an empty frame is sent whenever nothing was sent for interval, and the connection is closed when nothing was received for timeout."},
+			{Name: muxEnv, Description: "Asks the provider to multiplex its connection.  The host opens two named streams on it: \"" + RPCChannel + "\", which carries the RPC protocol, and \"" + ControlChannel + "\", which carries calls to the control API.  Any other stream is a channel the application opened with Plugin.OpenChannel.", Values: []string{"1"}},
+			{Name: batchingEnv, Description: "Asks the provider to batch its writes, as \"threshold,delay,size\": the call rate above which writes are held back, for at most delay in Go duration syntax, or until size bytes are held."},
+			{Name: hostBuildEnv, Description: "The host's build information, as a JSON object."},
+			{Name: featuresEnv, Description: "The host's feature flags, as a JSON object of booleans."},
+			{Name: bootstrapEnv, Description: "The address the provider connects to instead of using stdio, as tcp://host:port/token."},
+			{Name: netProxyEnv, Description: "The number of the file descriptor on which the provider reaches the host's network proxy."},
+			{Name: peerEnv, Description: "The number of the file descriptor of a Unix domain stream socket on which the host passes the provider connections to other plugins, each as a single byte with the connection's file descriptor attached, read by the " + controlService + ".PeerAccept call that follows it."},
+		},
+		Frames: []FrameDescriptor{
+			{
+				Name:    "plain",
+				Framing: "1",
+				Magic:   hex.EncodeToString(frameMagic[:]),
+				Header: []FrameField{
+					{Name: "magic", Offset: 0, Size: len(frameMagic), Encoding: "bytes", Description: "The frame's magic."},
+					{Name: "length", Offset: len(frameMagic), Size: 4, Encoding: "uint32be", Description: "The length of the payload."},
+				},
+				Usage: "Written by the provider when " + framingEnv + " is \"1\", and in both directions when " + keepaliveEnv + " is set.  What the provider writes to stdout outside of frames is stray output, which the host may skip.",
+			},
+			{
+				Name:    "checksummed",
+				Framing: "crc32",
+				Magic:   hex.EncodeToString(checksumMagic[:]),
+				Header: []FrameField{
+					{Name: "magic", Offset: 0, Size: len(checksumMagic), Encoding: "bytes", Description: "The frame's magic."},
+					{Name: "length", Offset: len(checksumMagic), Size: 4, Encoding: "uint32be", Description: "The length of the payload."},
+					{Name: "checksum", Offset: frameHeaderLen, Size: 4, Encoding: "uint32be", Description: "The CRC-32C (Castagnoli) checksum of the payload."},
+				},
+				MaxPayload: maxChecksumFrame,
+				Usage:      "Written in both directions when " + framingEnv + " is \"crc32\", or when the host's first bytes are a checksummed frame.",
+			},
+		},
+		ControlService: controlService,
+	}
+	for name, types := range controlTypes() {
+		d.ControlMethods = append(d.ControlMethods, ControlMethodDescriptor{
+			Name:  name,
+			Args:  gobType(types[0]),
+			Reply: gobType(types[1]),
+		})
+	}
+	sort.Slice(d.ControlMethods, func(i, j int) bool { return d.ControlMethods[i].Name < d.ControlMethods[j].Name })
+	return d
+}
+
+var (
+	gobEncoderType      = reflect.TypeOf((*gob.GobEncoder)(nil)).Elem()
+	binaryMarshalerType = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+)
+
+// gobType describes t as gob encodes it.
+func gobType(t reflect.Type) string {
+	return describeGobType(t, map[reflect.Type]bool{})
+}
+
+// describeGobType describes t as gob encodes it, naming the struct types in
+// seen instead of describing them again.
+func describeGobType(t reflect.Type, seen map[reflect.Type]bool) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Implements(gobEncoderType) || reflect.PtrTo(t).Implements(gobEncoderType) ||
+		t.Implements(binaryMarshalerType) || reflect.PtrTo(t).Implements(binaryMarshalerType) {
+		return "bytes (" + t.String() + ")"
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "int"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return "uint"
+	case reflect.Float32, reflect.Float64:
+		return "float"
+	case reflect.Complex64, reflect.Complex128:
+		return "complex"
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "bytes"
+		}
+		return "[]" + describeGobType(t.Elem(), seen)
+	case reflect.Map:
+		return "map[" + describeGobType(t.Key(), seen) + "]" + describeGobType(t.Elem(), seen)
+	case reflect.Struct:
+		if seen[t] {
+			return t.Name()
+		}
+		seen[t] = true
+		var fields []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() || f.Type.Kind() == reflect.Chan || f.Type.Kind() == reflect.Func {
+				continue
+			}
+			fields = append(fields, f.Name+" "+describeGobType(f.Type, seen))
+		}
+		if len(fields) == 0 {
+			return "struct {}"
+		}
+		return "struct { " + strings.Join(fields, "; ") + " }"
+	}
+	return t.Kind().String()
+}
+
+// Transcript is a recording of the bytes exchanged between a host and a
+// provider, from the start of the connection, for ValidateTranscript.
+type Transcript struct {
+	// Host is what the host wrote to the provider, and Provider what the
+	// provider wrote to the host, such as its stdout.
+	Host     []byte
+	Provider []byte
+	// Framing and Keepalive are the values of PIE_FRAMING and
+	// PIE_KEEPALIVE the provider was started with.
+	Framing   string
+	Keepalive string
+}
+
+// Violation is a way in which a Transcript breaks the protocol.
+type Violation struct {
+	// From is "host" or "provider", whichever wrote the offending bytes.
+	From string
+	// Offset is where in what From wrote the violation was found: in the
+	// bytes written for framing violations, and otherwise in the RPC stream
+	// the frames carry.
+	Offset int64
+	// Message describes the violation.
+	Message string
+}
+
+// String returns a human readable description of the violation.
+func (v Violation) String() string {
+	return fmt.Sprintf("%s at offset %d: %s", v.From, v.Offset, v.Message)
+}
+
+// ConformanceError is the error returned by ValidateTranscript for a
+// transcript that breaks the protocol.
+type ConformanceError struct {
+	Violations []Violation
+}
+
+// Error implements the error interface.
+func (e *ConformanceError) Error() string {
+	msgs := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		msgs[i] = v.String()
+	}
+	return "pie: transcript breaks the protocol: " + strings.Join(msgs, "; ")
+}
+
+// ValidateTranscript checks that t follows the protocol described by
+// Protocol, and returns a *ConformanceError listing how it does not.  It
+// checks that each direction is framed as t's environment asks, that the RPC
+// streams decode, that each reply answers a call that was made and has not
+// been answered yet, and that the arguments and replies of control methods
+// have the types described.  The transcript may end at any point, with calls
+// unanswered.  Multiplexed and encrypted connections are not covered, and
+// checking stops at a switch to another codec.
+func ValidateTranscript(t Transcript) error {
+	var violations []Violation
+	hostFramed := t.Framing == "crc32" || t.Keepalive != ""
+	providerFramed := t.Framing != "" || t.Keepalive != ""
+	host, vs := unframeTranscript("host", t.Host, hostFramed, t.Framing == "crc32")
+	violations = append(violations, vs...)
+	provider, vs := unframeTranscript("provider", t.Provider, providerFramed, t.Framing == "crc32")
+	violations = append(violations, vs...)
+	violations = append(violations, validateRPC(host, provider)...)
+	if len(violations) > 0 {
+		return &ConformanceError{Violations: violations}
+	}
+	return nil
+}
+
+// unframeTranscript returns the RPC stream carried in data, written by from,
+// which is framed if framed is true, in checksummed frames if checksums is
+// also true, along with the framing violations found.  The stream ends at the
+// first violation.
+func unframeTranscript(from string, data []byte, framed, checksums bool) ([]byte, []Violation) {
+	if !framed {
+		return data, nil
+	}
+	var stream []byte
+	var violations []Violation
+	magic, headerLen := frameMagic, frameHeaderLen
+	if checksums {
+		magic, headerLen = checksumMagic, checksumHeaderLen
+	}
+	for off := 0; off < len(data); {
+		rest := data[off:]
+		if !bytes.HasPrefix(rest, magic[:]) {
+			if len(rest) < len(magic) && bytes.HasPrefix(magic[:], rest) {
+				// The transcript ended inside the magic.
+				return stream, violations
+			}
+			n := bytes.Index(rest[1:], magic[:]) + 1
+			if n == 0 {
+				n = len(rest)
+			}
+			// Only the provider's stdout may carry stray output, and only
+			// with plain frames, since checksummed frames are the whole
+			// connection.
+			if from == "host" || checksums {
+				violations = append(violations, Violation{From: from, Offset: int64(off), Message: fmt.Sprintf("expected a frame, got %q", truncate(rest[:n]))})
+				return stream, violations
+			}
+			off += n
+			continue
+		}
+		if len(rest) < headerLen {
+			violations = append(violations, Violation{From: from, Offset: int64(off), Message: "truncated frame header"})
+			return stream, violations
+		}
+		n := binary.BigEndian.Uint32(rest[len(magic):])
+		if checksums && n > maxChecksumFrame {
+			violations = append(violations, Violation{From: from, Offset: int64(off), Message: fmt.Sprintf("frame length %d exceeds limit", n)})
+			return stream, violations
+		}
+		if uint64(len(rest)-headerLen) < uint64(n) {
+			// The transcript ended inside the frame.
+			return stream, violations
+		}
+		payload := rest[headerLen : headerLen+int(n)]
+		if checksums {
+			if want, got := binary.BigEndian.Uint32(rest[frameHeaderLen:]), checksum(payload); want != got {
+				violations = append(violations, Violation{From: from, Offset: int64(off), Message: fmt.Sprintf("checksum mismatch: header has %08x, payload has %08x", want, got)})
+				return stream, violations
+			}
+		}
+		stream = append(stream, payload...)
+		off += headerLen + int(n)
+	}
+	return stream, violations
+}
+
+// truncate returns the start of data, for messages.
+func truncate(data []byte) []byte {
+	if len(data) > 32 {
+		return data[:32]
+	}
+	return data
+}
+
+// controlTypes returns the argument and reply types of the control methods,
+// by name, with the reply types dereferenced.  They are those of the methods
+// of control that net/rpc serves, and of the methods the dispatcher answers
+// itself, since they change how what follows them is encoded.
+func controlTypes() map[string][2]reflect.Type {
+	types := map[string][2]reflect.Type{}
+	ctl := reflect.TypeOf((*control)(nil))
+	for i := 0; i < ctl.NumMethod(); i++ {
+		m := ctl.Method(i)
+		t := m.Type
+		if !m.IsExported() || t.NumIn() != 3 || t.In(2).Kind() != reflect.Ptr || t.NumOut() != 1 || t.Out(0) != typeOfError {
+			continue
+		}
+		types[controlService+"."+m.Name] = [2]reflect.Type{t.In(1), t.In(2).Elem()}
+	}
+	strs := reflect.TypeOf([]string(nil))
+	types[selectCodecMethod] = [2]reflect.Type{strs, reflect.TypeOf("")}
+	types[selectMarshalersMethod] = [2]reflect.Type{strs, strs}
+	return types
+}
+
+// transcriptCall is a call read from a transcript.
+type transcriptCall struct {
+	method string
+	// args are the decoded arguments of a control method, and nil for other
+	// methods.
+	args interface{}
+}
+
+// validateRPC checks the RPC streams written by the host and the provider,
+// and returns the violations found.
+func validateRPC(host, provider []byte) []Violation {
+	types := controlTypes()
+	var violations []Violation
+	calls := map[uint64]transcriptCall{}
+	hr := bytes.NewReader(host)
+	hdec := gob.NewDecoder(hr)
+	hostOff := func() int64 { return int64(len(host)) - int64(hr.Len()) }
+	for {
+		off := hostOff()
+		var req rpc.Request
+		if err := hdec.Decode(&req); err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				violations = append(violations, Violation{From: "host", Offset: off, Message: "bad request header: " + err.Error()})
+			}
+			break
+		}
+		if _, dup := calls[req.Seq]; dup {
+			violations = append(violations, Violation{From: "host", Offset: off, Message: fmt.Sprintf("request %d reuses the sequence number of a call in flight", req.Seq)})
+		}
+		call := transcriptCall{method: req.ServiceMethod}
+		off = hostOff()
+		var err error
+		if tt, ok := types[req.ServiceMethod]; ok {
+			v := reflect.New(tt[0])
+			err = hdec.Decode(v.Interface())
+			call.args = v.Elem().Interface()
+		} else {
+			err = hdec.DecodeValue(reflect.Value{})
+		}
+		if err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				violations = append(violations, Violation{From: "host", Offset: off, Message: fmt.Sprintf("bad arguments for %s: %v", req.ServiceMethod, err)})
+			}
+			break
+		}
+		calls[req.Seq] = call
+		if req.ServiceMethod == selectCodecMethod {
+			// What follows may be in another codec.
+			break
+		}
+	}
+	pr := bytes.NewReader(provider)
+	pdec := gob.NewDecoder(pr)
+	providerOff := func() int64 { return int64(len(provider)) - int64(pr.Len()) }
+	for {
+		off := providerOff()
+		var resp rpc.Response
+		if err := pdec.Decode(&resp); err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				violations = append(violations, Violation{From: "provider", Offset: off, Message: "bad response header: " + err.Error()})
+			}
+			break
+		}
+		call, ok := calls[resp.Seq]
+		if !ok {
+			violations = append(violations, Violation{From: "provider", Offset: off, Message: fmt.Sprintf("reply %d answers no call in flight", resp.Seq)})
+		} else if resp.ServiceMethod != call.method {
+			violations = append(violations, Violation{From: "provider", Offset: off, Message: fmt.Sprintf("reply %d is for %s, but the call was to %s", resp.Seq, resp.ServiceMethod, call.method)})
+		}
+		delete(calls, resp.Seq)
+		off = providerOff()
+		tt, isControl := types[call.method]
+		var reply reflect.Value
+		var err error
+		if ok && isControl && resp.Error == "" {
+			reply = reflect.New(tt[1])
+			err = pdec.Decode(reply.Interface())
+		} else {
+			err = pdec.DecodeValue(reflect.Value{})
+		}
+		if err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				violations = append(violations, Violation{From: "provider", Offset: off, Message: fmt.Sprintf("bad reply for %s: %v", resp.ServiceMethod, err)})
+			}
+			break
+		}
+		if !reply.IsValid() {
+			continue
+		}
+		if call.method == controlService+".Ping" && reply.Elem().Interface() != call.args {
+			violations = append(violations, Violation{From: "provider", Offset: off, Message: fmt.Sprintf("%s replied %v to %v, instead of echoing it", call.method, reply.Elem().Interface(), call.args)})
+		}
+		if call.method == selectCodecMethod {
+			// What follows is in the codec chosen.
+			break
+		}
+	}
+	return violations
+}
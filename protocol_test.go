@@ -0,0 +1,255 @@
+package pie
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/rpc"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProtocol(t *testing.T) {
+	d := Protocol()
+	if _, err := json.Marshal(d); err != nil {
+		t.Fatal(err)
+	}
+	methods := map[string]ControlMethodDescriptor{}
+	for _, m := range d.ControlMethods {
+		methods[m.Name] = m
+	}
+	if m := methods["pie.Ping"]; m.Args != "int" || m.Reply != "int" {
+		t.Errorf("Expected pie.Ping to take and return an int, got %+v", m)
+	}
+	if m := methods["pie.SelectCodec"]; m.Args != "[]string" || m.Reply != "string" {
+		t.Errorf("Expected pie.SelectCodec to be described, got %+v", m)
+	}
+	if m := methods["pie.Describe"]; !strings.HasPrefix(m.Reply, "struct { APIVersions []string; Methods []struct { Name string;") {
+		t.Errorf("Expected the manifest's type to be described, got %q", m.Reply)
+	}
+	if len(d.Frames) != 2 || d.Frames[0].Magic != "1b504945" || d.Frames[1].Magic != "1b504943" {
+		t.Errorf("Expected the frames' magic, got %+v", d.Frames)
+	}
+}
+
+func TestGobType(t *testing.T) {
+	type node struct {
+		Name     string
+		Children []node
+		Data     []byte
+		When     time.Time
+		hidden   int
+		Done     chan struct{}
+	}
+	want := "struct { Name string; Children []node; Data bytes; When bytes (time.Time) }"
+	if got := gobType(reflect.TypeOf(node{})); got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+// wireRecorder records the bytes a host exchanges with a plugin.
+type wireRecorder struct {
+	io.ReadWriteCloser
+	mu             sync.Mutex
+	host, provider bytes.Buffer
+}
+
+func (r *wireRecorder) Read(p []byte) (int, error) {
+	n, err := r.ReadWriteCloser.Read(p)
+	r.mu.Lock()
+	r.provider.Write(p[:n])
+	r.mu.Unlock()
+	return n, err
+}
+
+func (r *wireRecorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	r.host.Write(p)
+	r.mu.Unlock()
+	return r.ReadWriteCloser.Write(p)
+}
+
+// transcript returns what has been recorded.
+func (r *wireRecorder) transcript(framing, keepalive string) Transcript {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return Transcript{
+		Host:      append([]byte(nil), r.host.Bytes()...),
+		Provider:  append([]byte(nil), r.provider.Bytes()...),
+		Framing:   framing,
+		Keepalive: keepalive,
+	}
+}
+
+func TestValidateTranscriptOfGo(t *testing.T) {
+	for _, tc := range []struct {
+		name               string
+		framing, keepalive string
+		opts               []StartOption
+	}{
+		{name: "unframed"},
+		{name: "framed", framing: "1", opts: []StartOption{WithFraming(nil)}},
+		{name: "checksummed", framing: "crc32", opts: []StartOption{WithChecksums(false)}},
+		{name: "keepalive", keepalive: "10ms,1s", opts: []StartOption{WithTransportKeepalive(10*time.Millisecond, time.Second)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := &wireRecorder{}
+			opts := append(tc.opts, WithConnWrapper(func(rwc io.ReadWriteCloser) io.ReadWriteCloser {
+				rec.ReadWriteCloser = rwc
+				return rec
+			}))
+			p := inProcessAPI(t, opts...)
+			defer p.Close()
+			if err := p.Ping(); err != nil {
+				t.Fatal(err)
+			}
+			var reply string
+			if err := p.Call("api.SayHi", "bob", &reply); err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Call("api.Missing", "bob", &reply); err == nil {
+				t.Fatal("Expected an error calling a missing method")
+			}
+			if _, err := p.Manifest(); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(30 * time.Millisecond)
+			if err := ValidateTranscript(rec.transcript(tc.framing, tc.keepalive)); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// rpcStream writes gob-encoded net/rpc messages, as a host or a provider
+// does.
+type rpcStream struct {
+	buf bytes.Buffer
+	enc *gob.Encoder
+}
+
+func newRPCStream() *rpcStream {
+	s := &rpcStream{}
+	s.enc = gob.NewEncoder(&s.buf)
+	return s
+}
+
+func (s *rpcStream) write(header, body interface{}) *rpcStream {
+	s.enc.Encode(header)
+	s.enc.Encode(body)
+	return s
+}
+
+func TestValidateTranscriptViolations(t *testing.T) {
+	host := newRPCStream().
+		write(&rpc.Request{ServiceMethod: "pie.Ping", Seq: 1}, 7).
+		write(&rpc.Request{ServiceMethod: "api.SayHi", Seq: 2}, "bob").
+		buf.Bytes()
+	for name, tc := range map[string]struct {
+		provider []byte
+		want     string
+	}{
+		"wrong seq": {
+			newRPCStream().write(&rpc.Response{ServiceMethod: "pie.Ping", Seq: 3}, 7).buf.Bytes(),
+			"reply 3 answers no call in flight",
+		},
+		"wrong method": {
+			newRPCStream().write(&rpc.Response{ServiceMethod: "api.SayHi", Seq: 1}, 7).buf.Bytes(),
+			"reply 1 is for api.SayHi, but the call was to pie.Ping",
+		},
+		"no echo": {
+			newRPCStream().write(&rpc.Response{ServiceMethod: "pie.Ping", Seq: 1}, 8).buf.Bytes(),
+			"pie.Ping replied 8 to 7",
+		},
+		"wrong type": {
+			newRPCStream().write(&rpc.Response{ServiceMethod: "pie.Ping", Seq: 1}, "7").buf.Bytes(),
+			"bad reply for pie.Ping",
+		},
+		"answered twice": {
+			newRPCStream().
+				write(&rpc.Response{ServiceMethod: "api.SayHi", Seq: 2}, "Hi bob").
+				write(&rpc.Response{ServiceMethod: "api.SayHi", Seq: 2}, "Hi bob").buf.Bytes(),
+			"reply 2 answers no call in flight",
+		},
+		"garbage": {
+			[]byte("\x05hello"),
+			"bad response header",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := ValidateTranscript(Transcript{Host: host, Provider: tc.provider})
+			var cerr *ConformanceError
+			if !errors.As(err, &cerr) || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("Expected a violation containing %q, got %v", tc.want, err)
+			}
+			if cerr != nil && cerr.Violations[0].From != "provider" {
+				t.Errorf("Expected the provider to be blamed, got %+v", cerr.Violations)
+			}
+		})
+	}
+}
+
+func TestValidateTranscriptPartial(t *testing.T) {
+	host := newRPCStream().
+		write(&rpc.Request{ServiceMethod: "pie.Ping", Seq: 1}, 7).
+		write(&rpc.Request{ServiceMethod: "api.SayHi", Seq: 2}, "bob").
+		buf.Bytes()
+	provider := newRPCStream().
+		write(&rpc.Response{ServiceMethod: "api.SayHi", Seq: 2}, "Hi bob").
+		write(&rpc.Response{ServiceMethod: "pie.Ping", Seq: 1}, 7).
+		buf.Bytes()
+	if err := ValidateTranscript(Transcript{Host: host[:len(host)-2]}); err != nil {
+		t.Errorf("Expected a cut request to be valid, got %v", err)
+	}
+	for _, cut := range []int{0, 3, len(provider) / 2, len(provider) - 1, len(provider)} {
+		if err := ValidateTranscript(Transcript{Host: host, Provider: provider[:cut]}); err != nil {
+			t.Errorf("Expected a transcript cut at %d to be valid, got %v", cut, err)
+		}
+	}
+}
+
+func TestValidateTranscriptFrames(t *testing.T) {
+	stream := newRPCStream().write(&rpc.Response{ServiceMethod: "pie.Ping", Seq: 1}, 7).buf.Bytes()
+	host := newRPCStream().write(&rpc.Request{ServiceMethod: "pie.Ping", Seq: 1}, 7).buf.Bytes()
+	frames := func(format FrameFormat, payloads ...[]byte) []byte {
+		var buf bytes.Buffer
+		e := NewFrameEncoder(&buf, format)
+		for _, p := range payloads {
+			e.Encode(p)
+		}
+		return buf.Bytes()
+	}
+	split := [][]byte{stream[:5], {}, stream[5:]}
+
+	plain := append([]byte("stray\n"), frames(PlainFrames, split...)...)
+	if err := ValidateTranscript(Transcript{Host: host, Provider: plain, Framing: "1"}); err != nil {
+		t.Errorf("Expected stray output between plain frames to be skipped, got %v", err)
+	}
+	if err := ValidateTranscript(Transcript{Host: host, Provider: stream, Framing: "crc32"}); err == nil || !strings.Contains(err.Error(), "expected a frame") {
+		t.Errorf("Expected unframed output to break checksummed framing, got %v", err)
+	}
+	checksummed := frames(ChecksummedFrames, split...)
+	hostFrames := frames(ChecksummedFrames, host)
+	if err := ValidateTranscript(Transcript{Host: hostFrames, Provider: checksummed, Framing: "crc32"}); err != nil {
+		t.Errorf("Expected checksummed frames to be valid, got %v", err)
+	}
+	corrupt := append([]byte(nil), checksummed...)
+	corrupt[len(corrupt)-1] ^= 1
+	if err := ValidateTranscript(Transcript{Host: hostFrames, Provider: corrupt, Framing: "crc32"}); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("Expected a corrupt frame to be found, got %v", err)
+	}
+	big := append([]byte(nil), checksummed[:checksumHeaderLen]...)
+	binary.BigEndian.PutUint32(big[len(checksumMagic):], maxChecksumFrame+1)
+	if err := ValidateTranscript(Transcript{Host: hostFrames, Provider: big, Framing: "crc32"}); err == nil || !strings.Contains(err.Error(), "exceeds limit") {
+		t.Errorf("Expected an oversized frame to be found, got %v", err)
+	}
+	if err := ValidateTranscript(Transcript{Host: host, Provider: checksummed, Framing: "crc32"}); err == nil || !strings.Contains(err.Error(), "host at offset 0") {
+		t.Errorf("Expected an unframed host to break checksummed framing, got %v", err)
+	}
+}
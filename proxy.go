@@ -0,0 +1,99 @@
+package pie
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// Caller is anything that can make RPC calls to a plugin, such as an
+// *rpc.Client, a *Plugin, or a *Supervisor.
+type Caller interface {
+	Call(serviceMethod string, args interface{}, reply interface{}) error
+}
+
+// Bind fills in the func fields of the struct pointed to by proxy with
+// functions that call the methods of the named service through c, so that host
+// code can call a plugin's API as ordinary Go functions instead of passing
+// method names as strings.  Each field must have one of the types
+//
+//	func(A) (R, error)
+//	func(A) error
+//
+// and calls the method with the field's name, unless the field has a tag such
+// as `pie:"OtherName"`.  The second form is for methods whose reply the host
+// does not need.  Fields with the tag `pie:"-"` are left alone.
+//
+// Go cannot create types with methods at runtime, so a proxy is a struct of
+// funcs rather than an implementation of an interface.  To depend on an
+// interface, implement it with a thin type that calls a bound proxy:
+//
+//	type frobber struct {
+//		proxy struct {
+//			Frob func(A) (B, error)
+//		}
+//	}
+//
+//	func (f *frobber) Frob(a A) (B, error) { return f.proxy.Frob(a) }
+//
+// and pass &f.proxy to Bind.
+func Bind(c Caller, service string, proxy interface{}) error {
+	v := reflect.ValueOf(proxy)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("pie: proxy must be a pointer to a struct, not %T", proxy)
+	}
+	v = v.Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Tag.Get("pie")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if f.PkgPath != "" {
+			return fmt.Errorf("pie: proxy field %s is not exported", f.Name)
+		}
+		fn, err := proxyFunc(c, service+"."+name, f.Type)
+		if err != nil {
+			return fmt.Errorf("pie: proxy field %s: %w", f.Name, err)
+		}
+		v.Field(i).Set(fn)
+	}
+	return nil
+}
+
+// proxyFunc returns a function of type t that calls serviceMethod through c.
+func proxyFunc(c Caller, serviceMethod string, t reflect.Type) (reflect.Value, error) {
+	if t.Kind() != reflect.Func || t.NumIn() != 1 || t.IsVariadic() {
+		return reflect.Value{}, errors.New("must be a func taking one argument")
+	}
+	var replyType reflect.Type
+	switch {
+	case t.NumOut() == 1 && t.Out(0) == typeOfError:
+	case t.NumOut() == 2 && t.Out(1) == typeOfError:
+		replyType = t.Out(0)
+	default:
+		return reflect.Value{}, errors.New("must return either a result and an error, or just an error")
+	}
+	return reflect.MakeFunc(t, func(in []reflect.Value) []reflect.Value {
+		if replyType == nil {
+			err := c.Call(serviceMethod, in[0].Interface(), nil)
+			return []reflect.Value{errorValue(err)}
+		}
+		reply := reflect.New(replyType)
+		err := c.Call(serviceMethod, in[0].Interface(), reply.Interface())
+		return []reflect.Value{reply.Elem(), errorValue(err)}
+	}), nil
+}
+
+// errorValue returns err as a reflect.Value of type error, which is the zero
+// Value's counterpart for a nil error.
+func errorValue(err error) reflect.Value {
+	if err == nil {
+		return reflect.Zero(typeOfError)
+	}
+	return reflect.ValueOf(&err).Elem()
+}
@@ -0,0 +1,56 @@
+package pie
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBind(t *testing.T) {
+	p := startHelper(t, "provider", nil)
+	defer p.Close()
+
+	var proxy struct {
+		SayHi   func(string) (string, error)
+		Greet   func(string) (string, error) `pie:"SayHi"`
+		Discard func(string) error           `pie:"SayHi"`
+		Missing func(string) (string, error)
+		Skipped int `pie:"-"`
+	}
+	if err := Bind(p, "api", &proxy); err != nil {
+		t.Fatalf("Unexpected error from Bind: %#v", err)
+	}
+	if hi, err := proxy.SayHi("bob"); err != nil || hi != "Hi bob" {
+		t.Errorf("Wrong result from bound SayHi, expected %q, got %q, %#v", "Hi bob", hi, err)
+	}
+	if hi, err := proxy.Greet("sue"); err != nil || hi != "Hi sue" {
+		t.Errorf("Wrong result from renamed proxy, expected %q, got %q, %#v", "Hi sue", hi, err)
+	}
+	if err := proxy.Discard("bob"); err != nil {
+		t.Errorf("Unexpected error from proxy without result: %#v", err)
+	}
+	if _, err := proxy.Missing("bob"); err == nil || !strings.Contains(err.Error(), "Missing") {
+		t.Errorf("Expected error calling missing method, got %#v", err)
+	}
+	if p.Calls() != 4 {
+		t.Errorf("Expected proxy calls to go through the Plugin, got %d calls", p.Calls())
+	}
+}
+
+func TestBindInvalid(t *testing.T) {
+	tests := []struct {
+		proxy interface{}
+		err   string
+	}{
+		{struct{ F func(string) error }{}, "pointer to a struct"},
+		{&struct{ F int }{}, "field F"},
+		{&struct{ F func(string, string) error }{}, "one argument"},
+		{&struct{ F func(string) string }{}, "must return"},
+		{&struct{ f func(string) error }{}, "not exported"},
+	}
+	for _, test := range tests {
+		err := Bind(nil, "api", test.proxy)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Expected error containing %q binding %T, got %v", test.err, test.proxy, err)
+		}
+	}
+}
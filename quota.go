@@ -0,0 +1,162 @@
+package pie
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrQuotaExceeded is matched by the *QuotaError a Manager returns for a call
+// or channel that would exceed its plugin's Quota.  Check for it with
+// errors.Is.
+var ErrQuotaExceeded = errors.New("plugin quota exceeded")
+
+// Quota limits how much a Manager lets the host use a plugin, protecting the
+// host from plugins that are buggy or malicious, such as plugins that answer
+// with huge replies.  Zero fields mean no limit.
+type Quota struct {
+	// CallsPerMinute is how many calls a Manager makes to the plugin in each
+	// minute.
+	CallsPerMinute int
+	// BytesPerMinute is how many bytes may be sent to and received from the
+	// plugin in each minute.  A call that goes over the limit completes, but
+	// later calls are refused until the minute is over.
+	BytesPerMinute int64
+	// MaxStreams is how many channels opened with Manager.OpenChannel may be
+	// open at once.
+	MaxStreams int
+}
+
+// QuotaError is returned by a Manager for a call or channel that would exceed
+// its plugin's Quota.  It is also the Err of the EventQuotaExceeded event
+// emitted the first time in a minute that a limit is hit.
+type QuotaError struct {
+	// Name is the plugin's name.
+	Name string
+	// Limit describes the limit that was hit, such as "calls per minute".
+	Limit string
+	// Max is the limit's value.
+	Max int64
+}
+
+// Error implements the error interface.
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("plugin %s exceeded its quota of %d %s", e.Name, e.Max, e.Limit)
+}
+
+// Is reports whether target is ErrQuotaExceeded.
+func (e *QuotaError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+// quotaWindow is how long the per-minute limits of a Quota count usage for.
+const quotaWindow = time.Minute
+
+// quotaState tracks a managed plugin's usage of its Quota.
+type quotaState struct {
+	name  string
+	quota Quota
+
+	mu      sync.Mutex
+	start   time.Time
+	calls   int
+	bytes   int64
+	streams int
+	// plugin is the instance whose traffic was last counted, and seen is its
+	// byte count at the time.
+	plugin *Plugin
+	seen   uint64
+	// reported records the limits already reported in this window.
+	reported map[string]bool
+}
+
+// newQuotaState returns the state of a plugin with the given quota, or nil if
+// the quota has no limits.
+func newQuotaState(name string, q Quota) *quotaState {
+	if q == (Quota{}) {
+		return nil
+	}
+	return &quotaState{name: name, quota: q}
+}
+
+// admitCall checks that a call to p is within the quota, and counts it.  It
+// returns a *QuotaError, and whether the error should be reported with an
+// event, if not.
+func (q *quotaState) admitCall(p *Plugin) (*QuotaError, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.roll()
+	q.count(p)
+	if max := q.quota.CallsPerMinute; max > 0 && q.calls >= max {
+		return q.exceeded("calls per minute", int64(max))
+	}
+	if max := q.quota.BytesPerMinute; max > 0 && q.bytes >= max {
+		return q.exceeded("bytes per minute", max)
+	}
+	q.calls++
+	return nil, false
+}
+
+// done counts the traffic of a call to p that has finished.
+func (q *quotaState) done(p *Plugin) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.roll()
+	q.count(p)
+}
+
+// admitStream checks that another stream is within the quota, and counts it.
+func (q *quotaState) admitStream() (*QuotaError, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.roll()
+	if max := q.quota.MaxStreams; max > 0 && q.streams >= max {
+		return q.exceeded("concurrent streams", int64(max))
+	}
+	q.streams++
+	return nil, false
+}
+
+// closeStream counts a stream admitted by admitStream as closed.
+func (q *quotaState) closeStream() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.streams--
+}
+
+// roll starts a new window if the current one is over.  q.mu must be held.
+func (q *quotaState) roll() {
+	now := time.Now()
+	if now.Sub(q.start) < quotaWindow {
+		return
+	}
+	q.start = now
+	q.calls = 0
+	q.bytes = 0
+	q.reported = nil
+}
+
+// count adds the bytes p has sent and received since they were last counted.
+// q.mu must be held.
+func (q *quotaState) count(p *Plugin) {
+	stats := p.ConnStats()
+	total := stats.BytesRead + stats.BytesWritten
+	if p != q.plugin {
+		// A new instance starts counting from zero.
+		q.plugin, q.seen = p, 0
+	}
+	q.bytes += int64(total - q.seen)
+	q.seen = total
+}
+
+// exceeded returns the error for hitting the given limit, and whether it is the
+// first time in the window.  q.mu must be held.
+func (q *quotaState) exceeded(limit string, max int64) (*QuotaError, bool) {
+	first := !q.reported[limit]
+	if q.reported == nil {
+		q.reported = map[string]bool{}
+	}
+	q.reported[limit] = true
+	return &QuotaError{Name: q.name, Limit: limit, Max: max}, first
+}
@@ -0,0 +1,102 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// quotaManager starts the helper provider under a Manager with the given quota.
+func quotaManager(t *testing.T, q Quota, opts ...StartOption) (*Manager, eventRecorder) {
+	events := newEventRecorder()
+	m := &Manager{OnEvent: events.record, Quota: q}
+	spec := helperSpec("foo", "provider")
+	spec.Options = opts
+	if err := m.Start(context.Background(), spec); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m, events
+}
+
+func TestQuotaCallsPerMinute(t *testing.T) {
+	m, events := quotaManager(t, Quota{CallsPerMinute: 2})
+	var reply string
+	for i := 0; i < 2; i++ {
+		if err := m.Call("foo", "api.SayHi", "bob", &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		err := m.Call("foo", "api.SayHi", "bob", &reply)
+		var qerr *QuotaError
+		if !errors.As(err, &qerr) || !errors.Is(err, ErrQuotaExceeded) {
+			t.Fatalf("expected quota error, got %v", err)
+		}
+		if qerr.Name != "foo" || qerr.Limit != "calls per minute" || qerr.Max != 2 {
+			t.Fatalf("unexpected quota error %+v", qerr)
+		}
+	}
+	e := events.waitFor(t, EventQuotaExceeded)
+	if e.Name != "foo" {
+		t.Fatalf("expected event for foo, got %q", e.Name)
+	}
+	for {
+		select {
+		case e := <-events:
+			if e.Kind == EventQuotaExceeded {
+				t.Fatal("expected the quota to be reported once a minute")
+			}
+			continue
+		default:
+		}
+		break
+	}
+}
+
+func TestQuotaBytesPerMinute(t *testing.T) {
+	m, _ := quotaManager(t, Quota{BytesPerMinute: 100})
+	var reply string
+	if err := m.Call("foo", "api.SayHi", "bob", &reply); err != nil {
+		t.Fatal(err)
+	}
+	err := m.Call("foo", "api.SayHi", "bob", &reply)
+	var qerr *QuotaError
+	if !errors.As(err, &qerr) || qerr.Limit != "bytes per minute" {
+		t.Fatalf("expected bytes quota error, got %v", err)
+	}
+}
+
+func TestQuotaMaxStreams(t *testing.T) {
+	m, _ := quotaManager(t, Quota{MaxStreams: 1}, WithMux())
+	s, err := m.OpenChannel("foo", "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.OpenChannel("foo", "echo"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected quota error, got %v", err)
+	}
+	s.Close()
+	s, err = m.OpenChannel("foo", "echo")
+	if err != nil {
+		t.Fatalf("expected a stream once the first was closed, got %v", err)
+	}
+	s.Close()
+}
+
+func TestSpecQuotaOverridesManager(t *testing.T) {
+	events := newEventRecorder()
+	m := &Manager{OnEvent: events.record, Quota: Quota{CallsPerMinute: 1}}
+	spec := helperSpec("foo", "provider")
+	spec.Quota = Quota{CallsPerMinute: 3}
+	if err := m.Start(context.Background(), spec); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	var reply string
+	for i := 0; i < 3; i++ {
+		if err := m.Call("foo", "api.SayHi", "bob", &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package pie
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultReloadInterval is how often Supervisor.Watch polls for changes by
+// default.
+const defaultReloadInterval = 500 * time.Millisecond
+
+// Reload describes the files a Supervisor watches while a plugin is being
+// developed, and how to rebuild the plugin when they change.
+type Reload struct {
+	// Paths are the files and directories to watch, such as the plugin's
+	// executable or its source directory.  Directories are watched with the
+	// files and directories in them, except for those whose names start with
+	// a dot, such as .git.
+	Paths []string
+	// Build, if not empty, is the command, with its arguments, run to rebuild
+	// the plugin before it is restarted, such as
+	// []string{"go", "build", "-o", "bin/plugin", "./plugin"}.  If it fails,
+	// the plugin keeps running.
+	Build []string
+	// Dir is the working directory of Build.  It defaults to the host's.
+	Dir string
+	// Output, if not nil, is where Build's stdout and stderr are written.
+	Output io.Writer
+	// Interval is how often the paths are checked for changes.  It defaults
+	// to half a second.  Since the paths must look the same twice in a row
+	// before the plugin is reloaded, files still being written, such as an
+	// executable being linked, are not picked up half done.
+	Interval time.Duration
+}
+
+// BuildError is the error of a Reload's Build command that failed.
+type BuildError struct {
+	Command []string
+	// Output is what the command wrote to stdout and stderr.
+	Output []byte
+	Err    error
+}
+
+// Error implements the error interface.
+func (e *BuildError) Error() string {
+	msg := fmt.Sprintf("pie: rebuilding plugin with %q failed: %v", strings.Join(e.Command, " "), e.Err)
+	if out := bytes.TrimSpace(e.Output); len(out) > 0 {
+		msg += "\n" + string(out)
+	}
+	return msg
+}
+
+// Unwrap returns the command's error.
+func (e *BuildError) Unwrap() error {
+	return e.Err
+}
+
+// Watch reloads the plugin each time the files described by r change, until
+// the returned function is called or the Supervisor is closed: it runs r's
+// Build command, if any, and then starts a new instance with the function the
+// Supervisor starts instances with, and swaps it in the way Replace does.  Each
+// reload emits an EventReloaded, or an EventReloadFailed if the build or the
+// start failed, in which case the current instance is left running.  A plugin
+// the Supervisor gave up restarting is brought back by the next successful
+// reload.  Watch is meant for development, to save plugin authors from
+// restarting the host after each change.
+func (s *Supervisor) Watch(r Reload) (stop func(), err error) {
+	if len(r.Paths) == 0 {
+		return nil, errors.New("pie: no paths to watch")
+	}
+	if s.isClosed() {
+		return nil, rpc.ErrShutdown
+	}
+	interval := r.Interval
+	if interval <= 0 {
+		interval = defaultReloadInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	loaded := snapshot(r.Paths)
+	go func() {
+		defer close(done)
+		s.watch(ctx, r, loaded, interval)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}, nil
+}
+
+// watch polls the files described by r every interval, reloading the plugin
+// once they have changed from loaded and stopped changing, until ctx is done
+// or the Supervisor is closed.
+func (s *Supervisor) watch(ctx context.Context, r Reload, loaded fileStamps, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	last := loaded
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.done:
+			return
+		case <-t.C:
+		}
+		now := snapshot(r.Paths)
+		settled := now.equal(last)
+		last = now
+		if !settled || now.equal(loaded) {
+			continue
+		}
+		s.reload(ctx, r)
+		// The build may itself change the paths, such as by writing the
+		// executable into a watched source directory.
+		loaded = snapshot(r.Paths)
+		last = loaded
+	}
+}
+
+// reload rebuilds the plugin as described by r and swaps in a new instance.
+func (s *Supervisor) reload(ctx context.Context, r Reload) {
+	if len(r.Build) > 0 {
+		if err := r.build(ctx); err != nil {
+			if ctx.Err() == nil {
+				s.emit(Event{Kind: EventReloadFailed, Err: err})
+			}
+			return
+		}
+	}
+	np, err := s.starter()()
+	if err != nil {
+		s.emit(Event{Kind: EventReloadFailed, Err: err})
+		return
+	}
+	if old, ok := s.swap(nil, np, nil, EventReloaded); ok {
+		old.drain(s.drainTimeout(), s.done)
+		old.Close()
+	}
+}
+
+// build runs r's Build command.
+func (r Reload) build(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, r.Build[0], r.Build[1:]...)
+	cmd.Dir = r.Dir
+	var out bytes.Buffer
+	var w io.Writer = &out
+	if r.Output != nil {
+		w = io.MultiWriter(r.Output, &out)
+	}
+	cmd.Stdout, cmd.Stderr = w, w
+	if err := cmd.Run(); err != nil {
+		return &BuildError{Command: r.Build, Output: out.Bytes(), Err: err}
+	}
+	return nil
+}
+
+// fileStamps maps the paths of watched files to their stamps.  Files are taken
+// to have changed when their size or modification time has.
+type fileStamps map[string]fileStamp
+
+// snapshot returns the stamps of the files at or under paths.  Files that
+// cannot be read are left out, so that they count as changed once they can.
+func snapshot(paths []string) fileStamps {
+	stamps := fileStamps{}
+	for _, root := range paths {
+		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if path != root && strings.HasPrefix(d.Name(), ".") {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.IsDir() {
+				return nil
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil
+			}
+			stamps[path] = fileStamp{info.Size(), info.ModTime()}
+			return nil
+		})
+	}
+	return stamps
+}
+
+// equal reports whether f and g hold the same files with the same stamps.
+func (f fileStamps) equal(g fileStamps) bool {
+	if len(f) != len(g) {
+		return false
+	}
+	for path, stamp := range f {
+		if other, ok := g[path]; !ok || other != stamp {
+			return false
+		}
+	}
+	return true
+}
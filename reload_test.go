@@ -0,0 +1,119 @@
+package pie
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// watched starts supervising the helper plugin, reloading it when the files in
+// a new directory change, and returns the directory.
+func watched(t *testing.T, events eventRecorder, build ...string) (*Supervisor, string) {
+	t.Helper()
+	s, err := Supervise(helperStarter("provider"), Policy{OnEvent: events.record})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	dir := t.TempDir()
+	stop, err := s.Watch(Reload{Paths: []string{dir}, Build: build, Interval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(stop)
+	return s, dir
+}
+
+// writeFile writes data to the named file, failing the test if it cannot.
+func writeFile(t *testing.T, name, data string) {
+	t.Helper()
+	if err := os.WriteFile(name, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchReloads(t *testing.T) {
+	events := newEventRecorder()
+	s, dir := watched(t, events)
+	old, _ := s.Plugin()
+	writeFile(t, filepath.Join(dir, "plugin.go"), "package main")
+	e := events.waitFor(t, EventReloaded)
+	if p, _ := s.Plugin(); p != e.Plugin || p == old {
+		t.Error("Expected the reloaded instance to be current")
+	}
+	select {
+	case <-old.Exited():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the old instance to be closed")
+	}
+	var reply string
+	if err := s.Call("api.SayHi", "bob", &reply); err != nil || reply != "Hi bob" {
+		t.Errorf("Expected Hi bob, got %q, %v", reply, err)
+	}
+
+	// Only changes count, and hidden files are not watched.
+	writeFile(t, filepath.Join(dir, ".plugin.go.swp"), "x")
+	time.Sleep(100 * time.Millisecond)
+	if len(events) > 0 {
+		t.Errorf("Expected no more events, got %v", (<-events).Kind)
+	}
+	writeFile(t, filepath.Join(dir, "plugin.go"), "package main // changed")
+	events.waitFor(t, EventReloaded)
+}
+
+func TestWatchBuilds(t *testing.T) {
+	events := newEventRecorder()
+	// The helper plugin exits right away in an unknown mode.
+	s, dir := watched(t, events, os.Args[0], helperFlag+"none")
+	writeFile(t, filepath.Join(dir, "plugin.go"), "package main")
+	events.waitFor(t, EventReloaded)
+	if _, err := s.Plugin(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchBuildFails(t *testing.T) {
+	events := newEventRecorder()
+	s, dir := watched(t, events, os.Args[0], helperFlag+"exit")
+	old, _ := s.Plugin()
+	writeFile(t, filepath.Join(dir, "plugin.go"), "package main")
+	e := events.waitFor(t, EventReloadFailed)
+	var berr *BuildError
+	if !errors.As(e.Err, &berr) || berr.Command[0] != os.Args[0] {
+		t.Errorf("Expected a build error, got %v", e.Err)
+	}
+	if p, _ := s.Plugin(); p != old {
+		t.Error("Expected the plugin to keep running after a failed build")
+	}
+}
+
+func TestWatchNoPaths(t *testing.T) {
+	s, err := Supervise(helperStarter("provider"), Policy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Watch(Reload{}); err == nil {
+		t.Error("Expected an error watching no paths")
+	}
+}
+
+func TestFileStamps(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a"), "a")
+	before := snapshot([]string{dir})
+	if !before.equal(snapshot([]string{dir})) {
+		t.Error("Expected unchanged files to have the same stamps")
+	}
+	writeFile(t, filepath.Join(dir, "a"), "ab")
+	if before.equal(snapshot([]string{dir})) {
+		t.Error("Expected a changed file to have a new stamp")
+	}
+	os.Mkdir(filepath.Join(dir, ".git"), 0o755)
+	writeFile(t, filepath.Join(dir, ".git", "HEAD"), "ref")
+	if n := len(snapshot([]string{dir})); n != 1 {
+		t.Errorf("Expected hidden directories to be skipped, got %d files", n)
+	}
+}
@@ -0,0 +1,373 @@
+package pie
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ErrReplyTooLarge is matched by the error of a call whose reply was larger
+// than the limit set with WithMaxReplySize.  Check for it with errors.Is.
+var ErrReplyTooLarge = errors.New("reply too large")
+
+// errReplyTooLarge is returned to gob by a gobMessageReader that refused to
+// let it read an oversized message.
+var errReplyTooLarge = errors.New("pie: reply exceeds the maximum size")
+
+// errReplyCutShort is returned for good by a replyBudget once a reply went over
+// the limit, since the codec reading from it cannot find where the next reply
+// starts.
+var errReplyCutShort = fmt.Errorf("pie: connection closed by an oversized reply: %w", ErrReplyTooLarge)
+
+// ReplyTooLargeError is returned by calls whose reply was larger than the limit
+// set with WithMaxReplySize.  The reply is discarded without being decoded.
+type ReplyTooLargeError struct {
+	Method string
+	// Size is the size of the reply, or of the part that was read before it
+	// went over the limit.
+	Size  int
+	Limit int
+}
+
+// Error implements the error interface.
+func (e *ReplyTooLargeError) Error() string {
+	return fmt.Sprintf("reply to %s is at least %d bytes, the limit is %d", e.Method, e.Size, e.Limit)
+}
+
+// Is reports whether target is ErrReplyTooLarge.
+func (e *ReplyTooLargeError) Is(target error) bool {
+	return target == ErrReplyTooLarge
+}
+
+// CallMetrics describes a call made through Plugin.Call or one of its variants.
+type CallMetrics struct {
+	Method   string
+	Duration time.Duration
+	// ReplyBytes is the size of the encoded reply.  With codecs other than
+	// gob, it is the number of bytes read from the connection while the
+	// response was read, header included, which can take in the start of the
+	// next response.
+	ReplyBytes int
+	Err        error
+}
+
+// WithMaxReplySize limits the size of each reply the plugin sends to max bytes.
+// A call whose reply is larger fails with a *ReplyTooLargeError, and the reply
+// is skipped without being read into memory, so that a buggy plugin cannot
+// make the host run out of memory.  With gob encoding, the default, an
+// oversized reply to a call made directly through Plugin.Client shuts the
+// client down, as net/rpc does for any reply it cannot read.
+//
+// Other codecs are limited by the bytes read from the connection up to the
+// next response, which can go over max by up to one read of 4 KiB, or of max
+// bytes if that is smaller.  Since such codecs cannot skip the rest of an
+// oversized reply, it shuts the client down, and every call still waiting for
+// a reply fails with an error that matches ErrReplyTooLarge.
+func WithMaxReplySize(max int) StartOption {
+	return func(o *startOptions) {
+		o.maxReply = max
+	}
+}
+
+// WithCallMetrics makes the plugin handle call record with the measurements of
+// each call made through Plugin.Call and its variants, after the call returns.
+// It is called from the goroutine that made the call.
+func WithCallMetrics(record func(CallMetrics)) StartOption {
+	return func(o *startOptions) {
+		o.callMetrics = record
+	}
+}
+
+// replySize is what a clientCodec measured of a reply.
+type replySize struct {
+	bytes    int
+	tooLarge bool
+}
+
+// replySizer is implemented by the ClientCodecs that can measure the replies
+// they read, and by replyBudget for those that cannot.
+type replySizer interface {
+	// setReplyLimit limits the size of the replies read to max bytes.
+	setReplyLimit(max int)
+	// lastReplySize returns the measurements of the last reply body read.
+	lastReplySize() replySize
+}
+
+// watchReply makes the codec record the size of the reply decoded into reply,
+// which is a call's reply pointer, until it is taken with takeReplySize.  It
+// reports whether the codec can measure replies.
+func (c *clientCodec) watchReply(reply interface{}) bool {
+	if c.sizer() == nil {
+		return false
+	}
+	c.repliesMu.Lock()
+	defer c.repliesMu.Unlock()
+	if c.replies == nil {
+		c.replies = map[interface{}]replySize{}
+		c.aliases = map[interface{}]interface{}{}
+	}
+	c.replies[reply] = replySize{}
+	return true
+}
+
+// aliasReply makes the reply decoded into alias count as the one watched or
+// deferred for reply, until unaliasReply is called.
+func (c *clientCodec) aliasReply(alias, reply interface{}) {
+	c.repliesMu.Lock()
+	defer c.repliesMu.Unlock()
+	_, watched := c.replies[reply]
+	_, deferred := c.deferred[reply]
+	if watched || deferred {
+		c.aliases[alias] = reply
+	}
+}
+
+func (c *clientCodec) unaliasReply(alias interface{}) {
+	c.repliesMu.Lock()
+	defer c.repliesMu.Unlock()
+	delete(c.aliases, alias)
+}
+
+// sizer returns what measures the replies c reads, or nil if nothing does.
+func (c *clientCodec) sizer() replySizer {
+	if sizer, ok := c.ClientCodec.(replySizer); ok {
+		return sizer
+	}
+	if c.budget != nil {
+		return c.budget
+	}
+	return nil
+}
+
+// takeReplySize returns the size recorded for reply, and stops watching it.
+func (c *clientCodec) takeReplySize(reply interface{}) replySize {
+	c.repliesMu.Lock()
+	defer c.repliesMu.Unlock()
+	size := c.replies[reply]
+	delete(c.replies, reply)
+	return size
+}
+
+// ReadResponseBody reads a response body, recording its size if it is watched.
+// net/rpc shuts the client down when a body cannot be read, so a watched reply
+// that was too large counts as read, and the call it belongs to reports the
+// error instead.  Unwatched replies that are too large, such as those of calls
+// made directly through the rpc.Client, still shut the client down.
+//
+// Deferred replies are read without being decoded.
+func (c *clientCodec) ReadResponseBody(body interface{}) error {
+	deferred, err := c.readDeferred(body)
+	if !deferred {
+		err = c.usedMarshalers().readBody(body, c.ClientCodec.ReadResponseBody)
+	}
+	sizer := c.sizer()
+	if sizer == nil || body == nil {
+		return err
+	}
+	c.repliesMu.Lock()
+	defer c.repliesMu.Unlock()
+	key := body
+	if reply, ok := c.aliases[body]; ok {
+		key = reply
+	}
+	if _, ok := c.replies[key]; ok {
+		size := sizer.lastReplySize()
+		c.replies[key] = size
+		if size.tooLarge && (errors.Is(err, errReplyTooLarge) || errors.Is(err, errReplyCutShort)) {
+			return nil
+		}
+	}
+	return err
+}
+
+// gobMessageReader sits between a gob.Decoder and the connection, following
+// the boundaries of the messages gob reads so that it can measure replies and
+// stop gob from reading a message that would make a reply too large.  Gob
+// messages are a length, encoded as a gob unsigned integer, followed by that
+// many bytes, which start with a type ID that is negative for type definitions.
+type gobMessageReader struct {
+	r interface {
+		io.Reader
+		io.ByteReader
+	}
+	// prefix holds the bytes of the length of the message being started, and
+	// remaining is the number of bytes of the current message gob has yet to
+	// read.
+	prefix    []byte
+	remaining uint64
+
+	// While armed, used counts the bytes of the messages started, and
+	// messages that would make used exceed limit, if it is not zero, are
+	// skipped.
+	armed    bool
+	limit    uint64
+	used     uint64
+	tooLarge bool
+	// broken is the error returned for good once a message gob needed had to
+	// be skipped.
+	broken error
+}
+
+// arm starts measuring the messages read.
+func (r *gobMessageReader) arm() {
+	r.armed, r.used, r.tooLarge = true, 0, false
+}
+
+// disarm stops measuring, and returns what was measured since arm.
+func (r *gobMessageReader) disarm() replySize {
+	r.armed = false
+	return replySize{bytes: int(r.used), tooLarge: r.tooLarge}
+}
+
+// ReadByte reads a single byte, so that gob does not buffer r.
+func (r *gobMessageReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r, b[:])
+	return b[0], err
+}
+
+// Read reads the current message, or the next byte of the length of the next
+// one.
+func (r *gobMessageReader) Read(p []byte) (int, error) {
+	if r.broken != nil {
+		return 0, r.broken
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if r.remaining > 0 {
+		if uint64(len(p)) > r.remaining {
+			p = p[:r.remaining]
+		}
+		n, err := r.r.Read(p)
+		r.remaining -= uint64(n)
+		return n, err
+	}
+	b, err := r.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	r.prefix = append(r.prefix, b)
+	size, done := gobUint(r.prefix)
+	if !done {
+		p[0] = b
+		return 1, nil
+	}
+	total := uint64(len(r.prefix)) + size
+	r.prefix = r.prefix[:0]
+	if r.armed {
+		r.used += total
+		if r.limit > 0 && r.used > r.limit {
+			r.tooLarge = true
+			return 0, r.skip(size)
+		}
+	}
+	r.remaining = size
+	p[0] = b
+	return 1, nil
+}
+
+// skip discards a message of the given size that gob will not read, and
+// returns the error to give gob.  Gob can carry on if the message is a value,
+// but not if it is a type definition it will need for later messages.
+func (r *gobMessageReader) skip(size uint64) error {
+	var id []byte
+	for size > 0 {
+		b, err := r.r.ReadByte()
+		if err != nil {
+			r.broken = err
+			return err
+		}
+		size--
+		id = append(id, b)
+		if _, done := gobUint(id); done {
+			break
+		}
+	}
+	if _, err := io.CopyN(io.Discard, r.r, int64(size)); err != nil {
+		r.broken = err
+		return err
+	}
+	if u, _ := gobUint(id); u&1 != 0 {
+		r.broken = errReplyTooLarge
+	}
+	return errReplyTooLarge
+}
+
+// maxBudgetRead is the most a replyBudget with a limit reads at once.
+const maxBudgetRead = 4096
+
+// replyBudget sits between a codec other than gob and the connection, and
+// measures and limits each reply by the bytes read from the connection from
+// the start of its response to the start of the next.  It cannot see where
+// responses end, and a codec may read the start of the next response along with
+// the end of the last, so reads are kept short and a reply only goes over the
+// limit once it used a whole read more than that.
+type replyBudget struct {
+	io.ReadWriteCloser
+	limit    int
+	used     int
+	tooLarge bool
+}
+
+// arm starts measuring the response read next.
+func (b *replyBudget) arm() {
+	b.used = 0
+}
+
+// maxRead returns the most b reads at once.
+func (b *replyBudget) maxRead() int {
+	if b.limit < maxBudgetRead {
+		return b.limit
+	}
+	return maxBudgetRead
+}
+
+// Read reads from the connection, failing for good once a reply went over the
+// limit.
+func (b *replyBudget) Read(p []byte) (int, error) {
+	if b.tooLarge {
+		return 0, errReplyCutShort
+	}
+	if b.limit > 0 && len(p) > b.maxRead() {
+		p = p[:b.maxRead()]
+	}
+	n, err := b.ReadWriteCloser.Read(p)
+	b.used += n
+	if b.limit > 0 && b.used > b.limit+b.maxRead() {
+		b.tooLarge = true
+		return 0, errReplyCutShort
+	}
+	return n, err
+}
+
+func (b *replyBudget) setReplyLimit(max int) {
+	if max > 0 {
+		b.limit = max
+	}
+}
+
+func (b *replyBudget) lastReplySize() replySize {
+	return replySize{bytes: b.used, tooLarge: b.tooLarge}
+}
+
+// gobUint decodes the gob unsigned integer at the start of b, reporting whether
+// b holds all of it.
+func gobUint(b []byte) (uint64, bool) {
+	if len(b) == 0 {
+		return 0, false
+	}
+	if b[0] < 0x80 {
+		return uint64(b[0]), true
+	}
+	n := -int(int8(b[0]))
+	if n > 8 || len(b) < n+1 {
+		return 0, n > 8
+	}
+	var x uint64
+	for _, c := range b[1 : n+1] {
+		x = x<<8 | uint64(c)
+	}
+	return x, true
+}
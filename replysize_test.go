@@ -0,0 +1,155 @@
+package pie
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Blob is a reply with a payload of a chosen size.
+type Blob struct {
+	Data []byte
+}
+
+// blobAPI returns replies of the size asked for.
+type blobAPI struct{}
+
+func (blobAPI) Bytes(n int, b *[]byte) error {
+	*b = make([]byte, n)
+	return nil
+}
+
+func (blobAPI) Blob(n int, b *Blob) error {
+	b.Data = make([]byte, n)
+	return nil
+}
+
+// blobServer returns a provider serving blobAPI.
+func blobServer() Server {
+	s := NewProvider()
+	s.RegisterName("blob", blobAPI{})
+	return s
+}
+
+func testMaxReplySize(t *testing.T, p *Plugin) {
+	var b []byte
+	err := p.Call("blob.Bytes", 10000, &b)
+	var rerr *ReplyTooLargeError
+	if !errors.As(err, &rerr) || !errors.Is(err, ErrReplyTooLarge) {
+		t.Fatalf("Expected a *ReplyTooLargeError, got %v", err)
+	}
+	if rerr.Method != "blob.Bytes" || rerr.Limit != 1000 || rerr.Size <= 10000 {
+		t.Errorf("Wrong error: %+v", rerr)
+	}
+	if len(b) != 0 {
+		t.Errorf("Expected the reply not to be decoded, got %d bytes", len(b))
+	}
+	// The connection carries on after the oversized reply is skipped, even
+	// when the reply's type is first seen in it.
+	if err := p.Call("blob.Bytes", 100, &b); err != nil || len(b) != 100 {
+		t.Fatalf("Expected 100 bytes, got %d, error %v", len(b), err)
+	}
+	var blob Blob
+	if err := p.Call("blob.Blob", 10000, &blob); !errors.Is(err, ErrReplyTooLarge) {
+		t.Fatalf("Expected ErrReplyTooLarge, got %v", err)
+	}
+	if err := p.Call("blob.Blob", 100, &blob); err != nil || len(blob.Data) != 100 {
+		t.Fatalf("Expected 100 bytes, got %d, error %v", len(blob.Data), err)
+	}
+}
+
+func TestWithMaxReplySize(t *testing.T) {
+	testMaxReplySize(t, pipePlugin(t, blobServer(), WithMaxReplySize(1000)))
+}
+
+func TestWithMaxReplySizeCallTimeout(t *testing.T) {
+	testMaxReplySize(t, pipePlugin(t, blobServer(), WithMaxReplySize(1000), WithTimeouts(Timeouts{Call: 5 * time.Second})))
+}
+
+func TestWithMaxReplySizeNegotiated(t *testing.T) {
+	testMaxReplySize(t, pipePlugin(t, blobServer(), WithMaxReplySize(1000), WithCodecs("gob")))
+}
+
+func TestWithMaxReplySizeJSON(t *testing.T) {
+	p := pipePlugin(t, blobServer(), WithMaxReplySize(1000), WithCodecs("json"))
+	// Replies under the limit get through, even when several are read at once.
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var b []byte
+			if err := p.Call("blob.Bytes", 500, &b); err != nil || len(b) != 500 {
+				errs <- fmt.Errorf("expected 500 bytes, got %d, error %v", len(b), err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	var b []byte
+	if err := p.Call("blob.Bytes", 100000, &b); !errors.Is(err, ErrReplyTooLarge) {
+		t.Fatalf("Expected ErrReplyTooLarge, got %v", err)
+	}
+	if len(b) != 0 {
+		t.Errorf("Expected the reply not to be decoded, got %d bytes", len(b))
+	}
+	// The rest of the oversized reply cannot be skipped, so the client is
+	// shut down.
+	if err := p.Call("blob.Bytes", 100, &b); err == nil {
+		t.Fatal("Expected the client to be shut down")
+	}
+}
+
+func TestWithCallMetrics(t *testing.T) {
+	var mu sync.Mutex
+	var metrics []CallMetrics
+	p := pipePlugin(t, blobServer(), WithCallMetrics(func(m CallMetrics) {
+		mu.Lock()
+		metrics = append(metrics, m)
+		mu.Unlock()
+	}))
+	if err := p.Call("blob.Bytes", 500, new([]byte)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Call("blob.Missing", 0, new(int)); err == nil {
+		t.Fatal("Expected an error calling a missing method")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(metrics) != 2 {
+		t.Fatalf("Expected 2 calls measured, got %d", len(metrics))
+	}
+	m := metrics[0]
+	if m.Method != "blob.Bytes" || m.Err != nil || m.ReplyBytes < 500 || m.ReplyBytes > 600 || m.Duration <= 0 {
+		t.Errorf("Wrong metrics for blob.Bytes: %+v", m)
+	}
+	if m := metrics[1]; m.Method != "blob.Missing" || m.Err == nil {
+		t.Errorf("Wrong metrics for blob.Missing: %+v", m)
+	}
+}
+
+func TestGobUint(t *testing.T) {
+	tests := []struct {
+		b    []byte
+		want uint64
+		done bool
+	}{
+		{nil, 0, false},
+		{[]byte{0x7f}, 127, true},
+		{[]byte{0xfe}, 0, false},
+		{[]byte{0xfe, 0x01}, 0, false},
+		{[]byte{0xfe, 0x01, 0x00}, 256, true},
+	}
+	for _, tt := range tests {
+		got, done := gobUint(tt.b)
+		if got != tt.want || done != tt.done {
+			t.Errorf("gobUint(%x) = %d, %v; expected %d, %v", tt.b, got, done, tt.want, tt.done)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package pie
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+)
+
+// CallError is returned by calls made through a handle started with
+// WithRequestIDs when they fail.  It carries the call's request ID, which the
+// provider also sees, so that a failed operation in the host can be matched
+// with what the plugin logged while serving it.
+type CallError struct {
+	// Method is the method that was called.
+	Method string
+	// RequestID is the ID the call was sent with.
+	RequestID string
+	// Err is the error the call failed with.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *CallError) Error() string {
+	return e.Err.Error() + " (request " + e.RequestID + ")"
+}
+
+// Unwrap returns the error the call failed with.
+func (e *CallError) Unwrap() error {
+	return e.Err
+}
+
+// WithRequestIDs makes the handle send a unique request ID with each call made
+// through Call and its variants, which methods that take a context.Context
+// can get with RequestID, and a provider's request log records.  Calls that
+// fail return a *CallError carrying the ID.  If logf is not nil, such as
+// log.Printf, failed calls are also logged with it, with their IDs.  Request
+// IDs require a provider created with NewProvider.
+func WithRequestIDs(logf func(format string, v ...interface{})) StartOption {
+	return func(o *startOptions) {
+		o.requestIDs = true
+		o.requestLog = logf
+	}
+}
+
+// SetRequestLog makes the Server log the calls carrying request IDs, sent by
+// hosts that use WithRequestIDs, that fail, with their IDs, using logf, which
+// may be log.Printf.  It applies to connections served after it is called.
+func (s Server) SetRequestLog(logf func(format string, v ...interface{})) error {
+	if s.d == nil {
+		return errors.New("pie: server cannot be configured")
+	}
+	s.d.regMu.Lock()
+	defer s.d.regMu.Unlock()
+	s.d.requestLog = logf
+	return nil
+}
+
+// requestIDKey is the context key of a call's request ID.
+type requestIDKey struct{}
+
+// RequestID returns the request ID of the call the method given ctx is
+// serving, or an empty string if the host sent none.  Methods can include it
+// in what they log, so that their log lines can be found from the host's
+// error.  Only methods that take a context.Context can see their request ID.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// newRequestID returns a new random request ID.
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// The ID only correlates logs, so a failure of the system's random
+		// source is no reason to fail the call.
+		return "0000000000000000"
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,130 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// requestAPI records the request IDs of the calls it serves.
+type requestAPI struct {
+	mu  sync.Mutex
+	ids []string
+}
+
+func (a *requestAPI) Fail(ctx context.Context, msg string) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.ids = append(a.ids, RequestID(ctx))
+	if msg != "" {
+		return 0, errors.New(msg)
+	}
+	return 1, nil
+}
+
+// logRecorder records what is logged to it.
+type logRecorder struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *logRecorder) logf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func (l *logRecorder) all() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.lines...)
+}
+
+func TestRequestIDs(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	s := NewProviderConn(serverConn)
+	api := &requestAPI{}
+	s.RegisterName("api", api)
+	var pluginLog, hostLog logRecorder
+	s.SetRequestLog(pluginLog.logf)
+	go s.Serve()
+	p, err := NewPlugin(clientConn, WithRequestIDs(hostLog.logf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	var n int
+	if err := p.Call("api.Fail", "", &n); err != nil {
+		t.Fatal(err)
+	}
+	err = p.Call("api.Fail", "boom", &n)
+	var cerr *CallError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("Expected a *CallError, got %T: %v", err, err)
+	}
+	var serr rpc.ServerError
+	if !errors.As(err, &serr) || string(serr) != "boom" {
+		t.Errorf("Expected the provider's error to be wrapped, got %v", err)
+	}
+	if cerr.Method != "api.Fail" || !strings.Contains(err.Error(), cerr.RequestID) {
+		t.Errorf("Expected the error to name the call and its request ID, got %+v", cerr)
+	}
+
+	api.mu.Lock()
+	ids := api.ids
+	api.mu.Unlock()
+	if len(ids) != 2 || ids[0] == "" || ids[0] == ids[1] {
+		t.Fatalf("Expected two distinct request IDs, got %q", ids)
+	}
+	if ids[1] != cerr.RequestID {
+		t.Errorf("Expected the error to carry request ID %q, got %q", ids[1], cerr.RequestID)
+	}
+	for name, log := range map[string]*logRecorder{"host": &hostLog, "plugin": &pluginLog} {
+		lines := log.all()
+		if len(lines) != 1 || !strings.Contains(lines[0], cerr.RequestID) || !strings.Contains(lines[0], "boom") {
+			t.Errorf("Expected the %s to log the failed call with its ID, got %q", name, lines)
+		}
+	}
+}
+
+func TestRequestIDsStdMethod(t *testing.T) {
+	s := NewProvider()
+	s.RegisterName("api", api{})
+	var log logRecorder
+	s.SetRequestLog(log.logf)
+	p := pipePlugin(t, s)
+	p.requestIDs = true
+	var reply string
+	if err := p.Call("api.SayHi", "bob", &reply); err != nil || reply != "Hi bob" {
+		t.Fatalf("Expected a call with a request ID to net/rpc style method to work, got %q, %v", reply, err)
+	}
+	err := p.Call("api.Missing", "bob", &reply)
+	var cerr *CallError
+	if !errors.As(err, &cerr) || !isMissingMethod(err) {
+		t.Fatalf("Expected a *CallError for a missing method, got %v", err)
+	}
+	if lines := log.all(); len(lines) != 1 || !strings.Contains(lines[0], cerr.RequestID) {
+		t.Errorf("Expected the missing method to be logged with its ID, got %q", lines)
+	}
+}
+
+func TestNoRequestIDs(t *testing.T) {
+	s := NewProvider()
+	api := &requestAPI{}
+	s.RegisterName("api", api)
+	p := pipePlugin(t, s)
+	var n int
+	err := p.Call("api.Fail", "boom", &n)
+	if _, ok := err.(rpc.ServerError); !ok {
+		t.Errorf("Expected a plain rpc.ServerError without request IDs, got %T", err)
+	}
+	if len(api.ids) != 1 || api.ids[0] != "" {
+		t.Errorf("Expected no request ID, got %q", api.ids)
+	}
+}
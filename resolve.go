@@ -0,0 +1,117 @@
+package pie
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Resolver finds plugin binaries by logical name, searching a list of
+// directories for binaries built for a particular platform.  This supports the
+// common pattern of shipping a bundle of plugins for several platforms side by
+// side.
+//
+// For a plugin named "foo" on linux/amd64, each directory is searched for the
+// following files, in order:
+//
+//	foo_linux_amd64
+//	linux_amd64/foo
+//	foo
+//
+// On Windows, each candidate also gets an ".exe" suffix, unless the name
+// already has one.
+type Resolver struct {
+	// Dirs are the directories to search, in order.
+	Dirs []string
+	// GOOS and GOARCH are the platform to find binaries for.  They default to
+	// the platform the host is running on.
+	GOOS   string
+	GOARCH string
+}
+
+// ResolveError is returned by Resolver.Resolve when no binary could be found
+// for a plugin.  It matches fs.ErrNotExist with errors.Is.
+type ResolveError struct {
+	Name string
+	// Searched lists the paths that were tried, in order.
+	Searched []string
+}
+
+// Error implements the error interface.
+func (e *ResolveError) Error() string {
+	return "plugin " + e.Name + " not found, searched: " + strings.Join(e.Searched, ", ")
+}
+
+// Unwrap returns fs.ErrNotExist.
+func (e *ResolveError) Unwrap() error {
+	return fs.ErrNotExist
+}
+
+// WithResolver makes StartPlugin treat the path it is given as a logical
+// plugin name, and run the binary r resolves it to.
+func WithResolver(r Resolver) StartOption {
+	return func(o *startOptions) {
+		o.resolver = &r
+	}
+}
+
+// Candidates returns the file names tried in each directory when resolving
+// name, in order of preference.
+func (r Resolver) Candidates(name string) []string {
+	goos, goarch := r.platform()
+	platform := goos + "_" + goarch
+	names := []string{
+		name + "_" + platform,
+		filepath.Join(platform, name),
+		name,
+	}
+	if goos == "windows" {
+		for i, n := range names {
+			if !strings.HasSuffix(strings.ToLower(n), ".exe") {
+				names[i] = n + ".exe"
+			}
+		}
+	}
+	return names
+}
+
+// Resolve returns the path to the best binary for the named plugin.  If no
+// suitable binary is found, the error is a *ResolveError.
+func (r Resolver) Resolve(name string) (string, error) {
+	var searched []string
+	for _, dir := range r.Dirs {
+		for _, c := range r.Candidates(name) {
+			path := filepath.Join(dir, c)
+			searched = append(searched, path)
+			if isExecutable(path) {
+				return path, nil
+			}
+		}
+	}
+	return "", &ResolveError{Name: name, Searched: searched}
+}
+
+// platform returns the GOOS and GOARCH to resolve binaries for.
+func (r Resolver) platform() (goos, goarch string) {
+	goos, goarch = r.GOOS, r.GOARCH
+	if goos == "" {
+		goos = runtime.GOOS
+	}
+	if goarch == "" {
+		goarch = runtime.GOARCH
+	}
+	return goos, goarch
+}
+
+// isExecutable reports whether path is a regular file that could be executed.
+// On Windows, where there are no execute permission bits, any regular file
+// counts.
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	return runtime.GOOS == "windows" || info.Mode().Perm()&0111 != 0
+}
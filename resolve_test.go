@@ -0,0 +1,85 @@
+package pie
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestResolverCandidates(t *testing.T) {
+	r := Resolver{GOOS: "linux", GOARCH: "amd64"}
+	expected := []string{"foo_linux_amd64", filepath.Join("linux_amd64", "foo"), "foo"}
+	if c := r.Candidates("foo"); !reflect.DeepEqual(c, expected) {
+		t.Errorf("Wrong candidates, expected %q, got %q", expected, c)
+	}
+
+	r = Resolver{GOOS: "windows", GOARCH: "arm64"}
+	expected = []string{"foo_windows_arm64.exe", filepath.Join("windows_arm64", "foo.exe"), "foo.exe"}
+	if c := r.Candidates("foo"); !reflect.DeepEqual(c, expected) {
+		t.Errorf("Wrong candidates, expected %q, got %q", expected, c)
+	}
+}
+
+func TestResolverResolve(t *testing.T) {
+	first := t.TempDir()
+	second := t.TempDir()
+	touch := func(path string, perm os.FileMode) string {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("#!/bin/sh\n"), perm); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	r := Resolver{Dirs: []string{first, second}, GOOS: "linux", GOARCH: "amd64"}
+
+	generic := touch(filepath.Join(first, "foo"), 0755)
+	if path, err := r.Resolve("foo"); err != nil || path != generic {
+		t.Errorf("Expected %q, got %q, %v", generic, path, err)
+	}
+
+	specific := touch(filepath.Join(second, "linux_amd64", "foo"), 0755)
+	if path, err := r.Resolve("foo"); err != nil || path != generic {
+		t.Errorf("Expected earlier directory to win with %q, got %q, %v", generic, path, err)
+	}
+	os.Remove(generic)
+	if path, err := r.Resolve("foo"); err != nil || path != specific {
+		t.Errorf("Expected %q, got %q, %v", specific, path, err)
+	}
+
+	if runtime.GOOS != "windows" {
+		touch(filepath.Join(first, "foo_linux_amd64"), 0644)
+		if path, err := r.Resolve("foo"); err != nil || path != specific {
+			t.Errorf("Expected non-executable file to be skipped for %q, got %q, %v", specific, path, err)
+		}
+	}
+
+	_, err := r.Resolve("bar")
+	var rerr *ResolveError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("Expected *ResolveError, got %#v", err)
+	}
+	if len(rerr.Searched) != 6 {
+		t.Errorf("Expected 6 paths searched, got %q", rerr.Searched)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Error("Expected ResolveError to match fs.ErrNotExist")
+	}
+}
+
+func TestStartPluginWithResolver(t *testing.T) {
+	dir, name := filepath.Split(os.Args[0])
+	p, err := StartPlugin(nil, name, helperArgs("provider"), WithResolver(Resolver{Dirs: []string{dir}}))
+	if err != nil {
+		t.Fatalf("Unexpected error from StartPlugin: %#v", err)
+	}
+	defer p.Close()
+	if err := p.Ping(); err != nil {
+		t.Errorf("Unexpected error from Ping: %#v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package pie
+
+import (
+	"fmt"
+	"path"
+)
+
+// ResultHook processes the reply of a successful call to method, in
+// "Service.Method" form, after it has been decoded and before it is returned
+// to the caller.  reply is the pointer the caller passed.  A hook can change
+// the reply in place, such as to decrypt fields or redact secrets, or return
+// an error to fail the call, such as when the reply breaks an invariant.
+type ResultHook func(method string, reply interface{}) error
+
+// resultHook is a ResultHook for the methods matching a pattern.
+type resultHook struct {
+	pattern string
+	hook    ResultHook
+}
+
+// WithResultHook makes calls made through Plugin.Call and its variants to
+// methods matching pattern, a path.Match pattern of "Service.Method" names
+// such as "secrets.*" or "*.Get*", pass their replies through hook.  Hooks
+// run in the order they were given, each only if the ones before it
+// succeeded, and the first error fails the call.  Calls made through the
+// rpc.Client returned by Plugin.Client bypass the hooks.  A malformed pattern
+// matches nothing.
+func WithResultHook(pattern string, hook ResultHook) StartOption {
+	return func(o *startOptions) {
+		o.resultHooks = append(o.resultHooks, resultHook{pattern, hook})
+	}
+}
+
+// applyResultHooks passes the reply of a successful call to serviceMethod
+// through the hooks for it.
+func (p *Plugin) applyResultHooks(serviceMethod string, reply interface{}) error {
+	for _, h := range p.resultHooks {
+		if ok, _ := path.Match(h.pattern, serviceMethod); !ok {
+			continue
+		}
+		if err := h.hook(serviceMethod, reply); err != nil {
+			return fmt.Errorf("pie: result of %s rejected: %w", serviceMethod, err)
+		}
+	}
+	return nil
+}
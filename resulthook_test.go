@@ -0,0 +1,61 @@
+package pie
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestResultHooks(t *testing.T) {
+	var order []string
+	s := NewProvider()
+	s.RegisterName("api", api{})
+	p := pipePlugin(t, s,
+		WithResultHook("api.*", func(method string, reply interface{}) error {
+			order = append(order, "api.*")
+			s := reply.(*string)
+			*s = strings.ToUpper(*s)
+			return nil
+		}),
+		WithResultHook("other.*", func(string, interface{}) error {
+			order = append(order, "other.*")
+			return nil
+		}),
+		WithResultHook("*.SayHi", func(method string, reply interface{}) error {
+			order = append(order, method)
+			return nil
+		}),
+	)
+	var reply string
+	if err := p.Call("api.SayHi", "bob", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "HI BOB" {
+		t.Errorf("Expected the hook to change the reply, got %q", reply)
+	}
+	if want := "api.* api.SayHi"; strings.Join(order, " ") != want {
+		t.Errorf("Expected hooks %s to run, got %v", want, order)
+	}
+}
+
+func TestResultHookRejects(t *testing.T) {
+	errSecret := errors.New("reply contains a secret")
+	calls := 0
+	s := NewProvider()
+	s.RegisterName("api", api{})
+	p := pipePlugin(t, s,
+		WithResultHook("api.SayHi", func(string, interface{}) error { return errSecret }),
+		WithResultHook("api.SayHi", func(string, interface{}) error { calls++; return nil }),
+	)
+	err := p.Call("api.SayHi", "bob", new(string))
+	if !errors.Is(err, errSecret) {
+		t.Fatalf("Expected the hook's error, got %v", err)
+	}
+	if calls != 0 {
+		t.Error("Expected the hooks after a failure not to run")
+	}
+	// Failed calls are not passed to hooks.
+	if err := p.Call("api.Missing", "bob", new(string)); err == nil || errors.Is(err, errSecret) {
+		t.Errorf("Expected the call's own error, got %v", err)
+	}
+}
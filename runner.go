@@ -0,0 +1,169 @@
+package pie
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// Runner runs a plugin's process in place of os/exec, so that StartPlugin can
+// start plugins elsewhere, such as on a remote machine or in a container, or
+// fake them in tests, while pie still handles the handshake, supervision, and
+// RPC.  A Runner runs a single process, and is made for each start by the
+// function passed to WithRunner.
+type Runner interface {
+	// Stdio returns the writer to the plugin's stdin, and the reader of its
+	// stdout, which carry the RPC connection.  It is called once, before
+	// Start.  Closing them must not wait for the plugin to exit.
+	Stdio() (stdin io.WriteCloser, stdout io.ReadCloser, err error)
+	// Start starts the plugin.
+	Start() error
+	// Signal sends sig to the plugin.  Plugins are stopped by sending them
+	// os.Interrupt, and, if they do not stop in time, by Kill.
+	Signal(sig os.Signal) error
+	// Kill stops the plugin at once.
+	Kill() error
+	// Wait waits for the plugin to exit, and returns nil if it exited with
+	// status 0.  Otherwise, it returns an error, which has an ExitCode()
+	// int method, as *exec.ExitError does, if the plugin exited with a
+	// status, so that the Exit codes can be reported.  It is called once.
+	Wait() error
+}
+
+// WithRunner makes StartPlugin run the plugin with the Runner returned by
+// newRunner, instead of running cmd itself.  cmd is the command StartPlugin
+// would have run, once the other options have set it up, so that Runners can
+// start the plugin with its Path, Args, Env, Dir, and Stderr.  Options that
+// sandbox the plugin, such as WithPrivateRoot, set up cmd's SysProcAttr,
+// which only Runners that run cmd locally, such as ExecRunner, honor.
+//
+// A Runner that also has a Pid() int method reports the plugin's process ID
+// for Plugin.Pid and Plugin.Stats.
+func WithRunner(newRunner func(cmd *exec.Cmd) (Runner, error)) StartOption {
+	return func(o *startOptions) {
+		o.runner = newRunner
+	}
+}
+
+// ExecRunner returns a Runner that runs cmd with os/exec, as StartPlugin does
+// by default, for Runners that adjust how plugins are run locally to build on.
+func ExecRunner(cmd *exec.Cmd) Runner {
+	return &execRunner{cmd: cmd}
+}
+
+// execRunner is the Runner returned by ExecRunner.
+type execRunner struct {
+	cmd *exec.Cmd
+}
+
+func (r *execRunner) Stdio() (io.WriteCloser, io.ReadCloser, error) {
+	stdin, err := r.cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	stdout, err := r.cmd.StdoutPipe()
+	if err != nil {
+		stdin.Close()
+		return nil, nil, err
+	}
+	return stdin, stdout, nil
+}
+
+func (r *execRunner) Start() error { return r.cmd.Start() }
+
+func (r *execRunner) Signal(sig os.Signal) error { return r.cmd.Process.Signal(sig) }
+
+func (r *execRunner) Kill() error { return r.cmd.Process.Kill() }
+
+func (r *execRunner) Wait() error {
+	// Like os.Process's Wait, report how the process exited rather than
+	// treating a non-zero status as an error, so that the state is kept.
+	state, err := r.cmd.Process.Wait()
+	if err != nil {
+		return err
+	}
+	if !state.Success() {
+		return &exec.ExitError{ProcessState: state}
+	}
+	return nil
+}
+
+// Pid returns the process ID of the plugin.
+func (r *execRunner) Pid() int {
+	if r.cmd.Process == nil {
+		return 0
+	}
+	return r.cmd.Process.Pid
+}
+
+// runnerCmd is the commander for a Runner.
+type runnerCmd struct {
+	r      Runner
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	err    error
+}
+
+// newRunnerCmd returns the commander for r.
+func newRunnerCmd(r Runner) *runnerCmd {
+	c := &runnerCmd{r: r}
+	c.stdin, c.stdout, c.err = r.Stdio()
+	return c
+}
+
+func (c *runnerCmd) StdinPipe() (io.WriteCloser, error) {
+	return c.stdin, c.err
+}
+
+func (c *runnerCmd) StdoutPipe() (io.ReadCloser, error) {
+	return c.stdout, c.err
+}
+
+func (c *runnerCmd) Start() (osProcess, error) {
+	if err := c.r.Start(); err != nil {
+		return nil, err
+	}
+	return runnerProcess{c.r}, nil
+}
+
+// runnerProcess is the osProcess of a plugin run by a Runner.
+type runnerProcess struct {
+	r Runner
+}
+
+func (p runnerProcess) Signal(sig os.Signal) error { return p.r.Signal(sig) }
+
+func (p runnerProcess) Kill() error { return p.r.Kill() }
+
+// Wait waits for the plugin to exit.  As with os.Process, the state of a
+// plugin that exited with a non-zero status is returned without an error, if
+// the Runner reports it.
+func (p runnerProcess) Wait() (*os.ProcessState, error) {
+	err := p.r.Wait()
+	var ee *exec.ExitError
+	if errors.As(err, &ee) && ee.ProcessState != nil {
+		return ee.ProcessState, nil
+	}
+	return nil, err
+}
+
+// Pid returns the process ID of the plugin, or 0 if the Runner does not
+// report it.
+func (p runnerProcess) Pid() int {
+	if r, ok := p.r.(interface{ Pid() int }); ok {
+		return r.Pid()
+	}
+	return 0
+}
+
+// processID returns the process ID of proc, or 0 if it is not known.
+func processID(proc osProcess) int {
+	switch proc := proc.(type) {
+	case *os.Process:
+		return proc.Pid
+	case interface{ Pid() int }:
+		return proc.Pid()
+	}
+	return 0
+}
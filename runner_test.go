@@ -0,0 +1,175 @@
+package pie
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRunner is a Runner that serves api from the host process instead of
+// starting one.
+type fakeRunner struct {
+	hostEnd, pluginEnd net.Conn
+	// code is the status the plugin exits with, and exitAtOnce makes it exit
+	// as soon as it starts.
+	code       int
+	exitAtOnce bool
+
+	mu      sync.Mutex
+	signals []os.Signal
+	exited  chan struct{}
+	once    sync.Once
+}
+
+func newFakeRunner() *fakeRunner {
+	hostEnd, pluginEnd := net.Pipe()
+	return &fakeRunner{hostEnd: hostEnd, pluginEnd: pluginEnd, exited: make(chan struct{})}
+}
+
+func (f *fakeRunner) Stdio() (io.WriteCloser, io.ReadCloser, error) {
+	return f.hostEnd, f.hostEnd, nil
+}
+
+func (f *fakeRunner) Start() error {
+	if f.exitAtOnce {
+		f.exit()
+		return nil
+	}
+	s := NewProviderConn(f.pluginEnd)
+	s.RegisterName("api", api{})
+	go func() {
+		s.Serve()
+		f.exit()
+	}()
+	return nil
+}
+
+func (f *fakeRunner) exit() {
+	f.once.Do(func() {
+		f.pluginEnd.Close()
+		close(f.exited)
+	})
+}
+
+func (f *fakeRunner) Signal(sig os.Signal) error {
+	f.mu.Lock()
+	f.signals = append(f.signals, sig)
+	f.mu.Unlock()
+	f.exit()
+	return nil
+}
+
+func (f *fakeRunner) Kill() error {
+	f.exit()
+	return nil
+}
+
+func (f *fakeRunner) Wait() error {
+	<-f.exited
+	if f.code != 0 {
+		return fakeExit(f.code)
+	}
+	return nil
+}
+
+// fakeExit is the error a fakeRunner reports a non-zero exit status with.
+type fakeExit int
+
+func (e fakeExit) Error() string { return fmt.Sprintf("exit status %d", int(e)) }
+
+func (e fakeExit) ExitCode() int { return int(e) }
+
+func TestWithRunner(t *testing.T) {
+	f := newFakeRunner()
+	var cmd *exec.Cmd
+	p, err := StartPlugin(nil, "fake", []string{"-v"}, WithEnv("A=1"), WithRunner(func(c *exec.Cmd) (Runner, error) {
+		cmd = c
+		return f, nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd == nil || cmd.Args[1] != "-v" || !strings.Contains(strings.Join(cmd.Env, " "), "A=1") {
+		t.Errorf("Expected the runner to be given the command, got %+v", cmd)
+	}
+	var reply string
+	if err := p.Call("api.SayHi", "bob", &reply); err != nil || reply != "Hi bob" {
+		t.Errorf("Expected Hi bob, got %q, %v", reply, err)
+	}
+	if err := p.Ping(); err != nil {
+		t.Error(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Error(err)
+	}
+	<-p.Exited()
+	if err := p.ExitErr(); err != nil {
+		t.Errorf("Expected a clean exit, got %v", err)
+	}
+	if p.Pid() != 0 {
+		t.Errorf("Expected no pid from a runner that has none, got %d", p.Pid())
+	}
+}
+
+func TestWithRunnerExitCode(t *testing.T) {
+	f := newFakeRunner()
+	f.code, f.exitAtOnce = ExitInvalidConfig, true
+	p, err := StartPlugin(nil, "fake", nil, WithRunner(func(*exec.Cmd) (Runner, error) { return f, nil }))
+	if err == nil {
+		defer p.Close()
+		<-p.Exited()
+		err = p.ExitErr()
+	}
+	var xe *ExitError
+	if !errors.Is(err, ErrInvalidConfig) || !errors.As(err, &xe) || xe.State != nil {
+		t.Errorf("Expected the runner's exit code to be reported, got %v", err)
+	}
+}
+
+func TestExecRunner(t *testing.T) {
+	var started []string
+	runner := func(cmd *exec.Cmd) (Runner, error) {
+		started = append(started, cmd.Path)
+		return ExecRunner(cmd), nil
+	}
+	p, err := StartPlugin(os.Stderr, os.Args[0], helperArgs("provider"), WithRunner(runner))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply string
+	if err := p.Call("api.SayHi", "bob", &reply); err != nil || reply != "Hi bob" {
+		t.Errorf("Expected Hi bob, got %q, %v", reply, err)
+	}
+	if p.Pid() == 0 {
+		t.Error("Expected the plugin's pid")
+	}
+	if err := p.Close(); err != nil {
+		t.Error(err)
+	}
+	if len(started) != 1 {
+		t.Errorf("Expected the runner to start the plugin once, got %q", started)
+	}
+
+	p, err = StartPlugin(os.Stderr, os.Args[0], helperArgs("badconfig"), WithRunner(runner), WithCrashReports(0))
+	if err == nil {
+		defer p.Close()
+		<-p.Exited()
+		err = p.ExitErr()
+	}
+	var xe *ExitError
+	if !errors.Is(err, ErrInvalidConfig) || !errors.As(err, &xe) || xe.State == nil {
+		t.Errorf("Expected the process state to be reported, got %v", err)
+	}
+
+	if _, err := StartPlugin(nil, os.Args[0], nil, WithRunner(func(*exec.Cmd) (Runner, error) {
+		return nil, errors.New("no runner")
+	})); err == nil || err.Error() != "no runner" {
+		t.Errorf("Expected the runner's error, got %v", err)
+	}
+}
@@ -0,0 +1,331 @@
+package pie
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Overlap controls what a scheduled Job does when it is due while an earlier
+// run is still in progress.
+type Overlap int
+
+const (
+	// OverlapSkip skips the run that is due.
+	OverlapSkip Overlap = iota
+	// OverlapQueue runs it as soon as the runs before it have finished.  Runs
+	// pile up if the job is due more often than it can run.
+	OverlapQueue
+	// OverlapConcurrent runs it right away, alongside the earlier runs.
+	OverlapConcurrent
+)
+
+// Job is a plugin method that a Manager calls on a schedule.
+type Job struct {
+	// Plugin is the name of the plugin to call.
+	Plugin string
+	// Method is the service method to call, such as "Cache.Expire".
+	Method string
+	// Args are the arguments passed to each call.
+	Args interface{}
+	// Reply is a pointer to a value of the method's reply type.  Each run
+	// gets a new value of that type to decode its reply into.
+	Reply interface{}
+	// Every is the time between runs.
+	Every time.Duration
+	// Cron, used when Every is zero, is a cron expression of five fields:
+	// minute, hour, day of month, month, and day of week, each a "*", a
+	// number, a range such as "1-5", or a list of those separated by commas,
+	// optionally followed by a step such as "/15".  Times are in the local
+	// time zone.
+	Cron string
+	// Overlap is what to do when a run is due while another is in progress.
+	Overlap Overlap
+	// OnResult, if not nil, is called with the reply and error of each run.
+	OnResult func(reply interface{}, err error)
+}
+
+// Schedule calls the job's method on the job's plugin on the job's schedule,
+// until the returned function is called or the Manager is closed.  Calls go
+// through Manager.Call, and so are subject to the plugin's Quota; runs made
+// while the plugin is stopped fail.  Schedule returns ErrManagerShutDown once
+// Shutdown or Close has been called.
+func (m *Manager) Schedule(job Job) (cancel func(), err error) {
+	if job.Reply == nil || reflect.TypeOf(job.Reply).Kind() != reflect.Ptr {
+		return nil, errors.New("pie: job reply must be a pointer")
+	}
+	next, err := job.schedule()
+	if err != nil {
+		return nil, err
+	}
+	replyType := reflect.TypeOf(job.Reply).Elem()
+	run := func() {
+		reply := reflect.New(replyType).Interface()
+		err := m.Call(job.Plugin, job.Method, job.Args, reply)
+		if job.OnResult != nil {
+			job.OnResult(reply, err)
+		}
+	}
+	m.mu.Lock()
+	if m.shutDown {
+		m.mu.Unlock()
+		return nil, ErrManagerShutDown
+	}
+	s := startSchedule(next, job.Overlap, run)
+	if m.schedules == nil {
+		m.schedules = map[*schedule]bool{}
+	}
+	m.schedules[s] = true
+	m.mu.Unlock()
+	return func() {
+		m.mu.Lock()
+		delete(m.schedules, s)
+		m.mu.Unlock()
+		s.stop()
+	}, nil
+}
+
+// schedule returns the function giving the time of the job's next run after
+// a given time.
+func (job Job) schedule() (func(time.Time) time.Time, error) {
+	if job.Every > 0 {
+		return func(t time.Time) time.Time { return t.Add(job.Every) }, nil
+	}
+	if job.Cron == "" {
+		return nil, errors.New("pie: job has no schedule")
+	}
+	c, err := parseCron(job.Cron)
+	if err != nil {
+		return nil, err
+	}
+	return c.next, nil
+}
+
+// schedule runs a function on a schedule.
+type schedule struct {
+	next     func(time.Time) time.Time
+	overlap  Overlap
+	run      func()
+	done     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+
+	mu      sync.Mutex
+	running int
+	pending int
+}
+
+// startSchedule starts calling run at the times given by next.
+func startSchedule(next func(time.Time) time.Time, overlap Overlap, run func()) *schedule {
+	s := &schedule{next: next, overlap: overlap, run: run, done: make(chan struct{})}
+	s.wg.Add(1)
+	go s.loop()
+	return s
+}
+
+// stop stops the schedule, and waits for the runs in progress to finish.  Runs
+// that are queued are abandoned.
+func (s *schedule) stop() {
+	s.stopOnce.Do(func() { close(s.done) })
+	s.wg.Wait()
+}
+
+func (s *schedule) loop() {
+	defer s.wg.Done()
+	t := time.Now()
+	for {
+		t = s.next(t)
+		if now := time.Now(); t.Before(now) {
+			// Runs missed while the host was busy or asleep are not made up.
+			t = s.next(now)
+		}
+		if t.IsZero() {
+			// The schedule never matches, such as on February 30th.
+			<-s.done
+			return
+		}
+		timer := time.NewTimer(time.Until(t))
+		select {
+		case <-s.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		s.due()
+	}
+}
+
+// due starts a run, as the schedule's overlap policy allows.
+func (s *schedule) due() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running > 0 {
+		switch s.overlap {
+		case OverlapSkip:
+			return
+		case OverlapQueue:
+			s.pending++
+			return
+		}
+	}
+	s.running++
+	s.wg.Add(1)
+	go s.runQueued()
+}
+
+// runQueued runs the function, and then the runs queued behind it.
+func (s *schedule) runQueued() {
+	defer s.wg.Done()
+	for {
+		s.run()
+		s.mu.Lock()
+		if s.pending == 0 || s.stopped() {
+			s.running--
+			s.mu.Unlock()
+			return
+		}
+		s.pending--
+		s.mu.Unlock()
+	}
+}
+
+func (s *schedule) stopped() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// cron is a parsed cron expression.  Each field is the set of values it
+// matches, as a bit mask.
+type cron struct {
+	minute, hour, dom, month, dow uint64
+	// domStar and dowStar record whether the day fields were "*", since a
+	// day matches if either restricted day field matches it.
+	domStar, dowStar bool
+}
+
+// cronFields are the ranges of the fields of a cron expression.
+var cronFields = [5]struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+func parseCron(expr string) (*cron, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("pie: cron expression %q does not have 5 fields", expr)
+	}
+	var masks [5]uint64
+	for i, f := range fields {
+		mask, err := parseCronField(f, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("pie: cron expression %q: %s: %v", expr, cronFields[i].name, err)
+		}
+		masks[i] = mask
+	}
+	c := &cron{
+		minute:  masks[0],
+		hour:    masks[1],
+		dom:     masks[2],
+		month:   masks[3],
+		dow:     masks[4],
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}
+	// Sunday is both 0 and 7.
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+// parseCronField parses one field of a cron expression whose values range from
+// min to max.
+func parseCronField(f string, min, max int) (uint64, error) {
+	var mask uint64
+	for _, part := range strings.Split(f, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad step %q", part[i+1:])
+			}
+			step = n
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			var err error
+			bounds := strings.SplitN(part, "-", 2)
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("bad value %q", bounds[0])
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("bad value %q", bounds[1])
+				}
+			} else if step > 1 {
+				// "5/15" means from 5 to the end in steps of 15.
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			mask |= 1 << uint(v)
+		}
+	}
+	return mask, nil
+}
+
+// matchesDay reports whether the day of t matches the expression.
+func (c *cron) matchesDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case c.domStar && c.dowStar:
+		return true
+	case c.domStar:
+		return dow
+	case c.dowStar:
+		return dom
+	}
+	return dom || dow
+}
+
+// next returns the first time after t that matches the expression, or the zero
+// time if there is none within five years.
+func (c *cron) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
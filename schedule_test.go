@@ -0,0 +1,170 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	loc := time.UTC
+	at := func(y int, mo time.Month, d, h, mi int) time.Time { return time.Date(y, mo, d, h, mi, 0, 0, loc) }
+	from := at(2024, time.January, 31, 23, 58) // a Wednesday
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", at(2024, time.January, 31, 23, 59)},
+		{"*/15 * * * *", at(2024, time.February, 1, 0, 0)},
+		{"30 9 * * 1-5", at(2024, time.February, 1, 9, 30)},
+		{"0 0 29 2 *", at(2024, time.February, 29, 0, 0)},
+		{"0 12 * * 0", at(2024, time.February, 4, 12, 0)},
+		{"0 12 * * 7", at(2024, time.February, 4, 12, 0)},
+		{"0 0 15 * 6", at(2024, time.February, 3, 0, 0)},
+		{"5,10 1 * * *", at(2024, time.February, 1, 1, 5)},
+		{"0 6/8 * * *", at(2024, time.February, 1, 6, 0)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := c.next(from); !got.Equal(tt.want) {
+			t.Errorf("Next run of %q after %v: expected %v, got %v", tt.expr, from, tt.want, got)
+		}
+	}
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "a * * * *", "5-1 * * * *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("Expected an error parsing %q", expr)
+		}
+	}
+}
+
+// overlapRuns runs a schedule due every 10ms with the given overlap policy, of
+// runs that take 50ms, for 200ms.  It returns the number of runs started and
+// the most that were in progress at once.
+func overlapRuns(overlap Overlap) (started, concurrent int) {
+	var mu sync.Mutex
+	running := 0
+	run := func() {
+		mu.Lock()
+		started++
+		running++
+		if running > concurrent {
+			concurrent = running
+		}
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+	}
+	every := func(t time.Time) time.Time { return t.Add(10 * time.Millisecond) }
+	s := startSchedule(every, overlap, run)
+	time.Sleep(200 * time.Millisecond)
+	s.stop()
+	mu.Lock()
+	defer mu.Unlock()
+	return started, concurrent
+}
+
+func TestScheduleOverlap(t *testing.T) {
+	started, concurrent := overlapRuns(OverlapSkip)
+	if concurrent != 1 || started > 5 {
+		t.Errorf("OverlapSkip: expected at most 5 runs one at a time, got %d runs, %d at once", started, concurrent)
+	}
+	started, concurrent = overlapRuns(OverlapQueue)
+	if concurrent != 1 {
+		t.Errorf("OverlapQueue: expected runs one at a time, got %d at once", concurrent)
+	}
+	if started < 3 {
+		t.Errorf("OverlapQueue: expected runs back to back, got %d runs", started)
+	}
+	started, concurrent = overlapRuns(OverlapConcurrent)
+	if concurrent < 2 || started < 8 {
+		t.Errorf("OverlapConcurrent: expected runs at once, got %d runs, %d at once", started, concurrent)
+	}
+}
+
+func TestManagerSchedule(t *testing.T) {
+	m := &Manager{Plugins: []PluginSpec{helperSpec("a", "provider")}}
+	if err := m.StartAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	results := make(chan string, 100)
+	cancel, err := m.Schedule(Job{
+		Plugin: "a",
+		Method: "api.SayHi",
+		Args:   "cron",
+		Reply:  new(string),
+		Every:  10 * time.Millisecond,
+		OnResult: func(reply interface{}, err error) {
+			if err != nil {
+				t.Error(err)
+			}
+			results <- *reply.(*string)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		select {
+		case r := <-results:
+			if r != "Hi cron" {
+				t.Errorf("Expected %q, got %q", "Hi cron", r)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a scheduled run")
+		}
+	}
+}
+
+func TestManagerScheduleShutdown(t *testing.T) {
+	job := Job{Plugin: "a", Method: "api.SayHi", Reply: new(string), Every: time.Millisecond}
+	for i := 0; i < 200; i++ {
+		m := &Manager{}
+		cancel, err := m.Schedule(job)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Cancelling and shutting down at once must stop the job once.
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			<-start
+			cancel()
+		}()
+		go func() {
+			defer wg.Done()
+			<-start
+			m.Shutdown(context.Background())
+		}()
+		close(start)
+		wg.Wait()
+		if _, err := m.Schedule(job); !errors.Is(err, ErrManagerShutDown) {
+			t.Fatalf("Expected ErrManagerShutDown scheduling after Shutdown, got %v", err)
+		}
+	}
+}
+
+func TestManagerScheduleInvalid(t *testing.T) {
+	m := &Manager{}
+	for _, job := range []Job{
+		{Plugin: "a", Method: "api.SayHi", Reply: new(string)},
+		{Plugin: "a", Method: "api.SayHi", Reply: "x", Every: time.Second},
+		{Plugin: "a", Method: "api.SayHi", Reply: new(string), Cron: "* *"},
+	} {
+		if _, err := m.Schedule(job); err == nil {
+			t.Errorf("Expected an error scheduling %+v", job)
+		}
+	}
+}
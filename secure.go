@@ -0,0 +1,342 @@
+package pie
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// An encrypted connection starts with a handshake.  Each side sends a hello,
+// made of encryptionMagic, a version byte, and a fresh X25519 public key.  The
+// keys for each direction are derived from the shared X25519 secret, the
+// secret both sides were given, and the two hellos, using HKDF with SHA-256.
+// Each side then sends a record holding the hash of the hellos, which proves
+// it derived the same keys.  Everything after that travels in records: a
+// 4-byte big-endian length, and that many bytes sealed with AES-256-GCM, which
+// encrypts and then authenticates the data along with its length.  Nonces
+// count the records sent in each direction, so records cannot be replayed,
+// dropped, or reordered without being noticed.
+
+// encryptionMagic starts each side's hello.
+var encryptionMagic = [4]byte{0x1b, 'P', 'I', 'E'}
+
+// encryptionVersion is the version of the protocol sent in hellos.
+const encryptionVersion = 1
+
+// helloLen is the length of a hello.
+const helloLen = len(encryptionMagic) + 1 + 32
+
+// maxRecord is the most plaintext a record may hold.  Larger writes are split.
+const maxRecord = 64 << 10
+
+// ErrSecretMismatch is returned, possibly wrapped, when the encryption
+// handshake fails because the two sides were given different secrets, or the
+// handshake was tampered with.
+var ErrSecretMismatch = errors.New("pie: encryption handshake failed: secrets differ or the connection was tampered with")
+
+// ErrTampered is the error that ends an encrypted connection when a record read
+// from it fails authentication, which means it was modified, replayed, or
+// reordered on its way.
+var ErrTampered = errors.New("pie: encrypted record failed authentication")
+
+// WithEncryption makes the handle encrypt and authenticate everything it
+// exchanges with the plugin, with keys derived during a handshake from secret
+// and from keys exchanged on the spot, so that each connection uses its own
+// keys.  It protects plugins reached over untrusted transports, such as TCP,
+// for users who would rather not manage TLS certificates.  The provider must
+// be given the same secret with Server.SetEncryption; if it was not, NewPlugin
+// fails with ErrSecretMismatch.  The secret should be long and random, such as
+// 32 bytes read from crypto/rand, and must not be empty.
+//
+// Encryption applies to the connection itself, below any framing, batching,
+// or multiplexing, so it works with any codec.  It is meant for handles made
+// with NewPlugin; plugins started by StartPlugin talk over pipes private to
+// the host, and WithEncryption has no effect on them.
+func WithEncryption(secret []byte) StartOption {
+	return func(o *startOptions) {
+		o.encryption = append([]byte{}, secret...)
+	}
+}
+
+// SetEncryption makes the Server encrypt and authenticate its connection with
+// the given secret, as a host does with WithEncryption, on connections served
+// after it is called.  A nil secret turns encryption off.
+func (s Server) SetEncryption(secret []byte) error {
+	if s.d == nil {
+		return errors.New("pie: server cannot be configured")
+	}
+	if secret != nil && len(secret) == 0 {
+		return errors.New("pie: encryption secret is empty")
+	}
+	s.d.regMu.Lock()
+	defer s.d.regMu.Unlock()
+	if secret == nil {
+		s.d.encryption = nil
+	} else {
+		s.d.encryption = append([]byte{}, secret...)
+	}
+	return nil
+}
+
+// encrypt performs the encryption handshake over conn as the host if host is
+// true, and the provider otherwise, and returns the encrypted connection.  If
+// ctx is done first, conn is closed.
+func encrypt(ctx context.Context, conn io.ReadWriteCloser, secret []byte, host bool) (*secureConn, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("pie: encryption secret is empty")
+	}
+	type result struct {
+		c   *secureConn
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := secureHandshake(conn, secret, host)
+		done <- result{c, err}
+	}()
+	select {
+	case res := <-done:
+		return res.c, res.err
+	case <-ctx.Done():
+		conn.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// secureHandshake performs the encryption handshake over conn.
+func secureHandshake(conn io.ReadWriteCloser, secret []byte, host bool) (*secureConn, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	hello := make([]byte, 0, helloLen)
+	hello = append(hello, encryptionMagic[:]...)
+	hello = append(hello, encryptionVersion)
+	hello = append(hello, priv.PublicKey().Bytes()...)
+
+	// Both sides send before they receive, so the hello is written while the
+	// peer's is read, or they would deadlock on unbuffered transports.
+	peer := make([]byte, helloLen)
+	err = exchange(func() error {
+		_, err := conn.Write(hello)
+		return err
+	}, func() error {
+		_, err := io.ReadFull(conn, peer)
+		return err
+	})
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	if [4]byte(peer[:4]) != encryptionMagic {
+		return nil, fmt.Errorf("pie: encryption handshake failed: peer is not encrypting")
+	}
+	if peer[4] != encryptionVersion {
+		return nil, fmt.Errorf("pie: encryption handshake failed: unsupported version %d", peer[4])
+	}
+	peerKey, err := ecdh.X25519().NewPublicKey(peer[5:])
+	if err != nil {
+		return nil, fmt.Errorf("pie: encryption handshake failed: %w", err)
+	}
+	shared, err := priv.ECDH(peerKey)
+	if err != nil {
+		return nil, fmt.Errorf("pie: encryption handshake failed: %w", err)
+	}
+
+	transcript := sha256.New()
+	if host {
+		transcript.Write(hello)
+		transcript.Write(peer)
+	} else {
+		transcript.Write(peer)
+		transcript.Write(hello)
+	}
+	sum := transcript.Sum(nil)
+	prk := hkdfExtract(secret, shared)
+	hostKey := hkdfExpand(prk, append([]byte("pie encryption host"), sum...))
+	providerKey := hkdfExpand(prk, append([]byte("pie encryption provider"), sum...))
+	if !host {
+		hostKey, providerKey = providerKey, hostKey
+	}
+	c := &secureConn{conn: conn}
+	if c.seal, err = newGCM(hostKey); err != nil {
+		return nil, err
+	}
+	if c.open, err = newGCM(providerKey); err != nil {
+		return nil, err
+	}
+
+	// The peer has answered with a hello, so it is reading, and the record
+	// proving the keys is sent in full even when the peer's fails to verify,
+	// so that the peer also learns why the handshake failed.
+	sent := make(chan error, 1)
+	go func() { sent <- c.writeRecord(sum) }()
+	err = c.readRecord()
+	if serr := <-sent; err == nil {
+		err = serr
+	}
+	if err == ErrTampered || (err == nil && !hmac.Equal(c.in, sum)) {
+		return nil, ErrSecretMismatch
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.in = nil
+	return c, nil
+}
+
+// exchange calls send and receive at the same time, and returns the first of
+// their errors.  If receive fails, it returns without waiting for send, which
+// may be blocked until the connection is closed.
+func exchange(send, receive func() error) error {
+	sent := make(chan error, 1)
+	go func() { sent <- send() }()
+	if err := receive(); err != nil {
+		return err
+	}
+	return <-sent
+}
+
+// hkdfExtract is HKDF-Extract with SHA-256, as described in RFC 5869.
+func hkdfExtract(salt, ikm []byte) []byte {
+	m := hmac.New(sha256.New, salt)
+	m.Write(ikm)
+	return m.Sum(nil)
+}
+
+// hkdfExpand is HKDF-Expand with SHA-256, as described in RFC 5869, for an
+// output as long as the hash.
+func hkdfExpand(prk, info []byte) []byte {
+	m := hmac.New(sha256.New, prk)
+	m.Write(info)
+	m.Write([]byte{1})
+	return m.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// secureConn encrypts what is written to it into records, and decrypts the
+// records read from it.
+type secureConn struct {
+	conn io.ReadWriteCloser
+
+	wmu  sync.Mutex
+	seal cipher.AEAD
+	wseq uint64
+	out  []byte
+
+	rmu  sync.Mutex
+	open cipher.AEAD
+	rseq uint64
+	// buf holds the last record read, and in is the part of its plaintext
+	// not yet read.
+	buf  []byte
+	in   []byte
+	rerr error
+}
+
+// nonce returns the nonce of the record with the given sequence number.
+func nonce(seq uint64) []byte {
+	var n [12]byte
+	binary.BigEndian.PutUint64(n[4:], seq)
+	return n[:]
+}
+
+// Write encrypts p into one or more records and writes them.
+func (c *secureConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	n := 0
+	for n < len(p) {
+		chunk := p[n:min(len(p), n+maxRecord)]
+		if err := c.writeRecord(chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+// writeRecord encrypts p into a record and writes it, with c.wmu held or
+// during the handshake.
+func (c *secureConn) writeRecord(p []byte) error {
+	size := 4 + len(p) + c.seal.Overhead()
+	if cap(c.out) < size {
+		c.out = make([]byte, size)
+	}
+	out := c.out[:size]
+	binary.BigEndian.PutUint32(out, uint32(size-4))
+	c.seal.Seal(out[4:4], nonce(c.wseq), p, out[:4])
+	c.wseq++
+	_, err := c.conn.Write(out)
+	return err
+}
+
+// Read reads decrypted data, reading and decrypting records as needed.
+func (c *secureConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for len(c.in) == 0 {
+		if c.rerr != nil {
+			return 0, c.rerr
+		}
+		if err := c.readRecord(); err != nil {
+			c.rerr = err
+		}
+	}
+	n := copy(p, c.in)
+	c.in = c.in[n:]
+	return n, nil
+}
+
+// readRecord reads and decrypts the next record into c.in, with c.rmu held or
+// during the handshake.
+func (c *secureConn) readRecord() error {
+	var header [4]byte
+	if _, err := io.ReadFull(c.conn, header[:]); err != nil {
+		return err
+	}
+	size := int(binary.BigEndian.Uint32(header[:]))
+	if size < c.open.Overhead() || size > maxRecord+c.open.Overhead() {
+		return ErrTampered
+	}
+	if cap(c.buf) < size {
+		c.buf = make([]byte, size)
+	}
+	buf := c.buf[:size]
+	if _, err := io.ReadFull(c.conn, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	plain, err := c.open.Open(buf[:0], nonce(c.rseq), buf, header[:])
+	if err != nil {
+		return ErrTampered
+	}
+	c.rseq++
+	c.in = plain
+	return nil
+}
+
+// Close closes the underlying connection.
+func (c *secureConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,211 @@
+package pie
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// relay forwards what is written to either of the connections it returns to
+// the other, passing each chunk written by the host through tamper first, and
+// recording everything it forwards.
+type relay struct {
+	mu     sync.Mutex
+	wire   bytes.Buffer
+	tamper func([]byte)
+}
+
+func (r *relay) conns() (host, provider net.Conn) {
+	host, a := net.Pipe()
+	b, provider := net.Pipe()
+	forward := func(dst, src net.Conn, fromHost bool) {
+		buf := make([]byte, 4096)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				r.mu.Lock()
+				if fromHost && r.tamper != nil {
+					r.tamper(buf[:n])
+				}
+				r.wire.Write(buf[:n])
+				r.mu.Unlock()
+				if _, err := dst.Write(buf[:n]); err != nil {
+					src.Close()
+					return
+				}
+			}
+			if err != nil {
+				dst.Close()
+				return
+			}
+		}
+	}
+	go forward(b, a, true)
+	go forward(a, b, false)
+	return host, provider
+}
+
+func (r *relay) sawData(data string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return bytes.Contains(r.wire.Bytes(), []byte(data))
+}
+
+// encryptedPlugin returns a handle to a provider served over a relay, with
+// both sides encrypting with the given secrets.
+func encryptedPlugin(t *testing.T, r *relay, hostSecret, providerSecret []byte, setup func(Server), opts ...StartOption) (*Plugin, <-chan error, error) {
+	hostConn, providerConn := r.conns()
+	s := NewProviderConn(providerConn)
+	s.RegisterName("api", api{})
+	if setup != nil {
+		setup(s)
+	}
+	if err := s.SetEncryption(providerSecret); err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.ServeErr() }()
+	p, err := NewPlugin(hostConn, append(opts, WithEncryption(hostSecret))...)
+	if err == nil {
+		t.Cleanup(func() { p.Close() })
+	}
+	return p, served, err
+}
+
+func TestEncryption(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	for _, test := range []struct {
+		name  string
+		setup func(Server)
+		opts  []StartOption
+	}{
+		{"plain", nil, nil},
+		{"json", nil, []StartOption{WithCodecs("json")}},
+		{"mux", func(s Server) {
+			s.SetMultiplexing(true)
+			s.SetChecksums(true)
+		}, []StartOption{WithMux(), WithChecksums(false)}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := &relay{}
+			p, _, err := encryptedPlugin(t, r, secret, secret, test.setup, test.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			name := "confidential-" + strings.Repeat("x", 100000)
+			var response string
+			if err := p.Call("api.SayHi", name, &response); err != nil {
+				t.Fatal(err)
+			}
+			if response != "Hi "+name {
+				t.Errorf("Wrong response from api call, got %d bytes", len(response))
+			}
+			if err := p.Ping(); err != nil {
+				t.Errorf("Unexpected error from Ping: %v", err)
+			}
+			if r.sawData("confidential") || r.sawData("SayHi") {
+				t.Error("Plaintext seen on the wire")
+			}
+		})
+	}
+}
+
+func TestEncryptionSecretMismatch(t *testing.T) {
+	r := &relay{}
+	_, served, err := encryptedPlugin(t, r, []byte("host secret"), []byte("provider secret"), nil)
+	if !errors.Is(err, ErrSecretMismatch) {
+		t.Errorf("Expected %v, got %v", ErrSecretMismatch, err)
+	}
+	select {
+	case err := <-served:
+		var de *DisconnectError
+		if !errors.As(err, &de) || !errors.Is(err, ErrSecretMismatch) {
+			t.Errorf("Expected the provider to fail with %v, got %v", ErrSecretMismatch, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Provider still serving after a failed handshake")
+	}
+}
+
+func TestEncryptionProviderNotEncrypting(t *testing.T) {
+	hostConn, providerConn := (&relay{}).conns()
+	s := NewProviderConn(providerConn)
+	go s.Serve()
+	if _, err := NewPlugin(hostConn, WithEncryption([]byte("secret")), WithTimeouts(Timeouts{Ready: 2 * time.Second})); err == nil {
+		t.Fatal("Expected an error from a provider that does not encrypt")
+	}
+}
+
+func TestEncryptionTampered(t *testing.T) {
+	secret := []byte("secret")
+	r := &relay{}
+	p, served, err := encryptedPlugin(t, r, secret, secret, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.mu.Lock()
+	r.tamper = func(b []byte) { b[len(b)-1] ^= 1 }
+	r.mu.Unlock()
+	var response string
+	if err := p.Call("api.SayHi", "bob", &response); err == nil {
+		t.Error("Call succeeded over a tampered connection")
+	}
+	select {
+	case err := <-served:
+		if !errors.Is(err, ErrTampered) {
+			t.Errorf("Expected the provider to fail with %v, got %v", ErrTampered, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Provider still serving after reading a tampered record")
+	}
+}
+
+func TestEncryptionEmptySecret(t *testing.T) {
+	hostConn, providerConn := net.Pipe()
+	defer providerConn.Close()
+	if _, err := NewPlugin(hostConn, WithEncryption(nil)); err == nil {
+		t.Error("NewPlugin succeeded with an empty secret")
+	}
+	if err := NewProviderConn(providerConn).SetEncryption([]byte{}); err == nil {
+		t.Error("SetEncryption succeeded with an empty secret")
+	}
+}
+
+func TestSecureConnRecords(t *testing.T) {
+	a, b := net.Pipe()
+	secret := []byte("secret")
+	done := make(chan *secureConn, 1)
+	go func() {
+		c, err := secureHandshake(b, secret, false)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- c
+	}()
+	host, err := secureHandshake(a, secret, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := <-done
+	if provider == nil {
+		t.FailNow()
+	}
+	data := bytes.Repeat([]byte("0123456789"), 3*maxRecord/10+7)
+	go func() {
+		host.Write(data)
+		host.Write(nil)
+		host.Close()
+	}()
+	got, err := io.ReadAll(provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Expected %d bytes to arrive intact, got %d", len(data), len(got))
+	}
+}
@@ -0,0 +1,106 @@
+package pie
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// A host can serve as its own plugin: it registers plugin mains with
+// RegisterPluginMain, and starts its own executable with StartSelf, which
+// passes pluginMainFlag to select the plugin main to run.  This keeps a
+// second binary from having to be built and shipped, and with the sandboxing
+// options, such as WithPrivateRoot and WithNetworkPolicy, lets a program
+// separate the privileges of its parts.
+
+// pluginMainFlag is the argument through which StartSelf tells the host's own
+// executable which plugin main to run.
+const pluginMainFlag = "--pie-plugin"
+
+var (
+	pluginMainsMu sync.RWMutex
+	pluginMains   = map[string]func(Server) error{}
+)
+
+// RegisterPluginMain registers setup as the plugin main named name, which
+// StartSelf starts in a new process running the host's own executable, and
+// RunPluginMain runs there as RunProvider would.  Since both processes run the
+// same code, plugin mains are normally registered by init functions.
+// Registering a name again replaces the plugin main registered under it.
+func RegisterPluginMain(name string, setup func(Server) error) {
+	pluginMainsMu.Lock()
+	defer pluginMainsMu.Unlock()
+	pluginMains[name] = setup
+}
+
+// lookupPluginMain returns the plugin main registered under name.
+func lookupPluginMain(name string) (func(Server) error, bool) {
+	pluginMainsMu.RLock()
+	defer pluginMainsMu.RUnlock()
+	setup, ok := pluginMains[name]
+	return setup, ok
+}
+
+// RunPluginMain runs the plugin main selected by StartSelf, if the process
+// was started by StartSelf, and exits; otherwise it returns, so that the host
+// carries on.  Where there is a flag selecting a plugin main, it is removed
+// from os.Args, leaving the args passed to StartSelf.  Programs that use
+// StartSelf call it at the start of main, once their plugin mains are
+// registered, and before they parse their flags.  A process started to run a
+// plugin main that is not registered exits with ExitInvalidConfig.
+func RunPluginMain() {
+	name, ok := pluginMainArg()
+	if !ok {
+		return
+	}
+	setup, ok := lookupPluginMain(name)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "pie: no plugin main is registered as %q\n", name)
+		os.Exit(ExitInvalidConfig)
+	}
+	RunProvider(setup)
+}
+
+// pluginMainArg returns the name of the plugin main selected by the first
+// argument, and removes the argument from os.Args.  Only the first argument
+// is looked at, so that the host's own arguments are never mistaken for it.
+func pluginMainArg() (string, bool) {
+	if len(os.Args) < 2 {
+		return "", false
+	}
+	name, ok := strings.CutPrefix(os.Args[1], pluginMainFlag+"=")
+	if !ok {
+		return "", false
+	}
+	os.Args = append(os.Args[:1:1], os.Args[2:]...)
+	return name, true
+}
+
+// SelfCommand returns the path and arguments that start the host's own
+// executable as a plugin running the plugin main registered as name, with the
+// given args, for passing to StartPlugin, StartPluginContext, or a
+// Supervisor's start function.
+func SelfCommand(name string, args ...string) (path string, pluginArgs []string, err error) {
+	path, err = os.Executable()
+	if err != nil {
+		return "", nil, fmt.Errorf("pie: finding the host's executable: %w", err)
+	}
+	return path, append([]string{pluginMainFlag + "=" + name}, args...), nil
+}
+
+// StartSelf starts the host's own executable as a plugin running the plugin
+// main registered as name, with the given args, and returns a handle for it,
+// like StartPlugin.  The plugin main must be registered in the host process
+// too, so that a misspelled name fails here rather than in the plugin.
+func StartSelf(output io.Writer, name string, args []string, opts ...StartOption) (*Plugin, error) {
+	if _, ok := lookupPluginMain(name); !ok {
+		return nil, fmt.Errorf("pie: no plugin main is registered as %q", name)
+	}
+	path, pluginArgs, err := SelfCommand(name, args...)
+	if err != nil {
+		return nil, err
+	}
+	return StartPlugin(output, path, pluginArgs, opts...)
+}
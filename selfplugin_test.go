@@ -0,0 +1,87 @@
+package pie
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	RegisterPluginMain("api", func(s Server) error {
+		if len(os.Args) != 3 || os.Args[1] != "-v" || os.Args[2] != "x" {
+			return fmt.Errorf("%w: unexpected args %q", ErrInvalidConfig, os.Args)
+		}
+		return s.RegisterName("api", api{})
+	})
+}
+
+func TestStartSelf(t *testing.T) {
+	p, err := StartSelf(nil, "api", []string{"-v", "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	var reply string
+	if err := p.Call("api.SayHi", "bob", &reply); err != nil || reply != "Hi bob" {
+		t.Errorf("Expected Hi bob, got %q, %v", reply, err)
+	}
+}
+
+func TestStartSelfArgs(t *testing.T) {
+	var output lockedBuffer
+	p, err := StartSelf(&output, "api", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	<-p.Exited()
+	if !errors.Is(p.ExitErr(), ErrInvalidConfig) {
+		t.Errorf("Expected the plugin main to fail, got %v", p.ExitErr())
+	}
+	// The plugin's stderr may still be being copied after it has exited.
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(output.String(), "unexpected args") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the plugin main's error in its output, got %q", output.String())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStartSelfUnregistered(t *testing.T) {
+	if _, err := StartSelf(nil, "missing", nil); err == nil {
+		t.Error("Expected an error starting a plugin main that is not registered")
+	}
+	path, args, err := SelfCommand("missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output lockedBuffer
+	p, err := StartPlugin(&output, path, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	<-p.Exited()
+	if !errors.Is(p.ExitErr(), ErrInvalidConfig) {
+		t.Errorf("Expected the plugin to exit with ExitInvalidConfig, got %v, %q", p.ExitErr(), output.String())
+	}
+}
+
+func TestPluginMainArg(t *testing.T) {
+	defer func(args []string) { os.Args = args }(os.Args)
+	os.Args = []string{"host", "-v", pluginMainFlag + "=api"}
+	if _, ok := pluginMainArg(); ok {
+		t.Error("Expected only the first argument to select a plugin main")
+	}
+	os.Args = []string{"host", pluginMainFlag + "=api", "-v"}
+	if name, ok := pluginMainArg(); !ok || name != "api" {
+		t.Errorf("Expected the api plugin main, got %q, %v", name, ok)
+	}
+	if len(os.Args) != 2 || os.Args[1] != "-v" {
+		t.Errorf("Expected the flag to be removed, got %q", os.Args)
+	}
+}
@@ -0,0 +1,93 @@
+package pie
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// selfTestFlag is the argument that makes a provider test itself instead of
+// serving; see NewProvider.
+const selfTestFlag = "--pie-selftest"
+
+// SelfTestReport is what a provider run with --pie-selftest prints to stdout,
+// as JSON.
+type SelfTestReport struct {
+	// Build is the plugin's build information.
+	Build BuildInfo `json:"build"`
+	// Services maps each registered service to the names of its methods,
+	// sorted.
+	Services map[string][]string `json:"services"`
+	// Manifest is the manifest the plugin would describe itself with.
+	Manifest Manifest `json:"manifest"`
+	// Errors are the errors returned by Register and RegisterName.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// selfTestArg removes the self-test flag from os.Args, and reports whether it
+// was there.
+func selfTestArg() bool {
+	found := false
+	args := append([]string(nil), os.Args[:1]...)
+	for _, arg := range os.Args[1:] {
+		if arg == selfTestFlag || arg == selfTestFlag[1:] {
+			found = true
+			continue
+		}
+		args = append(args, arg)
+	}
+	if found {
+		os.Args = args
+	}
+	return found
+}
+
+// noteRegister records err, an error registering a service, for the
+// self-test report.
+func (s Server) noteRegister(err error) error {
+	if err != nil && s.ctl != nil {
+		s.ctl.mu.Lock()
+		s.ctl.registerErrs = append(s.ctl.registerErrs, err.Error())
+		s.ctl.mu.Unlock()
+	}
+	return err
+}
+
+// runSelfTest writes the provider's SelfTestReport to w, and returns the status
+// to exit with: 0 if the plugin registered services without errors, and 1
+// otherwise.
+func (c *control) runSelfTest(w io.Writer) int {
+	var r SelfTestReport
+	c.Describe(0, &r.Manifest)
+	r.Build = CurrentBuildInfo()
+	r.Services = map[string][]string{}
+	for _, mi := range r.Manifest.Methods {
+		if svc, m, ok := splitServiceMethod(mi.Name); ok {
+			r.Services[svc] = append(r.Services[svc], m)
+		}
+	}
+	for _, methods := range r.Services {
+		sort.Strings(methods)
+	}
+	c.mu.Lock()
+	r.Errors = append(r.Errors, c.registerErrs...)
+	c.mu.Unlock()
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(r); err != nil {
+		fmt.Fprintln(os.Stderr, "pie: self-test:", err)
+		return 1
+	}
+	switch {
+	case len(r.Errors) > 0:
+		fmt.Fprintln(os.Stderr, "pie: self-test: registering services failed")
+		return 1
+	case len(r.Services) == 0:
+		fmt.Fprintln(os.Stderr, "pie: self-test: no services registered")
+		return 1
+	}
+	return 0
+}
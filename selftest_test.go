@@ -0,0 +1,73 @@
+package pie
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"reflect"
+	"testing"
+)
+
+func TestSelfTestBinary(t *testing.T) {
+	var stdout bytes.Buffer
+	cmd := exec.Command(os.Args[0], append(helperArgs("provider"), selfTestFlag)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Expected the self-test to pass, got %v", err)
+	}
+	var r SelfTestReport
+	if err := json.Unmarshal(stdout.Bytes(), &r); err != nil {
+		t.Fatalf("Expected a JSON report, got %q: %v", stdout.String(), err)
+	}
+	if got := r.Services["api"]; !reflect.DeepEqual(got, []string{"SayHi"}) {
+		t.Errorf("Expected api to have SayHi, got %v", got)
+	}
+	if len(r.Services["helper"]) == 0 {
+		t.Errorf("Expected the helper service in %v", r.Services)
+	}
+	if _, ok := r.Services[controlService]; ok {
+		t.Error("Expected the control API to be left out")
+	}
+	if len(r.Manifest.Methods) == 0 || r.Build.GoVersion == "" {
+		t.Errorf("Expected a manifest and build info, got %+v", r)
+	}
+}
+
+func TestSelfTestArg(t *testing.T) {
+	defer func(args []string) { os.Args = args }(os.Args)
+	os.Args = []string{"plugin", "-v", selfTestFlag, "x"}
+	if !selfTestArg() {
+		t.Fatal("Expected the flag to be found")
+	}
+	if want := []string{"plugin", "-v", "x"}; !reflect.DeepEqual(os.Args, want) {
+		t.Errorf("Expected the flag to be removed leaving %v, got %v", want, os.Args)
+	}
+	if selfTestArg() {
+		t.Error("Expected no flag once removed")
+	}
+}
+
+func TestSelfTestFailures(t *testing.T) {
+	s := NewProviderConn(nil)
+	var out bytes.Buffer
+	if code := s.ctl.runSelfTest(&out); code != 1 {
+		t.Errorf("Expected a provider without services to fail, got %d", code)
+	}
+	s.RegisterName("api", api{})
+	if err := s.RegisterName("bad", 5); err == nil {
+		t.Fatal("Expected an error registering a value without methods")
+	}
+	out.Reset()
+	if code := s.ctl.runSelfTest(&out); code != 1 {
+		t.Errorf("Expected a provider with a failed registration to fail, got %d", code)
+	}
+	var r SelfTestReport
+	if err := json.Unmarshal(out.Bytes(), &r); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Errors) != 1 || len(r.Services["api"]) != 1 {
+		t.Errorf("Expected the error and the api service in the report, got %+v", r)
+	}
+}
@@ -0,0 +1,186 @@
+package pie
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a semantic version, as described at https://semver.org.  Build
+// metadata is accepted when parsing but ignored.
+type Version struct {
+	Major, Minor, Patch int
+	// Pre is the pre-release part of the version, without the leading "-".
+	Pre string
+}
+
+// ParseVersion parses a semantic version such as "1.2.3" or "v1.2.3-rc.1".  A
+// leading "v" is optional, and the minor and patch numbers may be omitted, so
+// "v2" is the same as "2.0.0".
+func ParseVersion(s string) (Version, error) {
+	orig := s
+	s = strings.TrimPrefix(s, "v")
+	if i := strings.Index(s, "+"); i >= 0 {
+		s = s[:i]
+	}
+	var v Version
+	if i := strings.Index(s, "-"); i >= 0 {
+		v.Pre, s = s[i+1:], s[:i]
+		if v.Pre == "" {
+			return Version{}, fmt.Errorf("invalid version %q: empty pre-release", orig)
+		}
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return Version{}, fmt.Errorf("invalid version %q", orig)
+	}
+	nums := []*int{&v.Major, &v.Minor, &v.Patch}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return Version{}, fmt.Errorf("invalid version %q", orig)
+		}
+		*nums[i] = n
+	}
+	return v, nil
+}
+
+// String returns the version in its canonical form, without a leading "v".
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Pre != "" {
+		s += "-" + v.Pre
+	}
+	return s
+}
+
+// Compare returns -1, 0, or 1 depending on whether v has lower, equal, or
+// higher precedence than o.
+func (v Version) Compare(o Version) int {
+	for _, d := range [...]int{v.Major - o.Major, v.Minor - o.Minor, v.Patch - o.Patch} {
+		if d != 0 {
+			return sign(d)
+		}
+	}
+	return comparePre(v.Pre, o.Pre)
+}
+
+// Less reports whether v has lower precedence than o.
+func (v Version) Less(o Version) bool {
+	return v.Compare(o) < 0
+}
+
+// comparePre compares pre-release strings by semver precedence rules.
+func comparePre(a, b string) int {
+	switch {
+	case a == b:
+		return 0
+	case a == "":
+		return 1
+	case b == "":
+		return -1
+	}
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aerr := strconv.Atoi(as[i])
+		bn, berr := strconv.Atoi(bs[i])
+		switch {
+		case aerr == nil && berr == nil:
+			if an != bn {
+				return sign(an - bn)
+			}
+		case aerr == nil:
+			return -1
+		case berr == nil:
+			return 1
+		default:
+			if c := strings.Compare(as[i], bs[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return sign(len(as) - len(bs))
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+// Constraint is a set of comparisons that a Version must satisfy, such as
+// ">= 1.2, < 2.0".
+type Constraint []comparison
+
+// comparison is a single operator and operand in a Constraint.
+type comparison struct {
+	op string
+	v  Version
+}
+
+// ParseConstraint parses a comma separated list of comparisons, each an
+// operator (=, !=, >, >=, <, or <=) followed by a version.  A version with no
+// operator must match exactly.  An empty string is a constraint that every
+// version satisfies.
+func ParseConstraint(s string) (Constraint, error) {
+	var c Constraint
+	if strings.TrimSpace(s) == "" {
+		return c, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		op := strings.TrimRight(part[:len(part)-len(strings.TrimLeft(part, "<>=!"))], " ")
+		switch op {
+		case "":
+			op = "="
+		case "=", "!=", ">", ">=", "<", "<=":
+		default:
+			return nil, fmt.Errorf("invalid operator %q in version constraint %q", op, s)
+		}
+		v, err := ParseVersion(strings.TrimSpace(strings.TrimLeft(part, "<>=!")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid version constraint %q: %w", s, err)
+		}
+		c = append(c, comparison{op: op, v: v})
+	}
+	return c, nil
+}
+
+// Check reports whether v satisfies every comparison in the constraint.
+func (c Constraint) Check(v Version) bool {
+	for _, cmp := range c {
+		n := v.Compare(cmp.v)
+		var ok bool
+		switch cmp.op {
+		case "=":
+			ok = n == 0
+		case "!=":
+			ok = n != 0
+		case ">":
+			ok = n > 0
+		case ">=":
+			ok = n >= 0
+		case "<":
+			ok = n < 0
+		case "<=":
+			ok = n <= 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the constraint in the form accepted by ParseConstraint.
+func (c Constraint) String() string {
+	parts := make([]string, len(c))
+	for i, cmp := range c {
+		parts[i] = cmp.op + " " + cmp.v.String()
+	}
+	return strings.Join(parts, ", ")
+}
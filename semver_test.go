@@ -0,0 +1,86 @@
+package pie
+
+import "testing"
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected Version
+	}{
+		{"1.2.3", Version{1, 2, 3, ""}},
+		{"v1.2.3", Version{1, 2, 3, ""}},
+		{"v2", Version{2, 0, 0, ""}},
+		{"1.2", Version{1, 2, 0, ""}},
+		{"1.2.3-rc.1+build.5", Version{1, 2, 3, "rc.1"}},
+	}
+	for _, test := range tests {
+		v, err := ParseVersion(test.s)
+		if err != nil {
+			t.Errorf("Unexpected error parsing %q: %s", test.s, err)
+			continue
+		}
+		if v != test.expected {
+			t.Errorf("Wrong parse of %q, expected %#v, got %#v", test.s, test.expected, v)
+		}
+	}
+	for _, bad := range []string{"", "x", "1.2.3.4", "1.-2", "1.2.3-"} {
+		if _, err := ParseVersion(bad); err == nil {
+			t.Errorf("Expected error parsing %q", bad)
+		}
+	}
+}
+
+func TestVersionCompare(t *testing.T) {
+	// Each version has lower precedence than the next, per semver.org.
+	ordered := []string{
+		"1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta",
+		"1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0", "1.0.1",
+		"1.1.0", "2.0.0",
+	}
+	for i := 0; i < len(ordered)-1; i++ {
+		a, _ := ParseVersion(ordered[i])
+		b, _ := ParseVersion(ordered[i+1])
+		if a.Compare(b) != -1 || b.Compare(a) != 1 {
+			t.Errorf("Expected %s < %s", a, b)
+		}
+		if a.Compare(a) != 0 {
+			t.Errorf("Expected %s to equal itself", a)
+		}
+	}
+}
+
+func TestConstraint(t *testing.T) {
+	tests := []struct {
+		constraint string
+		version    string
+		ok         bool
+	}{
+		{"", "0.1.0", true},
+		{">= 1.2, < 2.0", "1.2.0", true},
+		{">= 1.2, < 2.0", "1.9.9", true},
+		{">= 1.2, < 2.0", "2.0.0", false},
+		{">= 1.2, < 2.0", "1.1.9", false},
+		{">=1.2,<2", "1.5.0", true},
+		{"1.2.3", "1.2.3", true},
+		{"= 1.2.3", "1.2.4", false},
+		{"!= 1.2.3", "1.2.4", true},
+		{"> 1.2.3", "1.2.3", false},
+		{"<= 1.2.3", "1.2.3", true},
+	}
+	for _, test := range tests {
+		c, err := ParseConstraint(test.constraint)
+		if err != nil {
+			t.Errorf("Unexpected error parsing %q: %s", test.constraint, err)
+			continue
+		}
+		v, _ := ParseVersion(test.version)
+		if ok := c.Check(v); ok != test.ok {
+			t.Errorf("%q.Check(%s): expected %v, got %v", test.constraint, test.version, test.ok, ok)
+		}
+	}
+	for _, bad := range []string{"=> 1.0", "~ 1.0", ">= x", ">= 1.0,"} {
+		if _, err := ParseConstraint(bad); err == nil {
+			t.Errorf("Expected error parsing %q", bad)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package pie
+
+import "context"
+
+// runService reports that the process is not a Windows service.
+func runService(ctx context.Context, name string, serve func(context.Context, func()) error) (bool, error) {
+	return false, nil
+}
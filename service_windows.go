@@ -0,0 +1,134 @@
+package pie
+
+import (
+	"context"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	advapi32                          = syscall.NewLazyDLL("advapi32.dll")
+	procStartServiceCtrlDispatcherW   = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerExW = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus              = advapi32.NewProc("SetServiceStatus")
+)
+
+// Service control manager constants, from winsvc.h and winerror.h.
+const (
+	serviceWin32OwnProcess = 0x10
+
+	serviceStopped        = 1
+	serviceStartPending   = 2
+	serviceStopPending    = 3
+	serviceRunning        = 4
+	serviceAcceptStop     = 0x1
+	serviceAcceptShutdown = 0x4
+
+	serviceControlStop        = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown    = 5
+
+	errorCallNotImplemented             = 120
+	errorServiceSpecificError           = 1066
+	errorFailedServiceControllerConnect = 1063
+)
+
+// serviceTableEntry is a SERVICE_TABLE_ENTRYW.
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+// serviceStatus is a SERVICE_STATUS.
+type serviceStatus struct {
+	serviceType             uint32
+	currentState            uint32
+	controlsAccepted        uint32
+	win32ExitCode           uint32
+	serviceSpecificExitCode uint32
+	checkPoint              uint32
+	waitHint                uint32
+}
+
+// scmService runs a daemon as a Windows service.
+type scmService struct {
+	ctx    context.Context
+	name   *uint16
+	serve  func(context.Context, func()) error
+	status uintptr
+	cancel context.CancelFunc
+	err    error
+}
+
+// runService runs serve as the Windows service name, reporting whether the
+// process is one.  If it is, it returns once the service has stopped, with
+// the error serve returned.
+func runService(ctx context.Context, name string, serve func(context.Context, func()) error) (bool, error) {
+	namePtr, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return false, nil
+	}
+	s := &scmService{ctx: ctx, name: namePtr, serve: serve}
+	table := []serviceTableEntry{{namePtr, syscall.NewCallback(s.main)}, {nil, 0}}
+	// StartServiceCtrlDispatcher runs the service's main function on a
+	// thread of its own, and returns once it has stopped.
+	if r, _, err := procStartServiceCtrlDispatcherW.Call(uintptr(unsafe.Pointer(&table[0]))); r == 0 {
+		if err == syscall.Errno(errorFailedServiceControllerConnect) {
+			// The process was not started by the service control
+			// manager.
+			return false, nil
+		}
+		return true, err
+	}
+	return true, s.err
+}
+
+// main is the service's ServiceMain.
+func (s *scmService) main(argc, argv uintptr) uintptr {
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	s.cancel = cancel
+	h, _, err := procRegisterServiceCtrlHandlerExW.Call(uintptr(unsafe.Pointer(s.name)), syscall.NewCallback(s.control), 0)
+	if h == 0 {
+		s.err = err
+		return 0
+	}
+	s.status = h
+	s.setStatus(serviceStartPending, 0, nil)
+	s.err = s.serve(ctx, func() {
+		s.setStatus(serviceRunning, serviceAcceptStop|serviceAcceptShutdown, nil)
+	})
+	s.setStatus(serviceStopped, 0, s.err)
+	return 0
+}
+
+// control is the service's HandlerEx, which stops it when asked to.
+func (s *scmService) control(ctrl, eventType, eventData, context uintptr) uintptr {
+	switch ctrl {
+	case serviceControlStop, serviceControlShutdown:
+		s.setStatus(serviceStopPending, 0, nil)
+		s.cancel()
+		return 0
+	case serviceControlInterrogate:
+		return 0
+	}
+	return errorCallNotImplemented
+}
+
+// setStatus reports the service's state to the service control manager,
+// with err as its failure if it stopped with one.
+func (s *scmService) setStatus(state, accepts uint32, err error) {
+	st := serviceStatus{
+		serviceType:      serviceWin32OwnProcess,
+		currentState:     state,
+		controlsAccepted: accepts,
+	}
+	if err != nil {
+		st.win32ExitCode = errorServiceSpecificError
+		st.serviceSpecificExitCode = 1
+	}
+	if state == serviceStartPending || state == serviceStopPending {
+		st.waitHint = 10000
+	}
+	procSetServiceStatus.Call(s.status, uintptr(unsafe.Pointer(&st)))
+}
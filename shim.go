@@ -0,0 +1,324 @@
+package pie
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"text/template"
+)
+
+// ShimLanguage is a language GenerateShim can write provider shims in.
+type ShimLanguage int
+
+const (
+	// ShimPython is Python 3.
+	ShimPython ShimLanguage = iota
+	// ShimNode is JavaScript for Node.js.
+	ShimNode
+)
+
+// shimMethod describes a method of a provider shim, as passed to the shim's
+// template.
+type shimMethod struct {
+	Name string
+	// Args and Reply describe the JSON of the arguments and reply.  Reply is
+	// empty for methods that return only an error.
+	Args, Reply string
+}
+
+// GenerateShim writes to w the source of a provider written in lang that
+// serves the methods of a Go interface as the named service, so that plugins
+// can be prototyped in a scripting language against the same host as Go
+// plugins.  iface is a nil pointer to the interface, such as (*MyAPI)(nil),
+// whose methods must each take one argument, and return either a result and
+// an error, or just an error, like the funcs Bind binds.  The shim defines a
+// class named after the service, with a method for each of the interface's,
+// commented with the JSON of its arguments and reply, and a serve function
+// that serves an instance of a subclass over stdin and stdout.  A method
+// reports an error by raising or throwing it; ShimNode methods may return
+// promises.
+//
+// Shims speak JSON-RPC 1.0, so hosts start them with StartProviderCodec and
+// net/rpc/jsonrpc's NewClientCodec.  They serve only the service's methods,
+// not pie's control API, and so cannot be started with StartPlugin or its
+// options.
+func GenerateShim(w io.Writer, lang ShimLanguage, service string, iface interface{}) error {
+	t := reflect.TypeOf(iface)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Interface {
+		return fmt.Errorf("pie: shim interface must be a pointer to an interface, not %T", iface)
+	}
+	t = t.Elem()
+	if !isIdentifier(service) {
+		return fmt.Errorf("pie: shim service name %q is not an identifier", service)
+	}
+	var methods []shimMethod
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		if !m.IsExported() {
+			continue
+		}
+		mt := m.Type
+		if mt.NumIn() != 1 || mt.IsVariadic() {
+			return fmt.Errorf("pie: shim method %s must take one argument", m.Name)
+		}
+		sm := shimMethod{Name: m.Name, Args: jsonType(mt.In(0))}
+		switch {
+		case mt.NumOut() == 1 && mt.Out(0) == typeOfError:
+		case mt.NumOut() == 2 && mt.Out(1) == typeOfError:
+			sm.Reply = jsonType(mt.Out(0))
+		default:
+			return fmt.Errorf("pie: shim method %s must return either a result and an error, or just an error", m.Name)
+		}
+		methods = append(methods, sm)
+	}
+	if len(methods) == 0 {
+		return fmt.Errorf("pie: %s has no exported methods", t)
+	}
+	var tmpl *template.Template
+	switch lang {
+	case ShimPython:
+		tmpl = pythonShim
+	case ShimNode:
+		tmpl = nodeShim
+	default:
+		return fmt.Errorf("pie: unknown shim language %d", lang)
+	}
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, struct {
+		Interface string
+		Service   string
+		Methods   []shimMethod
+	}{t.String(), service, methods})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// isIdentifier reports whether s can name a class in every ShimLanguage.
+func isIdentifier(s string) bool {
+	for i, r := range s {
+		switch {
+		case r == '_', 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z':
+		case i > 0 && '0' <= r && r <= '9':
+		default:
+			return false
+		}
+	}
+	return s != ""
+}
+
+var shimFuncs = template.FuncMap{
+	// quote quotes a string in a way both Python and JavaScript accept.
+	"quote": func(s string) string {
+		b, _ := json.Marshal(s)
+		return string(b)
+	},
+}
+
+var pythonShim = template.Must(template.New("python").Funcs(shimFuncs).Parse(`#!/usr/bin/env python3
+# Code generated by pie.GenerateShim from {{.Interface}}. DO NOT EDIT.
+#
+# A provider serving {{.Interface}} as the service {{quote .Service}} over
+# JSON-RPC 1.0 on stdin and stdout.  Subclass {{.Service}}, implement its
+# methods, and pass an instance to serve.  Log to stderr, since stdout carries
+# the replies.
+
+import json
+import sys
+
+
+class {{.Service}}:
+{{- range .Methods}}
+
+    # Takes {{.Args}}.
+    # {{if .Reply}}Returns {{.Reply}}.{{else}}Returns nothing.{{end}}
+    def {{.Name}}(self, args):
+        raise NotImplementedError({{quote (print $.Service "." .Name " is not implemented")}})
+{{- end}}
+
+
+def serve(impl, stdin=sys.stdin, stdout=sys.stdout):
+    """Serves impl's methods until stdin is closed."""
+    methods = {
+{{- range .Methods}}
+        {{quote (print $.Service "." .Name)}}: impl.{{.Name}},
+{{- end}}
+    }
+    while True:
+        line = stdin.readline()
+        if not line:
+            return
+        if not line.strip():
+            continue
+        req = json.loads(line)
+        result, error = None, None
+        method = methods.get(req.get("method"))
+        if method is None:
+            error = "rpc: can't find method " + str(req.get("method"))
+        else:
+            try:
+                params = req.get("params") or [None]
+                result = method(params[0])
+            except Exception as e:
+                error = str(e) or type(e).__name__
+        if req.get("id") is None:
+            continue
+        stdout.write(json.dumps({"id": req["id"], "result": result, "error": error}) + "\n")
+        stdout.flush()
+`))
+
+var nodeShim = template.Must(template.New("node").Funcs(shimFuncs).Parse(`#!/usr/bin/env node
+// Code generated by pie.GenerateShim from {{.Interface}}. DO NOT EDIT.
+//
+// A provider serving {{.Interface}} as the service {{quote .Service}} over
+// JSON-RPC 1.0 on stdin and stdout.  Extend {{.Service}}, implement its
+// methods, which may return promises, and pass an instance to serve.  Log to
+// stderr, since stdout carries the replies.
+
+'use strict';
+
+const readline = require('readline');
+
+class {{.Service}} {
+{{- range .Methods}}
+
+  // Takes {{.Args}}.
+  // {{if .Reply}}Returns {{.Reply}}.{{else}}Returns nothing.{{end}}
+  {{.Name}}(args) {
+    throw new Error({{quote (print $.Service "." .Name " is not implemented")}});
+  }
+{{- end}}
+}
+
+// serve serves impl's methods until stdin is closed.
+function serve(impl, input = process.stdin, output = process.stdout) {
+  const methods = {
+{{- range .Methods}}
+    {{quote (print $.Service "." .Name)}}: (args) => impl.{{.Name}}(args),
+{{- end}}
+  };
+  const lines = readline.createInterface({ input, terminal: false });
+  lines.on('line', async (line) => {
+    if (!line.trim()) {
+      return;
+    }
+    const req = JSON.parse(line);
+    let result = null;
+    let error = null;
+    const method = Object.prototype.hasOwnProperty.call(methods, req.method) ? methods[req.method] : null;
+    if (method === null) {
+      error = "rpc: can't find method " + req.method;
+    } else {
+      try {
+        const r = await method((req.params || [null])[0]);
+        result = r === undefined ? null : r;
+      } catch (e) {
+        error = String((e && e.message) || e);
+      }
+    }
+    if (req.id === null || req.id === undefined) {
+      return;
+    }
+    output.write(JSON.stringify({ id: req.id, result, error }) + '\n');
+  });
+}
+
+module.exports = { {{.Service}}, serve };
+`))
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// jsonType describes the JSON encoding/json encodes values of t as.
+func jsonType(t reflect.Type) string {
+	return describeJSONType(t, map[reflect.Type]bool{})
+}
+
+// describeJSONType describes the JSON values of t are encoded as, naming the
+// struct types in seen instead of describing them again.
+func describeJSONType(t reflect.Type, seen map[reflect.Type]bool) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Implements(jsonMarshalerType) || reflect.PtrTo(t).Implements(jsonMarshalerType) {
+		return "JSON (" + t.String() + ")"
+	}
+	if t.Implements(textMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType) {
+		return "string (" + t.String() + ")"
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 && t.Kind() == reflect.Slice {
+			return "string (base64)"
+		}
+		return "[" + describeJSONType(t.Elem(), seen) + "]"
+	case reflect.Map:
+		return "{string: " + describeJSONType(t.Elem(), seen) + "}"
+	case reflect.Struct:
+		if seen[t] {
+			return t.Name()
+		}
+		seen[t] = true
+		fields := jsonFields(t, seen)
+		if len(fields) == 0 {
+			return "{}"
+		}
+		return "{" + strings.Join(fields, ", ") + "}"
+	case reflect.Interface:
+		return "any"
+	}
+	return t.Kind().String()
+}
+
+// jsonFields describes the fields encoding/json encodes structs of type t
+// with, including those of the structs embedded in t.
+func jsonFields(t reflect.Type, seen map[reflect.Type]bool) []string {
+	var fields []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			fields = append(fields, jsonFields(ft, seen)...)
+			continue
+		}
+		if !f.IsExported() || ft.Kind() == reflect.Chan || ft.Kind() == reflect.Func {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		desc := describeJSONType(f.Type, seen)
+		if strings.Contains(opts, "string") {
+			desc = "string (" + desc + ")"
+		}
+		if strings.Contains(opts, "omitempty") {
+			desc = "optional " + desc
+		}
+		fields = append(fields, fmt.Sprintf("%q: %s", name, desc))
+	}
+	return fields
+}
@@ -0,0 +1,145 @@
+package pie
+
+import (
+	"bytes"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// GreetArgs are the arguments of Greeter.Greet.
+type GreetArgs struct {
+	Name  string
+	Loud  bool     `json:"loud,omitempty"`
+	Tags  []string `json:"tags"`
+	Extra string   `json:"-"`
+}
+
+// Greeting is the reply of Greeter.Greet.
+type Greeting struct {
+	Text string
+	At   time.Time
+}
+
+// Greeter is the interface the test shims implement.
+type Greeter interface {
+	Greet(GreetArgs) (Greeting, error)
+	Forget(name string) error
+}
+
+// shimImpls are implementations of Greeter for the generated shims, which are
+// imported from greeter.py and greeter.js.
+var shimImpls = map[ShimLanguage]struct {
+	interpreter, file, main string
+}{
+	ShimPython: {"python3", "greeter.py", `
+import sys
+sys.path.insert(0, sys.argv[1])
+from greeter import Greeter, serve
+
+class Impl(Greeter):
+    def Greet(self, args):
+        return {"Text": "Hi " + args["Name"]}
+
+    def Forget(self, name):
+        raise Exception("cannot forget " + name)
+
+serve(Impl())
+`},
+	ShimNode: {"node", "greeter.js", `
+const { Greeter, serve } = require(process.argv[2] + '/greeter.js');
+
+class Impl extends Greeter {
+  async Greet(args) {
+    return { Text: 'Hi ' + args.Name };
+  }
+
+  Forget(name) {
+    throw new Error('cannot forget ' + name);
+  }
+}
+
+serve(new Impl());
+`},
+}
+
+func TestGenerateShim(t *testing.T) {
+	for lang, impl := range shimImpls {
+		t.Run(impl.interpreter, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := GenerateShim(&buf, lang, "Greeter", (*Greeter)(nil)); err != nil {
+				t.Fatal(err)
+			}
+			src := buf.String()
+			for _, want := range []string{
+				"pie.Greeter",
+				`Takes {"Name": string, "loud": optional boolean, "tags": [string]}.`,
+				`Returns {"Text": string, "At": JSON (time.Time)}.`,
+				`"Greeter.Forget"`,
+			} {
+				if !strings.Contains(src, want) {
+					t.Errorf("Expected the shim to contain %q, got\n%s", want, src)
+				}
+			}
+			if _, err := exec.LookPath(impl.interpreter); err != nil {
+				t.Skip(impl.interpreter + " is not installed")
+			}
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, impl.file), buf.Bytes(), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			main := filepath.Join(dir, "main")
+			if err := os.WriteFile(main, []byte(impl.main), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			var stderr lockedBuffer
+			client, err := StartProviderCodec(jsonrpc.NewClientCodec, &stderr, impl.interpreter, main, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			var proxy struct {
+				Greet  func(GreetArgs) (Greeting, error)
+				Forget func(string) error
+			}
+			if err := Bind(client, "Greeter", &proxy); err != nil {
+				t.Fatal(err)
+			}
+			g, err := proxy.Greet(GreetArgs{Name: "bob"})
+			if err != nil || g.Text != "Hi bob" {
+				t.Errorf("Expected Hi bob, got %+v, %v (stderr %q)", g, err, stderr.String())
+			}
+			if err := proxy.Forget("bob"); err == nil || err.Error() != "cannot forget bob" {
+				t.Errorf("Expected the method's error, got %v", err)
+			}
+			if err := client.Call("Greeter.Missing", 1, nil); err == nil || !strings.Contains(err.Error(), "can't find method") {
+				t.Errorf("Expected an error calling a missing method, got %v", err)
+			}
+		})
+	}
+}
+
+// badShim has a method no shim can serve.
+type badShim interface {
+	Two(a, b int) error
+}
+
+func TestGenerateShimErrors(t *testing.T) {
+	var buf bytes.Buffer
+	if err := GenerateShim(&buf, ShimPython, "Greeter", Greeter(nil)); err == nil {
+		t.Error("Expected an error for a value that is not a pointer to an interface")
+	}
+	if err := GenerateShim(&buf, ShimPython, "Greeter-1", (*Greeter)(nil)); err == nil {
+		t.Error("Expected an error for a service name that is not an identifier")
+	}
+	if err := GenerateShim(&buf, ShimPython, "Bad", (*badShim)(nil)); err == nil {
+		t.Error("Expected an error for a method with two arguments")
+	}
+	if err := GenerateShim(&buf, ShimLanguage(9), "Greeter", (*Greeter)(nil)); err == nil {
+		t.Error("Expected an error for an unknown language")
+	}
+}
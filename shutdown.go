@@ -0,0 +1,169 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/rpc"
+	"sort"
+	"time"
+)
+
+// ErrShutdownTimeout is reported for a plugin that did not stop within the
+// StopTimeout of its PluginSpec when its Manager shut down.
+var ErrShutdownTimeout = errors.New("plugin did not stop within its stop timeout")
+
+// ShutdownReport is the result of Manager.Shutdown.
+type ShutdownReport struct {
+	// Plugins are the results for each plugin, in the order their stops
+	// began.
+	Plugins []PluginShutdown
+}
+
+// PluginShutdown is the result of stopping one plugin.
+type PluginShutdown struct {
+	Name string
+	// Err is the error stopping the plugin, if any.
+	Err error
+	// Duration is how long the plugin took to stop, or how long was waited
+	// for it if it did not stop in time.
+	Duration time.Duration
+}
+
+// Err returns the errors stopping the plugins, joined with errors.Join, or
+// nil if they all stopped cleanly.
+func (r *ShutdownReport) Err() error {
+	var errs []error
+	for _, p := range r.Plugins {
+		if p.Err != nil {
+			errs = append(errs, fmt.Errorf("plugin %s: %w", p.Name, p.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Shutdown stops the scheduled jobs and all the managed plugins, and reports
+// how each stop went.
+//
+// Plugins are stopped before the plugins they depend on, as given by the
+// DependsOn of their specs, so that no plugin loses a dependency while it is
+// still running.  Up to StopParallelism plugins are stopped at once, in order
+// of name among those whose dependents have stopped.  Plugins in a dependency
+// cycle are stopped together once nothing else can be.  Each plugin is given
+// the StopTimeout of its spec to stop; one that takes longer is reported with
+// ErrShutdownTimeout, and counts as stopped for the plugins it depends on.
+//
+// If ctx is done before all the plugins have stopped, the ones not yet being
+// stopped are stopped at once, regardless of their dependencies, and
+// Shutdown returns without waiting for them, reporting ctx's error for every
+// plugin that had not stopped.  The returned error is the report's Err.
+func (m *Manager) Shutdown(ctx context.Context) (*ShutdownReport, error) {
+	m.mu.Lock()
+	plugins := m.plugins
+	m.plugins = nil
+	schedules := m.schedules
+	m.schedules = nil
+	m.shutDown = true
+	m.mu.Unlock()
+	for s := range schedules {
+		s.stop()
+	}
+
+	names := make([]string, 0, len(plugins))
+	for name := range plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// deps are the running dependencies of each plugin, and dependents how
+	// many running plugins depend on each.
+	deps := map[string][]string{}
+	dependents := map[string]int{}
+	for _, name := range names {
+		seen := map[string]bool{}
+		for _, dep := range plugins[name].currentSpec().DependsOn {
+			if _, ok := plugins[dep]; !ok || dep == name || seen[dep] {
+				continue
+			}
+			seen[dep] = true
+			deps[name] = append(deps[name], dep)
+			dependents[dep]++
+		}
+	}
+
+	limit := m.StopParallelism
+	if limit <= 0 {
+		limit = len(names)
+	}
+	report := &ShutdownReport{}
+	index := map[string]int{}
+	results := make(chan PluginShutdown, len(names))
+	begin := func(name string) {
+		index[name] = len(report.Plugins)
+		report.Plugins = append(report.Plugins, PluginShutdown{Name: name})
+		go func() { results <- stopManaged(name, plugins[name]) }()
+	}
+	finished := map[string]bool{}
+	running := 0
+	cycle := false
+	for len(finished) < len(names) {
+		for _, name := range names {
+			if running >= limit {
+				break
+			}
+			if _, begun := index[name]; !begun && (dependents[name] == 0 || cycle) {
+				begin(name)
+				running++
+			}
+		}
+		if running == 0 {
+			// Everything left depends on something else left.
+			cycle = true
+			continue
+		}
+		select {
+		case r := <-results:
+			report.Plugins[index[r.Name]] = r
+			finished[r.Name] = true
+			running--
+			for _, dep := range deps[r.Name] {
+				dependents[dep]--
+			}
+		case <-ctx.Done():
+			for _, name := range names {
+				if _, begun := index[name]; !begun {
+					begin(name)
+				}
+			}
+			for i, p := range report.Plugins {
+				if !finished[p.Name] {
+					report.Plugins[i].Err = ctx.Err()
+				}
+			}
+			return report, report.Err()
+		}
+	}
+	return report, report.Err()
+}
+
+// stopManaged stops the plugin, waiting at most the StopTimeout of its spec.
+func stopManaged(name string, mp *managed) PluginShutdown {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- mp.sup.Close() }()
+	var timeout <-chan time.Time
+	if t := mp.currentSpec().StopTimeout; t > 0 {
+		timer := time.NewTimer(t)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var err error
+	select {
+	case err = <-done:
+		if err == rpc.ErrShutdown {
+			err = nil
+		}
+	case <-timeout:
+		err = ErrShutdownTimeout
+	}
+	return PluginShutdown{Name: name, Err: err, Duration: time.Since(start)}
+}
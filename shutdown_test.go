@@ -0,0 +1,162 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stopRecorder records the order in which the connections of the plugins
+// added with add are closed.
+type stopRecorder struct {
+	mu    sync.Mutex
+	order []string
+}
+
+// stopConn is a connection to a plugin that tells its recorder when it is
+// closed, and blocks closing until block is closed, if it is not nil.
+type stopConn struct {
+	net.Conn
+	name  string
+	rec   *stopRecorder
+	block chan struct{}
+	once  sync.Once
+}
+
+func (c *stopConn) Close() error {
+	c.once.Do(func() {
+		c.rec.mu.Lock()
+		c.rec.order = append(c.rec.order, c.name)
+		c.rec.mu.Unlock()
+		if c.block != nil {
+			<-c.block
+		}
+	})
+	return c.Conn.Close()
+}
+
+// add runs a plugin served over a pipe under m, as spec.
+func (r *stopRecorder) add(t *testing.T, m *Manager, spec PluginSpec, block chan struct{}) {
+	sup, err := Supervise(func() (*Plugin, error) {
+		serverConn, clientConn := net.Pipe()
+		s := NewProviderConn(serverConn)
+		s.RegisterName("api", api{})
+		go s.Serve()
+		return NewPlugin(&stopConn{Conn: clientConn, name: spec.Name, rec: r, block: block})
+	}, Policy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.plugins == nil {
+		m.plugins = map[string]*managed{}
+	}
+	m.plugins[spec.Name] = &managed{sup: sup, spec: spec}
+}
+
+func (r *stopRecorder) stopped() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.order...)
+}
+
+func TestManagerShutdownOrder(t *testing.T) {
+	m := &Manager{}
+	rec := &stopRecorder{}
+	// app depends on db and cache, and cache depends on db.  log depends on
+	// a plugin that is not running, which is ignored.
+	rec.add(t, m, PluginSpec{Name: "app", DependsOn: []string{"db", "cache"}}, nil)
+	rec.add(t, m, PluginSpec{Name: "cache", DependsOn: []string{"db"}}, nil)
+	rec.add(t, m, PluginSpec{Name: "db"}, nil)
+	rec.add(t, m, PluginSpec{Name: "log", DependsOn: []string{"missing"}}, nil)
+	m.StopParallelism = 1
+	report, err := m.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"app", "cache", "db", "log"}
+	if got := rec.stopped(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected plugins stopped in order %v, got %v", want, got)
+	}
+	var names []string
+	for _, p := range report.Plugins {
+		names = append(names, p.Name)
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected report in order %v, got %v", want, names)
+	}
+	if _, err := m.Supervisor("db"); !errors.Is(err, ErrUnknownPlugin) {
+		t.Errorf("Expected the plugins to be gone, got %v", err)
+	}
+}
+
+func TestManagerShutdownCycle(t *testing.T) {
+	m := &Manager{}
+	rec := &stopRecorder{}
+	rec.add(t, m, PluginSpec{Name: "a", DependsOn: []string{"b"}}, nil)
+	rec.add(t, m, PluginSpec{Name: "b", DependsOn: []string{"a"}}, nil)
+	rec.add(t, m, PluginSpec{Name: "c", DependsOn: []string{"a"}}, nil)
+	report, err := m.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rec.stopped(); len(got) != 3 || got[0] != "c" {
+		t.Errorf("Expected c to stop first and the cycle after, got %v", got)
+	}
+	if len(report.Plugins) != 3 {
+		t.Errorf("Expected 3 plugins in the report, got %+v", report.Plugins)
+	}
+}
+
+func TestManagerShutdownTimeout(t *testing.T) {
+	m := &Manager{}
+	rec := &stopRecorder{}
+	block := make(chan struct{})
+	defer close(block)
+	rec.add(t, m, PluginSpec{Name: "slow", StopTimeout: 50 * time.Millisecond, DependsOn: []string{"base"}}, block)
+	rec.add(t, m, PluginSpec{Name: "base"}, nil)
+	report, err := m.Shutdown(context.Background())
+	if !errors.Is(err, ErrShutdownTimeout) {
+		t.Fatalf("Expected ErrShutdownTimeout, got %v", err)
+	}
+	if len(report.Plugins) != 2 {
+		t.Fatalf("Expected 2 plugins in the report, got %+v", report.Plugins)
+	}
+	slow, base := report.Plugins[0], report.Plugins[1]
+	if slow.Name != "slow" || !errors.Is(slow.Err, ErrShutdownTimeout) || slow.Duration < 50*time.Millisecond {
+		t.Errorf("Wrong result for the slow plugin: %+v", slow)
+	}
+	// The timed out plugin no longer holds up its dependencies.
+	if base.Name != "base" || base.Err != nil {
+		t.Errorf("Wrong result for the base plugin: %+v", base)
+	}
+}
+
+func TestManagerShutdownContext(t *testing.T) {
+	m := &Manager{}
+	rec := &stopRecorder{}
+	block := make(chan struct{})
+	defer close(block)
+	rec.add(t, m, PluginSpec{Name: "stuck", DependsOn: []string{"base"}}, block)
+	rec.add(t, m, PluginSpec{Name: "base"}, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	report, err := m.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the context's error, got %v", err)
+	}
+	if len(report.Plugins) != 2 || !errors.Is(report.Plugins[0].Err, context.DeadlineExceeded) {
+		t.Errorf("Expected the stuck plugin to be reported, got %+v", report.Plugins)
+	}
+	// The dependency is stopped anyway once ctx is done.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(rec.stopped()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := rec.stopped(); len(got) != 2 {
+		t.Errorf("Expected both plugins to be stopped, got %v", got)
+	}
+}
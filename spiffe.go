@@ -0,0 +1,120 @@
+package pie
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// SPIFFE identifies workloads by SPIFFE IDs, URIs such as
+// spiffe://example.org/plugins/resizer, carried as the only URI SAN of their
+// X.509 SVIDs, which are certificates issued to them by the SPIFFE Workload
+// API.  Trust is organized by trust domain, the host part of the ID, each with
+// its own bundle of authorities.
+//
+// The Workload API is a gRPC service, so pie does not talk to it itself.  An
+// IdentityProvider that returns the SVID and bundles of a Workload API client,
+// such as the X509Source of github.com/spiffe/go-spiffe, plugs it into the
+// configurations made here.  Alternatively, an agent that writes the SVID and
+// bundle to files, such as spiffe-helper, can be used with WatchCertFiles.
+
+// SPIFFEIDAuthorizer decides whether a peer with the given SPIFFE ID, whose
+// certificate has already been verified against its trust domain's bundle, may
+// connect.  It returns an error if the peer may not.
+type SPIFFEIDAuthorizer func(id *url.URL) error
+
+// AuthorizeSPIFFEID returns a SPIFFEIDAuthorizer that accepts only peers with
+// one of the given IDs.
+func AuthorizeSPIFFEID(ids ...string) SPIFFEIDAuthorizer {
+	return func(id *url.URL) error {
+		for _, want := range ids {
+			if id.String() == want {
+				return nil
+			}
+		}
+		return fmt.Errorf("pie: SPIFFE ID %s is not authorized", id)
+	}
+}
+
+// AuthorizeTrustDomain returns a SPIFFEIDAuthorizer that accepts any peer in
+// one of the given trust domains, such as "example.org".
+func AuthorizeTrustDomain(domains ...string) SPIFFEIDAuthorizer {
+	return func(id *url.URL) error {
+		for _, d := range domains {
+			if id.Host == d {
+				return nil
+			}
+		}
+		return fmt.Errorf("pie: SPIFFE ID %s is not in an authorized trust domain", id)
+	}
+}
+
+// SPIFFEClientConfig returns a TLS configuration for the host's side of
+// connections to plugins, which presents the X.509 SVID of p's current
+// identity and accepts plugins with valid SVIDs whose IDs authorize accepts.
+// Server names are not checked, since SVIDs identify workloads by ID rather
+// than by DNS name.
+func SPIFFEClientConfig(p IdentityProvider, authorize SPIFFEIDAuthorizer) *tls.Config {
+	return clientTLSConfig(p, func(cs tls.ConnectionState, id *TLSIdentity) error {
+		return verifySVID(cs, id, authorize)
+	})
+}
+
+// SPIFFEServerConfig returns a TLS configuration for the plugin's side of
+// connections from hosts, which presents the X.509 SVID of p's current
+// identity and accepts hosts with valid SVIDs whose IDs authorize accepts.
+func SPIFFEServerConfig(p IdentityProvider, authorize SPIFFEIDAuthorizer) *tls.Config {
+	return serverTLSConfig(p, func(cs tls.ConnectionState, id *TLSIdentity) error {
+		return verifySVID(cs, id, authorize)
+	})
+}
+
+// SPIFFEID returns the SPIFFE ID of an X.509 SVID.  It returns an error if
+// cert does not have exactly one URI SAN, or it is not a valid SPIFFE ID.
+func SPIFFEID(cert *x509.Certificate) (*url.URL, error) {
+	if len(cert.URIs) != 1 {
+		return nil, fmt.Errorf("pie: certificate has %d URI SANs, not one SPIFFE ID", len(cert.URIs))
+	}
+	id := cert.URIs[0]
+	switch {
+	case id.Scheme != "spiffe":
+		return nil, fmt.Errorf("pie: %s is not a SPIFFE ID", id)
+	case id.Host == "" || id.User != nil || id.Port() != "":
+		return nil, fmt.Errorf("pie: SPIFFE ID %s has an invalid trust domain", id)
+	case id.RawQuery != "" || id.Fragment != "" || strings.HasSuffix(id.Path, "/"):
+		return nil, fmt.Errorf("pie: SPIFFE ID %s is invalid", id)
+	}
+	return id, nil
+}
+
+// verifySVID verifies the SVID the peer presented against the bundle for its
+// trust domain, and checks that authorize accepts its ID.
+func verifySVID(cs tls.ConnectionState, id *TLSIdentity, authorize SPIFFEIDAuthorizer) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("pie: peer presented no certificate")
+	}
+	leaf := cs.PeerCertificates[0]
+	if leaf.IsCA {
+		return errors.New("pie: peer's SVID is a CA certificate")
+	}
+	peerID, err := SPIFFEID(leaf)
+	if err != nil {
+		return err
+	}
+	roots := id.Roots
+	if id.Bundles != nil {
+		if roots = id.Bundles[peerID.Host]; roots == nil {
+			return fmt.Errorf("pie: no bundle for trust domain %s", peerID.Host)
+		}
+	}
+	if _, err := verifyPeer(cs, roots, "", x509.ExtKeyUsageAny); err != nil {
+		return err
+	}
+	if authorize == nil {
+		return errors.New("pie: no SPIFFE ID authorizer")
+	}
+	return authorize(peerID)
+}
@@ -0,0 +1,114 @@
+package pie
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/url"
+	"testing"
+)
+
+// workloadSource stands in for a SPIFFE Workload API client.
+type workloadSource struct {
+	id  *TLSIdentity
+	err error
+}
+
+func (s workloadSource) Identity() (*TLSIdentity, error) {
+	return s.id, s.err
+}
+
+func svidSource(t *testing.T, ca *testCA, spiffeID string, bundles map[string]*testCA) workloadSource {
+	cert, _, _ := ca.issue(t, "", spiffeID)
+	id := &TLSIdentity{Certificate: cert, Bundles: map[string]*x509.CertPool{}}
+	for domain, ca := range bundles {
+		pool := x509.NewCertPool()
+		pool.AddCert(ca.cert)
+		id.Bundles[domain] = pool
+	}
+	return workloadSource{id: id}
+}
+
+func TestSPIFFE(t *testing.T) {
+	ca := newTestCA(t)
+	bundles := map[string]*testCA{"example.org": ca}
+	host := svidSource(t, ca, "spiffe://example.org/host", bundles)
+	plugin := svidSource(t, ca, "spiffe://example.org/plugins/resizer", bundles)
+
+	p, err := tlsPlugin(t,
+		SPIFFEClientConfig(host, AuthorizeSPIFFEID("spiffe://example.org/plugins/resizer")),
+		SPIFFEServerConfig(plugin, AuthorizeTrustDomain("example.org")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	callSayHi(t, p)
+
+	if _, err := tlsPlugin(t,
+		SPIFFEClientConfig(host, AuthorizeSPIFFEID("spiffe://example.org/plugins/other")),
+		SPIFFEServerConfig(plugin, AuthorizeTrustDomain("example.org"))); err == nil {
+		t.Error("Connected to a plugin with an unauthorized ID")
+	}
+}
+
+func TestSPIFFETrustDomainBundles(t *testing.T) {
+	ours, theirs := newTestCA(t), newTestCA(t)
+	bundles := map[string]*testCA{"example.org": ours, "partner.org": theirs}
+	host := svidSource(t, ours, "spiffe://example.org/host", bundles)
+	// The plugin claims to be in partner.org, but its SVID was signed by
+	// example.org's authority, which partner.org's bundle does not include.
+	plugin := svidSource(t, ours, "spiffe://partner.org/plugin", bundles)
+	if _, err := tlsPlugin(t,
+		SPIFFEClientConfig(host, AuthorizeTrustDomain("partner.org")),
+		SPIFFEServerConfig(plugin, AuthorizeTrustDomain("example.org"))); err == nil {
+		t.Error("Accepted an SVID signed by another trust domain's authority")
+	}
+	plugin = svidSource(t, theirs, "spiffe://partner.org/plugin", bundles)
+	p, err := tlsPlugin(t,
+		SPIFFEClientConfig(host, AuthorizeTrustDomain("partner.org")),
+		SPIFFEServerConfig(plugin, AuthorizeTrustDomain("example.org")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	callSayHi(t, p)
+}
+
+func TestSPIFFEProviderError(t *testing.T) {
+	ca := newTestCA(t)
+	bundles := map[string]*testCA{"example.org": ca}
+	plugin := svidSource(t, ca, "spiffe://example.org/plugin", bundles)
+	broken := workloadSource{err: errors.New("workload API unavailable")}
+	if _, err := tlsPlugin(t,
+		SPIFFEClientConfig(broken, AuthorizeTrustDomain("example.org")),
+		SPIFFEServerConfig(plugin, AuthorizeTrustDomain("example.org"))); err == nil {
+		t.Error("Connected without an identity")
+	}
+}
+
+func TestSPIFFEID(t *testing.T) {
+	for _, test := range []struct {
+		uris []string
+		ok   bool
+	}{
+		{[]string{"spiffe://example.org/workload"}, true},
+		{[]string{"spiffe://example.org"}, true},
+		{nil, false},
+		{[]string{"spiffe://example.org/a", "spiffe://example.org/b"}, false},
+		{[]string{"https://example.org/workload"}, false},
+		{[]string{"spiffe:///workload"}, false},
+		{[]string{"spiffe://example.org:443/workload"}, false},
+		{[]string{"spiffe://user@example.org/workload"}, false},
+		{[]string{"spiffe://example.org/workload?x=1"}, false},
+		{[]string{"spiffe://example.org/workload/"}, false},
+	} {
+		cert := &x509.Certificate{}
+		for _, u := range test.uris {
+			parsed, err := url.Parse(u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert.URIs = append(cert.URIs, parsed)
+		}
+		if _, err := SPIFFEID(cert); (err == nil) != test.ok {
+			t.Errorf("SPIFFEID(%v): expected ok=%v, got %v", test.uris, test.ok, err)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package pie
+
+import "errors"
+
+// dumpStacks is not supported on platforms without SIGQUIT.
+func dumpStacks(proc osProcess) error {
+	return errors.New("dumping stacks is not supported on this platform")
+}
@@ -0,0 +1,11 @@
+//go:build unix
+
+package pie
+
+import "syscall"
+
+// dumpStacks asks proc to write the stacks of its goroutines to stderr, which
+// the Go runtime does on receiving SIGQUIT.
+func dumpStacks(proc osProcess) error {
+	return proc.Signal(syscall.SIGQUIT)
+}
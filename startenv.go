@@ -0,0 +1,213 @@
+package pie
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// redacted replaces the values of environment variables that StartEnvironment
+// does not record.
+const redacted = "[redacted]"
+
+// StartEnvironment describes what StartPlugin actually started a plugin with,
+// once every option had adjusted it, so that a plugin that behaves
+// differently on one machine can be diagnosed from its report alone.
+type StartEnvironment struct {
+	// Time is when the plugin was started.
+	Time time.Time
+	// Path is the path of the plugin's executable, and Args its arguments,
+	// including the command name, redacted as Env is: the values of flags
+	// with such words in their names, given as "--name=value" or as the next
+	// argument, and the passwords in URLs.
+	Path string
+	Args []string
+	// Env is the plugin's environment, sorted, with the values of variables
+	// that look like they hold secrets redacted: those with a word such as
+	// SECRET, TOKEN, PASSWORD, or KEY in their names, and the passwords in
+	// URLs.  The token of the bootstrap address set by WithSocketBootstrap is
+	// always redacted, in the environment and in the arguments.
+	Env []string
+	// Dir is the plugin's working directory.
+	Dir string
+	// UID and GID are the user and group the plugin runs as, or -1 on
+	// platforms without them.
+	UID, GID int
+	// Limits are the plugin's resource limits, by name, such as "nofile" and
+	// "core", on platforms with them.  The plugin inherits them from the
+	// host, but the Go runtime raises its own soft "nofile" limit.
+	Limits map[string]ResourceLimit
+}
+
+// ResourceLimit is a resource limit.  Unlimited values are ^uint64(0).
+type ResourceLimit struct {
+	Soft, Hard uint64
+}
+
+// StartEnvironment returns what the plugin was started with, or nil if it was
+// not started as a process by StartPlugin.
+func (p *Plugin) StartEnvironment() *StartEnvironment {
+	return p.startEnv
+}
+
+// String returns a multi-line description of the start environment, for
+// pasting into bug reports.
+func (e *StartEnvironment) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "started: %s\n", e.Time.Format(time.RFC3339))
+	fmt.Fprintf(&b, "path: %s\n", e.Path)
+	fmt.Fprintf(&b, "args: %q\n", e.Args)
+	fmt.Fprintf(&b, "dir: %s\n", e.Dir)
+	fmt.Fprintf(&b, "uid: %d, gid: %d\n", e.UID, e.GID)
+	names := make([]string, 0, len(e.Limits))
+	for name := range e.Limits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		l := e.Limits[name]
+		fmt.Fprintf(&b, "limit %s: %s soft, %s hard\n", name, formatLimit(l.Soft), formatLimit(l.Hard))
+	}
+	b.WriteString("env:\n")
+	for _, kv := range e.Env {
+		fmt.Fprintf(&b, "  %s\n", kv)
+	}
+	return b.String()
+}
+
+// formatLimit formats a resource limit value.
+func formatLimit(v uint64) string {
+	if v == ^uint64(0) {
+		return "unlimited"
+	}
+	return fmt.Sprint(v)
+}
+
+// captureStartEnvironment returns what cmd is about to be started with.
+func captureStartEnvironment(cmd *exec.Cmd) *StartEnvironment {
+	e := &StartEnvironment{
+		Time: time.Now(),
+		Path: cmd.Path,
+		Args: sanitizeArgs(cmd.Args),
+		Dir:  cmd.Dir,
+	}
+	if e.Dir == "" {
+		e.Dir, _ = os.Getwd()
+	}
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	// Like os/exec, keep the last of duplicate variables.
+	vars := map[string]string{}
+	for _, kv := range env {
+		key, _, _ := strings.Cut(kv, "=")
+		vars[key] = kv
+	}
+	for _, kv := range vars {
+		e.Env = append(e.Env, sanitizeEnv(kv))
+	}
+	sort.Strings(e.Env)
+	e.UID, e.GID = processCredential(cmd)
+	e.Limits = resourceLimits()
+	return e
+}
+
+// secretWords are the words in the names of environment variables whose
+// values StartEnvironment redacts.
+var secretWords = map[string]bool{
+	"SECRET": true, "SECRETS": true, "TOKEN": true, "TOKENS": true,
+	"PASSWORD": true, "PASSWD": true, "PASS": true, "KEY": true, "KEYS": true,
+	"APIKEY": true, "CREDENTIAL": true, "CREDENTIALS": true, "AUTH": true,
+	"PRIVATE": true, "COOKIE": true, "SESSION": true, "SIGNATURE": true,
+}
+
+// sanitizeEnv returns the environment variable kv, of the form "key=value",
+// with its value redacted if it may hold a secret.
+func sanitizeEnv(kv string) string {
+	key, value, ok := strings.Cut(kv, "=")
+	if !ok {
+		return kv
+	}
+	if key == bootstrapEnv {
+		return key + "=" + redactBootstrap(value)
+	}
+	if secretName(key) {
+		return key + "=" + redacted
+	}
+	return key + "=" + redactURL(value)
+}
+
+// sanitizeArgs returns a copy of the command line args with the values that
+// may hold secrets redacted, as sanitizeEnv redacts variables: the values of
+// flags with secret names, whether given as "--name=value" or as the argument
+// after the flag, passwords in URLs, and the token of a bootstrap address.
+func sanitizeArgs(args []string) []string {
+	if args == nil {
+		return nil
+	}
+	out := make([]string, len(args))
+	secretNext := false
+	for i, arg := range args {
+		switch {
+		case i == 0:
+			out[i] = arg
+		case secretNext:
+			out[i] = redacted
+			secretNext = false
+		case strings.HasPrefix(arg, "-"):
+			name, value, hasValue := strings.Cut(arg, "=")
+			switch {
+			case strings.TrimPrefix(name, "-") == bootstrapFlag[1:] && hasValue:
+				out[i] = name + "=" + redactBootstrap(value)
+			case secretName(name) && hasValue:
+				out[i] = name + "=" + redacted
+			case hasValue:
+				out[i] = name + "=" + redactURL(value)
+			default:
+				out[i] = arg
+				secretNext = secretName(name) && name != "--"
+			}
+		default:
+			out[i] = redactURL(arg)
+		}
+	}
+	return out
+}
+
+// secretName reports whether the name of a variable or flag has one of
+// secretWords in it.
+func secretName(name string) bool {
+	for _, word := range strings.FieldsFunc(strings.ToUpper(name), func(r rune) bool {
+		return !('A' <= r && r <= 'Z' || '0' <= r && r <= '9')
+	}) {
+		if secretWords[word] {
+			return true
+		}
+	}
+	return false
+}
+
+// redactURL returns s with the password redacted, if it is a URL with one.
+func redactURL(s string) string {
+	if u, err := url.Parse(s); err == nil && u.User != nil {
+		if _, hasPassword := u.User.Password(); hasPassword {
+			return u.Redacted()
+		}
+	}
+	return s
+}
+
+// redactBootstrap returns the bootstrap address addr, of the form
+// tcp://host:port/token, with its token redacted.
+func redactBootstrap(addr string) string {
+	u, err := url.Parse(addr)
+	if err != nil || u.Host == "" {
+		return redacted
+	}
+	return u.Scheme + "://" + u.Host + "/" + redacted
+}
@@ -0,0 +1,19 @@
+//go:build !unix || aix
+
+package pie
+
+import (
+	"os"
+	"os/exec"
+)
+
+// processCredential returns the user and group cmd runs as, which are -1 on
+// platforms without them.
+func processCredential(cmd *exec.Cmd) (uid, gid int) {
+	return os.Getuid(), os.Getgid()
+}
+
+// resourceLimits returns nil, since this platform has no resource limits.
+func resourceLimits() map[string]ResourceLimit {
+	return nil
+}
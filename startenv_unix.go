@@ -0,0 +1,37 @@
+//go:build unix && !aix
+
+package pie
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// processCredential returns the user and group cmd runs as.
+func processCredential(cmd *exec.Cmd) (uid, gid int) {
+	if cmd.SysProcAttr != nil && cmd.SysProcAttr.Credential != nil {
+		return int(cmd.SysProcAttr.Credential.Uid), int(cmd.SysProcAttr.Credential.Gid)
+	}
+	return os.Getuid(), os.Getgid()
+}
+
+// resourceLimits returns the host's resource limits, which its plugins
+// inherit.
+func resourceLimits() map[string]ResourceLimit {
+	limits := map[string]ResourceLimit{}
+	for name, resource := range map[string]int{
+		"core":   syscall.RLIMIT_CORE,
+		"cpu":    syscall.RLIMIT_CPU,
+		"data":   syscall.RLIMIT_DATA,
+		"fsize":  syscall.RLIMIT_FSIZE,
+		"nofile": syscall.RLIMIT_NOFILE,
+		"stack":  syscall.RLIMIT_STACK,
+	} {
+		var l syscall.Rlimit
+		if syscall.Getrlimit(resource, &l) == nil {
+			limits[name] = ResourceLimit{Soft: uint64(l.Cur), Hard: uint64(l.Max)}
+		}
+	}
+	return limits
+}
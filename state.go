@@ -0,0 +1,142 @@
+package pie
+
+import (
+	"net/rpc"
+	"strconv"
+)
+
+// State is a stage in the life of a plugin handle.  A handle moves through
+// its states in one direction only:
+//
+//	Starting → Ready → Serving ─┬→ Draining → Stopped
+//	                            └→ Failed
+//
+// Handles for plugins not started with WithPhases begin in StateServing.  A
+// handle in any of the first three states moves to StateDraining when it is
+// closed with Close or handed over with Detach, and to StateFailed when the
+// plugin exits without being closed, or stops answering the pings asked for by
+// Timeouts.Keepalive.  A draining handle is stopped once the plugin has
+// exited, and a failed handle stays failed when it is closed.
+//
+// What a handle allows depends on its state:
+//
+//   - Starting: Init, and calls to the control API, such as Ping and
+//     Manifest.  Call and Notify return ErrNotServing.
+//   - Ready: StartServing, and the control API.  Call and Notify return
+//     ErrNotServing.
+//   - Serving: everything.
+//   - Draining, Stopped, and Failed: nothing more is sent to the plugin.
+//     Call, Notify, Init, and StartServing return rpc.ErrShutdown, as do
+//     calls in flight that had not been answered, and closing the handle
+//     again returns an error.  Exited, ExitErr, and CrashReport describe the
+//     plugin's exit once it has exited.
+//
+// The accessors, such as State, Phase, and ConnStats, may be used in every
+// state.  All of a handle's methods may be called from any goroutine.
+type State int32
+
+const (
+	// StateStarting is the state of a plugin started with WithPhases that
+	// has not been initialized with Init.
+	StateStarting State = iota
+	// StateReady is the state of a plugin started with WithPhases that has
+	// been initialized, but not yet let application calls through with
+	// StartServing.
+	StateReady
+	// StateServing is the state of a plugin that takes application calls.
+	StateServing
+	// StateDraining is the state of a handle that has been closed or
+	// detached, whose plugin has not yet exited.
+	StateDraining
+	// StateStopped is the state of a handle that was closed or detached,
+	// once its plugin has exited.
+	StateStopped
+	// StateFailed is the state of a handle whose plugin exited without being
+	// closed, or was closed by the handle for not answering keepalive pings.
+	StateFailed
+)
+
+var stateNames = [...]string{
+	StateStarting: "starting",
+	StateReady:    "ready",
+	StateServing:  "serving",
+	StateDraining: "draining",
+	StateStopped:  "stopped",
+	StateFailed:   "failed",
+}
+
+// String returns the name of the state.
+func (s State) String() string {
+	if s >= 0 && int(s) < len(stateNames) {
+		return stateNames[s]
+	}
+	return "State(" + strconv.Itoa(int(s)) + ")"
+}
+
+// How a handle was stopped, as recorded in Plugin.stopped.
+const (
+	// notStopped is the value of handles that have not been stopped.
+	notStopped int32 = iota
+	// stoppedByHost is the value of handles closed or detached by the host.
+	stoppedByHost
+	// stoppedByFailure is the value of handles closed because the plugin
+	// stopped responding.
+	stoppedByFailure
+)
+
+// State returns the state of the handle.
+func (p *Plugin) State() State {
+	exited := p.exited()
+	switch p.stopped.Load() {
+	case stoppedByHost:
+		if exited {
+			return StateStopped
+		}
+		return StateDraining
+	case stoppedByFailure:
+		return StateFailed
+	}
+	if exited {
+		return StateFailed
+	}
+	switch p.Phase() {
+	case PhaseInit:
+		return StateStarting
+	case PhaseReady:
+		return StateReady
+	}
+	return StateServing
+}
+
+// exited reports whether the plugin has exited.
+func (p *Plugin) exited() bool {
+	if p.proc == nil {
+		return false
+	}
+	select {
+	case <-p.proc.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop records that the handle has been stopped, for the given reason, unless
+// it already has been.  Stopping a handle whose plugin has already exited
+// leaves it failed, so that closing a crashed plugin does not hide the crash.
+func (p *Plugin) stop(reason int32) {
+	if reason == stoppedByHost && p.exited() {
+		reason = stoppedByFailure
+	}
+	p.stopped.CompareAndSwap(notStopped, reason)
+}
+
+// checkRunning returns rpc.ErrShutdown if the handle is draining, stopped, or
+// failed.
+func (p *Plugin) checkRunning() error {
+	switch p.State() {
+	case StateDraining, StateStopped, StateFailed:
+		return rpc.ErrShutdown
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"net/rpc"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStatePhases(t *testing.T) {
+	p := inProcessAPI(t, WithPhases())
+	defer p.Close()
+	if s := p.State(); s != StateStarting {
+		t.Errorf("Expected a phased plugin to start in %s, got %s", StateStarting, s)
+	}
+	if err := p.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if s := p.State(); s != StateReady {
+		t.Errorf("Expected an initialized plugin to be %s, got %s", StateReady, s)
+	}
+	if err := p.StartServing(); err != nil {
+		t.Fatal(err)
+	}
+	if s := p.State(); s != StateServing {
+		t.Errorf("Expected %s, got %s", StateServing, s)
+	}
+}
+
+func TestStateClose(t *testing.T) {
+	p := inProcessAPI(t, WithPhases())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			p.State()
+		}
+	}()
+	p.Close()
+	wg.Wait()
+	select {
+	case <-p.Exited():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the plugin to exit")
+	}
+	if s := p.State(); s != StateStopped {
+		t.Errorf("Expected a closed plugin to be %s, got %s", StateStopped, s)
+	}
+	var reply string
+	if err := p.Call("api.SayHi", "bob", &reply); !errors.Is(err, rpc.ErrShutdown) {
+		t.Errorf("Expected calls to a stopped plugin to fail with rpc.ErrShutdown, got %v", err)
+	}
+	if err := p.Init(context.Background()); !errors.Is(err, rpc.ErrShutdown) {
+		t.Errorf("Expected initializing a stopped plugin to fail with rpc.ErrShutdown, got %v", err)
+	}
+}
+
+func TestStateFailed(t *testing.T) {
+	p := startHelper(t, "provider", os.Stderr)
+	if s := p.State(); s != StateServing {
+		t.Errorf("Expected %s, got %s", StateServing, s)
+	}
+	p.Call("helper.Exit", 3, new(int))
+	select {
+	case <-p.Exited():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the plugin to exit")
+	}
+	if s := p.State(); s != StateFailed {
+		t.Errorf("Expected a plugin that exited by itself to be %s, got %s", StateFailed, s)
+	}
+	if err := p.Notify("api.SayHi", "bob"); !errors.Is(err, rpc.ErrShutdown) {
+		t.Errorf("Expected notifying a failed plugin to fail with rpc.ErrShutdown, got %v", err)
+	}
+	p.Close()
+	if s := p.State(); s != StateFailed {
+		t.Errorf("Expected closing a failed plugin to leave it %s, got %s", StateFailed, s)
+	}
+}
+
+func TestStateString(t *testing.T) {
+	if s := StateDraining.String(); s != "draining" {
+		t.Errorf("Expected draining, got %q", s)
+	}
+	if s := State(42).String(); s != "State(42)" {
+		t.Errorf("Expected State(42), got %q", s)
+	}
+}
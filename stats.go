@@ -0,0 +1,113 @@
+package pie
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrStatsUnsupported is returned by Plugin.Stats on platforms where the
+// resource usage of a process cannot be determined, which are all but Linux
+// and Windows.  On macOS and the BSDs, pie does not yet read process stats.
+var ErrStatsUnsupported = errors.New("process stats are not supported on this platform")
+
+// Stats describes the resource usage of a plugin process.
+type Stats struct {
+	// RSS is the resident set size of the process, in bytes.
+	RSS uint64
+	// CPUTime is the total user and system CPU time used by the process.
+	CPUTime time.Duration
+	// OpenFDs is the number of open file descriptors (or handles, on Windows)
+	// held by the process.
+	OpenFDs int
+	// Uptime is how long ago the process was started.
+	Uptime time.Duration
+}
+
+// Stats returns the current resource usage of the plugin process.  It is
+// supported on Linux and Windows.  Elsewhere, including on macOS and the BSDs,
+// and where resource usage cannot be determined, the returned Stats has only
+// Uptime set, and the error is ErrStatsUnsupported.  If reading the usage
+// fails, for example because the process has exited, the returned Stats also
+// has only Uptime set, and the error says why; Stats never returns part of the
+// usage.
+func (p *Plugin) Stats() (Stats, error) {
+	s := Stats{Uptime: time.Since(p.started)}
+	pid := p.Pid()
+	if pid == 0 {
+		return s, ErrStatsUnsupported
+	}
+	usage := s
+	if err := processStats(pid, &usage); err != nil {
+		if errors.Is(err, ErrStatsUnsupported) {
+			return s, err
+		}
+		return s, fmt.Errorf("pie: reading the stats of process %d: %w", pid, err)
+	}
+	return usage, nil
+}
+
+// Pid returns the process ID of the plugin, or 0 if it is not known.
+func (p *Plugin) Pid() int {
+	return processID(p.proc.osProcess)
+}
+
+// ThresholdAction is what a Supervisor does when a plugin exceeds one of its
+// Policy's Thresholds.
+type ThresholdAction int
+
+const (
+	// ThresholdWarn emits an EventThreshold but otherwise leaves the plugin
+	// alone.
+	ThresholdWarn ThresholdAction = iota
+	// ThresholdRecycle emits an EventThreshold and recycles the plugin, as if
+	// it had reached the Policy's MaxCalls.
+	ThresholdRecycle
+	// ThresholdKill emits an EventThreshold and kills the plugin, which is
+	// then restarted like a plugin that exited on its own.
+	ThresholdKill
+)
+
+// Threshold is a limit on the resources a supervised plugin may use.  Zero
+// fields are not checked.
+type Threshold struct {
+	MaxRSS     uint64
+	MaxCPUTime time.Duration
+	MaxOpenFDs int
+	Action     ThresholdAction
+}
+
+// ThresholdError is the error in an EventThreshold, describing which limit of
+// which Threshold was exceeded.
+type ThresholdError struct {
+	Threshold Threshold
+	Stats     Stats
+	// Resource is the name of the resource that exceeded its limit: "RSS",
+	// "CPU time", or "open FDs".
+	Resource string
+}
+
+// Error implements the error interface.
+func (e *ThresholdError) Error() string {
+	switch e.Resource {
+	case "RSS":
+		return fmt.Sprintf("plugin RSS of %d bytes exceeds threshold of %d bytes", e.Stats.RSS, e.Threshold.MaxRSS)
+	case "CPU time":
+		return fmt.Sprintf("plugin CPU time of %s exceeds threshold of %s", e.Stats.CPUTime, e.Threshold.MaxCPUTime)
+	default:
+		return fmt.Sprintf("plugin has %d open FDs, exceeding threshold of %d", e.Stats.OpenFDs, e.Threshold.MaxOpenFDs)
+	}
+}
+
+// check returns a ThresholdError if s exceeds t, and nil otherwise.
+func (t Threshold) check(s Stats) *ThresholdError {
+	switch {
+	case t.MaxRSS > 0 && s.RSS > t.MaxRSS:
+		return &ThresholdError{Threshold: t, Stats: s, Resource: "RSS"}
+	case t.MaxCPUTime > 0 && s.CPUTime > t.MaxCPUTime:
+		return &ThresholdError{Threshold: t, Stats: s, Resource: "CPU time"}
+	case t.MaxOpenFDs > 0 && s.OpenFDs > t.MaxOpenFDs:
+		return &ThresholdError{Threshold: t, Stats: s, Resource: "open FDs"}
+	}
+	return nil
+}
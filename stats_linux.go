@@ -0,0 +1,56 @@
+package pie
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTicks is the unit of the CPU times in /proc/<pid>/stat.  USER_HZ is 100
+// on every architecture Go supports.
+const clockTicks = 100
+
+// processStats fills in s with the resource usage of the process with the
+// given pid, as reported by /proc.
+func processStats(pid int, s *Stats) error {
+	dir := "/proc/" + strconv.Itoa(pid)
+	stat, err := os.ReadFile(dir + "/stat")
+	if err != nil {
+		return err
+	}
+	// The command name in the second field may contain spaces, so skip past
+	// its closing paren before splitting.
+	i := strings.LastIndexByte(string(stat), ')')
+	if i < 0 {
+		return fmt.Errorf("malformed %s/stat", dir)
+	}
+	fields := strings.Fields(string(stat[i+1:]))
+	// fields[0] is field 3 of stat: utime and stime are fields 14 and 15, and
+	// rss (in pages) is field 24.
+	if len(fields) < 22 {
+		return fmt.Errorf("malformed %s/stat", dir)
+	}
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return err
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return err
+	}
+	rss, err := strconv.ParseUint(fields[21], 10, 64)
+	if err != nil {
+		return err
+	}
+	s.CPUTime = time.Duration(utime+stime) * time.Second / clockTicks
+	s.RSS = rss * uint64(os.Getpagesize())
+
+	fds, err := os.ReadDir(dir + "/fd")
+	if err != nil {
+		return err
+	}
+	s.OpenFDs = len(fds)
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !windows
+
+package pie
+
+// processStats is not supported on this platform.  Reading the stats of a
+// process on macOS and the BSDs needs their kinfo_proc structures, which are
+// not implemented.
+func processStats(pid int, s *Stats) error {
+	return ErrStatsUnsupported
+}
@@ -0,0 +1,109 @@
+package pie
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPluginStats(t *testing.T) {
+	p := startHelper(t, "provider", nil)
+	defer p.Close()
+	// Make sure the plugin is up and running before measuring it.
+	if err := p.Ping(); err != nil {
+		t.Fatalf("Unexpected error from Ping: %#v", err)
+	}
+	s, err := p.Stats()
+	if err == ErrStatsUnsupported {
+		t.Skip("process stats are not supported on this platform")
+	}
+	if err != nil {
+		t.Fatalf("Unexpected error from Stats: %#v", err)
+	}
+	if s.RSS == 0 {
+		t.Error("Expected non-zero RSS")
+	}
+	if s.OpenFDs < 3 {
+		t.Errorf("Expected at least stdin, stdout, and stderr to be open, got %d FDs", s.OpenFDs)
+	}
+	if s.Uptime <= 0 {
+		t.Errorf("Expected positive uptime, got %s", s.Uptime)
+	}
+}
+
+func TestPluginStatsExited(t *testing.T) {
+	p := startHelper(t, "provider", nil)
+	if err := p.Ping(); err != nil {
+		t.Fatalf("Unexpected error from Ping: %#v", err)
+	}
+	p.Close()
+	s, err := p.Stats()
+	if err == ErrStatsUnsupported {
+		t.Skip("process stats are not supported on this platform")
+	}
+	if err == nil {
+		t.Fatal("Expected an error reading the stats of an exited plugin")
+	}
+	if s.RSS != 0 || s.CPUTime != 0 || s.OpenFDs != 0 {
+		t.Errorf("Expected no usage with the error, got %+v", s)
+	}
+	if s.Uptime <= 0 {
+		t.Errorf("Expected positive uptime, got %s", s.Uptime)
+	}
+}
+
+func TestThresholdCheck(t *testing.T) {
+	s := Stats{RSS: 100, CPUTime: time.Second, OpenFDs: 10}
+	tests := []struct {
+		threshold Threshold
+		resource  string
+	}{
+		{Threshold{}, ""},
+		{Threshold{MaxRSS: 100, MaxCPUTime: time.Second, MaxOpenFDs: 10}, ""},
+		{Threshold{MaxRSS: 99}, "RSS"},
+		{Threshold{MaxCPUTime: time.Millisecond}, "CPU time"},
+		{Threshold{MaxOpenFDs: 9}, "open FDs"},
+	}
+	for _, test := range tests {
+		err := test.threshold.check(s)
+		if test.resource == "" {
+			if err != nil {
+				t.Errorf("Unexpected error for %#v: %s", test.threshold, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("Expected %s to exceed %#v", test.resource, test.threshold)
+			continue
+		}
+		if err.Resource != test.resource {
+			t.Errorf("Wrong resource exceeded for %#v, expected %q, got %q", test.threshold, test.resource, err.Resource)
+		}
+	}
+}
+
+func TestSuperviseThresholdKill(t *testing.T) {
+	if err := processStats(0, &Stats{}); err == ErrStatsUnsupported {
+		t.Skip("process stats are not supported on this platform")
+	}
+	events := newEventRecorder()
+	s, err := Supervise(helperStarter("provider"), Policy{
+		MaxRestarts:   1,
+		Thresholds:    []Threshold{{MaxOpenFDs: 1, Action: ThresholdKill}},
+		StatsInterval: 10 * time.Millisecond,
+		OnEvent:       events.record,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error from Supervise: %#v", err)
+	}
+	defer s.Close()
+	e := events.waitFor(t, EventThreshold)
+	terr, ok := e.Err.(*ThresholdError)
+	if !ok {
+		t.Fatalf("Expected *ThresholdError in threshold event, got %#v", e.Err)
+	}
+	if terr.Resource != "open FDs" {
+		t.Errorf("Wrong resource exceeded, expected %q, got %q", "open FDs", terr.Resource)
+	}
+	events.waitFor(t, EventExited)
+	events.waitFor(t, EventRestarted)
+}
@@ -0,0 +1,69 @@
+package pie
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Access rights needed to query a process, from winnt.h.
+const (
+	processQueryLimitedInformation = 0x1000
+	processVMRead                  = 0x0010
+)
+
+var (
+	kernel32                  = syscall.NewLazyDLL("kernel32.dll")
+	procGetProcessMemoryInfo  = kernel32.NewProc("K32GetProcessMemoryInfo")
+	procGetProcessHandleCount = kernel32.NewProc("GetProcessHandleCount")
+)
+
+// processMemoryCounters mirrors PROCESS_MEMORY_COUNTERS from psapi.h.
+type processMemoryCounters struct {
+	cb                         uint32
+	pageFaultCount             uint32
+	peakWorkingSetSize         uintptr
+	workingSetSize             uintptr
+	quotaPeakPagedPoolUsage    uintptr
+	quotaPagedPoolUsage        uintptr
+	quotaPeakNonPagedPoolUsage uintptr
+	quotaNonPagedPoolUsage     uintptr
+	pagefileUsage              uintptr
+	peakPagefileUsage          uintptr
+}
+
+// processStats fills in s with the resource usage of the process with the
+// given pid, as reported by the Windows process APIs.
+func processStats(pid int, s *Stats) error {
+	h, err := syscall.OpenProcess(processQueryLimitedInformation|processVMRead, false, uint32(pid))
+	if err != nil {
+		return err
+	}
+	defer syscall.CloseHandle(h)
+
+	var creation, exit, kernel, user syscall.Filetime
+	if err := syscall.GetProcessTimes(h, &creation, &exit, &kernel, &user); err != nil {
+		return err
+	}
+	// Filetimes used as durations are in units of 100ns.
+	s.CPUTime = time.Duration(filetimeTicks(kernel)+filetimeTicks(user)) * 100
+
+	var mem processMemoryCounters
+	mem.cb = uint32(unsafe.Sizeof(mem))
+	if r, _, err := procGetProcessMemoryInfo.Call(uintptr(h), uintptr(unsafe.Pointer(&mem)), uintptr(mem.cb)); r == 0 {
+		return err
+	}
+	s.RSS = uint64(mem.workingSetSize)
+
+	var handles uint32
+	if r, _, err := procGetProcessHandleCount.Call(uintptr(h), uintptr(unsafe.Pointer(&handles))); r == 0 {
+		return err
+	}
+	s.OpenFDs = int(handles)
+	return nil
+}
+
+// filetimeTicks returns the 100ns ticks in ft.
+func filetimeTicks(ft syscall.Filetime) int64 {
+	return int64(ft.HighDateTime)<<32 | int64(ft.LowDateTime)
+}
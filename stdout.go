@@ -0,0 +1,74 @@
+package pie
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// guardEnv is the environment variable through which StartPlugin tells a
+// provider that it was started by a host, and so may take over its stdout.
+const guardEnv = "PIE_GUARD_STDOUT"
+
+// stdoutGuard is the process-wide guard of stdout installed by NewProvider.
+var stdoutGuard struct {
+	once sync.Once
+	// rpc is the stdout the host reads the RPC stream from.
+	rpc *os.File
+
+	mu    sync.Mutex
+	stray io.Writer
+}
+
+// SetStrayOutput sets where a provider started by StartPlugin sends what the
+// plugin writes to its stdout, which it otherwise sends to stderr.  See
+// NewProvider.  Passing nil discards stray output.
+func SetStrayOutput(w io.Writer) {
+	if w == nil {
+		w = io.Discard
+	}
+	stdoutGuard.mu.Lock()
+	defer stdoutGuard.mu.Unlock()
+	stdoutGuard.stray = w
+}
+
+// strayWriter writes stray output to the writer set by SetStrayOutput.
+type strayWriter struct{}
+
+func (strayWriter) Write(p []byte) (int, error) {
+	stdoutGuard.mu.Lock()
+	w := stdoutGuard.stray
+	stdoutGuard.mu.Unlock()
+	if w == nil {
+		w = os.Stderr
+	}
+	w.Write(p)
+	return len(p), nil
+}
+
+// guardedStdout returns the file a provider writes its RPC stream to.  If the
+// plugin was started by StartPlugin, the first call takes the real stdout for
+// the RPC stream, and replaces stdout with a pipe whose contents are sent to
+// stderr, so that stray prints cannot corrupt the stream.  Where the platform
+// allows, file descriptor 1 itself is replaced, which also captures the output
+// of C code and of child processes that inherit stdout.
+func guardedStdout() *os.File {
+	if providerGetenv(guardEnv) == "" {
+		return os.Stdout
+	}
+	stdoutGuard.once.Do(func() {
+		stdoutGuard.rpc = os.Stdout
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			return
+		}
+		if saved, err := redirectFd(int(pw.Fd()), 1); err == nil {
+			pw.Close()
+			stdoutGuard.rpc = os.NewFile(uintptr(saved), "/dev/stdout")
+		} else {
+			os.Stdout = pw
+		}
+		go io.Copy(strayWriter{}, pr)
+	})
+	return stdoutGuard.rpc
+}
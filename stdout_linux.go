@@ -0,0 +1,18 @@
+package pie
+
+import "syscall"
+
+// redirectFd makes fd refer to what newfd does, and returns a new descriptor
+// for what fd referred to before.
+func redirectFd(newfd, fd int) (int, error) {
+	saved, err := syscall.Dup(fd)
+	if err != nil {
+		return 0, err
+	}
+	syscall.CloseOnExec(saved)
+	if err := syscall.Dup3(newfd, fd, 0); err != nil {
+		syscall.Close(saved)
+		return 0, err
+	}
+	return saved, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package pie
+
+import "errors"
+
+// redirectFd is not supported on this platform, so only os.Stdout is replaced.
+func redirectFd(newfd, fd int) (int, error) {
+	return 0, errors.New("redirecting file descriptors is not supported on this platform")
+}
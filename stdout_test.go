@@ -0,0 +1,43 @@
+package pie
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStdoutGuard(t *testing.T) {
+	var output lockedBuffer
+	p, err := StartPlugin(&output, os.Args[0], helperArgs("provider"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if err := p.Call("helper.Print", "Hello world\n", new(int)); err != nil {
+		t.Fatal(err)
+	}
+	var reply string
+	if err := p.Call("api.SayHi", "bob", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "Hi bob" {
+		t.Fatalf("expected %q, got %q", "Hi bob", reply)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(output.String(), "Hello world") {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected stray print on stderr, got %q", output.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStdoutGuardUnsetEnv(t *testing.T) {
+	if os.Getenv(guardEnv) != "" {
+		t.Skip("stdout is guarded")
+	}
+	if got := guardedStdout(); got != os.Stdout {
+		t.Fatal("expected stdout to be left alone when not started by a host")
+	}
+}
@@ -0,0 +1,253 @@
+package pie
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// A provider can hand the host an io.Reader or io.Writer by exporting it,
+// which gives a StreamHandle that can be returned from a method like any
+// other value.  The host turns the handle back into a reader or writer with
+// ReadStream or WriteStream, whose reads and writes are calls to the
+// provider's control API that move the data in chunks.
+
+// streamChunkSize is the most data moved by one call.
+const streamChunkSize = 64 << 10
+
+// StreamHandle refers to a reader or writer exported by a provider with
+// Server.ExportReader or Server.ExportWriter.
+type StreamHandle struct {
+	ID string
+}
+
+// StreamChunk is a piece of an exported stream moved by a call to the control
+// API.  Applications do not need to use it; it is exported because net/rpc
+// requires the types of the arguments of the methods it serves to be.
+type StreamChunk struct {
+	ID   string
+	Data []byte
+	// Max is the most data a read asks for.
+	Max int
+	// EOF is set by a read that reached the end of the stream.
+	EOF bool
+}
+
+// exportedStream is a reader or writer exported by a provider.
+type exportedStream struct {
+	mu sync.Mutex
+	r  io.Reader
+	w  io.Writer
+}
+
+// ExportReader makes r readable by the host through the returned handle, with
+// ReadStream.  If r is also an io.Closer, it is closed when the host closes
+// its reader, or when the connection ends while the stream is still exported.
+// Only providers can export streams.
+func (s Server) ExportReader(r io.Reader) (StreamHandle, error) {
+	return s.export(&exportedStream{r: r})
+}
+
+// ExportWriter makes w writable by the host through the returned handle, with
+// WriteStream.  If w is also an io.Closer, it is closed when the host closes
+// its writer, or when the connection ends while the stream is still exported.
+// Only providers can export streams.
+func (s Server) ExportWriter(w io.Writer) (StreamHandle, error) {
+	return s.export(&exportedStream{w: w})
+}
+
+// export records st under a new handle.
+func (s Server) export(st *exportedStream) (StreamHandle, error) {
+	if s.ctl == nil {
+		return StreamHandle{}, errors.New("only providers can export streams")
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return StreamHandle{}, err
+	}
+	h := StreamHandle{ID: hex.EncodeToString(b)}
+	s.ctl.streamsMu.Lock()
+	defer s.ctl.streamsMu.Unlock()
+	if s.ctl.streams == nil {
+		s.ctl.streams = map[string]*exportedStream{}
+	}
+	s.ctl.streams[h.ID] = st
+	return h, nil
+}
+
+// stream returns the exported stream with the given ID.
+func (c *control) stream(id string) (*exportedStream, error) {
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	st, ok := c.streams[id]
+	if !ok {
+		return nil, fmt.Errorf("pie: no stream %q is exported", id)
+	}
+	return st, nil
+}
+
+// StreamRead reads up to args.Max bytes from an exported reader.
+func (c *control) StreamRead(args StreamChunk, reply *StreamChunk) error {
+	st, err := c.stream(args.ID)
+	if err != nil {
+		return err
+	}
+	if st.r == nil {
+		return fmt.Errorf("pie: stream %q is not readable", args.ID)
+	}
+	max := args.Max
+	if max <= 0 || max > streamChunkSize {
+		max = streamChunkSize
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	buf := make([]byte, max)
+	n, err := io.ReadAtLeast(st.r, buf, 1)
+	reply.Data = buf[:n]
+	switch {
+	case err == io.EOF:
+		reply.EOF = true
+	case err != nil:
+		return err
+	}
+	return nil
+}
+
+// StreamWrite writes args.Data to an exported writer.
+func (c *control) StreamWrite(args StreamChunk, n *int) error {
+	st, err := c.stream(args.ID)
+	if err != nil {
+		return err
+	}
+	if st.w == nil {
+		return fmt.Errorf("pie: stream %q is not writable", args.ID)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	*n, err = st.w.Write(args.Data)
+	return err
+}
+
+// StreamClose forgets an exported stream, closing it if it can be closed.
+func (c *control) StreamClose(id string, _ *int) error {
+	c.streamsMu.Lock()
+	st, ok := c.streams[id]
+	delete(c.streams, id)
+	c.streamsMu.Unlock()
+	if !ok {
+		return fmt.Errorf("pie: no stream %q is exported", id)
+	}
+	return st.close()
+}
+
+// closeStreams forgets every exported stream, closing those that can be
+// closed, when the connection they were exported on ends.
+func (c *control) closeStreams() {
+	c.streamsMu.Lock()
+	streams := c.streams
+	c.streams = nil
+	c.streamsMu.Unlock()
+	for _, st := range streams {
+		st.close()
+	}
+}
+
+// close closes the stream's reader or writer, if it can be closed.
+func (st *exportedStream) close() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var rw interface{} = st.r
+	if st.w != nil {
+		rw = st.w
+	}
+	if closer, ok := rw.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// ReadStream returns a reader for the stream a provider exported with
+// Server.ExportReader, whose reads are calls made through c.  It must be
+// closed to release the stream in the provider.
+func ReadStream(c Caller, h StreamHandle) io.ReadCloser {
+	return &streamReader{c: c, h: h}
+}
+
+// streamReader reads an exported reader.
+type streamReader struct {
+	c   Caller
+	h   StreamHandle
+	buf []byte
+	err error
+}
+
+// Read reads from the data fetched from the provider, fetching more if it has
+// all been read.
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		var chunk StreamChunk
+		if err := r.c.Call(controlService+".StreamRead", StreamChunk{ID: r.h.ID, Max: streamChunkSize}, &chunk); err != nil {
+			r.err = err
+			return 0, err
+		}
+		r.buf = chunk.Data
+		if chunk.EOF {
+			r.err = io.EOF
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// Close releases the stream in the provider.
+func (r *streamReader) Close() error {
+	r.err = errors.New("pie: read from closed stream")
+	return r.c.Call(controlService+".StreamClose", r.h.ID, new(int))
+}
+
+// WriteStream returns a writer for the stream a provider exported with
+// Server.ExportWriter, whose writes are calls made through c.  It must be
+// closed to release the stream in the provider.
+func WriteStream(c Caller, h StreamHandle) io.WriteCloser {
+	return &streamWriter{c: c, h: h}
+}
+
+// streamWriter writes to an exported writer.
+type streamWriter struct {
+	c Caller
+	h StreamHandle
+}
+
+// Write sends p to the provider, in chunks if it is large.
+func (w *streamWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > streamChunkSize {
+			chunk = chunk[:streamChunkSize]
+		}
+		var n int
+		err := w.c.Call(controlService+".StreamWrite", StreamChunk{ID: w.h.ID, Data: chunk}, &n)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n < len(chunk) {
+			return written, io.ErrShortWrite
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// Close releases the stream in the provider.
+func (w *streamWriter) Close() error {
+	return w.c.Call(controlService+".StreamClose", w.h.ID, new(int))
+}
@@ -0,0 +1,173 @@
+package pie
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// closeBuffer is a buffer that records being closed.
+type closeBuffer struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	closed bool
+}
+
+func (b *closeBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *closeBuffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	return nil
+}
+
+// streamAPI exports readers and writers from its provider.
+type streamAPI struct {
+	s    Server
+	sink *closeBuffer
+}
+
+func (a *streamAPI) Read(size int, h *StreamHandle) error {
+	var err error
+	*h, err = a.s.ExportReader(alphabet(size))
+	return err
+}
+
+func (a *streamAPI) Write(_ int, h *StreamHandle) error {
+	var err error
+	*h, err = a.s.ExportWriter(a.sink)
+	return err
+}
+
+// alphabet returns a reader of size bytes of the repeated alphabet.
+func alphabet(size int) io.Reader {
+	return io.LimitReader(alphabetReader{new(int)}, int64(size))
+}
+
+// alphabetReader reads an endless stream of the alphabet.
+type alphabetReader struct {
+	off *int
+}
+
+func (r alphabetReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte('a' + *r.off%26)
+		*r.off++
+	}
+	return len(p), nil
+}
+
+func streamPlugin(t *testing.T) (*Plugin, *streamAPI) {
+	s := NewProvider()
+	api := &streamAPI{s: s, sink: &closeBuffer{}}
+	if err := s.RegisterName("api", api); err != nil {
+		t.Fatal(err)
+	}
+	return pipePlugin(t, s), api
+}
+
+func TestReadStream(t *testing.T) {
+	p, _ := streamPlugin(t)
+	size := 3*streamChunkSize + 100
+	var h StreamHandle
+	if err := p.Call("api.Read", size, &h); err != nil {
+		t.Fatal(err)
+	}
+	r := ReadStream(p, h)
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := io.ReadAll(alphabet(size))
+	if !bytes.Equal(got, want) {
+		t.Errorf("Read %d bytes, expected %d bytes of the alphabet", len(got), size)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected an error reading a closed stream")
+	}
+	// The stream has been released, so closing it again fails.
+	if err := ReadStream(p, h).Close(); err == nil {
+		t.Error("Expected an error closing a released stream")
+	}
+}
+
+func TestWriteStream(t *testing.T) {
+	p, api := streamPlugin(t)
+	var h StreamHandle
+	if err := p.Call("api.Write", 0, &h); err != nil {
+		t.Fatal(err)
+	}
+	w := WriteStream(p, h)
+	data := strings.Repeat("hello, world\n", streamChunkSize/4)
+	n, err := io.WriteString(w, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(data) {
+		t.Errorf("Wrote %d bytes, expected %d", n, len(data))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	api.sink.mu.Lock()
+	defer api.sink.mu.Unlock()
+	if api.sink.buf.String() != data {
+		t.Errorf("Provider received %d bytes, expected %d", api.sink.buf.Len(), len(data))
+	}
+	if !api.sink.closed {
+		t.Error("Expected the exported writer to be closed")
+	}
+}
+
+func TestStreamWrongDirection(t *testing.T) {
+	p, _ := streamPlugin(t)
+	var h StreamHandle
+	if err := p.Call("api.Write", 0, &h); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadStream(p, h).Read(make([]byte, 10)); err == nil {
+		t.Error("Expected an error reading an exported writer")
+	}
+}
+
+func TestStreamsClosedWithConnection(t *testing.T) {
+	p, api := streamPlugin(t)
+	var h StreamHandle
+	if err := p.Call("api.Write", 0, &h); err != nil {
+		t.Fatal(err)
+	}
+	p.client.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		api.sink.mu.Lock()
+		closed := api.sink.closed
+		api.sink.mu.Unlock()
+		if closed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the exported writer to be closed when the connection ended")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := api.s.ctl.stream(h.ID); err == nil {
+		t.Error("Expected the stream to be forgotten when the connection ended")
+	}
+}
+
+func TestExportStreamNotProvider(t *testing.T) {
+	if _, err := (Server{}).ExportReader(strings.NewReader("x")); err == nil {
+		t.Error("Expected an error exporting a stream from a consumer")
+	}
+}
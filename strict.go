@@ -0,0 +1,210 @@
+package pie
+
+import (
+	"errors"
+	"net/rpc"
+	"sort"
+	"strings"
+)
+
+// The error a strict Server returns for a call to a method it does not serve
+// is net/rpc's, extended with the closest matches and the provider's
+// services, in a form the host parses back into a *MethodNotFoundError:
+//
+//	rpc: can't find method api.SayHo; closest matches: api.SayHi; services: api
+//
+// It keeps net/rpc's prefix, so that hosts that do not know about strict mode
+// still recognize it as a missing method.
+
+const (
+	notFoundPrefix   = "rpc: can't find method "
+	notFoundClosest  = "; closest matches: "
+	notFoundServices = "; services: "
+	notFoundNone     = "(none)"
+	// maxClosest is the most close matches reported for a missing method.
+	maxClosest = 3
+)
+
+// MethodNotFoundError is returned by calls to a provider in strict mode, set
+// with Server.SetStrict, for a method the provider does not serve, such as
+// one whose name has a typo or that only a newer version of the provider has.
+type MethodNotFoundError struct {
+	// Method is the method that was called.
+	Method string
+	// Closest are the provider's methods whose names are closest to Method,
+	// best match first.  It is empty if none are close.
+	Closest []string
+	// Services are the services the provider serves, sorted by name.  pie's
+	// built-in control API is not included.
+	Services []string
+}
+
+// Error implements the error interface.
+func (e *MethodNotFoundError) Error() string {
+	return notFoundPrefix + e.Method + notFoundClosest + joinOrNone(e.Closest) + notFoundServices + joinOrNone(e.Services)
+}
+
+// Unwrap returns the error as the rpc.ServerError it was sent as, so that
+// code checking for server errors keeps working with strict providers.
+func (e *MethodNotFoundError) Unwrap() error {
+	return rpc.ServerError(e.Error())
+}
+
+// SetStrict makes the Server answer calls to methods it does not serve, or
+// does not expose, with the error a host reports as a *MethodNotFoundError,
+// instead of net/rpc's terse one.  It must be called before Serve.
+func (s Server) SetStrict(on bool) error {
+	if s.d == nil {
+		return errors.New("pie: server cannot be configured")
+	}
+	s.d.regMu.Lock()
+	defer s.d.regMu.Unlock()
+	if s.d.serving {
+		return errors.New("pie: strict mode must be set before Serve")
+	}
+	s.d.strict = on
+	return nil
+}
+
+// notFound returns the error for a call to serviceMethod, which the
+// dispatcher does not serve.
+func (d *dispatcher) notFound(serviceMethod string) *MethodNotFoundError {
+	d.mu.RLock()
+	var names []string
+	for name := range d.methods {
+		if d.exposedLocked(name) && !strings.HasPrefix(name, controlService+".") {
+			names = append(names, name)
+		}
+	}
+	d.mu.RUnlock()
+	e := &MethodNotFoundError{Method: serviceMethod}
+	services := map[string]bool{}
+	for _, name := range names {
+		service, _, _ := splitServiceMethod(name)
+		services[service] = true
+	}
+	for service := range services {
+		e.Services = append(e.Services, service)
+	}
+	sort.Strings(e.Services)
+	e.Closest = closestNames(serviceMethod, names)
+	return e
+}
+
+// closestNames returns up to maxClosest of names that are within a few edits
+// of name, ignoring case, closest first.  A method of another service counts
+// as one edit more than the edits between the method names, so that calls to
+// the right method of the wrong service find it.
+func closestNames(name string, names []string) []string {
+	type match struct {
+		name string
+		dist int
+	}
+	limit := len(name)/3 + 1
+	if limit < 2 {
+		limit = 2
+	}
+	var matches []match
+	for _, n := range names {
+		if d := nameDistance(strings.ToLower(name), strings.ToLower(n)); d <= limit {
+			matches = append(matches, match{n, d})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].dist != matches[j].dist {
+			return matches[i].dist < matches[j].dist
+		}
+		return matches[i].name < matches[j].name
+	})
+	var closest []string
+	for i := 0; i < len(matches) && i < maxClosest; i++ {
+		closest = append(closest, matches[i].name)
+	}
+	return closest
+}
+
+// nameDistance returns the distance between two method names, as used by
+// closestNames.
+func nameDistance(a, b string) int {
+	d := editDistance(a, b)
+	_, am, _ := splitServiceMethod(a)
+	_, bm, _ := splitServiceMethod(b)
+	if md := editDistance(am, bm) + 1; md < d {
+		d = md
+	}
+	return d
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// joinOrNone joins names for a MethodNotFoundError's message.
+func joinOrNone(names []string) string {
+	if len(names) == 0 {
+		return notFoundNone
+	}
+	return strings.Join(names, ", ")
+}
+
+// splitOrNone reverses joinOrNone.
+func splitOrNone(s string) []string {
+	if s == notFoundNone || s == "" {
+		return nil
+	}
+	return strings.Split(s, ", ")
+}
+
+// methodNotFound returns err as a *MethodNotFoundError if it is the error a
+// strict provider sends for a missing method, and err otherwise.
+func methodNotFound(err error) error {
+	serr, ok := err.(rpc.ServerError)
+	if !ok {
+		return err
+	}
+	rest, ok := strings.CutPrefix(string(serr), notFoundPrefix)
+	if !ok {
+		return err
+	}
+	// The method was named by the caller and may contain anything, but the
+	// lists are of the provider's names, so search from the end.
+	i := strings.LastIndex(rest, notFoundServices)
+	if i < 0 {
+		return err
+	}
+	services := rest[i+len(notFoundServices):]
+	rest = rest[:i]
+	j := strings.LastIndex(rest, notFoundClosest)
+	if j < 0 {
+		return err
+	}
+	return &MethodNotFoundError{
+		Method:   rest[:j],
+		Closest:  splitOrNone(rest[j+len(notFoundClosest):]),
+		Services: splitOrNone(services),
+	}
+}
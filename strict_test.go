@@ -0,0 +1,128 @@
+package pie
+
+import (
+	"errors"
+	"net/rpc"
+	"reflect"
+	"testing"
+)
+
+// strictPlugin returns a handle to a strict provider serving api.
+func strictPlugin(t *testing.T) (Server, *Plugin) {
+	s := NewProvider()
+	if err := s.RegisterName("api", api{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetStrict(true); err != nil {
+		t.Fatal(err)
+	}
+	return s, pipePlugin(t, s)
+}
+
+func TestStrictMethodNotFound(t *testing.T) {
+	_, p := strictPlugin(t)
+	var reply string
+	err := p.Call("api.SayHo", "bob", &reply)
+	var nf *MethodNotFoundError
+	if !errors.As(err, &nf) {
+		t.Fatalf("Expected a *MethodNotFoundError, got %T: %v", err, err)
+	}
+	want := &MethodNotFoundError{Method: "api.SayHo", Closest: []string{"api.SayHi"}, Services: []string{"api"}}
+	if !reflect.DeepEqual(nf, want) {
+		t.Errorf("Expected %+v, got %+v", want, nf)
+	}
+	var serr rpc.ServerError
+	if !errors.As(err, &serr) || !isMissingMethod(err) {
+		t.Errorf("Expected the error to still be a missing method rpc.ServerError, got %v", err)
+	}
+	if err := p.Call("api.SayHi", "bob", &reply); err != nil || reply != "Hi bob" {
+		t.Errorf("Expected the existing method to work, got %q, %v", reply, err)
+	}
+}
+
+func TestStrictUnknownService(t *testing.T) {
+	_, p := strictPlugin(t)
+	var reply string
+	err := p.Call("API.SayHi", "bob", &reply)
+	var nf *MethodNotFoundError
+	if !errors.As(err, &nf) {
+		t.Fatalf("Expected a *MethodNotFoundError, got %T: %v", err, err)
+	}
+	if !reflect.DeepEqual(nf.Closest, []string{"api.SayHi"}) {
+		t.Errorf("Expected api.SayHi to be suggested, got %v", nf.Closest)
+	}
+	err = p.Call("nothing.Like", "bob", &reply)
+	if !errors.As(err, &nf) || nf.Closest != nil {
+		t.Errorf("Expected no suggestions, got %v", err)
+	}
+}
+
+func TestStrictHidesUnexposed(t *testing.T) {
+	s := NewProvider()
+	s.RegisterName("api", api{})
+	s.RegisterName("other", api{})
+	s.SetStrict(true)
+	if err := s.Expose("api"); err != nil {
+		t.Fatal(err)
+	}
+	p := pipePlugin(t, s)
+	var reply string
+	err := p.Call("other.SayHi", "bob", &reply)
+	var nf *MethodNotFoundError
+	if !errors.As(err, &nf) {
+		t.Fatalf("Expected a *MethodNotFoundError, got %T: %v", err, err)
+	}
+	if !reflect.DeepEqual(nf.Services, []string{"api"}) || !reflect.DeepEqual(nf.Closest, []string{"api.SayHi"}) {
+		t.Errorf("Expected only exposed names, got %+v", nf)
+	}
+}
+
+func TestNotStrict(t *testing.T) {
+	s := NewProvider()
+	s.RegisterName("api", api{})
+	p := pipePlugin(t, s)
+	var reply string
+	err := p.Call("api.SayHo", "bob", &reply)
+	if _, ok := err.(rpc.ServerError); !ok || !isMissingMethod(err) {
+		t.Errorf("Expected net/rpc's error, got %T: %v", err, err)
+	}
+}
+
+func TestSetStrictAfterServe(t *testing.T) {
+	s, p := strictPlugin(t)
+	var reply string
+	if err := p.Call("api.SayHi", "bob", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetStrict(false); err == nil {
+		t.Error("Expected an error setting strict mode after Serve")
+	}
+}
+
+func TestMethodNotFoundRoundTrip(t *testing.T) {
+	for _, e := range []*MethodNotFoundError{
+		{Method: "a.B"},
+		{Method: "a.B; services: x", Closest: []string{"a.C", "a.D"}, Services: []string{"a", "z"}},
+	} {
+		got := methodNotFound(rpc.ServerError(e.Error()))
+		if !reflect.DeepEqual(got, e) {
+			t.Errorf("Expected %+v, got %+v", e, got)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"abc", "", 3},
+		{"kitten", "sitting", 3},
+		{"api.SayHi", "api.SayHo", 1},
+	} {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, expected %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,405 @@
+package pie
+
+import (
+	"errors"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// ErrRestartLimit is returned by a Supervisor whose plugin has exited when its
+// Policy does not allow the plugin to be restarted again.
+var ErrRestartLimit = errors.New("plugin exited and restart limit reached")
+
+// Policy controls how a Supervisor keeps its plugin running.
+type Policy struct {
+	// MaxRestarts is the number of times the plugin will be restarted after it
+	// exits or is declared hung.  Zero means the plugin is never restarted,
+	// and a negative value means there is no limit.
+	MaxRestarts int
+	// Backoff is how long to wait before each restart attempt.
+	Backoff time.Duration
+	// MaxCalls, if not zero, is the number of calls made through the
+	// Supervisor after which the plugin is recycled: a fresh instance is
+	// started to take new calls, and the old instance is closed once the
+	// calls in flight on it have finished.  This keeps plugins that slowly
+	// leak resources healthy.
+	MaxCalls uint64
+	// MaxLifetime, if not zero, is how long a plugin instance may run before
+	// it is recycled like an instance that reached MaxCalls.
+	MaxLifetime time.Duration
+	// DrainTimeout is how long a recycled instance is given to finish its
+	// calls in flight before it is closed.  It defaults to 30 seconds.
+	DrainTimeout time.Duration
+	// Thresholds are limits on the resources the plugin may use, checked
+	// every StatsInterval using Plugin.Stats.  They are not enforced on
+	// platforms where Plugin.Stats returns ErrStatsUnsupported.
+	Thresholds []Threshold
+	// StatsInterval is how often the plugin's resource usage is checked
+	// against Thresholds.  It defaults to ten seconds.
+	StatsInterval time.Duration
+	// Watchdog, if not nil, watches the plugin for hangs.  A hung plugin is
+	// killed, and then restarted like a plugin that exited on its own.
+	Watchdog *Watchdog
+	// OnEvent, if not nil, is called with each lifecycle event.  It is called
+	// synchronously from the Supervisor's goroutines, and so must not block.
+	OnEvent func(Event)
+}
+
+// Supervisor keeps a plugin running, restarting it according to its Policy
+// when the plugin process exits or is declared hung by the Policy's Watchdog,
+// and recycling it when it reaches the Policy's limits.  Feature flags set on
+// an instance with Plugin.SetFeatures are set on the instances that restart
+// or recycle it too.
+type Supervisor struct {
+	start  func() (*Plugin, error)
+	policy Policy
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	mu        sync.Mutex
+	plugin    *Plugin
+	recycleCh chan struct{}
+	restarts  int
+	closed    bool
+	err       error
+}
+
+// Supervise starts a plugin by calling start, and returns a Supervisor that
+// will call start again to replace the plugin whenever it exits or hangs, as
+// allowed by policy.
+func Supervise(start func() (*Plugin, error), policy Policy) (*Supervisor, error) {
+	p, err := start()
+	if err != nil {
+		return nil, err
+	}
+	s := &Supervisor{
+		start:     start,
+		policy:    policy,
+		done:      make(chan struct{}),
+		plugin:    p,
+		recycleCh: make(chan struct{}, 1),
+	}
+	s.emit(Event{Kind: EventStarted, Plugin: p})
+	s.reportWarmUp(p)
+	s.wg.Add(1)
+	go s.monitor(p)
+	return s, nil
+}
+
+// Plugin returns the currently running plugin instance.  It returns an error
+// if the Supervisor has been closed or has given up restarting the plugin.
+func (s *Supervisor) Plugin() (*Plugin, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, rpc.ErrShutdown
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.plugin, nil
+}
+
+// Call invokes the named function on the currently running plugin instance.
+// Calls in flight when a plugin exits fail; the Supervisor does not retry
+// them.
+func (s *Supervisor) Call(serviceMethod string, args interface{}, reply interface{}) error {
+	p, err := s.Plugin()
+	if err != nil {
+		return err
+	}
+	err = p.Call(serviceMethod, args, reply)
+	if s.policy.MaxCalls > 0 && p.Calls() >= s.policy.MaxCalls {
+		s.requestRecycle(p)
+	}
+	return err
+}
+
+// Replace starts a new plugin instance by calling start, and swaps it in for
+// the current instance the way a recycled plugin is replaced: new calls go to
+// the new instance, and the old instance is closed once its calls in flight
+// have finished or the Policy's DrainTimeout has elapsed.  The Supervisor uses
+// start for all later restarts and recycles.  If start fails, the current
+// instance is left running and the error is returned.
+func (s *Supervisor) Replace(start func() (*Plugin, error)) error {
+	if s.isClosed() {
+		return rpc.ErrShutdown
+	}
+	np, err := start()
+	if err != nil {
+		return err
+	}
+	old, ok := s.swap(nil, np, start, EventReplaced)
+	if !ok {
+		return rpc.ErrShutdown
+	}
+	old.drain(s.drainTimeout(), s.done)
+	old.Close()
+	return nil
+}
+
+// Restarts returns the number of times the plugin has been restarted.
+func (s *Supervisor) Restarts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.restarts
+}
+
+// Close stops supervising the plugin and shuts it down.  It does not return
+// until any restart in progress has been abandoned.
+func (s *Supervisor) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return rpc.ErrShutdown
+	}
+	s.closed = true
+	close(s.done)
+	p := s.plugin
+	s.mu.Unlock()
+	err := p.Close()
+	s.wg.Wait()
+	return err
+}
+
+// monitor waits for p to exit or be declared hung, and then restarts it.  It
+// also recycles p when the policy's limits on p's lifetime are reached.
+func (s *Supervisor) monitor(p *Plugin) {
+	defer s.wg.Done()
+	stop := make(chan struct{})
+	defer close(stop)
+	hung := make(chan HangReport, 1)
+	if s.policy.Watchdog != nil {
+		go s.policy.Watchdog.watch(p, hung, stop)
+	}
+	var lifetime <-chan time.Time
+	if s.policy.MaxLifetime > 0 {
+		lifetime = time.After(s.policy.MaxLifetime)
+	}
+	recycle := s.recycleRequests()
+	var statsTick <-chan time.Time
+	if len(s.policy.Thresholds) > 0 {
+		t := time.NewTicker(s.statsInterval())
+		defer t.Stop()
+		statsTick = t.C
+	}
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-p.Exited():
+		case report := <-hung:
+			s.policy.Watchdog.diagnose(p, &report)
+			s.emit(Event{Kind: EventHung, Plugin: p, Hang: &report})
+			p.proc.Kill()
+			<-p.Exited()
+		case <-lifetime:
+			if s.recycle(p) {
+				return
+			}
+			lifetime = time.After(s.policy.MaxLifetime)
+			continue
+		case <-recycle:
+			if s.recycle(p) {
+				return
+			}
+			continue
+		case <-statsTick:
+			switch s.checkThresholds(p) {
+			case ThresholdRecycle:
+				if s.recycle(p) {
+					return
+				}
+			case ThresholdKill:
+				p.proc.Kill()
+			}
+			continue
+		}
+		break
+	}
+	s.mu.Lock()
+	replaced := s.closed || s.plugin != p
+	s.mu.Unlock()
+	if replaced {
+		return
+	}
+	s.emit(Event{Kind: EventExited, Plugin: p, Err: p.ExitErr(), Crash: p.CrashReport()})
+	p.Close()
+	s.restart(p)
+}
+
+// recycleRequests returns the channel on which requests to recycle the current
+// plugin instance are sent.
+func (s *Supervisor) recycleRequests() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.recycleCh
+}
+
+// requestRecycle asks the monitor of p to recycle it, if p is still the
+// current plugin instance.
+func (s *Supervisor) requestRecycle(p *Plugin) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.plugin != p {
+		return
+	}
+	select {
+	case s.recycleCh <- struct{}{}:
+	default:
+	}
+}
+
+// recycle replaces p with a fresh plugin instance, then waits for the calls
+// in flight on p to finish before closing it.  It reports whether p is no
+// longer the current instance; if the new instance fails to start, p is left
+// running.
+func (s *Supervisor) recycle(p *Plugin) bool {
+	np, err := s.starter()()
+	if err == nil {
+		err = carryFeatures(p, np)
+	}
+	if err != nil {
+		s.emit(Event{Kind: EventRestartFailed, Err: err})
+		return false
+	}
+	if _, ok := s.swap(p, np, nil, EventRecycled); ok {
+		p.drain(s.drainTimeout(), s.done)
+		p.Close()
+	}
+	return true
+}
+
+// swap makes np the current plugin instance in place of old, emits an event of
+// the given kind, and starts monitoring np.  If old is nil, np replaces
+// whatever instance is current.  If start is not nil, it replaces the function
+// used to start new instances.  If the Supervisor has been closed, or old is
+// no longer the current instance, np is closed instead.  swap returns the
+// instance that was replaced and whether np was swapped in.
+func (s *Supervisor) swap(old, np *Plugin, start func() (*Plugin, error), kind EventKind) (*Plugin, bool) {
+	s.mu.Lock()
+	if s.closed || (old != nil && s.plugin != old) {
+		s.mu.Unlock()
+		np.Close()
+		return nil, false
+	}
+	prev := s.plugin
+	s.plugin = np
+	if start != nil {
+		s.start = start
+	}
+	s.recycleCh = make(chan struct{}, 1)
+	s.err = nil
+	s.wg.Add(1)
+	s.mu.Unlock()
+	s.emit(Event{Kind: kind, Plugin: np})
+	s.reportWarmUp(np)
+	go s.monitor(np)
+	return prev, true
+}
+
+// starter returns the function used to start new plugin instances.
+func (s *Supervisor) starter() func() (*Plugin, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.start
+}
+
+// checkThresholds compares p's resource usage to the policy's thresholds,
+// emitting an event for each threshold exceeded, and returns the most severe
+// action called for.
+func (s *Supervisor) checkThresholds(p *Plugin) ThresholdAction {
+	stats, err := p.Stats()
+	if err != nil {
+		return ThresholdWarn
+	}
+	action := ThresholdWarn
+	for _, t := range s.policy.Thresholds {
+		if terr := t.check(stats); terr != nil {
+			s.emit(Event{Kind: EventThreshold, Plugin: p, Err: terr})
+			if t.Action > action {
+				action = t.Action
+			}
+		}
+	}
+	return action
+}
+
+// statsInterval returns how often to check the plugin's resource usage.
+func (s *Supervisor) statsInterval() time.Duration {
+	if s.policy.StatsInterval > 0 {
+		return s.policy.StatsInterval
+	}
+	return 10 * time.Second
+}
+
+// drainTimeout returns how long to wait for calls to finish on a plugin being
+// recycled.
+func (s *Supervisor) drainTimeout() time.Duration {
+	if s.policy.DrainTimeout > 0 {
+		return s.policy.DrainTimeout
+	}
+	return 30 * time.Second
+}
+
+// restart replaces old, which has exited, with a new instance, retrying failed
+// starts for as long as the policy allows.  It gives up early if old is
+// replaced by other means in the meantime.
+func (s *Supervisor) restart(old *Plugin) {
+	for {
+		s.mu.Lock()
+		if s.closed || s.plugin != old {
+			s.mu.Unlock()
+			return
+		}
+		if s.policy.MaxRestarts >= 0 && s.restarts >= s.policy.MaxRestarts {
+			s.err = ErrRestartLimit
+			s.mu.Unlock()
+			s.emit(Event{Kind: EventGaveUp, Err: ErrRestartLimit})
+			return
+		}
+		s.restarts++
+		s.mu.Unlock()
+
+		select {
+		case <-s.done:
+			return
+		case <-time.After(s.policy.Backoff):
+		}
+
+		p, err := s.starter()()
+		if err == nil {
+			err = carryFeatures(old, p)
+		}
+		if err != nil {
+			s.emit(Event{Kind: EventRestartFailed, Err: err})
+			continue
+		}
+		s.swap(old, p, nil, EventRestarted)
+		return
+	}
+}
+
+// reportWarmUp emits an event if p's warm-up failed.
+func (s *Supervisor) reportWarmUp(p *Plugin) {
+	if err := p.WarmUpErr(); err != nil {
+		s.emit(Event{Kind: EventWarmUpFailed, Plugin: p, Err: err})
+	}
+}
+
+// isClosed reports whether Close has been called.
+func (s *Supervisor) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// emit sends e to the policy's event handler, if there is one.
+func (s *Supervisor) emit(e Event) {
+	if s.policy.OnEvent == nil {
+		return
+	}
+	e.Time = time.Now()
+	s.policy.OnEvent(e)
+}
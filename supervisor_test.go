@@ -0,0 +1,232 @@
+package pie
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// helperStarter returns a function suitable for Supervise that starts the test
+// binary as a plugin in the given mode.
+func helperStarter(mode string) func() (*Plugin, error) {
+	return func() (*Plugin, error) {
+		return StartPlugin(nil, os.Args[0], helperArgs(mode))
+	}
+}
+
+func TestSuperviseRestartsExitedPlugin(t *testing.T) {
+	events := newEventRecorder()
+	s, err := Supervise(helperStarter("exit"), Policy{MaxRestarts: 2, OnEvent: events.record})
+	if err != nil {
+		t.Fatalf("Unexpected error from Supervise: %#v", err)
+	}
+	defer s.Close()
+
+	events.waitFor(t, EventStarted)
+	for i := 0; i < 2; i++ {
+		events.waitFor(t, EventExited)
+		events.waitFor(t, EventRestarted)
+	}
+	events.waitFor(t, EventExited)
+	e := events.waitFor(t, EventGaveUp)
+	if e.Err != ErrRestartLimit {
+		t.Errorf("Wrong error in gave up event, expected %#v, got %#v", ErrRestartLimit, e.Err)
+	}
+	if n := s.Restarts(); n != 2 {
+		t.Errorf("Wrong number of restarts, expected 2, got %d", n)
+	}
+	if _, err := s.Plugin(); err != ErrRestartLimit {
+		t.Errorf("Wrong error from Plugin after giving up, expected %#v, got %#v", ErrRestartLimit, err)
+	}
+}
+
+func TestSuperviseCall(t *testing.T) {
+	s, err := Supervise(helperStarter("provider"), Policy{})
+	if err != nil {
+		t.Fatalf("Unexpected error from Supervise: %#v", err)
+	}
+	var response string
+	if err := s.Call("api.SayHi", "bob", &response); err != nil {
+		t.Fatalf("Unexpected error from Call: %#v", err)
+	}
+	if response != "Hi bob" {
+		t.Errorf("Wrong response from api call, expected %q, got %q", "Hi bob", response)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("Unexpected error from Close: %#v", err)
+	}
+	if err := s.Call("api.SayHi", "bob", &response); err == nil {
+		t.Error("Unexpected nil error from Call after Close")
+	}
+}
+
+func TestSuperviseStartError(t *testing.T) {
+	_, err := Supervise(func() (*Plugin, error) {
+		return StartPlugin(nil, "/does/not/exist", nil)
+	}, Policy{})
+	if err == nil {
+		t.Fatal("Unexpected nil error from Supervise with bad path")
+	}
+}
+
+func TestSuperviseKeepsFeatures(t *testing.T) {
+	events := newEventRecorder()
+	s, err := Supervise(helperStarter("provider"), Policy{MaxRestarts: 1, MaxCalls: 3, OnEvent: events.record})
+	if err != nil {
+		t.Fatalf("Unexpected error from Supervise: %#v", err)
+	}
+	defer s.Close()
+	p, _ := s.Plugin()
+	if err := p.SetFeatures(Features{"fast": true}); err != nil {
+		t.Fatal(err)
+	}
+	p.Call("helper.Exit", 0, new(int))
+	e := events.waitFor(t, EventRestarted)
+	var on bool
+	if err := e.Plugin.Call("helper.Feature", "fast", &on); err != nil {
+		t.Fatal(err)
+	}
+	if !on {
+		t.Error("Expected the restarted plugin to have the flag set on the old one")
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.Call("helper.Feature", "fast", &on); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e = events.waitFor(t, EventRecycled)
+	if err := e.Plugin.Call("helper.Feature", "fast", &on); err != nil {
+		t.Fatal(err)
+	}
+	if !on {
+		t.Error("Expected the recycled plugin to have the flag set on the old one")
+	}
+}
+
+func TestSuperviseRecycleAfterMaxCalls(t *testing.T) {
+	events := newEventRecorder()
+	s, err := Supervise(helperStarter("provider"), Policy{MaxCalls: 2, OnEvent: events.record})
+	if err != nil {
+		t.Fatalf("Unexpected error from Supervise: %#v", err)
+	}
+	defer s.Close()
+	old, _ := s.Plugin()
+
+	var response string
+	for i := 0; i < 2; i++ {
+		if err := s.Call("api.SayHi", "bob", &response); err != nil {
+			t.Fatalf("Unexpected error from Call: %#v", err)
+		}
+	}
+	e := events.waitFor(t, EventRecycled)
+	if e.Plugin == old {
+		t.Fatal("Recycled plugin was not replaced with a new instance")
+	}
+	select {
+	case <-old.Exited():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Recycled plugin instance was not closed")
+	}
+	if cur, _ := s.Plugin(); cur != e.Plugin {
+		t.Error("Supervisor is not using the new plugin instance")
+	}
+	if err := s.Call("api.SayHi", "bob", &response); err != nil {
+		t.Fatalf("Unexpected error from Call after recycle: %#v", err)
+	}
+	if n := s.Restarts(); n != 0 {
+		t.Errorf("Recycling unexpectedly counted as %d restarts", n)
+	}
+}
+
+func TestSuperviseRecycleAfterMaxLifetime(t *testing.T) {
+	events := newEventRecorder()
+	s, err := Supervise(helperStarter("provider"), Policy{
+		MaxLifetime: 20 * time.Millisecond,
+		OnEvent:     events.record,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error from Supervise: %#v", err)
+	}
+	defer s.Close()
+	first := events.waitFor(t, EventRecycled)
+	second := events.waitFor(t, EventRecycled)
+	if first.Plugin == second.Plugin {
+		t.Error("Plugin was not replaced by a new instance when recycled again")
+	}
+}
+
+func TestSuperviseRecycleDrainsCalls(t *testing.T) {
+	events := newEventRecorder()
+	s, err := Supervise(helperStarter("provider"), Policy{
+		MaxCalls:     1,
+		DrainTimeout: 50 * time.Millisecond,
+		OnEvent:      events.record,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error from Supervise: %#v", err)
+	}
+	defer s.Close()
+	old, _ := s.Plugin()
+
+	blocked := make(chan error, 1)
+	go func() { blocked <- old.Call("helper.Block", 0, new(int)) }()
+	var response string
+	if err := s.Call("api.SayHi", "bob", &response); err != nil {
+		t.Fatalf("Unexpected error from Call: %#v", err)
+	}
+	events.waitFor(t, EventRecycled)
+	select {
+	case <-old.Exited():
+		t.Fatal("Recycled plugin closed without waiting for calls in flight")
+	case <-time.After(20 * time.Millisecond):
+	}
+	select {
+	case err := <-blocked:
+		if err == nil {
+			t.Error("Unexpected nil error from call aborted by recycling")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Call in flight was not aborted after the drain timeout")
+	}
+}
+
+func TestSupervisorReplace(t *testing.T) {
+	events := newEventRecorder()
+	s, err := Supervise(helperStarter("provider"), Policy{OnEvent: events.record})
+	if err != nil {
+		t.Fatalf("Unexpected error from Supervise: %#v", err)
+	}
+	defer s.Close()
+	old, _ := s.Plugin()
+
+	failed := errors.New("no such plugin")
+	if err := s.Replace(func() (*Plugin, error) { return nil, failed }); err != failed {
+		t.Errorf("Wrong error from failed Replace, expected %#v, got %#v", failed, err)
+	}
+	if p, _ := s.Plugin(); p != old {
+		t.Error("Failed Replace changed the current instance")
+	}
+
+	if err := s.Replace(helperStarter("provider")); err != nil {
+		t.Fatalf("Unexpected error from Replace: %#v", err)
+	}
+	e := events.waitFor(t, EventReplaced)
+	if p, _ := s.Plugin(); p != e.Plugin || p == old {
+		t.Error("Replace did not make the new instance current")
+	}
+	select {
+	case <-old.Exited():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Replaced plugin did not exit")
+	}
+	var response string
+	if err := s.Call("api.SayHi", "bob", &response); err != nil {
+		t.Fatalf("Unexpected error from Call after Replace: %#v", err)
+	}
+	select {
+	case e := <-events:
+		t.Errorf("Unexpected %s event after Replace", e.Kind)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
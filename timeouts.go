@@ -0,0 +1,117 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"net/rpc"
+	"reflect"
+	"time"
+)
+
+// defaultStopTimeout is how long a plugin is given to stop after being
+// interrupted, unless Timeouts.Stop says otherwise.
+const defaultStopTimeout = time.Second
+
+// ErrCallTimeout is returned by calls that did not complete within the call
+// timeout set by Timeouts.Call.
+var ErrCallTimeout = errors.New("pie: call timed out")
+
+// Timeouts configures how long pie waits for things to happen.  The zero value
+// for each field selects its default.  Timeouts apply to plugins started with
+// WithTimeouts, and to Servers configured with SetTimeouts.
+type Timeouts struct {
+	// Stop is how long to wait for a plugin process to exit after being
+	// interrupted before killing it.  It defaults to one second.
+	Stop time.Duration
+	// Ready is how long StartPlugin waits for the plugin to answer a ping
+	// before giving up on it.  By default StartPlugin does not wait.  Plugins
+	// that do not serve pie's control API count as ready as soon as they
+	// answer.
+	Ready time.Duration
+	// Keepalive, if not zero, is the interval at which the plugin is pinged.
+	// If it fails to answer a ping within the interval, the handle is closed,
+	// failing the calls in flight instead of leaving them hanging.
+	Keepalive time.Duration
+	// Call, if not zero, is how long a call may take before it fails with
+	// ErrCallTimeout.  On a Server, it is the deadline of the context passed
+	// to methods that take one.
+	Call time.Duration
+}
+
+// stop returns how long to wait for a process to stop.
+func (t Timeouts) stop() time.Duration {
+	if t.Stop > 0 {
+		return t.Stop
+	}
+	return defaultStopTimeout
+}
+
+// WithTimeouts sets the timeouts StartPlugin and the returned handle use.
+func WithTimeouts(t Timeouts) StartOption {
+	return func(o *startOptions) {
+		o.timeouts = t
+	}
+}
+
+// SetTimeouts sets the timeouts the Server uses.  Call sets the deadline of
+// the contexts passed to methods, and Stop is how long a consumer-style plugin
+// started with StartConsumer is given to exit when the Server is closed.  It
+// must be called before Serve.
+func (s Server) SetTimeouts(t Timeouts) error {
+	if s.d == nil {
+		return errors.New("pie: server cannot be configured")
+	}
+	s.d.regMu.Lock()
+	defer s.d.regMu.Unlock()
+	s.d.timeouts = t
+	return nil
+}
+
+// keepalive pings the plugin every interval until it exits, closing the
+// handle if a ping is not answered in time.
+func (p *Plugin) keepalive(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.proc.done:
+			return
+		case <-t.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := p.ping(ctx)
+		cancel()
+		if err != nil {
+			p.stop(stoppedByFailure)
+			p.Close()
+			return
+		}
+	}
+}
+
+// callWithin calls serviceMethod, failing with ErrCallTimeout if the call does
+// not complete within timeout.  The reply is decoded into a copy of reply,
+// which is only copied into reply if the call completes in time, so that a late
+// response cannot change reply after callWithin has returned.
+func (p *Plugin) callWithin(serviceMethod string, args interface{}, reply interface{}, timeout time.Duration) error {
+	rv := reflect.ValueOf(reply)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return p.client.Call(serviceMethod, args, reply)
+	}
+	fresh := reflect.New(rv.Type().Elem())
+	if p.codec != nil {
+		p.codec.aliasReply(fresh.Interface(), reply)
+		defer p.codec.unaliasReply(fresh.Interface())
+	}
+	call := p.client.Go(serviceMethod, args, fresh.Interface(), make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			return call.Error
+		}
+		rv.Elem().Set(fresh.Elem())
+		return nil
+	case <-time.After(timeout):
+		return ErrCallTimeout
+	}
+}
@@ -0,0 +1,76 @@
+package pie
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeoutsCall(t *testing.T) {
+	p, err := StartPlugin(ioutil.Discard, os.Args[0], helperArgs("provider"),
+		WithTimeouts(Timeouts{Call: 50 * time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if err := p.Call("helper.Block", 0, new(int)); err != ErrCallTimeout {
+		t.Errorf("Expected ErrCallTimeout from a blocked call, got %v", err)
+	}
+	var value string
+	if err := p.Call("helper.Getenv", "HOME", &value); err != nil {
+		t.Fatalf("Unexpected error from a quick call: %v", err)
+	}
+	if value != os.Getenv("HOME") {
+		t.Errorf("Expected reply %q, got %q", os.Getenv("HOME"), value)
+	}
+}
+
+func TestTimeoutsReady(t *testing.T) {
+	p, err := StartPlugin(ioutil.Discard, os.Args[0], helperArgs("provider"),
+		WithTimeouts(Timeouts{Ready: 5 * time.Second}))
+	if err != nil {
+		t.Fatalf("Unexpected error starting a responsive plugin: %v", err)
+	}
+	p.Close()
+
+	_, err = StartPlugin(ioutil.Discard, os.Args[0], helperArgs("deaf"),
+		WithTimeouts(Timeouts{Ready: 100 * time.Millisecond, Stop: 10 * time.Millisecond}))
+	if err == nil {
+		t.Error("Expected an error starting a plugin that never answers")
+	}
+}
+
+func TestTimeoutsKeepalive(t *testing.T) {
+	p, err := StartPlugin(ioutil.Discard, os.Args[0], helperArgs("deaf"),
+		WithTimeouts(Timeouts{Keepalive: 50 * time.Millisecond, Stop: 10 * time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-p.Exited():
+	case <-time.After(5 * time.Second):
+		p.Close()
+		t.Fatal("Keepalive did not close a plugin that stopped answering")
+	}
+	if s := p.State(); s != StateFailed {
+		t.Errorf("Expected a plugin closed by keepalive to be %s, got %s", StateFailed, s)
+	}
+}
+
+func TestServerTimeoutsCall(t *testing.T) {
+	s := NewProvider()
+	api := ctxAPI{started: make(chan struct{}), cancelled: make(chan error, 1)}
+	if err := s.RegisterName("ctx", api); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetTimeouts(Timeouts{Call: 20 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	client := servePipe(t, s, nil, nil)
+	err := client.Call("ctx.Wait", 0, new(int))
+	if err == nil || !strings.Contains(err.Error(), "deadline exceeded") {
+		t.Errorf("Expected a deadline error, got %v", err)
+	}
+}
@@ -0,0 +1,225 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ValidationStage is a step of validating a plugin with Manager.Validate.
+type ValidationStage int
+
+const (
+	// ValidateResolve finds the plugin's binary: it downloads it from its
+	// URL or installs it from the Manager's Catalog if it has no Path, and
+	// checks its digest and version.
+	ValidateResolve ValidationStage = iota
+	// ValidatePreflight checks the binary with Preflight.
+	ValidatePreflight
+	// ValidateStart starts the plugin, which performs every handshake its
+	// options ask for, such as API version and marshaler negotiation, and
+	// waits for it to become ready.
+	ValidateStart
+	// ValidateIntrospect asks the running plugin for its build information
+	// and Manifest.
+	ValidateIntrospect
+	// ValidateStop stops the plugin.
+	ValidateStop
+)
+
+var validationStageNames = [...]string{
+	ValidateResolve:    "resolve",
+	ValidatePreflight:  "preflight",
+	ValidateStart:      "start",
+	ValidateIntrospect: "introspect",
+	ValidateStop:       "stop",
+}
+
+// String returns the name of the stage.
+func (s ValidationStage) String() string {
+	if s >= 0 && int(s) < len(validationStageNames) {
+		return validationStageNames[s]
+	}
+	return fmt.Sprintf("ValidationStage(%d)", int(s))
+}
+
+// ValidationReport is the result of Manager.Validate.
+type ValidationReport struct {
+	// Plugins are the results for each of the Manager's Plugins, in order.
+	Plugins []PluginValidation
+	// Profiles holds an error for each of the Manager's Profiles that names
+	// plugins it does not have.
+	Profiles map[string]error
+}
+
+// PluginValidation is the result of validating one plugin.
+type PluginValidation struct {
+	Name string
+	// Path is the plugin's binary, once it has been resolved.
+	Path string
+	// Version is the version of the plugin's binary, as given in its spec or
+	// by the Catalog it was installed from.
+	Version string
+	// Build is the build information the plugin reported.
+	Build BuildInfo
+	// APIVersion is the API version negotiated with the plugin, if its
+	// options ask for one with WithAPIVersions.
+	APIVersion string
+	// Manifest describes the plugin's API.  It is nil for plugins that cannot
+	// describe it.
+	Manifest *Manifest
+	// Stage is the last stage reached: the stage that failed if Err is not
+	// nil, and ValidateStop otherwise.
+	Stage ValidationStage
+	// Err is why the plugin failed validation, if it did.
+	Err error
+	// Duration is how long validating the plugin took.
+	Duration time.Duration
+}
+
+// OK reports whether every plugin and profile passed validation.
+func (r *ValidationReport) OK() bool {
+	return r.Err() == nil
+}
+
+// Err returns the reasons validation failed, joined with errors.Join, or nil
+// if it passed.
+func (r *ValidationReport) Err() error {
+	var errs []error
+	for _, p := range r.Plugins {
+		if p.Err != nil {
+			errs = append(errs, fmt.Errorf("plugin %s: %s: %w", p.Name, p.Stage, p.Err))
+		}
+	}
+	names := make([]string, 0, len(r.Profiles))
+	for name := range r.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		errs = append(errs, r.Profiles[name])
+	}
+	return errors.Join(errs...)
+}
+
+// Validate checks that the Manager's Plugins could be run, without serving
+// any traffic, for gating deployments: it resolves each plugin's binary,
+// verifying its digest, checks it with Preflight, starts it with its options,
+// which performs the handshakes they ask for, fetches its build information
+// and Manifest, and stops it.  It also checks that the Manager's Profiles only
+// name its Plugins.  The plugins are validated concurrently, in instances of
+// their own, and do not affect plugins the Manager is running.  The returned
+// error is the report's Err.
+func (m *Manager) Validate(ctx context.Context) (*ValidationReport, error) {
+	report := &ValidationReport{Plugins: make([]PluginValidation, len(m.Plugins))}
+	var wg sync.WaitGroup
+	for i, spec := range m.Plugins {
+		wg.Add(1)
+		go func(i int, spec PluginSpec) {
+			defer wg.Done()
+			report.Plugins[i] = m.validate(ctx, spec)
+		}(i, spec)
+	}
+	wg.Wait()
+	for name := range m.Profiles {
+		if _, err := m.Profile(name); err != nil {
+			if report.Profiles == nil {
+				report.Profiles = map[string]error{}
+			}
+			report.Profiles[name] = err
+		}
+	}
+	return report, report.Err()
+}
+
+// validate validates the plugin described by spec.
+func (m *Manager) validate(ctx context.Context, spec PluginSpec) (v PluginValidation) {
+	start := time.Now()
+	v = PluginValidation{Name: spec.Name, Stage: ValidateResolve}
+	defer func() { v.Duration = time.Since(start) }()
+	if spec.Name == "" {
+		v.Err = errors.New("plugin spec has no name")
+		return v
+	}
+	spec, v.Err = m.locate(ctx, spec)
+	if v.Err != nil {
+		return v
+	}
+	v.Path, v.Version = spec.Path, spec.Version
+	if v.Err = checkSpecVersion(spec); v.Err != nil {
+		return v
+	}
+	if spec.SHA256 != "" {
+		if v.Err = checkDigest(spec.Path, spec.SHA256); v.Err != nil {
+			return v
+		}
+	}
+
+	v.Stage = ValidatePreflight
+	if v.Err = Preflight(spec.Path); v.Err != nil {
+		return v
+	}
+
+	v.Stage = ValidateStart
+	p, err := StartPluginContext(ctx, spec.Output, spec.Path, spec.Args, spec.Options...)
+	if err != nil {
+		v.Err = err
+		return v
+	}
+	v.APIVersion = p.APIVersion()
+
+	v.Stage = ValidateIntrospect
+	if v.Build, err = p.BuildInfo(); err == nil {
+		v.Manifest, err = p.Manifest()
+		if _, old := err.(rpc.ServerError); old {
+			// Plugins that cannot describe their API are still valid.
+			err = nil
+		}
+	}
+	if err != nil {
+		p.Close()
+		v.Err = err
+		return v
+	}
+
+	v.Stage = ValidateStop
+	v.Err = p.Close()
+	return v
+}
+
+// checkSpecVersion checks that the version of the plugin described by spec,
+// if known, meets its constraint.
+func checkSpecVersion(spec PluginSpec) error {
+	if spec.Version == "" || spec.Constraint == "" {
+		return nil
+	}
+	c, err := ParseConstraint(spec.Constraint)
+	if err != nil {
+		return err
+	}
+	v, err := ParseVersion(spec.Version)
+	if err != nil {
+		return err
+	}
+	if !c.Check(v) {
+		return fmt.Errorf("version %s does not satisfy %s", spec.Version, spec.Constraint)
+	}
+	return nil
+}
+
+// checkDigest checks that the file at path has the given digest, in the form
+// accepted by Fetcher.Fetch.
+func checkDigest(path, digest string) error {
+	sum, err := parseDigest(digest)
+	if err != nil {
+		return err
+	}
+	if actual := fileDigest(path); actual != sum {
+		return fmt.Errorf("%s has digest sha256:%s, expected sha256:%s", path, actual, sum)
+	}
+	return nil
+}
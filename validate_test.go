@@ -0,0 +1,117 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestManagerValidate(t *testing.T) {
+	good := helperSpec("good", "versioned")
+	good.SHA256 = "sha256:" + fileDigest(os.Args[0])
+	good.Options = []StartOption{WithAPIVersions("2.0")}
+	m := &Manager{
+		Plugins: []PluginSpec{good},
+		Profiles: map[string]Profile{
+			"ci": {Plugins: []string{"good"}},
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	report, err := m.Validate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || len(report.Plugins) != 1 {
+		t.Fatalf("Expected one valid plugin, got %+v", report)
+	}
+	v := report.Plugins[0]
+	if v.Name != "good" || v.Path != os.Args[0] || v.Stage != ValidateStop || v.Duration <= 0 {
+		t.Errorf("Wrong result %+v", v)
+	}
+	if v.Build != CurrentBuildInfo() {
+		t.Errorf("Expected the plugin's build info %+v, got %+v", CurrentBuildInfo(), v.Build)
+	}
+	if v.APIVersion == "" {
+		t.Error("Expected an API version to be negotiated")
+	}
+	if v.Manifest == nil || len(v.Manifest.Methods) == 0 {
+		t.Errorf("Expected the plugin's manifest, got %+v", v.Manifest)
+	}
+	// Validation leaves nothing running.
+	if _, err := m.Supervisor("good"); !errors.Is(err, ErrUnknownPlugin) {
+		t.Errorf("Expected no plugin to be running, got %v", err)
+	}
+}
+
+func TestManagerValidateFailures(t *testing.T) {
+	dir := t.TempDir()
+	notExec := filepath.Join(dir, "plugin")
+	if err := os.WriteFile(notExec, []byte("#!/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	digest := helperSpec("digest", "provider")
+	digest.SHA256 = strings.Repeat("0", 64)
+	old := helperSpec("old", "provider")
+	old.Version, old.Constraint = "1.0.0", ">= 2.0"
+	m := &Manager{
+		Plugins: []PluginSpec{
+			helperSpec("good", "provider"),
+			digest,
+			old,
+			{Name: "noexec", Path: notExec},
+			helperSpec("exits", "exit"),
+			{Name: "nowhere"},
+		},
+		Profiles: map[string]Profile{
+			"typo": {Plugins: []string{"goood"}},
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	report, err := m.Validate(ctx)
+	if err == nil || report.OK() {
+		t.Fatal("Expected validation to fail")
+	}
+	want := map[string]ValidationStage{
+		"digest":  ValidateResolve,
+		"old":     ValidateResolve,
+		"noexec":  ValidatePreflight,
+		"exits":   ValidateStart,
+		"nowhere": ValidateResolve,
+	}
+	for _, v := range report.Plugins {
+		stage, fails := want[v.Name]
+		switch {
+		case !fails && v.Err != nil:
+			t.Errorf("Expected plugin %s to pass, got %v", v.Name, v.Err)
+		case fails && v.Err == nil:
+			t.Errorf("Expected plugin %s to fail", v.Name)
+		case fails && v.Stage != stage:
+			t.Errorf("Expected plugin %s to fail at %s, got %s: %v", v.Name, stage, v.Stage, v.Err)
+		}
+	}
+	var perr *PreflightError
+	if !errors.As(err, &perr) {
+		t.Errorf("Expected the error to include the preflight failure, got %v", err)
+	}
+	if !errors.Is(report.Profiles["typo"], ErrUnknownPlugin) {
+		t.Errorf("Expected the profile to be reported, got %v", report.Profiles)
+	}
+	if !strings.Contains(err.Error(), "plugin exits: start:") {
+		t.Errorf("Expected the error to name the plugin and stage, got %q", err)
+	}
+}
+
+func TestValidationStageString(t *testing.T) {
+	if s := ValidatePreflight.String(); s != "preflight" {
+		t.Errorf("Expected preflight, got %q", s)
+	}
+	if s := ValidationStage(42).String(); s != "ValidationStage(42)" {
+		t.Errorf("Expected ValidationStage(42), got %q", s)
+	}
+}
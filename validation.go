@@ -0,0 +1,196 @@
+package pie
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// A provider sends the errors of its argument validators in a form the host
+// parses back into an *InvalidArgumentError, with each violation's field and
+// description quoted:
+//
+//	pie: invalid argument to api.Resize: "width": "must be positive"; "format": "unknown format"
+//
+// A violation without a field has only its description.
+
+const invalidArgumentPrefix = "pie: invalid argument to "
+
+// ArgValidator checks the argument of a call to method, in "Service.Method"
+// form, before the method runs.  It returns an error to fail the call without
+// running the method: an *InvalidArgumentError to describe what is wrong with
+// which fields, or any other error to describe the argument as a whole.
+type ArgValidator func(method string, args interface{}) error
+
+// FieldViolation describes what is wrong with one field of an argument.
+type FieldViolation struct {
+	// Field names the field, such as "width" or "options.size".  It is empty
+	// if the violation concerns the argument as a whole.
+	Field string
+	// Description says what is wrong, such as "must be positive".
+	Description string
+}
+
+// InvalidArgumentError is returned by calls whose argument failed the
+// provider's validation, set with Server.SetValidator.
+type InvalidArgumentError struct {
+	// Method is the method that was called.  Validators may leave it empty;
+	// the Server fills it in.
+	Method string
+	// Violations are what is wrong with the argument.
+	Violations []FieldViolation
+}
+
+// Add records a violation of field.
+func (e *InvalidArgumentError) Add(field, description string) {
+	e.Violations = append(e.Violations, FieldViolation{Field: field, Description: description})
+}
+
+// Err returns e if it records any violations, and nil otherwise, so that a
+// validator can add violations as it finds them and return e.Err().
+func (e *InvalidArgumentError) Err() error {
+	if len(e.Violations) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Error implements the error interface.
+func (e *InvalidArgumentError) Error() string {
+	parts := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		parts[i] = strconv.Quote(v.Description)
+		if v.Field != "" {
+			parts[i] = strconv.Quote(v.Field) + ": " + parts[i]
+		}
+	}
+	return invalidArgumentPrefix + e.Method + ": " + strings.Join(parts, "; ")
+}
+
+// Unwrap returns the error as the rpc.ServerError it was sent as, so that
+// code checking for server errors keeps working.
+func (e *InvalidArgumentError) Unwrap() error {
+	return rpc.ServerError(e.Error())
+}
+
+// SetValidator makes the Server check the arguments of calls to the methods
+// of service with v before running them.  Calls that fail validation return
+// an *InvalidArgumentError to the caller.  Passing a nil validator removes it.
+func (s Server) SetValidator(service string, v ArgValidator) error {
+	if s.d == nil {
+		return errors.New("pie: server cannot be configured")
+	}
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	if !s.d.services[service] {
+		return fmt.Errorf("pie: cannot validate arguments of %s: no such service", service)
+	}
+	if v == nil {
+		delete(s.d.validators, service)
+		return nil
+	}
+	if s.d.validators == nil {
+		s.d.validators = map[string]ArgValidator{}
+	}
+	s.d.validators[service] = v
+	return nil
+}
+
+// Validatable is implemented by arguments that can check themselves, for use
+// with ValidateArgs.
+type Validatable interface {
+	Validate() error
+}
+
+// ValidateArgs is an ArgValidator that calls the Validate method of arguments
+// that implement Validatable, on a value or a pointer receiver.  Arguments
+// that do not are valid.
+func ValidateArgs(_ string, args interface{}) error {
+	if v, ok := args.(Validatable); ok {
+		return v.Validate()
+	}
+	rv := reflect.ValueOf(args)
+	if !rv.IsValid() {
+		return nil
+	}
+	ptr := reflect.New(rv.Type())
+	ptr.Elem().Set(rv)
+	if v, ok := ptr.Interface().(Validatable); ok {
+		return v.Validate()
+	}
+	return nil
+}
+
+// validator returns the argument validator for serviceMethod, if any.
+func (d *dispatcher) validator(serviceMethod string) ArgValidator {
+	service, _, _ := splitServiceMethod(serviceMethod)
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.validators[service]
+}
+
+// validate checks arg, the argument of a call to serviceMethod, with v, and
+// returns the error to send if it is invalid.
+func validate(v ArgValidator, serviceMethod string, arg interface{}) error {
+	err := v(serviceMethod, arg)
+	if err == nil {
+		return nil
+	}
+	var iae *InvalidArgumentError
+	if errors.As(err, &iae) {
+		e := *iae
+		e.Method = serviceMethod
+		if len(e.Violations) == 0 {
+			e.Add("", "invalid argument")
+		}
+		return &e
+	}
+	return &InvalidArgumentError{Method: serviceMethod, Violations: []FieldViolation{{Description: err.Error()}}}
+}
+
+// invalidArgument returns err as an *InvalidArgumentError if it is the error
+// a provider fails calls with invalid arguments with, and err otherwise.
+func invalidArgument(err error) error {
+	serr, ok := err.(rpc.ServerError)
+	if !ok {
+		return err
+	}
+	rest, ok := strings.CutPrefix(string(serr), invalidArgumentPrefix)
+	if !ok {
+		return err
+	}
+	method, rest, ok := strings.Cut(rest, ": ")
+	if !ok {
+		return err
+	}
+	e := &InvalidArgumentError{Method: method}
+	for {
+		first, err := strconv.QuotedPrefix(rest)
+		if err != nil {
+			return serr
+		}
+		rest = rest[len(first):]
+		var v FieldViolation
+		v.Description, _ = strconv.Unquote(first)
+		if strings.HasPrefix(rest, ": ") {
+			desc, err := strconv.QuotedPrefix(rest[2:])
+			if err != nil {
+				return serr
+			}
+			rest = rest[2+len(desc):]
+			v.Field = v.Description
+			v.Description, _ = strconv.Unquote(desc)
+		}
+		e.Violations = append(e.Violations, v)
+		if rest == "" {
+			return e
+		}
+		if !strings.HasPrefix(rest, "; ") {
+			return serr
+		}
+		rest = rest[2:]
+	}
+}
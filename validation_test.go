@@ -0,0 +1,124 @@
+package pie
+
+import (
+	"errors"
+	"net/rpc"
+	"reflect"
+	"testing"
+)
+
+// ResizeArgs is the argument of resizer.Resize.
+type ResizeArgs struct {
+	Width, Height int
+}
+
+// Validate implements Validatable.
+func (a *ResizeArgs) Validate() error {
+	var e InvalidArgumentError
+	if a.Width <= 0 {
+		e.Add("width", "must be positive")
+	}
+	if a.Height > 4096 {
+		e.Add("height", "must be at most 4096")
+	}
+	return e.Err()
+}
+
+type resizer struct{}
+
+func (resizer) Resize(args ResizeArgs, area *int) error {
+	*area = args.Width * args.Height
+	return nil
+}
+
+// validatedServer returns a provider serving resizer and api, with v
+// validating resizer.
+func validatedServer(t *testing.T, v ArgValidator) Server {
+	s := NewProvider()
+	s.RegisterName("resizer", resizer{})
+	s.RegisterName("api", api{})
+	if err := s.SetValidator("resizer", v); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestValidateArgs(t *testing.T) {
+	p := pipePlugin(t, validatedServer(t, ValidateArgs))
+	var area int
+	if err := p.Call("resizer.Resize", ResizeArgs{Width: 2, Height: 3}, &area); err != nil {
+		t.Fatal(err)
+	}
+	if area != 6 {
+		t.Errorf("Expected area 6, got %d", area)
+	}
+	err := p.Call("resizer.Resize", ResizeArgs{Width: 0, Height: 5000}, &area)
+	var iae *InvalidArgumentError
+	if !errors.As(err, &iae) {
+		t.Fatalf("Expected an InvalidArgumentError, got %v", err)
+	}
+	want := &InvalidArgumentError{Method: "resizer.Resize", Violations: []FieldViolation{
+		{Field: "width", Description: "must be positive"},
+		{Field: "height", Description: "must be at most 4096"},
+	}}
+	if !reflect.DeepEqual(iae, want) {
+		t.Errorf("Expected %+v, got %+v", want, iae)
+	}
+	if msg := `pie: invalid argument to resizer.Resize: "width": "must be positive"; "height": "must be at most 4096"`; err.Error() != msg {
+		t.Errorf("Expected %q, got %q", msg, err.Error())
+	}
+	var serr rpc.ServerError
+	if !errors.As(err, &serr) {
+		t.Error("Expected the error to unwrap to an rpc.ServerError")
+	}
+	// Other services are not validated.
+	var reply string
+	if err := p.Call("api.SayHi", "bob", &reply); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidatorPlainError(t *testing.T) {
+	var called string
+	p := pipePlugin(t, validatedServer(t, func(method string, args interface{}) error {
+		called = method
+		if args.(ResizeArgs).Width == 13 {
+			return errors.New("unlucky: \"13\"; try again")
+		}
+		return nil
+	}))
+	err := p.Call("resizer.Resize", ResizeArgs{Width: 13}, new(int))
+	var iae *InvalidArgumentError
+	if !errors.As(err, &iae) {
+		t.Fatalf("Expected an InvalidArgumentError, got %v", err)
+	}
+	if len(iae.Violations) != 1 || iae.Violations[0] != (FieldViolation{Description: "unlucky: \"13\"; try again"}) {
+		t.Errorf("Wrong violations %+v", iae.Violations)
+	}
+	if called != "resizer.Resize" {
+		t.Errorf("Expected the validator to be told the method, got %q", called)
+	}
+}
+
+func TestSetValidatorErrors(t *testing.T) {
+	s := NewProviderConn(nil)
+	if err := s.SetValidator("missing", ValidateArgs); err == nil {
+		t.Error("Expected an error validating an unknown service")
+	}
+	if err := (Server{}).SetValidator("api", ValidateArgs); err == nil {
+		t.Error("Expected an error from a server that cannot be configured")
+	}
+}
+
+func TestInvalidArgumentParse(t *testing.T) {
+	for _, msg := range []string{
+		"pie: invalid argument to api.X: garbage",
+		`pie: invalid argument to api.X: "a": "b" "c"`,
+		"pie: invalid argument to api.X",
+		"something else",
+	} {
+		if got := invalidArgument(rpc.ServerError(msg)); got != rpc.ServerError(msg) {
+			t.Errorf("Expected %q to be kept, got %#v", msg, got)
+		}
+	}
+}
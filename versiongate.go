@@ -0,0 +1,196 @@
+package pie
+
+import "errors"
+
+// A provider whose host requirement is not met refuses calls to its own
+// services from the host, and says why in its reply to the host's build
+// information.  Hosts that wait for the plugin to become ready send it right
+// after the handshake.  Others send it once a call fails, as it may have been
+// refused because the provider did not know the host's version, and make the
+// call again if the provider then admits the host.
+
+// unknownVersion is how a VersionRequirementError reads a version that is not
+// known.
+const unknownVersion = "unknown"
+
+// VersionRequirementError is returned when the host or the plugin requires a
+// version of the other that it is not running, as set with
+// WithRequiredPluginVersion and Server.SetRequiredHostVersion.
+type VersionRequirementError struct {
+	// Requirer is the side whose requirement was not met, "host" or
+	// "plugin".
+	Requirer string
+	// Constraint is the requirement, such as ">= 1.2".
+	Constraint string
+	// Version is the version of the other side, as reported in its
+	// BuildInfo, or empty if it is not known.
+	Version string
+}
+
+// Error implements the error interface.
+func (e *VersionRequirementError) Error() string {
+	other := "host"
+	if e.Requirer == "host" {
+		other = "plugin"
+	}
+	v := e.Version
+	if v == "" {
+		v = unknownVersion
+	}
+	return "pie: " + e.Requirer + " requires " + other + " version " + e.Constraint + "; " + other + " version is " + v
+}
+
+// SetBuildVersion sets the version reported as the BuildInfo.Version of the
+// running binary, in place of the module version recorded by the go command,
+// which is "(devel)" for binaries not built from a tagged module version.  It
+// lets applications built from source stamp their own version, for example
+// from a variable set with -ldflags.  It must be called before any plugin is
+// started or served.
+func SetBuildVersion(v string) {
+	CurrentBuildInfo()
+	buildInfoMu.Lock()
+	defer buildInfoMu.Unlock()
+	buildInfo.Version = v
+}
+
+// versionMeets reports whether v, a version reported in a BuildInfo, meets
+// the constraint c.
+func versionMeets(v string, c Constraint) bool {
+	pv, err := ParseVersion(v)
+	return err == nil && c.Check(pv)
+}
+
+// WithRequiredPluginVersion makes StartPlugin check that the plugin's version,
+// as reported in its BuildInfo, meets constraint, such as ">= 1.4", and stop
+// the plugin with a *VersionRequirementError if it does not or is not known.
+// The plugin must have been created by a version of this package that reports
+// its build information.
+func WithRequiredPluginVersion(constraint string) StartOption {
+	return func(o *startOptions) {
+		o.pluginVersion = constraint
+	}
+}
+
+// checkPluginVersion checks that the plugin's version meets constraint.
+func (p *Plugin) checkPluginVersion(constraint string) error {
+	c, err := ParseConstraint(constraint)
+	if err != nil {
+		return err
+	}
+	info, err := p.BuildInfo()
+	if err != nil {
+		return err
+	}
+	if !versionMeets(info.Version, c) {
+		return &VersionRequirementError{Requirer: "host", Constraint: constraint, Version: info.Version}
+	}
+	return nil
+}
+
+// SetRequiredHostVersion makes the Server refuse calls to its services from a
+// host whose version, as reported in its BuildInfo, does not meet constraint,
+// such as ">= 2.1".  Such a host fails to start the plugin with a
+// *VersionRequirementError if it waits for the plugin to become ready, as
+// StartPluginContext does, and its calls fail with it otherwise.  Hosts that
+// cannot report their version, because they were built with a version of
+// this package that does not, are refused.  An empty constraint removes the
+// requirement.  It should be called before the Server serves; calls refused
+// because the requirement was set later fail with the requirement's error
+// text, not a *VersionRequirementError.
+func (s Server) SetRequiredHostVersion(constraint string) error {
+	if s.d == nil {
+		return errors.New("pie: server cannot be configured")
+	}
+	var c Constraint
+	if constraint != "" {
+		var err error
+		if c, err = ParseConstraint(constraint); err != nil {
+			return err
+		}
+	}
+	s.d.regMu.Lock()
+	defer s.d.regMu.Unlock()
+	s.d.hostReq = c
+	s.d.hostReqText = constraint
+	s.d.checkHostLocked()
+	return nil
+}
+
+// setHostBuild records the build information sent by the host.
+func (d *dispatcher) setHostBuild(b BuildInfo) {
+	d.regMu.Lock()
+	defer d.regMu.Unlock()
+	d.hostBuild = &b
+	d.checkHostLocked()
+}
+
+// checkHostLocked checks the host's version against the requirement, with
+// d.regMu held, and records the result for hostError.
+func (d *dispatcher) checkHostLocked() {
+	var err *VersionRequirementError
+	switch {
+	case d.hostReqText == "":
+	case d.hostBuild == nil:
+		err = &VersionRequirementError{Requirer: "plugin", Constraint: d.hostReqText}
+	case !versionMeets(d.hostBuild.Version, d.hostReq):
+		err = &VersionRequirementError{Requirer: "plugin", Constraint: d.hostReqText, Version: d.hostBuild.Version}
+		if err.Version == "" {
+			err.Version = "(none)"
+		}
+	}
+	d.hostErr.Store(err)
+}
+
+// hostError returns the error calls from the host are refused with, or nil if
+// they may be served.
+func (d *dispatcher) hostError() *VersionRequirementError {
+	return d.hostErr.Load()
+}
+
+// send makes a call to the plugin, through serviceMethod with its metadata.
+// If it fails before build information has been exchanged, it is exchanged,
+// and the call fails with the plugin's *VersionRequirementError if the plugin
+// refuses the host, or is made again if the plugin refused it only because it
+// did not know the host's version.
+func (p *Plugin) send(serviceMethod string, args interface{}, reply interface{}) error {
+	err := p.sendOnce(serviceMethod, args, reply)
+	if !isServerError(err) {
+		return err
+	}
+	retry, refused := p.admit()
+	if refused != nil {
+		return refused
+	}
+	if retry {
+		return p.sendOnce(serviceMethod, args, reply)
+	}
+	return err
+}
+
+// admit exchanges build information with the plugin after a call failed, if
+// it has not been exchanged, and reports whether the plugin refused the call
+// only because it did not know the host's version.  If the plugin refuses the
+// host, admit returns why.  If the exchange fails, the call's error stands.
+func (p *Plugin) admit() (retry bool, refused error) {
+	p.buildMu.Lock()
+	defer p.buildMu.Unlock()
+	if p.buildInfo != nil {
+		return false, nil
+	}
+	reply, err := p.exchangeLater()
+	if err != nil {
+		return false, nil
+	}
+	if reply.Refused != nil {
+		return false, reply.Refused
+	}
+	return reply.Admitted, nil
+}
+
+// sendOnce makes a call to the plugin, with the handle's call timeout.
+func (p *Plugin) sendOnce(serviceMethod string, args interface{}, reply interface{}) error {
+	if p.callTimeout > 0 {
+		return p.callWithin(serviceMethod, args, reply, p.callTimeout)
+	}
+	return p.client.Call(serviceMethod, args, reply)
+}
@@ -0,0 +1,174 @@
+package pie
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+// withBuildVersion sets the version of the test binary for the rest of the
+// test.
+func withBuildVersion(t *testing.T, v string) {
+	old := CurrentBuildInfo().Version
+	SetBuildVersion(v)
+	t.Cleanup(func() { SetBuildVersion(old) })
+}
+
+// gatedProvider serves api on a provider with the given host requirement,
+// and returns a plugin handle connected to it with opts.
+func gatedProvider(t *testing.T, hostReq string, opts ...StartOption) (*Plugin, Server, error) {
+	serverConn, clientConn := net.Pipe()
+	s := NewProviderConn(serverConn)
+	s.RegisterName("api", api{})
+	if hostReq != "" {
+		if err := s.SetRequiredHostVersion(hostReq); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go s.Serve()
+	t.Cleanup(func() { s.Close() })
+	p, err := NewPlugin(clientConn, opts...)
+	if err == nil {
+		t.Cleanup(func() { p.Close() })
+	}
+	return p, s, err
+}
+
+func TestRequiredHostVersionMet(t *testing.T) {
+	withBuildVersion(t, "v1.4.0")
+	p, s, err := gatedProvider(t, ">= 1.2, < 2.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The provider does not know the host's version until the first call is
+	// refused, and the host sends it.
+	var reply string
+	if err := p.Call("api.SayHi", "bob", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "Hi bob" {
+		t.Errorf("Expected %q, got %q", "Hi bob", reply)
+	}
+	if got := s.HostBuildInfo().Version; got != "v1.4.0" {
+		t.Errorf("Expected the provider to know the host's version, got %q", got)
+	}
+}
+
+func TestRequiredHostVersionUnmet(t *testing.T) {
+	withBuildVersion(t, "v2.1.0")
+	p, _, err := gatedProvider(t, ">= 1.2, < 2.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply string
+	err = p.Call("api.SayHi", "bob", &reply)
+	var vre *VersionRequirementError
+	if !errors.As(err, &vre) {
+		t.Fatalf("Expected a VersionRequirementError, got %v", err)
+	}
+	want := VersionRequirementError{Requirer: "plugin", Constraint: ">= 1.2, < 2.0", Version: "v2.1.0"}
+	if *vre != want {
+		t.Errorf("Expected %+v, got %+v", want, *vre)
+	}
+	if msg := "pie: plugin requires host version >= 1.2, < 2.0; host version is v2.1.0"; err.Error() != msg {
+		t.Errorf("Expected %q, got %q", msg, err.Error())
+	}
+	// The control API is still served.
+	if err := p.Ping(); err != nil {
+		t.Errorf("Expected ping to work, got %v", err)
+	}
+}
+
+func TestRequiredHostVersionUnmetAtStart(t *testing.T) {
+	withBuildVersion(t, "v2.1.0")
+	_, _, err := gatedProvider(t, ">= 1.2, < 2.0", WithTimeouts(Timeouts{Ready: 5 * time.Second}))
+	var vre *VersionRequirementError
+	if !errors.As(err, &vre) {
+		t.Fatalf("Expected a VersionRequirementError starting the plugin, got %v", err)
+	}
+	want := VersionRequirementError{Requirer: "plugin", Constraint: ">= 1.2, < 2.0", Version: "v2.1.0"}
+	if *vre != want {
+		t.Errorf("Expected %+v, got %+v", want, *vre)
+	}
+}
+
+func TestRequiredHostVersionNotSemver(t *testing.T) {
+	withBuildVersion(t, "(devel)")
+	p, _, err := gatedProvider(t, ">= 1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply string
+	err = p.Call("api.SayHi", "bob", &reply)
+	var vre *VersionRequirementError
+	if !errors.As(err, &vre) || vre.Version != "(devel)" {
+		t.Fatalf("Expected a VersionRequirementError for (devel), got %v", err)
+	}
+}
+
+func TestSetRequiredHostVersionRemoved(t *testing.T) {
+	withBuildVersion(t, "v0.1.0")
+	p, s, err := gatedProvider(t, ">= 1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetRequiredHostVersion(""); err != nil {
+		t.Fatal(err)
+	}
+	var reply string
+	if err := p.Call("api.SayHi", "bob", &reply); err != nil {
+		t.Fatal(err)
+	}
+	// A requirement set once the host is served refuses its calls too.
+	if err := s.SetRequiredHostVersion(">= 1.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Call("api.SayHi", "bob", &reply); err == nil {
+		t.Error("Expected the call to be refused")
+	}
+}
+
+func TestSetRequiredHostVersionBadConstraint(t *testing.T) {
+	if err := NewProviderConn(nil).SetRequiredHostVersion(">= one"); err == nil {
+		t.Error("Expected an error for a bad constraint")
+	}
+	if err := (Server{}).SetRequiredHostVersion(">= 1.0"); err == nil {
+		t.Error("Expected an error from a server that cannot be configured")
+	}
+}
+
+func TestRequiredPluginVersion(t *testing.T) {
+	withBuildVersion(t, "v1.3.0")
+	if _, _, err := gatedProvider(t, "", WithRequiredPluginVersion(">= 1.3, < 1.4")); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := gatedProvider(t, "", WithRequiredPluginVersion(">= 1.4"))
+	var vre *VersionRequirementError
+	if !errors.As(err, &vre) {
+		t.Fatalf("Expected a VersionRequirementError, got %v", err)
+	}
+	want := VersionRequirementError{Requirer: "host", Constraint: ">= 1.4", Version: "v1.3.0"}
+	if *vre != want {
+		t.Errorf("Expected %+v, got %+v", want, *vre)
+	}
+	if msg := "pie: host requires plugin version >= 1.4; plugin version is v1.3.0"; err.Error() != msg {
+		t.Errorf("Expected %q, got %q", msg, err.Error())
+	}
+}
+
+func TestRequiredPluginVersionOldPlugin(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	s := rpc.NewServer()
+	s.RegisterName("api", api{})
+	go s.ServeConn(serverConn)
+	_, err := NewPlugin(clientConn, WithRequiredPluginVersion(">= 1.0"))
+	var vre *VersionRequirementError
+	if !errors.As(err, &vre) || vre.Version != "" {
+		t.Fatalf("Expected a VersionRequirementError for an unknown version, got %v", err)
+	}
+	if msg := "pie: host requires plugin version >= 1.0; plugin version is unknown"; err.Error() != msg {
+		t.Errorf("Expected %q, got %q", msg, err.Error())
+	}
+}
@@ -0,0 +1,40 @@
+package pie
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Well-known vsock context IDs.  A context ID (CID) identifies a virtual
+// machine, or the host, the way an IP address identifies a machine on a
+// network.
+const (
+	// VsockLocalCID addresses the local machine over the vsock loopback
+	// transport, which is mostly useful for testing.
+	VsockLocalCID uint32 = 1
+	// VsockHostCID addresses the host from inside a virtual machine.
+	VsockHostCID uint32 = 2
+	// VsockAnyCID, when listening, accepts connections addressed to any of
+	// the machine's CIDs.
+	VsockAnyCID uint32 = 0xFFFFFFFF
+)
+
+// ErrVsockUnsupported is returned by DialVsock and ListenVsock on platforms,
+// or kernels, that do not support vsock.
+var ErrVsockUnsupported = errors.New("vsock is not supported on this system")
+
+// VsockAddr is the address of a vsock endpoint.
+type VsockAddr struct {
+	CID  uint32
+	Port uint32
+}
+
+// Network returns "vsock".
+func (a VsockAddr) Network() string {
+	return "vsock"
+}
+
+// String returns the address in the form "cid:port".
+func (a VsockAddr) String() string {
+	return fmt.Sprintf("%d:%d", a.CID, a.Port)
+}
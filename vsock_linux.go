@@ -0,0 +1,186 @@
+//go:build linux && (amd64 || arm64)
+
+package pie
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// afVsock is AF_VSOCK, which package syscall does not define.
+const afVsock = 40
+
+// rawSockaddrVM is the kernel's struct sockaddr_vm.
+type rawSockaddrVM struct {
+	Family    uint16
+	Reserved1 uint16
+	Port      uint32
+	CID       uint32
+	Flags     uint8
+	Zero      [3]uint8
+}
+
+// DialVsock connects to the vsock port of the machine with the given context
+// ID, such as a plugin listening inside a virtual machine.  The connection can
+// be passed to NewPlugin, or served from with NewProviderConn.
+func DialVsock(cid, port uint32) (net.Conn, error) {
+	fd, err := vsockSocket()
+	if err != nil {
+		return nil, err
+	}
+	sa := rawSockaddrVM{Family: afVsock, CID: cid, Port: port}
+	for {
+		err = sockaddrCall(syscall.SYS_CONNECT, fd, &sa)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return nil, &net.OpError{Op: "dial", Net: "vsock", Addr: VsockAddr{cid, port}, Err: os.NewSyscallError("connect", err)}
+	}
+	local, err := vsockName(fd)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return newVsockConn(fd, local, VsockAddr{cid, port})
+}
+
+// ListenVsock listens for vsock connections on the given port, addressed to
+// any of the machine's context IDs.
+func ListenVsock(port uint32) (net.Listener, error) {
+	fd, err := vsockSocket()
+	if err != nil {
+		return nil, err
+	}
+	sa := rawSockaddrVM{Family: afVsock, CID: VsockAnyCID, Port: port}
+	if err := sockaddrCall(syscall.SYS_BIND, fd, &sa); err != nil {
+		syscall.Close(fd)
+		return nil, &net.OpError{Op: "listen", Net: "vsock", Addr: VsockAddr{VsockAnyCID, port}, Err: os.NewSyscallError("bind", err)}
+	}
+	if err := syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("listen", err)
+	}
+	addr, err := vsockName(fd)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setnonblock", err)
+	}
+	return &vsockListener{f: os.NewFile(uintptr(fd), "vsock:"+addr.String()), addr: addr}, nil
+}
+
+// vsockSocket opens a vsock stream socket.
+func vsockSocket() (int, error) {
+	fd, err := syscall.Socket(afVsock, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err == syscall.EAFNOSUPPORT {
+		return -1, ErrVsockUnsupported
+	}
+	if err != nil {
+		return -1, os.NewSyscallError("socket", err)
+	}
+	return fd, nil
+}
+
+// sockaddrCall makes a system call, such as bind or connect, that takes a
+// socket and its address.
+func sockaddrCall(trap uintptr, fd int, sa *rawSockaddrVM) error {
+	_, _, errno := syscall.Syscall(trap, uintptr(fd), uintptr(unsafe.Pointer(sa)), unsafe.Sizeof(*sa))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// vsockName returns the local address of a vsock socket.
+func vsockName(fd int) (VsockAddr, error) {
+	var sa rawSockaddrVM
+	n := uint32(unsafe.Sizeof(sa))
+	_, _, errno := syscall.Syscall(syscall.SYS_GETSOCKNAME, uintptr(fd), uintptr(unsafe.Pointer(&sa)), uintptr(unsafe.Pointer(&n)))
+	if errno != 0 {
+		return VsockAddr{}, os.NewSyscallError("getsockname", errno)
+	}
+	return VsockAddr{CID: sa.CID, Port: sa.Port}, nil
+}
+
+// newVsockConn makes a net.Conn of a connected vsock socket.
+func newVsockConn(fd int, local, remote VsockAddr) (net.Conn, error) {
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setnonblock", err)
+	}
+	f := os.NewFile(uintptr(fd), "vsock:"+remote.String())
+	return &vsockConn{File: f, local: local, remote: remote}, nil
+}
+
+// vsockConn is a vsock connection.  The runtime's poller serves its reads,
+// writes, and deadlines through the embedded os.File.
+type vsockConn struct {
+	*os.File
+	local, remote VsockAddr
+}
+
+// LocalAddr returns the local address of the connection.
+func (c *vsockConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr returns the address of the other end of the connection.
+func (c *vsockConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// vsockListener is a net.Listener for vsock connections.
+type vsockListener struct {
+	f    *os.File
+	addr VsockAddr
+}
+
+// Accept waits for and returns the next connection to the listener.
+func (l *vsockListener) Accept() (net.Conn, error) {
+	rc, err := l.f.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var nfd int
+	var sa rawSockaddrVM
+	var acceptErr error
+	err = rc.Read(func(fd uintptr) bool {
+		n := uint32(unsafe.Sizeof(sa))
+		r, _, errno := syscall.Syscall6(syscall.SYS_ACCEPT4, fd, uintptr(unsafe.Pointer(&sa)), uintptr(unsafe.Pointer(&n)), syscall.SOCK_CLOEXEC, 0, 0)
+		switch errno {
+		case syscall.EAGAIN, syscall.EINTR:
+			return false
+		case 0:
+			nfd = int(r)
+		default:
+			acceptErr = errno
+		}
+		return true
+	})
+	if err == nil {
+		err = acceptErr
+	}
+	if err != nil {
+		return nil, &net.OpError{Op: "accept", Net: "vsock", Addr: l.addr, Err: fmt.Errorf("accept: %w", err)}
+	}
+	return newVsockConn(nfd, l.addr, VsockAddr{CID: sa.CID, Port: sa.Port})
+}
+
+// Close stops listening.  Blocked calls to Accept fail.
+func (l *vsockListener) Close() error {
+	return l.f.Close()
+}
+
+// Addr returns the listener's address.
+func (l *vsockListener) Addr() net.Addr {
+	return l.addr
+}
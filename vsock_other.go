@@ -0,0 +1,17 @@
+//go:build !linux || !(amd64 || arm64)
+
+package pie
+
+import "net"
+
+// DialVsock connects to the vsock port of the machine with the given context
+// ID.  It is not supported on this platform.
+func DialVsock(cid, port uint32) (net.Conn, error) {
+	return nil, ErrVsockUnsupported
+}
+
+// ListenVsock listens for vsock connections on the given port.  It is not
+// supported on this platform.
+func ListenVsock(port uint32) (net.Listener, error) {
+	return nil, ErrVsockUnsupported
+}
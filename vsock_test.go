@@ -0,0 +1,56 @@
+package pie
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestVsock(t *testing.T) {
+	l, err := ListenVsock(0xFFFFFFFF)
+	if errors.Is(err, ErrVsockUnsupported) {
+		t.Skip("vsock is not supported on this system")
+	}
+	if err != nil {
+		t.Skipf("Cannot listen on vsock: %v", err)
+	}
+	defer l.Close()
+	port := l.Addr().(VsockAddr).Port
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			accepted <- err
+			return
+		}
+		accepted <- nil
+		s := NewProviderConn(conn)
+		s.RegisterName("api", api{})
+		s.Serve()
+	}()
+	conn, err := DialVsock(VsockLocalCID, port)
+	if err != nil {
+		t.Skipf("Cannot dial vsock loopback: %v", err)
+	}
+	if err := <-accepted; err != nil {
+		t.Fatalf("Unexpected error from Accept: %v", err)
+	}
+	p, err := NewPlugin(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	var response string
+	if err := p.Call("api.SayHi", "bob", &response); err != nil {
+		t.Fatalf("Unexpected error from Call: %#v", err)
+	}
+	if response != "Hi bob" {
+		t.Errorf("Wrong response from api call, expected %q, got %q", "Hi bob", response)
+	}
+}
+
+func TestVsockAddr(t *testing.T) {
+	a := VsockAddr{CID: 3, Port: 1024}
+	if a.Network() != "vsock" || a.String() != "3:1024" {
+		t.Errorf("Unexpected network %q and address %q", a.Network(), a.String())
+	}
+}
@@ -0,0 +1,81 @@
+package pie
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// WarmUpCall is a call made to a plugin as soon as it is ready, before the host
+// sends it any other calls, so that the first real call does not pay for
+// filling caches or compiling code.
+type WarmUpCall struct {
+	Method string
+	Args   interface{}
+	// Reply is a pointer to a value of the method's reply type.  The call
+	// decodes its reply into a new value of that type, which is discarded.
+	Reply interface{}
+}
+
+// WarmUpError is the error of a failed WarmUpCall.
+type WarmUpError struct {
+	Method string
+	Err    error
+}
+
+// Error implements the error interface.
+func (e *WarmUpError) Error() string {
+	return fmt.Sprintf("warm-up call to %s failed: %v", e.Method, e.Err)
+}
+
+// Unwrap returns the error of the call.
+func (e *WarmUpError) Unwrap() error {
+	return e.Err
+}
+
+// WithWarmUp makes the plugin handle make the given calls, in order, as soon as
+// the plugin is ready: when it has started, or for plugins started with
+// WithPhases, when it has been initialized.  A failed call stops the warm-up
+// but not the plugin; the failure is reported by Plugin.WarmUpErr, and by an
+// EventWarmUpFailed from the plugin's Supervisor.  Since StartOptions apply to
+// every instance a Supervisor starts, plugins are warmed up again after every
+// restart, before they take calls.
+func WithWarmUp(calls ...WarmUpCall) StartOption {
+	return func(o *startOptions) {
+		o.warmUp = append(o.warmUp, calls...)
+	}
+}
+
+// WarmUpErr returns the error of the plugin's failed warm-up call, as a
+// *WarmUpError, or nil if the warm-up succeeded or has not happened.
+func (p *Plugin) WarmUpErr() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.warmUpErr
+}
+
+// warm makes the plugin's warm-up calls, the first time it is called.  The
+// calls are made even though a plugin started with WithPhases is not serving
+// yet.
+func (p *Plugin) warm() {
+	p.warmOnce.Do(func() {
+		for _, c := range p.warmUp {
+			if err := p.warmUpCall(c); err != nil {
+				p.mu.Lock()
+				p.warmUpErr = &WarmUpError{Method: c.Method, Err: err}
+				p.mu.Unlock()
+				return
+			}
+		}
+	})
+}
+
+// warmUpCall makes the warm-up call c, decoding its reply into a new value of
+// the type c.Reply points to, so that the caller's value is never written.
+func (p *Plugin) warmUpCall(c WarmUpCall) error {
+	if c.Reply == nil || reflect.TypeOf(c.Reply).Kind() != reflect.Ptr {
+		return errors.New("pie: warm-up reply must be a pointer")
+	}
+	reply := reflect.New(reflect.TypeOf(c.Reply).Elem()).Interface()
+	return p.invoke(c.Method, callMeta{}, c.Args, reply)
+}
@@ -0,0 +1,108 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+)
+
+// warmAPI records the calls made to it.
+type warmAPI struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (a *warmAPI) Load(name string, _ *int) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.calls = append(a.calls, name)
+	return nil
+}
+
+func (a *warmAPI) Calls() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string(nil), a.calls...)
+}
+
+// warmServer returns a provider serving the returned warmAPI.
+func warmServer() (Server, *warmAPI) {
+	s := NewProvider()
+	api := &warmAPI{}
+	s.RegisterName("warm", api)
+	return s, api
+}
+
+func TestWithWarmUp(t *testing.T) {
+	s, api := warmServer()
+	p := pipePlugin(t, s, WithWarmUp(
+		WarmUpCall{Method: "warm.Load", Args: "model", Reply: new(int)},
+		WarmUpCall{Method: "warm.Load", Args: "cache", Reply: new(int)},
+	))
+	if err := p.WarmUpErr(); err != nil {
+		t.Fatal(err)
+	}
+	if got := api.Calls(); len(got) != 2 || got[0] != "model" || got[1] != "cache" {
+		t.Errorf("Expected warm-up calls for model and cache, got %v", got)
+	}
+}
+
+func TestWithWarmUpFailure(t *testing.T) {
+	s, api := warmServer()
+	p := pipePlugin(t, s, WithWarmUp(
+		WarmUpCall{Method: "warm.Missing", Args: 0, Reply: new(int)},
+		WarmUpCall{Method: "warm.Load", Args: "never", Reply: new(int)},
+	))
+	var werr *WarmUpError
+	if err := p.WarmUpErr(); !errors.As(err, &werr) || werr.Method != "warm.Missing" {
+		t.Fatalf("Expected a *WarmUpError for warm.Missing, got %v", err)
+	}
+	if !isMissingMethod(werr.Err) {
+		t.Errorf("Expected the missing method error, got %v", werr.Err)
+	}
+	if got := api.Calls(); len(got) != 0 {
+		t.Errorf("Expected the warm-up to stop at the failure, got calls %v", got)
+	}
+	// The plugin still works.
+	if err := p.Call("warm.Load", "x", new(int)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWithWarmUpPhases(t *testing.T) {
+	s, api := warmServer()
+	p := pipePlugin(t, s, WithPhases(), WithWarmUp(WarmUpCall{Method: "warm.Load", Args: "model", Reply: new(int)}))
+	if got := api.Calls(); len(got) != 0 {
+		t.Fatalf("Expected no warm-up before init, got %v", got)
+	}
+	if err := p.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := api.Calls(); len(got) != 1 {
+		t.Errorf("Expected a warm-up call after init, got %v", got)
+	}
+}
+
+func TestSupervisorWarmUpFailed(t *testing.T) {
+	events := newEventRecorder()
+	start := func() (*Plugin, error) {
+		return StartPlugin(os.Stderr, os.Args[0], helperArgs("provider"),
+			WithWarmUp(WarmUpCall{Method: "api.Missing", Args: 0, Reply: new(int)}))
+	}
+	s, err := Supervise(start, Policy{MaxRestarts: 1, OnEvent: events.record})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	e := events.waitFor(t, EventWarmUpFailed)
+	var werr *WarmUpError
+	if !errors.As(e.Err, &werr) || werr.Method != "api.Missing" {
+		t.Errorf("Expected a *WarmUpError for api.Missing, got %v", e.Err)
+	}
+	p, _ := s.Plugin()
+	p.proc.Kill()
+	events.waitFor(t, EventRestarted)
+	events.waitFor(t, EventWarmUpFailed)
+}
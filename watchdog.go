@@ -0,0 +1,138 @@
+package pie
+
+import (
+	"net/rpc"
+	"time"
+)
+
+// Watchdog detects plugins that are still running but have stopped doing
+// useful work, for example because of a deadlock.  A plugin is declared hung
+// when it misses too many consecutive heartbeats, or when a call made through
+// Plugin.Call has been in flight for too long.  Heartbeats use the built-in
+// control API served by providers created with NewProvider.
+//
+// A Watchdog is used by setting it as the Watchdog of a Supervisor's Policy.
+type Watchdog struct {
+	// Interval is the time between heartbeats.  It defaults to one second.
+	Interval time.Duration
+	// Timeout is how long to wait for a reply to a heartbeat before counting
+	// it as missed.  It defaults to Interval.
+	Timeout time.Duration
+	// MaxMisses is the number of consecutive missed heartbeats after which the
+	// plugin is declared hung.  It defaults to 3.
+	MaxMisses int
+	// StuckCall, if not zero, is how long a call may be in flight before the
+	// plugin is declared hung.
+	StuckCall time.Duration
+	// DumpStacks makes the watchdog send SIGQUIT to a hung plugin before it is
+	// killed, which makes plugins written in Go write the stacks of all their
+	// goroutines to stderr.  It has no effect on platforms without SIGQUIT.
+	DumpStacks bool
+	// DumpWait is how long to give the plugin to write its stacks after
+	// SIGQUIT is sent.  It defaults to one second.
+	DumpWait time.Duration
+}
+
+// HangReport describes why a Watchdog declared a plugin hung.
+type HangReport struct {
+	// MissedHeartbeats is the number of consecutive heartbeats the plugin
+	// failed to answer.
+	MissedHeartbeats int
+	// StuckCalls lists the calls that had been in flight for longer than the
+	// watchdog allows.
+	StuckCalls []StuckCall
+	// StacksDumped reports whether the plugin was sent SIGQUIT so it would
+	// write its goroutine stacks to stderr.
+	StacksDumped bool
+}
+
+// StuckCall describes a call that has been in flight for a long time.
+type StuckCall struct {
+	Method  string
+	Elapsed time.Duration
+}
+
+func (w *Watchdog) interval() time.Duration {
+	if w.Interval > 0 {
+		return w.Interval
+	}
+	return time.Second
+}
+
+func (w *Watchdog) timeout() time.Duration {
+	if w.Timeout > 0 {
+		return w.Timeout
+	}
+	return w.interval()
+}
+
+func (w *Watchdog) maxMisses() int {
+	if w.MaxMisses > 0 {
+		return w.MaxMisses
+	}
+	return 3
+}
+
+func (w *Watchdog) dumpWait() time.Duration {
+	if w.DumpWait > 0 {
+		return w.DumpWait
+	}
+	return time.Second
+}
+
+// watch checks on p until it is declared hung, in which case a report is sent
+// on hung, or until p exits or stop is closed.
+func (w *Watchdog) watch(p *Plugin, hung chan<- HangReport, stop <-chan struct{}) {
+	t := time.NewTicker(w.interval())
+	defer t.Stop()
+	misses := 0
+	for {
+		select {
+		case <-stop:
+			return
+		case <-p.Exited():
+			return
+		case <-t.C:
+		}
+		if w.heartbeat(p, stop) {
+			misses = 0
+		} else {
+			misses++
+		}
+		var stuck []StuckCall
+		if w.StuckCall > 0 {
+			stuck = p.stuckCalls(w.StuckCall)
+		}
+		if misses < w.maxMisses() && len(stuck) == 0 {
+			continue
+		}
+		hung <- HangReport{MissedHeartbeats: misses, StuckCalls: stuck}
+		return
+	}
+}
+
+// diagnose collects diagnostics from a hung plugin before it is killed,
+// recording what was collected in report.
+func (w *Watchdog) diagnose(p *Plugin, report *HangReport) {
+	if !w.DumpStacks || dumpStacks(p.proc) != nil {
+		return
+	}
+	report.StacksDumped = true
+	select {
+	case <-p.Exited():
+	case <-time.After(w.dumpWait()):
+	}
+}
+
+// heartbeat pings p, and reports whether it answered within the timeout.
+func (w *Watchdog) heartbeat(p *Plugin, stop <-chan struct{}) bool {
+	call := p.controlClient().Go(controlService+".Ping", 1, new(int), make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error == nil
+	case <-time.After(w.timeout()):
+		return false
+	case <-stop:
+		return true
+	}
+}
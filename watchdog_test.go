@@ -0,0 +1,75 @@
+package pie
+
+import (
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchdogMissedHeartbeats(t *testing.T) {
+	events := newEventRecorder()
+	s, err := Supervise(helperStarter("deaf"), Policy{
+		MaxRestarts: 1,
+		Watchdog:    &Watchdog{Interval: 10 * time.Millisecond, MaxMisses: 2},
+		OnEvent:     events.record,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error from Supervise: %#v", err)
+	}
+	defer s.Close()
+
+	e := events.waitFor(t, EventHung)
+	if e.Hang == nil {
+		t.Fatal("Unexpected nil HangReport in hung event")
+	}
+	if e.Hang.MissedHeartbeats != 2 {
+		t.Errorf("Wrong number of missed heartbeats, expected 2, got %d", e.Hang.MissedHeartbeats)
+	}
+	select {
+	case <-e.Plugin.Exited():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Hung plugin was not killed")
+	}
+	events.waitFor(t, EventRestarted)
+}
+
+func TestWatchdogStuckCall(t *testing.T) {
+	events := newEventRecorder()
+	output := &lockedBuffer{}
+	s, err := Supervise(func() (*Plugin, error) {
+		return StartPlugin(output, os.Args[0], helperArgs("provider"))
+	}, Policy{
+		Watchdog: &Watchdog{
+			Interval:   10 * time.Millisecond,
+			Timeout:    time.Second,
+			StuckCall:  20 * time.Millisecond,
+			DumpStacks: true,
+		},
+		OnEvent: events.record,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error from Supervise: %#v", err)
+	}
+	defer s.Close()
+
+	go s.Call("helper.Block", 0, new(int))
+	e := events.waitFor(t, EventHung)
+	if e.Hang.MissedHeartbeats != 0 {
+		t.Errorf("Unexpected missed heartbeats for responsive plugin: %d", e.Hang.MissedHeartbeats)
+	}
+	if len(e.Hang.StuckCalls) != 1 || e.Hang.StuckCalls[0].Method != "helper.Block" {
+		t.Fatalf("Expected helper.Block to be stuck, got %#v", e.Hang.StuckCalls)
+	}
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		return
+	}
+	if !e.Hang.StacksDumped {
+		t.Error("Expected stacks to be dumped")
+	}
+	events.waitFor(t, EventExited)
+	if out := output.String(); !strings.Contains(out, "goroutine") {
+		t.Errorf("Expected goroutine stacks in plugin output, got %q", out)
+	}
+}
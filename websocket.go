@@ -0,0 +1,445 @@
+package pie
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// webSocketGUID is the key suffix that RFC 6455 uses to compute
+// Sec-WebSocket-Accept.
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// webSocketProtocol is the subprotocol pie offers and accepts.
+const webSocketProtocol = "pie"
+
+// WebSocket frame opcodes.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// WebSocketServer is an http.Handler that serves a provider over each
+// WebSocket connection made to it, so that plugins can run behind HTTP
+// reverse proxies or serve hosts that can only speak HTTP, such as web-based
+// ones.  Hosts connect with DialWebSocket and NewPlugin.
+type WebSocketServer struct {
+	// Setup is called with the Server for each connection before it serves,
+	// to register the services it provides.  If it returns an error, the
+	// connection is closed.
+	Setup func(Server) error
+	// Codec, if not nil, returns the codec the Server serves with.  It
+	// defaults to gob encoding.
+	Codec func(io.ReadWriteCloser) rpc.ServerCodec
+	// CheckOrigin, if not nil, decides whether to accept a connection given
+	// its request.  By default, requests with an Origin header whose host does
+	// not match the request's Host are rejected, so that web pages cannot
+	// connect to the plugin from the user's browser.
+	CheckOrigin func(r *http.Request) bool
+}
+
+// ServeHTTP upgrades the request to a WebSocket connection and serves a
+// provider over it until the connection is closed.
+func (ws *WebSocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	check := ws.CheckOrigin
+	if check == nil {
+		check = sameOrigin
+	}
+	if !check(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	conn, err := UpgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	s := NewProviderConn(conn)
+	if ws.Setup != nil {
+		if err := ws.Setup(s); err != nil {
+			conn.Close()
+			return
+		}
+	}
+	if ws.Codec != nil {
+		s.ServeCodec(ws.Codec)
+	} else {
+		s.Serve()
+	}
+}
+
+// sameOrigin reports whether r has no Origin header, or one whose host matches
+// r's Host.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// UpgradeWebSocket performs the server side of the WebSocket handshake on r,
+// and returns the connection, over which each Write is sent as a binary
+// message.  If r is not a valid WebSocket handshake, UpgradeWebSocket replies
+// to it with an HTTP error and returns an error.  It does not check the
+// request's origin.
+func UpgradeWebSocket(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	switch {
+	case r.Method != http.MethodGet:
+		return nil, webSocketError(w, http.StatusMethodNotAllowed, "method must be GET")
+	case !headerHasToken(r.Header, "Connection", "upgrade"), !headerHasToken(r.Header, "Upgrade", "websocket"):
+		return nil, webSocketError(w, http.StatusBadRequest, "not a websocket handshake")
+	case r.Header.Get("Sec-WebSocket-Version") != "13":
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, webSocketError(w, http.StatusUpgradeRequired, "unsupported websocket version")
+	case key == "":
+		return nil, webSocketError(w, http.StatusBadRequest, "missing Sec-WebSocket-Key")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, webSocketError(w, http.StatusInternalServerError, "connection cannot be hijacked")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n"
+	if headerHasToken(r.Header, "Sec-WebSocket-Protocol", webSocketProtocol) {
+		resp += "Sec-WebSocket-Protocol: " + webSocketProtocol + "\r\n"
+	}
+	if _, err := brw.WriteString(resp + "\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{Conn: conn, br: brw.Reader}, nil
+}
+
+// webSocketError replies to a failed handshake, and returns the matching error.
+func webSocketError(w http.ResponseWriter, code int, msg string) error {
+	http.Error(w, msg, code)
+	return errors.New("websocket: " + msg)
+}
+
+// WebSocketDialer connects to plugins served by a WebSocketServer.
+type WebSocketDialer struct {
+	// TLSConfig is used for wss URLs.  If nil, the default configuration is
+	// used.
+	TLSConfig *tls.Config
+	// Header holds extra headers to send with the handshake, such as
+	// Authorization.
+	Header http.Header
+}
+
+// DialWebSocket connects to the WebSocket at rawurl, which must have a ws or
+// wss scheme, using a zero WebSocketDialer.
+func DialWebSocket(ctx context.Context, rawurl string) (net.Conn, error) {
+	var d WebSocketDialer
+	return d.DialContext(ctx, rawurl)
+}
+
+// DialContext connects to the WebSocket at rawurl, which must have a ws or wss
+// scheme.  The connection can be passed to NewPlugin.  Each Write on it is
+// sent as a binary message.
+func (d *WebSocketDialer) DialContext(ctx context.Context, rawurl string) (net.Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		switch u.Scheme {
+		case "ws":
+			host = net.JoinHostPort(u.Hostname(), "80")
+		case "wss":
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+	}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ws":
+		var nd net.Dialer
+		conn, err = nd.DialContext(ctx, "tcp", host)
+	case "wss":
+		cfg := d.TLSConfig.Clone()
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+		td := tls.Dialer{Config: cfg}
+		conn, err = td.DialContext(ctx, "tcp", host)
+	default:
+		return nil, fmt.Errorf("websocket: unsupported URL scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	ws, err := d.handshake(conn, u)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+// handshake performs the client side of the WebSocket handshake over conn.
+func (d *WebSocketDialer) handshake(conn net.Conn, u *url.URL) (net.Conn, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Host:       u.Host,
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+	for k, v := range d.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Protocol", webSocketProtocol)
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body.Close()
+		return nil, fmt.Errorf("websocket: handshake failed: %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		return nil, errors.New("websocket: handshake failed: bad Sec-WebSocket-Accept")
+	}
+	return &wsConn{Conn: conn, br: br, client: true}, nil
+}
+
+// webSocketAccept returns the Sec-WebSocket-Accept value for key.
+func webSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerHasToken reports whether the comma separated list in header name
+// contains token, ignoring case.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn is a WebSocket connection that carries a byte stream: each Write is
+// sent as a binary message, and Read returns the payloads of the data
+// messages received in order, answering pings and close frames along the way.
+type wsConn struct {
+	net.Conn
+	br *bufio.Reader
+	// client is true for the client end, which must mask its frames.
+	client bool
+
+	rmu       sync.Mutex
+	remaining uint64
+	mask      [4]byte
+	masked    bool
+	maskPos   int
+	closed    bool
+
+	wmu       sync.Mutex
+	closeOnce sync.Once
+}
+
+// Read reads the payload of the current data message, moving on to the next
+// message as each is exhausted.  It returns io.EOF once the peer sends a close
+// frame.
+func (c *wsConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for c.remaining == 0 {
+		if c.closed {
+			return 0, io.EOF
+		}
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.br.Read(p)
+	c.remaining -= uint64(n)
+	if c.masked {
+		for i := range p[:n] {
+			p[i] ^= c.mask[c.maskPos%4]
+			c.maskPos++
+		}
+	}
+	return n, err
+}
+
+// nextFrame reads the next frame header, handling control frames itself.  On
+// return, remaining is the length of the payload of the data frame read.
+func (c *wsConn) nextFrame() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		return err
+	}
+	op := hdr[0] & 0x0F
+	masked := hdr[1]&0x80 != 0
+	length := uint64(hdr[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+			return err
+		}
+	}
+	switch op {
+	case wsContinuation, wsText, wsBinary:
+		c.remaining, c.mask, c.masked, c.maskPos = length, mask, masked, 0
+		return nil
+	case wsClose, wsPing, wsPong:
+		if length > 125 {
+			return errors.New("websocket: control frame too long")
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return err
+		}
+		if masked {
+			for i := range payload {
+				payload[i] ^= mask[i%4]
+			}
+		}
+		switch op {
+		case wsPing:
+			return c.writeFrame(wsPong, payload)
+		case wsClose:
+			c.closed = true
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			c.closeOnce.Do(func() { c.writeFrame(wsClose, payload) })
+		}
+		return nil
+	default:
+		return fmt.Errorf("websocket: unknown opcode %#x", op)
+	}
+}
+
+// Write sends p as a single binary message.
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeFrame writes a final frame with the given opcode and payload, masking
+// it if this is the client end.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	hdr := make([]byte, 2, 14)
+	hdr[0] = 0x80 | op
+	switch n := len(payload); {
+	case n < 126:
+		hdr[1] = byte(n)
+	case n <= 0xFFFF:
+		hdr[1] = 126
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(n))
+	default:
+		hdr[1] = 127
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+	}
+	var mask [4]byte
+	if c.client {
+		hdr[1] |= 0x80
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		hdr = append(hdr, mask[:]...)
+	}
+	frame := GetBuffer(len(hdr) + len(payload))
+	defer PutBuffer(frame)
+	copy(frame, hdr)
+	body := frame[len(hdr):]
+	copy(body, payload)
+	if c.client {
+		for i := range body {
+			body[i] ^= mask[i%4]
+		}
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if _, err := c.Conn.Write(frame); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Close sends a normal closure frame, if one has not been sent, and closes the
+// connection.
+func (c *wsConn) Close() error {
+	c.closeOnce.Do(func() { c.writeFrame(wsClose, []byte{0x03, 0xE8}) })
+	return c.Conn.Close()
+}
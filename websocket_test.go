@@ -0,0 +1,91 @@
+package pie
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// webSocketURL returns the ws or wss URL of a test server.
+func webSocketURL(srv *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// newWebSocketServer returns a test server that serves api over WebSockets.
+func newWebSocketServer(tls bool) *httptest.Server {
+	ws := &WebSocketServer{Setup: func(s Server) error {
+		return s.RegisterName("api", api{})
+	}}
+	if tls {
+		return httptest.NewTLSServer(ws)
+	}
+	return httptest.NewServer(ws)
+}
+
+// testWebSocketPlugin checks that a plugin served by srv can be called.
+func testWebSocketPlugin(t *testing.T, srv *httptest.Server, d *WebSocketDialer) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := d.DialContext(ctx, webSocketURL(srv))
+	if err != nil {
+		t.Fatalf("Unexpected error from DialContext: %v", err)
+	}
+	p, err := NewPluginContext(ctx, conn)
+	if err != nil {
+		t.Fatalf("Unexpected error from NewPluginContext: %v", err)
+	}
+	defer p.Close()
+	// Long enough to need a 64 bit frame length.
+	name := strings.Repeat("bob", 30000)
+	var response string
+	if err := p.Call("api.SayHi", name, &response); err != nil {
+		t.Fatalf("Unexpected error from Call: %#v", err)
+	}
+	if response != "Hi "+name {
+		t.Errorf("Wrong response from api call, got %d bytes", len(response))
+	}
+	if err := p.Call("api.SayHi", "bob", &response); err != nil {
+		t.Fatalf("Unexpected error from Call: %#v", err)
+	}
+	if response != "Hi bob" {
+		t.Errorf("Wrong response from api call, expected %q, got %q", "Hi bob", response)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	srv := newWebSocketServer(false)
+	defer srv.Close()
+	testWebSocketPlugin(t, srv, &WebSocketDialer{})
+}
+
+func TestWebSocketTLS(t *testing.T) {
+	srv := newWebSocketServer(true)
+	defer srv.Close()
+	cfg := srv.Client().Transport.(*http.Transport).TLSClientConfig
+	testWebSocketPlugin(t, srv, &WebSocketDialer{TLSConfig: cfg})
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	srv := newWebSocketServer(false)
+	defer srv.Close()
+	d := &WebSocketDialer{Header: http.Header{"Origin": {"http://evil.example"}}}
+	if _, err := d.DialContext(context.Background(), webSocketURL(srv)); err == nil {
+		t.Error("Expected an error connecting from another origin")
+	}
+}
+
+func TestWebSocketNotUpgrade(t *testing.T) {
+	srv := newWebSocketServer(false)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status %d for a plain request, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
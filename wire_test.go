@@ -0,0 +1,354 @@
+package pie
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden wire fixtures in testdata/wire")
+
+// The fixtures in testdata/wire hold the bytes pie puts on the wire.  The
+// tests check that what pie writes still matches them, and that it can still
+// read them, so that a change to framing or encoding that would break hosts
+// and plugins built with older versions of this package is caught.  Run the
+// tests with -update to rewrite the fixtures after a deliberate change.
+
+// golden compares got to the named fixture, or rewrites the fixture if -update
+// is set.
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", "wire", name)
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want := readFixture(t, name)
+	if !bytes.Equal(got, want) {
+		t.Errorf("Wire format of %s changed:\nexpected %q\ngot      %q", name, want, got)
+	}
+}
+
+// readFixture returns the contents of the named fixture.
+func readFixture(t testing.TB, name string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", "wire", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// framePayloads are the payloads written to the frame fixtures: data, a
+// keepalive, and more data.
+var framePayloads = [][]byte{[]byte("hello"), {}, []byte("world")}
+
+func TestGoldenFrames(t *testing.T) {
+	for name, format := range map[string]FrameFormat{
+		"frames_plain.golden": PlainFrames,
+		"frames_crc32.golden": ChecksummedFrames,
+	} {
+		var buf bytes.Buffer
+		enc := NewFrameEncoder(&buf, format)
+		for _, p := range framePayloads {
+			if err := enc.Encode(p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		golden(t, name, buf.Bytes())
+
+		dec := NewFrameDecoder(bytes.NewReader(readFixture(t, name)))
+		for i, want := range framePayloads {
+			got, err := dec.Decode()
+			if err != nil {
+				t.Fatalf("%s: decoding frame %d: %v", name, i, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s: frame %d: expected %q, got %q", name, i, want, got)
+			}
+		}
+		if _, err := dec.Decode(); err != io.EOF {
+			t.Errorf("%s: expected io.EOF after the last frame, got %v", name, err)
+		}
+	}
+}
+
+func TestFrameDecoderErrors(t *testing.T) {
+	var buf bytes.Buffer
+	NewFrameEncoder(&buf, ChecksummedFrames).Encode([]byte("hello"))
+	frame := buf.Bytes()
+
+	corrupt := append([]byte{}, frame...)
+	corrupt[len(corrupt)-1] ^= 1
+	_, err := NewFrameDecoder(bytes.NewReader(corrupt)).Decode()
+	if _, ok := err.(*CorruptFrameError); !ok {
+		t.Errorf("Expected a *CorruptFrameError for a corrupt frame, got %v", err)
+	}
+	_, err = NewFrameDecoder(bytes.NewReader(frame[:len(frame)-1])).Decode()
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF for a truncated frame, got %v", err)
+	}
+	_, err = NewFrameDecoder(bytes.NewReader([]byte("oops"))).Decode()
+	if _, ok := err.(*StrayOutputError); !ok {
+		t.Errorf("Expected a *StrayOutputError for data between frames, got %v", err)
+	}
+}
+
+// recordConn records what is written to it.  Reads block until it is closed.
+type recordConn struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newRecordConn() *recordConn {
+	return &recordConn{closed: make(chan struct{})}
+}
+
+func (c *recordConn) Read(p []byte) (int, error) {
+	<-c.closed
+	return 0, io.EOF
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buf.Write(p)
+}
+
+func (c *recordConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *recordConn) Bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte{}, c.buf.Bytes()...)
+}
+
+// fixtureConn is a connection that reads from r and discards what is written
+// to it.
+type fixtureConn struct {
+	io.Reader
+}
+
+func (fixtureConn) Write(p []byte) (int, error) { return len(p), nil }
+func (fixtureConn) Close() error                { return nil }
+
+func TestGoldenMux(t *testing.T) {
+	conn := newRecordConn()
+	m := NewMux(conn, true)
+	defer m.Close()
+	s, err := m.Open(RPCChannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	golden(t, "mux.golden", conn.Bytes())
+
+	sm := NewMux(fixtureConn{bytes.NewReader(readFixture(t, "mux.golden"))}, false)
+	defer sm.Close()
+	st, err := sm.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Name() != RPCChannel {
+		t.Errorf("Expected stream %q, got %q", RPCChannel, st.Name())
+	}
+	data, err := io.ReadAll(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hi" {
+		t.Errorf("Expected %q, got %q", "hi", data)
+	}
+}
+
+// Gob assigns type IDs per process, so gob's encoding depends on what else the
+// process has encoded, and only reading the gob fixtures is checked.
+
+func TestGoldenGobCall(t *testing.T) {
+	if *update {
+		conn := newRecordConn()
+		c := newGobClientCodec(conn)
+		if err := c.WriteRequest(&rpc.Request{ServiceMethod: "api.SayHi", Seq: 1}, "bob"); err != nil {
+			t.Fatal(err)
+		}
+		golden(t, "gob_call.golden", conn.Bytes())
+	}
+	c := newGobServerCodec(fixtureConn{bytes.NewReader(readFixture(t, "gob_call.golden"))})
+	var req rpc.Request
+	if err := c.ReadRequestHeader(&req); err != nil {
+		t.Fatal(err)
+	}
+	var arg string
+	if err := c.ReadRequestBody(&arg); err != nil {
+		t.Fatal(err)
+	}
+	if req.ServiceMethod != "api.SayHi" || req.Seq != 1 || arg != "bob" {
+		t.Errorf("Expected call of api.SayHi(%q) with seq 1, got %s(%q) with seq %d", "bob", req.ServiceMethod, arg, req.Seq)
+	}
+}
+
+func TestGoldenGobReply(t *testing.T) {
+	if *update {
+		conn := newRecordConn()
+		c := newGobServerCodec(conn)
+		if err := c.WriteResponse(&rpc.Response{ServiceMethod: "api.SayHi", Seq: 1}, "Hi bob"); err != nil {
+			t.Fatal(err)
+		}
+		golden(t, "gob_reply.golden", conn.Bytes())
+	}
+	c := newGobClientCodec(fixtureConn{bytes.NewReader(readFixture(t, "gob_reply.golden"))})
+	var resp rpc.Response
+	if err := c.ReadResponseHeader(&resp); err != nil {
+		t.Fatal(err)
+	}
+	var reply string
+	if err := c.ReadResponseBody(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ServiceMethod != "api.SayHi" || resp.Seq != 1 || resp.Error != "" || reply != "Hi bob" {
+		t.Errorf("Expected reply %q to api.SayHi with seq 1, got %+v with reply %q", "Hi bob", resp, reply)
+	}
+}
+
+func TestGoldenJSONCall(t *testing.T) {
+	var out bytes.Buffer
+	conn := struct {
+		io.Reader
+		io.Writer
+		io.Closer
+	}{bytes.NewReader(readFixture(t, "json_call.golden")), &out, io.NopCloser(nil)}
+	s := NewProviderConn(conn)
+	s.RegisterName("api", api{})
+	s.ServeCodec(NewJSONServerCodec)
+	golden(t, "json_reply.golden", out.Bytes())
+}
+
+// FuzzFrameDecoder checks that decoding untrusted input fails cleanly, and
+// that what decodes survives a round trip.
+func FuzzFrameDecoder(f *testing.F) {
+	for _, name := range []string{"frames_plain.golden", "frames_crc32.golden"} {
+		f.Add(readFixture(f, name))
+	}
+	f.Add([]byte("stray\x1bPIE\x00\x00\x00\x01x"))
+	f.Add([]byte("\x1bPIC\xff\xff\xff\xff\x00\x00\x00\x00"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var payloads [][]byte
+		dec := NewFrameDecoder(bytes.NewReader(data))
+		for {
+			p, err := dec.Decode()
+			if err != nil {
+				break
+			}
+			payloads = append(payloads, p)
+		}
+		var buf bytes.Buffer
+		enc := NewFrameEncoder(&buf, ChecksummedFrames)
+		for _, p := range payloads {
+			if err := enc.Encode(p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		dec = NewFrameDecoder(&buf)
+		for i, want := range payloads {
+			got, err := dec.Decode()
+			if err != nil {
+				t.Fatalf("Decoding re-encoded frame %d: %v", i, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("Re-encoded frame %d: expected %q, got %q", i, want, got)
+			}
+		}
+	})
+}
+
+// FuzzFramedConn checks that a handle's reader copes with whatever a plugin
+// writes to its stdout.
+func FuzzFramedConn(f *testing.F) {
+	for _, name := range []string{"frames_plain.golden", "frames_crc32.golden"} {
+		f.Add(readFixture(f, name))
+	}
+	f.Add([]byte("debug output\n\x1bPIE\x00\x00\x00\x02hi"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		c := newFramedConn(fixtureConn{bytes.NewReader(data)}, framing{onStray: func([]byte) {}})
+		defer c.Close()
+		n, err := io.Copy(io.Discard, c)
+		if n > int64(len(data)) {
+			t.Fatalf("Read %d payload bytes from %d bytes of input", n, len(data))
+		}
+		if err == nil {
+			return
+		}
+		var corrupt *CorruptFrameError
+		if !errors.As(err, &corrupt) && err != io.ErrUnexpectedEOF {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	})
+}
+
+// FuzzMux checks that a Mux fails cleanly on malformed frames.
+func FuzzMux(f *testing.F) {
+	f.Add(readFixture(f, "mux.golden"))
+	f.Add([]byte("\x00\x00\x00\x01\x01\xff\xff\xff\xff"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m := NewMux(fixtureConn{bytes.NewReader(data)}, false)
+		defer m.Close()
+		for {
+			s, err := m.Accept()
+			if err != nil {
+				break
+			}
+			io.Copy(io.Discard, s)
+			s.Close()
+		}
+		if m.Err() == nil {
+			t.Fatal("Expected the Mux to fail at the end of its input")
+		}
+	})
+}
+
+// FuzzServeJSON checks that a provider copes with malformed requests from an
+// untrusted host, including malformed call metadata.
+func FuzzServeJSON(f *testing.F) {
+	f.Add(readFixture(f, "json_call.golden"))
+	f.Add([]byte(`{"method":"api.SayHi?key=a&idem=b&group=c&cap=d","params":["bob"],"id":1}`))
+	f.Add([]byte(`{"method":"api.SayHi?notify=1","params":[1],"id":null}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		s := NewProviderConn(fixtureConn{bytes.NewReader(data)})
+		s.RegisterName("api", api{})
+		s.ServeCodec(NewJSONServerCodec)
+	})
+}
+
+// FuzzSplitMeta checks that call metadata survives a round trip.
+func FuzzSplitMeta(f *testing.F) {
+	f.Add("api.SayHi")
+	f.Add("api.SayHi?notify=1&key=a&group=g&cap=t&idem=i")
+	f.Add("api.SayHi?key=%zz;x")
+	f.Fuzz(func(t *testing.T, serviceMethod string) {
+		name, meta := splitMeta(serviceMethod)
+		name2, meta2 := splitMeta(meta.encode(name))
+		meta2.present = meta.present
+		if name2 != name || meta2 != meta {
+			t.Fatalf("%q: split into %q %+v, which round trips to %q %+v", serviceMethod, name, meta, name2, meta2)
+		}
+	})
+}